@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/app"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// auditOptions are the command line options for working with the audit log.
+type auditOptions struct {
+	verify bool
+	export string
+	query  bool
+	user   string
+	action string
+	since  string
+	limit  int
+}
+
+func (ao *auditOptions) requested() bool {
+	return ao.verify || ao.export != "" || ao.query
+}
+
+// runAudit verifies, exports or queries the audit log, in that order.
+func runAudit(ao *auditOptions, out io.Writer) error {
+	aud, err := app.AuditLog()
+	if err != nil {
+		return err
+	}
+
+	if ao.verify {
+		n, err := aud.Verify()
+		var chainErr *models.AuditChainError
+		if errors.As(err, &chainErr) {
+			return fmt.Errorf("%w (%d events were fine before it)", err, n)
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "audit log OK: %d events verified\n", n)
+	}
+
+	if ao.export != "" {
+		w := out
+		if ao.export != "-" {
+			f, err := os.OpenFile(ao.export, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		enc := json.NewEncoder(w)
+		if err := aud.ForEach(func(e *models.AuditEvent) error { return enc.Encode(e) }); err != nil {
+			return err
+		}
+	}
+
+	if ao.query {
+		q := models.AuditQuery{UserID: ao.user, Action: ao.action, Limit: ao.limit}
+		if ao.since != "" {
+			d, err := time.ParseDuration(ao.since)
+			if err != nil {
+				return fmt.Errorf("-audit-since should be a duration like 24h: %w", err)
+			}
+			q.Since = time.Now().Add(-d)
+		}
+		events, err := aud.Query(q)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tACTION\tACTOR\tTARGET\tIP\tDETAILS")
+		for _, e := range events {
+			var details []string
+			for k, v := range e.Details {
+				details = append(details, k+"="+v)
+			}
+			sort.Strings(details)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Action,
+				e.ActorID, e.TargetID, e.IP, strings.Join(details, " "))
+		}
+		return tw.Flush()
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"os/signal"
@@ -14,6 +15,12 @@ import (
 
 	"github.com/boltdb/bolt"
 	"github.com/ejamesc/auth_demo/internal/app"
+	"github.com/ejamesc/auth_demo/internal/blob"
+	"github.com/ejamesc/auth_demo/internal/ldap"
+	"github.com/ejamesc/auth_demo/internal/mail"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/password"
+	"github.com/ejamesc/auth_demo/internal/saml"
 	"github.com/sirupsen/logrus"
 )
 
@@ -29,6 +36,40 @@ The options are:`)
 	staticFilePath := flag.String("s", "", "static directory path - the full path of the static assets directory (required)")
 	templatesPath := flag.String("t", "", "template directory path - the full path of the templates directory. All templates should be have the .html format. (required)")
 	boltdbpath := flag.String("d", "", "boldb directory path")
+	minPassLen := flag.Int("min-password-length", 10, "minimum number of characters in a password")
+	minPassStrength := flag.Int("min-password-strength", 2, "minimum password strength score, from 0 (anything goes) to 4 (very strong)")
+	smtpAddr := flag.String("smtp", "", "SMTP server address (host:port) to send email through. Emails are logged if this isn't set")
+	mailFrom := flag.String("mail-from", "noreply@localhost", "address emails are sent from")
+	breachedPath := flag.String("breached-passwords", "", "path to a file of breached password SHA-1 hashes, one per line, in the Pwned Passwords format")
+	grantAdmin := flag.String("grant-admin", "", "make the user with this email an admin, then exit")
+	signupMode := flag.String("signup-mode", "open", "who can sign up: open, closed, invite (only with a signup invite) or domains (only emails at -signup-domains, or with an invite)")
+	signupDomains := flag.String("signup-domains", "", "comma separated email domains anyone can sign up with in the domains signup mode, e.g. example.com")
+	newInvite := flag.Int("create-signup-invite", 0, "create a signup invite that can be used this many times, print its link, then exit")
+	reindex := flag.Bool("search-reindex", false, "build the search index again from every todo and comment, then exit")
+	samlMetadata := flag.String("saml-idp-metadata", "", "path to a SAML IdP's metadata, to let users log in through it")
+	samlURL := flag.String("saml-url", "http://localhost:8085", "the URL the site is reached at, which SAML metadata and the assertion consumer service are under")
+	samlLinkByEmail := flag.Bool("saml-link-by-email", false, "link SAML users to the existing account with their email when they first log in. Only use it if the IdP checks emails")
+	samlIdPInitiated := flag.Bool("saml-idp-initiated", false, "accept SAML logins started at the IdP")
+	samlNoProvisioning := flag.Bool("saml-no-provisioning", false, "don't create accounts for SAML users who don't have one")
+	ldapURL := flag.String("ldap-url", "", "ldap:// or ldaps:// URL of a directory to let users log in with their password in it. The service account's password is read from $LDAP_BIND_PASSWORD")
+	ldapBaseDN := flag.String("ldap-base-dn", "", "DN users are searched for under in the directory, e.g. ou=people,dc=example,dc=com")
+	ldapBindDN := flag.String("ldap-bind-dn", "", "DN of the service account users are searched for as. Searches are anonymous if this isn't set")
+	ldapUserFilter := flag.String("ldap-user-filter", ldap.DefaultUserFilter, "filter finding a user's entry, with {login} replaced by the email they log in with")
+	ldapAttrs := flag.String("ldap-attributes", "", "comma separated attributes of users to use, if not the usual ones, e.g. id=entryUUID,email=mail,username=uid,name=cn")
+	ldapLinkByEmail := flag.Bool("ldap-link-by-email", false, "link directory users to the existing account with their email when they first log in")
+	ldapNoProvisioning := flag.Bool("ldap-no-provisioning", false, "don't create accounts for directory users who don't have one")
+	var ao auditOptions
+	flag.BoolVar(&ao.verify, "audit-verify", false, "check the audit log's hash chain, then exit")
+	flag.StringVar(&ao.export, "audit-export", "", "write the audit log as JSON lines to this new file, or - for stdout, then exit")
+	flag.BoolVar(&ao.query, "audit-query", false, "print audit events, newest first, then exit")
+	flag.StringVar(&ao.user, "audit-user", "", "only print audit events by or about the user with this ID")
+	flag.StringVar(&ao.action, "audit-action", "", "only print audit events with this action, or actions under it, e.g. admin")
+	flag.StringVar(&ao.since, "audit-since", "", "only print audit events from this long ago, e.g. 24h")
+	flag.IntVar(&ao.limit, "audit-limit", 50, "print at most this many audit events")
+	maxTodoDepth := flag.Int("max-todo-depth", models.DefaultMaxTodoDepth, "how deep subtasks can be nested, counting a todo that isn't a subtask as 1")
+	blobDir := flag.String("blob-dir", "", "directory attached files are kept in, which defaults to blobs in the boltdb directory")
+	attachmentQuota := flag.Int64("attachment-quota", models.DefaultAttachmentQuota>>20, "how many MB of attached files each user can have")
+	trashDays := flag.Int("trash-days", int(models.DefaultTrashRetention/(24*time.Hour)), "how many days deleted todos stay in the trash")
 	helpPtr := flag.Bool("h", false, "display help")
 
 	flag.Parse()
@@ -42,8 +83,19 @@ The options are:`)
 	if strings.TrimSpace(*boltdbpath) == "" {
 		logr.Fatal("app needs a boltdbpath")
 	}
+	if *maxTodoDepth < 1 {
+		logr.Fatal("-max-todo-depth needs to be at least 1")
+	}
+	if *attachmentQuota < 1 {
+		logr.Fatal("-attachment-quota needs to be at least 1")
+	}
+	if *trashDays < 1 {
+		logr.Fatal("-trash-days needs to be at least 1")
+	}
 
-	boltDB, err := bolt.Open(path.Join(*boltdbpath, "auth_demo.db"), 0600, nil)
+	// Only one process can have the db open, so don't wait forever if the
+	// server is already running
+	boltDB, err := bolt.Open(path.Join(*boltdbpath, "auth_demo.db"), 0600, &bolt.Options{Timeout: 5 * time.Second})
 	if err != nil {
 		logr.Fatalf("unable to open boldb: %s", err)
 	}
@@ -52,13 +104,164 @@ The options are:`)
 		logr.Fatalf("unable to set boltdb: %s", err)
 	}
 
+	if strings.TrimSpace(*grantAdmin) != "" {
+		u, err := app.GrantAdmin(strings.TrimSpace(*grantAdmin))
+		if err != nil {
+			logr.Fatalf("unable to grant admin to %s: %s", *grantAdmin, err)
+		}
+		logr.Infof("%s (%s) is now an admin", u.Username, u.Email)
+		boltDB.Close()
+		os.Exit(0)
+	}
+
+	if *newInvite > 0 {
+		link, err := app.CreateSignupInvite(*newInvite, models.MaxMemberInviteLifetime)
+		boltDB.Close()
+		if err != nil {
+			logr.Fatalf("unable to create signup invite: %s", err)
+		}
+		fmt.Println(link)
+		os.Exit(0)
+	}
+
+	if *reindex {
+		n, err := app.Reindex()
+		boltDB.Close()
+		if err != nil {
+			logr.Fatalf("unable to rebuild the search index: %s", err)
+		}
+		logr.Infof("Indexed %d todos and comments", n)
+		os.Exit(0)
+	}
+
+	if ao.requested() {
+		err := runAudit(&ao, os.Stdout)
+		boltDB.Close()
+		if err != nil {
+			logr.Fatalf("audit log: %s", err)
+		}
+		os.Exit(0)
+	}
+
 	doneCh := make(chan bool, 1)
 	quitCh := make(chan os.Signal, 1)
 
 	signal.Notify(quitCh, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
 
-	env := app.NewEnv(logr, *templatesPath)
+	policy := password.DefaultPolicy()
+	policy.MinLength = *minPassLen
+	policy.MinStrength = password.Score(*minPassStrength)
+	if strings.TrimSpace(*breachedPath) != "" {
+		corpus, err := password.LoadBreachCorpus(*breachedPath)
+		if err != nil {
+			logr.Fatalf("unable to load breached passwords: %s", err)
+		}
+		logr.Infof("Loaded %d breached password hashes", corpus.Len())
+		policy.Breached = corpus
+	}
+
+	var mailer mail.Mailer = &mail.LogMailer{Log: logr}
+	if strings.TrimSpace(*smtpAddr) != "" {
+		mailer = &mail.SMTPMailer{Addr: *smtpAddr, From: *mailFrom}
+	}
+
+	mode, err := models.ParseSignupMode(*signupMode)
+	if err != nil {
+		logr.Fatal(err)
+	}
+	signup := models.SignupPolicy{Mode: mode}
+	for _, d := range strings.Split(*signupDomains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			signup.AllowedDomains = append(signup.AllowedDomains, d)
+		}
+	}
+	if mode == models.SignupDomains && len(signup.AllowedDomains) == 0 {
+		logr.Fatal("the domains signup mode needs -signup-domains")
+	}
+
+	var samlCfg *app.SAMLConfig
+	if strings.TrimSpace(*samlMetadata) != "" {
+		md, err := ioutil.ReadFile(*samlMetadata)
+		if err != nil {
+			logr.Fatalf("unable to read SAML IdP metadata: %s", err)
+		}
+		idp, err := saml.ParseIdPMetadata(md)
+		if err != nil {
+			logr.Fatalf("unable to parse SAML IdP metadata: %s", err)
+		}
+		base := strings.TrimSuffix(*samlURL, "/")
+		samlCfg = &app.SAMLConfig{
+			SP:                  &saml.ServiceProvider{EntityID: base + "/saml/metadata", ACSURL: base + "/saml/acs", IdP: idp},
+			LinkByEmail:         *samlLinkByEmail,
+			AllowIdPInitiated:   *samlIdPInitiated,
+			DisableProvisioning: *samlNoProvisioning,
+		}
+		logr.Infof("Logging in through SAML IdP %s", idp.EntityID)
+	}
+
+	var ldapCfg *app.LDAPConfig
+	if strings.TrimSpace(*ldapURL) != "" {
+		dir := &ldap.Directory{
+			URL:          *ldapURL,
+			BindDN:       *ldapBindDN,
+			BindPassword: os.Getenv("LDAP_BIND_PASSWORD"),
+			BaseDN:       *ldapBaseDN,
+			UserFilter:   *ldapUserFilter,
+		}
+		for _, kv := range strings.Split(*ldapAttrs, ",") {
+			if kv = strings.TrimSpace(kv); kv == "" {
+				continue
+			}
+			parts := strings.SplitN(kv, "=", 2)
+			if len(parts) != 2 {
+				logr.Fatalf("%q in -ldap-attributes isn't name=attribute", kv)
+			}
+			switch attr := strings.TrimSpace(parts[1]); strings.TrimSpace(parts[0]) {
+			case "id":
+				dir.IDAttribute = attr
+			case "email":
+				dir.EmailAttribute = attr
+			case "username":
+				dir.UsernameAttribute = attr
+			case "name":
+				dir.NameAttribute = attr
+			default:
+				logr.Fatalf("unknown attribute %q in -ldap-attributes, it should be id, email, username or name", parts[0])
+			}
+		}
+		if err := dir.CheckUserFilter(); err != nil {
+			logr.Fatalf("bad -ldap-user-filter: %s", err)
+		}
+		ldapCfg = &app.LDAPConfig{
+			Directory:           dir,
+			LinkByEmail:         *ldapLinkByEmail,
+			DisableProvisioning: *ldapNoProvisioning,
+		}
+		logr.Infof("Logging in through LDAP directory %s", dir.URL)
+	}
+
+	if *blobDir == "" {
+		*blobDir = path.Join(*boltdbpath, "blobs")
+	}
+	blobs, err := blob.NewFileStore(*blobDir)
+	if err != nil {
+		logr.Fatalf("unable to open blob directory %s: %s", *blobDir, err)
+	}
+
+	env := app.NewEnv(logr, *templatesPath, app.Config{
+		PasswordPolicy:  policy,
+		Mailer:          mailer,
+		Signup:          signup,
+		SAML:            samlCfg,
+		LDAP:            ldapCfg,
+		MaxTodoDepth:    *maxTodoDepth,
+		Blobs:           blobs,
+		AttachmentQuota: *attachmentQuota << 20,
+		TrashRetention:  time.Duration(*trashDays) * 24 * time.Hour,
+	})
 	rter := app.NewRouter(*staticFilePath, env)
+	jobsCtx, stopJobs := context.WithCancel(context.Background())
+	jobsWg := app.StartJobs(jobsCtx, env)
 	portStr := ":8085"
 	serv := &http.Server{
 		// It's important to set timeouts so you don't explode
@@ -89,6 +292,10 @@ The options are:`)
 			logr.Fatalf("Server failed to shutdown gracefully, %v", err)
 		}
 
+		// Let background jobs finish what they're doing
+		stopJobs()
+		jobsWg.Wait()
+
 		close(doneCh)
 	}()
 
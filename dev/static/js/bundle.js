@@ -132,15 +132,33 @@ function req(options) {
 const app = {
   patch: Object(_router__WEBPACK_IMPORTED_MODULE_8__["navTo"])([_router__WEBPACK_IMPORTED_MODULE_8__["Route"].Home()]),
   initial: Object.assign({
-    "todos": []
+    "todos": [],
+    "orgs": [],
+    "currentOrg": null
   }),
   Actions: function (update) {
-    const navigateTo = route => update(Object(_router__WEBPACK_IMPORTED_MODULE_8__["navTo"])(route));
+    const navigateTo = route => update(Object(_router__WEBPACK_IMPORTED_MODULE_8__["navTo"])(route)); // Todos belong to the current org if one is picked, and to the user otherwise
 
-    const getTodo = () => {
+
+    const todosURL = org => org ? `/api/v1/orgs/${encodeURIComponent(org)}/todos` : "/api/v1/todos";
+
+    const loadOrgs = () => {
       req({
         method: "GET",
-        url: "/api/v1/todos"
+        url: "/api/v1/orgs"
+      }).then(res => {
+        update({
+          orgs: res.data
+        });
+      }).catch(e => {
+        console.log(JSON.stringify(e));
+      });
+    };
+
+    const getTodo = org => {
+      req({
+        method: "GET",
+        url: todosURL(org)
       }).then(res => {
         console.log(res);
         update({
@@ -154,7 +172,7 @@ const app = {
     const postTodo = state => {
       req({
         method: "POST",
-        url: "/api/v1/todos",
+        url: todosURL(state.currentOrg),
         csrf: state.csrfToken,
         body: {
           "data": {
@@ -177,10 +195,20 @@ const app = {
       });
     };
 
+    const switchOrg = org => {
+      update({
+        currentOrg: org,
+        todos: []
+      });
+      getTodo(org);
+    };
+
     return {
       navigateTo,
+      loadOrgs,
       getTodo,
-      postTodo
+      postTodo,
+      switchOrg
     };
   },
   services: [_services__WEBPACK_IMPORTED_MODULE_9__["routeService"], _services__WEBPACK_IMPORTED_MODULE_9__["todoLoadService"]]
@@ -197,9 +225,13 @@ const {
 window.addEventListener("DOMContentLoaded", main);
 
 function main() {
+  const meta = document.getElementsByTagName("meta");
   update({
-    "csrfToken": document.getElementsByTagName("meta")["csrf.Token"].getAttribute("content")
+    "csrfToken": meta["csrf.Token"].getAttribute("content"),
+    "impersonating": meta["impersonating"] ? meta["impersonating"].getAttribute("content") : null,
+    "currentOrg": new URLSearchParams(window.location.search).get("org")
   });
+  actions.loadOrgs();
   mithril__WEBPACK_IMPORTED_MODULE_2___default.a.route.prefix = "";
   mithril__WEBPACK_IMPORTED_MODULE_2___default.a.route(root, "/c", _router__WEBPACK_IMPORTED_MODULE_8__["router"].MithrilRoutes({
     states,
@@ -3535,7 +3567,12 @@ const Root = {
     const isActive = tab => tab === Component;
 
     console.log(state);
-    return mithril__WEBPACK_IMPORTED_MODULE_0___default()("main.w-100", [mithril__WEBPACK_IMPORTED_MODULE_0___default()(".fl.w-100.w-20-ns", [mithril__WEBPACK_IMPORTED_MODULE_0___default()(mithril__WEBPACK_IMPORTED_MODULE_0___default.a.route.Link, {
+    return mithril__WEBPACK_IMPORTED_MODULE_0___default()("main.w-100", [state.impersonating ? mithril__WEBPACK_IMPORTED_MODULE_0___default()(ImpersonationBanner, {
+      state
+    }) : null, mithril__WEBPACK_IMPORTED_MODULE_0___default()(".fl.w-100.w-20-ns", [mithril__WEBPACK_IMPORTED_MODULE_0___default()(OrgSwitcher, {
+      state,
+      actions
+    }), mithril__WEBPACK_IMPORTED_MODULE_0___default()(mithril__WEBPACK_IMPORTED_MODULE_0___default.a.route.Link, {
       href: _router__WEBPACK_IMPORTED_MODULE_2__["router"].toPath([_router__WEBPACK_IMPORTED_MODULE_2__["Route"].Home()]),
       class: "pl3"
     }, "Home"), mithril__WEBPACK_IMPORTED_MODULE_0___default()(mithril__WEBPACK_IMPORTED_MODULE_0___default.a.route.Link, {
@@ -3547,6 +3584,40 @@ const Root = {
       routing
     }))]);
   }
+}; // Picks whose todos to show: the user's own, or one of their orgs'
+
+const OrgSwitcher = {
+  view: ({
+    attrs: {
+      state,
+      actions
+    }
+  }) => mithril__WEBPACK_IMPORTED_MODULE_0___default()(".pa3", mithril__WEBPACK_IMPORTED_MODULE_0___default()("select.f6.w-100.pa1.ba.b--black-20.bg-white", {
+    value: state.currentOrg || "",
+    onchange: e => actions.switchOrg(e.target.value || null)
+  }, [mithril__WEBPACK_IMPORTED_MODULE_0___default()("option", {
+    value: ""
+  }, "Personal"), state.orgs.map(org => mithril__WEBPACK_IMPORTED_MODULE_0___default()("option", {
+    value: org.attributes.slug
+  }, org.attributes.name))]))
+}; // Shown while an admin is logged in as this user
+
+const ImpersonationBanner = {
+  view: ({
+    attrs: {
+      state
+    }
+  }) => mithril__WEBPACK_IMPORTED_MODULE_0___default()(".w-100.bg-gold.black-80.pa2.tc.f6", ["You are signed in as ", mithril__WEBPACK_IMPORTED_MODULE_0___default()("b", state.impersonating), ".", mithril__WEBPACK_IMPORTED_MODULE_0___default()("form.dib.ml2", {
+    action: "/impersonate/stop",
+    method: "post"
+  }, [mithril__WEBPACK_IMPORTED_MODULE_0___default()("input", {
+    type: "hidden",
+    name: "gorilla.csrf.Token",
+    value: state.csrfToken
+  }), mithril__WEBPACK_IMPORTED_MODULE_0___default()("input.b.ph2.pv1.input-reset.ba.b--black-80.bg-transparent.pointer.f6", {
+    type: "submit",
+    value: "Stop impersonating"
+  })])])
 };
 
 /***/ }),
@@ -4201,7 +4272,7 @@ const todoLoadService = ({
         update,
         actions
       }) => {
-        actions.getTodo();
+        actions.getTodo(state.currentOrg);
       }
     };
   }
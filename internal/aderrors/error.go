@@ -12,6 +12,13 @@ import (
 var ErrNoRecords = errors.New("no records found")
 var ErrNoID = errors.New("no ID supplied")
 var ErrAlreadyExists = errors.New("entity already exists")
+var ErrExpired = errors.New("entity has expired")
+var ErrTokenReused = errors.New("token reuse detected")
+var ErrLastOwner = errors.New("an org needs at least one owner")
+var ErrWrongRecipient = errors.New("sent to someone else")
+var ErrWrongPassword = errors.New("wrong password")
+var ErrTooLarge = errors.New("too large")
+var ErrUploadOffset = errors.New("upload is at a different offset")
 var ErrNotJSONAPIMediaType = APIStatusError{
 	PublicMessage: "Content-Type header is not application/vnd.api+json",
 	StatusError: StatusError{
@@ -124,3 +131,56 @@ func New404APIError(err error) APIStatusError {
 func New401APIError(err error) APIStatusError {
 	return NewAPIError(http.StatusUnauthorized, "Unauthorized", err)
 }
+
+// FieldError describes a problem with a single input field.
+// Code is a stable identifier for the rule that failed, e.g. "password_too_short".
+type FieldError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// ValidationError collects the problems found with a form or request body,
+// so each one can be shown next to its field.
+type ValidationError struct {
+	Fields []FieldError
+}
+
+func (ve ValidationError) Error() string {
+	msgs := make([]string, 0, len(ve.Fields))
+	for _, f := range ve.Fields {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", f.Field, f.Message))
+	}
+	return "validation failed: " + strings.Join(msgs, "; ")
+}
+
+// Add appends a FieldError.
+func (ve *ValidationError) Add(field, code, msg string) {
+	ve.Fields = append(ve.Fields, FieldError{Field: field, Code: code, Message: msg})
+}
+
+// HasErrors reports whether any FieldErrors were added.
+func (ve ValidationError) HasErrors() bool {
+	return len(ve.Fields) > 0
+}
+
+// NewValidationAPIError wraps a ValidationError for the API error handler,
+// which turns every field into its own JSON:API error object.
+func NewValidationAPIError(ve ValidationError) APIStatusError {
+	return NewAPIError(http.StatusUnprocessableEntity, "Validation failed", ve)
+}
+
+// PermissionError says which permission the user was missing.
+type PermissionError struct {
+	Permission string
+}
+
+func (pe PermissionError) Error() string {
+	return fmt.Sprintf("missing permission %s", pe.Permission)
+}
+
+// NewPermissionAPIError wraps a PermissionError for the API error handler,
+// which reports the missing permission in the error object.
+func NewPermissionAPIError(permission string) APIStatusError {
+	return NewAPIError(http.StatusForbidden, "Forbidden", PermissionError{Permission: permission})
+}
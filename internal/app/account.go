@@ -0,0 +1,124 @@
+package app
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/mail"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/sirupsen/logrus"
+)
+
+// serveAccountExport sends the user a ZIP archive of everything we hold
+// about them, one JSON file per kind of record. The audit events about them
+// are included too.
+func serveAccountExport(env *Env, adb models.AccountService, aud models.AuditService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		export, err := adb.Export(u.ID)
+		if err != nil {
+			return aderrors.New500Error("error exporting account", err).WithFields(logrus.Fields{"user_id": u.ID})
+		}
+		env.recordAudit(r, &models.AuditEvent{Action: models.AuditAccountExported, TargetID: u.ID})
+		events, err := aud.Query(models.AuditQuery{UserID: u.ID})
+		if err != nil {
+			return aderrors.New500Error("error exporting account audit log", err).WithFields(logrus.Fields{"user_id": u.ID})
+		}
+
+		files := []struct {
+			name string
+			data interface{}
+		}{
+			{"user.json", export.User},
+			{"sessions.json", export.Sessions},
+			{"todos.json", export.Todos},
+			{"identities.json", export.Identities},
+			{"notifications.json", export.Notifications},
+			{"lists.json", export.Lists},
+			{"labels.json", export.Labels},
+			{"boards.json", export.Boards},
+			{"columns.json", export.Columns},
+			{"note_revisions.json", export.NoteRevisions},
+			{"attachments.json", export.Attachments},
+			{"comments.json", export.Comments},
+			{"audit_log.json", events},
+		}
+
+		filename := fmt.Sprintf("auth_demo-%s-%s.zip", u.Username, timeNow().Format("2006-01-02"))
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		zw := zip.NewWriter(w)
+		for _, f := range files {
+			fw, err := zw.Create(f.name)
+			if err != nil {
+				return aderrors.New500Error("error writing export archive", err).WithFields(logrus.Fields{"user_id": u.ID})
+			}
+			enc := json.NewEncoder(fw)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(f.data); err != nil {
+				return aderrors.New500Error("error writing export archive", err).WithFields(logrus.Fields{"user_id": u.ID})
+			}
+		}
+		env.loe(zw.Close())
+		return nil
+	}
+}
+
+// servePostDeleteAccount schedules the account for deletion once the grace
+// period is over. The user has to confirm with their password.
+func servePostDeleteAccount(env *Env, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		if passOK, _ := u.CheckPassword(r.FormValue("current_password")); !passOK {
+			env.saveFlash(w, r, "Your current password was incorrect.")
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "wrong password when deleting account", nil).WithFields(logrus.Fields{"user_id": u.ID})
+		}
+		if u.IsPendingDeletion() {
+			http.Redirect(w, r, "/settings", http.StatusFound)
+			return nil
+		}
+
+		u.DeletionTime = timeNow().Add(models.AccountDeletionGracePeriod)
+		if _, err := udb.Update(u); err != nil {
+			return aderrors.New500Error("error scheduling account deletion", err).WithFields(logrus.Fields{"user_id": u.ID})
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditAccountDeletionRequested,
+			TargetID: u.ID,
+			Details:  map[string]string{"deletion_time": u.DeletionTime.Format(time.RFC3339)},
+		})
+		env.loe(env.mailer.Send(&mail.Message{
+			To:      u.Email,
+			Subject: fmt.Sprintf("Your %s account will be deleted", env.gp.SiteName),
+			Body: fmt.Sprintf("Hi %s,\n\nYour %s account and everything in it will be permanently deleted on %s.\n\n"+
+				"If you change your mind, log in and cancel the deletion from your settings before then.\n",
+				u.Username, env.gp.SiteName, u.DeletionTime.Format("2 Jan 2006 15:04 MST")),
+		}))
+
+		env.saveFlash(w, r, fmt.Sprintf("Your account will be deleted on %s.", u.DeletionTime.Format("2 Jan 2006")))
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
+
+func servePostCancelDeleteAccount(env *Env, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		if u.IsPendingDeletion() {
+			u.DeletionTime = time.Time{}
+			if _, err := udb.Update(u); err != nil {
+				return aderrors.New500Error("error cancelling account deletion", err).WithFields(logrus.Fields{"user_id": u.ID})
+			}
+			env.recordAudit(r, &models.AuditEvent{Action: models.AuditAccountDeletionCancelled, TargetID: u.ID})
+			env.saveFlash(w, r, "Your account will no longer be deleted.")
+		}
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
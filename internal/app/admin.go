@@ -0,0 +1,643 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"github.com/gorilla/csrf"
+	"github.com/sirupsen/logrus"
+	"goji.io/pat"
+)
+
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+)
+
+// The things an admin can do to a user's account.
+const (
+	adminActionLogout      = "logout"
+	adminActionLock        = "lock"
+	adminActionUnlock      = "unlock"
+	adminActionGrantAdmin  = "grant_admin"
+	adminActionRevokeAdmin = "revoke_admin"
+	adminActionSetRoles    = "roles"
+)
+
+// adminActionPermissions is the permission needed for each admin action.
+var adminActionPermissions = map[string]models.Permission{
+	adminActionLogout:      models.PermUsersLogout,
+	adminActionLock:        models.PermUsersLock,
+	adminActionUnlock:      models.PermUsersLock,
+	adminActionGrantAdmin:  models.PermRolesManage,
+	adminActionRevokeAdmin: models.PermRolesManage,
+}
+
+// adminActionAudits is the audit log action recorded for each admin action.
+var adminActionAudits = map[string]string{
+	adminActionLogout:      models.AuditAdminLogout,
+	adminActionLock:        models.AuditAdminLock,
+	adminActionUnlock:      models.AuditAdminUnlock,
+	adminActionGrantAdmin:  models.AuditAdminRolesChanged,
+	adminActionRevokeAdmin: models.AuditAdminRolesChanged,
+	adminActionSetRoles:    models.AuditAdminRolesChanged,
+}
+
+var errAdminSelfAction = errors.New("admins can't lock themselves out or revoke their own admin rights")
+var errUnknownAdminAction = errors.New("unknown admin action")
+
+// apiAdminUser is a models.User as admins see it.
+type apiAdminUser struct {
+	ID           string     `jsonapi:"primary,user"`
+	Username     string     `jsonapi:"attr,username"`
+	Email        string     `jsonapi:"attr,email"`
+	Name         string     `jsonapi:"attr,name"`
+	DateCreated  time.Time  `jsonapi:"attr,date_created,iso8601"`
+	Roles        []string   `jsonapi:"attr,roles"`
+	IsAdmin      bool       `jsonapi:"attr,is_admin"`
+	IsLocked     bool       `jsonapi:"attr,is_locked"`
+	LockedTime   *time.Time `jsonapi:"attr,locked_time,iso8601,omitempty"`
+	DeletionTime *time.Time `jsonapi:"attr,deletion_time,iso8601,omitempty"`
+	// SignupInviteID is the signup invite the account was created with.
+	SignupInviteID string `jsonapi:"attr,signup_invite_id,omitempty"`
+}
+
+func newAPIAdminUser(u *models.User) *apiAdminUser {
+	au := &apiAdminUser{
+		ID:          u.ID,
+		Username:    u.Username,
+		Email:       u.Email,
+		Name:        u.Name,
+		DateCreated: u.DateCreated,
+		Roles:       []string{},
+		IsAdmin:     u.IsAdmin(),
+		IsLocked:    u.IsLocked(),
+	}
+	for _, r := range u.Roles() {
+		au.Roles = append(au.Roles, string(r))
+	}
+	if u.D != nil {
+		au.SignupInviteID = u.D.SignupInviteID
+	}
+	if u.IsLocked() {
+		t := u.LockedTime
+		au.LockedTime = &t
+	}
+	if u.IsPendingDeletion() {
+		t := u.DeletionTime
+		au.DeletionTime = &t
+	}
+	return au
+}
+
+// HasRole is used by templates to tick the user's roles.
+func (au *apiAdminUser) HasRole(role models.Role) bool {
+	for _, r := range au.Roles {
+		if r == string(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// apiRole is the public representation of a models.Role.
+type apiRole struct {
+	ID          string   `jsonapi:"primary,role"`
+	Permissions []string `jsonapi:"attr,permissions"`
+}
+
+// adminUserChanges holds the changes an admin asked for through the api.
+// Nil fields are left alone.
+type adminUserChanges struct {
+	ID       string   `jsonapi:"primary,user"`
+	Roles    []string `jsonapi:"attr,roles"`
+	IsAdmin  *bool    `jsonapi:"attr,is_admin"`
+	IsLocked *bool    `jsonapi:"attr,is_locked"`
+}
+
+// actions turns the lock and admin changes into admin actions, in a stable
+// order. Role changes are handled separately by setUserRoles.
+func (c *adminUserChanges) actions() []string {
+	var actions []string
+	if c.IsLocked != nil {
+		if *c.IsLocked {
+			actions = append(actions, adminActionLock)
+		} else {
+			actions = append(actions, adminActionUnlock)
+		}
+	}
+	if c.IsAdmin != nil {
+		if *c.IsAdmin {
+			actions = append(actions, adminActionGrantAdmin)
+		} else {
+			actions = append(actions, adminActionRevokeAdmin)
+		}
+	}
+	return actions
+}
+
+// applyAdminAction carries out an admin action on the target's account,
+// provided the admin has the permission for it. Locking an account also
+// logs the user out everywhere.
+func applyAdminAction(udb models.UserService, adb models.AdminService, admin, target *models.User, action string) error {
+	perm, ok := adminActionPermissions[action]
+	if !ok {
+		return errUnknownAdminAction
+	}
+	if !admin.Can(perm) {
+		return aderrors.PermissionError{Permission: string(perm)}
+	}
+
+	switch action {
+	case adminActionLogout:
+		_, err := adb.ForceLogout(target.ID)
+		return err
+	case adminActionLock:
+		if target.ID == admin.ID {
+			return errAdminSelfAction
+		}
+		if !target.IsLocked() {
+			target.LockedTime = timeNow()
+			if _, err := udb.Update(target); err != nil {
+				return err
+			}
+		}
+		_, err := adb.ForceLogout(target.ID)
+		return err
+	case adminActionUnlock:
+		target.LockedTime = time.Time{}
+		_, err := udb.Update(target)
+		return err
+	case adminActionGrantAdmin:
+		return setUserRoles(udb, admin, target, append(target.Roles(), models.RoleAdmin))
+	default: // adminActionRevokeAdmin
+		var roles []models.Role
+		for _, r := range target.Roles() {
+			if r != models.RoleAdmin {
+				roles = append(roles, r)
+			}
+		}
+		return setUserRoles(udb, admin, target, roles)
+	}
+}
+
+// adminAuditEvent is the audit event for an admin action that has been
+// applied to target. Role changes record the roles before and after.
+func adminAuditEvent(action string, target *models.User, oldRoles []models.Role) *models.AuditEvent {
+	ev := &models.AuditEvent{Action: adminActionAudits[action], TargetID: target.ID}
+	if ev.Action == models.AuditAdminRolesChanged {
+		ev.Details = map[string]string{"old_roles": joinRoles(oldRoles), "new_roles": joinRoles(target.Roles())}
+	}
+	return ev
+}
+
+func joinRoles(roles []models.Role) string {
+	names := make([]string, 0, len(roles))
+	for _, r := range roles {
+		names = append(names, string(r))
+	}
+	return strings.Join(names, ",")
+}
+
+// setUserRoles replaces the target's roles, provided the admin may manage
+// roles. Admins can't take away their own admin role.
+func setUserRoles(udb models.UserService, admin, target *models.User, roles []models.Role) error {
+	if !admin.Can(models.PermRolesManage) {
+		return aderrors.PermissionError{Permission: string(models.PermRolesManage)}
+	}
+	var ve aderrors.ValidationError
+	for _, r := range roles {
+		if !r.IsValid() {
+			ve.Add("roles", "role_invalid", fmt.Sprintf("%q is not a role.", r))
+		}
+	}
+	if ve.HasErrors() {
+		return ve
+	}
+
+	isAdmin := false
+	for _, r := range roles {
+		isAdmin = isAdmin || r == models.RoleAdmin
+	}
+	if target.ID == admin.ID && admin.IsAdmin() && !isAdmin {
+		return errAdminSelfAction
+	}
+	target.SetRoles(roles)
+	_, err := udb.Update(target)
+	return err
+}
+
+// pageParams reads a 1-based page number and a page size from the query
+// string, falling back to the first page of defaultPageSize.
+func pageParams(q url.Values, numberKey, sizeKey string) (number, size int) {
+	number, err := strconv.Atoi(q.Get(numberKey))
+	if err != nil || number < 1 {
+		number = 1
+	}
+	size = defaultPageSize
+	if sizeKey != "" {
+		if s, err := strconv.Atoi(q.Get(sizeKey)); err == nil && s > 0 {
+			size = s
+		}
+	}
+	if size > maxPageSize {
+		size = maxPageSize
+	}
+	return number, size
+}
+
+// lastPage returns the number of the last page, which is 1 when there are
+// no results.
+func lastPage(total, size int) int {
+	if total == 0 {
+		return 1
+	}
+	return (total + size - 1) / size
+}
+
+// adminUsersPresenter is used to render the admin user list.
+type adminUsersPresenter struct {
+	*localPresenter
+	Users    []*apiAdminUser
+	Query    string
+	Total    int
+	Page     int
+	PrevPage int
+	NextPage int
+}
+
+func serveAdminUsers(env *Env, adb models.AdminService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		q := r.URL.Query()
+		query := q.Get("q")
+		page, size := pageParams(q, "page", "")
+		users, total, err := adb.SearchUsers(query, (page-1)*size, size)
+		if err != nil {
+			return aderrors.New500Error("error searching users", err).WithFields(logrus.Fields{"query": query})
+		}
+
+		ap := &adminUsersPresenter{
+			localPresenter: &localPresenter{
+				PageTitle:       "Admin · Users",
+				PageURL:         "/admin",
+				CSRFToken:       csrf.Token(r),
+				Flashes:         env.getFlash(w, r),
+				globalPresenter: env.gp,
+			},
+			Query: query,
+			Total: total,
+			Page:  page,
+		}
+		if page > 1 {
+			ap.PrevPage = page - 1
+		}
+		if page < lastPage(total, size) {
+			ap.NextPage = page + 1
+		}
+		for _, u := range users {
+			ap.Users = append(ap.Users, newAPIAdminUser(u))
+		}
+		env.loe(env.rndr.HTML(w, http.StatusOK, "admin_users", ap))
+		return nil
+	}
+}
+
+// adminUserPresenter is used to render a single user in the admin console.
+type adminUserPresenter struct {
+	*localPresenter
+	User           *apiAdminUser
+	Sessions       []*apiSession
+	IsSelf         bool
+	Roles          []models.Role
+	CanLogout      bool
+	CanLock        bool
+	CanManageRoles bool
+	CanImpersonate bool
+}
+
+func serveAdminUser(env *Env, udb models.UserService, sdb models.SessionService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		admin := env.getUser(r)
+		id := pat.Param(r, "id")
+		u, err := udb.Get(id)
+		if err != nil {
+			if errors.Is(err, aderrors.ErrNoRecords) {
+				env.saveFlash(w, r, "That user doesn't exist.")
+				http.Redirect(w, r, "/admin", http.StatusFound)
+				return aderrors.New404Error("no such user", err).WithFields(logrus.Fields{"user_id": id})
+			}
+			return aderrors.New500Error("error retrieving user", err).WithFields(logrus.Fields{"user_id": id})
+		}
+		sessions, err := sdb.GetSessionsByUserID(u.ID)
+		if err != nil {
+			return aderrors.New500Error("error retrieving sessions for user", err).WithFields(logrus.Fields{"user_id": id})
+		}
+
+		ap := &adminUserPresenter{
+			localPresenter: &localPresenter{
+				PageTitle:       "Admin · " + u.Username,
+				PageURL:         "/admin/users/" + u.ID,
+				CSRFToken:       csrf.Token(r),
+				Flashes:         env.getFlash(w, r),
+				globalPresenter: env.gp,
+			},
+			User:           newAPIAdminUser(u),
+			IsSelf:         u.ID == admin.ID,
+			Roles:          models.Roles(),
+			CanLogout:      admin.Can(models.PermUsersLogout),
+			CanLock:        admin.Can(models.PermUsersLock),
+			CanManageRoles: admin.Can(models.PermRolesManage),
+			CanImpersonate: admin.CanImpersonate(u),
+		}
+		currentID := env.getSessionID(r)
+		for _, s := range sessions {
+			ap.Sessions = append(ap.Sessions, newAPISession(s, currentID))
+		}
+		env.loe(env.rndr.HTML(w, http.StatusOK, "admin_user", ap))
+		return nil
+	}
+}
+
+// adminActionFlashes are shown after an admin action succeeds.
+var adminActionFlashes = map[string]string{
+	adminActionLogout:      "The user has been logged out everywhere.",
+	adminActionLock:        "The account has been locked and logged out everywhere.",
+	adminActionUnlock:      "The account has been unlocked.",
+	adminActionGrantAdmin:  "The user is now an admin.",
+	adminActionRevokeAdmin: "The user is no longer an admin.",
+	adminActionSetRoles:    "The user's roles have been updated.",
+}
+
+func servePostAdminUserAction(env *Env, udb models.UserService, adb models.AdminService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		admin := env.getUser(r)
+		id, action := pat.Param(r, "id"), pat.Param(r, "action")
+		userURL := "/admin/users/" + id
+		fields := logrus.Fields{"admin_id": admin.ID, "user_id": id, "action": action}
+
+		target, err := udb.Get(id)
+		if err != nil {
+			if errors.Is(err, aderrors.ErrNoRecords) {
+				env.saveFlash(w, r, "That user doesn't exist.")
+				http.Redirect(w, r, "/admin", http.StatusFound)
+				return aderrors.New404Error("no such user", err).WithFields(fields)
+			}
+			return aderrors.New500Error("error retrieving user", err).WithFields(fields)
+		}
+
+		oldRoles := target.Roles()
+		if action == adminActionSetRoles {
+			if err := r.ParseForm(); err != nil {
+				return aderrors.NewError(http.StatusBadRequest, "error parsing roles form", err).WithFields(fields)
+			}
+			var roles []models.Role
+			for _, role := range r.PostForm["role"] {
+				roles = append(roles, models.Role(role))
+			}
+			err = setUserRoles(udb, admin, target, roles)
+		} else {
+			err = applyAdminAction(udb, adb, admin, target, action)
+		}
+		var pe aderrors.PermissionError
+		switch {
+		case errors.As(err, &pe):
+			env.saveFlash(w, r, "You don't have permission to do that.")
+			http.Redirect(w, r, userURL, http.StatusFound)
+			return aderrors.NewError(http.StatusForbidden, "admin action not permitted", err).WithFields(fields)
+		case env.saveFieldErrorFlashes(w, r, err):
+			http.Redirect(w, r, userURL, http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "invalid roles", err).WithFields(fields)
+		case errors.Is(err, errAdminSelfAction):
+			env.saveFlash(w, r, "You can't lock your own account or remove your own admin rights.")
+			http.Redirect(w, r, userURL, http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "admin tried to act on themselves", err).WithFields(fields)
+		case errors.Is(err, errUnknownAdminAction):
+			env.saveFlash(w, r, "That's not something you can do to an account.")
+			http.Redirect(w, r, userURL, http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "unknown admin action", err).WithFields(fields)
+		case err != nil:
+			return aderrors.New500Error("error applying admin action", err).WithFields(fields)
+		}
+
+		env.log.WithFields(fields).Info("admin action applied")
+		env.recordAudit(r, adminAuditEvent(action, target, oldRoles))
+		env.saveFlash(w, r, adminActionFlashes[action])
+		http.Redirect(w, r, userURL, http.StatusFound)
+		return nil
+	}
+}
+
+func serveAPIAdminUsers(env *Env, adb models.AdminService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		q := r.URL.Query()
+		query := q.Get("filter[q]")
+		page, size := pageParams(q, "page[number]", "page[size]")
+		users, total, err := adb.SearchUsers(query, (page-1)*size, size)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error searching users for %q: %w", query, err))
+		}
+
+		res := []*apiAdminUser{}
+		for _, u := range users {
+			res = append(res, newAPIAdminUser(u))
+		}
+		p, err := jsonapi.Marshal(res)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error marshalling users: %w", err))
+		}
+		payload := p.(*jsonapi.ManyPayload)
+		payload.Links = paginationLinks(r.URL, page, size, total)
+		payload.Meta = &jsonapi.Meta{"total": total}
+
+		w.Header().Set("Content-Type", jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		env.loe(json.NewEncoder(w).Encode(payload))
+		return nil
+	}
+}
+
+// paginationLinks builds the JSON:API pagination links for a page of results,
+// keeping every other query parameter of u.
+func paginationLinks(u *url.URL, page, size, total int) *jsonapi.Links {
+	pageURL := func(n int) string {
+		q := u.Query()
+		q.Set("page[number]", strconv.Itoa(n))
+		q.Set("page[size]", strconv.Itoa(size))
+		pu := *u
+		pu.RawQuery = q.Encode()
+		return pu.RequestURI()
+	}
+	last := lastPage(total, size)
+	links := jsonapi.Links{
+		"self":  pageURL(page),
+		"first": pageURL(1),
+		"last":  pageURL(last),
+	}
+	if page > 1 {
+		links["prev"] = pageURL(page - 1)
+	}
+	if page < last {
+		links["next"] = pageURL(page + 1)
+	}
+	return &links
+}
+
+func serveAPIAdminUser(env *Env, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id := pat.Param(r, "id")
+		u, err := udb.Get(id)
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving user %s: %w", id, err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, newAPIAdminUser(u)))
+		return nil
+	}
+}
+
+func serveAPIAdminUserSessions(env *Env, udb models.UserService, sdb models.SessionService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		id := pat.Param(r, "id")
+		if _, err := udb.Get(id); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving user %s: %w", id, err))
+		}
+		sessions, err := sdb.GetSessionsByUserID(id)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving sessions for user %s: %w", id, err))
+		}
+
+		currentID := env.getSessionID(r)
+		res := []*apiSession{}
+		for _, s := range sessions {
+			res = append(res, newAPISession(s, currentID))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// serveAPIAdminPatchUser locks or unlocks the user, and grants or revokes
+// admin rights.
+func serveAPIAdminPatchUser(env *Env, udb models.UserService, adb models.AdminService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		admin := env.getUser(r)
+		id := pat.Param(r, "id")
+		changes := new(adminUserChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, changes); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if changes.ID != "" && changes.ID != id {
+			return aderrors.NewAPIError(http.StatusConflict, "The id in the body doesn't match the url",
+				fmt.Errorf("user id %s in body, %s in url", changes.ID, id))
+		}
+
+		target, err := udb.Get(id)
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving user %s: %w", id, err))
+		}
+		if changes.Roles != nil {
+			oldRoles := target.Roles()
+			roles := make([]models.Role, 0, len(changes.Roles))
+			for _, role := range changes.Roles {
+				roles = append(roles, models.Role(role))
+			}
+			if err := setUserRoles(udb, admin, target, roles); err != nil {
+				return adminActionAPIError(err)
+			}
+			env.log.WithFields(logrus.Fields{"admin_id": admin.ID, "user_id": id, "roles": changes.Roles}).Info("roles set")
+			env.recordAudit(r, adminAuditEvent(adminActionSetRoles, target, oldRoles))
+		}
+		for _, action := range changes.actions() {
+			oldRoles := target.Roles()
+			if err := applyAdminAction(udb, adb, admin, target, action); err != nil {
+				return adminActionAPIError(err)
+			}
+			env.log.WithFields(logrus.Fields{"admin_id": admin.ID, "user_id": id, "action": action}).Info("admin action applied")
+			env.recordAudit(r, adminAuditEvent(action, target, oldRoles))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, newAPIAdminUser(target)))
+		return nil
+	}
+}
+
+func serveAPIAdminLogoutUser(env *Env, udb models.UserService, adb models.AdminService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		admin := env.getUser(r)
+		id := pat.Param(r, "id")
+		target, err := udb.Get(id)
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving user %s: %w", id, err))
+		}
+		if err := applyAdminAction(udb, adb, admin, target, adminActionLogout); err != nil {
+			return adminActionAPIError(err)
+		}
+		env.log.WithFields(logrus.Fields{"admin_id": admin.ID, "user_id": id, "action": adminActionLogout}).Info("admin action applied")
+		env.recordAudit(r, adminAuditEvent(adminActionLogout, target, nil))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+func adminActionAPIError(err error) error {
+	var pe aderrors.PermissionError
+	var ve aderrors.ValidationError
+	switch {
+	case errors.As(err, &pe):
+		return aderrors.NewPermissionAPIError(pe.Permission)
+	case errors.As(err, &ve):
+		return aderrors.NewValidationAPIError(ve)
+	case errors.Is(err, errAdminSelfAction):
+		return aderrors.NewAPIError(http.StatusConflict, "You can't lock your own account or remove your own admin rights", err)
+	}
+	return handleCommonAPIErrors(fmt.Errorf("error applying admin action: %w", err))
+}
+
+func serveAPIAdminRoles(env *Env) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		res := []*apiRole{}
+		for _, role := range models.Roles() {
+			ar := &apiRole{ID: string(role), Permissions: []string{}}
+			for _, p := range models.RolePermissions[role] {
+				ar.Permissions = append(ar.Permissions, string(p))
+			}
+			res = append(res, ar)
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// GrantAdmin makes the user with the given email an admin. It's used to set
+// up the first admin from the command line.
+func GrantAdmin(email string) (*models.User, error) {
+	if pdb == nil {
+		return nil, errors.New("db has not been set")
+	}
+	udb := &datastore.UserStore{BDB: pdb}
+	u, err := udb.GetByEmail(email)
+	if err != nil {
+		return nil, err
+	}
+	oldRoles := u.Roles()
+	u.SetRoles(append(u.Roles(), models.RoleAdmin))
+	if _, err := udb.Update(u); err != nil {
+		return nil, err
+	}
+	ev := adminAuditEvent(adminActionGrantAdmin, u, oldRoles)
+	ev.Details["source"] = "command line"
+	if err := (&datastore.AuditStore{BDB: pdb}).Record(ev); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/ejamesc/jsonapi"
 
+	"github.com/ejamesc/auth_demo/internal/aderrors"
 	"github.com/ejamesc/auth_demo/internal/models"
 	"github.com/ejamesc/auth_demo/pkg/router"
 	ulid "github.com/oklog/ulid/v2"
@@ -36,34 +37,95 @@ func nsp(ns null.String) *null.String {
 	return &ns
 }
 
-func serveAPITodo(env *Env) router.HandlerError {
+func serveAPITodo(env *Env, tdserv models.TodoService) router.HandlerError {
 	return func(w http.ResponseWriter, r *http.Request) error {
-		td := []*models.Todo{
-			&models.Todo{ID: tempGenerateULID(), Name: null.StringFrom("Some random todo"), IsDone: null.BoolFrom(false), DateCreated: null.NewTime(timeNow(), true)},
-			&models.Todo{ID: tempGenerateULID(), Name: null.NewString("", false), IsDone: null.BoolFrom(true), DateCreated: null.NewTime(timeNow(), true)},
-			&models.Todo{ID: tempGenerateULID(), Name: null.NewString("", true), IsDone: null.BoolFrom(true), DateCreated: null.NewTime(timeNow(), true)},
+		u := env.getUser(r)
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+		td, err := tdserv.GetByUserID(u.ID)
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving todos: %w", err))
 		}
-		env.loe(env.jsonAPI(w, http.StatusOK, td))
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, filterTodos(td, r), include))
 		return nil
 	}
 }
 
 func serveCreateAPITodo(env *Env, tdserv models.TodoService) router.HandlerError {
 	return func(w http.ResponseWriter, r *http.Request) error {
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
 		todo := new(models.Todo)
 		// TODO: refactor to own method
 		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
 		if err := jsonapi.UnmarshalPayload(r.Body, todo); err != nil {
 			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
 		}
+		setTodoRelationshipIDs(todo)
+		todo.UserID = env.getUser(r).ID
+		if ve := validateTodo(todo, timeNow()); ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
 		env.log.Infof("%+v", todo)
-		_, err := tdserv.Create(todo)
+		_, err = tdserv.Create(todo)
 		if err != nil {
-			return handleCommonAPIErrors(fmt.Errorf("error creating todo: %w", err))
+			return orgAPIError(fmt.Errorf("error creating todo: %w", err))
 		}
-		env.loe(env.jsonAPI(w, http.StatusCreated, todo))
+		if todo.RemindAt.Valid {
+			env.wakeReminders()
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusCreated, todo, include))
 		td2, err := tdserv.Get(todo.ID)
 		env.log.Infof("%+v", td2)
 		return nil
 	}
 }
+
+// serveAPIOrgTodos lists the org's todos. Whether the user may see them is
+// decided by the TodoService.
+func serveAPIOrgTodos(env *Env, tdserv models.TodoService, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, err := orgFromURL(ors, r)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		td, err := tdserv.GetByOrgID(org.ID, env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving todos of org %s: %w", org.ID, err))
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, td, nil))
+		return nil
+	}
+}
+
+func serveCreateAPIOrgTodo(env *Env, tdserv models.TodoService, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, err := orgFromURL(ors, r)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		todo := new(models.Todo)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, todo); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		setTodoRelationshipIDs(todo)
+		todo.UserID = env.getUser(r).ID
+		todo.OrgID = org.ID
+		if ve := validateTodo(todo, timeNow()); ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+		if _, err := tdserv.Create(todo); err != nil {
+			return orgAPIError(fmt.Errorf("error creating todo in org %s: %w", org.ID, err))
+		}
+		if todo.RemindAt.Valid {
+			env.wakeReminders()
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusCreated, todo, nil))
+		return nil
+	}
+}
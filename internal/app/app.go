@@ -7,6 +7,7 @@ import (
 
 	"github.com/boltdb/bolt"
 	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
 	"github.com/gorilla/csrf"
 
 	"github.com/ejamesc/auth_demo/pkg/router"
@@ -31,7 +32,23 @@ func SetDB(db *bolt.DB) error {
 func NewRouter(staticFilePath string, env *Env) *router.Router {
 	ustore := &datastore.UserStore{BDB: pdb}
 	sessionStore := &datastore.SessionStore{BDB: pdb, UserStore: ustore}
-	tdstore := &datastore.TodoStore{BDB: pdb}
+	tdstore := &datastore.TodoStore{BDB: pdb, MaxDepth: env.maxDepth}
+	listStore := &datastore.ListStore{BDB: pdb}
+	boardStore := &datastore.BoardStore{BDB: pdb}
+	attachmentStore := &datastore.AttachmentStore{BDB: pdb, Blobs: env.blobs, Quota: env.quota}
+	commentStore := &datastore.CommentStore{BDB: pdb}
+	searchStore := &datastore.SearchStore{BDB: pdb}
+	rememberStore := &datastore.RememberTokenStore{BDB: pdb}
+	accountStore := &datastore.AccountStore{BDB: pdb}
+	adminStore := &datastore.AdminStore{BDB: pdb}
+	auditStore := &datastore.AuditStore{BDB: pdb}
+	orgStore := &datastore.OrgStore{BDB: pdb}
+	signupInviteStore := &datastore.SignupInviteStore{BDB: pdb}
+	identityStore := &datastore.IdentityStore{BDB: pdb}
+	samlStore := &datastore.SAMLStore{BDB: pdb}
+	notificationStore := &datastore.NotificationStore{BDB: pdb}
+	notifiers := newNotifiers(env, notificationStore, ustore)
+	authn := newAuthenticator(env, ustore, sessionStore, identityStore)
 	fakeErrHandler := func(w http.ResponseWriter, req *http.Request, err error) {
 		env.log.Errorf("%+v", err)
 	}
@@ -41,14 +58,23 @@ func NewRouter(staticFilePath string, env *Env) *router.Router {
 	rter := router.New(errHandler, fakeErrHandler)
 	rter.Use(handle404Middleware(env)) // goji only handles 404s here
 	rter.Use(logHandler(env))
-	rter.Use(userMiddleware(env, sessionStore))
+	rter.Use(userMiddleware(env, ustore, sessionStore, rememberStore))
 
 	authM := authMiddleware(env)
+	noImpM := noImpersonationMiddleware(env)
+	// sensitiveM guards pages an impersonating admin shouldn't reach
+	sensitiveM := func(h router.HandlerError) router.HandlerError { return authM(noImpM(h)) }
+	adminM := func(perm models.Permission, h router.HandlerError) router.HandlerError {
+		return sensitiveM(requirePagePermission(env, perm)(h))
+	}
 
 	// TODO: csrf.Secure(false) should not be set during production
 	csrfAPIMdware := csrf.Protect(
 		[]byte(csrfSecretKey),
 		csrf.Secure(false),
+		// One cookie for the whole site, so a form can post to a page under
+		// another path, like the logout form on the sessions page
+		csrf.Path("/"),
 		csrf.ErrorHandler(csrfErrHandler(env)),
 	)
 
@@ -56,9 +82,33 @@ func NewRouter(staticFilePath string, env *Env) *router.Router {
 	rter.HandleE(pat.Get("/c"), authM(serveSPA(env, csrfAPIMdware)))
 	rter.HandleE(pat.Get("/card"), authM(serveSPA(env, csrfAPIMdware)))
 	rter.HandleE(pat.Get("/login"), serveLogin(env))
-	rter.HandleE(pat.Post("/login"), servePostLogin(env, sessionStore))
-	rter.HandleE(pat.Get("/signup"), serveSignup(env))
-	rter.HandleE(pat.Post("/signup"), servePostSignup(env, sessionStore))
+	rter.HandleE(pat.Post("/login"), servePostLogin(env, authn, sessionStore, rememberStore))
+	rter.HandleE(pat.Get("/signup"), serveSignup(env, signupInviteStore))
+	rter.HandleE(pat.Post("/signup"), servePostSignup(env, sessionStore, signupInviteStore))
+	if env.saml != nil {
+		rter.HandleE(pat.Get("/saml/metadata"), serveSAMLMetadata(env))
+		rter.HandleE(pat.Get("/saml/login"), serveSAMLLogin(env, samlStore))
+		// The IdP posts here from its own site, so there's no CSRF token;
+		// the signed response stands in for one
+		rter.HandleE(pat.Post("/saml/acs"), servePostSAMLACS(env, ustore, sessionStore, identityStore, samlStore))
+	}
+	csrfM := csrfHTMLMiddleware(csrfAPIMdware)
+	rter.HandleE(pat.Post("/logout"), csrfM(servePostLogout(env, sessionStore, rememberStore)))
+	rter.HandleE(pat.Get("/settings"), authM(csrfM(serveSettings(env))))
+	rter.HandleE(pat.Post("/settings"), sensitiveM(csrfM(servePostSettings(env, ustore, sessionStore, rememberStore))))
+	rter.HandleE(pat.Get("/settings/export"), sensitiveM(serveAccountExport(env, accountStore, auditStore)))
+	rter.HandleE(pat.Post("/settings/delete"), sensitiveM(csrfM(servePostDeleteAccount(env, ustore))))
+	rter.HandleE(pat.Post("/settings/delete/cancel"), sensitiveM(csrfM(servePostCancelDeleteAccount(env, ustore))))
+	rter.HandleE(pat.Get("/settings/sessions"), authM(csrfM(serveSessions(env, sessionStore))))
+	rter.HandleE(pat.Post("/settings/sessions/:id/revoke"), sensitiveM(csrfM(servePostRevokeSession(env, sessionStore, rememberStore))))
+	rter.HandleE(pat.Get("/admin"), adminM(models.PermUsersRead, csrfM(serveAdminUsers(env, adminStore))))
+	rter.HandleE(pat.Get("/admin/users/:id"), adminM(models.PermUsersRead, csrfM(serveAdminUser(env, ustore, sessionStore))))
+	rter.HandleE(pat.Post("/admin/users/:id/impersonate"), adminM(models.PermUsersImpersonate, csrfM(servePostImpersonate(env, ustore, sessionStore))))
+	rter.HandleE(pat.Post("/admin/users/:id/:action"), adminM(models.PermUsersRead, csrfM(servePostAdminUserAction(env, ustore, adminStore))))
+	rter.HandleE(pat.Get("/todos/:id"), authM(csrfM(serveTodo(env, tdstore))))
+	rter.HandleE(pat.Get("/invitations/:token"), authM(csrfM(serveInvitation(env, orgStore, ustore))))
+	rter.HandleE(pat.Post("/invitations/:token/accept"), sensitiveM(csrfM(servePostAcceptInvitation(env, orgStore))))
+	rter.HandleE(pat.Post("/impersonate/stop"), authM(csrfM(servePostStopImpersonating(env, sessionStore))))
 	rter.Handle(pat.Get("/static/*"), http.FileServer(http.Dir(staticFilePath)))
 
 	apiRtr := router.NewSubMux(apiErrHandler, fakeErrHandler)
@@ -71,12 +121,127 @@ func NewRouter(staticFilePath string, env *Env) *router.Router {
 	v1Rtr.Use(csrfMiddleware(csrfAPIMdware))
 
 	rter.Handle(pat.New("/api/*"), apiRtr)
+
+	apiAuth := authAPIMiddleware(env, ustore, sessionStore, rememberStore)
+	noImpAPIM := noImpersonationAPIMiddleware(env)
+	apiSensitive := func(h router.HandlerError) router.HandlerError { return apiAuth(noImpAPIM(h)) }
+	if env.blobs != nil {
+		// Files are sent as they are rather than as JSON:API documents, so
+		// these are routed before v1Rtr, which only takes JSON:API
+		fileM := func(perm models.Permission, h router.HandlerError) router.HandlerError {
+			return csrfHTMLMiddleware(csrfMiddleware(csrfAPIMdware))(apiAuth(requirePermission(env, perm)(h)))
+		}
+		apiRtr.HandleE(pat.Post("/v1/todos/:id/attachments"), fileM(models.PermTodosWrite, serveAPICreateAttachment(env, attachmentStore)))
+		apiRtr.HandleE(pat.Patch("/v1/uploads/:id"), fileM(models.PermTodosWrite, serveAPIAppendUpload(env, attachmentStore)))
+		apiRtr.HandleE(pat.Get("/v1/attachments/:id/download"), fileM(models.PermTodosRead, serveAPIDownloadAttachment(env, attachmentStore)))
+	}
 	apiRtr.Handle(pat.New("/v1/*"), v1Rtr)
 
-	apiAuth := authAPIMiddleware(env, sessionStore)
-	v1Rtr.HandleE(pat.Post("/login"), serveAPIPostLogin(env, sessionStore))
-	v1Rtr.HandleE(pat.Get("/todos"), apiAuth(serveAPITodo(env)))
-	v1Rtr.HandleE(pat.Post("/todos"), apiAuth(serveCreateAPITodo(env, tdstore)))
+	v1Rtr.HandleE(pat.Post("/login"), serveAPIPostLogin(env, authn, sessionStore))
+	v1Rtr.HandleE(pat.Get("/todos"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPITodo(env, tdstore))))
+	v1Rtr.HandleE(pat.Post("/todos"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveCreateAPITodo(env, tdstore))))
+	v1Rtr.HandleE(pat.Delete("/todos"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIBulkDeleteTodos(env, tdstore))))
+	v1Rtr.HandleE(pat.Patch("/todos/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIPatchTodo(env, tdstore))))
+	v1Rtr.HandleE(pat.Delete("/todos/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteTodo(env, tdstore))))
+	v1Rtr.HandleE(pat.Post("/todos/:id/skip"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPISkipTodo(env, tdstore))))
+	v1Rtr.HandleE(pat.Get("/todos/:id/series"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPITodoSeries(env, tdstore))))
+	v1Rtr.HandleE(pat.Post("/todos/:id/move"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIMoveTodo(env, tdstore))))
+	v1Rtr.HandleE(pat.Get("/todos/:id/children"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPITodoChildren(env, tdstore))))
+	v1Rtr.HandleE(pat.Get("/todos/:id/revisions"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPINoteRevisions(env, tdstore))))
+	v1Rtr.HandleE(pat.Get("/todos/:id/revisions/diff"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPINoteDiff(env, tdstore))))
+	v1Rtr.HandleE(pat.Post("/todos/:id/revisions/:rev/restore"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIRestoreNotes(env, tdstore))))
+	v1Rtr.HandleE(pat.Get("/todos/:id/comments"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPIComments(env, commentStore))))
+	v1Rtr.HandleE(pat.Post("/todos/:id/comments"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPICreateComment(env, commentStore, notifiers))))
+	v1Rtr.HandleE(pat.Patch("/todos/:id/comments/:comment"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIPatchComment(env, commentStore, notifiers))))
+	v1Rtr.HandleE(pat.Delete("/todos/:id/comments/:comment"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteComment(env, commentStore))))
+	if env.blobs != nil {
+		v1Rtr.HandleE(pat.Get("/todos/:id/attachments"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPIAttachments(env, attachmentStore))))
+		v1Rtr.HandleE(pat.Post("/todos/:id/uploads"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPICreateUpload(env, attachmentStore))))
+		v1Rtr.HandleE(pat.Get("/uploads/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIUpload(env, attachmentStore))))
+		v1Rtr.HandleE(pat.Delete("/uploads/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteUpload(env, attachmentStore))))
+		v1Rtr.HandleE(pat.Get("/attachments/:id"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPIAttachment(env, attachmentStore))))
+		v1Rtr.HandleE(pat.Delete("/attachments/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteAttachment(env, attachmentStore))))
+	}
+	v1Rtr.HandleE(pat.Get("/search"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPISearch(env, searchStore))))
+	v1Rtr.HandleE(pat.Get("/trash"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPITrash(env, tdstore, nil))))
+	v1Rtr.HandleE(pat.Delete("/trash"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIEmptyTrash(env, tdstore, nil))))
+	v1Rtr.HandleE(pat.Post("/trash/undo/:token"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIUndoDelete(env, tdstore))))
+	v1Rtr.HandleE(pat.Post("/trash/:id/restore"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIRestoreTodo(env, tdstore))))
+	v1Rtr.HandleE(pat.Get("/lists"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPILists(env, listStore))))
+	v1Rtr.HandleE(pat.Post("/lists"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPICreateList(env, listStore))))
+	v1Rtr.HandleE(pat.Patch("/lists/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIPatchList(env, listStore))))
+	v1Rtr.HandleE(pat.Delete("/lists/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteList(env, listStore))))
+	v1Rtr.HandleE(pat.Get("/labels"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPILabels(env, listStore))))
+	v1Rtr.HandleE(pat.Post("/labels"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPICreateLabel(env, listStore))))
+	v1Rtr.HandleE(pat.Patch("/labels/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIPatchLabel(env, listStore))))
+	v1Rtr.HandleE(pat.Delete("/labels/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteLabel(env, listStore))))
+	v1Rtr.HandleE(pat.Get("/boards"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPIBoards(env, boardStore))))
+	v1Rtr.HandleE(pat.Post("/boards"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPICreateBoard(env, boardStore))))
+	v1Rtr.HandleE(pat.Get("/boards/:id"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPIBoard(env, boardStore))))
+	v1Rtr.HandleE(pat.Patch("/boards/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIPatchBoard(env, boardStore))))
+	v1Rtr.HandleE(pat.Delete("/boards/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteBoard(env, boardStore))))
+	v1Rtr.HandleE(pat.Post("/boards/:id/columns"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPICreateColumn(env, boardStore))))
+	v1Rtr.HandleE(pat.Patch("/columns/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIPatchColumn(env, boardStore))))
+	v1Rtr.HandleE(pat.Post("/columns/:id/move"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIMoveColumn(env, boardStore))))
+	v1Rtr.HandleE(pat.Delete("/columns/:id"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIDeleteColumn(env, boardStore))))
+	v1Rtr.HandleE(pat.Post("/cards/:id/move"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIMoveCard(env, boardStore, tdstore))))
+	v1Rtr.HandleE(pat.Get("/me"), apiAuth(serveAPIMe(env)))
+	v1Rtr.HandleE(pat.Patch("/me"), apiSensitive(serveAPIPatchMe(env, ustore, sessionStore, rememberStore)))
+	v1Rtr.HandleE(pat.Get("/orgs"), apiAuth(serveAPIOrgs(env, orgStore)))
+	v1Rtr.HandleE(pat.Post("/orgs"), apiAuth(serveAPICreateOrg(env, orgStore)))
+	v1Rtr.HandleE(pat.Get("/orgs/:org"), apiAuth(serveAPIOrg(env, orgStore)))
+	v1Rtr.HandleE(pat.Get("/orgs/:org/members"), apiAuth(serveAPIOrgMembers(env, orgStore, ustore)))
+	v1Rtr.HandleE(pat.Patch("/orgs/:org/members/:user"), apiSensitive(serveAPIPatchOrgMember(env, orgStore, ustore)))
+	v1Rtr.HandleE(pat.Delete("/orgs/:org/members/:user"), apiSensitive(serveAPIDeleteOrgMember(env, orgStore)))
+	v1Rtr.HandleE(pat.Get("/orgs/:org/invitations"), apiAuth(serveAPIOrgInvitations(env, orgStore)))
+	v1Rtr.HandleE(pat.Post("/orgs/:org/invitations"), apiSensitive(serveAPICreateOrgInvitation(env, orgStore)))
+	v1Rtr.HandleE(pat.Delete("/orgs/:org/invitations/:id"), apiSensitive(serveAPIDeleteOrgInvitation(env, orgStore)))
+	v1Rtr.HandleE(pat.Post("/orgs/:org/scim_token"), apiSensitive(serveAPICreateOrgSCIMToken(env, orgStore)))
+	v1Rtr.HandleE(pat.Delete("/orgs/:org/scim_token"), apiSensitive(serveAPIDeleteOrgSCIMToken(env, orgStore)))
+	v1Rtr.HandleE(pat.Get("/orgs/:org/todos"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPIOrgTodos(env, tdstore, orgStore))))
+	v1Rtr.HandleE(pat.Post("/orgs/:org/todos"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveCreateAPIOrgTodo(env, tdstore, orgStore))))
+	v1Rtr.HandleE(pat.Get("/orgs/:org/trash"), apiAuth(requirePermission(env, models.PermTodosRead)(serveAPITrash(env, tdstore, orgStore))))
+	v1Rtr.HandleE(pat.Delete("/orgs/:org/trash"), apiAuth(requirePermission(env, models.PermTodosWrite)(serveAPIEmptyTrash(env, tdstore, orgStore))))
+	v1Rtr.HandleE(pat.Get("/signup_invites"), apiAuth(serveAPISignupInvites(env, signupInviteStore)))
+	v1Rtr.HandleE(pat.Post("/signup_invites"), apiSensitive(requirePermission(env, models.PermSignupInvitesCreate)(serveAPICreateSignupInvite(env, signupInviteStore))))
+	v1Rtr.HandleE(pat.Delete("/signup_invites/:id"), apiSensitive(serveAPIDeleteSignupInvite(env, signupInviteStore)))
+	v1Rtr.HandleE(pat.Get("/notifications"), apiAuth(serveAPINotifications(env, notificationStore)))
+	v1Rtr.HandleE(pat.Post("/notifications/:id/read"), apiAuth(serveAPIReadNotification(env, notificationStore)))
+	v1Rtr.HandleE(pat.Get("/sessions"), apiAuth(serveAPISessions(env, sessionStore)))
+	v1Rtr.HandleE(pat.Delete("/sessions/:id"), apiSensitive(serveAPIDeleteSession(env, sessionStore, rememberStore)))
+
+	apiAdmin := func(perm models.Permission, h router.HandlerError) router.HandlerError {
+		return apiSensitive(requirePermission(env, perm)(h))
+	}
+	v1Rtr.HandleE(pat.Get("/admin/roles"), apiAdmin(models.PermUsersRead, serveAPIAdminRoles(env)))
+	v1Rtr.HandleE(pat.Get("/admin/users"), apiAdmin(models.PermUsersRead, serveAPIAdminUsers(env, adminStore)))
+	v1Rtr.HandleE(pat.Get("/admin/users/:id"), apiAdmin(models.PermUsersRead, serveAPIAdminUser(env, ustore)))
+	v1Rtr.HandleE(pat.Patch("/admin/users/:id"), apiAdmin(models.PermUsersRead, serveAPIAdminPatchUser(env, ustore, adminStore)))
+	v1Rtr.HandleE(pat.Get("/admin/users/:id/sessions"), apiAdmin(models.PermUsersRead, serveAPIAdminUserSessions(env, ustore, sessionStore)))
+	v1Rtr.HandleE(pat.Post("/admin/users/:id/logout"), apiAdmin(models.PermUsersLogout, serveAPIAdminLogoutUser(env, ustore, adminStore)))
+	v1Rtr.HandleE(pat.Get("/admin/signup_invites"), apiAdmin(models.PermSignupInvitesManage, serveAPIAdminSignupInvites(env, signupInviteStore)))
+	v1Rtr.HandleE(pat.Get("/admin/audit"), apiAdmin(models.PermAuditRead, serveAPIAdminAudit(env, auditStore)))
+	v1Rtr.HandleE(pat.Get("/admin/audit/verify"), apiAdmin(models.PermAuditRead, serveAPIAdminAuditVerify(env, auditStore)))
+	v1Rtr.HandleE(pat.Get("/admin/audit/export"), apiAdmin(models.PermAuditRead, serveAPIAdminAuditExport(env, auditStore)))
+
+	scimRtr := router.NewSubMux(scimErrorHandler(env), fakeErrHandler)
+	scimRtr.Use(handle404SCIMMiddleware(env))
+	rter.Handle(pat.New(scimBasePath+"/*"), scimRtr)
+
+	scimAuth := scimAuthMiddleware(env, orgStore)
+	scimRtr.HandleE(pat.Get("/ServiceProviderConfig"), scimAuth(serveSCIMServiceProviderConfig(env)))
+	scimRtr.HandleE(pat.Get("/Users"), scimAuth(serveSCIMUsers(env, orgStore, orgStore, ustore)))
+	scimRtr.HandleE(pat.Post("/Users"), scimAuth(serveSCIMCreateUser(env, orgStore, sessionStore)))
+	scimRtr.HandleE(pat.Get("/Users/:id"), scimAuth(serveSCIMUser(env, orgStore, orgStore, ustore)))
+	scimRtr.HandleE(pat.Put("/Users/:id"), scimAuth(serveSCIMReplaceUser(env, orgStore, orgStore, ustore)))
+	scimRtr.HandleE(pat.Patch("/Users/:id"), scimAuth(serveSCIMPatchUser(env, orgStore, orgStore, ustore)))
+	scimRtr.HandleE(pat.Delete("/Users/:id"), scimAuth(serveSCIMDeleteUser(env, orgStore, ustore)))
+	scimRtr.HandleE(pat.Get("/Groups"), scimAuth(serveSCIMGroups(env, orgStore)))
+	scimRtr.HandleE(pat.Post("/Groups"), scimAuth(serveSCIMCreateGroup(env, orgStore, orgStore)))
+	scimRtr.HandleE(pat.Get("/Groups/:id"), scimAuth(serveSCIMGroup(env, orgStore)))
+	scimRtr.HandleE(pat.Put("/Groups/:id"), scimAuth(serveSCIMReplaceGroup(env, orgStore, orgStore)))
+	scimRtr.HandleE(pat.Patch("/Groups/:id"), scimAuth(serveSCIMPatchGroup(env, orgStore, orgStore)))
+	scimRtr.HandleE(pat.Delete("/Groups/:id"), scimAuth(serveSCIMDeleteGroup(env, orgStore)))
 
 	return rter
 }
@@ -94,6 +259,7 @@ func serveSPA(env *Env, csrfmdware func(http.Handler) http.Handler) router.Handl
 			lp := &localPresenter{
 				globalPresenter: env.gp,
 				CSRFToken:       csrf.Token(r),
+				Impersonating:   env.impersonating(r),
 			}
 			env.loe(env.spaRndr.HTML(w, http.StatusOK, "spa", lp))
 		}))
@@ -124,6 +290,7 @@ type localPresenter struct {
 	LocalDescription string
 	CSRFToken        string
 	Flashes          []interface{}
+	Impersonating    string
 	*globalPresenter
 }
 
@@ -0,0 +1,308 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"goji.io/pat"
+)
+
+// maxAttachmentNameLength is how long an attachment's file name can be, in
+// bytes.
+const maxAttachmentNameLength = 255
+
+// uploadOffsetHeader says how much of a resumable upload the server has,
+// and where a part sent to it starts.
+const uploadOffsetHeader = "Upload-Offset"
+
+// uploadPartMediaType is the Content-Type of a part of a resumable upload.
+const uploadPartMediaType = "application/offset+octet-stream"
+
+// uploadChanges starts a resumable upload.
+type uploadChanges struct {
+	ID   string  `jsonapi:"primary,upload"`
+	Name *string `jsonapi:"attr,name"`
+	Size *int64  `jsonapi:"attr,size"`
+}
+
+// attachmentName cleans up the name a file was uploaded with, keeping only
+// its base name without control characters. It's "" if nothing is left.
+func attachmentName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(path.Base(strings.Replace(name, `\`, "/", -1)))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+	for len(name) > maxAttachmentNameLength {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+	return name
+}
+
+func withDownloadURL(atts ...*models.Attachment) {
+	for _, a := range atts {
+		a.DownloadURL = "/api/v1/attachments/" + a.ID + "/download"
+	}
+}
+
+func serveAPIAttachments(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		atts, err := as.GetAttachments(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving attachments: %w", err))
+		}
+		withDownloadURL(atts...)
+		env.loe(env.jsonAPI(w, http.StatusOK, atts))
+		return nil
+	}
+}
+
+func serveAPIAttachment(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		a, err := as.GetAttachment(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving attachment: %w", err))
+		}
+		withDownloadURL(a)
+		env.loe(env.jsonAPI(w, http.StatusOK, a))
+		return nil
+	}
+}
+
+// serveAPICreateAttachment attaches the file sent as the file field of a
+// multipart/form-data request to a todo.
+func serveAPICreateAttachment(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		r.Body = http.MaxBytesReader(w, r.Body, models.MaxAttachmentSize+1048576)
+		mr, err := r.MultipartReader()
+		if err != nil {
+			return aderrors.NewAPIError(http.StatusBadRequest, "The file needs to be sent as multipart/form-data", err)
+		}
+		var ve aderrors.ValidationError
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				ve.Add("file", "file_required", "Choose a file to attach.")
+				return aderrors.NewValidationAPIError(ve)
+			} else if err != nil {
+				return aderrors.NewAPIError(http.StatusBadRequest, "The request body couldn't be read", err)
+			}
+			if part.FormName() != "file" {
+				continue
+			}
+
+			name := attachmentName(part.FileName())
+			if name == "" {
+				ve.Add("file", "name_required", "The file needs a name.")
+				return aderrors.NewValidationAPIError(ve)
+			}
+			sb, err := env.blobs.Stage(part, models.MaxAttachmentSize)
+			if errors.Is(err, aderrors.ErrTooLarge) {
+				ve.Add("file", "file_too_large", fmt.Sprintf("Files can be at most %d MB.", models.MaxAttachmentSize>>20))
+				return aderrors.NewValidationAPIError(ve)
+			} else if err != nil {
+				return aderrors.NewAPIError(http.StatusBadRequest, "The file couldn't be read", err)
+			}
+			if sb.Size == 0 {
+				env.loe(env.blobs.Discard(sb))
+				ve.Add("file", "file_empty", "The file is empty.")
+				return aderrors.NewValidationAPIError(ve)
+			}
+
+			a := &models.Attachment{TodoID: pat.Param(r, "id"), UserID: u.ID, Name: name}
+			if err := as.CreateAttachment(a, sb); err != nil {
+				return orgAPIError(fmt.Errorf("error creating attachment: %w", err))
+			}
+			withDownloadURL(a)
+			env.loe(env.jsonAPI(w, http.StatusCreated, a))
+			return nil
+		}
+	}
+}
+
+// serveAPIDownloadAttachment sends an attachment's file, honouring Range
+// requests. Only images are shown in the browser; anything else is
+// downloaded, and nothing the file holds can run as part of the site.
+func serveAPIDownloadAttachment(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		a, err := as.GetAttachment(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving attachment: %w", err))
+		}
+		blob, err := env.blobs.Open(a.Hash)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error opening blob %s of attachment %s: %w", a.Hash, a.ID, err))
+		}
+		defer blob.Close()
+
+		disposition := "attachment"
+		if strings.HasPrefix(a.ContentType, "image/") {
+			disposition = "inline"
+		}
+		if cd := mime.FormatMediaType(disposition, map[string]string{"filename": a.Name}); cd != "" {
+			disposition = cd
+		}
+		w.Header().Set("Content-Disposition", disposition)
+		w.Header().Set("Content-Type", a.ContentType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; sandbox")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		// Blobs never change, so their hash is as good an ETag as any
+		w.Header().Set("ETag", `"`+a.Hash+`"`)
+		http.ServeContent(w, r, a.Name, a.DateCreated, blob)
+		return nil
+	}
+}
+
+func serveAPIDeleteAttachment(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := as.DeleteAttachment(pat.Param(r, "id"), env.getUser(r).ID); err != nil {
+			return orgAPIError(fmt.Errorf("error deleting attachment: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// serveAPICreateUpload starts a resumable upload of a file to attach to a
+// todo. Its parts are sent to serveAPIAppendUpload.
+func serveAPICreateUpload(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		in := new(uploadChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		var ve aderrors.ValidationError
+		var name string
+		if in.Name != nil {
+			name = attachmentName(*in.Name)
+		}
+		if name == "" {
+			ve.Add("name", "name_required", "The file needs a name.")
+		}
+		switch {
+		case in.Size == nil || *in.Size < 1:
+			ve.Add("size", "size_invalid", "The size needs to be how many bytes the file is.")
+		case *in.Size > models.MaxAttachmentSize:
+			ve.Add("size", "file_too_large", fmt.Sprintf("Files can be at most %d MB.", models.MaxAttachmentSize>>20))
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		up := &models.Upload{UserID: env.getUser(r).ID, TodoID: pat.Param(r, "id"), Name: name, Size: *in.Size}
+		if err := as.CreateUpload(up); err != nil {
+			return orgAPIError(fmt.Errorf("error creating upload: %w", err))
+		}
+		w.Header().Set(uploadOffsetHeader, "0")
+		env.loe(env.jsonAPI(w, http.StatusCreated, up))
+		return nil
+	}
+}
+
+// serveAPIUpload says how much of an upload has arrived, so it can be
+// carried on from there.
+func serveAPIUpload(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		up, err := as.GetUpload(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving upload: %w", err))
+		}
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(up.Offset, 10))
+		env.loe(env.jsonAPI(w, http.StatusOK, up))
+		return nil
+	}
+}
+
+// serveAPIAppendUpload adds the part of a file in the body to an upload.
+// The part's Upload-Offset has to be where the upload has got to. Once
+// the whole file has arrived it's attached, and the attachment is sent
+// back instead of the upload.
+func serveAPIAppendUpload(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		up, err := as.GetUpload(pat.Param(r, "id"), u.ID)
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving upload: %w", err))
+		}
+		if mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mt != uploadPartMediaType {
+			return aderrors.NewAPIError(http.StatusUnsupportedMediaType, "Content-Type header is not "+uploadPartMediaType, nil)
+		}
+		offset, err := strconv.ParseInt(r.Header.Get(uploadOffsetHeader), 10, 64)
+		if err != nil {
+			return aderrors.NewAPIError(http.StatusBadRequest, "The Upload-Offset header needs to be where the part starts", err)
+		}
+		w.Header().Set(uploadOffsetHeader, strconv.FormatInt(up.Offset, 10))
+		if offset != up.Offset {
+			return aderrors.NewAPIError(http.StatusConflict, "The part doesn't start where the upload has got to",
+				fmt.Errorf("upload %s is at %d, not %d", up.ID, up.Offset, offset))
+		}
+
+		n, err := env.blobs.Append(up.ID, offset, r.Body, up.Size)
+		if n > up.Offset {
+			if serr := as.SetUploadOffset(up.ID, u.ID, n); serr != nil {
+				return aderrors.New500APIError(fmt.Errorf("error updating upload: %w", serr))
+			}
+			up.Offset = n
+			w.Header().Set(uploadOffsetHeader, strconv.FormatInt(n, 10))
+		}
+		switch {
+		case errors.Is(err, aderrors.ErrUploadOffset):
+			return aderrors.NewAPIError(http.StatusConflict, "The upload is being added to by another request", err)
+		case errors.Is(err, aderrors.ErrTooLarge):
+			var ve aderrors.ValidationError
+			ve.Add("size", "upload_too_large", fmt.Sprintf("The upload was started as %d bytes, and this would make it bigger.", up.Size))
+			return aderrors.NewValidationAPIError(ve)
+		case err != nil:
+			return aderrors.NewAPIError(http.StatusBadRequest, "The part couldn't be read. Carry on from Upload-Offset", err)
+		}
+		if up.Offset < up.Size {
+			env.loe(env.jsonAPI(w, http.StatusOK, up))
+			return nil
+		}
+
+		sb, err := env.blobs.StageUpload(up.ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error staging upload %s: %w", up.ID, err))
+		}
+		a, err := as.CompleteUpload(up.ID, u.ID, sb)
+		if err != nil {
+			// It can't be finished, so there's no use keeping it
+			env.loe(as.DeleteUpload(up.ID, u.ID))
+			return orgAPIError(fmt.Errorf("error completing upload: %w", err))
+		}
+		withDownloadURL(a)
+		env.loe(env.jsonAPI(w, http.StatusCreated, a))
+		return nil
+	}
+}
+
+func serveAPIDeleteUpload(env *Env, as models.AttachmentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := as.DeleteUpload(pat.Param(r, "id"), env.getUser(r).ID); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error deleting upload: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -0,0 +1,202 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"github.com/sirupsen/logrus"
+)
+
+// recordAudit adds the event to the audit log, along with where the request
+// came from. The actor defaults to the logged in user. When an admin is
+// impersonating the user, the admin is the actor, acting on behalf of the
+// user. Failing to record an event doesn't fail the request.
+func (e *Env) recordAudit(r *http.Request, ev *models.AuditEvent) {
+	if r != nil {
+		ev.SetClient(clientInfo(r))
+		u := e.getUser(r)
+		if ev.ActorID == "" && u != nil {
+			ev.ActorID = u.ID
+		}
+		if admin := e.getImpersonator(r); admin != nil && u != nil && ev.ActorID == u.ID {
+			ev.ActorID = admin.ID
+			if ev.Details == nil {
+				ev.Details = map[string]string{}
+			}
+			ev.Details["on_behalf_of"] = u.ID
+		}
+	}
+	if e.audit == nil {
+		return
+	}
+	if err := e.audit.Record(ev); err != nil {
+		e.log.WithFields(logrus.Fields{
+			"error":     err,
+			"action":    ev.Action,
+			"actor_id":  ev.ActorID,
+			"target_id": ev.TargetID,
+		}).Error("error recording audit event")
+	}
+}
+
+// AuditLog returns the audit log in the database set with SetDB, for the
+// command line.
+func AuditLog() (models.AuditService, error) {
+	if pdb == nil {
+		return nil, errors.New("db has not been set")
+	}
+	return &datastore.AuditStore{BDB: pdb}, nil
+}
+
+// apiAuditEvent is a models.AuditEvent as returned by the api.
+type apiAuditEvent struct {
+	ID        string            `jsonapi:"primary,audit_event"`
+	Time      time.Time         `jsonapi:"attr,time,iso8601"`
+	Action    string            `jsonapi:"attr,action"`
+	ActorID   string            `jsonapi:"attr,actor_id,omitempty"`
+	TargetID  string            `jsonapi:"attr,target_id,omitempty"`
+	IP        string            `jsonapi:"attr,ip,omitempty"`
+	UserAgent string            `jsonapi:"attr,user_agent,omitempty"`
+	Details   map[string]string `jsonapi:"attr,details,omitempty"`
+	PrevHash  string            `jsonapi:"attr,prev_hash"`
+	Hash      string            `jsonapi:"attr,hash"`
+}
+
+func newAPIAuditEvent(e *models.AuditEvent) *apiAuditEvent {
+	return &apiAuditEvent{
+		ID:        e.ID,
+		Time:      e.Time,
+		Action:    e.Action,
+		ActorID:   e.ActorID,
+		TargetID:  e.TargetID,
+		IP:        e.IP,
+		UserAgent: e.UserAgent,
+		Details:   e.Details,
+		PrevHash:  e.PrevHash,
+		Hash:      e.Hash,
+	}
+}
+
+// apiAuditVerification is the result of checking the audit log's hash chain.
+type apiAuditVerification struct {
+	ID            string `jsonapi:"primary,audit_verification"`
+	Valid         bool   `jsonapi:"attr,valid"`
+	EventsChecked int    `jsonapi:"attr,events_checked"`
+	BrokenEventID string `jsonapi:"attr,broken_event_id,omitempty"`
+	Problem       string `jsonapi:"attr,problem,omitempty"`
+}
+
+// auditQueryFromFilters reads the filter[...] and page[...] query parameters
+// of the audit log endpoint. Times are RFC 3339.
+func auditQueryFromFilters(r *http.Request) (models.AuditQuery, error) {
+	q := r.URL.Query()
+	aq := models.AuditQuery{
+		ActorID:  q.Get("filter[actor]"),
+		TargetID: q.Get("filter[target]"),
+		UserID:   q.Get("filter[user]"),
+		Action:   q.Get("filter[action]"),
+		Before:   q.Get("page[before]"),
+		Limit:    defaultPageSize,
+	}
+	for key, t := range map[string]*time.Time{"filter[since]": &aq.Since, "filter[until]": &aq.Until} {
+		if v := q.Get(key); v != "" {
+			parsed, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return aq, aderrors.NewAPIError(http.StatusBadRequest, key+" must be an RFC 3339 time", err)
+			}
+			*t = parsed
+		}
+	}
+	if size, err := strconv.Atoi(q.Get("page[size]")); err == nil && size > 0 {
+		aq.Limit = size
+	}
+	if aq.Limit > maxPageSize {
+		aq.Limit = maxPageSize
+	}
+	return aq, nil
+}
+
+// serveAPIAdminAudit lists audit events, newest first. Pages are walked with
+// the next link, which asks for the events before the last one returned.
+func serveAPIAdminAudit(env *Env, aud models.AuditService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		aq, err := auditQueryFromFilters(r)
+		if err != nil {
+			return err
+		}
+		events, err := aud.Query(aq)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error querying audit log: %w", err))
+		}
+
+		res := []*apiAuditEvent{}
+		for _, e := range events {
+			res = append(res, newAPIAuditEvent(e))
+		}
+		p, err := jsonapi.Marshal(res)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error marshalling audit events: %w", err))
+		}
+		payload := p.(*jsonapi.ManyPayload)
+		links := jsonapi.Links{"self": r.URL.RequestURI()}
+		if len(events) == aq.Limit {
+			q := r.URL.Query()
+			q.Set("page[before]", events[len(events)-1].ID)
+			next := *r.URL
+			next.RawQuery = q.Encode()
+			links["next"] = next.RequestURI()
+		}
+		payload.Links = &links
+
+		w.Header().Set("Content-Type", jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		env.loe(json.NewEncoder(w).Encode(payload))
+		return nil
+	}
+}
+
+// serveAPIAdminAuditVerify checks the audit log's hash chain. A broken chain
+// is still a 200; it's the answer to the question.
+func serveAPIAdminAuditVerify(env *Env, aud models.AuditService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		n, err := aud.Verify()
+		res := &apiAuditVerification{ID: timeNow().Format(time.RFC3339), Valid: err == nil, EventsChecked: n}
+		var chainErr *models.AuditChainError
+		if errors.As(err, &chainErr) {
+			res.BrokenEventID, res.Problem = chainErr.EventID, chainErr.Problem
+			env.log.WithFields(logrus.Fields{"event_id": chainErr.EventID, "problem": chainErr.Problem}).Error("audit log chain broken")
+		} else if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error verifying audit log: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// serveAPIAdminAuditExport streams the whole audit log as newline-delimited
+// JSON, oldest first, with the hashes needed to verify it elsewhere.
+func serveAPIAdminAuditExport(env *Env, aud models.AuditService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		filename := fmt.Sprintf("auth_demo-audit-%s.ndjson", timeNow().Format("2006-01-02"))
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+		enc := json.NewEncoder(w)
+		err := aud.ForEach(func(e *models.AuditEvent) error {
+			return enc.Encode(e)
+		})
+		if err != nil {
+			// Headers are gone by now, so all we can do is log it
+			env.log.WithField("error", err).Error("error exporting audit log")
+		}
+		return nil
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
@@ -28,12 +30,18 @@ func serveLogin(env *Env) router.HandlerError {
 			Flashes:         fs,
 			globalPresenter: env.gp,
 		}
-		env.loe(env.rndr.HTML(w, http.StatusOK, "login", lp))
+		env.loe(env.rndr.HTML(w, http.StatusOK, "login", &loginPresenter{localPresenter: lp, SSO: env.saml != nil}))
 		return nil
 	}
 }
 
-func servePostLogin(env *Env, sdb models.SessionService) router.HandlerError {
+type loginPresenter struct {
+	*localPresenter
+	// SSO is whether users can log in through an identity provider.
+	SSO bool
+}
+
+func servePostLogin(env *Env, authn models.Authenticator, sdb models.SessionService, rdb models.RememberTokenService) router.HandlerError {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		email, pass := r.FormValue("email"), r.FormValue("password")
 		if !govalidator.IsEmail(email) {
@@ -50,97 +58,204 @@ func servePostLogin(env *Env, sdb models.SessionService) router.HandlerError {
 			return aderrors.NewError(http.StatusBadRequest, "no password provided", nil)
 		}
 
-		u, err := sdb.GetUserByEmail(email)
-		if err != nil {
-			if errors.Is(err, aderrors.ErrNoRecords) {
-				env.saveFlash(w, r, "Your email or password were incorrect.")
-				// check pass to prevent timing attack, so extra
-				u = &models.User{}
-				u.CheckPassword(pass)
-				http.Redirect(w, r, "/login", http.StatusFound)
-				return aderrors.NewError(http.StatusBadRequest, "no user found", nil).WithFields(
-					logrus.Fields{"email": email})
-			} else {
-				return aderrors.New500Error("error with retrieving user in login", err)
-			}
-		}
-
-		passOK := u.CheckPassword(pass)
-		if !passOK {
+		a, err := authn.Authenticate(email, pass)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			env.saveFlash(w, r, "Your email or password were incorrect.")
+			env.recordAudit(r, loginFailedEvent("", email, "no_such_user"))
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "no user found", nil).WithFields(
+				logrus.Fields{"email": email})
+		} else if errors.Is(err, aderrors.ErrWrongPassword) {
+			env.recordAudit(r, loginFailedEvent(a.User.ID, email, "wrong_password"))
 			env.saveFlash(w, r, "Your email or password were incorrect")
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return aderrors.NewError(http.StatusBadRequest, "no user found", nil).WithFields(
 				logrus.Fields{"email": email})
+		} else if err != nil {
+			return aderrors.New500Error("error with authenticating user in login", err)
+		}
+		env.recordAuthentication(r, a)
+		u := a.User
+		if u.IsLocked() {
+			env.recordAudit(r, loginFailedEvent(u.ID, email, "locked"))
+			env.saveFlash(w, r, "This account has been locked. Please contact support.")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusForbidden, "locked user tried to log in", nil).WithFields(
+				logrus.Fields{"user_id": u.ID})
 		}
 
-		sess, err := sdb.CreateSession(u.ID, false)
+		opts := models.SessionOptions{Client: clientInfo(r)}
+		if r.FormValue("remember") != "" {
+			token, rt, err := rdb.CreateRememberToken(u.ID, "")
+			if err != nil {
+				return aderrors.New500Error("error creating remember token for user", err).WithFields(logrus.Fields{"user_id": u.ID})
+			}
+			opts.RememberFamilyID = rt.FamilyID
+			env.loe(env.saveRememberCookie(w, r, token))
+		}
+
+		sess, err := sdb.CreateSession(u.ID, false, opts)
 		if err != nil {
 			return aderrors.New500Error("error creating session for user", err).WithFields(logrus.Fields{"session": printStruct(sess)})
 		}
-		cookieStore, _ := env.store.Get(r, sessionNameConst)
-		cookieStore.Values[sessionKeyConst] = sess.ID
-		cookieStore.Save(r, w)
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditLoginSucceeded,
+			ActorID:  u.ID,
+			TargetID: u.ID,
+			Details: map[string]string{
+				"session_id": sess.ID,
+				"remember":   strconv.FormatBool(opts.RememberFamilyID != ""),
+				"method":     a.Method,
+			},
+		})
+		env.loe(env.saveSessionCookie(w, r, sess.ID))
 		http.Redirect(w, r, "/c", http.StatusFound)
 		return nil
 	}
 }
 
-func serveSignup(env *Env) router.HandlerError {
+// servePostLogout ends the current session, along with any remember tokens
+// that were issued with it. Logging out while impersonating only stops the
+// impersonation.
+func servePostLogout(env *Env, sdb models.SessionService, rdb models.RememberTokenService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if env.getImpersonator(r) != nil {
+			return stopImpersonating(env, sdb, w, r)
+		}
+		sID := env.getSessionID(r)
+		env.clearAuthCookies(w, r)
+		if sID != "" {
+			if err := endSession(sdb, rdb, sID); err != nil {
+				return aderrors.New500Error("error deleting session on logout", err).WithFields(logrus.Fields{"session_id": sID})
+			}
+			u := env.getUser(r)
+			env.recordAudit(r, &models.AuditEvent{Action: models.AuditLogout, TargetID: u.ID, Details: map[string]string{"session_id": sID}})
+		}
+		http.Redirect(w, r, "/login", http.StatusFound)
+		return nil
+	}
+}
+
+// endSession deletes the session and revokes the remember token family it
+// was logged in with, if any.
+func endSession(sdb models.SessionService, rdb models.RememberTokenService, sessionID string) error {
+	sess, err := sdb.GetSession(sessionID)
+	if err != nil {
+		if errors.Is(err, aderrors.ErrNoRecords) || errors.Is(err, aderrors.ErrExpired) {
+			return nil
+		}
+		return err
+	}
+	if sess.RememberFamilyID != "" {
+		if _, err := rdb.DeleteRememberTokenFamily(sess.RememberFamilyID); err != nil {
+			return err
+		}
+	}
+	_, err = sdb.DeleteSession(sess.ID)
+	return err
+}
+
+// signupPresenter is used to render the signup page, which changes with
+// the signup mode.
+type signupPresenter struct {
+	*localPresenter
+	Mode           models.SignupMode
+	AllowedDomains []string
+	Invite         string
+	InviteProblem  string
+}
+
+func serveSignup(env *Env, sis models.SignupInviteService) router.HandlerError {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		if u := env.getUser(r); u != nil {
 			http.Redirect(w, r, "/c", http.StatusFound)
 			return nil
 		}
 		fs := env.getFlash(w, r)
-		lp := &localPresenter{
-			PageTitle:       "Sign Up",
-			PageURL:         "/signup",
-			Flashes:         fs,
-			globalPresenter: env.gp,
+		sp := &signupPresenter{
+			localPresenter: &localPresenter{
+				PageTitle:       "Sign Up",
+				PageURL:         "/signup",
+				Flashes:         fs,
+				globalPresenter: env.gp,
+			},
+			Mode:           env.signup.Mode,
+			AllowedDomains: env.signup.AllowedDomains,
+			Invite:         strings.TrimSpace(r.FormValue("invite")),
+		}
+		if sp.Invite != "" && sp.Mode != models.SignupClosed {
+			problem, err := signupInviteProblem(sis, sp.Invite)
+			if err != nil {
+				return aderrors.New500Error("error retrieving signup invite", err)
+			}
+			sp.InviteProblem = problem
 		}
-		env.loe(env.rndr.HTML(w, http.StatusOK, "signup", lp))
+		env.loe(env.rndr.HTML(w, http.StatusOK, "signup", sp))
 		return nil
 	}
 }
 
-func servePostSignup(env *Env, sdb models.SessionService) router.HandlerError {
+// servePostSignup creates an account, if the signup mode allows it. An
+// invite code, if given, is only redeemed once everything else checks out.
+func servePostSignup(env *Env, sdb models.SessionService, sis models.SignupInviteService) router.HandlerError {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		email := strings.TrimSpace(r.FormValue("email"))
 		pass := r.FormValue("password")
 		username := strings.TrimSpace(r.FormValue("username"))
+		invite := strings.TrimSpace(r.FormValue("invite"))
+		signupURL := "/signup"
+		if invite != "" {
+			signupURL += "?invite=" + url.QueryEscape(invite)
+		}
+
+		if env.signup.Mode == models.SignupClosed {
+			env.saveFlash(w, r, "Sorry, we aren't taking signups right now.")
+			http.Redirect(w, r, "/signup", http.StatusFound)
+			return aderrors.NewError(http.StatusForbidden, "signups are closed", nil)
+		}
 
 		if !govalidator.IsEmail(email) {
 			env.saveFlash(w, r, "That's not a valid email.")
-			http.Redirect(w, r, "/signup", http.StatusFound)
+			http.Redirect(w, r, signupURL, http.StatusFound)
 			return aderrors.NewError(http.StatusBadRequest, "invalid email provided", nil)
 		}
 
-		if strings.TrimSpace(pass) == "" {
-			env.saveFlash(w, r, "You need to provide a password!")
-			http.Redirect(w, r, "/signup", http.StatusFound)
-			return aderrors.NewError(http.StatusBadRequest, "no password provided", nil)
+		if invite == "" && env.signup.NeedsInvite(email) {
+			if env.signup.Mode == models.SignupDomains {
+				env.saveFlash(w, r, fmt.Sprintf("You need an invite to sign up, unless your email is at %s.", strings.Join(env.signup.AllowedDomains, " or ")))
+			} else {
+				env.saveFlash(w, r, "You need an invite to sign up.")
+			}
+			http.Redirect(w, r, signupURL, http.StatusFound)
+			return aderrors.NewError(http.StatusForbidden, "signup without a needed invite", nil).WithFields(logrus.Fields{"email": email})
 		}
 
 		username = strings.ToLower(strings.Replace(username, " ", "_", -1))
 		if username == "" {
 			env.saveFlash(w, r, "You need to provide a username!")
-			http.Redirect(w, r, "/signup", http.StatusFound)
+			http.Redirect(w, r, signupURL, http.StatusFound)
 			return aderrors.NewError(http.StatusBadRequest, "no username provided", nil)
 		}
 
 		if len(username) < 2 {
 			env.saveFlash(w, r, "A username needs to be at least 2 characters long.")
-			http.Redirect(w, r, "/signup", http.StatusFound)
+			http.Redirect(w, r, signupURL, http.StatusFound)
 			return aderrors.NewError(http.StatusBadRequest, "username too short", nil)
 		}
 
+		if err := env.pwPolicy.Check("password", pass, username, email); err != nil {
+			env.saveFieldErrorFlashes(w, r, err)
+			http.Redirect(w, r, signupURL, http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "password rejected by policy", err)
+		}
+
 		u, err := sdb.GetUserByEmail(email)
 		if err != nil && err != aderrors.ErrNoRecords {
 			return aderrors.New500Error("error getting user from db", err)
 		}
 		if u != nil {
 			env.saveFlash(w, r, "That email is already taken!")
-			http.Redirect(w, r, "/signup", http.StatusFound)
+			http.Redirect(w, r, signupURL, http.StatusFound)
 			return aderrors.NewError(http.StatusBadRequest, "email already taken", nil).WithFields(logrus.Fields{"email": email})
 		}
 
@@ -152,7 +267,7 @@ func servePostSignup(env *Env, sdb models.SessionService) router.HandlerError {
 		if u != nil {
 			env.log.WithField("user", u).Println("there is a user with that username")
 			env.saveFlash(w, r, "That username is already taken!")
-			http.Redirect(w, r, "/signup", http.StatusFound)
+			http.Redirect(w, r, signupURL, http.StatusFound)
 			return aderrors.NewError(http.StatusBadRequest, "username already taken", nil).WithFields(logrus.Fields{"username": username})
 		}
 
@@ -169,29 +284,57 @@ func servePostSignup(env *Env, sdb models.SessionService) router.HandlerError {
 		u.GenerateID()
 		u.SetPassword(pass)
 
-		ok, err := sdb.CreateUser(u)
-		if !ok || err != nil {
-			return aderrors.New500Error("error creating user during signup", err).WithFields(logrus.Fields{"user": printStruct(u)})
+		// The invite is only used up when it's needed to sign up
+		if env.signup.NeedsInvite(email) {
+			_, err := sis.RedeemSignupInvite(invite, u)
+			if errors.Is(err, aderrors.ErrNoRecords) || errors.Is(err, aderrors.ErrExpired) {
+				problem, _ := signupInviteProblem(sis, invite)
+				env.saveFlash(w, r, problem)
+				http.Redirect(w, r, signupURL, http.StatusFound)
+				return aderrors.NewError(http.StatusForbidden, "signup with an unusable invite", err).WithFields(logrus.Fields{"email": email})
+			}
+			if err != nil {
+				return aderrors.New500Error("error creating user with a signup invite during signup", err).WithFields(logrus.Fields{"user": printStruct(u)})
+			}
+		} else {
+			ok, err := sdb.CreateUser(u)
+			if !ok || err != nil {
+				return aderrors.New500Error("error creating user during signup", err).WithFields(logrus.Fields{"user": printStruct(u)})
+			}
 		}
 
-		sess, err := sdb.CreateSession(u.ID, false)
+		ev := &models.AuditEvent{Action: models.AuditSignup, ActorID: u.ID, TargetID: u.ID}
+		if u.D.SignupInviteID != "" {
+			ev.Details = map[string]string{"signup_invite_id": u.D.SignupInviteID}
+		}
+		env.recordAudit(r, ev)
+
+		sess, err := sdb.CreateSession(u.ID, false, models.SessionOptions{Client: clientInfo(r)})
 		if err != nil {
 			return aderrors.New500Error("error creating session for user", err).WithFields(logrus.Fields{"session": printStruct(sess)})
 		}
-		cookieStore, _ := env.store.Get(r, sessionNameConst)
-		cookieStore.Values[sessionKeyConst] = sess.ID
-		cookieStore.Save(r, w)
+		env.loe(env.saveSessionCookie(w, r, sess.ID))
 		http.Redirect(w, r, "/c", http.StatusFound)
 		return nil
 	}
 }
 
+// loginFailedEvent is the audit event for a failed login. userID is empty
+// when nobody has that email.
+func loginFailedEvent(userID, email, reason string) *models.AuditEvent {
+	return &models.AuditEvent{
+		Action:   models.AuditLoginFailed,
+		TargetID: userID,
+		Details:  map[string]string{"email": email, "reason": reason},
+	}
+}
+
 type apiLoginStruct struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
 }
 
-func serveAPIPostLogin(env *Env, sdb models.SessionService) router.HandlerError {
+func serveAPIPostLogin(env *Env, authn models.Authenticator, sdb models.SessionService) router.HandlerError {
 	return func(w http.ResponseWriter, r *http.Request) error {
 		var alogin apiLoginStruct
 		err := json.NewDecoder(r.Body).Decode(&alogin)
@@ -212,33 +355,40 @@ func serveAPIPostLogin(env *Env, sdb models.SessionService) router.HandlerError
 			return apiErr
 		}
 
-		u, err := sdb.GetUserByEmail(alogin.Email)
-		if err != nil {
-			if errors.Is(err, aderrors.ErrNoRecords) {
-				// check pass to prevent timing attack, so extra
-				u = &models.User{}
-				u.CheckPassword(alogin.Password)
-				apiErr := aderrors.NewAPIError(http.StatusBadRequest, "no user found", fmt.Errorf("No user found")).WithFields(
-					logrus.Fields{"email": alogin.Email})
-				return apiErr
-			} else {
-				apiErr := aderrors.New500APIError(fmt.Errorf("error retrieving user: %w", err))
-				return apiErr
-			}
-		}
-
-		passOK := u.CheckPassword(alogin.Password)
-		if !passOK {
+		a, err := authn.Authenticate(alogin.Email, alogin.Password)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			env.recordAudit(r, loginFailedEvent("", alogin.Email, "no_such_user"))
+			apiErr := aderrors.NewAPIError(http.StatusBadRequest, "no user found", fmt.Errorf("No user found")).WithFields(
+				logrus.Fields{"email": alogin.Email})
+			return apiErr
+		} else if errors.Is(err, aderrors.ErrWrongPassword) {
+			env.recordAudit(r, loginFailedEvent(a.User.ID, alogin.Email, "wrong_password"))
 			apiErr := aderrors.NewAPIError(http.StatusBadRequest, "your email or password was incorrect", fmt.Errorf("Password check failed")).WithFields(
 				logrus.Fields{"email": alogin.Email})
 			return apiErr
+		} else if err != nil {
+			apiErr := aderrors.New500APIError(fmt.Errorf("error authenticating user: %w", err))
+			return apiErr
+		}
+		env.recordAuthentication(r, a)
+		u := a.User
+		if u.IsLocked() {
+			env.recordAudit(r, loginFailedEvent(u.ID, alogin.Email, "locked"))
+			return aderrors.NewAPIError(http.StatusForbidden, "this account has been locked", fmt.Errorf("Account is locked")).WithFields(
+				logrus.Fields{"user_id": u.ID})
 		}
 
-		sess, err := sdb.CreateSession(u.ID, true)
+		sess, err := sdb.CreateSession(u.ID, true, models.SessionOptions{Client: clientInfo(r)})
 		if err != nil {
 			apiErr := aderrors.New500APIError(fmt.Errorf("error creating session for user: %w", err)).WithFields(logrus.Fields{"session": printStruct(sess)})
 			return apiErr
 		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditTokenCreated,
+			ActorID:  u.ID,
+			TargetID: u.ID,
+			Details:  map[string]string{"session_id": sess.ID, "method": a.Method},
+		})
 		env.loe(env.jsonAPI(w, http.StatusCreated, &tokenStruct{ID: sess.Token}))
 		return nil
 	}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/ldap"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// LDAPConfig turns on logging in with the email and password of a user in
+// an LDAP directory. Users who aren't in it can still log in with their
+// password here.
+type LDAPConfig struct {
+	Directory *ldap.Directory
+	// LinkByEmail links a directory user to the account with the same
+	// email the first time they log in. Otherwise they log in to it with
+	// its own password.
+	LinkByEmail bool
+	// DisableProvisioning stops accounts being created for directory users
+	// who don't have one.
+	DisableProvisioning bool
+}
+
+// provider is what users in the directory are linked under.
+func (lc *LDAPConfig) provider() string {
+	return "ldap:" + lc.Directory.URL
+}
+
+// newAuthenticator returns what checks the passwords users log in with:
+// the directory if there is one, and then the passwords kept here.
+func newAuthenticator(env *Env, udb models.UserService, sdb models.SessionService, ids models.IdentityService) models.Authenticator {
+	chain := authenticatorChain{env: env}
+	if env.ldap != nil {
+		chain.as = append(chain.as, &ldapAuthenticator{env: env, udb: udb, sdb: sdb, ids: ids})
+	}
+	chain.as = append(chain.as, &passwordAuthenticator{sdb: sdb})
+	return chain
+}
+
+// authenticatorChain tries each authenticator until one knows the user.
+// One that fails is skipped, so local users can still log in when the
+// directory is down, but its error is returned if no other knows the user.
+type authenticatorChain struct {
+	env *Env
+	as  []models.Authenticator
+}
+
+func (ac authenticatorChain) Authenticate(email, password string) (*models.Authentication, error) {
+	var firstErr error
+	for _, a := range ac.as {
+		authn, err := a.Authenticate(email, password)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			continue
+		} else if err != nil && !errors.Is(err, aderrors.ErrWrongPassword) {
+			ac.env.log.WithFields(logrus.Fields{"error": err, "email": email}).Error("error authenticating user")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		return authn, err
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+	return nil, aderrors.ErrNoRecords
+}
+
+// passwordAuthenticator checks the password hashes kept here.
+type passwordAuthenticator struct {
+	sdb models.SessionService
+}
+
+func (pa *passwordAuthenticator) Authenticate(email, password string) (*models.Authentication, error) {
+	u, err := pa.sdb.CheckPassword(email, password)
+	if errors.Is(err, aderrors.ErrWrongPassword) {
+		return &models.Authentication{User: u, Method: "password"}, err
+	} else if err != nil {
+		return nil, err
+	}
+	return &models.Authentication{User: u, Method: "password"}, nil
+}
+
+// ldapAuthenticator checks passwords against the directory, giving users
+// found there an account the first time they log in.
+type ldapAuthenticator struct {
+	env *Env
+	udb models.UserService
+	sdb models.SessionService
+	ids models.IdentityService
+}
+
+func (la *ldapAuthenticator) Authenticate(email, password string) (*models.Authentication, error) {
+	cfg := la.env.ldap
+	du, err := cfg.Directory.Authenticate(email, password)
+	if errors.Is(err, ldap.ErrNoSuchUser) {
+		return nil, aderrors.ErrNoRecords
+	} else if err != nil && !errors.Is(err, ldap.ErrInvalidCredentials) {
+		return nil, err
+	}
+	wrongPassword := err != nil
+
+	a := &models.Authentication{Method: "ldap"}
+	li, err := la.ids.GetIdentity(cfg.provider(), du.ID)
+	if err == nil {
+		if a.User, err = la.udb.Get(li.UserID); err != nil {
+			return nil, err
+		}
+		if wrongPassword {
+			return a, aderrors.ErrWrongPassword
+		}
+		la.env.loe(la.ids.RecordIdentityLogin(cfg.provider(), du.ID))
+		return a, nil
+	} else if !errors.Is(err, aderrors.ErrNoRecords) {
+		return nil, err
+	}
+
+	// Directory users without an account here yet are left to the
+	// password authenticator until they get the password right.
+	if wrongPassword {
+		return nil, aderrors.ErrNoRecords
+	}
+	if e := strings.ToLower(strings.TrimSpace(du.Email)); govalidator.IsEmail(e) {
+		email = e
+	}
+	u, err := la.sdb.GetUserByEmail(email)
+	switch {
+	case err == nil && !cfg.LinkByEmail:
+		return nil, aderrors.ErrNoRecords
+	case errors.Is(err, aderrors.ErrNoRecords) && cfg.DisableProvisioning:
+		return nil, aderrors.ErrNoRecords
+	case errors.Is(err, aderrors.ErrNoRecords):
+		if u, err = provisionUser(la.sdb, email, du.Username, du.Name); err != nil {
+			return nil, err
+		}
+		a.Created = true
+	case err != nil:
+		return nil, err
+	}
+	a.User = u
+
+	a.Linked = &models.LinkedIdentity{Provider: cfg.provider(), Subject: du.ID, UserID: u.ID, Email: email}
+	if _, err := la.ids.LinkIdentity(a.Linked); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// recordAuthentication audits the account that was made for, and the
+// identity that was linked to, a user when they logged in.
+func (e *Env) recordAuthentication(r *http.Request, a *models.Authentication) {
+	if a.Created {
+		e.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditSignup,
+			ActorID:  a.User.ID,
+			TargetID: a.User.ID,
+			Details:  map[string]string{"method": a.Method},
+		})
+	}
+	if a.Linked != nil {
+		e.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditIdentityLinked,
+			ActorID:  a.User.ID,
+			TargetID: a.User.ID,
+			Details:  map[string]string{"provider": a.Linked.Provider, "subject": a.Linked.Subject},
+		})
+	}
+}
+
+// provisionUser creates an account for a user logging in through an
+// identity provider for the first time, with a username based on the one
+// they have there, or else their email. They can't log in with a password
+// until they reset it.
+func provisionUser(sdb models.SessionService, email, username, name string) (*models.User, error) {
+	base := username
+	if base == "" {
+		base = email[:strings.Index(email, "@")]
+	}
+	base = strings.ToLower(strings.Replace(strings.TrimSpace(base), " ", "_", -1))
+	if len(base) < 2 {
+		base = "user"
+	}
+	username, err := freeUsername(sdb, base)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &models.User{
+		Email:    email,
+		Username: username,
+		Name:     name,
+		D:        &models.UserMetadata{IsFirstTime: true},
+	}
+	u.GenerateID()
+	if err := u.SetRandomPassword(); err != nil {
+		return nil, err
+	}
+	if ok, err := sdb.CreateUser(u); !ok || err != nil {
+		return nil, fmt.Errorf("error creating user: %w", err)
+	}
+	return u, nil
+}
+
+// freeUsername returns username, or if it's taken, it with the first number
+// after it that isn't.
+func freeUsername(sdb models.SessionService, username string) (string, error) {
+	for i := 1; ; i++ {
+		try := username
+		if i > 1 {
+			try = username + strconv.Itoa(i)
+		}
+		_, err := sdb.GetUserByUsername(try)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			return try, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
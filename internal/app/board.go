@@ -0,0 +1,317 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"goji.io/pat"
+)
+
+// boardChanges is a board as sent to create or PATCH it.
+type boardChanges struct {
+	ID   string  `jsonapi:"primary,board"`
+	Name *string `jsonapi:"attr,name"`
+}
+
+// columnChanges is a column as sent to create or PATCH it. Attributes left
+// out of a PATCH aren't changed, and a WIP limit of 0 removes it.
+type columnChanges struct {
+	ID       string  `jsonapi:"primary,column"`
+	Name     *string `jsonapi:"attr,name"`
+	WIPLimit *int    `jsonapi:"attr,wip_limit"`
+}
+
+// columnMove is where to move a column on its board: after the column with
+// the ID after or before the one with the ID before, or last if both are
+// left out.
+type columnMove struct {
+	ID     string  `jsonapi:"primary,column"`
+	After  *string `jsonapi:"attr,after"`
+	Before *string `jsonapi:"attr,before"`
+}
+
+// cardMove is where to move a todo on the boards. Leaving out column_id
+// keeps it in its column, and "" takes it off its board. after and before
+// are as in columnMove, among the cards in the column.
+type cardMove struct {
+	ID       string  `jsonapi:"primary,todo"`
+	ColumnID *string `jsonapi:"attr,column_id"`
+	After    *string `jsonapi:"attr,after"`
+	Before   *string `jsonapi:"attr,before"`
+}
+
+func validateWIPLimit(ve *aderrors.ValidationError, limit *int) {
+	if limit != nil && *limit < 0 {
+		ve.Add("wip_limit", "wip_limit_invalid", "The WIP limit can't be negative. Use 0 for no limit.")
+	}
+}
+
+// boardIncluded keeps the columns and cards of the boards in a document,
+// and the cards' lists and labels, so a board comes whole. Cards' parents
+// that aren't on a board, and the boards the columns link back to, are
+// left out.
+func boardIncluded(boards ...*models.Board) func(n *jsonapi.Node) bool {
+	cards := map[string]bool{}
+	for _, b := range boards {
+		for _, td := range b.Cards {
+			cards[td.ID] = true
+		}
+	}
+	return func(n *jsonapi.Node) bool {
+		switch n.Type {
+		case "column", "list", "label":
+			return true
+		case "todo":
+			return cards[n.ID]
+		}
+		return false
+	}
+}
+
+func serveAPIBoards(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		boards, err := bs.GetBoardsByUserID(env.getUser(r).ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving boards: %w", err))
+		}
+		env.loe(env.jsonAPIFiltered(w, http.StatusOK, boards, boardIncluded(boards...)))
+		return nil
+	}
+}
+
+// serveAPIBoard returns a board with its columns and cards in one compound
+// document.
+func serveAPIBoard(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		b, err := bs.GetBoard(env.getUser(r).ID, pat.Param(r, "id"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving board: %w", err))
+		}
+		env.loe(env.jsonAPIFiltered(w, http.StatusOK, b, boardIncluded(b)))
+		return nil
+	}
+}
+
+func serveAPICreateBoard(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		in := new(boardChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, false)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		b := &models.Board{UserID: env.getUser(r).ID, Name: *in.Name}
+		b.GenerateID()
+		if err := bs.CreateBoard(b); err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error creating board: %w", err))
+		}
+		env.loe(env.jsonAPIFiltered(w, http.StatusCreated, b, boardIncluded(b)))
+		return nil
+	}
+}
+
+func serveAPIPatchBoard(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		b, err := bs.GetBoard(env.getUser(r).ID, pat.Param(r, "id"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving board: %w", err))
+		}
+		in := new(boardChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.ID != "" && in.ID != b.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "The board's ID doesn't match the URL",
+				fmt.Errorf("board %s patched with ID %s", b.ID, in.ID))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, true)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		if in.Name != nil {
+			b.Name = *in.Name
+		}
+		if err := bs.UpdateBoard(b); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error updating board: %w", err))
+		}
+		env.loe(env.jsonAPIFiltered(w, http.StatusOK, b, boardIncluded(b)))
+		return nil
+	}
+}
+
+// serveAPIDeleteBoard deletes a board and its columns. The cards on it are
+// kept as todos.
+func serveAPIDeleteBoard(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := bs.DeleteBoard(env.getUser(r).ID, pat.Param(r, "id")); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error deleting board: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// serveAPICreateColumn adds a column to the end of a board.
+func serveAPICreateColumn(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		in := new(columnChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, false)
+		validateWIPLimit(&ve, in.WIPLimit)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		c := &models.Column{UserID: env.getUser(r).ID, BoardID: pat.Param(r, "id"), Name: *in.Name}
+		if in.WIPLimit != nil {
+			c.WIPLimit = *in.WIPLimit
+		}
+		c.GenerateID()
+		if err := bs.CreateColumn(c); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error creating column: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusCreated, c))
+		return nil
+	}
+}
+
+func serveAPIPatchColumn(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		c, err := bs.GetColumn(env.getUser(r).ID, pat.Param(r, "id"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving column: %w", err))
+		}
+		in := new(columnChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.ID != "" && in.ID != c.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "The column's ID doesn't match the URL",
+				fmt.Errorf("column %s patched with ID %s", c.ID, in.ID))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, true)
+		validateWIPLimit(&ve, in.WIPLimit)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		if in.Name != nil {
+			c.Name = *in.Name
+		}
+		if in.WIPLimit != nil {
+			c.WIPLimit = *in.WIPLimit
+		}
+		if err := bs.UpdateColumn(c); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error updating column: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, c))
+		return nil
+	}
+}
+
+func serveAPIMoveColumn(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		in := new(columnMove)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		id := pat.Param(r, "id")
+		if in.ID != "" && in.ID != id {
+			return aderrors.NewAPIError(http.StatusConflict, "The column's ID doesn't match the URL",
+				fmt.Errorf("column %s moved with ID %s", id, in.ID))
+		}
+		m := &models.ColumnMove{}
+		if in.After != nil {
+			m.AfterID = *in.After
+		}
+		if in.Before != nil {
+			m.BeforeID = *in.Before
+		}
+		c, err := bs.MoveColumn(env.getUser(r).ID, id, m)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error moving column: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, c))
+		return nil
+	}
+}
+
+// serveAPIDeleteColumn deletes a column, taking its cards off the board.
+func serveAPIDeleteColumn(env *Env, bs models.BoardService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := bs.DeleteColumn(env.getUser(r).ID, pat.Param(r, "id")); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error deleting column: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// serveAPIMoveCard puts a todo in a column, moves it within or between
+// columns, or takes it off its board, changing its column and position
+// together.
+func serveAPIMoveCard(env *Env, bs models.BoardService, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+		td, err := tdserv.Get(pat.Param(r, "id"))
+		if err == nil && td.OrgID == "" && td.UserID != u.ID {
+			err = aderrors.ErrNoRecords
+		}
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving todo: %w", err))
+		}
+		in := new(cardMove)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.ID != "" && in.ID != td.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "The todo's ID doesn't match the URL",
+				fmt.Errorf("card %s moved with ID %s", td.ID, in.ID))
+		}
+
+		m := &models.CardMove{ColumnID: td.ColumnID}
+		if in.ColumnID != nil {
+			m.ColumnID = *in.ColumnID
+		}
+		if in.After != nil {
+			m.AfterID = *in.After
+		}
+		if in.Before != nil {
+			m.BeforeID = *in.Before
+		}
+		if m.ColumnID == "" && (m.AfterID != "" || m.BeforeID != "") {
+			var ve aderrors.ValidationError
+			ve.Add("column", "column_required", "Only a card in a column can be moved after or before others.")
+			return aderrors.NewValidationAPIError(ve)
+		}
+		if td, err = bs.MoveCard(u.ID, td.ID, m); err != nil {
+			return orgAPIError(fmt.Errorf("error moving card: %w", err))
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, td, include))
+		return nil
+	}
+}
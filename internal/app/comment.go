@@ -0,0 +1,149 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"goji.io/pat"
+)
+
+// mentionExcerptLength is how much of a comment, in characters, is quoted
+// in the notifications of the users it mentions.
+const mentionExcerptLength = 280
+
+// commentChanges creates or edits a comment.
+type commentChanges struct {
+	ID   string  `jsonapi:"primary,comment"`
+	Body *string `jsonapi:"attr,body"`
+}
+
+// readCommentChanges reads the comment's body from the request.
+func readCommentChanges(w http.ResponseWriter, r *http.Request) (string, error) {
+	in := new(commentChanges)
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+		return "", handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+	}
+	var ve aderrors.ValidationError
+	var body string
+	if in.Body != nil {
+		body = strings.TrimSpace(*in.Body)
+	}
+	switch {
+	case body == "":
+		ve.Add("body", "body_required", "Write something to comment.")
+	case utf8.RuneCountInString(body) > models.MaxCommentLength:
+		ve.Add("body", "body_too_long", fmt.Sprintf("Comments can't be longer than %d characters.", models.MaxCommentLength))
+	}
+	if ve.HasErrors() {
+		return "", aderrors.NewValidationAPIError(ve)
+	}
+	return body, nil
+}
+
+// notifyMentions tells the users the comment mentions, besides those in
+// already, who were told when they were first mentioned.
+func notifyMentions(env *Env, notifiers []models.Notifier, c *models.Comment, author *models.User, already []string) {
+	told := map[string]bool{}
+	for _, id := range already {
+		told[id] = true
+	}
+	for _, id := range c.MentionIDs {
+		if told[id] {
+			continue
+		}
+		n := mentionNotification(c, author, id)
+		for _, nt := range notifiers {
+			if err := nt.Notify(n); err != nil {
+				env.loe(fmt.Errorf("error notifying mention through %s: %w", nt.Name(), err))
+			}
+		}
+	}
+}
+
+// mentionNotification is what a user mentioned in the comment is told.
+// Its ID is the same however many times they're mentioned in it.
+func mentionNotification(c *models.Comment, author *models.User, userID string) *models.Notification {
+	body := c.Body
+	if utf8.RuneCountInString(body) > mentionExcerptLength {
+		body = string([]rune(body)[:mentionExcerptLength]) + "…"
+	}
+	return &models.Notification{
+		ID:     "mention-" + c.ID + "-" + userID,
+		UserID: userID,
+		Kind:   models.NotificationCommentMention,
+		Title:  author.Username + " mentioned you in a comment",
+		Body:   body,
+		TodoID: c.TodoID,
+	}
+}
+
+func serveAPIComments(env *Env, cs models.CommentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		comments, err := cs.GetComments(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving comments: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, comments))
+		return nil
+	}
+}
+
+func serveAPICreateComment(env *Env, cs models.CommentService, notifiers []models.Notifier) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		body, err := readCommentChanges(w, r)
+		if err != nil {
+			return err
+		}
+		u := env.getUser(r)
+		c := &models.Comment{TodoID: pat.Param(r, "id"), UserID: u.ID, Body: body}
+		if err := cs.CreateComment(c); err != nil {
+			return orgAPIError(fmt.Errorf("error creating comment: %w", err))
+		}
+		notifyMentions(env, notifiers, c, u, nil)
+		env.loe(env.jsonAPI(w, http.StatusCreated, c))
+		return nil
+	}
+}
+
+// serveAPIPatchComment edits a comment's body. Only users newly mentioned
+// by the edit are notified.
+func serveAPIPatchComment(env *Env, cs models.CommentService, notifiers []models.Notifier) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		todoID, id := pat.Param(r, "id"), pat.Param(r, "comment")
+		old, err := cs.GetComment(todoID, id, u.ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving comment: %w", err))
+		}
+		body, err := readCommentChanges(w, r)
+		if err != nil {
+			return err
+		}
+		c := &models.Comment{ID: id, TodoID: todoID, Body: body}
+		if err := cs.UpdateComment(c, u.ID); err != nil {
+			return orgAPIError(fmt.Errorf("error updating comment: %w", err))
+		}
+		notifyMentions(env, notifiers, c, u, old.MentionIDs)
+		env.loe(env.jsonAPI(w, http.StatusOK, c))
+		return nil
+	}
+}
+
+// serveAPIDeleteComment soft deletes a comment, returning what's left of it.
+func serveAPIDeleteComment(env *Env, cs models.CommentService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		c, err := cs.DeleteComment(pat.Param(r, "id"), pat.Param(r, "comment"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error deleting comment: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, c))
+		return nil
+	}
+}
@@ -1,9 +1,16 @@
 package app
 
 import (
+	"encoding/json"
+	"errors"
 	"net/http"
+	"time"
 
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/mail"
 	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/password"
 
 	"github.com/ejamesc/jsonapi"
 	"github.com/gorilla/sessions"
@@ -12,14 +19,55 @@ import (
 )
 
 type Env struct {
-	rndr    *render.Render
-	spaRndr *render.Render
-	gp      *globalPresenter
-	log     *logrus.Logger
-	store   *sessions.CookieStore
+	rndr     *render.Render
+	spaRndr  *render.Render
+	gp       *globalPresenter
+	log      *logrus.Logger
+	store    *sessions.CookieStore
+	pwPolicy *password.Policy
+	mailer   mail.Mailer
+	audit    models.AuditService
+	signup   models.SignupPolicy
+	saml     *SAMLConfig
+	ldap     *LDAPConfig
+	maxDepth int
+	blobs    models.BlobStore
+	quota    int64
+	// trashRetention is how long todos stay in the trash.
+	trashRetention time.Duration
+	// reminderWake wakes the reminder dispatcher when a reminder is
+	// scheduled, in case it's due before the one it's waiting for.
+	reminderWake chan struct{}
 }
 
-func NewEnv(logr *logrus.Logger, templatesPath string) *Env {
+// Config holds the settings the app is started with.
+// Zero values fall back to sensible defaults.
+type Config struct {
+	PasswordPolicy *password.Policy
+	Mailer         mail.Mailer
+	// Audit defaults to the audit log in the database set with SetDB.
+	Audit models.AuditService
+	// Signup defaults to open signups.
+	Signup models.SignupPolicy
+	// SAML turns on logging in through a SAML IdP when it's set.
+	SAML *SAMLConfig
+	// LDAP turns on logging in with directory passwords when it's set.
+	LDAP *LDAPConfig
+	// MaxTodoDepth is how deep subtasks can be nested, which defaults to
+	// models.DefaultMaxTodoDepth.
+	MaxTodoDepth int
+	// Blobs turns on attaching files to todos when it's set.
+	Blobs models.BlobStore
+	// AttachmentQuota is how many bytes of attachments each user can
+	// have, which defaults to models.DefaultAttachmentQuota.
+	AttachmentQuota int64
+	// TrashRetention is how long deleted todos stay in the trash before
+	// they're deleted for good, which defaults to
+	// models.DefaultTrashRetention.
+	TrashRetention time.Duration
+}
+
+func NewEnv(logr *logrus.Logger, templatesPath string, cfg Config) *Env {
 	renderOpts := render.Options{
 		Directory:     templatesPath,
 		Extensions:    []string{".html"},
@@ -27,10 +75,41 @@ func NewEnv(logr *logrus.Logger, templatesPath string) *Env {
 		IsDevelopment: true,
 	}
 	e := &Env{
-		rndr:  render.New(renderOpts),
-		log:   logr,
-		gp:    getGlobalPresenter(),
-		store: sessions.NewCookieStore([]byte(cookieSecretKey)),
+		rndr:     render.New(renderOpts),
+		log:      logr,
+		gp:       getGlobalPresenter(),
+		store:    sessions.NewCookieStore([]byte(cookieSecretKey)),
+		pwPolicy: cfg.PasswordPolicy,
+		mailer:   cfg.Mailer,
+		audit:    cfg.Audit,
+		signup:   cfg.Signup,
+		saml:     cfg.SAML,
+		ldap:     cfg.LDAP,
+		maxDepth: cfg.MaxTodoDepth,
+		blobs:    cfg.Blobs,
+		quota:    cfg.AttachmentQuota,
+
+		trashRetention: cfg.TrashRetention,
+
+		reminderWake: make(chan struct{}, 1),
+	}
+	if e.pwPolicy == nil {
+		e.pwPolicy = password.DefaultPolicy()
+	}
+	if e.mailer == nil {
+		e.mailer = &mail.LogMailer{Log: logr}
+	}
+	if e.signup.Mode == "" {
+		e.signup.Mode = models.SignupOpen
+	}
+	if e.quota == 0 {
+		e.quota = models.DefaultAttachmentQuota
+	}
+	if e.trashRetention == 0 {
+		e.trashRetention = models.DefaultTrashRetention
+	}
+	if e.audit == nil && pdb != nil {
+		e.audit = &datastore.AuditStore{BDB: pdb}
 	}
 
 	renderOpts.Layout = ""
@@ -59,6 +138,43 @@ func (e *Env) getUser(r *http.Request) *models.User {
 	return user
 }
 
+// saveFieldErrorFlashes adds a flash message for every field in a
+// ValidationError. It returns false if err isn't a ValidationError.
+func (e *Env) saveFieldErrorFlashes(w http.ResponseWriter, r *http.Request, err error) bool {
+	var ve aderrors.ValidationError
+	if !errors.As(err, &ve) {
+		return false
+	}
+	session, _ := e.store.Get(r, sessionNameConst)
+	for _, f := range ve.Fields {
+		session.AddFlash(f.Message)
+	}
+	e.loe(session.Save(r, w))
+	return true
+}
+
+// getImpersonator returns the admin acting as the current user, if any.
+func (e *Env) getImpersonator(r *http.Request) *models.User {
+	u, _ := r.Context().Value(impersonatorKeyConst).(*models.User)
+	return u
+}
+
+// impersonating returns the username of the user being impersonated, for
+// the banner shown on every page during impersonation.
+func (e *Env) impersonating(r *http.Request) string {
+	if e.getImpersonator(r) == nil {
+		return ""
+	}
+	return e.getUser(r).Username
+}
+
+// getSessionID returns the ID of the session the current request was
+// authenticated with, if any.
+func (e *Env) getSessionID(r *http.Request) string {
+	sID, _ := r.Context().Value(sessionIDKeyConst).(string)
+	return sID
+}
+
 func (e *Env) saveFlash(w http.ResponseWriter, req *http.Request, msg string) error {
 	session, err := e.store.Get(req, sessionNameConst)
 	if err != nil {
@@ -73,6 +189,77 @@ func (e *Env) saveFlash(w http.ResponseWriter, req *http.Request, msg string) er
 	return nil
 }
 
+// saveSessionCookie logs the browser in to the given session. The cookie
+// only lasts until the browser is closed; "remember me" is handled by a
+// separate cookie.
+func (e *Env) saveSessionCookie(w http.ResponseWriter, r *http.Request, sessionID string) error {
+	session, _ := e.store.Get(r, sessionNameConst)
+	opts := *e.store.Options
+	opts.MaxAge = 0
+	opts.HttpOnly = true
+	session.Options = &opts
+	session.Values[sessionKeyConst] = sessionID
+	delete(session.Values, impersonatorSessionKeyConst)
+	return session.Save(r, w)
+}
+
+// saveImpersonationCookie logs the browser in to an impersonation session,
+// keeping the admin's own session ID so it can be restored afterwards.
+func (e *Env) saveImpersonationCookie(w http.ResponseWriter, r *http.Request, sessionID, adminSessionID string) error {
+	if err := e.saveSessionCookie(w, r, sessionID); err != nil {
+		return err
+	}
+	session, _ := e.store.Get(r, sessionNameConst)
+	session.Values[impersonatorSessionKeyConst] = adminSessionID
+	return session.Save(r, w)
+}
+
+// getImpersonatorSessionID returns the admin's own session ID saved when
+// they started impersonating, if any.
+func (e *Env) getImpersonatorSessionID(r *http.Request) string {
+	session, err := e.store.Get(r, sessionNameConst)
+	if err != nil {
+		return ""
+	}
+	sID, _ := session.Values[impersonatorSessionKeyConst].(string)
+	return sID
+}
+
+// saveRememberCookie stores a remember token on the browser.
+func (e *Env) saveRememberCookie(w http.ResponseWriter, r *http.Request, token string) error {
+	session, _ := e.store.Get(r, rememberNameConst)
+	opts := *e.store.Options
+	opts.MaxAge = int(models.RememberTokenLifetime / time.Second)
+	opts.HttpOnly = true
+	session.Options = &opts
+	session.Values[rememberKeyConst] = token
+	return session.Save(r, w)
+}
+
+// getRememberToken returns the remember token stored on the browser, if any.
+func (e *Env) getRememberToken(r *http.Request) string {
+	session, err := e.store.Get(r, rememberNameConst)
+	if err != nil {
+		return ""
+	}
+	tok, _ := session.Values[rememberKeyConst].(string)
+	return tok
+}
+
+// clearAuthCookies logs the browser out by removing both the session
+// and the remember cookies.
+func (e *Env) clearAuthCookies(w http.ResponseWriter, r *http.Request) {
+	session, _ := e.store.Get(r, sessionNameConst)
+	delete(session.Values, sessionKeyConst)
+	delete(session.Values, impersonatorSessionKeyConst)
+	e.loe(session.Save(r, w))
+
+	remember, _ := e.store.Get(r, rememberNameConst)
+	remember.Options.MaxAge = -1
+	remember.Values = map[interface{}]interface{}{}
+	e.loe(remember.Save(r, w))
+}
+
 // loe stands for 'log on error'
 func (e *Env) loe(err error) {
 	if err != nil {
@@ -86,6 +273,41 @@ func (e *Env) jsonAPI(w http.ResponseWriter, statusCode int, obj interface{}) er
 	return jsonapi.MarshalPayload(w, obj)
 }
 
+// jsonAPIIncluded is like jsonAPI, except that only related resources of
+// the types in include are put in the document's "included", as asked for
+// with ?include=. The relationships themselves are always there.
+func (e *Env) jsonAPIIncluded(w http.ResponseWriter, statusCode int, obj interface{}, include map[string]bool) error {
+	return e.jsonAPIFiltered(w, statusCode, obj, func(n *jsonapi.Node) bool { return include[n.Type] })
+}
+
+// jsonAPIFiltered is like jsonAPI, except that only the related resources
+// keep returns true for are put in the document's "included".
+func (e *Env) jsonAPIFiltered(w http.ResponseWriter, statusCode int, obj interface{}, keep func(n *jsonapi.Node) bool) error {
+	payload, err := jsonapi.Marshal(obj)
+	if err != nil {
+		return err
+	}
+	switch p := payload.(type) {
+	case *jsonapi.OnePayload:
+		p.Included = filterIncluded(p.Included, keep)
+	case *jsonapi.ManyPayload:
+		p.Included = filterIncluded(p.Included, keep)
+	}
+	w.Header().Set("Content-Type", jsonapi.MediaType)
+	w.WriteHeader(statusCode)
+	return json.NewEncoder(w).Encode(payload)
+}
+
+func filterIncluded(nodes []*jsonapi.Node, keep func(n *jsonapi.Node) bool) []*jsonapi.Node {
+	var included []*jsonapi.Node
+	for _, n := range nodes {
+		if keep(n) {
+			included = append(included, n)
+		}
+	}
+	return included
+}
+
 func (e *Env) jsonAPIErr(w http.ResponseWriter, statusCode int, errorObjs []*jsonapi.ErrorObject) error {
 	w.Header().Set("Content-Type", jsonapi.MediaType)
 	w.WriteHeader(statusCode)
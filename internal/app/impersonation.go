@@ -0,0 +1,158 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/sirupsen/logrus"
+	"goji.io/pat"
+)
+
+var errImpersonationRevoked = errors.New("impersonator can no longer impersonate the user")
+
+// withImpersonator attaches the admin to the request if the session is an
+// impersonation. If the admin has since been locked, deleted or lost the
+// right to impersonate the user, the session is ended and
+// errImpersonationRevoked is returned.
+func withImpersonator(r *http.Request, udb models.UserService, sdb models.SessionService, sessionID string, u *models.User) (*http.Request, error) {
+	sess, err := sdb.GetSession(sessionID)
+	if err != nil {
+		return r, err
+	}
+	if !sess.IsImpersonation() {
+		return r, nil
+	}
+	admin, err := udb.Get(sess.ImpersonatorID)
+	if err != nil && !errors.Is(err, aderrors.ErrNoRecords) {
+		return r, err
+	}
+	if admin == nil || admin.IsLocked() || !admin.CanImpersonate(u) {
+		if _, err := sdb.DeleteSession(sess.ID); err != nil {
+			return r, err
+		}
+		return r, errImpersonationRevoked
+	}
+	ctx := context.WithValue(r.Context(), impersonatorKeyConst, admin)
+	return r.WithContext(ctx), nil
+}
+
+// noImpersonationMiddleware keeps admins who are acting as a user away from
+// sensitive pages, such as changing the password or deleting the account.
+func noImpersonationMiddleware(env *Env) func(next router.HandlerError) router.HandlerError {
+	return func(next router.HandlerError) router.HandlerError {
+		fn := func(w http.ResponseWriter, r *http.Request) error {
+			if admin := env.getImpersonator(r); admin != nil {
+				env.saveFlash(w, r, "You can't do that while impersonating a user.")
+				http.Redirect(w, r, "/c", http.StatusFound)
+				return aderrors.NewError(http.StatusForbidden, "sensitive action blocked during impersonation", nil).WithFields(
+					logrus.Fields{"admin_id": admin.ID, "user_id": env.getUser(r).ID, "path": r.URL.Path})
+			}
+			return next(w, r)
+		}
+		return fn
+	}
+}
+
+// noImpersonationAPIMiddleware is noImpersonationMiddleware for api endpoints.
+func noImpersonationAPIMiddleware(env *Env) func(next router.HandlerError) router.HandlerError {
+	return func(next router.HandlerError) router.HandlerError {
+		fn := func(w http.ResponseWriter, r *http.Request) error {
+			if admin := env.getImpersonator(r); admin != nil {
+				return aderrors.NewAPIError(http.StatusForbidden, "You can't do that while impersonating a user",
+					fmt.Errorf("admin %s tried %s %s while impersonating", admin.ID, r.Method, r.URL.Path))
+			}
+			return next(w, r)
+		}
+		return fn
+	}
+}
+
+// servePostImpersonate starts an impersonation session for the user. The
+// admin's own session is kept, and restored when they stop.
+func servePostImpersonate(env *Env, udb models.UserService, sdb models.SessionService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		admin := env.getUser(r)
+		id := pat.Param(r, "id")
+		userURL := "/admin/users/" + id
+		fields := logrus.Fields{"admin_id": admin.ID, "user_id": id}
+
+		target, err := udb.Get(id)
+		if err != nil {
+			if errors.Is(err, aderrors.ErrNoRecords) {
+				env.saveFlash(w, r, "That user doesn't exist.")
+				http.Redirect(w, r, "/admin", http.StatusFound)
+				return aderrors.New404Error("no such user", err).WithFields(fields)
+			}
+			return aderrors.New500Error("error retrieving user", err).WithFields(fields)
+		}
+		if !admin.CanImpersonate(target) {
+			env.saveFlash(w, r, "You don't have permission to impersonate that user.")
+			http.Redirect(w, r, userURL, http.StatusFound)
+			return aderrors.NewError(http.StatusForbidden, "impersonation not permitted", nil).WithFields(fields)
+		}
+
+		sess, err := sdb.CreateSession(target.ID, false, models.SessionOptions{
+			Client:         clientInfo(r),
+			ImpersonatorID: admin.ID,
+		})
+		if err != nil {
+			return aderrors.New500Error("error creating impersonation session", err).WithFields(fields)
+		}
+		env.loe(env.saveImpersonationCookie(w, r, sess.ID, env.getSessionID(r)))
+		fields["session_id"] = sess.ID
+		env.log.WithFields(fields).Info("impersonation started")
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditImpersonationStarted,
+			TargetID: target.ID,
+			Details:  map[string]string{"session_id": sess.ID},
+		})
+		http.Redirect(w, r, "/c", http.StatusFound)
+		return nil
+	}
+}
+
+func servePostStopImpersonating(env *Env, sdb models.SessionService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if env.getImpersonator(r) == nil {
+			http.Redirect(w, r, "/c", http.StatusFound)
+			return nil
+		}
+		return stopImpersonating(env, sdb, w, r)
+	}
+}
+
+// stopImpersonating ends the impersonation session and logs the admin back
+// in to their own session, if it is still valid. Otherwise the browser is
+// logged out, and the admin's remember cookie gets a chance to log them in.
+func stopImpersonating(env *Env, sdb models.SessionService, w http.ResponseWriter, r *http.Request) error {
+	admin, u := env.getImpersonator(r), env.getUser(r)
+	sID := env.getSessionID(r)
+	fields := logrus.Fields{"admin_id": admin.ID, "user_id": u.ID, "session_id": sID}
+	if _, err := sdb.DeleteSession(sID); err != nil && !errors.Is(err, aderrors.ErrNoRecords) {
+		return aderrors.New500Error("error ending impersonation session", err).WithFields(fields)
+	}
+	env.log.WithFields(fields).Info("impersonation stopped")
+	env.recordAudit(r, &models.AuditEvent{
+		Action:   models.AuditImpersonationStopped,
+		ActorID:  admin.ID,
+		TargetID: u.ID,
+		Details:  map[string]string{"session_id": sID},
+	})
+
+	adminSID := env.getImpersonatorSessionID(r)
+	if adminSess, err := sdb.GetSession(adminSID); err == nil && adminSess.UserID == admin.ID {
+		env.loe(env.saveSessionCookie(w, r, adminSID))
+	} else {
+		session, _ := env.store.Get(r, sessionNameConst)
+		delete(session.Values, sessionKeyConst)
+		delete(session.Values, impersonatorSessionKeyConst)
+		env.loe(session.Save(r, w))
+	}
+	http.Redirect(w, r, "/admin/users/"+u.ID, http.StatusFound)
+	return nil
+}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// job is a task that runs in the background every interval.
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+}
+
+// StartJobs starts the background jobs, and the dispatcher sending todo
+// reminders. They run until ctx is cancelled;
+// wait on the returned WaitGroup to know when they have all stopped.
+// SetDB must be called first.
+func StartJobs(ctx context.Context, env *Env) *sync.WaitGroup {
+	accountStore := &datastore.AccountStore{BDB: pdb}
+	sessionStore := &datastore.SessionStore{BDB: pdb, UserStore: &datastore.UserStore{BDB: pdb}}
+	jobs := []job{
+		{name: "purge deleted accounts", interval: time.Hour, run: purgeDeletedAccounts(env, accountStore)},
+		{name: "purge trash", interval: time.Hour, run: purgeTrash(env, &datastore.TodoStore{BDB: pdb, MaxDepth: env.maxDepth})},
+		{name: "purge expired logins", interval: time.Hour, run: purgeExpiredLogins(env, sessionStore, &datastore.RememberTokenStore{BDB: pdb})},
+	}
+	if env.blobs != nil {
+		attachmentStore := &datastore.AttachmentStore{BDB: pdb, Blobs: env.blobs, Quota: env.quota}
+		jobs = append(jobs, job{name: "clean up attachments", interval: 10 * time.Minute, run: cleanUpAttachments(env, attachmentStore)})
+	}
+
+	reminders := &reminderDispatcher{
+		env:       env,
+		rs:        &datastore.ReminderStore{BDB: pdb},
+		tds:       &datastore.TodoStore{BDB: pdb, MaxDepth: env.maxDepth},
+		notifiers: newNotifiers(env, &datastore.NotificationStore{BDB: pdb}, &datastore.UserStore{BDB: pdb}),
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		reminders.run(ctx)
+	}()
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			runJob(ctx, env, j)
+		}(j)
+	}
+	return &wg
+}
+
+func runJob(ctx context.Context, env *Env, j job) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		runJobOnce(ctx, env, j)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// runJobOnce runs the job, making sure a panic doesn't take the server down.
+func runJobOnce(ctx context.Context, env *Env, j job) {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := make([]byte, 1024*8)
+			stack = stack[:runtime.Stack(stack, false)]
+			env.log.WithFields(logrus.Fields{
+				"job":   j.name,
+				"error": err,
+				"stack": string(stack),
+			}).Error("job PANIC")
+		}
+	}()
+	if err := j.run(ctx); err != nil {
+		env.log.WithFields(logrus.Fields{
+			"job":   j.name,
+			"error": err,
+		}).Error("job failed")
+	}
+}
+
+// cleanUpAttachments deletes uploads that were never finished, then the
+// blobs no attachment uses any more.
+func cleanUpAttachments(env *Env, as models.AttachmentService) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		ids, err := as.DeleteExpiredUploads(timeNow().Add(-models.UploadExpiry))
+		if len(ids) > 0 {
+			env.log.WithField("uploads", len(ids)).Info("deleted expired uploads")
+		}
+		if err != nil {
+			return err
+		}
+		n, err := as.DeleteUnusedBlobs()
+		if n > 0 {
+			env.log.WithField("blobs", n).Info("deleted unused blobs")
+		}
+		return err
+	}
+}
+
+// purgeTrash deletes the todos that have been in the trash for longer than
+// the trash retention for good.
+func purgeTrash(env *Env, tdserv models.TodoService) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		n, err := tdserv.PurgeTrash(timeNow().Add(-env.trashRetention))
+		if n > 0 {
+			env.log.WithField("todos", n).Info("purged trash")
+		}
+		return err
+	}
+}
+
+// purgeExpiredLogins deletes the sessions and remember tokens that have
+// expired.
+func purgeExpiredLogins(env *Env, sdb models.SessionService, rdb models.RememberTokenService) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		now := timeNow()
+		n, err := sdb.PurgeExpiredSessions(now)
+		if n > 0 {
+			env.log.WithField("sessions", n).Info("purged expired sessions")
+		}
+		if err != nil {
+			return err
+		}
+		n, err = rdb.PurgeExpiredRememberTokens(now)
+		if n > 0 {
+			env.log.WithField("remember_tokens", n).Info("purged expired remember tokens")
+		}
+		return err
+	}
+}
+
+// purgeDeletedAccounts hard deletes the accounts whose deletion grace
+// period has run out.
+func purgeDeletedAccounts(env *Env, adb models.AccountService) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		users, err := adb.GetUsersDueForDeletion(timeNow())
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if _, err := adb.Purge(u.ID); err != nil {
+				env.log.WithFields(logrus.Fields{
+					"error":   err,
+					"user_id": u.ID,
+				}).Error("error purging deleted account")
+				continue
+			}
+			env.log.WithField("user_id", u.ID).Info("purged deleted account")
+			env.recordAudit(nil, &models.AuditEvent{
+				Action:   models.AuditAccountPurged,
+				TargetID: u.ID,
+				Details:  map[string]string{"deletion_time": u.DeletionTime.Format(time.RFC3339)},
+			})
+		}
+		return nil
+	}
+}
@@ -0,0 +1,222 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"goji.io/pat"
+)
+
+const maxListNameLength = 80
+
+var colorRe = regexp.MustCompile(`^#[0-9a-f]{6}$`)
+
+// listChanges is a list or label as sent to create or PATCH it. Attributes
+// left out of a PATCH aren't changed.
+type listChanges struct {
+	ID    string  `jsonapi:"primary,list"`
+	Name  *string `jsonapi:"attr,name"`
+	Color *string `jsonapi:"attr,color"`
+}
+
+type labelChanges struct {
+	ID    string  `jsonapi:"primary,label"`
+	Name  *string `jsonapi:"attr,name"`
+	Color *string `jsonapi:"attr,color"`
+}
+
+// validateListName trims the name, adding to ve what's wrong with it. A
+// nil name is left out, which is only allowed if it's optional.
+func validateListName(ve *aderrors.ValidationError, name *string, optional bool) {
+	if name == nil {
+		if !optional {
+			ve.Add("name", "name_required", "It needs a name.")
+		}
+		return
+	}
+	*name = strings.TrimSpace(*name)
+	if *name == "" {
+		ve.Add("name", "name_required", "It needs a name.")
+	} else if len([]rune(*name)) > maxListNameLength {
+		ve.Add("name", "name_too_long", fmt.Sprintf("The name can be at most %d characters long.", maxListNameLength))
+	}
+}
+
+func validateColor(ve *aderrors.ValidationError, color *string) {
+	if color == nil {
+		return
+	}
+	*color = strings.ToLower(strings.TrimSpace(*color))
+	if !colorRe.MatchString(*color) {
+		ve.Add("color", "color_invalid", "The colour needs to be a hex colour, such as #ff8800.")
+	}
+}
+
+func serveAPILists(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		lists, err := ls.GetListsByUserID(env.getUser(r).ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving lists: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, lists))
+		return nil
+	}
+}
+
+func serveAPICreateList(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		in := new(listChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, false)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		l := &models.List{UserID: env.getUser(r).ID, Name: *in.Name}
+		l.GenerateID()
+		if err := ls.CreateList(l); err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error creating list: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusCreated, l))
+		return nil
+	}
+}
+
+func serveAPIPatchList(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		l, err := ls.GetList(env.getUser(r).ID, pat.Param(r, "id"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving list: %w", err))
+		}
+		in := new(listChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.ID != "" && in.ID != l.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "The list's ID doesn't match the URL",
+				fmt.Errorf("list %s patched with ID %s", l.ID, in.ID))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, true)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		if in.Name != nil {
+			l.Name = *in.Name
+		}
+		if err := ls.UpdateList(l); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error updating list: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, l))
+		return nil
+	}
+}
+
+// serveAPIDeleteList deletes a list. Its todos aren't deleted, just taken
+// out of it.
+func serveAPIDeleteList(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := ls.DeleteList(env.getUser(r).ID, pat.Param(r, "id")); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error deleting list: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+func serveAPILabels(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		labels, err := ls.GetLabelsByUserID(env.getUser(r).ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving labels: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, labels))
+		return nil
+	}
+}
+
+func serveAPICreateLabel(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		in := new(labelChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, false)
+		if in.Color == nil {
+			ve.Add("color", "color_required", "The label needs a colour, such as #ff8800.")
+		}
+		validateColor(&ve, in.Color)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		l := &models.Label{UserID: env.getUser(r).ID, Name: *in.Name, Color: *in.Color}
+		l.GenerateID()
+		if err := ls.CreateLabel(l); err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error creating label: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusCreated, l))
+		return nil
+	}
+}
+
+func serveAPIPatchLabel(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		l, err := ls.GetLabel(env.getUser(r).ID, pat.Param(r, "id"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving label: %w", err))
+		}
+		in := new(labelChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.ID != "" && in.ID != l.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "The label's ID doesn't match the URL",
+				fmt.Errorf("label %s patched with ID %s", l.ID, in.ID))
+		}
+		var ve aderrors.ValidationError
+		validateListName(&ve, in.Name, true)
+		validateColor(&ve, in.Color)
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		if in.Name != nil {
+			l.Name = *in.Name
+		}
+		if in.Color != nil {
+			l.Color = *in.Color
+		}
+		if err := ls.UpdateLabel(l); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error updating label: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, l))
+		return nil
+	}
+}
+
+// serveAPIDeleteLabel deletes a label, taking it off its todos.
+func serveAPIDeleteLabel(env *Env, ls models.ListService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if err := ls.DeleteLabel(env.getUser(r).ID, pat.Param(r, "id")); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error deleting label: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
@@ -2,6 +2,7 @@ package app
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -46,8 +47,10 @@ func logHandler(env *Env) func(http.Handler) http.Handler {
 	}
 }
 
-// Attaches the user object to the context, if logged in
-func userMiddleware(env *Env, adb models.SessionService) func(http.Handler) http.Handler {
+// Attaches the user object to the context, if logged in.
+// If the session has expired but the browser holds a remember token, the
+// login is silently restored with a fresh session.
+func userMiddleware(env *Env, udb models.UserService, adb models.SessionService, rdb models.RememberTokenService) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			session, err := env.store.Get(r, sessionNameConst)
@@ -58,6 +61,7 @@ func userMiddleware(env *Env, adb models.SessionService) func(http.Handler) http
 			}
 			sessionKey, ok := session.Values[sessionKeyConst]
 			if !ok { // not logged in
+				r = restoreRememberedLogin(env, adb, rdb, w, r)
 				next.ServeHTTP(w, r)
 				return
 			}
@@ -68,8 +72,21 @@ func userMiddleware(env *Env, adb models.SessionService) func(http.Handler) http
 				env.log.WithFields(logrus.Fields{
 					"error":      err,
 					"session_id": sID,
-				}).Error("error getting user with session ID")
-				delete(session.Values, sessionKey)
+				}).Info("error getting user with session ID")
+				delete(session.Values, sessionKeyConst)
+				session.Save(r, w)
+				r = restoreRememberedLogin(env, adb, rdb, w, r)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			r, err = withImpersonator(r, udb, adb, sID, u)
+			if err != nil {
+				env.log.WithFields(logrus.Fields{
+					"error":      err,
+					"session_id": sID,
+				}).Info("error checking impersonation for session")
+				delete(session.Values, sessionKeyConst)
 				session.Save(r, w)
 				next.ServeHTTP(w, r)
 				return
@@ -77,6 +94,7 @@ func userMiddleware(env *Env, adb models.SessionService) func(http.Handler) http
 
 			ctx := r.Context()
 			ctx = context.WithValue(ctx, userKeyConst, u)
+			ctx = context.WithValue(ctx, sessionIDKeyConst, sID)
 			r = r.WithContext(ctx)
 			next.ServeHTTP(w, r)
 		}
@@ -84,6 +102,80 @@ func userMiddleware(env *Env, adb models.SessionService) func(http.Handler) http
 	}
 }
 
+// restoreRememberedLogin logs the browser back in with its remember token,
+// rotating the token in the process. It returns the request with the user
+// attached, or the original request if there is nothing to restore or a
+// user is already attached. A reused token is treated as stolen: its family
+// and every session created from it are revoked.
+func restoreRememberedLogin(env *Env, adb models.SessionService, rdb models.RememberTokenService, w http.ResponseWriter, r *http.Request) *http.Request {
+	tok := env.getRememberToken(r)
+	if tok == "" || env.getUser(r) != nil {
+		return r
+	}
+
+	newTok, rt, err := rdb.ConsumeRememberToken(tok)
+	if err != nil {
+		if errors.Is(err, aderrors.ErrTokenReused) {
+			env.log.WithFields(logrus.Fields{
+				"user_id":   rt.UserID,
+				"family_id": rt.FamilyID,
+			}).Warn("remember token reuse detected, revoking token family")
+			sessions, err := adb.GetSessionsByUserID(rt.UserID)
+			env.loe(err)
+			revoked := 0
+			for _, s := range sessions {
+				if s.RememberFamilyID == rt.FamilyID {
+					_, err := adb.DeleteSession(s.ID)
+					env.loe(err)
+					revoked++
+				}
+			}
+			env.recordAudit(r, &models.AuditEvent{
+				Action:   models.AuditRememberTokenReused,
+				TargetID: rt.UserID,
+				Details:  map[string]string{"family_id": rt.FamilyID, "sessions_revoked": strconv.Itoa(revoked)},
+			})
+		} else {
+			env.log.WithField("error", err).Info("unable to restore login from remember token")
+		}
+		env.clearAuthCookies(w, r)
+		return r
+	}
+
+	sess, err := adb.CreateSession(rt.UserID, false, models.SessionOptions{
+		Client:           clientInfo(r),
+		RememberFamilyID: rt.FamilyID,
+	})
+	if err != nil {
+		env.log.WithFields(logrus.Fields{
+			"error":   err,
+			"user_id": rt.UserID,
+		}).Error("error creating session from remember token")
+		return r
+	}
+	u, err := adb.GetUserBySessionID(sess.ID)
+	if err != nil {
+		env.log.WithFields(logrus.Fields{
+			"error":      err,
+			"session_id": sess.ID,
+		}).Error("error getting user with session ID")
+		return r
+	}
+	env.loe(env.saveRememberCookie(w, r, newTok))
+	env.loe(env.saveSessionCookie(w, r, sess.ID))
+	env.recordAudit(r, &models.AuditEvent{
+		Action:   models.AuditLoginRestored,
+		ActorID:  u.ID,
+		TargetID: u.ID,
+		Details:  map[string]string{"session_id": sess.ID, "family_id": rt.FamilyID},
+	})
+
+	ctx := r.Context()
+	ctx = context.WithValue(ctx, userKeyConst, u)
+	ctx = context.WithValue(ctx, sessionIDKeyConst, sess.ID)
+	return r.WithContext(ctx)
+}
+
 // jsonAPIMiddleware checks for that the media type is application/vnd.api+json
 func jsonAPIMiddleware(env *Env) func(next http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
@@ -125,11 +217,13 @@ func authMiddleware(env *Env) func(next router.HandlerError) router.HandlerError
 }
 
 // authAPIMiddleware is the middleware layer to protect api endpoints.
-// This does not have to be placed after userMiddleware.
-func authAPIMiddleware(env *Env, adb models.SessionService) func(next router.HandlerError) router.HandlerError {
+// This does not have to be placed after userMiddleware. Like it, a cookie
+// login whose session has expired is restored from the remember token.
+func authAPIMiddleware(env *Env, udb models.UserService, adb models.SessionService, rdb models.RememberTokenService) func(next router.HandlerError) router.HandlerError {
 	return func(next router.HandlerError) router.HandlerError {
 		fn := func(w http.ResponseWriter, r *http.Request) error {
 			var usr *models.User
+			var sID string
 			tok := r.Header.Get("access_token")
 			// This is a request with an access token
 			if tok != "" {
@@ -138,6 +232,7 @@ func authAPIMiddleware(env *Env, adb models.SessionService) func(next router.Han
 					return aderrors.New401APIError(fmt.Errorf("problem retrieving session: %w", err))
 				}
 
+				sID = appSess.ID
 				usr, err = adb.GetUserBySessionID(appSess.ID)
 				if err != nil {
 					env.log.WithFields(logrus.Fields{
@@ -151,19 +246,39 @@ func authAPIMiddleware(env *Env, adb models.SessionService) func(next router.Han
 				if err != nil {
 					return aderrors.New401APIError(fmt.Errorf("no credentials detected"))
 				}
+				// restore logs the browser back in with its remember token,
+				// failing with cause if it can't
+				restore := func(cause error) error {
+					rr := restoreRememberedLogin(env, adb, rdb, w, r)
+					sID = env.getSessionID(rr)
+					if env.getUser(rr) == nil || sID == "" {
+						return aderrors.New401APIError(cause)
+					}
+					r = rr
+					return nil
+				}
 				sessionKey, ok := session.Values[sessionKeyConst]
 				if !ok { // not logged in
-					return aderrors.New401APIError(fmt.Errorf("no credentials detected"))
+					if err := restore(fmt.Errorf("no credentials detected")); err != nil {
+						return err
+					}
+					sessionKey = sID
 				}
 
-				sID := sessionKey.(string)
+				sID = sessionKey.(string)
 				appSess, err := adb.GetSession(sID)
 				if err != nil {
 					env.log.WithFields(logrus.Fields{
 						"error":      err,
 						"session_id": sID,
-					}).Error("Error retrieving session")
-					return aderrors.New401APIError(fmt.Errorf("problem retrieving session: %w", err))
+					}).Info("Error retrieving session")
+					if err := restore(fmt.Errorf("problem retrieving session: %w", err)); err != nil {
+						return err
+					}
+					appSess, err = adb.GetSession(sID)
+					if err != nil {
+						return aderrors.New401APIError(fmt.Errorf("problem retrieving session: %w", err))
+					}
 				}
 
 				if appSess.TokenOnly {
@@ -176,14 +291,20 @@ func authAPIMiddleware(env *Env, adb models.SessionService) func(next router.Han
 						"error":      err,
 						"session_id": sID,
 					}).Error("Error getting user with session ID")
-					delete(session.Values, sessionKey)
+					delete(session.Values, sessionKeyConst)
 					session.Save(r, w)
 					return aderrors.New401APIError(fmt.Errorf("problem retrieving user from session: %w", err))
 				}
+
+				r, err = withImpersonator(r, udb, adb, sID, usr)
+				if err != nil {
+					return aderrors.New401APIError(fmt.Errorf("problem checking impersonation for session: %w", err))
+				}
 			}
 
 			ctx := r.Context()
 			ctx = context.WithValue(ctx, userKeyConst, usr)
+			ctx = context.WithValue(ctx, sessionIDKeyConst, sID)
 			r = r.WithContext(ctx)
 			return next(w, r)
 		}
@@ -191,6 +312,39 @@ func authAPIMiddleware(env *Env, adb models.SessionService) func(next router.Han
 	}
 }
 
+// requirePagePermission only lets users with the permission through to a
+// page. Everyone else is sent back to the app. This has to be placed after
+// authMiddleware.
+func requirePagePermission(env *Env, perm models.Permission) func(next router.HandlerError) router.HandlerError {
+	return func(next router.HandlerError) router.HandlerError {
+		fn := func(w http.ResponseWriter, r *http.Request) error {
+			user := env.getUser(r)
+			if !user.Can(perm) {
+				env.saveFlash(w, r, "You don't have access to that page.")
+				http.Redirect(w, r, "/c", http.StatusFound)
+				return aderrors.NewError(http.StatusForbidden, "user tried to access page without permission", nil).WithFields(
+					logrus.Fields{"user_id": user.ID, "path": r.URL.Path, "permission": perm})
+			}
+			return next(w, r)
+		}
+		return fn
+	}
+}
+
+// requirePermission only lets users with the permission through to an api
+// endpoint. This has to be placed after authAPIMiddleware.
+func requirePermission(env *Env, perm models.Permission) func(next router.HandlerError) router.HandlerError {
+	return func(next router.HandlerError) router.HandlerError {
+		fn := func(w http.ResponseWriter, r *http.Request) error {
+			if !env.getUser(r).Can(perm) {
+				return aderrors.NewPermissionAPIError(string(perm)).WithFields(logrus.Fields{"path": r.URL.Path})
+			}
+			return next(w, r)
+		}
+		return fn
+	}
+}
+
 // NOTE: 404s are not handled by the errorhandler below, because goji
 // does 404s before the middleware stack. So we have to have an explicit
 // middleware. See: https://github.com/goji/goji/issues/20
@@ -254,6 +408,22 @@ func csrfMiddleware(csrfmdware func(http.Handler) http.Handler) func(http.Handle
 	}
 }
 
+// csrfHTMLMiddleware applies the csrf middleware to server-rendered pages.
+// Errors returned by next are passed on to the router's error handler.
+func csrfHTMLMiddleware(csrfmdware func(http.Handler) http.Handler) func(next router.HandlerError) router.HandlerError {
+	return func(next router.HandlerError) router.HandlerError {
+		fn := func(w http.ResponseWriter, r *http.Request) error {
+			var err error
+			h := csrfmdware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				err = next(w, r)
+			}))
+			h.ServeHTTP(w, r)
+			return err
+		}
+		return fn
+	}
+}
+
 // Generic error handler for all http routes
 func errorHandler(env *Env) router.ErrorHandler {
 	return func(w http.ResponseWriter, r *http.Request, err error) {
@@ -280,6 +450,24 @@ func apiErrorHandler(env *Env) router.ErrorHandler {
 		switch e := err.(type) {
 		case aderrors.APIStatusError:
 			env.log.WithFields(e.Fields()).Error(e.Error())
+			var ve aderrors.ValidationError
+			if errors.As(e.Err, &ve) {
+				env.jsonAPIErr(w, e.Status(), validationErrorObjects(e, ve))
+				return
+			}
+			var pe aderrors.PermissionError
+			if errors.As(e.Err, &pe) {
+				meta := map[string]interface{}{"permission": pe.Permission}
+				errObj := &jsonapi.ErrorObject{
+					Status: strconv.Itoa(e.Status()),
+					Title:  e.PublicMessage,
+					Detail: fmt.Sprintf("You need the %s permission to do that.", pe.Permission),
+					Code:   "permission_denied",
+					Meta:   &meta,
+				}
+				env.jsonAPIErr(w, e.Status(), []*jsonapi.ErrorObject{errObj})
+				return
+			}
 			errObj := &jsonapi.ErrorObject{
 				Status: strconv.Itoa(e.Status()),
 				Title:  e.PublicMessage,
@@ -296,6 +484,23 @@ func apiErrorHandler(env *Env) router.ErrorHandler {
 	}
 }
 
+// validationErrorObjects turns every field of a ValidationError into its own
+// jsonapi Error Object, with the offending field in meta.
+func validationErrorObjects(e aderrors.APIStatusError, ve aderrors.ValidationError) []*jsonapi.ErrorObject {
+	errObjs := make([]*jsonapi.ErrorObject, 0, len(ve.Fields))
+	for _, f := range ve.Fields {
+		meta := map[string]interface{}{"field": f.Field}
+		errObjs = append(errObjs, &jsonapi.ErrorObject{
+			Status: strconv.Itoa(e.Status()),
+			Title:  e.PublicMessage,
+			Detail: f.Message,
+			Code:   f.Code,
+			Meta:   &meta,
+		})
+	}
+	return errObjs
+}
+
 func csrfErrHandler(env *Env) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		err := csrf.FailureReason(r)
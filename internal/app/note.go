@@ -0,0 +1,163 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strconv"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/markdown"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/textdiff"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/gorilla/csrf"
+	"github.com/sirupsen/logrus"
+	"goji.io/pat"
+)
+
+// noteDiff is how a todo's notes changed from one revision to another.
+// Revision 0 is the empty notes the todo started with.
+type noteDiff struct {
+	ID      string          `jsonapi:"primary,note_diff"`
+	From    int             `jsonapi:"attr,from"`
+	To      int             `jsonapi:"attr,to"`
+	Lines   []textdiff.Line `jsonapi:"attr,lines"`
+	Unified string          `jsonapi:"attr,unified"`
+}
+
+// serveAPINoteRevisions lists every revision of a todo's notes, oldest
+// first.
+func serveAPINoteRevisions(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		revs, err := tdserv.GetNoteRevisions(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving note revisions: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, revs))
+		return nil
+	}
+}
+
+// serveAPINoteDiff compares two revisions of a todo's notes, given by the
+// from and to query parameters.
+func serveAPINoteDiff(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		id := pat.Param(r, "id")
+		var ve aderrors.ValidationError
+		from, err := strconv.Atoi(r.URL.Query().Get("from"))
+		if err != nil || from < 0 {
+			ve.Add("from", "revision_invalid", "from needs to be the number of a revision, or 0 for no notes.")
+		}
+		to, err := strconv.Atoi(r.URL.Query().Get("to"))
+		if err != nil || to < 0 {
+			ve.Add("to", "revision_invalid", "to needs to be the number of a revision, or 0 for no notes.")
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		notes := func(rev int) (string, error) {
+			if rev == 0 {
+				// Still checks the user may read the todo
+				_, err := tdserv.GetNoteRevisions(id, u.ID)
+				return "", err
+			}
+			nr, err := tdserv.GetNoteRevision(id, rev, u.ID)
+			if err != nil {
+				return "", err
+			}
+			return nr.Notes, nil
+		}
+		a, err := notes(from)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving note revision %d: %w", from, err))
+		}
+		b, err := notes(to)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving note revision %d: %w", to, err))
+		}
+		lines := textdiff.Lines(a, b)
+		if lines == nil {
+			lines = []textdiff.Line{}
+		}
+		diff := &noteDiff{
+			ID:      fmt.Sprintf("%s-%d-%d", id, from, to),
+			From:    from,
+			To:      to,
+			Lines:   lines,
+			Unified: textdiff.Unified(lines),
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, diff))
+		return nil
+	}
+}
+
+// serveAPIRestoreNotes sets a todo's notes back to an old revision, which
+// saves them as a new one.
+func serveAPIRestoreNotes(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+		rev, err := strconv.Atoi(pat.Param(r, "rev"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("invalid note revision %q: %w", pat.Param(r, "rev"), aderrors.ErrNoRecords))
+		}
+		td, err := tdserv.RestoreNotes(pat.Param(r, "id"), rev, env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error restoring notes: %w", err))
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, td, include))
+		return nil
+	}
+}
+
+type todoPresenter struct {
+	*localPresenter
+	Todo      *models.Todo
+	Notes     template.HTML
+	Revisions int
+}
+
+// serveTodo shows a todo with its notes rendered from Markdown. The HTML
+// is built by the markdown package, which escapes anything it doesn't
+// produce itself, so it's safe to put in the page as it is.
+func serveTodo(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		id := pat.Param(r, "id")
+		td, err := tdserv.Get(id)
+		var revs []*models.NoteRevision
+		if err == nil {
+			revs, err = tdserv.GetNoteRevisions(id, u.ID)
+		}
+		var pe aderrors.PermissionError
+		if errors.Is(err, aderrors.ErrNoRecords) || errors.As(err, &pe) {
+			lp := &localPresenter{PageTitle: "404 Page Not Found", PageURL: r.URL.String(), globalPresenter: env.gp}
+			env.loe(env.rndr.HTML(w, http.StatusNotFound, "404", lp))
+			return aderrors.New404Error("no such todo", err).WithFields(logrus.Fields{"user_id": u.ID, "todo_id": id})
+		} else if err != nil {
+			return aderrors.New500Error("error retrieving todo", err).WithFields(logrus.Fields{"user_id": u.ID, "todo_id": id})
+		}
+
+		tp := &todoPresenter{
+			localPresenter: &localPresenter{
+				PageTitle:       td.Name.String,
+				PageURL:         "/todos/" + td.ID,
+				CSRFToken:       csrf.Token(r),
+				Flashes:         env.getFlash(w, r),
+				Impersonating:   env.impersonating(r),
+				globalPresenter: env.gp,
+			},
+			Todo:      td,
+			Notes:     template.HTML(markdown.ToHTML(td.Notes)),
+			Revisions: len(revs),
+		}
+		env.loe(env.rndr.HTML(w, http.StatusOK, "todo", tp))
+		return nil
+	}
+}
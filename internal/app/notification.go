@@ -0,0 +1,77 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/mail"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"goji.io/pat"
+)
+
+// newNotifiers returns the notifiers users are told things through: in
+// the app, and by email.
+func newNotifiers(env *Env, ns models.NotificationService, udb models.UserService) []models.Notifier {
+	return []models.Notifier{&inAppNotifier{ns: ns}, &emailNotifier{env: env, udb: udb}}
+}
+
+// emailNotifier emails notifications to users.
+type emailNotifier struct {
+	env *Env
+	udb models.UserService
+}
+
+func (en *emailNotifier) Name() string { return "email" }
+
+func (en *emailNotifier) Notify(n *models.Notification) error {
+	u, err := en.udb.Get(n.UserID)
+	if err != nil {
+		return fmt.Errorf("error retrieving user %s: %w", n.UserID, err)
+	}
+	return en.env.mailer.Send(&mail.Message{
+		To:      u.Email,
+		Subject: n.Title,
+		Body: fmt.Sprintf("Hi %s,\n\n%s\n\n%s\n\nSee your todos at http://%s/c\n",
+			u.Username, n.Title, n.Body, en.env.gp.SiteURL),
+	})
+}
+
+// inAppNotifier shows notifications to users in the app. Notifying the
+// same thing twice only shows it once.
+type inAppNotifier struct {
+	ns models.NotificationService
+}
+
+func (in *inAppNotifier) Name() string { return "in_app" }
+
+func (in *inAppNotifier) Notify(n *models.Notification) error {
+	if _, err := in.ns.CreateNotification(n); err != nil && !errors.Is(err, aderrors.ErrAlreadyExists) {
+		return err
+	}
+	return nil
+}
+
+func serveAPINotifications(env *Env, ns models.NotificationService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		notifications, err := ns.GetNotificationsByUserID(env.getUser(r).ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving notifications: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, notifications))
+		return nil
+	}
+}
+
+func serveAPIReadNotification(env *Env, ns models.NotificationService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		n, err := ns.MarkNotificationRead(env.getUser(r).ID, pat.Param(r, "id"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error marking notification read: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, n))
+		return nil
+	}
+}
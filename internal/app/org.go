@@ -0,0 +1,547 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/mail"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"github.com/gorilla/csrf"
+	"github.com/sirupsen/logrus"
+	"goji.io/pat"
+)
+
+const maxOrgNameLength = 80
+
+// apiOrg is a models.Org along with the current user's role in it.
+type apiOrg struct {
+	ID          string    `jsonapi:"primary,org"`
+	Slug        string    `jsonapi:"attr,slug"`
+	Name        string    `jsonapi:"attr,name"`
+	Role        string    `jsonapi:"attr,role,omitempty"`
+	SCIMEnabled bool      `jsonapi:"attr,scim_enabled"`
+	DateCreated time.Time `jsonapi:"attr,date_created,iso8601"`
+}
+
+func newAPIOrg(org *models.Org, m *models.Membership) *apiOrg {
+	ao := &apiOrg{ID: org.ID, Slug: org.Slug, Name: org.Name, SCIMEnabled: org.SCIMTokenHash != "", DateCreated: org.DateCreated}
+	if m != nil {
+		ao.Role = string(m.Role)
+	}
+	return ao
+}
+
+// apiMember is a models.Membership, identified by the member's user ID.
+type apiMember struct {
+	ID         string    `jsonapi:"primary,member"`
+	Username   string    `jsonapi:"attr,username"`
+	Name       string    `jsonapi:"attr,name"`
+	Role       string    `jsonapi:"attr,role"`
+	Active     bool      `jsonapi:"attr,active"`
+	ExternalID string    `jsonapi:"attr,external_id,omitempty"`
+	DateJoined time.Time `jsonapi:"attr,date_joined,iso8601"`
+}
+
+func newAPIMember(m *models.Membership, u *models.User) *apiMember {
+	return &apiMember{
+		ID:         m.UserID,
+		Username:   u.Username,
+		Name:       u.Name,
+		Role:       string(m.Role),
+		Active:     m.IsActive(),
+		ExternalID: m.ExternalID,
+		DateJoined: m.DateJoined,
+	}
+}
+
+// apiSCIMToken is the bearer token for an org's SCIM endpoint. It's only
+// shown when it's created.
+type apiSCIMToken struct {
+	ID    string `jsonapi:"primary,scim_token"`
+	Token string `jsonapi:"attr,token"`
+	URL   string `jsonapi:"attr,url"`
+}
+
+// apiInvitation is a models.Invitation without its token.
+type apiInvitation struct {
+	ID           string     `jsonapi:"primary,invitation"`
+	Email        string     `jsonapi:"attr,email"`
+	Role         string     `jsonapi:"attr,role"`
+	DateCreated  time.Time  `jsonapi:"attr,date_created,iso8601"`
+	ExpiryTime   time.Time  `jsonapi:"attr,expiry_time,iso8601"`
+	AcceptedTime *time.Time `jsonapi:"attr,accepted_time,iso8601,omitempty"`
+}
+
+func newAPIInvitation(inv *models.Invitation) *apiInvitation {
+	ai := &apiInvitation{
+		ID:          inv.ID,
+		Email:       inv.Email,
+		Role:        string(inv.Role),
+		DateCreated: inv.DateCreated,
+		ExpiryTime:  inv.ExpiryTime,
+	}
+	if !inv.AcceptedTime.IsZero() {
+		ai.AcceptedTime = &inv.AcceptedTime
+	}
+	return ai
+}
+
+// orgFromURL looks up the :org in the url by slug, or failing that by ID.
+func orgFromURL(ors models.OrgService, r *http.Request) (*models.Org, error) {
+	key := pat.Param(r, "org")
+	org, err := ors.GetOrgBySlug(key)
+	if errors.Is(err, aderrors.ErrNoRecords) {
+		org, err = ors.GetOrg(key)
+	}
+	return org, err
+}
+
+// memberOrgFromURL is orgFromURL for org members only, returning the user's
+// membership too. Orgs the user isn't an active member of are reported
+// missing.
+func memberOrgFromURL(ors models.OrgService, r *http.Request, u *models.User) (*models.Org, *models.Membership, error) {
+	org, err := orgFromURL(ors, r)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, err := ors.GetMembership(org.ID, u.ID)
+	if err == nil && !m.IsActive() {
+		err = aderrors.ErrNoRecords
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return org, m, nil
+}
+
+func orgAPIError(err error) error {
+	var pe aderrors.PermissionError
+	var ve aderrors.ValidationError
+	switch {
+	case errors.As(err, &pe):
+		return aderrors.NewPermissionAPIError(pe.Permission)
+	case errors.As(err, &ve):
+		return aderrors.NewValidationAPIError(ve)
+	case errors.Is(err, aderrors.ErrLastOwner):
+		return aderrors.NewAPIError(http.StatusConflict, "An org needs at least one owner. Make someone else an owner first", err)
+	}
+	return handleCommonAPIErrors(err)
+}
+
+func serveAPIOrgs(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		orgs, err := ors.GetOrgsByUserID(u.ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving orgs: %w", err))
+		}
+		res := []*apiOrg{}
+		for _, org := range orgs {
+			m, err := ors.GetMembership(org.ID, u.ID)
+			if err != nil {
+				return aderrors.New500APIError(fmt.Errorf("error retrieving membership of org %s: %w", org.ID, err))
+			}
+			res = append(res, newAPIOrg(org, m))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// serveAPICreateOrg creates an org with the current user as its owner.
+func serveAPICreateOrg(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		in := new(apiOrg)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+
+		org := &models.Org{Slug: strings.ToLower(strings.TrimSpace(in.Slug)), Name: strings.TrimSpace(in.Name)}
+		var ve aderrors.ValidationError
+		if !models.IsValidOrgSlug(org.Slug) {
+			ve.Add("slug", "slug_invalid", "The slug can only have 3 to 40 lowercase letters, numbers and dashes, and can't start or end with a dash.")
+		}
+		if org.Name == "" {
+			ve.Add("name", "name_required", "Your org needs a name.")
+		} else if len([]rune(org.Name)) > maxOrgNameLength {
+			ve.Add("name", "name_too_long", fmt.Sprintf("The name can be at most %d characters long.", maxOrgNameLength))
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		org.GenerateID()
+		if err := ors.CreateOrg(org, u.ID); err != nil {
+			if errors.Is(err, aderrors.ErrAlreadyExists) {
+				ve.Add("slug", "slug_taken", "That slug is already taken.")
+				return aderrors.NewValidationAPIError(ve)
+			}
+			return aderrors.New500APIError(fmt.Errorf("error creating org: %w", err))
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:  models.AuditOrgCreated,
+			Details: map[string]string{"org_id": org.ID, "slug": org.Slug},
+		})
+		env.loe(env.jsonAPI(w, http.StatusCreated, newAPIOrg(org, &models.Membership{Role: models.OrgRoleOwner})))
+		return nil
+	}
+}
+
+func serveAPIOrg(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, m, err := memberOrgFromURL(ors, r, env.getUser(r))
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, newAPIOrg(org, m)))
+		return nil
+	}
+}
+
+func serveAPIOrgMembers(env *Env, ors models.OrgService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, _, err := memberOrgFromURL(ors, r, env.getUser(r))
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		members, err := ors.GetMembers(org.ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving members of org %s: %w", org.ID, err))
+		}
+		res := []*apiMember{}
+		for _, m := range members {
+			mu, err := udb.Get(m.UserID)
+			if err != nil {
+				return aderrors.New500APIError(fmt.Errorf("error retrieving member %s: %w", m.UserID, err))
+			}
+			res = append(res, newAPIMember(m, mu))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// serveAPIPatchOrgMember changes a member's role. Admins can hand out any
+// role but owner; only owners can make or unmake owners.
+func serveAPIPatchOrgMember(env *Env, ors models.OrgService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, me, err := memberOrgFromURL(ors, r, env.getUser(r))
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		userID := pat.Param(r, "user")
+		in := new(apiMember)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.ID != "" && in.ID != userID {
+			return aderrors.NewAPIError(http.StatusConflict, "The id in the body doesn't match the url",
+				fmt.Errorf("member id %s in body, %s in url", in.ID, userID))
+		}
+		role := models.OrgRole(in.Role)
+		if !role.IsValid() {
+			var ve aderrors.ValidationError
+			ve.Add("role", "role_invalid", fmt.Sprintf("%q is not an org role.", in.Role))
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		target, err := ors.GetMembership(org.ID, userID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving member %s: %w", userID, err))
+		}
+		if !me.CanAssign(target.Role, role) {
+			return aderrors.NewPermissionAPIError(string(models.PermOrgMembersManage))
+		}
+		oldRole := target.Role
+		target, err = ors.SetMemberRole(org.ID, userID, role)
+		if err != nil {
+			return orgAPIError(err)
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditOrgMemberRoleChanged,
+			TargetID: userID,
+			Details:  map[string]string{"org_id": org.ID, "old_role": string(oldRole), "new_role": string(role)},
+		})
+
+		mu, err := udb.Get(userID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving member %s: %w", userID, err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, newAPIMember(target, mu)))
+		return nil
+	}
+}
+
+// serveAPIDeleteOrgMember removes a member. Anyone can leave; removing
+// someone else takes the same rights as changing their role.
+func serveAPIDeleteOrgMember(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		org, me, err := memberOrgFromURL(ors, r, u)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		userID := pat.Param(r, "user")
+		target, err := ors.GetMembership(org.ID, userID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving member %s: %w", userID, err))
+		}
+		if userID != u.ID && !me.CanAssign(target.Role, target.Role) {
+			return aderrors.NewPermissionAPIError(string(models.PermOrgMembersManage))
+		}
+		if err := ors.RemoveMember(org.ID, userID); err != nil {
+			return orgAPIError(err)
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditOrgMemberRemoved,
+			TargetID: userID,
+			Details:  map[string]string{"org_id": org.ID, "role": string(target.Role)},
+		})
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+func serveAPIOrgInvitations(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, me, err := memberOrgFromURL(ors, r, env.getUser(r))
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		if !me.Can(models.PermOrgMembersManage) {
+			return aderrors.NewPermissionAPIError(string(models.PermOrgMembersManage))
+		}
+		invs, err := ors.GetInvitations(org.ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving invitations to org %s: %w", org.ID, err))
+		}
+		res := []*apiInvitation{}
+		for _, inv := range invs {
+			res = append(res, newAPIInvitation(inv))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// serveAPICreateOrgInvitation emails an invitation link to join the org.
+func serveAPICreateOrgInvitation(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		org, me, err := memberOrgFromURL(ors, r, u)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		in := new(apiInvitation)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.Role == "" {
+			in.Role = string(models.OrgRoleMember)
+		}
+
+		inv := &models.Invitation{OrgID: org.ID, Email: strings.TrimSpace(in.Email), Role: models.OrgRole(in.Role), InviterID: u.ID}
+		var ve aderrors.ValidationError
+		if !govalidator.IsEmail(inv.Email) {
+			ve.Add("email", "email_invalid", "That's not a valid email.")
+		}
+		if !inv.Role.IsValid() {
+			ve.Add("role", "role_invalid", fmt.Sprintf("%q is not an org role.", in.Role))
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+		if !me.CanAssign("", inv.Role) {
+			return aderrors.NewPermissionAPIError(string(models.PermOrgMembersManage))
+		}
+
+		token, err := ors.CreateInvitation(inv)
+		if err != nil {
+			if errors.Is(err, aderrors.ErrAlreadyExists) {
+				return aderrors.NewAPIError(http.StatusConflict, "That email has already been invited", err)
+			}
+			return aderrors.New500APIError(fmt.Errorf("error creating invitation: %w", err))
+		}
+		env.loe(env.mailer.Send(&mail.Message{
+			To:      inv.Email,
+			Subject: fmt.Sprintf("%s invited you to %s on %s", u.Username, org.Name, env.gp.SiteName),
+			Body: fmt.Sprintf("Hi,\n\n%s invited you to join %s on %s as a %s. To accept, open this link:\n\n"+
+				"http://%s/invitations/%s\n\nThe invitation expires on %s.\n",
+				u.Username, org.Name, env.gp.SiteName, inv.Role, env.gp.SiteURL, token, inv.ExpiryTime.Format("2 Jan 2006")),
+		}))
+		env.recordAudit(r, &models.AuditEvent{
+			Action:  models.AuditOrgInvitationCreated,
+			Details: map[string]string{"org_id": org.ID, "invitation_id": inv.ID, "email": inv.Email, "role": string(inv.Role)},
+		})
+		env.loe(env.jsonAPI(w, http.StatusCreated, newAPIInvitation(inv)))
+		return nil
+	}
+}
+
+func serveAPIDeleteOrgInvitation(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, me, err := memberOrgFromURL(ors, r, env.getUser(r))
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		if !me.Can(models.PermOrgMembersManage) {
+			return aderrors.NewPermissionAPIError(string(models.PermOrgMembersManage))
+		}
+		id := pat.Param(r, "id")
+		if err := ors.RevokeInvitation(org.ID, id); err != nil {
+			return orgAPIError(err)
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:  models.AuditOrgInvitationRevoked,
+			Details: map[string]string{"org_id": org.ID, "invitation_id": id},
+		})
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// serveAPICreateOrgSCIMToken sets up SCIM for the org, or replaces its
+// token if it already has one.
+func serveAPICreateOrgSCIMToken(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, me, err := memberOrgFromURL(ors, r, env.getUser(r))
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		if !me.Can(models.PermOrgManage) {
+			return aderrors.NewPermissionAPIError(string(models.PermOrgManage))
+		}
+		token, err := ors.CreateSCIMToken(org.ID)
+		if err != nil {
+			return aderrors.New500APIError(err)
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:  models.AuditOrgSCIMTokenCreated,
+			Details: map[string]string{"org_id": org.ID},
+		})
+		res := &apiSCIMToken{ID: org.ID, Token: token, URL: "http://" + env.gp.SiteURL + scimBasePath}
+		env.loe(env.jsonAPI(w, http.StatusCreated, res))
+		return nil
+	}
+}
+
+func serveAPIDeleteOrgSCIMToken(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org, me, err := memberOrgFromURL(ors, r, env.getUser(r))
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+		}
+		if !me.Can(models.PermOrgManage) {
+			return aderrors.NewPermissionAPIError(string(models.PermOrgManage))
+		}
+		if err := ors.RevokeSCIMToken(org.ID); err != nil {
+			return orgAPIError(err)
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:  models.AuditOrgSCIMTokenRevoked,
+			Details: map[string]string{"org_id": org.ID},
+		})
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// invitationPresenter is used to render the page for accepting an invitation.
+type invitationPresenter struct {
+	*localPresenter
+	Token   string
+	Org     *models.Org
+	Inviter string
+	Role    models.OrgRole
+	Problem string
+}
+
+// serveInvitation shows the invitation behind an emailed link, and whether
+// the user can accept it.
+func serveInvitation(env *Env, ors models.OrgService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		token := pat.Param(r, "token")
+		inv, err := ors.GetInvitationByToken(token)
+		if err != nil {
+			if errors.Is(err, aderrors.ErrNoRecords) {
+				env.saveFlash(w, r, "That invitation doesn't exist. It may have been revoked.")
+				http.Redirect(w, r, "/c", http.StatusFound)
+				return aderrors.New404Error("no such invitation", err)
+			}
+			return aderrors.New500Error("error retrieving invitation", err)
+		}
+		org, err := ors.GetOrg(inv.OrgID)
+		if err != nil {
+			return aderrors.New500Error("error retrieving org for invitation", err).WithFields(logrus.Fields{"invitation_id": inv.ID})
+		}
+		ip := &invitationPresenter{
+			localPresenter: &localPresenter{
+				PageTitle:       "Join " + org.Name,
+				PageURL:         "/invitations",
+				CSRFToken:       csrf.Token(r),
+				Flashes:         env.getFlash(w, r),
+				Impersonating:   env.impersonating(r),
+				globalPresenter: env.gp,
+			},
+			Token: token,
+			Org:   org,
+			Role:  inv.Role,
+		}
+		if inviter, err := udb.Get(inv.InviterID); err == nil {
+			ip.Inviter = inviter.Username
+		}
+		switch {
+		case !inv.IsPending(timeNow()):
+			ip.Problem = "This invitation has expired or has already been used."
+		case !strings.EqualFold(inv.Email, u.Email):
+			ip.Problem = fmt.Sprintf("This invitation was sent to %s. Log in with that account to accept it.", inv.Email)
+		}
+		env.loe(env.rndr.HTML(w, http.StatusOK, "invitation", ip))
+		return nil
+	}
+}
+
+func servePostAcceptInvitation(env *Env, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		token := pat.Param(r, "token")
+		m, err := ors.AcceptInvitation(token, u)
+		if err != nil {
+			fields := logrus.Fields{"user_id": u.ID}
+			switch {
+			case errors.Is(err, aderrors.ErrNoRecords):
+				env.saveFlash(w, r, "That invitation doesn't exist. It may have been revoked.")
+				http.Redirect(w, r, "/c", http.StatusFound)
+				return aderrors.New404Error("no such invitation", err).WithFields(fields)
+			case errors.Is(err, aderrors.ErrExpired), errors.Is(err, aderrors.ErrWrongRecipient):
+				http.Redirect(w, r, "/invitations/"+token, http.StatusFound)
+				return aderrors.NewError(http.StatusBadRequest, "invitation can't be accepted", err).WithFields(fields)
+			}
+			return aderrors.New500Error("error accepting invitation", err).WithFields(fields)
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditOrgInvitationAccepted,
+			TargetID: u.ID,
+			Details:  map[string]string{"org_id": m.OrgID, "role": string(m.Role)},
+		})
+		org, err := ors.GetOrg(m.OrgID)
+		if err != nil {
+			return aderrors.New500Error("error retrieving org", err).WithFields(logrus.Fields{"org_id": m.OrgID})
+		}
+		env.saveFlash(w, r, fmt.Sprintf("You're now a member of %s.", org.Name))
+		http.Redirect(w, r, "/c?org="+org.Slug, http.StatusFound)
+		return nil
+	}
+}
@@ -0,0 +1,147 @@
+package app
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// reminderPollInterval is the longest the dispatcher waits before
+	// looking for due reminders again, which is also how often one that
+	// failed to send is retried.
+	reminderPollInterval = time.Minute
+	// reminderGiveUpAfter is how long a reminder that keeps failing to send
+	// is retried for.
+	reminderGiveUpAfter = 24 * time.Hour
+)
+
+// reminderDispatcher sends todo reminders through each notifier when
+// they're due. The schedule is kept in the ReminderService, so reminders
+// that came due while the server was down are sent when it starts.
+type reminderDispatcher struct {
+	env       *Env
+	rs        models.ReminderService
+	tds       models.TodoService
+	notifiers []models.Notifier
+}
+
+// run sends reminders until ctx is cancelled. A reminder being sent when
+// it is finishes first.
+func (d *reminderDispatcher) run(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-d.env.reminderWake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		}
+		runJobOnce(ctx, d.env, job{name: "send reminders", run: d.sendDue})
+		timer.Reset(d.wait())
+	}
+}
+
+// wait returns how long until the next reminder is due.
+func (d *reminderDispatcher) wait() time.Duration {
+	next, err := d.rs.NextReminderTime()
+	if err != nil {
+		d.env.log.WithField("error", err).Error("error finding the next reminder")
+		return reminderPollInterval
+	}
+	// One already due failed to send, and is retried on the next poll
+	wait := next.Sub(timeNow())
+	if next.IsZero() || wait <= 0 || wait > reminderPollInterval {
+		return reminderPollInterval
+	}
+	return wait
+}
+
+func (d *reminderDispatcher) sendDue(ctx context.Context) error {
+	now := timeNow()
+	reminders, err := d.rs.ClaimDueReminders(now)
+	if err != nil {
+		return err
+	}
+	for _, r := range reminders {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := d.send(r, now); err != nil {
+			d.env.log.WithFields(logrus.Fields{"error": err, "todo_id": r.TodoID}).Error("error sending reminder")
+		}
+	}
+	return nil
+}
+
+// send sends the reminder through each notifier that hasn't yet, and
+// completes it once they all have. Each notifier that succeeds is saved
+// straight away, so a restart only resends through the notifier that was
+// sending it at the time.
+func (d *reminderDispatcher) send(r *models.Reminder, now time.Time) error {
+	td, err := d.tds.Get(r.TodoID)
+	if errors.Is(err, aderrors.ErrNoRecords) {
+		return d.rs.CompleteReminder(r)
+	} else if err != nil {
+		return err
+	}
+	if td.IsDone.Bool {
+		return d.rs.CompleteReminder(r)
+	}
+
+	n := reminderNotification(td, r)
+	var failed error
+	for _, nt := range d.notifiers {
+		if r.IsSentBy(nt.Name()) {
+			continue
+		}
+		if err := nt.Notify(n); err != nil {
+			failed = fmt.Errorf("error sending through %s: %w", nt.Name(), err)
+			continue
+		}
+		if err := d.rs.MarkReminderSent(r.TodoID, nt.Name()); err != nil {
+			return err
+		}
+	}
+	if failed != nil && now.Sub(r.ClaimedTime) < reminderGiveUpAfter {
+		return failed
+	} else if failed != nil {
+		d.env.log.WithFields(logrus.Fields{"error": failed, "todo_id": r.TodoID}).Error("giving up on reminder")
+	}
+	return d.rs.CompleteReminder(r)
+}
+
+// reminderNotification is what the user is told when the todo's reminder
+// is due. Its ID is the same each time it's sent.
+func reminderNotification(td *models.Todo, r *models.Reminder) *models.Notification {
+	body := "You asked to be reminded about this todo."
+	if td.DueAt.Valid {
+		body = "It's due " + td.DueAt.Time.In(td.Location()).Format("Mon 2 Jan 2006 at 15:04 MST") + "."
+	}
+	return &models.Notification{
+		ID:     "reminder-" + td.ID + "-" + strconv.FormatInt(r.RemindAt.Unix(), 10),
+		UserID: r.UserID,
+		Kind:   models.NotificationTodoReminder,
+		Title:  "Reminder: " + td.Name.String,
+		Body:   body,
+		TodoID: td.ID,
+	}
+}
+
+// wakeReminders tells the reminder dispatcher a reminder was scheduled.
+func (e *Env) wakeReminders() {
+	select {
+	case e.reminderWake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,226 @@
+package app
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/saml"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/sirupsen/logrus"
+)
+
+// SAMLConfig turns on logging in through a SAML identity provider.
+type SAMLConfig struct {
+	SP *saml.ServiceProvider
+	// LinkByEmail links an IdP user to the account with the same email the
+	// first time they log in. Only turn it on if the IdP checks emails.
+	LinkByEmail bool
+	// AllowIdPInitiated accepts logins started at the IdP, which aren't in
+	// response to one of our AuthnRequests.
+	AllowIdPInitiated bool
+	// DisableProvisioning stops accounts being created for IdP users who
+	// don't have one.
+	DisableProvisioning bool
+}
+
+// provider is what identities at the IdP are linked under.
+func (sc *SAMLConfig) provider() string {
+	return "saml:" + sc.SP.IdP.EntityID
+}
+
+func serveSAMLMetadata(env *Env) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.WriteHeader(http.StatusOK)
+		_, err := w.Write(env.saml.SP.Metadata())
+		env.loe(err)
+		return nil
+	}
+}
+
+// serveSAMLLogin sends the browser to the IdP with an AuthnRequest,
+// remembering where to go once the user is logged in.
+func serveSAMLLogin(env *Env, ss models.SAMLService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		next := localPath(r.FormValue("next"))
+		if u := env.getUser(r); u != nil {
+			http.Redirect(w, r, next, http.StatusFound)
+			return nil
+		}
+
+		req := &models.SAMLRequest{
+			ID:         saml.NewRequestID(),
+			Next:       next,
+			ExpiryTime: timeNow().Add(models.SAMLRequestLifetime),
+		}
+		if err := ss.SaveSAMLRequest(req); err != nil {
+			return aderrors.New500Error("error saving SAML request", err)
+		}
+		u, err := env.saml.SP.AuthnRequestURL(req.ID, "", timeNow())
+		if err != nil {
+			return aderrors.New500Error("error creating SAML request", err)
+		}
+		http.Redirect(w, r, u, http.StatusFound)
+		return nil
+	}
+}
+
+// servePostSAMLACS is the assertion consumer service, which the IdP posts
+// its Response to after the user logs in there.
+func servePostSAMLACS(env *Env, udb models.UserService, sdb models.SessionService, ids models.IdentityService, ss models.SAMLService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		a, err := env.saml.SP.ParseResponse(r.FormValue("SAMLResponse"), timeNow())
+		if err != nil {
+			env.recordAudit(r, loginFailedEvent("", "", "invalid_saml_response"))
+			env.saveFlash(w, r, "We couldn't log you in with your identity provider. Please try again.")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "invalid SAML response", err)
+		}
+
+		next := "/c"
+		if a.InResponseTo != "" {
+			req, err := ss.ConsumeSAMLRequest(a.InResponseTo)
+			if errors.Is(err, aderrors.ErrNoRecords) || errors.Is(err, aderrors.ErrExpired) {
+				env.saveFlash(w, r, "That login took too long or was already used. Please try again.")
+				http.Redirect(w, r, "/login", http.StatusFound)
+				return aderrors.NewError(http.StatusBadRequest, "SAML response to an unknown request", err).WithFields(
+					logrus.Fields{"in_response_to": a.InResponseTo})
+			} else if err != nil {
+				return aderrors.New500Error("error consuming SAML request", err)
+			}
+			next = req.Next
+		} else if env.saml.AllowIdPInitiated {
+			next = localPath(r.FormValue("RelayState"))
+		} else {
+			env.saveFlash(w, r, "Please start logging in from here.")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "unsolicited SAML response", nil).WithFields(
+				logrus.Fields{"name_id": a.NameID})
+		}
+
+		if err := ss.UseSAMLAssertion(a.ID, a.Expiry); errors.Is(err, aderrors.ErrTokenReused) {
+			env.recordAudit(r, loginFailedEvent("", a.Email(), "saml_assertion_reused"))
+			env.saveFlash(w, r, "That login was already used. Please try again.")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "SAML assertion replayed", err).WithFields(
+				logrus.Fields{"assertion_id": a.ID})
+		} else if err != nil {
+			return aderrors.New500Error("error using SAML assertion", err)
+		}
+
+		if a.NameIDFormat == saml.NameIDFormatTransient {
+			env.saveFlash(w, r, "Your identity provider needs to send a persistent NameID. Please contact support.")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusBadRequest, "transient SAML NameID", nil)
+		}
+
+		u, problem, err := samlUser(env, r, udb, sdb, ids, a)
+		if err != nil {
+			return aderrors.New500Error("error finding the user for a SAML login", err).WithFields(
+				logrus.Fields{"name_id": a.NameID})
+		}
+		if problem != "" {
+			env.recordAudit(r, loginFailedEvent("", a.Email(), "saml_no_account"))
+			env.saveFlash(w, r, problem)
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusForbidden, "no account for SAML login", nil).WithFields(
+				logrus.Fields{"name_id": a.NameID, "email": a.Email()})
+		}
+		if u.IsLocked() {
+			env.recordAudit(r, loginFailedEvent(u.ID, u.Email, "locked"))
+			env.saveFlash(w, r, "This account has been locked. Please contact support.")
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return aderrors.NewError(http.StatusForbidden, "locked user tried to log in", nil).WithFields(
+				logrus.Fields{"user_id": u.ID})
+		}
+		env.loe(ids.RecordIdentityLogin(env.saml.provider(), a.NameID))
+
+		sess, err := sdb.CreateSession(u.ID, false, models.SessionOptions{Client: clientInfo(r)})
+		if err != nil {
+			return aderrors.New500Error("error creating session for user", err).WithFields(logrus.Fields{"user_id": u.ID})
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditLoginSucceeded,
+			ActorID:  u.ID,
+			TargetID: u.ID,
+			Details:  map[string]string{"session_id": sess.ID, "remember": "false", "method": "saml"},
+		})
+		env.loe(env.saveSessionCookie(w, r, sess.ID))
+		http.Redirect(w, r, next, http.StatusFound)
+		return nil
+	}
+}
+
+// samlUser returns the user the assertion is about. Users are found by the
+// identity linked to them, and failing that linked by email if that's
+// allowed, or else given a new account. problem explains why a user
+// can't log in.
+func samlUser(env *Env, r *http.Request, udb models.UserService, sdb models.SessionService, ids models.IdentityService, a *saml.Assertion) (u *models.User, problem string, err error) {
+	provider := env.saml.provider()
+	li, err := ids.GetIdentity(provider, a.NameID)
+	if err == nil {
+		u, err = udb.Get(li.UserID)
+		return u, "", err
+	} else if !errors.Is(err, aderrors.ErrNoRecords) {
+		return nil, "", err
+	}
+
+	email := strings.ToLower(strings.TrimSpace(a.Email()))
+	if !govalidator.IsEmail(email) {
+		return nil, "Your identity provider didn't send your email address. Please contact support.", nil
+	}
+	u, err = sdb.GetUserByEmail(email)
+	switch {
+	case err == nil && !env.saml.LinkByEmail:
+		return nil, "You already have an account with that email. Log in with your password instead.", nil
+	case errors.Is(err, aderrors.ErrNoRecords) && env.saml.DisableProvisioning:
+		return nil, "You don't have an account here yet. Please ask an admin for one.", nil
+	case errors.Is(err, aderrors.ErrNoRecords):
+		if u, err = provisionSAMLUser(env, r, sdb, email, a); err != nil {
+			return nil, "", err
+		}
+	case err != nil:
+		return nil, "", err
+	}
+
+	li = &models.LinkedIdentity{Provider: provider, Subject: a.NameID, UserID: u.ID, Email: email}
+	if _, err := ids.LinkIdentity(li); err != nil {
+		return nil, "", err
+	}
+	env.recordAudit(r, &models.AuditEvent{
+		Action:   models.AuditIdentityLinked,
+		ActorID:  u.ID,
+		TargetID: u.ID,
+		Details:  map[string]string{"provider": provider, "subject": a.NameID},
+	})
+	return u, "", nil
+}
+
+// provisionSAMLUser creates an account for an IdP user logging in for the
+// first time.
+func provisionSAMLUser(env *Env, r *http.Request, sdb models.SessionService, email string, a *saml.Assertion) (*models.User, error) {
+	u, err := provisionUser(sdb, email, a.Username(), a.DisplayName())
+	if err != nil {
+		return nil, err
+	}
+	env.recordAudit(r, &models.AuditEvent{
+		Action:   models.AuditSignup,
+		ActorID:  u.ID,
+		TargetID: u.ID,
+		Details:  map[string]string{"method": "saml"},
+	})
+	return u, nil
+}
+
+// localPath returns next if it's a path on this site, so it's safe to
+// redirect to, or else the home page.
+func localPath(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/c"
+	}
+	return next
+}
@@ -0,0 +1,678 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/scim"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"goji.io/middleware"
+	"goji.io/pat"
+)
+
+// scimBasePath is where an org's directory provisions users and groups.
+// Each org has its own bearer token, which decides the org a request is for.
+const scimBasePath = "/scim/v2"
+
+// The attributes SCIM clients can't change on each resource.
+var (
+	scimUserReadOnly  = []string{"id", "meta", "groups"}
+	scimGroupReadOnly = []string{"id", "meta"}
+)
+
+func (e *Env) scimJSON(w http.ResponseWriter, statusCode int, obj interface{}) error {
+	w.Header().Set("Content-Type", scim.MediaType)
+	w.WriteHeader(statusCode)
+	return json.NewEncoder(w).Encode(obj)
+}
+
+// scimErrorHandler writes errors in the SCIM error schema.
+func scimErrorHandler(env *Env) router.ErrorHandler {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		var se *scim.Error
+		var ase aderrors.APIStatusError
+		switch {
+		case errors.As(err, &se):
+			env.log.WithField("path", r.URL.Path).Info(se.Error())
+		case errors.As(err, &ase):
+			env.log.WithFields(ase.Fields()).Error(ase.Error())
+			se = scim.NewError(ase.Status(), "", ase.PublicMessage)
+		default:
+			env.log.Errorf("%+v", err)
+			se = scim.NewError(http.StatusInternalServerError, "", "Internal Server Error")
+		}
+		if se.Status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scim"`)
+		}
+		env.loe(env.scimJSON(w, se.Status, se))
+	}
+}
+
+func handle404SCIMMiddleware(env *Env) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			if middleware.Handler(r.Context()) == nil {
+				env.loe(env.scimJSON(w, http.StatusNotFound, scim.NotFound("No such endpoint")))
+				return
+			}
+			next.ServeHTTP(w, r)
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// scimAuthMiddleware authenticates the org's directory by its bearer token.
+func scimAuthMiddleware(env *Env, ors models.OrgService) func(next router.HandlerError) router.HandlerError {
+	return func(next router.HandlerError) router.HandlerError {
+		return func(w http.ResponseWriter, r *http.Request) error {
+			auth := r.Header.Get("Authorization")
+			if len(auth) < 7 || !strings.EqualFold(auth[:7], "bearer ") {
+				return scim.NewError(http.StatusUnauthorized, "", "A bearer token is required")
+			}
+			org, err := ors.GetOrgBySCIMToken(strings.TrimSpace(auth[7:]))
+			if errors.Is(err, aderrors.ErrNoRecords) {
+				return scim.NewError(http.StatusUnauthorized, "", "That token isn't valid")
+			}
+			if err != nil {
+				return fmt.Errorf("error retrieving org by SCIM token: %w", err)
+			}
+			ctx := context.WithValue(r.Context(), scimOrgKeyConst, org)
+			return next(w, r.WithContext(ctx))
+		}
+	}
+}
+
+// getSCIMOrg returns the org whose directory made the request.
+func (e *Env) getSCIMOrg(r *http.Request) *models.Org {
+	org, _ := r.Context().Value(scimOrgKeyConst).(*models.Org)
+	return org
+}
+
+// recordSCIMAudit records a change made by the org's directory. There is
+// no user to blame, so the org is noted instead.
+func (e *Env) recordSCIMAudit(r *http.Request, action, targetID string, details map[string]string) {
+	if details == nil {
+		details = map[string]string{}
+	}
+	details["org_id"] = e.getSCIMOrg(r).ID
+	e.recordAudit(r, &models.AuditEvent{Action: action, TargetID: targetID, Details: details})
+}
+
+func (e *Env) scimLocation(resourceType, id string) string {
+	return "http://" + e.gp.SiteURL + scimBasePath + "/" + resourceType + "/" + id
+}
+
+func decodeSCIM(w http.ResponseWriter, r *http.Request, v interface{}) error {
+	r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return scim.NewError(http.StatusBadRequest, scim.ErrInvalidSyntax, fmt.Sprintf("The request body isn't valid: %s", err))
+	}
+	return nil
+}
+
+// scimPage reads the filter and pagination parameters of a list request.
+func scimPage(r *http.Request) (scim.Filter, int, int, error) {
+	q := r.URL.Query()
+	var f scim.Filter
+	if s := q.Get("filter"); s != "" {
+		var err error
+		if f, err = scim.ParseFilter(s); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	startIndex, count := 1, scim.MaxResults
+	for name, v := range map[string]*int{"startIndex": &startIndex, "count": &count} {
+		if s := q.Get(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return nil, 0, 0, scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, name+" must be a number")
+			}
+			*v = n
+		}
+	}
+	return f, startIndex, count, nil
+}
+
+// scimList filters the resources and returns the requested page.
+func scimList(r *http.Request, resources []interface{}) (*scim.ListResponse, error) {
+	f, startIndex, count, err := scimPage(r)
+	if err != nil {
+		return nil, err
+	}
+	matched := []interface{}{}
+	for _, res := range resources {
+		if f != nil {
+			m, err := scim.ToMap(res)
+			if err != nil {
+				return nil, err
+			}
+			if !f.Matches(m) {
+				continue
+			}
+		}
+		matched = append(matched, res)
+	}
+	return scim.NewListResponse(matched, startIndex, count), nil
+}
+
+func (e *Env) scimUser(u *models.User, m *models.Membership, groups []*models.Group) *scim.User {
+	active := m.IsActive()
+	su := &scim.User{
+		Schemas:     []string{scim.UserSchema},
+		ID:          u.ID,
+		ExternalID:  m.ExternalID,
+		UserName:    u.Username,
+		DisplayName: u.Name,
+		Emails:      []scim.MultiValue{{Value: u.Email, Type: "work", Primary: true}},
+		Active:      &active,
+		Meta: &scim.Meta{
+			ResourceType: "User",
+			Created:      m.DateJoined,
+			LastModified: m.DateJoined,
+			Location:     e.scimLocation("Users", u.ID),
+		},
+	}
+	if m.DeactivatedTime.After(m.DateJoined) {
+		su.Meta.LastModified = m.DeactivatedTime
+	}
+	if u.Name != "" {
+		su.Name = &scim.Name{Formatted: u.Name}
+	}
+	for _, g := range groups {
+		if g.HasMember(u.ID) {
+			su.Groups = append(su.Groups, scim.MultiValue{Value: g.ID, Display: g.DisplayName, Ref: e.scimLocation("Groups", g.ID)})
+		}
+	}
+	return su
+}
+
+func (e *Env) scimGroup(g *models.Group) *scim.Group {
+	sg := &scim.Group{
+		Schemas:     []string{scim.GroupSchema},
+		ID:          g.ID,
+		ExternalID:  g.ExternalID,
+		DisplayName: g.DisplayName,
+		Members:     []scim.MultiValue{},
+		Meta: &scim.Meta{
+			ResourceType: "Group",
+			Created:      g.DateCreated,
+			LastModified: g.DateModified,
+			Location:     e.scimLocation("Groups", g.ID),
+		},
+	}
+	if g.Role != "" {
+		sg.Schemas = append(sg.Schemas, scim.GroupRoleSchema)
+		sg.Role = &scim.GroupRoleExtension{Role: string(g.Role)}
+	}
+	for _, id := range g.MemberIDs {
+		sg.Members = append(sg.Members, scim.MultiValue{Value: id, Ref: e.scimLocation("Users", id)})
+	}
+	return sg
+}
+
+// scimMember looks up the :id in the url among the org's members.
+func scimMember(r *http.Request, org *models.Org, ors models.OrgService, udb models.UserService) (*models.User, *models.Membership, error) {
+	id := pat.Param(r, "id")
+	m, err := ors.GetMembership(org.ID, id)
+	if errors.Is(err, aderrors.ErrNoRecords) {
+		return nil, nil, scim.NotFound(fmt.Sprintf("User %s not found", id))
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	u, err := udb.Get(id)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error retrieving user %s: %w", id, err)
+	}
+	return u, m, nil
+}
+
+// normalizeSCIMUserName turns a userName into one of our usernames.
+func normalizeSCIMUserName(userName string) string {
+	return strings.ToLower(strings.Replace(strings.TrimSpace(userName), " ", "_", -1))
+}
+
+func serveSCIMServiceProviderConfig(env *Env) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		supported := func(ok bool) map[string]interface{} { return map[string]interface{}{"supported": ok} }
+		env.loe(env.scimJSON(w, http.StatusOK, map[string]interface{}{
+			"schemas":        []string{scim.ServiceProviderConfigSchema},
+			"patch":          supported(true),
+			"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+			"filter":         map[string]interface{}{"supported": true, "maxResults": scim.MaxResults},
+			"changePassword": supported(true),
+			"sort":           supported(false),
+			"etag":           supported(false),
+			"authenticationSchemes": []map[string]interface{}{{
+				"type":        "oauthbearertoken",
+				"name":        "Bearer Token",
+				"description": "The org's SCIM token, created in the org's settings",
+				"primary":     true,
+			}},
+		}))
+		return nil
+	}
+}
+
+func serveSCIMUsers(env *Env, ors models.OrgService, gs models.GroupService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org := env.getSCIMOrg(r)
+		members, err := ors.GetMembers(org.ID)
+		if err != nil {
+			return err
+		}
+		groups, err := gs.GetGroups(org.ID)
+		if err != nil {
+			return err
+		}
+		users := []interface{}{}
+		for _, m := range members {
+			u, err := udb.Get(m.UserID)
+			if err != nil {
+				return fmt.Errorf("error retrieving user %s: %w", m.UserID, err)
+			}
+			users = append(users, env.scimUser(u, m, groups))
+		}
+		res, err := scimList(r, users)
+		if err != nil {
+			return err
+		}
+		env.loe(env.scimJSON(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+func serveSCIMUser(env *Env, ors models.OrgService, gs models.GroupService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org := env.getSCIMOrg(r)
+		u, m, err := scimMember(r, org, ors, udb)
+		if err != nil {
+			return err
+		}
+		groups, err := gs.GetGroups(org.ID)
+		if err != nil {
+			return err
+		}
+		env.loe(env.scimJSON(w, http.StatusOK, env.scimUser(u, m, groups)))
+		return nil
+	}
+}
+
+// serveSCIMCreateUser creates an account for the user and adds them to the
+// org as a member. Without a password, the account gets one nobody knows.
+// Existing accounts aren't taken over: they have to be invited instead.
+func serveSCIMCreateUser(env *Env, ors models.OrgService, sdb models.SessionService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org := env.getSCIMOrg(r)
+		var su scim.User
+		if err := decodeSCIM(w, r, &su); err != nil {
+			return err
+		}
+		username := normalizeSCIMUserName(su.UserName)
+		email := strings.ToLower(strings.TrimSpace(su.PrimaryEmail()))
+		switch {
+		case len(username) < 2:
+			return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "userName needs to be at least 2 characters long")
+		case !govalidator.IsEmail(email):
+			return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "A valid email is required")
+		}
+
+		if u, err := sdb.GetUserByEmail(email); err != nil && !errors.Is(err, aderrors.ErrNoRecords) {
+			return fmt.Errorf("error retrieving user by email: %w", err)
+		} else if u != nil {
+			return scim.NewError(http.StatusConflict, scim.ErrUniqueness, "An account with that email already exists. Invite them to the org instead")
+		}
+		if u, err := sdb.GetUserByUsername(username); err != nil && !errors.Is(err, aderrors.ErrNoRecords) {
+			return fmt.Errorf("error retrieving user by username: %w", err)
+		} else if u != nil {
+			return scim.NewError(http.StatusConflict, scim.ErrUniqueness, "That userName is taken")
+		}
+
+		u := &models.User{
+			Email:    email,
+			Username: username,
+			Name:     su.FormattedName(),
+			D:        &models.UserMetadata{IsFirstTime: true, SCIMOrgID: org.ID},
+		}
+		u.GenerateID()
+		if su.Password != "" {
+			if err := env.pwPolicy.Check("password", su.Password, username, email); err != nil {
+				return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, err.Error())
+			}
+			if err := u.SetPassword(su.Password); err != nil {
+				return err
+			}
+		} else if err := u.SetRandomPassword(); err != nil {
+			return err
+		}
+		if ok, err := sdb.CreateUser(u); !ok || err != nil {
+			return fmt.Errorf("error creating user from SCIM: %w", err)
+		}
+
+		m := &models.Membership{OrgID: org.ID, UserID: u.ID, Role: models.OrgRoleMember, ExternalID: su.ExternalID}
+		if !su.IsActive() {
+			m.DeactivatedTime = timeNow()
+		}
+		if err := ors.AddMember(m); err != nil {
+			return err
+		}
+		env.recordSCIMAudit(r, models.AuditSCIMUserCreated, u.ID, nil)
+
+		w.Header().Set("Location", env.scimLocation("Users", u.ID))
+		env.loe(env.scimJSON(w, http.StatusCreated, env.scimUser(u, m, nil)))
+		return nil
+	}
+}
+
+// updateSCIMUser applies the directory's view of the user. The account's
+// name, email and password only change if the org's directory created the
+// account; for everyone else only their membership changes. Owners can't
+// be deactivated, so the directory can't lock an org's owners out of it.
+func (e *Env) updateSCIMUser(org *models.Org, u *models.User, m *models.Membership, su *scim.User, ors models.OrgService, udb models.UserService) error {
+	if normalizeSCIMUserName(su.UserName) != u.Username {
+		return scim.NewError(http.StatusBadRequest, scim.ErrMutability, "userName can't be changed")
+	}
+
+	if u.D != nil && u.D.SCIMOrgID == org.ID {
+		email := strings.ToLower(strings.TrimSpace(su.PrimaryEmail()))
+		if !govalidator.IsEmail(email) {
+			return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "A valid email is required")
+		}
+		if su.Password != "" {
+			if err := e.pwPolicy.Check("password", su.Password, u.Username, email); err != nil {
+				return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, err.Error())
+			}
+			if err := u.SetPassword(su.Password); err != nil {
+				return err
+			}
+		}
+		u.Name = su.FormattedName()
+		if _, err := udb.Update(u); err != nil {
+			return err
+		}
+		if email != u.Email {
+			_, err := udb.ChangeEmail(u, email)
+			if errors.Is(err, aderrors.ErrAlreadyExists) {
+				return scim.NewError(http.StatusConflict, scim.ErrUniqueness, "Another account has that email")
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	m.ExternalID = su.ExternalID
+	switch {
+	case su.IsActive():
+		m.DeactivatedTime = time.Time{}
+	case m.Role == models.OrgRoleOwner:
+		return scim.NewError(http.StatusBadRequest, scim.ErrMutability, "Owners of the org can't be deactivated")
+	case m.IsActive():
+		m.DeactivatedTime = timeNow()
+	}
+	return ors.UpdateMember(m)
+}
+
+func serveSCIMReplaceUser(env *Env, ors models.OrgService, gs models.GroupService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org := env.getSCIMOrg(r)
+		u, m, err := scimMember(r, org, ors, udb)
+		if err != nil {
+			return err
+		}
+		var su scim.User
+		if err := decodeSCIM(w, r, &su); err != nil {
+			return err
+		}
+		if err := env.updateSCIMUser(org, u, m, &su, ors, udb); err != nil {
+			return err
+		}
+		env.recordSCIMAudit(r, models.AuditSCIMUserUpdated, u.ID, nil)
+		return serveSCIMUser(env, ors, gs, udb)(w, r)
+	}
+}
+
+func serveSCIMPatchUser(env *Env, ors models.OrgService, gs models.GroupService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org := env.getSCIMOrg(r)
+		u, m, err := scimMember(r, org, ors, udb)
+		if err != nil {
+			return err
+		}
+		var po scim.PatchOp
+		if err := decodeSCIM(w, r, &po); err != nil {
+			return err
+		}
+		groups, err := gs.GetGroups(org.ID)
+		if err != nil {
+			return err
+		}
+		res, err := scim.ToMap(env.scimUser(u, m, groups))
+		if err != nil {
+			return err
+		}
+		if err := po.Apply(res, scimUserReadOnly...); err != nil {
+			return err
+		}
+		// Some directories send active as "True" or "False"
+		if s, ok := res["active"].(string); ok {
+			active, err := strconv.ParseBool(s)
+			if err != nil {
+				return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "active must be true or false")
+			}
+			res["active"] = active
+		}
+		var su scim.User
+		if err := scim.FromMap(res, &su); err != nil {
+			return err
+		}
+		if err := env.updateSCIMUser(org, u, m, &su, ors, udb); err != nil {
+			return err
+		}
+		env.recordSCIMAudit(r, models.AuditSCIMUserUpdated, u.ID, nil)
+		env.loe(env.scimJSON(w, http.StatusOK, env.scimUser(u, m, groups)))
+		return nil
+	}
+}
+
+// serveSCIMDeleteUser takes the user out of the org. Their account is left
+// alone, as it may be used outside the org.
+func serveSCIMDeleteUser(env *Env, ors models.OrgService, udb models.UserService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org := env.getSCIMOrg(r)
+		u, m, err := scimMember(r, org, ors, udb)
+		if err != nil {
+			return err
+		}
+		if m.Role == models.OrgRoleOwner {
+			return scim.NewError(http.StatusBadRequest, scim.ErrMutability, "Owners of the org can't be removed")
+		}
+		if err := ors.RemoveMember(org.ID, u.ID); err != nil {
+			return err
+		}
+		env.recordSCIMAudit(r, models.AuditSCIMUserDeleted, u.ID, nil)
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+func scimGroupFromURL(r *http.Request, org *models.Org, gs models.GroupService) (*models.Group, error) {
+	id := pat.Param(r, "id")
+	g, err := gs.GetGroup(org.ID, id)
+	if errors.Is(err, aderrors.ErrNoRecords) {
+		return nil, scim.NotFound(fmt.Sprintf("Group %s not found", id))
+	}
+	return g, err
+}
+
+// applySCIMGroup copies the directory's view of the group onto g. Members
+// have to be members of the org, and groups can't make anyone an owner.
+func applySCIMGroup(g *models.Group, sg *scim.Group, ors models.OrgService) error {
+	name := strings.TrimSpace(sg.DisplayName)
+	if name == "" {
+		return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, "displayName is required")
+	}
+	var role models.OrgRole
+	if sg.Role != nil && sg.Role.Role != "" {
+		role = models.OrgRole(sg.Role.Role)
+		if !role.IsValid() || role == models.OrgRoleOwner {
+			return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, fmt.Sprintf("%q is not a role groups can give", sg.Role.Role))
+		}
+	}
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, mv := range sg.Members {
+		if seen[mv.Value] {
+			continue
+		}
+		seen[mv.Value] = true
+		_, err := ors.GetMembership(g.OrgID, mv.Value)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			return scim.NewError(http.StatusBadRequest, scim.ErrInvalidValue, fmt.Sprintf("User %s is not in the org", mv.Value))
+		}
+		if err != nil {
+			return err
+		}
+		ids = append(ids, mv.Value)
+	}
+	g.DisplayName = name
+	g.ExternalID = sg.ExternalID
+	g.Role = role
+	g.MemberIDs = ids
+	return nil
+}
+
+func scimGroupError(err error) error {
+	if errors.Is(err, aderrors.ErrAlreadyExists) {
+		return scim.NewError(http.StatusConflict, scim.ErrUniqueness, "A group with that displayName already exists")
+	}
+	return err
+}
+
+func serveSCIMGroups(env *Env, gs models.GroupService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		groups, err := gs.GetGroups(env.getSCIMOrg(r).ID)
+		if err != nil {
+			return err
+		}
+		resources := []interface{}{}
+		for _, g := range groups {
+			resources = append(resources, env.scimGroup(g))
+		}
+		res, err := scimList(r, resources)
+		if err != nil {
+			return err
+		}
+		env.loe(env.scimJSON(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+func serveSCIMGroup(env *Env, gs models.GroupService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		g, err := scimGroupFromURL(r, env.getSCIMOrg(r), gs)
+		if err != nil {
+			return err
+		}
+		env.loe(env.scimJSON(w, http.StatusOK, env.scimGroup(g)))
+		return nil
+	}
+}
+
+func serveSCIMCreateGroup(env *Env, ors models.OrgService, gs models.GroupService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var sg scim.Group
+		if err := decodeSCIM(w, r, &sg); err != nil {
+			return err
+		}
+		g := &models.Group{OrgID: env.getSCIMOrg(r).ID}
+		if err := applySCIMGroup(g, &sg, ors); err != nil {
+			return err
+		}
+		g.GenerateID()
+		if err := gs.CreateGroup(g); err != nil {
+			return scimGroupError(err)
+		}
+		env.recordSCIMAudit(r, models.AuditSCIMGroupCreated, "", map[string]string{"group_id": g.ID, "role": string(g.Role)})
+
+		w.Header().Set("Location", env.scimLocation("Groups", g.ID))
+		env.loe(env.scimJSON(w, http.StatusCreated, env.scimGroup(g)))
+		return nil
+	}
+}
+
+func serveSCIMReplaceGroup(env *Env, ors models.OrgService, gs models.GroupService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		g, err := scimGroupFromURL(r, env.getSCIMOrg(r), gs)
+		if err != nil {
+			return err
+		}
+		var sg scim.Group
+		if err := decodeSCIM(w, r, &sg); err != nil {
+			return err
+		}
+		return env.saveSCIMGroup(w, r, g, &sg, ors, gs)
+	}
+}
+
+func serveSCIMPatchGroup(env *Env, ors models.OrgService, gs models.GroupService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		g, err := scimGroupFromURL(r, env.getSCIMOrg(r), gs)
+		if err != nil {
+			return err
+		}
+		var po scim.PatchOp
+		if err := decodeSCIM(w, r, &po); err != nil {
+			return err
+		}
+		res, err := scim.ToMap(env.scimGroup(g))
+		if err != nil {
+			return err
+		}
+		if err := po.Apply(res, scimGroupReadOnly...); err != nil {
+			return err
+		}
+		var sg scim.Group
+		if err := scim.FromMap(res, &sg); err != nil {
+			return err
+		}
+		return env.saveSCIMGroup(w, r, g, &sg, ors, gs)
+	}
+}
+
+func (e *Env) saveSCIMGroup(w http.ResponseWriter, r *http.Request, g *models.Group, sg *scim.Group, ors models.OrgService, gs models.GroupService) error {
+	if err := applySCIMGroup(g, sg, ors); err != nil {
+		return err
+	}
+	if err := gs.UpdateGroup(g); err != nil {
+		return scimGroupError(err)
+	}
+	e.recordSCIMAudit(r, models.AuditSCIMGroupUpdated, "", map[string]string{"group_id": g.ID, "role": string(g.Role)})
+	e.loe(e.scimJSON(w, http.StatusOK, e.scimGroup(g)))
+	return nil
+}
+
+func serveSCIMDeleteGroup(env *Env, gs models.GroupService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		org := env.getSCIMOrg(r)
+		g, err := scimGroupFromURL(r, org, gs)
+		if err != nil {
+			return err
+		}
+		if err := gs.DeleteGroup(org.ID, g.ID); err != nil {
+			return err
+		}
+		env.recordSCIMAudit(r, models.AuditSCIMGroupDeleted, "", map[string]string{"group_id": g.ID})
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
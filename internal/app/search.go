@@ -0,0 +1,66 @@
+package app
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+)
+
+// maxSearchQueryLength is how long a search query can be, in bytes.
+const maxSearchQueryLength = 500
+
+// serveAPISearch finds the todos the user can see matching ?q= by their
+// names, notes and comments, best match first, a page at a time. Each
+// result has the todo it found included.
+func serveAPISearch(env *Env, ss models.SearchService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		q := r.URL.Query()
+		query := strings.TrimSpace(q.Get("q"))
+		var ve aderrors.ValidationError
+		switch {
+		case query == "":
+			ve.Add("q", "query_required", "Enter something to search for.")
+		case len(query) > maxSearchQueryLength:
+			ve.Add("q", "query_too_long", fmt.Sprintf("Searches can't be longer than %d characters.", maxSearchQueryLength))
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		page, size := pageParams(q, "page[number]", "page[size]")
+		results, total, err := ss.Search(query, env.getUser(r).ID, (page-1)*size, size)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error searching for %q: %w", query, err))
+		}
+		p, err := jsonapi.Marshal(results)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error marshalling search results: %w", err))
+		}
+		payload := p.(*jsonapi.ManyPayload)
+		payload.Included = filterIncluded(payload.Included, func(n *jsonapi.Node) bool { return n.Type == "todo" })
+		payload.Links = paginationLinks(r.URL, page, size, total)
+		payload.Meta = &jsonapi.Meta{"total": total}
+
+		w.Header().Set("Content-Type", jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		env.loe(json.NewEncoder(w).Encode(payload))
+		return nil
+	}
+}
+
+// Reindex builds the search index again from every todo and comment, for
+// data saved before there was an index, returning the number indexed.
+func Reindex() (int, error) {
+	if pdb == nil {
+		return 0, errors.New("db has not been set")
+	}
+	return (&datastore.SearchStore{BDB: pdb}).Reindex()
+}
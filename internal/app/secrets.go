@@ -2,9 +2,15 @@ package app
 
 // In a real production app, it isn't recommended to embed cookie secrets into source code.
 const (
-	cookieSecretKey  = "cOWOs._Ew*nG{<Wu,,MLubJx71-F2.913<RDIuE|VLAf%:5t q4|+lC#{~MwmBh1"
-	sessionNameConst = "session-auth_demo-3501382"
-	sessionKeyConst  = "session_key-auth_demo-1293485"
-	userKeyConst     = "user-key-2401851"
-	csrfSecretKey    = "bN?>2A&X]3a8dvQ-ge/0C3~[UDlcn9[L"
+	cookieSecretKey             = "cOWOs._Ew*nG{<Wu,,MLubJx71-F2.913<RDIuE|VLAf%:5t q4|+lC#{~MwmBh1"
+	sessionNameConst            = "session-auth_demo-3501382"
+	sessionKeyConst             = "session_key-auth_demo-1293485"
+	rememberNameConst           = "remember-auth_demo-8812045"
+	rememberKeyConst            = "remember_key-auth_demo-5520917"
+	userKeyConst                = "user-key-2401851"
+	sessionIDKeyConst           = "session-id-key-7730214"
+	impersonatorKeyConst        = "impersonator-key-6190378"
+	scimOrgKeyConst             = "scim-org-key-3358120"
+	impersonatorSessionKeyConst = "impersonator_session_key-auth_demo-4417260"
+	csrfSecretKey               = "bN?>2A&X]3a8dvQ-ge/0C3~[UDlcn9[L"
 )
@@ -0,0 +1,160 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/gorilla/csrf"
+	"github.com/sirupsen/logrus"
+	"goji.io/pat"
+)
+
+// apiSession is the public representation of a models.Session.
+// The token itself is never exposed.
+type apiSession struct {
+	ID           string    `jsonapi:"primary,session"`
+	Kind         string    `jsonapi:"attr,kind"`
+	DeviceName   string    `jsonapi:"attr,device_name"`
+	UserAgent    string    `jsonapi:"attr,user_agent"`
+	IP           string    `jsonapi:"attr,ip"`
+	LoginTime    time.Time `jsonapi:"attr,login_time,iso8601"`
+	LastSeenTime time.Time `jsonapi:"attr,last_seen_time,iso8601"`
+	Current      bool      `jsonapi:"attr,current"`
+	Impersonated bool      `jsonapi:"attr,impersonated"`
+}
+
+func newAPISession(sess *models.Session, currentSessionID string) *apiSession {
+	kind := "session"
+	if sess.TokenOnly {
+		kind = "token"
+	}
+	return &apiSession{
+		ID:           sess.ID,
+		Kind:         kind,
+		DeviceName:   sess.DeviceName,
+		UserAgent:    sess.UserAgent,
+		IP:           sess.IP,
+		LoginTime:    sess.LoginTime,
+		LastSeenTime: sess.LastSeenTime,
+		Current:      sess.ID == currentSessionID,
+		Impersonated: sess.IsImpersonation(),
+	}
+}
+
+// sessionsPresenter is used to render the sessions settings page.
+type sessionsPresenter struct {
+	*localPresenter
+	Sessions []*apiSession
+}
+
+func serveSessions(env *Env, sdb models.SessionService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		sessions, err := sdb.GetSessionsByUserID(u.ID)
+		if err != nil {
+			return aderrors.New500Error("error retrieving sessions for user", err).WithFields(logrus.Fields{"user_id": u.ID})
+		}
+
+		currentID := env.getSessionID(r)
+		sp := &sessionsPresenter{
+			localPresenter: &localPresenter{
+				PageTitle:       "Sessions",
+				PageURL:         "/settings/sessions",
+				CSRFToken:       csrf.Token(r),
+				Flashes:         env.getFlash(w, r),
+				Impersonating:   env.impersonating(r),
+				globalPresenter: env.gp,
+			},
+		}
+		for _, s := range sessions {
+			sp.Sessions = append(sp.Sessions, newAPISession(s, currentID))
+		}
+		env.loe(env.rndr.HTML(w, http.StatusOK, "sessions", sp))
+		return nil
+	}
+}
+
+func servePostRevokeSession(env *Env, sdb models.SessionService, rdb models.RememberTokenService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		id := pat.Param(r, "id")
+		err := revokeSession(sdb, rdb, u, id)
+		if err != nil {
+			if errors.Is(err, aderrors.ErrNoRecords) {
+				env.saveFlash(w, r, "That session no longer exists.")
+				http.Redirect(w, r, "/settings/sessions", http.StatusFound)
+				return aderrors.NewError(http.StatusNotFound, "no such session to revoke", err).WithFields(
+					logrus.Fields{"user_id": u.ID, "session_id": id})
+			}
+			return aderrors.New500Error("error revoking session", err).WithFields(
+				logrus.Fields{"user_id": u.ID, "session_id": id})
+		}
+		env.recordAudit(r, sessionRevokedEvent(u, id))
+
+		if id == env.getSessionID(r) {
+			env.clearAuthCookies(w, r)
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return nil
+		}
+		env.saveFlash(w, r, "The session has been revoked.")
+		http.Redirect(w, r, "/settings/sessions", http.StatusFound)
+		return nil
+	}
+}
+
+func serveAPISessions(env *Env, sdb models.SessionService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		sessions, err := sdb.GetSessionsByUserID(u.ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving sessions for user %s: %w", u.ID, err))
+		}
+
+		currentID := env.getSessionID(r)
+		res := []*apiSession{}
+		for _, s := range sessions {
+			res = append(res, newAPISession(s, currentID))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+func serveAPIDeleteSession(env *Env, sdb models.SessionService, rdb models.RememberTokenService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		id := pat.Param(r, "id")
+		if err := revokeSession(sdb, rdb, u, id); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error revoking session %s: %w", id, err))
+		}
+		env.recordAudit(r, sessionRevokedEvent(u, id))
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// revokeSession ends a session, provided it belongs to the user.
+// Sessions belonging to other users are reported as missing.
+func revokeSession(sdb models.SessionService, rdb models.RememberTokenService, u *models.User, sessionID string) error {
+	sess, err := sdb.GetSession(sessionID)
+	if err != nil {
+		return err
+	}
+	if sess.UserID != u.ID {
+		return aderrors.ErrNoRecords
+	}
+	return endSession(sdb, rdb, sess.ID)
+}
+
+func sessionRevokedEvent(u *models.User, sessionID string) *models.AuditEvent {
+	return &models.AuditEvent{
+		Action:   models.AuditSessionRevoked,
+		TargetID: u.ID,
+		Details:  map[string]string{"session_id": sessionID},
+	}
+}
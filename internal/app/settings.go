@@ -0,0 +1,294 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/mail"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"github.com/gorilla/csrf"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxNameLength = 100
+	maxBioLength  = 1000
+)
+
+// apiUser is the public representation of a models.User.
+type apiUser struct {
+	ID           string    `jsonapi:"primary,user"`
+	Username     string    `jsonapi:"attr,username"`
+	Email        string    `jsonapi:"attr,email"`
+	Name         string    `jsonapi:"attr,name"`
+	URL          string    `jsonapi:"attr,url"`
+	Bio          string    `jsonapi:"attr,bio"`
+	GravatarHash string    `jsonapi:"attr,gravatar_hash"`
+	DateCreated  time.Time `jsonapi:"attr,date_created,iso8601"`
+}
+
+func newAPIUser(u *models.User) *apiUser {
+	return &apiUser{
+		ID:           u.ID,
+		Username:     u.Username,
+		Email:        u.Email,
+		Name:         u.Name,
+		URL:          u.URL,
+		Bio:          u.Bio,
+		GravatarHash: u.GravatarHash(),
+		DateCreated:  u.DateCreated,
+	}
+}
+
+// accountChanges holds the changes a user asked for. Nil fields are left alone.
+// Changing the email or password requires the current password.
+type accountChanges struct {
+	ID              string  `jsonapi:"primary,user"`
+	Name            *string `jsonapi:"attr,name"`
+	URL             *string `jsonapi:"attr,url"`
+	Bio             *string `jsonapi:"attr,bio"`
+	Email           *string `jsonapi:"attr,email"`
+	Password        *string `jsonapi:"attr,password"`
+	CurrentPassword *string `jsonapi:"attr,current_password"`
+}
+
+// applyAccountChanges validates the changes and applies them to u, without
+// saving. It returns a ValidationError listing every field that failed.
+func applyAccountChanges(env *Env, u *models.User, ac *accountChanges) error {
+	var ve aderrors.ValidationError
+
+	if ac.Name != nil {
+		*ac.Name = strings.TrimSpace(*ac.Name)
+		if utf8.RuneCountInString(*ac.Name) > maxNameLength {
+			ve.Add("name", "name_too_long", fmt.Sprintf("Your name can be at most %d characters long.", maxNameLength))
+		}
+	}
+	if ac.URL != nil {
+		*ac.URL = strings.TrimSpace(*ac.URL)
+		if *ac.URL != "" && !govalidator.IsRequestURL(*ac.URL) {
+			ve.Add("url", "url_invalid", "That's not a valid URL. It should start with http:// or https://.")
+		}
+	}
+	if ac.Bio != nil {
+		*ac.Bio = strings.TrimSpace(*ac.Bio)
+		if utf8.RuneCountInString(*ac.Bio) > maxBioLength {
+			ve.Add("bio", "bio_too_long", fmt.Sprintf("Your bio can be at most %d characters long.", maxBioLength))
+		}
+	}
+	if ac.Email != nil {
+		*ac.Email = strings.TrimSpace(*ac.Email)
+		if !govalidator.IsEmail(*ac.Email) {
+			ve.Add("email", "email_invalid", "That's not a valid email.")
+		}
+	}
+	if ac.Password != nil {
+		email := u.Email
+		if ac.Email != nil {
+			email = *ac.Email
+		}
+		var pve aderrors.ValidationError
+		if err := env.pwPolicy.Check("password", *ac.Password, u.Username, email); errors.As(err, &pve) {
+			ve.Fields = append(ve.Fields, pve.Fields...)
+		}
+	}
+
+	// Re-authenticate before sensitive changes
+	if ac.Email != nil || ac.Password != nil {
+		current := ""
+		if ac.CurrentPassword != nil {
+			current = *ac.CurrentPassword
+		}
+		if passOK, _ := u.CheckPassword(current); !passOK {
+			ve.Add("current_password", "current_password_incorrect", "Your current password was incorrect.")
+		}
+	}
+
+	if ve.HasErrors() {
+		return ve
+	}
+
+	if ac.Name != nil {
+		u.Name = *ac.Name
+	}
+	if ac.URL != nil {
+		u.URL = *ac.URL
+	}
+	if ac.Bio != nil {
+		u.Bio = *ac.Bio
+	}
+	if ac.Password != nil {
+		if err := u.SetPassword(*ac.Password); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveAccountChanges applies and saves the changes, then takes care of the
+// side effects: notifying the user, recording the change in the audit log,
+// and logging out every other session after a password change.
+func saveAccountChanges(env *Env, udb models.UserService, sdb models.SessionService, rdb models.RememberTokenService,
+	r *http.Request, u *models.User, ac *accountChanges) error {
+	if err := applyAccountChanges(env, u, ac); err != nil {
+		return err
+	}
+
+	oldEmail := u.Email
+	emailChanged := ac.Email != nil && *ac.Email != u.Email
+	if emailChanged {
+		if _, err := udb.ChangeEmail(u, *ac.Email); err != nil {
+			if errors.Is(err, aderrors.ErrAlreadyExists) {
+				var ve aderrors.ValidationError
+				ve.Add("email", "email_taken", "That email is already taken!")
+				return ve
+			}
+			return err
+		}
+	} else if _, err := udb.Update(u); err != nil {
+		return err
+	}
+
+	if emailChanged {
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditEmailChanged,
+			TargetID: u.ID,
+			Details:  map[string]string{"old_email": oldEmail, "new_email": u.Email},
+		})
+		env.loe(env.mailer.Send(&mail.Message{
+			To:      oldEmail,
+			Subject: fmt.Sprintf("Your %s email address was changed", env.gp.SiteName),
+			Body: fmt.Sprintf("Hi %s,\n\nThe email address on your %s account was just changed to %s.\n\n"+
+				"If you didn't do this, please contact us right away.\n", u.Username, env.gp.SiteName, u.Email),
+		}))
+	}
+	if ac.Password != nil {
+		env.loe(env.mailer.Send(&mail.Message{
+			To:      u.Email,
+			Subject: fmt.Sprintf("Your %s password was changed", env.gp.SiteName),
+			Body: fmt.Sprintf("Hi %s,\n\nThe password on your %s account was just changed, and every other "+
+				"device has been logged out.\n\nIf you didn't do this, please contact us right away.\n", u.Username, env.gp.SiteName),
+		}))
+		sessions, err := sdb.GetSessionsByUserID(u.ID)
+		if err != nil {
+			return err
+		}
+		ended := 0
+		for _, s := range sessions {
+			if s.ID != env.getSessionID(r) {
+				env.loe(endSession(sdb, rdb, s.ID))
+				ended++
+			}
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditPasswordChanged,
+			TargetID: u.ID,
+			Details:  map[string]string{"sessions_ended": strconv.Itoa(ended)},
+		})
+	}
+	return nil
+}
+
+// settingsPresenter is used to render the settings page.
+type settingsPresenter struct {
+	*localPresenter
+	User     *models.User
+	CanAdmin bool
+}
+
+func serveSettings(env *Env) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		sp := &settingsPresenter{
+			localPresenter: &localPresenter{
+				PageTitle:       "Settings",
+				PageURL:         "/settings",
+				CSRFToken:       csrf.Token(r),
+				Flashes:         env.getFlash(w, r),
+				Impersonating:   env.impersonating(r),
+				globalPresenter: env.gp,
+			},
+			User:     u,
+			CanAdmin: u.Can(models.PermUsersRead),
+		}
+		env.loe(env.rndr.HTML(w, http.StatusOK, "settings", sp))
+		return nil
+	}
+}
+
+// servePostSettings handles the forms on the settings page. Each form only
+// submits the fields it's responsible for.
+func servePostSettings(env *Env, udb models.UserService, sdb models.SessionService, rdb models.RememberTokenService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		if err := r.ParseForm(); err != nil {
+			return aderrors.NewError(http.StatusBadRequest, "error parsing settings form", err)
+		}
+
+		ac := &accountChanges{}
+		formValue := func(key string) *string {
+			if _, ok := r.PostForm[key]; !ok {
+				return nil
+			}
+			v := r.PostForm.Get(key)
+			return &v
+		}
+		ac.Name, ac.URL, ac.Bio = formValue("name"), formValue("url"), formValue("bio")
+		ac.Email, ac.Password = formValue("email"), formValue("password")
+		ac.CurrentPassword = formValue("current_password")
+
+		err := saveAccountChanges(env, udb, sdb, rdb, r, u, ac)
+		if err != nil {
+			if env.saveFieldErrorFlashes(w, r, err) {
+				http.Redirect(w, r, "/settings", http.StatusFound)
+				return aderrors.NewError(http.StatusBadRequest, "invalid settings", err).WithFields(logrus.Fields{"user_id": u.ID})
+			}
+			return aderrors.New500Error("error saving settings", err).WithFields(logrus.Fields{"user_id": u.ID})
+		}
+
+		env.saveFlash(w, r, "Your settings have been saved.")
+		http.Redirect(w, r, "/settings", http.StatusFound)
+		return nil
+	}
+}
+
+func serveAPIMe(env *Env) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		env.loe(env.jsonAPI(w, http.StatusOK, newAPIUser(env.getUser(r))))
+		return nil
+	}
+}
+
+func serveAPIPatchMe(env *Env, udb models.UserService, sdb models.SessionService, rdb models.RememberTokenService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		ac := new(accountChanges)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, ac); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if ac.ID != "" && ac.ID != u.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "You can only update your own account",
+				fmt.Errorf("user %s tried to update user %s", u.ID, ac.ID))
+		}
+
+		err := saveAccountChanges(env, udb, sdb, rdb, r, u, ac)
+		if err != nil {
+			var ve aderrors.ValidationError
+			if errors.As(err, &ve) {
+				return aderrors.NewValidationAPIError(ve).WithFields(logrus.Fields{"user_id": u.ID})
+			}
+			return aderrors.New500APIError(fmt.Errorf("error saving account changes: %w", err))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, newAPIUser(u)))
+		return nil
+	}
+}
@@ -0,0 +1,213 @@
+package app
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"goji.io/pat"
+)
+
+// apiSignupInvite is a models.SignupInvite. The code and the signup link
+// are only there when the invite is created.
+type apiSignupInvite struct {
+	ID          string     `jsonapi:"primary,signup_invite"`
+	UserID      string     `jsonapi:"attr,user_id,omitempty"`
+	Note        string     `jsonapi:"attr,note"`
+	Code        string     `jsonapi:"attr,code,omitempty"`
+	URL         string     `jsonapi:"attr,url,omitempty"`
+	MaxUses     int        `jsonapi:"attr,max_uses"`
+	Uses        int        `jsonapi:"attr,uses"`
+	IsUsable    bool       `jsonapi:"attr,is_usable"`
+	DateCreated time.Time  `jsonapi:"attr,date_created,iso8601"`
+	ExpiryTime  *time.Time `jsonapi:"attr,expiry_time,iso8601,omitempty"`
+	RevokedTime *time.Time `jsonapi:"attr,revoked_time,iso8601,omitempty"`
+}
+
+func newAPISignupInvite(inv *models.SignupInvite) *apiSignupInvite {
+	ai := &apiSignupInvite{
+		ID:          inv.ID,
+		UserID:      inv.UserID,
+		Note:        inv.Note,
+		MaxUses:     inv.MaxUses,
+		Uses:        inv.Uses(),
+		IsUsable:    inv.IsUsable(timeNow()),
+		DateCreated: inv.DateCreated,
+	}
+	if !inv.ExpiryTime.IsZero() {
+		t := inv.ExpiryTime
+		ai.ExpiryTime = &t
+	}
+	if !inv.RevokedTime.IsZero() {
+		t := inv.RevokedTime
+		ai.RevokedTime = &t
+	}
+	return ai
+}
+
+func signupInviteURL(gp *globalPresenter, code string) string {
+	return "http://" + gp.SiteURL + "/signup?invite=" + url.QueryEscape(code)
+}
+
+func serveAPISignupInvites(env *Env, sis models.SignupInviteService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		invs, err := sis.GetSignupInvites(env.getUser(r).ID)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving signup invites: %w", err))
+		}
+		res := []*apiSignupInvite{}
+		for _, inv := range invs {
+			res = append(res, newAPISignupInvite(inv))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// serveAPICreateSignupInvite creates a signup invite. Without
+// PermSignupInvitesManage, an invite can be used at most
+// models.MaxMemberInviteUses times, defaulting to once, and must expire
+// within models.MaxMemberInviteLifetime. Otherwise a max_uses of zero means
+// unlimited uses. Invites expire after models.DefaultSignupInviteLifetime
+// unless an expiry_time is given.
+func serveAPICreateSignupInvite(env *Env, sis models.SignupInviteService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		in := new(apiSignupInvite)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+
+		now := timeNow()
+		unlimited := u.Can(models.PermSignupInvitesManage)
+		inv := &models.SignupInvite{UserID: u.ID, Note: in.Note, MaxUses: in.MaxUses, ExpiryTime: now.Add(models.DefaultSignupInviteLifetime)}
+		if in.ExpiryTime != nil {
+			inv.ExpiryTime = in.ExpiryTime.UTC()
+		}
+		if !unlimited && inv.MaxUses == 0 {
+			inv.MaxUses = 1
+		}
+
+		var ve aderrors.ValidationError
+		switch {
+		case inv.MaxUses < 0:
+			ve.Add("max_uses", "max_uses_invalid", "An invite can't have fewer than zero uses.")
+		case !unlimited && inv.MaxUses > models.MaxMemberInviteUses:
+			ve.Add("max_uses", "max_uses_too_high", fmt.Sprintf("An invite can be used at most %d times.", models.MaxMemberInviteUses))
+		}
+		switch {
+		case !inv.ExpiryTime.After(now):
+			ve.Add("expiry_time", "expiry_time_past", "An invite has to expire in the future.")
+		case !unlimited && inv.ExpiryTime.After(now.Add(models.MaxMemberInviteLifetime)):
+			ve.Add("expiry_time", "expiry_time_too_late", fmt.Sprintf("An invite has to expire within %d days.", models.MaxMemberInviteLifetime/(24*time.Hour)))
+		}
+		if len([]rune(inv.Note)) > 200 {
+			ve.Add("note", "note_too_long", "The note can be at most 200 characters long.")
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		code, err := sis.CreateSignupInvite(inv)
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error creating signup invite: %w", err))
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:  models.AuditSignupInviteCreated,
+			Details: map[string]string{"signup_invite_id": inv.ID, "max_uses": fmt.Sprint(inv.MaxUses)},
+		})
+
+		res := newAPISignupInvite(inv)
+		res.Code = code
+		res.URL = signupInviteURL(env.gp, code)
+		env.loe(env.jsonAPI(w, http.StatusCreated, res))
+		return nil
+	}
+}
+
+// serveAPIDeleteSignupInvite revokes a signup invite. Users can revoke their
+// own invites; revoking anyone else's needs PermSignupInvitesManage.
+func serveAPIDeleteSignupInvite(env *Env, sis models.SignupInviteService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		id := pat.Param(r, "id")
+		inv, err := sis.GetSignupInvite(id)
+		if err == nil && inv.UserID != u.ID && !u.Can(models.PermSignupInvitesManage) {
+			err = aderrors.ErrNoRecords
+		}
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving signup invite %s: %w", id, err))
+		}
+		if err := sis.RevokeSignupInvite(id); err != nil {
+			return aderrors.New500APIError(err)
+		}
+		env.recordAudit(r, &models.AuditEvent{
+			Action:   models.AuditSignupInviteRevoked,
+			TargetID: inv.UserID,
+			Details:  map[string]string{"signup_invite_id": inv.ID},
+		})
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+func serveAPIAdminSignupInvites(env *Env, sis models.SignupInviteService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		invs, err := sis.GetSignupInvites("")
+		if err != nil {
+			return aderrors.New500APIError(fmt.Errorf("error retrieving signup invites: %w", err))
+		}
+		res := []*apiSignupInvite{}
+		for _, inv := range invs {
+			res = append(res, newAPISignupInvite(inv))
+		}
+		env.loe(env.jsonAPI(w, http.StatusOK, res))
+		return nil
+	}
+}
+
+// signupInviteProblem explains why an invite code can't be signed up with,
+// or returns "" if it can.
+func signupInviteProblem(sis models.SignupInviteService, code string) (string, error) {
+	inv, err := sis.GetSignupInviteByCode(code)
+	if errors.Is(err, aderrors.ErrNoRecords) {
+		return "That invite link isn't valid. Check that you copied all of it.", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if !inv.IsUsable(timeNow()) {
+		return "That invite has expired or has been used up. Ask whoever sent it for a new one.", nil
+	}
+	return "", nil
+}
+
+// CreateSignupInvite creates a signup invite from the command line, so the
+// first accounts can be made when signups are invite only. It returns the
+// link to sign up with.
+func CreateSignupInvite(maxUses int, lifetime time.Duration) (string, error) {
+	if pdb == nil {
+		return "", errors.New("db has not been set")
+	}
+	inv := &models.SignupInvite{Note: "created on the command line", MaxUses: maxUses, ExpiryTime: timeNow().Add(lifetime)}
+	code, err := (&datastore.SignupInviteStore{BDB: pdb}).CreateSignupInvite(inv)
+	if err != nil {
+		return "", err
+	}
+	ev := &models.AuditEvent{
+		Action:  models.AuditSignupInviteCreated,
+		Details: map[string]string{"signup_invite_id": inv.ID, "max_uses": fmt.Sprint(maxUses), "source": "command line"},
+	}
+	if err := (&datastore.AuditStore{BDB: pdb}).Record(ev); err != nil {
+		return "", err
+	}
+	return signupInviteURL(getGlobalPresenter(), code), nil
+}
@@ -1 +1,460 @@
 package app
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/rrule"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"goji.io/pat"
+	null "gopkg.in/guregu/null.v3"
+)
+
+// todoRelationships maps the relationships of a todo that can be
+// included to their types.
+var todoRelationships = map[string]string{"list": "list", "labels": "label", "column": "column"}
+
+// todoChanges is a PATCH to a todo. Attributes left out aren't changed,
+// and the times, time zone and rule are removed by setting them to "".
+// ListID and LabelIDs are read from the relationships by
+// readTodoRelationshipChanges, and removing the list sets ListID to "".
+type todoChanges struct {
+	ID           string   `jsonapi:"primary,todo"`
+	Name         *string  `jsonapi:"attr,name"`
+	IsDone       *bool    `jsonapi:"attr,is_done"`
+	DueAt        *string  `jsonapi:"attr,due_at"`
+	RemindAt     *string  `jsonapi:"attr,remind_at"`
+	TimeZone     *string  `jsonapi:"attr,time_zone"`
+	Notes        *string  `jsonapi:"attr,notes"`
+	RRule        *string  `jsonapi:"attr,rrule"`
+	ExDates      []string `jsonapi:"attr,exdates"`
+	Priority     *int     `jsonapi:"attr,priority"`
+	AutoComplete *bool    `jsonapi:"attr,auto_complete"`
+	ListID       *string
+	LabelIDs     *[]string
+}
+
+// readTodoRelationshipChanges reads the list and labels relationships of a
+// PATCH into tc. jsonapi can't tell a relationship being emptied from one
+// being left out, so they're read from the body again.
+func readTodoRelationshipChanges(body []byte, tc *todoChanges) error {
+	var doc struct {
+		Data struct {
+			Relationships struct {
+				List *struct {
+					Data *jsonapi.Node `json:"data"`
+				} `json:"list"`
+				Labels *struct {
+					Data []*jsonapi.Node `json:"data"`
+				} `json:"labels"`
+			} `json:"relationships"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return err
+	}
+	rels := doc.Data.Relationships
+	if rels.List != nil {
+		id := ""
+		if n := rels.List.Data; n != nil {
+			if n.Type != "list" {
+				return fmt.Errorf("list relationship of type %q: %w", n.Type, jsonapi.ErrInvalidResourceObjectType)
+			}
+			id = n.ID
+		}
+		tc.ListID = &id
+	}
+	if rels.Labels != nil {
+		ids := []string{}
+		for _, n := range rels.Labels.Data {
+			if n == nil || n.Type != "label" {
+				return fmt.Errorf("labels relationship with another type: %w", jsonapi.ErrInvalidResourceObjectType)
+			}
+			ids = append(ids, n.ID)
+		}
+		tc.LabelIDs = &ids
+	}
+	return nil
+}
+
+// setTodoRelationshipIDs sets the IDs of the list, labels and parent the
+// todo was sent with, which is how they're saved.
+func setTodoRelationshipIDs(td *models.Todo) {
+	td.ListID, td.ParentID = "", ""
+	if td.List != nil {
+		td.ListID = td.List.ID
+	}
+	if td.Parent != nil {
+		td.ParentID = td.Parent.ID
+	}
+	ids := make([]string, 0, len(td.Labels))
+	for _, l := range td.Labels {
+		ids = append(ids, l.ID)
+	}
+	td.LabelIDs = uniqueIDs(ids)
+}
+
+func uniqueIDs(ids []string) []string {
+	var unique []string
+	seen := map[string]bool{}
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+	return unique
+}
+
+// filterTodos keeps the todos in the lists and with the labels asked for
+// with ?filter[list]= and ?filter[label]=. Each is a comma separated list
+// of IDs, and a todo has to match one ID of each filter given.
+// ?filter[parent]= keeps the subtasks of a todo, or todos that aren't
+// subtasks if it's empty.
+func filterTodos(todos []*models.Todo, r *http.Request) []*models.Todo {
+	q := r.URL.Query()
+	lists, labels := q.Get("filter[list]"), q.Get("filter[label]")
+	_, byParent := q["filter[parent]"]
+	if lists == "" && labels == "" && !byParent {
+		return todos
+	}
+	inList, hasLabel := map[string]bool{}, map[string]bool{}
+	for _, id := range strings.Split(lists, ",") {
+		inList[id] = true
+	}
+	for _, id := range strings.Split(labels, ",") {
+		hasLabel[id] = true
+	}
+
+	filtered := []*models.Todo{}
+	for _, td := range todos {
+		if lists != "" && !inList[td.ListID] {
+			continue
+		}
+		if byParent && td.ParentID != q.Get("filter[parent]") {
+			continue
+		}
+		if labels != "" {
+			found := false
+			for _, id := range td.LabelIDs {
+				found = found || hasLabel[id]
+			}
+			if !found {
+				continue
+			}
+		}
+		filtered = append(filtered, td)
+	}
+	return filtered
+}
+
+// applyTodoChanges validates the changes and applies them to td, without
+// saving. Changing the rule starts the series again from the todo.
+func applyTodoChanges(td *models.Todo, tc *todoChanges, now time.Time) error {
+	var ve aderrors.ValidationError
+	if tc.Name != nil {
+		td.Name = null.StringFrom(*tc.Name)
+	}
+	if tc.IsDone != nil {
+		td.IsDone = null.BoolFrom(*tc.IsDone)
+	}
+	if tc.DueAt != nil {
+		t, err := parseTodoTime(*tc.DueAt)
+		if err != nil {
+			ve.Add("due_at", "due_at_invalid", "The due date needs to be an RFC 3339 time, such as 2026-01-02T15:04:05Z.")
+		}
+		td.DueAt = t
+	}
+	// A reminder that isn't being changed may already have been sent
+	remindNow := time.Time{}
+	if tc.RemindAt != nil {
+		t, err := parseTodoTime(*tc.RemindAt)
+		if err != nil {
+			ve.Add("remind_at", "remind_at_invalid", "The reminder needs to be an RFC 3339 time, such as 2026-01-02T15:04:05Z.")
+		}
+		td.RemindAt = t
+		remindNow = now
+	}
+	if tc.TimeZone != nil {
+		td.TimeZone = null.NewString(*tc.TimeZone, *tc.TimeZone != "")
+	}
+	if tc.Notes != nil {
+		td.Notes = *tc.Notes
+	}
+	if tc.RRule != nil && *tc.RRule != td.RRule.String {
+		td.RRule = null.NewString(*tc.RRule, *tc.RRule != "")
+		if td.IsRecurring() {
+			td.StartSeries()
+		}
+	}
+	if tc.ExDates != nil {
+		td.ExDates = tc.ExDates
+	}
+	if tc.Priority != nil {
+		td.Priority = *tc.Priority
+	}
+	if tc.AutoComplete != nil {
+		td.AutoComplete = *tc.AutoComplete
+	}
+	if tc.ListID != nil {
+		td.ListID = *tc.ListID
+	}
+	if tc.LabelIDs != nil {
+		td.LabelIDs = uniqueIDs(*tc.LabelIDs)
+	}
+	if ve.HasErrors() {
+		return ve
+	}
+	if ve := validateTodo(td, remindNow); ve.HasErrors() {
+		return ve
+	}
+	return nil
+}
+
+func parseTodoTime(s string) (null.Time, error) {
+	if s == "" {
+		return null.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return null.Time{}, err
+	}
+	return null.TimeFrom(t.UTC()), nil
+}
+
+// validateTodo checks the todo's times and recurrence before it's saved. A
+// reminder can't be set in the past or after the todo is due, though a
+// zero now allows one in the past, for a reminder that isn't being
+// changed. Notes can't be longer than models.MaxNotesLength. A todo can
+// only recur if it has a due date to start from.
+func validateTodo(td *models.Todo, now time.Time) aderrors.ValidationError {
+	var ve aderrors.ValidationError
+	if td.TimeZone.Valid && td.TimeZone.String != "" {
+		if _, err := time.LoadLocation(td.TimeZone.String); err != nil {
+			ve.Add("time_zone", "time_zone_invalid", "The time zone needs to be an IANA time zone name, such as Asia/Singapore.")
+		}
+	}
+	if td.RemindAt.Valid {
+		switch {
+		case td.RemindAt.Time.Before(now.Add(-time.Minute)):
+			ve.Add("remind_at", "remind_at_past", "The reminder can't be in the past.")
+		case td.DueAt.Valid && td.RemindAt.Time.After(td.DueAt.Time):
+			ve.Add("remind_at", "remind_at_after_due", "The reminder can't be after the todo is due.")
+		}
+	}
+	if td.IsRecurring() {
+		if _, err := rrule.Parse(td.RRule.String); err != nil {
+			ve.Add("rrule", "rrule_invalid", fmt.Sprintf("The recurrence rule isn't one we understand: %s.", err))
+		} else if !td.DueAt.Valid {
+			ve.Add("rrule", "rrule_needs_due_at", "A todo needs to be due to recur.")
+		}
+	}
+	if len(td.Notes) > models.MaxNotesLength {
+		ve.Add("notes", "notes_too_long", fmt.Sprintf("Notes can't be longer than %d KB.", models.MaxNotesLength>>10))
+	}
+	if td.Priority < models.PriorityNone || td.Priority > models.PriorityHigh {
+		ve.Add("priority", "priority_invalid", fmt.Sprintf("The priority needs to be from %d, none, to %d, high.", models.PriorityNone, models.PriorityHigh))
+	}
+	for _, d := range td.ExDates {
+		if _, err := time.Parse(models.ExDateFormat, d); err != nil {
+			ve.Add("exdates", "exdates_invalid", "Skipped dates need to be dates, such as 2026-01-02.")
+			break
+		}
+	}
+	return ve
+}
+
+// serveAPIPatchTodo saves changes to a todo. Completing an occurrence of a
+// recurring todo creates the next one, which the todo's next_id points to.
+func serveAPIPatchTodo(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		td, err := tdserv.Get(pat.Param(r, "id"))
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving todo: %w", err))
+		}
+		if td.OrgID == "" && td.UserID != u.ID {
+			return handleCommonAPIErrors(fmt.Errorf("user %s tried to update todo %s: %w", u.ID, td.ID, aderrors.ErrNoRecords))
+		}
+
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+
+		tc := new(todoChanges)
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1048576))
+		if err != nil {
+			return aderrors.NewAPIError(http.StatusBadRequest, "The request body couldn't be read", err)
+		}
+		if err := jsonapi.UnmarshalPayload(bytes.NewReader(body), tc); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if err := readTodoRelationshipChanges(body, tc); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error reading relationships: %w", err))
+		}
+		if tc.ID != "" && tc.ID != td.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "The todo's ID doesn't match the URL",
+				fmt.Errorf("todo %s patched with ID %s", td.ID, tc.ID))
+		}
+		if err := applyTodoChanges(td, tc, timeNow()); err != nil {
+			return orgAPIError(err)
+		}
+
+		next, err := tdserv.Update(td, u.ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error updating todo: %w", err))
+		}
+		if td.RemindAt.Valid || (next != nil && next.RemindAt.Valid) {
+			env.wakeReminders()
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, td, include))
+		return nil
+	}
+}
+
+// serveAPISkipTodo skips the current occurrence of a recurring todo,
+// moving it on to the next.
+func serveAPISkipTodo(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+		td, err := tdserv.Get(pat.Param(r, "id"))
+		if err == nil && td.OrgID == "" && td.UserID != u.ID {
+			err = aderrors.ErrNoRecords
+		}
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving todo: %w", err))
+		}
+		var ve aderrors.ValidationError
+		switch {
+		case !td.IsRecurring():
+			ve.Add("rrule", "not_recurring", "Only occurrences of a recurring todo can be skipped.")
+		case td.IsDone.Bool:
+			ve.Add("is_done", "already_done", "This occurrence is already done.")
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		td, err = tdserv.Skip(td.ID, u.ID)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			ve.Add("rrule", "series_ended", "This is the last occurrence of the todo.")
+			return aderrors.NewValidationAPIError(ve)
+		} else if err != nil {
+			return orgAPIError(fmt.Errorf("error skipping todo: %w", err))
+		}
+		if td.RemindAt.Valid {
+			env.wakeReminders()
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, td, include))
+		return nil
+	}
+}
+
+// serveAPITodoSeries lists every occurrence of a recurring todo, done or
+// not, in order.
+func serveAPITodoSeries(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+		td, err := tdserv.Get(pat.Param(r, "id"))
+		if err == nil && td.SeriesID == "" {
+			err = aderrors.ErrNoRecords
+		}
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving todo: %w", err))
+		}
+		todos, err := tdserv.GetSeries(td.SeriesID, u.ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving todo series: %w", err))
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, todos, include))
+		return nil
+	}
+}
+
+// todoMove is where to move a todo to. Leaving out parent_id keeps its
+// parent, and "" makes it a todo of its own. It goes after the todo with
+// the ID after or before the one with the ID before, or after the last of
+// its new siblings if both are left out.
+type todoMove struct {
+	ID       string  `jsonapi:"primary,todo"`
+	ParentID *string `jsonapi:"attr,parent_id"`
+	After    *string `jsonapi:"attr,after"`
+	Before   *string `jsonapi:"attr,before"`
+}
+
+// serveAPIMoveTodo moves a todo under another, or among its siblings.
+func serveAPIMoveTodo(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		u := env.getUser(r)
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+		td, err := tdserv.Get(pat.Param(r, "id"))
+		if err == nil && td.OrgID == "" && td.UserID != u.ID {
+			err = aderrors.ErrNoRecords
+		}
+		if err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error retrieving todo: %w", err))
+		}
+		in := new(todoMove)
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := jsonapi.UnmarshalPayload(r.Body, in); err != nil {
+			return handleCommonAPIErrors(fmt.Errorf("error unmarshalling jsonapi: %w", err))
+		}
+		if in.ID != "" && in.ID != td.ID {
+			return aderrors.NewAPIError(http.StatusConflict, "The todo's ID doesn't match the URL",
+				fmt.Errorf("todo %s moved with ID %s", td.ID, in.ID))
+		}
+
+		m := &models.TodoMove{ParentID: td.ParentID}
+		if in.ParentID != nil {
+			m.ParentID = *in.ParentID
+		}
+		if in.After != nil {
+			m.AfterID = *in.After
+		}
+		if in.Before != nil {
+			m.BeforeID = *in.Before
+		}
+		if td, err = tdserv.Move(td.ID, u.ID, m); err != nil {
+			return orgAPIError(fmt.Errorf("error moving todo: %w", err))
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, td, include))
+		return nil
+	}
+}
+
+// serveAPITodoChildren lists a todo's subtasks in order.
+func serveAPITodoChildren(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		include, err := parseInclude(r, todoRelationships)
+		if err != nil {
+			return err
+		}
+		todos, err := tdserv.GetChildren(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving subtasks: %w", err))
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, todos, include))
+		return nil
+	}
+}
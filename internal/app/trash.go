@@ -0,0 +1,160 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/pkg/router"
+	"github.com/ejamesc/jsonapi"
+	"goji.io/pat"
+)
+
+// maxBulkDelete is how many todos can be deleted at once.
+const maxBulkDelete = 500
+
+// serveAPIDeleteTodo moves a todo and its subtasks to the trash.
+func serveAPIDeleteTodo(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		if _, err := tdserv.Delete([]string{pat.Param(r, "id")}, env.getUser(r).ID); err != nil {
+			return orgAPIError(fmt.Errorf("error deleting todo: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// serveAPIBulkDeleteTodos moves the todos identified in the request body,
+// as in a JSON:API to-many relationship, to the trash. It responds with the
+// undo token that puts them all back in meta.
+func serveAPIBulkDeleteTodos(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		var doc struct {
+			Data []*jsonapi.Node `json:"data"`
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 1048576)
+		if err := json.NewDecoder(r.Body).Decode(&doc); err != nil {
+			return aderrors.NewAPIError(http.StatusBadRequest, "The request body couldn't be read", err)
+		}
+		var ve aderrors.ValidationError
+		seen := map[string]bool{}
+		ids := []string{}
+		for _, n := range doc.Data {
+			if n == nil || n.Type != "todo" || n.ID == "" {
+				ve.Add("data", "todo_invalid", "Only todos, identified by their type and ID, can be deleted.")
+				return aderrors.NewValidationAPIError(ve)
+			}
+			if !seen[n.ID] {
+				seen[n.ID] = true
+				ids = append(ids, n.ID)
+			}
+		}
+		switch {
+		case len(ids) == 0:
+			ve.Add("data", "todos_required", "Choose the todos to delete.")
+		case len(ids) > maxBulkDelete:
+			ve.Add("data", "too_many_todos", fmt.Sprintf("At most %d todos can be deleted at once.", maxBulkDelete))
+		}
+		if ve.HasErrors() {
+			return aderrors.NewValidationAPIError(ve)
+		}
+
+		token, err := tdserv.Delete(ids, env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error deleting todos: %w", err))
+		}
+		w.Header().Set("Content-Type", jsonapi.MediaType)
+		w.WriteHeader(http.StatusOK)
+		env.loe(json.NewEncoder(w).Encode(map[string]interface{}{
+			"meta": jsonapi.Meta{"undo_token": token, "deleted": len(ids)},
+		}))
+		return nil
+	}
+}
+
+// serveAPITrash lists the todos in the user's trash, or in the trash of
+// the org in the URL if ors is set.
+func serveAPITrash(env *Env, tdserv models.TodoService, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		orgID, err := trashOrgID(ors, r)
+		if err != nil {
+			return err
+		}
+		todos, err := tdserv.GetTrash(orgID, env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error retrieving trash: %w", err))
+		}
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, todos, nil))
+		return nil
+	}
+}
+
+// serveAPIEmptyTrash deletes the todos in the user's trash, or in the trash
+// of the org in the URL if ors is set, for good.
+func serveAPIEmptyTrash(env *Env, tdserv models.TodoService, ors models.OrgService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		orgID, err := trashOrgID(ors, r)
+		if err != nil {
+			return err
+		}
+		if _, err := tdserv.EmptyTrash(orgID, env.getUser(r).ID); err != nil {
+			return orgAPIError(fmt.Errorf("error emptying trash: %w", err))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+}
+
+// serveAPIRestoreTodo takes a todo out of the trash, responding with it and
+// the subtasks restored with it.
+func serveAPIRestoreTodo(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		todos, err := tdserv.Restore(pat.Param(r, "id"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error restoring todo: %w", err))
+		}
+		wakeForReminders(env, todos)
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, todos, nil))
+		return nil
+	}
+}
+
+// serveAPIUndoDelete restores the todos deleted together by
+// serveAPIBulkDeleteTodos, responding with them.
+func serveAPIUndoDelete(env *Env, tdserv models.TodoService) router.HandlerError {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		todos, err := tdserv.Undo(pat.Param(r, "token"), env.getUser(r).ID)
+		if err != nil {
+			return orgAPIError(fmt.Errorf("error undoing delete: %w", err))
+		}
+		wakeForReminders(env, todos)
+		env.loe(env.jsonAPIIncluded(w, http.StatusOK, todos, nil))
+		return nil
+	}
+}
+
+// trashOrgID returns the ID of the org in the URL, or "" for the user's
+// own trash if ors isn't set.
+func trashOrgID(ors models.OrgService, r *http.Request) (string, error) {
+	if ors == nil {
+		return "", nil
+	}
+	org, err := orgFromURL(ors, r)
+	if err != nil {
+		return "", orgAPIError(fmt.Errorf("error retrieving org: %w", err))
+	}
+	return org.ID, nil
+}
+
+// wakeForReminders wakes the reminder dispatcher if any of the restored
+// todos have their reminders back.
+func wakeForReminders(env *Env, todos []*models.Todo) {
+	for _, td := range todos {
+		if td.RemindAt.Valid && !td.IsDone.Bool {
+			env.wakeReminders()
+			return
+		}
+	}
+}
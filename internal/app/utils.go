@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
 	"github.com/ejamesc/jsonapi"
 	"github.com/golang/gddo/httputil/header"
 )
@@ -72,6 +74,20 @@ func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) err
 	return nil
 }
 
+// clientInfo extracts the user agent and remote IP of a request.
+// We deliberately ignore X-Forwarded-For, since it can be spoofed when the app
+// isn't sitting behind a proxy we trust.
+func clientInfo(r *http.Request) models.ClientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return models.ClientInfo{
+		UserAgent: r.UserAgent(),
+		IP:        ip,
+	}
+}
+
 func isJSONAPIMediaType(r *http.Request) bool {
 	// If the Content-Type header is present, check that it has the value
 	// application/vnd.api+json. Note that we are using the gddo/httputil/header
@@ -85,6 +101,27 @@ func isJSONAPIMediaType(r *http.Request) bool {
 	return false
 }
 
+// parseInclude reads the relationships asked for with ?include=, returning
+// the types of resource to include. relationships maps the names of the
+// ones that can be included to their types; asking for any other is a bad
+// request.
+func parseInclude(r *http.Request, relationships map[string]string) (map[string]bool, error) {
+	include := map[string]bool{}
+	param := r.URL.Query().Get("include")
+	if param == "" {
+		return include, nil
+	}
+	for _, name := range strings.Split(param, ",") {
+		typ, ok := relationships[name]
+		if !ok {
+			return nil, aderrors.NewAPIError(http.StatusBadRequest, fmt.Sprintf("%q can't be included", name),
+				fmt.Errorf("unknown include %q", name))
+		}
+		include[typ] = true
+	}
+	return include, nil
+}
+
 func handleCommonAPIErrors(err error) error {
 	switch {
 	case errors.Is(err, aderrors.ErrNoRecords):
@@ -0,0 +1,288 @@
+// Package blob stores the contents of attached files on disk.
+package blob
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// sniffLen is how much of a blob is read to sniff its content type.
+const sniffLen = 512
+
+// FileStore is a models.BlobStore keeping blobs as files under a
+// directory. Each blob is at blobs/ab/abcdef..., named by its hash and
+// under the first two characters of it, so no directory gets too big.
+// Blobs are written to staging first, and resumable uploads to uploads.
+type FileStore struct {
+	dir string
+
+	mu sync.Mutex
+	// appending holds the uploads being appended to, so two requests
+	// can't append to the same one at once.
+	appending map[string]bool
+}
+
+// NewFileStore returns a FileStore keeping blobs under dir, creating it if
+// it doesn't exist. Blobs left staged when the server last stopped are
+// deleted, so only one FileStore can use dir at a time.
+func NewFileStore(dir string) (*FileStore, error) {
+	for _, sub := range []string{"blobs", "staging", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return nil, err
+		}
+	}
+	staged, err := ioutil.ReadDir(filepath.Join(dir, "staging"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fi := range staged {
+		if err := os.Remove(filepath.Join(dir, "staging", fi.Name())); err != nil {
+			return nil, err
+		}
+	}
+	return &FileStore{dir: dir, appending: map[string]bool{}}, nil
+}
+
+// Stage satisfies the models.BlobStore interface.
+func (fs *FileStore) Stage(r io.Reader, limit int64) (*models.StagedBlob, error) {
+	f, err := ioutil.TempFile(filepath.Join(fs.dir, "staging"), "blob-")
+	if err != nil {
+		return nil, err
+	}
+	sb, err := stage(f, r, limit)
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return sb, nil
+}
+
+// stage copies r into f, which it closes, hashing and sniffing it.
+func stage(f *os.File, r io.Reader, limit int64) (*models.StagedBlob, error) {
+	defer f.Close()
+	h := sha256.New()
+	head := &headWriter{}
+	n, err := io.Copy(io.MultiWriter(f, h, head), io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > limit {
+		return nil, aderrors.ErrTooLarge
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	return &models.StagedBlob{
+		Hash:        hex.EncodeToString(h.Sum(nil)),
+		Size:        n,
+		ContentType: http.DetectContentType(head.buf),
+		Path:        f.Name(),
+	}, nil
+}
+
+// Append satisfies the models.BlobStore interface.
+func (fs *FileStore) Append(uploadID string, offset int64, r io.Reader, limit int64) (int64, error) {
+	path, err := fs.uploadPath(uploadID)
+	if err != nil {
+		return 0, err
+	}
+	fs.mu.Lock()
+	if fs.appending[uploadID] {
+		fs.mu.Unlock()
+		return 0, aderrors.ErrUploadOffset
+	}
+	fs.appending[uploadID] = true
+	fs.mu.Unlock()
+	defer func() {
+		fs.mu.Lock()
+		delete(fs.appending, uploadID)
+		fs.mu.Unlock()
+	}()
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() != offset {
+		return fi.Size(), aderrors.ErrUploadOffset
+	}
+	n, err := io.Copy(f, io.LimitReader(r, limit-offset+1))
+	if err == nil && offset+n > limit {
+		// Keep what was there, so the upload can carry on from offset
+		if err := f.Truncate(offset); err != nil {
+			return 0, err
+		}
+		return offset, aderrors.ErrTooLarge
+	}
+	if serr := f.Sync(); serr != nil {
+		return 0, serr
+	}
+	// What arrived before a request broke off is kept, so the upload
+	// can carry on from there
+	return offset + n, err
+}
+
+// StageUpload satisfies the models.BlobStore interface. It returns
+// aderrors.ErrNoRecords if nothing has been appended to the upload.
+func (fs *FileStore) StageUpload(uploadID string) (*models.StagedBlob, error) {
+	path, err := fs.uploadPath(uploadID)
+	if err != nil {
+		return nil, err
+	}
+	up, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, aderrors.ErrNoRecords
+	} else if err != nil {
+		return nil, err
+	}
+	defer up.Close()
+	sb, err := fs.Stage(up, 1<<62)
+	if err != nil {
+		return nil, err
+	}
+	up.Close()
+	if err := os.Remove(path); err != nil {
+		fs.Discard(sb)
+		return nil, err
+	}
+	return sb, nil
+}
+
+// DeleteUpload satisfies the models.BlobStore interface.
+func (fs *FileStore) DeleteUpload(uploadID string) error {
+	path, err := fs.uploadPath(uploadID)
+	if err != nil {
+		return err
+	}
+	return removeIfExists(path)
+}
+
+// Commit satisfies the models.BlobStore interface.
+func (fs *FileStore) Commit(sb *models.StagedBlob) error {
+	path, err := fs.blobPath(sb.Hash)
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(path); err == nil {
+		return fs.Discard(sb)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.Rename(sb.Path, path)
+}
+
+// Discard satisfies the models.BlobStore interface.
+func (fs *FileStore) Discard(sb *models.StagedBlob) error {
+	if filepath.Dir(sb.Path) != filepath.Join(fs.dir, "staging") {
+		return fmt.Errorf("%s isn't a staged blob", sb.Path)
+	}
+	return removeIfExists(sb.Path)
+}
+
+// Open satisfies the models.BlobStore interface.
+func (fs *FileStore) Open(hash string) (models.Blob, error) {
+	path, err := fs.blobPath(hash)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, aderrors.ErrNoRecords
+	} else if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Delete satisfies the models.BlobStore interface.
+func (fs *FileStore) Delete(hash string) error {
+	path, err := fs.blobPath(hash)
+	if err != nil {
+		return err
+	}
+	return removeIfExists(path)
+}
+
+// List satisfies the models.BlobStore interface.
+func (fs *FileStore) List() ([]string, error) {
+	dirs, err := ioutil.ReadDir(filepath.Join(fs.dir, "blobs"))
+	if err != nil {
+		return nil, err
+	}
+	var hashes []string
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(fs.dir, "blobs", d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if _, err := fs.blobPath(fi.Name()); err == nil && !fi.IsDir() {
+				hashes = append(hashes, fi.Name())
+			}
+		}
+	}
+	return hashes, nil
+}
+
+// blobPath checks the hash is a SHA-256 hash, so it can't point outside
+// the store, and returns where the blob with it is kept.
+func (fs *FileStore) blobPath(hash string) (string, error) {
+	if b, err := hex.DecodeString(hash); err != nil || len(b) != sha256.Size || hash != hex.EncodeToString(b) {
+		return "", fmt.Errorf("%q isn't a blob hash", hash)
+	}
+	return filepath.Join(fs.dir, "blobs", hash[:2], hash), nil
+}
+
+func (fs *FileStore) uploadPath(id string) (string, error) {
+	if id == "" {
+		return "", aderrors.ErrNoID
+	}
+	for _, c := range id {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z') {
+			return "", fmt.Errorf("%q isn't an upload ID", id)
+		}
+	}
+	return filepath.Join(fs.dir, "uploads", id), nil
+}
+
+func removeIfExists(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// headWriter keeps the first sniffLen bytes written to it.
+type headWriter struct {
+	buf []byte
+}
+
+func (hw *headWriter) Write(p []byte) (int, error) {
+	if n := sniffLen - len(hw.buf); n > 0 {
+		if n > len(p) {
+			n = len(p)
+		}
+		hw.buf = append(hw.buf, p[:n]...)
+	}
+	return len(p), nil
+}
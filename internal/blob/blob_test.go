@@ -0,0 +1,97 @@
+package blob_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/blob"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "auth_demo_blobs")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	fs, err := blob.NewFileStore(dir)
+	ok(t, err)
+
+	png := "\x89PNG\r\n\x1a\n rest of the image"
+	sb, err := fs.Stage(strings.NewReader(png), 100)
+	ok(t, err)
+	equals(t, "image/png", sb.ContentType)
+	equals(t, int64(len(png)), sb.Size)
+	ok(t, fs.Commit(sb))
+
+	// Committing the same content again keeps the blob that's there
+	again, err := fs.Stage(strings.NewReader(png), 100)
+	ok(t, err)
+	equals(t, sb.Hash, again.Hash)
+	ok(t, fs.Commit(again))
+	_, err = os.Stat(again.Path)
+	assert(t, os.IsNotExist(err), "expected the staged copy to be discarded, got %v", err)
+	b, err := fs.Open(sb.Hash)
+	ok(t, err)
+	content, err := ioutil.ReadAll(b)
+	ok(t, err)
+	ok(t, b.Close())
+	equals(t, png, string(content))
+	hashes, err := fs.List()
+	ok(t, err)
+	equals(t, []string{sb.Hash}, hashes)
+
+	_, err = fs.Stage(strings.NewReader("too long"), 3)
+	assert(t, errors.Is(err, aderrors.ErrTooLarge), "expected the blob to be too large, got %v", err)
+	_, err = fs.Open("../../etc/passwd")
+	assert(t, err != nil && !errors.Is(err, aderrors.ErrNoRecords), "expected a bad hash to be refused, got %v", err)
+	_, err = fs.Append("../x", 0, strings.NewReader("x"), 10)
+	assert(t, err != nil, "expected a bad upload ID to be refused")
+
+	ok(t, fs.Delete(sb.Hash))
+	ok(t, fs.Delete(sb.Hash))
+	_, err = fs.Open(sb.Hash)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the blob to be deleted, got %v", err)
+
+	// Blobs left staged are cleaned up when the store is opened again
+	left, err := fs.Stage(strings.NewReader("left"), 100)
+	ok(t, err)
+	_, err = blob.NewFileStore(dir)
+	ok(t, err)
+	_, err = os.Stat(left.Path)
+	assert(t, os.IsNotExist(err), "expected the staged blob to be deleted, got %v", err)
+	var _ models.BlobStore = fs
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
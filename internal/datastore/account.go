@@ -0,0 +1,390 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// AccountStore works on everything belonging to a user at once, so it reads
+// and writes across the buckets of the other stores.
+type AccountStore struct{ *BDB }
+
+// Export gathers a consistent snapshot of everything belonging to the user.
+func (as *AccountStore) Export(userID string) (*models.AccountExport, error) {
+	export := &models.AccountExport{
+		Sessions:      []*models.Session{},
+		Todos:         []*models.Todo{},
+		Identities:    []*models.LinkedIdentity{},
+		Notifications: []*models.Notification{},
+		Lists:         []*models.List{},
+		Labels:        []*models.Label{},
+		Boards:        []*models.Board{},
+		Columns:       []*models.Column{},
+		NoteRevisions: []*models.NoteRevision{},
+		Attachments:   []*models.Attachment{},
+		Comments:      []*models.Comment{},
+	}
+	err := as.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UserBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UserBucket))
+		}
+		uJSON := b.Get([]byte(userID))
+		if uJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		export.User = &models.User{}
+		if err := json.Unmarshal(uJSON, export.User); err != nil {
+			return err
+		}
+		export.User.Password = ""
+
+		err := forEachOwned(tx, SessionBucket, userID, func(k, v []byte) error {
+			var sess models.Session
+			if err := json.Unmarshal(v, &sess); err != nil {
+				return err
+			}
+			sess.Token = ""
+			export.Sessions = append(export.Sessions, &sess)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, TodoBucket, userID, func(k, v []byte) error {
+			var todo models.Todo
+			if err := json.Unmarshal(v, &todo); err != nil {
+				return err
+			}
+			export.Todos = append(export.Todos, &todo)
+			revs := tx.Bucket(NoteRevisionBucket).Bucket([]byte(todo.ID))
+			if revs == nil {
+				return nil
+			}
+			return revs.ForEach(func(k, v []byte) error {
+				rev, err := unmarshalNoteRevision(v)
+				if err != nil {
+					return err
+				}
+				export.NoteRevisions = append(export.NoteRevisions, rev)
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, IdentityBucket, userID, func(k, v []byte) error {
+			var li models.LinkedIdentity
+			if err := json.Unmarshal(v, &li); err != nil {
+				return err
+			}
+			export.Identities = append(export.Identities, &li)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, NotificationBucket, userID, func(k, v []byte) error {
+			var n models.Notification
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+			export.Notifications = append(export.Notifications, &n)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, ListBucket, userID, func(k, v []byte) error {
+			var l models.List
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			export.Lists = append(export.Lists, &l)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, LabelBucket, userID, func(k, v []byte) error {
+			var l models.Label
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			export.Labels = append(export.Labels, &l)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, BoardBucket, userID, func(k, v []byte) error {
+			var b models.Board
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			export.Boards = append(export.Boards, &b)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, ColumnBucket, userID, func(k, v []byte) error {
+			var c models.Column
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			export.Columns = append(export.Columns, &c)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		err = forEachOwned(tx, AttachmentBucket, userID, func(k, v []byte) error {
+			var a models.Attachment
+			if err := json.Unmarshal(v, &a); err != nil {
+				return err
+			}
+			export.Attachments = append(export.Attachments, &a)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		return forEachOwned(tx, CommentBucket, userID, func(k, v []byte) error {
+			var c models.Comment
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			export.Comments = append(export.Comments, &c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error exporting account %s: %w", userID, err)
+	}
+	return export, nil
+}
+
+// GetUsersDueForDeletion returns the users whose deletion grace period
+// ended before t.
+func (as *AccountStore) GetUsersDueForDeletion(t time.Time) ([]*models.User, error) {
+	users := []*models.User{}
+	err := as.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UserBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UserBucket))
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var usr models.User
+			if err := json.Unmarshal(v, &usr); err != nil {
+				return err
+			}
+			if usr.IsPendingDeletion() && usr.DeletionTime.Before(t) {
+				users = append(users, &usr)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving users due for deletion: %w", err)
+	}
+	return users, nil
+}
+
+// Purge permanently deletes, in a single transaction, the user and their
+// email and username index entries, sessions, session tokens, remember
+// tokens, todos with their note revisions, attachments and comments, lists,
+// labels, boards, signup invites and comments on org todos.
+//
+// The user leaves their orgs too; see leaveOrgs. Blobs their attachments
+// used are left for DeleteUnusedBlobs, and unfinished uploads to expire.
+func (as *AccountStore) Purge(userID string) (bool, error) {
+	err := as.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UserBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UserBucket))
+		}
+		uJSON := b.Get([]byte(userID))
+		if uJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		var usr models.User
+		if err := json.Unmarshal(uJSON, &usr); err != nil {
+			return err
+		}
+
+		if err := deleteIndexEntry(tx, userEmailBucket, usr.Email, userID); err != nil {
+			return err
+		}
+		if err := deleteIndexEntry(tx, userUsernameBucket, usr.Username, userID); err != nil {
+			return err
+		}
+
+		if _, err := deleteLogins(tx, userID); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, TodoBucket, userID, func(v []byte) error {
+			var td models.Todo
+			if err := json.Unmarshal(v, &td); err != nil {
+				return err
+			}
+			return deleteTodoContent(tx, td.ID)
+		}); err != nil {
+			return err
+		}
+		if err := deleteSignupInvites(tx, userID); err != nil {
+			return err
+		}
+		if err := leaveOrgs(tx, userID); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, IdentityBucket, userID, nil); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, ReminderBucket, userID, func(v []byte) error {
+			var r models.Reminder
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			return tx.Bucket(reminderDueBucket).Delete(reminderDueKey(r.RemindAt, r.TodoID))
+		}); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, NotificationBucket, userID, nil); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, ListBucket, userID, nil); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, LabelBucket, userID, nil); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, BoardBucket, userID, nil); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, ColumnBucket, userID, nil); err != nil {
+			return err
+		}
+		if err := deleteOwned(tx, CommentBucket, userID, func(v []byte) error {
+			var c models.Comment
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+			return unindexDoc(tx, commentDocPrefix+c.ID)
+		}); err != nil {
+			return err
+		}
+		return b.Delete([]byte(userID))
+	})
+	if err != nil {
+		return false, fmt.Errorf("error purging user %s: %w", userID, err)
+	}
+	return true, nil
+}
+
+// deleteLogins deletes the user's sessions, session tokens and remember
+// tokens, returning the number of sessions deleted.
+func deleteLogins(tx *bolt.Tx, userID string) (int, error) {
+	bt := tx.Bucket(sessionTokenBucket)
+	if bt == nil {
+		return 0, fmt.Errorf("no %s bucket exists", string(sessionTokenBucket))
+	}
+	n := 0
+	err := deleteOwned(tx, SessionBucket, userID, func(v []byte) error {
+		var sess models.Session
+		if err := json.Unmarshal(v, &sess); err != nil {
+			return err
+		}
+		n++
+		return bt.Delete([]byte(sess.Token))
+	})
+	if err != nil {
+		return 0, err
+	}
+	bf := tx.Bucket(rememberFamilyBucket)
+	if bf == nil {
+		return 0, fmt.Errorf("no %s bucket exists", string(rememberFamilyBucket))
+	}
+	err = deleteOwned(tx, RememberTokenBucket, userID, func(v []byte) error {
+		var rt models.RememberToken
+		if err := json.Unmarshal(v, &rt); err != nil {
+			return err
+		}
+		return bf.Delete(rememberFamilyKey(rt.FamilyID, rt.Selector))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// ownedRecord is the part of every record that says who it belongs to.
+// Records with an OrgID belong to the org, even though they have a UserID.
+type ownedRecord struct {
+	UserID string `json:"user_id"`
+	OrgID  string `json:"org_id"`
+}
+
+// forEachOwned calls fn for every record in the bucket belonging to the user.
+func forEachOwned(tx *bolt.Tx, bucket []byte, userID string, fn func(k, v []byte) error) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(bucket))
+	}
+	return b.ForEach(func(k, v []byte) error {
+		var rec ownedRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		if rec.UserID != userID || rec.OrgID != "" {
+			return nil
+		}
+		return fn(k, v)
+	})
+}
+
+// deleteOwned deletes every record in the bucket belonging to the user,
+// calling beforeDelete first if it's given.
+func deleteOwned(tx *bolt.Tx, bucket []byte, userID string, beforeDelete func(v []byte) error) error {
+	var keys [][]byte
+	err := forEachOwned(tx, bucket, userID, func(k, v []byte) error {
+		if beforeDelete != nil {
+			if err := beforeDelete(v); err != nil {
+				return err
+			}
+		}
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	b := tx.Bucket(bucket)
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteIndexEntry removes key from an index bucket, but only if it still
+// points at the user.
+func deleteIndexEntry(tx *bolt.Tx, bucket []byte, key, userID string) error {
+	if key == "" {
+		return nil
+	}
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(bucket))
+	}
+	if id := b.Get([]byte(key)); id != nil && string(id) == userID {
+		return b.Delete([]byte(key))
+	}
+	return nil
+}
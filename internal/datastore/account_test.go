@@ -0,0 +1,111 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestAccountExportAndPurge(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ss := &datastore.SessionStore{BDB: db, UserStore: us}
+	rs := &datastore.RememberTokenStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	as := &datastore.AccountStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	sess, err := ss.CreateSession(alice.ID, true, models.SessionOptions{})
+	ok(t, err)
+	_, err = ss.CreateSession(bob.ID, false, models.SessionOptions{})
+	ok(t, err)
+	remember, _, err := rs.CreateRememberToken(alice.ID, "")
+	ok(t, err)
+	aliceTodo := &models.Todo{UserID: alice.ID, Name: null.StringFrom("alice's todo")}
+	aliceTodo.GenerateID()
+	_, err = ts.Create(aliceTodo)
+	ok(t, err)
+	bobTodo := &models.Todo{UserID: bob.ID, Name: null.StringFrom("bob's todo")}
+	bobTodo.GenerateID()
+	_, err = ts.Create(bobTodo)
+	ok(t, err)
+
+	export, err := as.Export(alice.ID)
+	ok(t, err)
+	equals(t, "", export.User.Password)
+	equals(t, 1, len(export.Sessions))
+	equals(t, "", export.Sessions[0].Token)
+	equals(t, 1, len(export.Todos))
+	equals(t, aliceTodo.ID, export.Todos[0].ID)
+
+	_, err = as.Purge(alice.ID)
+	ok(t, err)
+
+	_, err = us.Get(alice.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected user to be purged, got %v", err)
+	_, err = us.GetByEmail(alice.Email)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected email index to be purged, got %v", err)
+	_, err = us.GetByUsername(alice.Username)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected username index to be purged, got %v", err)
+	_, err = ss.GetSessionByToken(sess.Token)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected session token to be purged, got %v", err)
+	_, _, err = rs.ConsumeRememberToken(remember)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected remember token to be purged, got %v", err)
+	_, err = ts.Get(aliceTodo.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected todo to be purged, got %v", err)
+
+	// Bob is untouched
+	_, err = us.Get(bob.ID)
+	ok(t, err)
+	sessions, err := ss.GetSessionsByUserID(bob.ID)
+	ok(t, err)
+	equals(t, 1, len(sessions))
+	_, err = ts.Get(bobTodo.ID)
+	ok(t, err)
+}
+
+func TestGetUsersDueForDeletion(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	as := &datastore.AccountStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	newTestUser(t, us, "bob")
+
+	alice.DeletionTime = time.Now().Add(time.Hour)
+	_, err := us.Update(alice)
+	ok(t, err)
+
+	users, err := as.GetUsersDueForDeletion(time.Now())
+	ok(t, err)
+	equals(t, 0, len(users))
+
+	users, err = as.GetUsersDueForDeletion(time.Now().Add(2 * time.Hour))
+	ok(t, err)
+	equals(t, 1, len(users))
+	equals(t, alice.ID, users[0].ID)
+}
+
+// newTestUser creates a user with the given username. The password hash is a
+// placeholder, since hashing is slow and these tests don't check passwords.
+func newTestUser(tb testing.TB, us *datastore.UserStore, username string) *models.User {
+	u := &models.User{
+		Username: username,
+		Email:    username + "@example.com",
+		Password: "$argon2id$placeholder",
+		D:        &models.UserMetadata{},
+	}
+	u.GenerateID()
+	_, err := us.Create(u)
+	ok(tb, err)
+	return u
+}
@@ -0,0 +1,82 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// AdminStore backs the admin console.
+type AdminStore struct{ *BDB }
+
+// SearchUsers matches query case-insensitively against the username, email
+// and name of every user. User IDs are ULIDs, so walking the bucket
+// backwards gives the newest users first.
+func (as *AdminStore) SearchUsers(query string, offset, limit int) ([]*models.User, int, error) {
+	users := []*models.User{}
+	total := 0
+	query = strings.ToLower(strings.TrimSpace(query))
+	err := as.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UserBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UserBucket))
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var usr models.User
+			if err := json.Unmarshal(v, &usr); err != nil {
+				return err
+			}
+			if !userMatches(&usr, query) {
+				continue
+			}
+			if total >= offset && len(users) < limit {
+				users = append(users, &usr)
+			}
+			total++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching users for %q: %w", query, err)
+	}
+	return users, total, nil
+}
+
+func userMatches(usr *models.User, query string) bool {
+	if query == "" {
+		return true
+	}
+	for _, f := range []string{usr.Username, usr.Email, usr.Name} {
+		if strings.Contains(strings.ToLower(f), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForceLogout deletes all of the user's sessions and remember tokens in a
+// single transaction.
+func (as *AdminStore) ForceLogout(userID string) (int, error) {
+	n := 0
+	err := as.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UserBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UserBucket))
+		}
+		if b.Get([]byte(userID)) == nil {
+			return aderrors.ErrNoRecords
+		}
+		var err error
+		n, err = deleteLogins(tx, userID)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error logging out user %s: %w", userID, err)
+	}
+	return n, nil
+}
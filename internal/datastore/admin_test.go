@@ -0,0 +1,88 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestSearchUsers(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	as := &datastore.AdminStore{BDB: db}
+
+	var created []*models.User
+	for _, name := range []string{"alice", "bob", "alison", "carol"} {
+		created = append(created, newTestUser(t, us, name))
+		// IDs are only ordered to the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	users, total, err := as.SearchUsers("", 0, 10)
+	ok(t, err)
+	equals(t, 4, total)
+	equals(t, created[3].ID, users[0].ID)
+	equals(t, created[0].ID, users[3].ID)
+
+	users, total, err = as.SearchUsers("ALI", 0, 10)
+	ok(t, err)
+	equals(t, 2, total)
+	equals(t, "alison", users[0].Username)
+	equals(t, "alice", users[1].Username)
+
+	users, total, err = as.SearchUsers("", 1, 2)
+	ok(t, err)
+	equals(t, 4, total)
+	equals(t, 2, len(users))
+	equals(t, "alison", users[0].Username)
+	equals(t, "bob", users[1].Username)
+
+	users, total, err = as.SearchUsers("bob@example", 5, 10)
+	ok(t, err)
+	equals(t, 1, total)
+	equals(t, 0, len(users))
+}
+
+func TestForceLogout(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ss := &datastore.SessionStore{BDB: db, UserStore: us}
+	rs := &datastore.RememberTokenStore{BDB: db}
+	as := &datastore.AdminStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	tokSess, err := ss.CreateSession(alice.ID, true, models.SessionOptions{})
+	ok(t, err)
+	_, err = ss.CreateSession(alice.ID, false, models.SessionOptions{})
+	ok(t, err)
+	remember, _, err := rs.CreateRememberToken(alice.ID, "")
+	ok(t, err)
+	_, err = ss.CreateSession(bob.ID, false, models.SessionOptions{})
+	ok(t, err)
+
+	n, err := as.ForceLogout(alice.ID)
+	ok(t, err)
+	equals(t, 2, n)
+
+	sessions, err := ss.GetSessionsByUserID(alice.ID)
+	ok(t, err)
+	equals(t, 0, len(sessions))
+	_, err = ss.GetSessionByToken(tokSess.Token)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected session token to be deleted, got %v", err)
+	_, _, err = rs.ConsumeRememberToken(remember)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected remember token to be deleted, got %v", err)
+
+	sessions, err = ss.GetSessionsByUserID(bob.ID)
+	ok(t, err)
+	equals(t, 1, len(sessions))
+
+	_, err = as.ForceLogout("nonexistent")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected ErrNoRecords, got %v", err)
+}
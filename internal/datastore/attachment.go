@@ -0,0 +1,489 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/sirupsen/logrus"
+)
+
+// AttachmentStore keeps attachments and uploads in bolt, and their
+// contents in Blobs. BlobBucket counts the attachments using each blob;
+// ones no attachment uses are left for DeleteUnusedBlobs. A blob is only
+// stored once the transaction counting it has committed, and only deleted
+// when it has no count, so a failed transaction can't leave the two out of
+// step for long.
+type AttachmentStore struct {
+	*BDB
+	Blobs models.BlobStore
+	// Quota is how many bytes of attachments each user can have, which
+	// defaults to models.DefaultAttachmentQuota.
+	Quota int64
+}
+
+// blobRecord is how many attachments use a blob.
+type blobRecord struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	Refs int    `json:"refs"`
+}
+
+func (as *AttachmentStore) GetAttachments(todoID, userID string) ([]*models.Attachment, error) {
+	atts := []*models.Attachment{}
+	err := as.View(func(tx *bolt.Tx) error {
+		td, err := getTodo(tx, todoID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosRead); err != nil {
+			return err
+		}
+		return forEachAttachment(tx, func(a *models.Attachment) error {
+			if a.TodoID == todoID {
+				atts = append(atts, a)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving attachments of todo %s: %w", todoID, err)
+	}
+	return atts, nil
+}
+
+func (as *AttachmentStore) GetAttachment(id, userID string) (*models.Attachment, error) {
+	var a *models.Attachment
+	err := as.View(func(tx *bolt.Tx) error {
+		var err error
+		a, err = getAttachment(tx, id, userID, models.PermTodosRead)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving attachment %s: %w", id, err)
+	}
+	return a, nil
+}
+
+func (as *AttachmentStore) CreateAttachment(a *models.Attachment, sb *models.StagedBlob) error {
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		td, err := getTodo(tx, a.TodoID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, a.UserID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		return as.attach(tx, a, sb)
+	})
+	if err == nil {
+		err = as.commitBlob(a, sb)
+	}
+	if err != nil {
+		as.Blobs.Discard(sb)
+		return fmt.Errorf("error creating attachment: %w", err)
+	}
+	return nil
+}
+
+func (as *AttachmentStore) DeleteAttachment(id, userID string) error {
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		a, err := getAttachment(tx, id, userID, models.PermTodosWrite)
+		if err != nil {
+			return err
+		}
+		return deleteAttachment(tx, a)
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting attachment %s: %w", id, err)
+	}
+	return nil
+}
+
+func (as *AttachmentStore) GetUsage(userID string) (int64, error) {
+	var used int64
+	err := as.View(func(tx *bolt.Tx) error {
+		var err error
+		used, err = attachmentUsage(tx, userID)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error retrieving attachment usage of user %s: %w", userID, err)
+	}
+	return used, nil
+}
+
+func (as *AttachmentStore) CreateUpload(up *models.Upload) error {
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		td, err := getTodo(tx, up.TodoID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, up.UserID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		if err := as.checkQuota(tx, up.UserID, up.Size); err != nil {
+			return err
+		}
+		if up.ID == "" {
+			up.GenerateID()
+		}
+		up.Offset = 0
+		up.DateCreated = timeNow()
+		return putRecord(tx, UploadBucket, up.ID, up)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating upload: %w", err)
+	}
+	return nil
+}
+
+func (as *AttachmentStore) GetUpload(id, userID string) (*models.Upload, error) {
+	var up models.Upload
+	err := as.View(func(tx *bolt.Tx) error {
+		return getOwnedRecord(tx, UploadBucket, userID, id, &up)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving upload %s: %w", id, err)
+	}
+	return &up, nil
+}
+
+func (as *AttachmentStore) SetUploadOffset(id, userID string, offset int64) error {
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		var up models.Upload
+		if err := getOwnedRecord(tx, UploadBucket, userID, id, &up); err != nil {
+			return err
+		}
+		up.Offset = offset
+		return putRecord(tx, UploadBucket, up.ID, &up)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating upload %s: %w", id, err)
+	}
+	return nil
+}
+
+// CompleteUpload satisfies the models.AttachmentService interface. The
+// upload's reservation is given back before the attachment is counted, so
+// it only fails the quota if the quota has been lowered since.
+func (as *AttachmentStore) CompleteUpload(id, userID string, sb *models.StagedBlob) (*models.Attachment, error) {
+	var a *models.Attachment
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		var up models.Upload
+		if err := getOwnedRecord(tx, UploadBucket, userID, id, &up); err != nil {
+			return err
+		}
+		if sb.Size != up.Size {
+			return fmt.Errorf("upload is %d bytes, not %d", sb.Size, up.Size)
+		}
+		td, err := getTodo(tx, up.TodoID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		if err := tx.Bucket(UploadBucket).Delete([]byte(id)); err != nil {
+			return err
+		}
+		a = &models.Attachment{TodoID: up.TodoID, UserID: userID, Name: up.Name}
+		return as.attach(tx, a, sb)
+	})
+	if err == nil {
+		err = as.commitBlob(a, sb)
+	}
+	if err != nil {
+		as.Blobs.Discard(sb)
+		return nil, fmt.Errorf("error completing upload %s: %w", id, err)
+	}
+	return a, nil
+}
+
+func (as *AttachmentStore) DeleteUpload(id, userID string) error {
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		var up models.Upload
+		if err := getOwnedRecord(tx, UploadBucket, userID, id, &up); err != nil {
+			return err
+		}
+		return tx.Bucket(UploadBucket).Delete([]byte(id))
+	})
+	if err == nil {
+		err = as.Blobs.DeleteUpload(id)
+	}
+	if err != nil {
+		return fmt.Errorf("error deleting upload %s: %w", id, err)
+	}
+	return nil
+}
+
+func (as *AttachmentStore) DeleteExpiredUploads(before time.Time) ([]string, error) {
+	var ids []string
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UploadBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UploadBucket))
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			var up models.Upload
+			if err := json.Unmarshal(v, &up); err != nil {
+				return err
+			}
+			if up.DateCreated.Before(before) {
+				ids = append(ids, up.ID)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error deleting expired uploads: %w", err)
+	}
+	for _, id := range ids {
+		if err := as.Blobs.DeleteUpload(id); err != nil {
+			return ids, fmt.Errorf("error deleting expired upload %s: %w", id, err)
+		}
+	}
+	return ids, nil
+}
+
+// DeleteUnusedBlobs satisfies the models.AttachmentService interface. The
+// counts of blobs no attachment uses are deleted first. Then every stored
+// blob without a count is, which also catches ones left behind when
+// storing or deleting a blob failed.
+func (as *AttachmentStore) DeleteUnusedBlobs() (int, error) {
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(BlobBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(BlobBucket))
+		}
+		var unused [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var br blobRecord
+			if err := json.Unmarshal(v, &br); err != nil {
+				return err
+			}
+			if br.Refs <= 0 {
+				unused = append(unused, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range unused {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error deleting unused blobs: %w", err)
+	}
+
+	// This changes nothing in bolt, but being a write transaction keeps an
+	// attachment from starting to use a blob while it's being deleted
+	deleted := 0
+	err = as.DB.Update(func(tx *bolt.Tx) error {
+		hashes, err := as.Blobs.List()
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(BlobBucket)
+		for _, hash := range hashes {
+			if b.Get([]byte(hash)) != nil {
+				continue
+			}
+			if err := as.Blobs.Delete(hash); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return deleted, fmt.Errorf("error deleting unused blobs: %w", err)
+	}
+	return deleted, nil
+}
+
+// attach saves the attachment, after checking it fits in the quota of the
+// user who uploaded it, and counts its blob. The blob is stored by
+// commitBlob once the transaction has committed.
+func (as *AttachmentStore) attach(tx *bolt.Tx, a *models.Attachment, sb *models.StagedBlob) error {
+	if err := as.checkQuota(tx, a.UserID, sb.Size); err != nil {
+		return err
+	}
+	if a.ID == "" {
+		a.GenerateID()
+	}
+	a.Hash, a.Size, a.ContentType = sb.Hash, sb.Size, sb.ContentType
+	a.DateCreated = timeNow()
+
+	b := tx.Bucket(BlobBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(BlobBucket))
+	}
+	br := blobRecord{Hash: sb.Hash, Size: sb.Size}
+	if v := b.Get([]byte(sb.Hash)); v != nil {
+		if err := json.Unmarshal(v, &br); err != nil {
+			return err
+		}
+	}
+	br.Refs++
+	if err := putRecord(tx, BlobBucket, br.Hash, &br); err != nil {
+		return err
+	}
+	return putRecord(tx, AttachmentBucket, a.ID, a)
+}
+
+// commitBlob stores the blob of an attachment just saved, deleting the
+// attachment again if it can't be.
+func (as *AttachmentStore) commitBlob(a *models.Attachment, sb *models.StagedBlob) error {
+	err := as.Blobs.Commit(sb)
+	if err == nil {
+		return nil
+	}
+	if derr := as.DB.Update(func(tx *bolt.Tx) error { return deleteAttachment(tx, a) }); derr != nil {
+		log.WithFields(logrus.Fields{"error": derr, "attachment_id": a.ID}).Error("error deleting attachment whose blob wasn't stored")
+	}
+	return err
+}
+
+// checkQuota returns an aderrors.ValidationError if another size bytes
+// would take the user over their quota.
+func (as *AttachmentStore) checkQuota(tx *bolt.Tx, userID string, size int64) error {
+	quota := as.Quota
+	if quota == 0 {
+		quota = models.DefaultAttachmentQuota
+	}
+	used, err := attachmentUsage(tx, userID)
+	if err != nil {
+		return err
+	}
+	if used+size > quota {
+		var ve aderrors.ValidationError
+		ve.Add("file", "quota_exceeded", fmt.Sprintf("That would take you over your %d MB of attachments. You have %d MB left.",
+			quota>>20, (quota-used)>>20))
+		return ve
+	}
+	return nil
+}
+
+// attachmentUsage adds up the sizes of the user's attachments and uploads.
+func attachmentUsage(tx *bolt.Tx, userID string) (int64, error) {
+	var used int64
+	err := forEachOwned(tx, AttachmentBucket, userID, func(k, v []byte) error {
+		var a models.Attachment
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		used += a.Size
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	err = forEachOwned(tx, UploadBucket, userID, func(k, v []byte) error {
+		var up models.Upload
+		if err := json.Unmarshal(v, &up); err != nil {
+			return err
+		}
+		used += up.Size
+		return nil
+	})
+	return used, err
+}
+
+// getAttachment returns the attachment if the user has perm on its todo.
+func getAttachment(tx *bolt.Tx, id, userID string, perm models.Permission) (*models.Attachment, error) {
+	b := tx.Bucket(AttachmentBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(AttachmentBucket))
+	}
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var a models.Attachment
+	if err := json.Unmarshal(v, &a); err != nil {
+		return nil, err
+	}
+	td, err := getTodo(tx, a.TodoID)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeTodo(tx, td, userID, perm); err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func forEachAttachment(tx *bolt.Tx, fn func(a *models.Attachment) error) error {
+	b := tx.Bucket(AttachmentBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(AttachmentBucket))
+	}
+	return b.ForEach(func(k, v []byte) error {
+		var a models.Attachment
+		if err := json.Unmarshal(v, &a); err != nil {
+			return err
+		}
+		return fn(&a)
+	})
+}
+
+// deleteAttachment deletes the attachment, and stops counting it as using
+// its blob.
+func deleteAttachment(tx *bolt.Tx, a *models.Attachment) error {
+	if err := tx.Bucket(AttachmentBucket).Delete([]byte(a.ID)); err != nil {
+		return err
+	}
+	b := tx.Bucket(BlobBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(BlobBucket))
+	}
+	v := b.Get([]byte(a.Hash))
+	if v == nil {
+		return nil
+	}
+	var br blobRecord
+	if err := json.Unmarshal(v, &br); err != nil {
+		return err
+	}
+	br.Refs--
+	return putRecord(tx, BlobBucket, br.Hash, &br)
+}
+
+// deleteTodoAttachments deletes the todo's attachments, for when the todo
+// is deleted.
+func deleteTodoAttachments(tx *bolt.Tx, todoID string) error {
+	var atts []*models.Attachment
+	err := forEachAttachment(tx, func(a *models.Attachment) error {
+		if a.TodoID == todoID {
+			atts = append(atts, a)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, a := range atts {
+		if err := deleteAttachment(tx, a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package datastore_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/blob"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestAttachments(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "auth_demo_blobs")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+	blobs, err := blob.NewFileStore(dir)
+	ok(t, err)
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	as := &datastore.AttachmentStore{BDB: db, Blobs: blobs, Quota: 10}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	for _, id := range []string{"a", "b"} {
+		_, err := ts.Create(&models.Todo{ID: id, UserID: alice.ID, Name: null.StringFrom(id)})
+		ok(t, err)
+	}
+
+	attach := func(todoID, content string) (*models.Attachment, error) {
+		sb, err := blobs.Stage(strings.NewReader(content), models.MaxAttachmentSize)
+		ok(t, err)
+		a := &models.Attachment{TodoID: todoID, UserID: alice.ID, Name: "notes.txt"}
+		return a, as.CreateAttachment(a, sb)
+	}
+	read := func(hash string) string {
+		b, err := blobs.Open(hash)
+		ok(t, err)
+		defer b.Close()
+		content, err := ioutil.ReadAll(b)
+		ok(t, err)
+		return string(content)
+	}
+
+	// The same file attached twice is stored once
+	a1, err := attach("a", "hello")
+	ok(t, err)
+	a2, err := attach("b", "hello")
+	ok(t, err)
+	equals(t, a1.Hash, a2.Hash)
+	equals(t, "text/plain; charset=utf-8", a1.ContentType)
+	equals(t, "hello", read(a1.Hash))
+	used, err := as.GetUsage(alice.ID)
+	ok(t, err)
+	equals(t, int64(10), used)
+
+	_, err = attach("a", "!")
+	var ve aderrors.ValidationError
+	assert(t, errors.As(err, &ve) && ve.Fields[0].Code == "quota_exceeded", "expected the quota to be exceeded, got %v", err)
+	_, err = as.GetAttachment(a1.ID, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to see alice's attachment, got %v", err)
+	err = as.DeleteAttachment(a1.ID, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to delete alice's attachment, got %v", err)
+
+	// A blob is only deleted once nothing uses it
+	ok(t, as.DeleteAttachment(a1.ID, alice.ID))
+	n, err := as.DeleteUnusedBlobs()
+	ok(t, err)
+	equals(t, 0, n)
+	equals(t, "hello", read(a2.Hash))
+	atts, err := as.GetAttachments("b", alice.ID)
+	ok(t, err)
+	equals(t, 1, len(atts))
+
+	// Uploads reserve their size until they're finished
+	up := &models.Upload{UserID: alice.ID, TodoID: "a", Name: "big.bin", Size: 6}
+	err = as.CreateUpload(up)
+	assert(t, errors.As(err, &ve), "expected the upload not to fit, got %v", err)
+	up.Size = 5
+	ok(t, as.CreateUpload(up))
+	off, err := blobs.Append(up.ID, 0, strings.NewReader("wor"), up.Size)
+	ok(t, err)
+	ok(t, as.SetUploadOffset(up.ID, alice.ID, off))
+	_, err = blobs.Append(up.ID, 0, strings.NewReader("wor"), up.Size)
+	assert(t, errors.Is(err, aderrors.ErrUploadOffset), "expected the part to be at the wrong offset, got %v", err)
+	_, err = blobs.Append(up.ID, off, strings.NewReader("ld!!"), up.Size)
+	assert(t, errors.Is(err, aderrors.ErrTooLarge), "expected the upload to be too large, got %v", err)
+	off, err = blobs.Append(up.ID, off, strings.NewReader("ld"), up.Size)
+	ok(t, err)
+	equals(t, int64(5), off)
+	sb, err := blobs.StageUpload(up.ID)
+	ok(t, err)
+	a3, err := as.CompleteUpload(up.ID, alice.ID, sb)
+	ok(t, err)
+	equals(t, "world", read(a3.Hash))
+	_, err = as.GetUpload(up.ID, alice.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the upload to be gone, got %v", err)
+
+	up = &models.Upload{UserID: alice.ID, TodoID: "a", Name: "old.bin", Size: 1}
+	err = as.CreateUpload(up)
+	assert(t, errors.As(err, &ve), "expected the upload not to fit, got %v", err)
+	ok(t, as.DeleteAttachment(a3.ID, alice.ID))
+	ok(t, as.CreateUpload(up))
+	ids, err := as.DeleteExpiredUploads(time.Now().Add(time.Minute))
+	ok(t, err)
+	equals(t, []string{up.ID}, ids)
+
+	// Deleting the account deletes its todos' attachments, and the blobs
+	// they used
+	acs := &datastore.AccountStore{BDB: db}
+	_, err = acs.Purge(alice.ID)
+	ok(t, err)
+	n, err = as.DeleteUnusedBlobs()
+	ok(t, err)
+	equals(t, 2, n)
+	_, err = blobs.Open(a2.Hash)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the blob to be deleted, got %v", err)
+
+	// A blob isn't stored when its attachment can't be saved, and one
+	// stored without being counted is deleted
+	_, err = attach("gone", "orphan")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the todo not to be found, got %v", err)
+	hashes, err := blobs.List()
+	ok(t, err)
+	equals(t, 0, len(hashes))
+	sb, err = blobs.Stage(strings.NewReader("orphan"), models.MaxAttachmentSize)
+	ok(t, err)
+	ok(t, blobs.Commit(sb))
+	n, err = as.DeleteUnusedBlobs()
+	ok(t, err)
+	equals(t, 1, n)
+	_, err = blobs.Open(sb.Hash)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the blob to be deleted, got %v", err)
+}
@@ -0,0 +1,208 @@
+package datastore
+
+import (
+	"bytes"
+	cryptorand "crypto/rand"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/models"
+	ulid "github.com/oklog/ulid/v2"
+)
+
+var (
+	auditHeadKey = []byte("head")
+
+	// auditEntropy makes event IDs created in the same millisecond sort in
+	// the order they were created, which is also the order they're chained.
+	auditEntropy   = ulid.Monotonic(cryptorand.Reader, 0)
+	auditEntropyMu sync.Mutex
+)
+
+// AuditStore is the audit log. Events are keyed by ULID, so the bucket is in
+// the order they happened. It has no way to change or delete an event.
+type AuditStore struct{ *BDB }
+
+// Record appends the event, chaining it to the last one. The hash of the
+// newest event is also kept in a separate bucket, so that removing events
+// from the end of the log can be noticed too.
+func (as *AuditStore) Record(e *models.AuditEvent) error {
+	err := as.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(AuditBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(AuditBucket))
+		}
+		hb := tx.Bucket(auditHeadBucket)
+		if hb == nil {
+			return fmt.Errorf("no %s bucket exists", string(auditHeadBucket))
+		}
+
+		e.Time = timeNow()
+		ms := ulid.Timestamp(e.Time)
+		lastID, _ := b.Cursor().Last()
+		if lastID != nil {
+			// Never go backwards, even if the clock does
+			last, err := ulid.ParseStrict(strings.ToUpper(string(lastID)))
+			if err != nil {
+				return fmt.Errorf("error parsing last audit event ID %s: %w", lastID, err)
+			}
+			if last.Time() > ms {
+				ms = last.Time()
+			}
+		}
+		auditEntropyMu.Lock()
+		id, err := ulid.New(ms, auditEntropy)
+		auditEntropyMu.Unlock()
+		if err != nil {
+			return err
+		}
+		e.ID = strings.ToLower(id.String())
+		e.PrevHash = string(hb.Get(auditHeadKey))
+		e.Hash, err = e.ComputeHash()
+		if err != nil {
+			return err
+		}
+
+		eJSON, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(e.ID), eJSON); err != nil {
+			return err
+		}
+		return hb.Put(auditHeadKey, []byte(e.Hash))
+	})
+	if err != nil {
+		return fmt.Errorf("error recording %s audit event: %w", e.Action, err)
+	}
+	return nil
+}
+
+// Query walks the log backwards from q.Before, or the newest event.
+func (as *AuditStore) Query(q models.AuditQuery) ([]*models.AuditEvent, error) {
+	events := []*models.AuditEvent{}
+	err := as.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(AuditBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(AuditBucket))
+		}
+		c := b.Cursor()
+		var k, v []byte
+		if q.Before != "" {
+			before := []byte(q.Before)
+			k, v = c.Seek(before)
+			if k == nil {
+				k, v = c.Last()
+			}
+			if k != nil && bytes.Compare(k, before) >= 0 {
+				k, v = c.Prev()
+			}
+		} else {
+			k, v = c.Last()
+		}
+		for ; k != nil; k, v = c.Prev() {
+			if q.Limit > 0 && len(events) >= q.Limit {
+				break
+			}
+			var e models.AuditEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			if !q.Since.IsZero() && e.Time.Before(q.Since) {
+				break
+			}
+			if q.Matches(&e) {
+				events = append(events, &e)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error querying audit log: %w", err)
+	}
+	return events, nil
+}
+
+// ForEach calls fn with every event, oldest first. Returning an error from
+// fn stops the walk.
+func (as *AuditStore) ForEach(fn func(e *models.AuditEvent) error) error {
+	err := as.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(AuditBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(AuditBucket))
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var e models.AuditEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				return fmt.Errorf("error unmarshalling audit event %s: %w", k, err)
+			}
+			return fn(&e)
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error reading audit log: %w", err)
+	}
+	return nil
+}
+
+// Verify recomputes every event's hash and checks it against the next
+// event's PrevHash, and the last one against the stored head.
+func (as *AuditStore) Verify() (int, error) {
+	n := 0
+	var chainErr *models.AuditChainError
+	err := as.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(AuditBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(AuditBucket))
+		}
+		hb := tx.Bucket(auditHeadBucket)
+		if hb == nil {
+			return fmt.Errorf("no %s bucket exists", string(auditHeadBucket))
+		}
+
+		prevHash, lastID := "", "(start)"
+		err := b.ForEach(func(k, v []byte) error {
+			var e models.AuditEvent
+			if err := json.Unmarshal(v, &e); err != nil {
+				chainErr = &models.AuditChainError{EventID: string(k), Problem: "event can't be read"}
+				return chainErr
+			}
+			hash, err := e.ComputeHash()
+			if err != nil {
+				return err
+			}
+			switch {
+			case e.ID != string(k):
+				chainErr = &models.AuditChainError{EventID: string(k), Problem: "event is stored under the wrong ID"}
+			case e.PrevHash != prevHash:
+				chainErr = &models.AuditChainError{EventID: e.ID, Problem: "previous hash doesn't match, an earlier event was changed or removed"}
+			case e.Hash != hash:
+				chainErr = &models.AuditChainError{EventID: e.ID, Problem: "hash doesn't match, the event was changed"}
+			}
+			if chainErr != nil {
+				return chainErr
+			}
+			prevHash, lastID = e.Hash, e.ID
+			n++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if head := string(hb.Get(auditHeadKey)); head != prevHash {
+			chainErr = &models.AuditChainError{EventID: lastID, Problem: "last event isn't the head of the log, later events were removed"}
+			return chainErr
+		}
+		return nil
+	})
+	if chainErr != nil {
+		return n, chainErr
+	}
+	if err != nil {
+		return n, fmt.Errorf("error verifying audit log: %w", err)
+	}
+	return n, nil
+}
@@ -0,0 +1,142 @@
+package datastore_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func recordTestEvents(t *testing.T, as *datastore.AuditStore) []*models.AuditEvent {
+	events := []*models.AuditEvent{
+		{Action: models.AuditLoginSucceeded, ActorID: "alice", TargetID: "alice"},
+		{Action: models.AuditLoginFailed, Details: map[string]string{"email": "bob@example.com"}},
+		{Action: models.AuditAdminLock, ActorID: "alice", TargetID: "bob"},
+		{Action: models.AuditLogout, ActorID: "alice", TargetID: "alice"},
+	}
+	for _, e := range events {
+		ok(t, as.Record(e))
+	}
+	return events
+}
+
+func TestAuditRecordAndQuery(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	as := &datastore.AuditStore{BDB: db}
+	events := recordTestEvents(t, as)
+
+	equals(t, "", events[0].PrevHash)
+	for i := 1; i < len(events); i++ {
+		assert(t, events[i].ID > events[i-1].ID, "event IDs should increase: %s <= %s", events[i].ID, events[i-1].ID)
+		equals(t, events[i-1].Hash, events[i].PrevHash)
+	}
+
+	all, err := as.Query(models.AuditQuery{})
+	ok(t, err)
+	equals(t, 4, len(all))
+	equals(t, events[3].ID, all[0].ID)
+	equals(t, "bob@example.com", all[2].Details["email"])
+
+	got, err := as.Query(models.AuditQuery{UserID: "bob"})
+	ok(t, err)
+	equals(t, 1, len(got))
+	equals(t, models.AuditAdminLock, got[0].Action)
+
+	got, err = as.Query(models.AuditQuery{Action: "login"})
+	ok(t, err)
+	equals(t, 2, len(got))
+
+	got, err = as.Query(models.AuditQuery{ActorID: "alice", Limit: 2})
+	ok(t, err)
+	equals(t, 2, len(got))
+	equals(t, events[3].ID, got[0].ID)
+	got, err = as.Query(models.AuditQuery{ActorID: "alice", Before: got[1].ID})
+	ok(t, err)
+	equals(t, 1, len(got))
+	equals(t, events[0].ID, got[0].ID)
+
+	n, err := as.Verify()
+	ok(t, err)
+	equals(t, 4, n)
+}
+
+func TestAuditVerifyDetectsTampering(t *testing.T) {
+	tamper := func(t *testing.T, db *datastore.BDB, fn func(b *bolt.Bucket, events []*models.AuditEvent) error) {
+		ok(t, db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket(datastore.AuditBucket)
+			var events []*models.AuditEvent
+			err := b.ForEach(func(k, v []byte) error {
+				var e models.AuditEvent
+				events = append(events, &e)
+				return json.Unmarshal(v, &e)
+			})
+			if err != nil {
+				return err
+			}
+			return fn(b, events)
+		}))
+	}
+	put := func(b *bolt.Bucket, e *models.AuditEvent) error {
+		eJSON, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(e.ID), eJSON)
+	}
+
+	tests := []struct {
+		name    string
+		fn      func(b *bolt.Bucket, events []*models.AuditEvent) error
+		eventID func(events []*models.AuditEvent) string
+	}{
+		{
+			name: "edited",
+			fn: func(b *bolt.Bucket, events []*models.AuditEvent) error {
+				events[1].Details["email"] = "carol@example.com"
+				return put(b, events[1])
+			},
+			eventID: func(events []*models.AuditEvent) string { return events[1].ID },
+		},
+		{
+			name: "edited and rehashed",
+			fn: func(b *bolt.Bucket, events []*models.AuditEvent) error {
+				events[2].TargetID = "carol"
+				events[2].Hash, _ = events[2].ComputeHash()
+				return put(b, events[2])
+			},
+			eventID: func(events []*models.AuditEvent) string { return events[3].ID },
+		},
+		{
+			name: "removed",
+			fn: func(b *bolt.Bucket, events []*models.AuditEvent) error {
+				return b.Delete([]byte(events[1].ID))
+			},
+			eventID: func(events []*models.AuditEvent) string { return events[2].ID },
+		},
+		{
+			name: "last removed",
+			fn: func(b *bolt.Bucket, events []*models.AuditEvent) error {
+				return b.Delete([]byte(events[3].ID))
+			},
+			eventID: func(events []*models.AuditEvent) string { return events[2].ID },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, cleanup := newTestDB(t)
+			defer cleanup()
+			as := &datastore.AuditStore{BDB: db}
+			events := recordTestEvents(t, as)
+
+			tamper(t, db, tt.fn)
+			_, err := as.Verify()
+			var chainErr *models.AuditChainError
+			assert(t, errors.As(err, &chainErr), "expected a chain error, got %v", err)
+			equals(t, tt.eventID(events), chainErr.EventID)
+		})
+	}
+}
@@ -0,0 +1,389 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/fracindex"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// BoardStore keeps users' kanban boards and their columns. Cards are todos
+// with a ColumnID, so they're kept in the todo bucket.
+type BoardStore struct{ *BDB }
+
+func (bs *BoardStore) GetBoardsByUserID(userID string) ([]*models.Board, error) {
+	boards := []*models.Board{}
+	err := bs.View(func(tx *bolt.Tx) error {
+		err := forEachOwned(tx, BoardBucket, userID, func(k, v []byte) error {
+			var b models.Board
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			boards = append(boards, &b)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, b := range boards {
+			if err := fillBoard(tx, b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving boards of user %s: %w", userID, err)
+	}
+	sort.SliceStable(boards, func(i, j int) bool { return boards[i].Name < boards[j].Name })
+	return boards, nil
+}
+
+func (bs *BoardStore) GetBoard(userID, id string) (*models.Board, error) {
+	var b models.Board
+	err := bs.View(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, BoardBucket, userID, id, &b); err != nil {
+			return err
+		}
+		return fillBoard(tx, &b)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving board %s: %w", id, err)
+	}
+	return &b, nil
+}
+
+func (bs *BoardStore) CreateBoard(b *models.Board) error {
+	if b.ID == "" {
+		return aderrors.ErrNoID
+	}
+	b.DateCreated = timeNow()
+	b.Columns, b.Cards = []*models.Column{}, []*models.Todo{}
+	err := bs.Update(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket(BoardBucket); bkt != nil && bkt.Get([]byte(b.ID)) != nil {
+			return aderrors.ErrAlreadyExists
+		}
+		return putRecord(tx, BoardBucket, b.ID, b)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating board: %w", err)
+	}
+	return nil
+}
+
+func (bs *BoardStore) UpdateBoard(b *models.Board) error {
+	err := bs.Update(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, BoardBucket, b.UserID, b.ID, &models.Board{}); err != nil {
+			return err
+		}
+		return putRecord(tx, BoardBucket, b.ID, b)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating board %s: %w", b.ID, err)
+	}
+	return nil
+}
+
+func (bs *BoardStore) DeleteBoard(userID, id string) error {
+	err := bs.Update(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, BoardBucket, userID, id, &models.Board{}); err != nil {
+			return err
+		}
+		columns, err := boardColumns(tx, userID, id)
+		if err != nil {
+			return err
+		}
+		for _, c := range columns {
+			if err := deleteColumn(tx, c); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(BoardBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting board %s: %w", id, err)
+	}
+	return nil
+}
+
+func (bs *BoardStore) GetColumn(userID, id string) (*models.Column, error) {
+	var c models.Column
+	err := bs.View(func(tx *bolt.Tx) error {
+		return getOwnedRecord(tx, ColumnBucket, userID, id, &c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving column %s: %w", id, err)
+	}
+	c.Board = &models.Board{ID: c.BoardID}
+	return &c, nil
+}
+
+// CreateColumn returns aderrors.ErrNoRecords if the user doesn't have the
+// board.
+func (bs *BoardStore) CreateColumn(c *models.Column) error {
+	if c.ID == "" {
+		return aderrors.ErrNoID
+	}
+	c.DateCreated = timeNow()
+	err := bs.Update(func(tx *bolt.Tx) error {
+		if bkt := tx.Bucket(ColumnBucket); bkt != nil && bkt.Get([]byte(c.ID)) != nil {
+			return aderrors.ErrAlreadyExists
+		}
+		if err := getOwnedRecord(tx, BoardBucket, c.UserID, c.BoardID, &models.Board{}); err != nil {
+			return err
+		}
+		columns, err := boardColumns(tx, c.UserID, c.BoardID)
+		if err != nil {
+			return err
+		}
+		last := ""
+		if len(columns) > 0 {
+			last = columns[len(columns)-1].Position
+		}
+		if c.Position, err = fracindex.Between(last, ""); err != nil {
+			return err
+		}
+		return putRecord(tx, ColumnBucket, c.ID, c)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating column: %w", err)
+	}
+	c.Board = &models.Board{ID: c.BoardID}
+	return nil
+}
+
+// UpdateColumn saves the column's name and WIP limit. Which board it's on
+// and where can't be changed.
+func (bs *BoardStore) UpdateColumn(c *models.Column) error {
+	err := bs.Update(func(tx *bolt.Tx) error {
+		var cur models.Column
+		if err := getOwnedRecord(tx, ColumnBucket, c.UserID, c.ID, &cur); err != nil {
+			return err
+		}
+		c.BoardID, c.Position, c.DateCreated = cur.BoardID, cur.Position, cur.DateCreated
+		return putRecord(tx, ColumnBucket, c.ID, c)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating column %s: %w", c.ID, err)
+	}
+	c.Board = &models.Board{ID: c.BoardID}
+	return nil
+}
+
+func (bs *BoardStore) MoveColumn(userID, id string, m *models.ColumnMove) (*models.Column, error) {
+	var c models.Column
+	err := bs.Update(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, ColumnBucket, userID, id, &c); err != nil {
+			return err
+		}
+		columns, err := boardColumns(tx, userID, c.BoardID)
+		if err != nil {
+			return err
+		}
+		keys := []orderKey{}
+		for _, other := range columns {
+			if other.ID != c.ID {
+				keys = append(keys, orderKey{other.ID, other.Position})
+			}
+		}
+		after, before, ok := neighbours(keys, m.AfterID, m.BeforeID)
+		if !ok {
+			var ve aderrors.ValidationError
+			ve.Add("position", "position_invalid", "The columns to move it after and before need to be next to each other on its board.")
+			return ve
+		}
+		if c.Position, err = fracindex.Between(after, before); err != nil {
+			return err
+		}
+		return putRecord(tx, ColumnBucket, c.ID, &c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error moving column %s: %w", id, err)
+	}
+	c.Board = &models.Board{ID: c.BoardID}
+	return &c, nil
+}
+
+func (bs *BoardStore) DeleteColumn(userID, id string) error {
+	err := bs.Update(func(tx *bolt.Tx) error {
+		var c models.Column
+		if err := getOwnedRecord(tx, ColumnBucket, userID, id, &c); err != nil {
+			return err
+		}
+		return deleteColumn(tx, &c)
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting column %s: %w", id, err)
+	}
+	return nil
+}
+
+// MoveCard checks the user may write the todo as the TodoService does, but
+// only their own todos can be cards.
+func (bs *BoardStore) MoveCard(userID, todoID string, m *models.CardMove) (*models.Todo, error) {
+	var td *models.Todo
+	err := bs.Update(func(tx *bolt.Tx) error {
+		var err error
+		td, err = getTodo(tx, todoID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		if m.ColumnID == "" {
+			td.ColumnID, td.CardPosition = "", ""
+			if err := linkTodo(tx, td); err != nil {
+				return err
+			}
+			return putTodo(tx, td)
+		}
+
+		var ve aderrors.ValidationError
+		if td.OrgID != "" {
+			ve.Add("column", "org_todo_list", "Only your own todos can be put in lists, labelled or put on boards.")
+			return ve
+		}
+		var c models.Column
+		err = getOwnedRecord(tx, ColumnBucket, td.UserID, m.ColumnID, &c)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			ve.Add("column", "column_not_found", "There's no such column of yours.")
+			return ve
+		} else if err != nil {
+			return err
+		}
+		cards, err := columnCards(tx, td.UserID, c.ID)
+		if err != nil {
+			return err
+		}
+		others := []*models.Todo{}
+		for _, card := range cards {
+			if card.ID != td.ID {
+				others = append(others, card)
+			}
+		}
+		if td.ColumnID != c.ID && c.WIPLimit > 0 && len(others) >= c.WIPLimit {
+			ve.Add("column", "wip_limit_reached", fmt.Sprintf("%s is at its WIP limit of %d.", c.Name, c.WIPLimit))
+			return ve
+		}
+		after, before, ok := neighbours(todoKeys(others, true), m.AfterID, m.BeforeID)
+		if !ok {
+			ve.Add("position", "position_invalid", "The cards to move it after and before need to be next to each other in the column.")
+			return ve
+		}
+		if td.CardPosition, err = fracindex.Between(after, before); err != nil {
+			return err
+		}
+		td.ColumnID = c.ID
+		if err := linkTodo(tx, td); err != nil {
+			return err
+		}
+		return putTodo(tx, td)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error moving card %s: %w", todoID, err)
+	}
+	return td, nil
+}
+
+// fillBoard fills in the board's columns and cards. A card's parent is the
+// card itself if it's on the board too.
+func fillBoard(tx *bolt.Tx, b *models.Board) error {
+	columns, err := boardColumns(tx, b.UserID, b.ID)
+	if err != nil {
+		return err
+	}
+	b.Columns, b.Cards = columns, []*models.Todo{}
+	cards := map[string]*models.Todo{}
+	for _, c := range columns {
+		c.Board = &models.Board{ID: b.ID}
+		inColumn, err := columnCards(tx, b.UserID, c.ID)
+		if err != nil {
+			return err
+		}
+		for _, td := range inColumn {
+			if err := linkTodo(tx, td); err != nil {
+				return err
+			}
+			cards[td.ID] = td
+		}
+		b.Cards = append(b.Cards, inColumn...)
+	}
+	for _, td := range b.Cards {
+		if parent := cards[td.ParentID]; parent != nil {
+			td.Parent = parent
+		}
+	}
+	return nil
+}
+
+// boardColumns returns the board's columns in order.
+func boardColumns(tx *bolt.Tx, userID, boardID string) ([]*models.Column, error) {
+	columns := []*models.Column{}
+	err := forEachOwned(tx, ColumnBucket, userID, func(k, v []byte) error {
+		var c models.Column
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		if c.BoardID == boardID {
+			columns = append(columns, &c)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(columns, func(i, j int) bool {
+		if columns[i].Position != columns[j].Position {
+			return columns[i].Position < columns[j].Position
+		}
+		return columns[i].ID < columns[j].ID
+	})
+	return columns, nil
+}
+
+// columnCards returns the cards in the column in order, without their
+// relationships filled in.
+func columnCards(tx *bolt.Tx, userID, columnID string) ([]*models.Todo, error) {
+	cards := []*models.Todo{}
+	err := forEachOwned(tx, TodoBucket, userID, func(k, v []byte) error {
+		var td models.Todo
+		if err := json.Unmarshal(v, &td); err != nil {
+			return err
+		}
+		if td.ColumnID == columnID && !td.IsTrashed() {
+			cards = append(cards, &td)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(cards, func(i, j int) bool {
+		if cards[i].CardPosition != cards[j].CardPosition {
+			return cards[i].CardPosition < cards[j].CardPosition
+		}
+		return cards[i].ID < cards[j].ID
+	})
+	return cards, nil
+}
+
+// deleteColumn deletes the column, taking its cards off the board.
+func deleteColumn(tx *bolt.Tx, c *models.Column) error {
+	err := updateOwnedTodos(tx, c.UserID, func(td *models.Todo) bool {
+		if td.ColumnID != c.ID {
+			return false
+		}
+		td.ColumnID, td.CardPosition = "", ""
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(ColumnBucket).Delete([]byte(c.ID))
+}
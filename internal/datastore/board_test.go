@@ -0,0 +1,103 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestBoards(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	bs := &datastore.BoardStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	b := &models.Board{UserID: alice.ID, Name: "Work"}
+	b.GenerateID()
+	ok(t, bs.CreateBoard(b))
+	column := func(name string, limit int) *models.Column {
+		c := &models.Column{UserID: alice.ID, BoardID: b.ID, Name: name, WIPLimit: limit}
+		c.GenerateID()
+		ok(t, bs.CreateColumn(c))
+		return c
+	}
+	todo, doing, done := column("To do", 0), column("Doing", 1), column("Done", 0)
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := ts.Create(&models.Todo{ID: id, UserID: alice.ID, Name: null.StringFrom(id)})
+		ok(t, err)
+	}
+	cardIDs := func() map[string][]string {
+		board, err := bs.GetBoard(alice.ID, b.ID)
+		ok(t, err)
+		ids := map[string][]string{}
+		for _, td := range board.Cards {
+			ids[td.ColumnID] = append(ids[td.ColumnID], td.ID)
+		}
+		return ids
+	}
+	validationCode := func(err error) string {
+		var ve aderrors.ValidationError
+		if !errors.As(err, &ve) {
+			t.Fatalf("expected a validation error, got %v", err)
+		}
+		return ve.Fields[0].Code
+	}
+
+	c := &models.Column{UserID: bob.ID, BoardID: b.ID, Name: "Mine"}
+	c.GenerateID()
+	err := bs.CreateColumn(c)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to add to alice's board, got %v", err)
+
+	for _, id := range []string{"a", "b", "c"} {
+		_, err := bs.MoveCard(alice.ID, id, &models.CardMove{ColumnID: todo.ID})
+		ok(t, err)
+	}
+	_, err = bs.MoveCard(alice.ID, "c", &models.CardMove{ColumnID: todo.ID, BeforeID: "a"})
+	ok(t, err)
+	equals(t, map[string][]string{todo.ID: {"c", "a", "b"}}, cardIDs())
+	_, err = bs.MoveCard(bob.ID, "a", &models.CardMove{ColumnID: doing.ID})
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to move alice's card, got %v", err)
+
+	// Doing only takes one card
+	_, err = bs.MoveCard(alice.ID, "a", &models.CardMove{ColumnID: doing.ID})
+	ok(t, err)
+	_, err = bs.MoveCard(alice.ID, "b", &models.CardMove{ColumnID: doing.ID})
+	equals(t, "wip_limit_reached", validationCode(err))
+	_, err = bs.MoveCard(alice.ID, "a", &models.CardMove{ColumnID: doing.ID})
+	ok(t, err)
+	_, err = bs.MoveCard(alice.ID, "b", &models.CardMove{ColumnID: done.ID, AfterID: "a"})
+	equals(t, "position_invalid", validationCode(err))
+
+	// Editing a todo doesn't move it
+	a, err := ts.Get("a")
+	ok(t, err)
+	equals(t, doing.ID, a.Column.ID)
+	a.ColumnID, a.IsDone = "", null.BoolFrom(true)
+	_, err = ts.Update(a, alice.ID)
+	ok(t, err)
+	equals(t, map[string][]string{todo.ID: {"c", "b"}, doing.ID: {"a"}}, cardIDs())
+
+	_, err = bs.MoveColumn(alice.ID, done.ID, &models.ColumnMove{BeforeID: todo.ID})
+	ok(t, err)
+	board, err := bs.GetBoard(alice.ID, b.ID)
+	ok(t, err)
+	equals(t, []string{done.ID, todo.ID, doing.ID}, []string{board.Columns[0].ID, board.Columns[1].ID, board.Columns[2].ID})
+	equals(t, []string{"c", "b", "a"}, []string{board.Cards[0].ID, board.Cards[1].ID, board.Cards[2].ID})
+
+	ok(t, bs.DeleteColumn(alice.ID, todo.ID))
+	equals(t, map[string][]string{doing.ID: {"a"}}, cardIDs())
+	_, err = bs.MoveCard(alice.ID, "a", &models.CardMove{})
+	ok(t, err)
+	equals(t, map[string][]string{}, cardIDs())
+
+	ok(t, bs.DeleteBoard(alice.ID, b.ID))
+	_, err = bs.GetColumn(alice.ID, doing.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the board's columns to be deleted, got %v", err)
+}
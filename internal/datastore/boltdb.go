@@ -9,13 +9,49 @@ import (
 )
 
 var (
-	UserBucket         = []byte("user_bucket")
-	SessionBucket      = []byte("session_bucket")
-	sessionTokenBucket = []byte("session_token_bucket")
-	userEmailBucket    = []byte("user_email_bucket")
-	userUsernameBucket = []byte("user_username_bucket")
-	TodoBucket         = []byte("todo_bucket")
-	bucketsList        = [][]byte{UserBucket, SessionBucket, sessionTokenBucket, userEmailBucket, userUsernameBucket, TodoBucket}
+	UserBucket             = []byte("user_bucket")
+	SessionBucket          = []byte("session_bucket")
+	sessionTokenBucket     = []byte("session_token_bucket")
+	userEmailBucket        = []byte("user_email_bucket")
+	userUsernameBucket     = []byte("user_username_bucket")
+	TodoBucket             = []byte("todo_bucket")
+	RememberTokenBucket    = []byte("remember_token_bucket")
+	rememberFamilyBucket   = []byte("remember_family_bucket")
+	AuditBucket            = []byte("audit_bucket")
+	auditHeadBucket        = []byte("audit_head_bucket")
+	OrgBucket              = []byte("org_bucket")
+	orgSlugBucket          = []byte("org_slug_bucket")
+	membershipBucket       = []byte("membership_bucket")
+	userOrgBucket          = []byte("user_org_bucket")
+	InvitationBucket       = []byte("invitation_bucket")
+	invitationTokenBucket  = []byte("invitation_token_bucket")
+	SignupInviteBucket     = []byte("signup_invite_bucket")
+	signupInviteCodeBucket = []byte("signup_invite_code_bucket")
+	scimTokenBucket        = []byte("scim_token_bucket")
+	GroupBucket            = []byte("group_bucket")
+	IdentityBucket         = []byte("identity_bucket")
+	samlRequestBucket      = []byte("saml_request_bucket")
+	samlAssertionBucket    = []byte("saml_assertion_bucket")
+	ReminderBucket         = []byte("reminder_bucket")
+	reminderDueBucket      = []byte("reminder_due_bucket")
+	NotificationBucket     = []byte("notification_bucket")
+	ListBucket             = []byte("list_bucket")
+	LabelBucket            = []byte("label_bucket")
+	BoardBucket            = []byte("board_bucket")
+	ColumnBucket           = []byte("column_bucket")
+	NoteRevisionBucket     = []byte("note_revision_bucket")
+	AttachmentBucket       = []byte("attachment_bucket")
+	UploadBucket           = []byte("upload_bucket")
+	BlobBucket             = []byte("blob_bucket")
+	CommentBucket          = []byte("comment_bucket")
+	SearchIndexBucket      = []byte("search_index_bucket")
+	searchDocBucket        = []byte("search_doc_bucket")
+	bucketsList            = [][]byte{UserBucket, SessionBucket, sessionTokenBucket, userEmailBucket, userUsernameBucket, TodoBucket, RememberTokenBucket,
+		AuditBucket, auditHeadBucket, OrgBucket, orgSlugBucket, membershipBucket, userOrgBucket, InvitationBucket, invitationTokenBucket,
+		SignupInviteBucket, signupInviteCodeBucket, scimTokenBucket, GroupBucket, IdentityBucket, samlRequestBucket, samlAssertionBucket,
+		ReminderBucket, reminderDueBucket, NotificationBucket, ListBucket, LabelBucket,
+		BoardBucket, ColumnBucket, NoteRevisionBucket, AttachmentBucket, UploadBucket, BlobBucket, CommentBucket,
+		SearchIndexBucket, searchDocBucket, rememberFamilyBucket}
 )
 
 type BDB struct {
@@ -0,0 +1,245 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// CommentStore keeps comments in CommentBucket, keyed by their ID. IDs
+// are ULIDs, so a todo's comments come out of the bucket oldest first.
+type CommentStore struct {
+	*BDB
+}
+
+func (cs *CommentStore) GetComments(todoID, userID string) ([]*models.Comment, error) {
+	comments := []*models.Comment{}
+	err := cs.View(func(tx *bolt.Tx) error {
+		td, err := getTodo(tx, todoID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosRead); err != nil {
+			return err
+		}
+		return forEachComment(tx, func(c *models.Comment) error {
+			if c.TodoID == todoID {
+				comments = append(comments, c)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving comments of todo %s: %w", todoID, err)
+	}
+	return comments, nil
+}
+
+func (cs *CommentStore) GetComment(todoID, id, userID string) (*models.Comment, error) {
+	var c *models.Comment
+	err := cs.View(func(tx *bolt.Tx) error {
+		var err error
+		c, _, err = getComment(tx, todoID, id, userID, models.PermTodosRead)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving comment %s: %w", id, err)
+	}
+	return c, nil
+}
+
+func (cs *CommentStore) CreateComment(c *models.Comment) error {
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		td, err := getTodo(tx, c.TodoID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, c.UserID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		if c.ID == "" {
+			c.GenerateID()
+		}
+		c.DateCreated = timeNow()
+		c.Edited, c.EditedTime, c.Deleted, c.DeletedTime = false, nil, false, nil
+		if c.MentionIDs, err = mentionedUsers(tx, td, c); err != nil {
+			return err
+		}
+		return putComment(tx, c)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating comment: %w", err)
+	}
+	return nil
+}
+
+// UpdateComment satisfies the models.CommentService interface. Someone
+// other than the author gets aderrors.ErrNoRecords if they can read the
+// comment, as well as if they can't, as deleted comments can't be edited.
+func (cs *CommentStore) UpdateComment(c *models.Comment, userID string) error {
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		old, td, err := getComment(tx, c.TodoID, c.ID, userID, models.PermTodosWrite)
+		if err != nil {
+			return err
+		}
+		if old.UserID != userID || old.Deleted {
+			return aderrors.ErrNoRecords
+		}
+		if c.Body == old.Body {
+			*c = *old
+			return nil
+		}
+		now := timeNow()
+		old.Body, old.Edited, old.EditedTime = c.Body, true, &now
+		if old.MentionIDs, err = mentionedUsers(tx, td, old); err != nil {
+			return err
+		}
+		*c = *old
+		return putComment(tx, c)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating comment %s: %w", c.ID, err)
+	}
+	return nil
+}
+
+func (cs *CommentStore) DeleteComment(todoID, id, userID string) (*models.Comment, error) {
+	var c *models.Comment
+	err := cs.DB.Update(func(tx *bolt.Tx) error {
+		var td *models.Todo
+		var err error
+		c, td, err = getComment(tx, todoID, id, userID, models.PermTodosRead)
+		if err != nil {
+			return err
+		}
+		if c.Deleted {
+			return aderrors.ErrNoRecords
+		}
+		if c.UserID != userID {
+			if td.OrgID == "" {
+				return aderrors.ErrNoRecords
+			}
+			if err := authorizeOrg(tx, td.OrgID, userID, models.PermOrgMembersManage); err != nil {
+				return err
+			}
+		}
+		now := timeNow()
+		c.Body, c.MentionIDs, c.Deleted, c.DeletedTime = "", []string{}, true, &now
+		return putComment(tx, c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error deleting comment %s: %w", id, err)
+	}
+	return c, nil
+}
+
+// getComment returns the todo's comment, and the todo, if the user has
+// perm on the todo.
+func getComment(tx *bolt.Tx, todoID, id, userID string, perm models.Permission) (*models.Comment, *models.Todo, error) {
+	b := tx.Bucket(CommentBucket)
+	if b == nil {
+		return nil, nil, fmt.Errorf("no %s bucket exists", string(CommentBucket))
+	}
+	v := b.Get([]byte(id))
+	if v == nil {
+		return nil, nil, aderrors.ErrNoRecords
+	}
+	var c models.Comment
+	if err := json.Unmarshal(v, &c); err != nil {
+		return nil, nil, err
+	}
+	if c.TodoID != todoID {
+		return nil, nil, aderrors.ErrNoRecords
+	}
+	td, err := getTodo(tx, todoID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := authorizeTodo(tx, td, userID, perm); err != nil {
+		return nil, nil, err
+	}
+	return &c, td, nil
+}
+
+// mentionedUsers looks up the users the comment mentions, leaving out
+// usernames nobody has, its author, and users who can't read the todo, so
+// mentioning someone can't tell them about a todo they can't see.
+func mentionedUsers(tx *bolt.Tx, td *models.Todo, c *models.Comment) ([]string, error) {
+	bu := tx.Bucket(userUsernameBucket)
+	if bu == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(userUsernameBucket))
+	}
+	ids := []string{}
+	for _, username := range c.Mentions() {
+		id := bu.Get([]byte(username))
+		if id == nil || string(id) == c.UserID {
+			continue
+		}
+		err := authorizeTodo(tx, td, string(id), models.PermTodosRead)
+		if err == nil {
+			ids = append(ids, string(id))
+			continue
+		}
+		if !isAccessDenied(err) {
+			return nil, err
+		}
+	}
+	return ids, nil
+}
+
+// isAccessDenied reports whether the error is authorizeTodo turning the
+// user away.
+func isAccessDenied(err error) bool {
+	var pe aderrors.PermissionError
+	return errors.Is(err, aderrors.ErrNoRecords) || errors.As(err, &pe)
+}
+
+// putComment saves the comment and indexes it for search.
+func putComment(tx *bolt.Tx, c *models.Comment) error {
+	if err := putRecord(tx, CommentBucket, c.ID, c); err != nil {
+		return err
+	}
+	return indexComment(tx, c)
+}
+
+func forEachComment(tx *bolt.Tx, fn func(c *models.Comment) error) error {
+	b := tx.Bucket(CommentBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(CommentBucket))
+	}
+	return b.ForEach(func(k, v []byte) error {
+		var c models.Comment
+		if err := json.Unmarshal(v, &c); err != nil {
+			return err
+		}
+		return fn(&c)
+	})
+}
+
+// deleteTodoComments deletes the todo's comments, for when the todo is
+// deleted.
+func deleteTodoComments(tx *bolt.Tx, todoID string) error {
+	var ids [][]byte
+	err := forEachComment(tx, func(c *models.Comment) error {
+		if c.TodoID == todoID {
+			ids = append(ids, []byte(c.ID))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := tx.Bucket(CommentBucket).Delete(id); err != nil {
+			return err
+		}
+		if err := unindexDoc(tx, commentDocPrefix+string(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestComments(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ors := &datastore.OrgStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	cs := &datastore.CommentStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	carol := newTestUser(t, us, "carol")
+	dave := newTestUser(t, us, "dave")
+	acme := newTestOrg(t, ors, "acme", alice)
+	for _, m := range []struct {
+		u    *models.User
+		role models.OrgRole
+	}{{bob, models.OrgRoleMember}, {carol, models.OrgRoleViewer}} {
+		token, err := ors.CreateInvitation(&models.Invitation{OrgID: acme.ID, Email: m.u.Email, Role: m.role, InviterID: alice.ID})
+		ok(t, err)
+		_, err = ors.AcceptInvitation(token, m.u)
+		ok(t, err)
+	}
+	td := &models.Todo{ID: "shared", UserID: alice.ID, OrgID: acme.ID}
+	_, err := ts.Create(td)
+	ok(t, err)
+
+	// Only users who can read the todo are mentioned, and only once
+	c := &models.Comment{TodoID: td.ID, UserID: bob.ID, Body: "@Carol @dave @alice, see @carol. Mail bob@example.com or @bob"}
+	ok(t, cs.CreateComment(c))
+	equals(t, []string{carol.ID, alice.ID}, c.MentionIDs)
+
+	var pe aderrors.PermissionError
+	err = cs.CreateComment(&models.Comment{TodoID: td.ID, UserID: carol.ID, Body: "hi"})
+	assert(t, errors.As(err, &pe), "expected a viewer not to comment, got %v", err)
+	err = cs.CreateComment(&models.Comment{TodoID: td.ID, UserID: dave.ID, Body: "hi"})
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected an outsider not to comment, got %v", err)
+
+	// Only the author can edit
+	err = cs.UpdateComment(&models.Comment{ID: c.ID, TodoID: td.ID, Body: "changed"}, alice.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected only the author to edit, got %v", err)
+	edit := &models.Comment{ID: c.ID, TodoID: td.ID, Body: "just @alice"}
+	ok(t, cs.UpdateComment(edit, bob.ID))
+	assert(t, edit.Edited && edit.EditedTime != nil, "expected the comment to be marked edited")
+	equals(t, []string{alice.ID}, edit.MentionIDs)
+	_, err = cs.GetComment("other", c.ID, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the comment not to be on another todo, got %v", err)
+
+	// Org admins can delete others' comments, which are kept without their
+	// body
+	_, err = cs.DeleteComment(td.ID, c.ID, carol.ID)
+	assert(t, errors.As(err, &pe), "expected a viewer not to delete others' comments, got %v", err)
+	deleted, err := cs.DeleteComment(td.ID, c.ID, alice.ID)
+	ok(t, err)
+	assert(t, deleted.Deleted && deleted.Body == "", "expected the comment to be deleted, got %+v", deleted)
+	comments, err := cs.GetComments(td.ID, carol.ID)
+	ok(t, err)
+	equals(t, 1, len(comments))
+	assert(t, comments[0].Deleted, "expected the comment to stay deleted")
+	err = cs.UpdateComment(&models.Comment{ID: c.ID, TodoID: td.ID, Body: "back"}, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected a deleted comment not to be edited, got %v", err)
+
+	// Deleting an account deletes its comments, even on others' todos
+	ok(t, cs.CreateComment(&models.Comment{TodoID: td.ID, UserID: alice.ID, Body: "still here"}))
+	acs := &datastore.AccountStore{BDB: db}
+	_, err = acs.Purge(bob.ID)
+	ok(t, err)
+	comments, err = cs.GetComments(td.ID, alice.ID)
+	ok(t, err)
+	equals(t, 1, len(comments))
+	equals(t, "still here", comments[0].Body)
+}
@@ -0,0 +1,271 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func (ors *OrgStore) CreateGroup(g *models.Group) error {
+	if g.ID == "" {
+		return aderrors.ErrNoID
+	}
+	err := ors.Update(func(tx *bolt.Tx) error {
+		if _, err := getOrg(tx, g.OrgID); err != nil {
+			return err
+		}
+		if _, err := getGroup(tx, g.OrgID, g.ID); err == nil {
+			return aderrors.ErrAlreadyExists
+		}
+		if err := checkGroupNameFree(tx, g); err != nil {
+			return err
+		}
+		g.DateCreated = timeNow()
+		g.DateModified = g.DateCreated
+		if err := putGroup(tx, g); err != nil {
+			return err
+		}
+		if g.Role == "" {
+			return nil
+		}
+		return applyGroupRoles(tx, g.OrgID, g.MemberIDs)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating group %s in org %s: %w", g.DisplayName, g.OrgID, err)
+	}
+	return nil
+}
+
+func (ors *OrgStore) GetGroup(orgID, id string) (*models.Group, error) {
+	var g *models.Group
+	err := ors.View(func(tx *bolt.Tx) error {
+		var err error
+		g, err = getGroup(tx, orgID, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// GetGroups returns the org's groups, sorted by name.
+func (ors *OrgStore) GetGroups(orgID string) ([]*models.Group, error) {
+	var groups []*models.Group
+	err := ors.View(func(tx *bolt.Tx) error {
+		var err error
+		groups, err = getGroups(tx, orgID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving groups of org %s: %w", orgID, err)
+	}
+	return groups, nil
+}
+
+// UpdateGroup updates the roles of everyone who was in the group or now is,
+// if the group gives or gave a role.
+func (ors *OrgStore) UpdateGroup(g *models.Group) error {
+	err := ors.Update(func(tx *bolt.Tx) error {
+		old, err := getGroup(tx, g.OrgID, g.ID)
+		if err != nil {
+			return err
+		}
+		if err := checkGroupNameFree(tx, g); err != nil {
+			return err
+		}
+		g.DateCreated = old.DateCreated
+		g.DateModified = timeNow()
+		if err := putGroup(tx, g); err != nil {
+			return err
+		}
+		if old.Role == "" && g.Role == "" {
+			return nil
+		}
+		return applyGroupRoles(tx, g.OrgID, append(old.MemberIDs, g.MemberIDs...))
+	})
+	if err != nil {
+		return fmt.Errorf("error updating group %s in org %s: %w", g.ID, g.OrgID, err)
+	}
+	return nil
+}
+
+func (ors *OrgStore) DeleteGroup(orgID, id string) error {
+	err := ors.Update(func(tx *bolt.Tx) error {
+		g, err := getGroup(tx, orgID, id)
+		if err != nil {
+			return err
+		}
+		if err := tx.Bucket(GroupBucket).Delete(membershipKey(orgID, id)); err != nil {
+			return err
+		}
+		if g.Role == "" {
+			return nil
+		}
+		return applyGroupRoles(tx, orgID, g.MemberIDs)
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting group %s from org %s: %w", id, orgID, err)
+	}
+	return nil
+}
+
+func getGroup(tx *bolt.Tx, orgID, id string) (*models.Group, error) {
+	b := tx.Bucket(GroupBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(GroupBucket))
+	}
+	gJSON := b.Get(membershipKey(orgID, id))
+	if gJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var g models.Group
+	if err := json.Unmarshal(gJSON, &g); err != nil {
+		return nil, err
+	}
+	return &g, nil
+}
+
+func getGroups(tx *bolt.Tx, orgID string) ([]*models.Group, error) {
+	b := tx.Bucket(GroupBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(GroupBucket))
+	}
+	groups := []*models.Group{}
+	err := forEachPrefix(b, orgID, func(k, v []byte) error {
+		var g models.Group
+		if err := json.Unmarshal(v, &g); err != nil {
+			return err
+		}
+		groups = append(groups, &g)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return strings.ToLower(groups[i].DisplayName) < strings.ToLower(groups[j].DisplayName)
+	})
+	return groups, nil
+}
+
+func putGroup(tx *bolt.Tx, g *models.Group) error {
+	b := tx.Bucket(GroupBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(GroupBucket))
+	}
+	gJSON, err := json.Marshal(g)
+	if err != nil {
+		return err
+	}
+	return b.Put(membershipKey(g.OrgID, g.ID), gJSON)
+}
+
+// checkGroupNameFree returns aderrors.ErrAlreadyExists if another group in
+// the org has the same name, ignoring case.
+func checkGroupNameFree(tx *bolt.Tx, g *models.Group) error {
+	groups, err := getGroups(tx, g.OrgID)
+	if err != nil {
+		return err
+	}
+	for _, other := range groups {
+		if other.ID != g.ID && strings.EqualFold(other.DisplayName, g.DisplayName) {
+			return aderrors.ErrAlreadyExists
+		}
+	}
+	return nil
+}
+
+// applyGroupRoles gives each of the users the highest role of their
+// groups, or plain membership if none of their groups give a role. Owners
+// are left alone, as are users who aren't members of the org.
+func applyGroupRoles(tx *bolt.Tx, orgID string, userIDs []string) error {
+	groups, err := getGroups(tx, orgID)
+	if err != nil {
+		return err
+	}
+	done := map[string]bool{}
+	for _, userID := range userIDs {
+		if done[userID] {
+			continue
+		}
+		done[userID] = true
+		m, err := getMembership(tx, orgID, userID)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if m.Role == models.OrgRoleOwner {
+			continue
+		}
+		role := models.GroupRole(groups, userID)
+		if role == "" {
+			role = models.OrgRoleMember
+		}
+		if role == models.OrgRoleOwner {
+			// Groups can't make owners, as owners can't be removed by them
+			role = models.OrgRoleAdmin
+		}
+		if m.Role != role {
+			m.Role = role
+			if err := putMembership(tx, m); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeFromGroups takes the user out of every group in the org, for when
+// they stop being a member.
+func removeFromGroups(tx *bolt.Tx, orgID, userID string) error {
+	groups, err := getGroups(tx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, g := range groups {
+		if !g.HasMember(userID) {
+			continue
+		}
+		ids := []string{}
+		for _, id := range g.MemberIDs {
+			if id != userID {
+				ids = append(ids, id)
+			}
+		}
+		g.MemberIDs = ids
+		if err := putGroup(tx, g); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deleteGroups(tx *bolt.Tx, orgID string) error {
+	b := tx.Bucket(GroupBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(GroupBucket))
+	}
+	var keys [][]byte
+	err := forEachPrefix(b, orgID, func(k, v []byte) error {
+		keys = append(keys, k)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
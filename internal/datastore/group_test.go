@@ -0,0 +1,95 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestGroupRoles(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ors := &datastore.OrgStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	carol := newTestUser(t, us, "carol")
+	acme := newTestOrg(t, ors, "acme", alice)
+	ok(t, ors.AddMember(&models.Membership{OrgID: acme.ID, UserID: bob.ID, Role: models.OrgRoleViewer}))
+	ok(t, ors.AddMember(&models.Membership{OrgID: acme.ID, UserID: carol.ID, Role: models.OrgRoleMember}))
+	err := ors.AddMember(&models.Membership{OrgID: acme.ID, UserID: bob.ID, Role: models.OrgRoleMember})
+	assert(t, errors.Is(err, aderrors.ErrAlreadyExists), "expected adding a member twice to fail, got %v", err)
+
+	admins := &models.Group{OrgID: acme.ID, DisplayName: "Admins", Role: models.OrgRoleAdmin, MemberIDs: []string{alice.ID, bob.ID}}
+	admins.GenerateID()
+	ok(t, ors.CreateGroup(admins))
+	dup := &models.Group{OrgID: acme.ID, DisplayName: "admins"}
+	dup.GenerateID()
+	assert(t, errors.Is(ors.CreateGroup(dup), aderrors.ErrAlreadyExists), "expected group names to be unique")
+
+	roleOf := func(u *models.User) models.OrgRole {
+		m, err := ors.GetMembership(acme.ID, u.ID)
+		ok(t, err)
+		return m.Role
+	}
+	equals(t, models.OrgRoleOwner, roleOf(alice))
+	equals(t, models.OrgRoleAdmin, roleOf(bob))
+
+	admins.MemberIDs = []string{alice.ID, carol.ID}
+	ok(t, ors.UpdateGroup(admins))
+	equals(t, models.OrgRoleMember, roleOf(bob))
+	equals(t, models.OrgRoleAdmin, roleOf(carol))
+
+	ok(t, ors.RemoveMember(acme.ID, carol.ID))
+	g, err := ors.GetGroup(acme.ID, admins.ID)
+	ok(t, err)
+	equals(t, []string{alice.ID}, g.MemberIDs)
+
+	ok(t, ors.DeleteGroup(acme.ID, admins.ID))
+	_, err = ors.GetGroup(acme.ID, admins.ID)
+	equals(t, aderrors.ErrNoRecords, err)
+}
+
+func TestDeactivatedMember(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ors := &datastore.OrgStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	acme := newTestOrg(t, ors, "acme", alice)
+	ok(t, ors.AddMember(&models.Membership{OrgID: acme.ID, UserID: bob.ID, Role: models.OrgRoleMember}))
+
+	m, err := ors.GetMembership(acme.ID, alice.ID)
+	ok(t, err)
+	m.DeactivatedTime = time.Now()
+	assert(t, errors.Is(ors.UpdateMember(m), aderrors.ErrLastOwner), "the last owner shouldn't be deactivated")
+
+	m, err = ors.GetMembership(acme.ID, bob.ID)
+	ok(t, err)
+	m.DeactivatedTime = time.Now()
+	ok(t, ors.UpdateMember(m))
+	assert(t, !m.Can(models.PermTodosRead), "a deactivated member shouldn't be able to do anything")
+	orgs, err := ors.GetOrgsByUserID(bob.ID)
+	ok(t, err)
+	equals(t, 0, len(orgs))
+	_, err = ts.GetByOrgID(acme.ID, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected a deactivated member to be refused as a non-member, got %v", err)
+
+	token, err := ors.CreateSCIMToken(acme.ID)
+	ok(t, err)
+	got, err := ors.GetOrgBySCIMToken(token)
+	ok(t, err)
+	equals(t, acme.ID, got.ID)
+	_, err = ors.CreateSCIMToken(acme.ID)
+	ok(t, err)
+	_, err = ors.GetOrgBySCIMToken(token)
+	equals(t, aderrors.ErrNoRecords, err)
+}
@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// IdentityStore keeps the identities users log in with at identity
+// providers, keyed by provider and subject.
+type IdentityStore struct{ *BDB }
+
+func (is *IdentityStore) GetIdentity(provider, subject string) (*models.LinkedIdentity, error) {
+	var li *models.LinkedIdentity
+	err := is.View(func(tx *bolt.Tx) error {
+		var err error
+		li, err = getIdentity(tx, provider, subject)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving identity %s at %s: %w", subject, provider, err)
+	}
+	return li, nil
+}
+
+func (is *IdentityStore) GetIdentitiesByUserID(userID string) ([]*models.LinkedIdentity, error) {
+	lis := []*models.LinkedIdentity{}
+	err := is.View(func(tx *bolt.Tx) error {
+		return forEachOwned(tx, IdentityBucket, userID, func(k, v []byte) error {
+			var li models.LinkedIdentity
+			if err := json.Unmarshal(v, &li); err != nil {
+				return err
+			}
+			lis = append(lis, &li)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving identities of user %s: %w", userID, err)
+	}
+	return lis, nil
+}
+
+func (is *IdentityStore) LinkIdentity(li *models.LinkedIdentity) (bool, error) {
+	err := is.Update(func(tx *bolt.Tx) error {
+		if _, err := getIdentity(tx, li.Provider, li.Subject); err == nil {
+			return aderrors.ErrAlreadyExists
+		} else if err != aderrors.ErrNoRecords {
+			return err
+		}
+		if tx.Bucket(UserBucket).Get([]byte(li.UserID)) == nil {
+			return aderrors.ErrNoRecords
+		}
+		li.DateCreated = timeNow()
+		return putIdentity(tx, li)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error linking identity %s at %s: %w", li.Subject, li.Provider, err)
+	}
+	return true, nil
+}
+
+func (is *IdentityStore) RecordIdentityLogin(provider, subject string) error {
+	err := is.Update(func(tx *bolt.Tx) error {
+		li, err := getIdentity(tx, provider, subject)
+		if err != nil {
+			return err
+		}
+		li.LastLoginTime = timeNow()
+		return putIdentity(tx, li)
+	})
+	if err != nil {
+		return fmt.Errorf("error recording login of identity %s at %s: %w", subject, provider, err)
+	}
+	return nil
+}
+
+func getIdentity(tx *bolt.Tx, provider, subject string) (*models.LinkedIdentity, error) {
+	b := tx.Bucket(IdentityBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(IdentityBucket))
+	}
+	liJSON := b.Get(identityKey(provider, subject))
+	if liJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var li models.LinkedIdentity
+	if err := json.Unmarshal(liJSON, &li); err != nil {
+		return nil, err
+	}
+	return &li, nil
+}
+
+func putIdentity(tx *bolt.Tx, li *models.LinkedIdentity) error {
+	b := tx.Bucket(IdentityBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(IdentityBucket))
+	}
+	liJSON, err := json.Marshal(li)
+	if err != nil {
+		return err
+	}
+	return b.Put(identityKey(li.Provider, li.Subject), liJSON)
+}
+
+// identityKey keys identities by provider and subject. Either can have
+// slashes in it, so they're separated by a NUL.
+func identityKey(provider, subject string) []byte {
+	return []byte(provider + "\x00" + subject)
+}
@@ -0,0 +1,73 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestLinkIdentity(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	is := &datastore.IdentityStore{BDB: db}
+	as := &datastore.AccountStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	_, err := is.GetIdentity("saml", "alice-1")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected no identity, got %v", err)
+
+	_, err = is.LinkIdentity(&models.LinkedIdentity{Provider: "saml", Subject: "alice-1", UserID: alice.ID})
+	ok(t, err)
+	_, err = is.LinkIdentity(&models.LinkedIdentity{Provider: "saml", Subject: "alice-1", UserID: bob.ID})
+	assert(t, errors.Is(err, aderrors.ErrAlreadyExists), "expected the identity to stay linked to alice, got %v", err)
+	_, err = is.LinkIdentity(&models.LinkedIdentity{Provider: "saml", Subject: "nobody", UserID: "missing"})
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected a missing user to be refused, got %v", err)
+
+	ok(t, is.RecordIdentityLogin("saml", "alice-1"))
+	li, err := is.GetIdentity("saml", "alice-1")
+	ok(t, err)
+	equals(t, alice.ID, li.UserID)
+	assert(t, !li.LastLoginTime.IsZero(), "expected the login to be recorded")
+
+	lis, err := is.GetIdentitiesByUserID(alice.ID)
+	ok(t, err)
+	equals(t, 1, len(lis))
+	export, err := as.Export(alice.ID)
+	ok(t, err)
+	equals(t, 1, len(export.Identities))
+
+	_, err = as.Purge(alice.ID)
+	ok(t, err)
+	_, err = is.GetIdentity("saml", "alice-1")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the identity to be purged, got %v", err)
+}
+
+func TestSAMLRequests(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	ss := &datastore.SAMLStore{BDB: db}
+
+	ok(t, ss.SaveSAMLRequest(&models.SAMLRequest{ID: "_req1", Next: "/c", ExpiryTime: time.Now().Add(time.Minute)}))
+	ok(t, ss.SaveSAMLRequest(&models.SAMLRequest{ID: "_old", ExpiryTime: time.Now().Add(-time.Second)}))
+
+	req, err := ss.ConsumeSAMLRequest("_req1")
+	ok(t, err)
+	equals(t, "/c", req.Next)
+	_, err = ss.ConsumeSAMLRequest("_req1")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected a request to be answered only once, got %v", err)
+	_, err = ss.ConsumeSAMLRequest("_old")
+	assert(t, errors.Is(err, aderrors.ErrExpired), "expected an old request to have expired, got %v", err)
+
+	ok(t, ss.UseSAMLAssertion("_a1", time.Now().Add(time.Minute)))
+	err = ss.UseSAMLAssertion("_a1", time.Now().Add(time.Minute))
+	assert(t, errors.Is(err, aderrors.ErrTokenReused), "expected a replayed assertion to be refused, got %v", err)
+	ok(t, ss.UseSAMLAssertion("_a2", time.Now().Add(-time.Hour)))
+	err = ss.UseSAMLAssertion("_a2", time.Now())
+	assert(t, errors.Is(err, aderrors.ErrTokenReused), "expected an expired assertion to be remembered for a while, got %v", err)
+}
@@ -0,0 +1,241 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// ListStore keeps users' todo lists and labels. Todos refer to them by ID,
+// so deleting one also updates the todos that use it.
+type ListStore struct{ *BDB }
+
+func (ls *ListStore) GetListsByUserID(userID string) ([]*models.List, error) {
+	lists := []*models.List{}
+	err := ls.View(func(tx *bolt.Tx) error {
+		return forEachOwned(tx, ListBucket, userID, func(k, v []byte) error {
+			var l models.List
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			lists = append(lists, &l)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving lists of user %s: %w", userID, err)
+	}
+	sort.SliceStable(lists, func(i, j int) bool { return lists[i].Name < lists[j].Name })
+	return lists, nil
+}
+
+func (ls *ListStore) GetList(userID, id string) (*models.List, error) {
+	var l models.List
+	err := ls.View(func(tx *bolt.Tx) error {
+		return getOwnedRecord(tx, ListBucket, userID, id, &l)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving list %s: %w", id, err)
+	}
+	return &l, nil
+}
+
+func (ls *ListStore) CreateList(l *models.List) error {
+	if l.ID == "" {
+		return aderrors.ErrNoID
+	}
+	l.DateCreated = timeNow()
+	err := ls.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(ListBucket); b != nil && b.Get([]byte(l.ID)) != nil {
+			return aderrors.ErrAlreadyExists
+		}
+		return putRecord(tx, ListBucket, l.ID, l)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating list: %w", err)
+	}
+	return nil
+}
+
+func (ls *ListStore) UpdateList(l *models.List) error {
+	err := ls.Update(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, ListBucket, l.UserID, l.ID, &models.List{}); err != nil {
+			return err
+		}
+		return putRecord(tx, ListBucket, l.ID, l)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating list %s: %w", l.ID, err)
+	}
+	return nil
+}
+
+func (ls *ListStore) DeleteList(userID, id string) error {
+	err := ls.Update(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, ListBucket, userID, id, &models.List{}); err != nil {
+			return err
+		}
+		err := updateOwnedTodos(tx, userID, func(td *models.Todo) bool {
+			if td.ListID != id {
+				return false
+			}
+			td.ListID = ""
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(ListBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting list %s: %w", id, err)
+	}
+	return nil
+}
+
+func (ls *ListStore) GetLabelsByUserID(userID string) ([]*models.Label, error) {
+	labels := []*models.Label{}
+	err := ls.View(func(tx *bolt.Tx) error {
+		return forEachOwned(tx, LabelBucket, userID, func(k, v []byte) error {
+			var l models.Label
+			if err := json.Unmarshal(v, &l); err != nil {
+				return err
+			}
+			labels = append(labels, &l)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving labels of user %s: %w", userID, err)
+	}
+	sort.SliceStable(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+	return labels, nil
+}
+
+func (ls *ListStore) GetLabel(userID, id string) (*models.Label, error) {
+	var l models.Label
+	err := ls.View(func(tx *bolt.Tx) error {
+		return getOwnedRecord(tx, LabelBucket, userID, id, &l)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving label %s: %w", id, err)
+	}
+	return &l, nil
+}
+
+func (ls *ListStore) CreateLabel(l *models.Label) error {
+	if l.ID == "" {
+		return aderrors.ErrNoID
+	}
+	l.DateCreated = timeNow()
+	err := ls.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(LabelBucket); b != nil && b.Get([]byte(l.ID)) != nil {
+			return aderrors.ErrAlreadyExists
+		}
+		return putRecord(tx, LabelBucket, l.ID, l)
+	})
+	if err != nil {
+		return fmt.Errorf("error creating label: %w", err)
+	}
+	return nil
+}
+
+func (ls *ListStore) UpdateLabel(l *models.Label) error {
+	err := ls.Update(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, LabelBucket, l.UserID, l.ID, &models.Label{}); err != nil {
+			return err
+		}
+		return putRecord(tx, LabelBucket, l.ID, l)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating label %s: %w", l.ID, err)
+	}
+	return nil
+}
+
+func (ls *ListStore) DeleteLabel(userID, id string) error {
+	err := ls.Update(func(tx *bolt.Tx) error {
+		if err := getOwnedRecord(tx, LabelBucket, userID, id, &models.Label{}); err != nil {
+			return err
+		}
+		err := updateOwnedTodos(tx, userID, func(td *models.Todo) bool {
+			for i, labelID := range td.LabelIDs {
+				if labelID == id {
+					td.LabelIDs = append(td.LabelIDs[:i], td.LabelIDs[i+1:]...)
+					return true
+				}
+			}
+			return false
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Bucket(LabelBucket).Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting label %s: %w", id, err)
+	}
+	return nil
+}
+
+// updateOwnedTodos calls fn on each of the user's own todos, saving those
+// it changes, which it says by returning true.
+func updateOwnedTodos(tx *bolt.Tx, userID string, fn func(td *models.Todo) bool) error {
+	var changed []*models.Todo
+	err := forEachOwned(tx, TodoBucket, userID, func(k, v []byte) error {
+		var td models.Todo
+		if err := json.Unmarshal(v, &td); err != nil {
+			return err
+		}
+		if fn(&td) {
+			changed = append(changed, &td)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, td := range changed {
+		if err := putRecord(tx, TodoBucket, td.ID, td); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getOwnedRecord reads the record into v, returning aderrors.ErrNoRecords
+// if there's none with the ID that the user owns.
+func getOwnedRecord(tx *bolt.Tx, bucket []byte, userID, id string, v interface{}) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(bucket))
+	}
+	recJSON := b.Get([]byte(id))
+	if recJSON == nil {
+		return aderrors.ErrNoRecords
+	}
+	var rec ownedRecord
+	if err := json.Unmarshal(recJSON, &rec); err != nil {
+		return err
+	}
+	if rec.UserID != userID || rec.OrgID != "" {
+		return aderrors.ErrNoRecords
+	}
+	return json.Unmarshal(recJSON, v)
+}
+
+func putRecord(tx *bolt.Tx, bucket []byte, id string, v interface{}) error {
+	b := tx.Bucket(bucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(bucket))
+	}
+	recJSON, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(id), recJSON)
+}
@@ -0,0 +1,55 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestListsAndLabels(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	ls := &datastore.ListStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	home := &models.List{ID: "home", UserID: alice.ID, Name: "Home"}
+	ok(t, ls.CreateList(home))
+	urgent := &models.Label{ID: "urgent", UserID: alice.ID, Name: "urgent", Color: "#ff0000"}
+	ok(t, ls.CreateLabel(urgent))
+	bobs := &models.Label{ID: "bobs", UserID: bob.ID, Name: "bob's", Color: "#0000ff"}
+	ok(t, ls.CreateLabel(bobs))
+
+	_, err := ts.Create(&models.Todo{ID: "a", UserID: alice.ID, ListID: "home", LabelIDs: []string{"urgent"}})
+	ok(t, err)
+	td, err := ts.Get("a")
+	ok(t, err)
+	equals(t, "Home", td.List.Name)
+	equals(t, 1, len(td.Labels))
+	equals(t, "#ff0000", td.Labels[0].Color)
+
+	// Only the owner's lists and labels can be used
+	_, err = ts.Create(&models.Todo{ID: "b", UserID: alice.ID, LabelIDs: []string{"bobs"}})
+	var ve aderrors.ValidationError
+	assert(t, errors.As(err, &ve), "expected bob's label to be refused, got %v", err)
+	_, err = ls.GetList(bob.ID, "home")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to see alice's list, got %v", err)
+	err = ls.DeleteLabel(bob.ID, "urgent")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to delete alice's label, got %v", err)
+
+	// Deleting them takes the todo out of them
+	ok(t, ls.DeleteList(alice.ID, "home"))
+	ok(t, ls.DeleteLabel(alice.ID, "urgent"))
+	td, err = ts.Get("a")
+	ok(t, err)
+	assert(t, td.List == nil && td.ListID == "", "expected the todo to be out of the list, got %v", td.ListID)
+	equals(t, 0, len(td.LabelIDs))
+	labels, err := ls.GetLabelsByUserID(alice.ID)
+	ok(t, err)
+	equals(t, 0, len(labels))
+}
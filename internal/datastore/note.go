@@ -0,0 +1,165 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// Each todo's note revisions are kept in a bucket of their own in
+// NoteRevisionBucket, named by the todo's ID, and keyed by their number.
+
+func (tdstr *TodoStore) GetNoteRevisions(id, userID string) ([]*models.NoteRevision, error) {
+	revs := []*models.NoteRevision{}
+	err := tdstr.View(func(tx *bolt.Tx) error {
+		b, err := noteRevisionsOf(tx, id, userID, models.PermTodosRead)
+		if err != nil || b == nil {
+			return err
+		}
+		return b.ForEach(func(k, v []byte) error {
+			rev, err := unmarshalNoteRevision(v)
+			if err != nil {
+				return err
+			}
+			revs = append(revs, rev)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving note revisions of todo %s: %w", id, err)
+	}
+	return revs, nil
+}
+
+func (tdstr *TodoStore) GetNoteRevision(id string, rev int, userID string) (*models.NoteRevision, error) {
+	var nr *models.NoteRevision
+	err := tdstr.View(func(tx *bolt.Tx) error {
+		var err error
+		nr, err = getNoteRevision(tx, id, rev, userID, models.PermTodosRead)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving note revision %d of todo %s: %w", rev, id, err)
+	}
+	return nr, nil
+}
+
+func (tdstr *TodoStore) RestoreNotes(id string, rev int, userID string) (*models.Todo, error) {
+	var td *models.Todo
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		nr, err := getNoteRevision(tx, id, rev, userID, models.PermTodosWrite)
+		if err != nil {
+			return err
+		}
+		if td, err = getTodo(tx, id); err != nil {
+			return err
+		}
+		if td.Notes == nr.Notes {
+			return nil
+		}
+		td.Notes = nr.Notes
+		if err := putTodo(tx, td); err != nil {
+			return err
+		}
+		return addNoteRevision(tx, td, userID, rev)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error restoring note revision %d of todo %s: %w", rev, id, err)
+	}
+	return td, nil
+}
+
+// noteRevisionsOf returns the bucket of the todo's note revisions, which
+// is nil if it has none, once it's checked the user may use the todo.
+func noteRevisionsOf(tx *bolt.Tx, id, userID string, perm models.Permission) (*bolt.Bucket, error) {
+	td, err := getTodo(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := authorizeTodo(tx, td, userID, perm); err != nil {
+		return nil, err
+	}
+	b := tx.Bucket(NoteRevisionBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(NoteRevisionBucket))
+	}
+	return b.Bucket([]byte(id)), nil
+}
+
+func getNoteRevision(tx *bolt.Tx, id string, rev int, userID string, perm models.Permission) (*models.NoteRevision, error) {
+	b, err := noteRevisionsOf(tx, id, userID, perm)
+	if err != nil {
+		return nil, err
+	}
+	if b == nil || rev < 1 {
+		return nil, aderrors.ErrNoRecords
+	}
+	v := b.Get(noteRevisionKey(rev))
+	if v == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	return unmarshalNoteRevision(v)
+}
+
+// addNoteRevision saves the todo's notes as its next revision, made by the
+// author, and restored from an older one if restoredFrom isn't 0.
+func addNoteRevision(tx *bolt.Tx, td *models.Todo, authorID string, restoredFrom int) error {
+	b := tx.Bucket(NoteRevisionBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(NoteRevisionBucket))
+	}
+	revs, err := b.CreateBucketIfNotExists([]byte(td.ID))
+	if err != nil {
+		return err
+	}
+	n, err := revs.NextSequence()
+	if err != nil {
+		return err
+	}
+	rev := &models.NoteRevision{
+		Number:       int(n),
+		TodoID:       td.ID,
+		AuthorID:     authorID,
+		Notes:        td.Notes,
+		RestoredFrom: restoredFrom,
+		DateCreated:  timeNow(),
+	}
+	revJSON, err := json.Marshal(rev)
+	if err != nil {
+		return err
+	}
+	return revs.Put(noteRevisionKey(rev.Number), revJSON)
+}
+
+// deleteNoteRevisions deletes the todo's note revisions, if it has any.
+func deleteNoteRevisions(tx *bolt.Tx, todoID string) error {
+	b := tx.Bucket(NoteRevisionBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(NoteRevisionBucket))
+	}
+	if b.Bucket([]byte(todoID)) == nil {
+		return nil
+	}
+	return b.DeleteBucket([]byte(todoID))
+}
+
+func unmarshalNoteRevision(v []byte) (*models.NoteRevision, error) {
+	var rev models.NoteRevision
+	if err := json.Unmarshal(v, &rev); err != nil {
+		return nil, err
+	}
+	rev.ID = fmt.Sprintf("%s-%d", rev.TodoID, rev.Number)
+	return &rev, nil
+}
+
+// noteRevisionKey is the revision's number in big-endian, so revisions are
+// in order in their bucket.
+func noteRevisionKey(rev int) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, uint64(rev))
+	return k
+}
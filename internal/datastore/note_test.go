@@ -0,0 +1,94 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestNoteRevisions(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	as := &datastore.AccountStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	td := &models.Todo{ID: "a", UserID: alice.ID, Name: null.StringFrom("a"), Notes: "# Plan"}
+	_, err := ts.Create(td)
+	ok(t, err)
+	plain := &models.Todo{ID: "b", UserID: alice.ID, Name: null.StringFrom("b")}
+	_, err = ts.Create(plain)
+	ok(t, err)
+
+	update := func(notes string) {
+		td, err := ts.Get("a")
+		ok(t, err)
+		td.Notes = notes
+		_, err = ts.Update(td, alice.ID)
+		ok(t, err)
+	}
+	revisions := func() []string {
+		revs, err := ts.GetNoteRevisions("a", alice.ID)
+		ok(t, err)
+		notes := []string{}
+		for i, rev := range revs {
+			equals(t, i+1, rev.Number)
+			notes = append(notes, rev.Notes)
+		}
+		return notes
+	}
+
+	// Only changes to the notes are saved
+	update("# Plan\n- milk")
+	update("# Plan\n- milk")
+	td, err = ts.Get("a")
+	ok(t, err)
+	td.IsDone = null.BoolFrom(true)
+	_, err = ts.Update(td, alice.ID)
+	ok(t, err)
+	equals(t, []string{"# Plan", "# Plan\n- milk"}, revisions())
+	revs, err := ts.GetNoteRevisions("b", alice.ID)
+	ok(t, err)
+	equals(t, 0, len(revs))
+
+	// Restoring saves the old notes as a new revision
+	td, err = ts.RestoreNotes("a", 1, alice.ID)
+	ok(t, err)
+	equals(t, "# Plan", td.Notes)
+	rev, err := ts.GetNoteRevision("a", 3, alice.ID)
+	ok(t, err)
+	equals(t, "# Plan", rev.Notes)
+	equals(t, 1, rev.RestoredFrom)
+	equals(t, alice.ID, rev.AuthorID)
+	_, err = ts.RestoreNotes("a", 1, alice.ID)
+	ok(t, err)
+	equals(t, 3, len(revisions()))
+
+	_, err = ts.GetNoteRevision("a", 4, alice.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected no revision 4, got %v", err)
+	_, err = ts.GetNoteRevisions("a", bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to see alice's notes, got %v", err)
+	_, err = ts.RestoreNotes("a", 2, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to restore alice's notes, got %v", err)
+
+	export, err := as.Export(alice.ID)
+	ok(t, err)
+	equals(t, 3, len(export.NoteRevisions))
+
+	// Deleting the account deletes the revisions with the todos, so they
+	// aren't left for a todo that reuses the ID
+	_, err = as.Purge(alice.ID)
+	ok(t, err)
+	td = &models.Todo{ID: "a", UserID: bob.ID, Name: null.StringFrom("a")}
+	_, err = ts.Create(td)
+	ok(t, err)
+	revs, err = ts.GetNoteRevisions("a", bob.ID)
+	ok(t, err)
+	equals(t, 0, len(revs))
+}
@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// NotificationStore keeps the notifications shown to users in the app.
+type NotificationStore struct{ *BDB }
+
+func (ns *NotificationStore) CreateNotification(n *models.Notification) (bool, error) {
+	if n.ID == "" {
+		return false, aderrors.ErrNoID
+	}
+	if n.DateCreated.IsZero() {
+		n.DateCreated = timeNow()
+	}
+	err := ns.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(NotificationBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(NotificationBucket))
+		}
+		if b.Get([]byte(n.ID)) != nil {
+			return aderrors.ErrAlreadyExists
+		}
+		return putNotification(tx, n)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error creating notification %s: %w", n.ID, err)
+	}
+	return true, nil
+}
+
+func (ns *NotificationStore) GetNotificationsByUserID(userID string) ([]*models.Notification, error) {
+	notifications := []*models.Notification{}
+	err := ns.View(func(tx *bolt.Tx) error {
+		return forEachOwned(tx, NotificationBucket, userID, func(k, v []byte) error {
+			var n models.Notification
+			if err := json.Unmarshal(v, &n); err != nil {
+				return err
+			}
+			notifications = append(notifications, &n)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving notifications for user %s: %w", userID, err)
+	}
+	sort.SliceStable(notifications, func(i, j int) bool {
+		return notifications[i].DateCreated.After(notifications[j].DateCreated)
+	})
+	return notifications, nil
+}
+
+func (ns *NotificationStore) MarkNotificationRead(userID, id string) (*models.Notification, error) {
+	var n models.Notification
+	err := ns.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(NotificationBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(NotificationBucket))
+		}
+		nJSON := b.Get([]byte(id))
+		if nJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		if err := json.Unmarshal(nJSON, &n); err != nil {
+			return err
+		}
+		if n.UserID != userID {
+			return aderrors.ErrNoRecords
+		}
+		if n.ReadTime != nil {
+			return nil
+		}
+		now := timeNow()
+		n.ReadTime = &now
+		return putNotification(tx, &n)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error marking notification %s read: %w", id, err)
+	}
+	return &n, nil
+}
+
+func putNotification(tx *bolt.Tx, n *models.Notification) error {
+	nJSON, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(NotificationBucket).Put([]byte(n.ID), nJSON)
+}
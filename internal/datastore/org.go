@@ -0,0 +1,788 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// OrgStore keeps orgs, memberships, invitations and groups. Memberships
+// are keyed by org ID then user ID, and indexed the other way round in
+// userOrgBucket, so both an org's members and a user's orgs are a prefix
+// scan away. Groups are keyed by org ID then group ID.
+type OrgStore struct{ *BDB }
+
+func (ors *OrgStore) CreateOrg(org *models.Org, ownerID string) error {
+	if org.ID == "" {
+		return aderrors.ErrNoID
+	}
+	err := ors.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(OrgBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(OrgBucket))
+		}
+		sb := tx.Bucket(orgSlugBucket)
+		if sb == nil {
+			return fmt.Errorf("no %s bucket exists", string(orgSlugBucket))
+		}
+		if b.Get([]byte(org.ID)) != nil || sb.Get([]byte(org.Slug)) != nil {
+			return aderrors.ErrAlreadyExists
+		}
+
+		org.DateCreated = timeNow()
+		oJSON, err := json.Marshal(org)
+		if err != nil {
+			return err
+		}
+		if err := b.Put([]byte(org.ID), oJSON); err != nil {
+			return err
+		}
+		if err := sb.Put([]byte(org.Slug), []byte(org.ID)); err != nil {
+			return err
+		}
+		return putMembership(tx, &models.Membership{
+			OrgID:      org.ID,
+			UserID:     ownerID,
+			Role:       models.OrgRoleOwner,
+			DateJoined: org.DateCreated,
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("error creating org %s: %w", org.Slug, err)
+	}
+	return nil
+}
+
+func (ors *OrgStore) GetOrg(id string) (*models.Org, error) {
+	var org *models.Org
+	err := ors.View(func(tx *bolt.Tx) error {
+		var err error
+		org, err = getOrg(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+func (ors *OrgStore) GetOrgBySlug(slug string) (*models.Org, error) {
+	var org *models.Org
+	err := ors.View(func(tx *bolt.Tx) error {
+		sb := tx.Bucket(orgSlugBucket)
+		if sb == nil {
+			return fmt.Errorf("no %s bucket exists", string(orgSlugBucket))
+		}
+		id := sb.Get([]byte(slug))
+		if id == nil {
+			return aderrors.ErrNoRecords
+		}
+		var err error
+		org, err = getOrg(tx, string(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// GetOrgsByUserID returns the orgs the user is an active member of, sorted
+// by name.
+func (ors *OrgStore) GetOrgsByUserID(userID string) ([]*models.Org, error) {
+	orgs := []*models.Org{}
+	err := ors.View(func(tx *bolt.Tx) error {
+		ub := tx.Bucket(userOrgBucket)
+		if ub == nil {
+			return fmt.Errorf("no %s bucket exists", string(userOrgBucket))
+		}
+		return forEachPrefix(ub, userID, func(k, v []byte) error {
+			orgID := string(k[len(userID)+1:])
+			m, err := getMembership(tx, orgID, userID)
+			if err != nil {
+				return err
+			}
+			if !m.IsActive() {
+				return nil
+			}
+			org, err := getOrg(tx, orgID)
+			if err != nil {
+				return err
+			}
+			orgs = append(orgs, org)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving orgs for user %s: %w", userID, err)
+	}
+	sort.Slice(orgs, func(i, j int) bool { return strings.ToLower(orgs[i].Name) < strings.ToLower(orgs[j].Name) })
+	return orgs, nil
+}
+
+func (ors *OrgStore) GetMembership(orgID, userID string) (*models.Membership, error) {
+	var m *models.Membership
+	err := ors.View(func(tx *bolt.Tx) error {
+		var err error
+		m, err = getMembership(tx, orgID, userID)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// GetMembers returns the org's members, in the order they joined.
+func (ors *OrgStore) GetMembers(orgID string) ([]*models.Membership, error) {
+	var members []*models.Membership
+	err := ors.View(func(tx *bolt.Tx) error {
+		var err error
+		members, err = getMembers(tx, orgID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving members of org %s: %w", orgID, err)
+	}
+	return members, nil
+}
+
+func (ors *OrgStore) SetMemberRole(orgID, userID string, role models.OrgRole) (*models.Membership, error) {
+	var m *models.Membership
+	err := ors.Update(func(tx *bolt.Tx) error {
+		var err error
+		m, err = getMembership(tx, orgID, userID)
+		if err != nil {
+			return err
+		}
+		if m.Role == models.OrgRoleOwner && m.IsActive() && role != models.OrgRoleOwner {
+			if err := checkNotLastOwner(tx, orgID); err != nil {
+				return err
+			}
+		}
+		m.Role = role
+		return putMembership(tx, m)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error setting role of user %s in org %s: %w", userID, orgID, err)
+	}
+	return m, nil
+}
+
+func (ors *OrgStore) RemoveMember(orgID, userID string) error {
+	err := ors.Update(func(tx *bolt.Tx) error {
+		m, err := getMembership(tx, orgID, userID)
+		if err != nil {
+			return err
+		}
+		if m.Role == models.OrgRoleOwner && m.IsActive() {
+			if err := checkNotLastOwner(tx, orgID); err != nil {
+				return err
+			}
+		}
+		return deleteMembership(tx, orgID, userID)
+	})
+	if err != nil {
+		return fmt.Errorf("error removing user %s from org %s: %w", userID, orgID, err)
+	}
+	return nil
+}
+
+func (ors *OrgStore) AddMember(m *models.Membership) error {
+	err := ors.Update(func(tx *bolt.Tx) error {
+		if _, err := getOrg(tx, m.OrgID); err != nil {
+			return err
+		}
+		_, err := getMembership(tx, m.OrgID, m.UserID)
+		if err == nil {
+			return aderrors.ErrAlreadyExists
+		}
+		if !errors.Is(err, aderrors.ErrNoRecords) {
+			return err
+		}
+		if m.DateJoined.IsZero() {
+			m.DateJoined = timeNow()
+		}
+		return putMembership(tx, m)
+	})
+	if err != nil {
+		return fmt.Errorf("error adding user %s to org %s: %w", m.UserID, m.OrgID, err)
+	}
+	return nil
+}
+
+func (ors *OrgStore) UpdateMember(m *models.Membership) error {
+	err := ors.Update(func(tx *bolt.Tx) error {
+		old, err := getMembership(tx, m.OrgID, m.UserID)
+		if err != nil {
+			return err
+		}
+		if old.Role == models.OrgRoleOwner && old.IsActive() && (m.Role != models.OrgRoleOwner || !m.IsActive()) {
+			if err := checkNotLastOwner(tx, m.OrgID); err != nil {
+				return err
+			}
+		}
+		return putMembership(tx, m)
+	})
+	if err != nil {
+		return fmt.Errorf("error updating user %s in org %s: %w", m.UserID, m.OrgID, err)
+	}
+	return nil
+}
+
+// CreateSCIMToken replaces any token the org already has, so the old one
+// stops working at once.
+func (ors *OrgStore) CreateSCIMToken(orgID string) (string, error) {
+	token, err := models.NewSCIMToken()
+	if err != nil {
+		return "", err
+	}
+	err = ors.Update(func(tx *bolt.Tx) error {
+		org, err := getOrg(tx, orgID)
+		if err != nil {
+			return err
+		}
+		tb := tx.Bucket(scimTokenBucket)
+		if tb == nil {
+			return fmt.Errorf("no %s bucket exists", string(scimTokenBucket))
+		}
+		if org.SCIMTokenHash != "" {
+			if err := tb.Delete([]byte(org.SCIMTokenHash)); err != nil {
+				return err
+			}
+		}
+		org.SCIMTokenHash = models.HashSCIMToken(token)
+		if err := tb.Put([]byte(org.SCIMTokenHash), []byte(org.ID)); err != nil {
+			return err
+		}
+		return putOrg(tx, org)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating SCIM token for org %s: %w", orgID, err)
+	}
+	return token, nil
+}
+
+func (ors *OrgStore) RevokeSCIMToken(orgID string) error {
+	err := ors.Update(func(tx *bolt.Tx) error {
+		org, err := getOrg(tx, orgID)
+		if err != nil {
+			return err
+		}
+		if org.SCIMTokenHash == "" {
+			return aderrors.ErrNoRecords
+		}
+		if err := tx.Bucket(scimTokenBucket).Delete([]byte(org.SCIMTokenHash)); err != nil {
+			return err
+		}
+		org.SCIMTokenHash = ""
+		return putOrg(tx, org)
+	})
+	if err != nil {
+		return fmt.Errorf("error revoking SCIM token for org %s: %w", orgID, err)
+	}
+	return nil
+}
+
+func (ors *OrgStore) GetOrgBySCIMToken(token string) (*models.Org, error) {
+	var org *models.Org
+	err := ors.View(func(tx *bolt.Tx) error {
+		tb := tx.Bucket(scimTokenBucket)
+		if tb == nil {
+			return fmt.Errorf("no %s bucket exists", string(scimTokenBucket))
+		}
+		id := tb.Get([]byte(models.HashSCIMToken(token)))
+		if id == nil {
+			return aderrors.ErrNoRecords
+		}
+		var err error
+		org, err = getOrg(tx, string(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return org, nil
+}
+
+// CreateInvitation refuses to invite an email that already has a pending
+// invitation to the org.
+func (ors *OrgStore) CreateInvitation(inv *models.Invitation) (string, error) {
+	token, stored, err := models.NewInvitation(inv.OrgID, inv.Email, inv.Role, inv.InviterID, timeNow())
+	if err != nil {
+		return "", err
+	}
+	err = ors.Update(func(tx *bolt.Tx) error {
+		if _, err := getOrg(tx, inv.OrgID); err != nil {
+			return err
+		}
+		invs, err := getInvitations(tx, inv.OrgID)
+		if err != nil {
+			return err
+		}
+		for _, other := range invs {
+			if other.Email == stored.Email && other.IsPending(stored.DateCreated) {
+				return aderrors.ErrAlreadyExists
+			}
+		}
+		return putInvitation(tx, stored)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating invitation to org %s: %w", inv.OrgID, err)
+	}
+	*inv = *stored
+	return token, nil
+}
+
+// GetInvitations returns the org's invitations, newest first.
+func (ors *OrgStore) GetInvitations(orgID string) ([]*models.Invitation, error) {
+	var invs []*models.Invitation
+	err := ors.View(func(tx *bolt.Tx) error {
+		var err error
+		invs, err = getInvitations(tx, orgID)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving invitations to org %s: %w", orgID, err)
+	}
+	return invs, nil
+}
+
+func (ors *OrgStore) GetInvitationByToken(token string) (*models.Invitation, error) {
+	var inv *models.Invitation
+	err := ors.View(func(tx *bolt.Tx) error {
+		var err error
+		inv, err = getInvitationByToken(tx, token)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+// AcceptInvitation only works for the user the invitation was sent to.
+// Accepting an invitation to an org the user is already in keeps their
+// current role.
+func (ors *OrgStore) AcceptInvitation(token string, u *models.User) (*models.Membership, error) {
+	var m *models.Membership
+	err := ors.Update(func(tx *bolt.Tx) error {
+		inv, err := getInvitationByToken(tx, token)
+		if err != nil {
+			return err
+		}
+		now := timeNow()
+		if !inv.IsPending(now) {
+			return aderrors.ErrExpired
+		}
+		if !strings.EqualFold(inv.Email, u.Email) {
+			return aderrors.ErrWrongRecipient
+		}
+		inv.AcceptedTime = now
+		inv.AcceptedBy = u.ID
+		if err := putInvitation(tx, inv); err != nil {
+			return err
+		}
+
+		m, err = getMembership(tx, inv.OrgID, u.ID)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, aderrors.ErrNoRecords) {
+			return err
+		}
+		m = &models.Membership{OrgID: inv.OrgID, UserID: u.ID, Role: inv.Role, DateJoined: now}
+		return putMembership(tx, m)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error accepting invitation: %w", err)
+	}
+	return m, nil
+}
+
+func (ors *OrgStore) RevokeInvitation(orgID, id string) error {
+	err := ors.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(InvitationBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(InvitationBucket))
+		}
+		tb := tx.Bucket(invitationTokenBucket)
+		if tb == nil {
+			return fmt.Errorf("no %s bucket exists", string(invitationTokenBucket))
+		}
+		iJSON := b.Get([]byte(id))
+		if iJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		var inv models.Invitation
+		if err := json.Unmarshal(iJSON, &inv); err != nil {
+			return err
+		}
+		if inv.OrgID != orgID {
+			return aderrors.ErrNoRecords
+		}
+		if err := tb.Delete([]byte(inv.TokenHash)); err != nil {
+			return err
+		}
+		return b.Delete([]byte(id))
+	})
+	if err != nil {
+		return fmt.Errorf("error revoking invitation %s: %w", id, err)
+	}
+	return nil
+}
+
+func getOrg(tx *bolt.Tx, id string) (*models.Org, error) {
+	b := tx.Bucket(OrgBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(OrgBucket))
+	}
+	oJSON := b.Get([]byte(id))
+	if oJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var org models.Org
+	if err := json.Unmarshal(oJSON, &org); err != nil {
+		return nil, err
+	}
+	return &org, nil
+}
+
+func putOrg(tx *bolt.Tx, org *models.Org) error {
+	b := tx.Bucket(OrgBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(OrgBucket))
+	}
+	oJSON, err := json.Marshal(org)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(org.ID), oJSON)
+}
+
+func membershipKey(a, b string) []byte {
+	return []byte(a + "/" + b)
+}
+
+func getMembership(tx *bolt.Tx, orgID, userID string) (*models.Membership, error) {
+	b := tx.Bucket(membershipBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(membershipBucket))
+	}
+	mJSON := b.Get(membershipKey(orgID, userID))
+	if mJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var m models.Membership
+	if err := json.Unmarshal(mJSON, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+func getMembers(tx *bolt.Tx, orgID string) ([]*models.Membership, error) {
+	b := tx.Bucket(membershipBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(membershipBucket))
+	}
+	members := []*models.Membership{}
+	err := forEachPrefix(b, orgID, func(k, v []byte) error {
+		var m models.Membership
+		if err := json.Unmarshal(v, &m); err != nil {
+			return err
+		}
+		members = append(members, &m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(members, func(i, j int) bool { return members[i].DateJoined.Before(members[j].DateJoined) })
+	return members, nil
+}
+
+func putMembership(tx *bolt.Tx, m *models.Membership) error {
+	b := tx.Bucket(membershipBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(membershipBucket))
+	}
+	ub := tx.Bucket(userOrgBucket)
+	if ub == nil {
+		return fmt.Errorf("no %s bucket exists", string(userOrgBucket))
+	}
+	mJSON, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(membershipKey(m.OrgID, m.UserID), mJSON); err != nil {
+		return err
+	}
+	return ub.Put(membershipKey(m.UserID, m.OrgID), []byte{})
+}
+
+func deleteMembership(tx *bolt.Tx, orgID, userID string) error {
+	b := tx.Bucket(membershipBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(membershipBucket))
+	}
+	ub := tx.Bucket(userOrgBucket)
+	if ub == nil {
+		return fmt.Errorf("no %s bucket exists", string(userOrgBucket))
+	}
+	if err := b.Delete(membershipKey(orgID, userID)); err != nil {
+		return err
+	}
+	if err := ub.Delete(membershipKey(userID, orgID)); err != nil {
+		return err
+	}
+	return removeFromGroups(tx, orgID, userID)
+}
+
+// checkNotLastOwner returns aderrors.ErrLastOwner if the org has only one
+// active owner, who is about to stop being one.
+func checkNotLastOwner(tx *bolt.Tx, orgID string) error {
+	members, err := getMembers(tx, orgID)
+	if err != nil {
+		return err
+	}
+	owners := 0
+	for _, m := range members {
+		if m.Role == models.OrgRoleOwner && m.IsActive() {
+			owners++
+		}
+	}
+	if owners <= 1 {
+		return aderrors.ErrLastOwner
+	}
+	return nil
+}
+
+// authorizeOrg checks that the user's role in the org grants the
+// permission. Non-members and deactivated members get
+// aderrors.ErrNoRecords, so they can't tell whether the org exists.
+func authorizeOrg(tx *bolt.Tx, orgID, userID string, perm models.Permission) error {
+	m, err := getMembership(tx, orgID, userID)
+	if err != nil {
+		return err
+	}
+	if !m.IsActive() {
+		return aderrors.ErrNoRecords
+	}
+	if !m.Can(perm) {
+		return aderrors.PermissionError{Permission: string(perm)}
+	}
+	return nil
+}
+
+func putInvitation(tx *bolt.Tx, inv *models.Invitation) error {
+	b := tx.Bucket(InvitationBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(InvitationBucket))
+	}
+	tb := tx.Bucket(invitationTokenBucket)
+	if tb == nil {
+		return fmt.Errorf("no %s bucket exists", string(invitationTokenBucket))
+	}
+	iJSON, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(inv.ID), iJSON); err != nil {
+		return err
+	}
+	return tb.Put([]byte(inv.TokenHash), []byte(inv.ID))
+}
+
+func getInvitations(tx *bolt.Tx, orgID string) ([]*models.Invitation, error) {
+	b := tx.Bucket(InvitationBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(InvitationBucket))
+	}
+	invs := []*models.Invitation{}
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		var inv models.Invitation
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return nil, err
+		}
+		if inv.OrgID == orgID {
+			invs = append(invs, &inv)
+		}
+	}
+	return invs, nil
+}
+
+func getInvitationByToken(tx *bolt.Tx, token string) (*models.Invitation, error) {
+	b := tx.Bucket(InvitationBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(InvitationBucket))
+	}
+	tb := tx.Bucket(invitationTokenBucket)
+	if tb == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(invitationTokenBucket))
+	}
+	id := tb.Get([]byte(models.HashInvitationToken(token)))
+	if id == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	iJSON := b.Get(id)
+	if iJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var inv models.Invitation
+	if err := json.Unmarshal(iJSON, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+// leaveOrgs takes the user out of every org they're in, for when their
+// account is purged. An org left without members is deleted along with its
+// todos and invitations. One left without an owner passes ownership to the
+// longest standing admin, or failing that the longest standing member.
+func leaveOrgs(tx *bolt.Tx, userID string) error {
+	ub := tx.Bucket(userOrgBucket)
+	if ub == nil {
+		return fmt.Errorf("no %s bucket exists", string(userOrgBucket))
+	}
+	var orgIDs []string
+	err := forEachPrefix(ub, userID, func(k, v []byte) error {
+		orgIDs = append(orgIDs, string(k[len(userID)+1:]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, orgID := range orgIDs {
+		if err := deleteMembership(tx, orgID, userID); err != nil {
+			return err
+		}
+		members, err := getMembers(tx, orgID)
+		if err != nil {
+			return err
+		}
+		if len(members) == 0 {
+			if err := deleteOrg(tx, orgID); err != nil {
+				return err
+			}
+			continue
+		}
+		if heir := orgHeir(members); heir != nil {
+			heir.Role = models.OrgRoleOwner
+			if err := putMembership(tx, heir); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// orgHeir picks who should become owner of an org whose members are given
+// in the order they joined. It returns nil if the org still has an active
+// owner, or has no active members to pick from.
+func orgHeir(members []*models.Membership) *models.Membership {
+	byRole := map[models.OrgRole]*models.Membership{}
+	for _, m := range members {
+		if !m.IsActive() {
+			continue
+		}
+		if _, ok := byRole[m.Role]; !ok {
+			byRole[m.Role] = m
+		}
+	}
+	if byRole[models.OrgRoleOwner] != nil {
+		return nil
+	}
+	for _, role := range []models.OrgRole{models.OrgRoleAdmin, models.OrgRoleMember, models.OrgRoleViewer} {
+		if m := byRole[role]; m != nil {
+			return m
+		}
+	}
+	return nil
+}
+
+// deleteOrg deletes an org that has no members left, with its todos,
+// invitations, groups and SCIM token.
+func deleteOrg(tx *bolt.Tx, orgID string) error {
+	org, err := getOrg(tx, orgID)
+	if err != nil {
+		return err
+	}
+	sb := tx.Bucket(orgSlugBucket)
+	if sb == nil {
+		return fmt.Errorf("no %s bucket exists", string(orgSlugBucket))
+	}
+	if err := sb.Delete([]byte(org.Slug)); err != nil {
+		return err
+	}
+	if org.SCIMTokenHash != "" {
+		if err := tx.Bucket(scimTokenBucket).Delete([]byte(org.SCIMTokenHash)); err != nil {
+			return err
+		}
+	}
+	if err := deleteGroups(tx, orgID); err != nil {
+		return err
+	}
+
+	tb := tx.Bucket(TodoBucket)
+	if tb == nil {
+		return fmt.Errorf("no %s bucket exists", string(TodoBucket))
+	}
+	var todoIDs [][]byte
+	err = tb.ForEach(func(k, v []byte) error {
+		var rec ownedRecord
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		if rec.OrgID == orgID {
+			todoIDs = append(todoIDs, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range todoIDs {
+		if err := tb.Delete(k); err != nil {
+			return err
+		}
+		if err := deleteTodoContent(tx, string(k)); err != nil {
+			return err
+		}
+	}
+
+	invs, err := getInvitations(tx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, inv := range invs {
+		if err := tx.Bucket(invitationTokenBucket).Delete([]byte(inv.TokenHash)); err != nil {
+			return err
+		}
+		if err := tx.Bucket(InvitationBucket).Delete([]byte(inv.ID)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(OrgBucket).Delete([]byte(orgID))
+}
+
+// forEachPrefix calls fn for every key in the bucket that starts with
+// prefix followed by a slash.
+func forEachPrefix(b *bolt.Bucket, prefix string, fn func(k, v []byte) error) error {
+	p := []byte(prefix + "/")
+	c := b.Cursor()
+	for k, v := c.Seek(p); k != nil && bytes.HasPrefix(k, p); k, v = c.Next() {
+		if err := fn(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func newTestOrg(t *testing.T, ors *datastore.OrgStore, slug string, owner *models.User) *models.Org {
+	org := &models.Org{Slug: slug, Name: slug}
+	org.GenerateID()
+	ok(t, ors.CreateOrg(org, owner.ID))
+	return org
+}
+
+func TestOrgMembership(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ors := &datastore.OrgStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	acme := newTestOrg(t, ors, "acme", alice)
+	newTestOrg(t, ors, "beta", bob)
+
+	dup := &models.Org{Slug: "acme", Name: "Acme again"}
+	dup.GenerateID()
+	assert(t, errors.Is(ors.CreateOrg(dup, bob.ID), aderrors.ErrAlreadyExists), "expected the slug to be taken")
+
+	got, err := ors.GetOrgBySlug("acme")
+	ok(t, err)
+	equals(t, acme.ID, got.ID)
+
+	m, err := ors.GetMembership(acme.ID, alice.ID)
+	ok(t, err)
+	equals(t, models.OrgRoleOwner, m.Role)
+	_, err = ors.GetMembership(acme.ID, bob.ID)
+	equals(t, aderrors.ErrNoRecords, err)
+
+	_, err = ors.SetMemberRole(acme.ID, alice.ID, models.OrgRoleAdmin)
+	assert(t, errors.Is(err, aderrors.ErrLastOwner), "expected ErrLastOwner, got %v", err)
+	assert(t, errors.Is(ors.RemoveMember(acme.ID, alice.ID), aderrors.ErrLastOwner), "the last owner shouldn't be able to leave")
+
+	token, err := ors.CreateInvitation(&models.Invitation{OrgID: acme.ID, Email: "BOB@example.com", Role: models.OrgRoleMember, InviterID: alice.ID})
+	ok(t, err)
+	_, err = ors.CreateInvitation(&models.Invitation{OrgID: acme.ID, Email: "bob@example.com", Role: models.OrgRoleAdmin, InviterID: alice.ID})
+	assert(t, errors.Is(err, aderrors.ErrAlreadyExists), "expected a second pending invitation to be refused, got %v", err)
+
+	_, err = ors.AcceptInvitation(token, alice)
+	assert(t, errors.Is(err, aderrors.ErrWrongRecipient), "expected ErrWrongRecipient, got %v", err)
+	m, err = ors.AcceptInvitation(token, bob)
+	ok(t, err)
+	equals(t, models.OrgRoleMember, m.Role)
+	_, err = ors.AcceptInvitation(token, bob)
+	assert(t, errors.Is(err, aderrors.ErrExpired), "expected an accepted invitation to be spent, got %v", err)
+
+	orgs, err := ors.GetOrgsByUserID(bob.ID)
+	ok(t, err)
+	equals(t, 2, len(orgs))
+	equals(t, "acme", orgs[0].Slug)
+
+	_, err = ors.SetMemberRole(acme.ID, bob.ID, models.OrgRoleOwner)
+	ok(t, err)
+	_, err = ors.SetMemberRole(acme.ID, alice.ID, models.OrgRoleViewer)
+	ok(t, err)
+	members, err := ors.GetMembers(acme.ID)
+	ok(t, err)
+	equals(t, 2, len(members))
+	equals(t, alice.ID, members[0].UserID)
+
+	ok(t, ors.RemoveMember(acme.ID, alice.ID))
+	orgs, err = ors.GetOrgsByUserID(alice.ID)
+	ok(t, err)
+	equals(t, 0, len(orgs))
+}
+
+func TestOrgTodoAuthorization(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ors := &datastore.OrgStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	carol := newTestUser(t, us, "carol")
+	acme := newTestOrg(t, ors, "acme", alice)
+	token, err := ors.CreateInvitation(&models.Invitation{OrgID: acme.ID, Email: bob.Email, Role: models.OrgRoleViewer, InviterID: alice.ID})
+	ok(t, err)
+	_, err = ors.AcceptInvitation(token, bob)
+	ok(t, err)
+
+	newTodo := func(u *models.User, orgID string) *models.Todo {
+		td := &models.Todo{UserID: u.ID, OrgID: orgID}
+		td.GenerateID()
+		return td
+	}
+	_, err = ts.Create(newTodo(alice, acme.ID))
+	ok(t, err)
+	_, err = ts.Create(newTodo(alice, ""))
+	ok(t, err)
+
+	var pe aderrors.PermissionError
+	_, err = ts.Create(newTodo(bob, acme.ID))
+	assert(t, errors.As(err, &pe), "expected a viewer to be refused, got %v", err)
+	equals(t, string(models.PermTodosWrite), pe.Permission)
+	_, err = ts.Create(newTodo(carol, acme.ID))
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected a non-member to be refused, got %v", err)
+
+	todos, err := ts.GetByOrgID(acme.ID, bob.ID)
+	ok(t, err)
+	equals(t, 1, len(todos))
+	_, err = ts.GetByOrgID(acme.ID, carol.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected a non-member to be refused, got %v", err)
+
+	todos, err = ts.GetByUserID(alice.ID)
+	ok(t, err)
+	equals(t, 1, len(todos))
+	equals(t, "", todos[0].OrgID)
+}
+
+func TestPurgeLeavesOrgs(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ors := &datastore.OrgStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	as := &datastore.AccountStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	carol := newTestUser(t, us, "carol")
+	shared := newTestOrg(t, ors, "shared", alice)
+	solo := newTestOrg(t, ors, "solo", alice)
+	for _, invitee := range []struct {
+		u    *models.User
+		role models.OrgRole
+	}{{bob, models.OrgRoleMember}, {carol, models.OrgRoleAdmin}} {
+		token, err := ors.CreateInvitation(&models.Invitation{OrgID: shared.ID, Email: invitee.u.Email, Role: invitee.role, InviterID: alice.ID})
+		ok(t, err)
+		_, err = ors.AcceptInvitation(token, invitee.u)
+		ok(t, err)
+	}
+	for _, orgID := range []string{shared.ID, solo.ID} {
+		td := &models.Todo{UserID: alice.ID, OrgID: orgID}
+		td.GenerateID()
+		_, err := ts.Create(td)
+		ok(t, err)
+	}
+
+	_, err := as.Purge(alice.ID)
+	ok(t, err)
+
+	// Carol is the only admin, so she inherits the org, todos and all
+	m, err := ors.GetMembership(shared.ID, carol.ID)
+	ok(t, err)
+	equals(t, models.OrgRoleOwner, m.Role)
+	todos, err := ts.GetByOrgID(shared.ID, carol.ID)
+	ok(t, err)
+	equals(t, 1, len(todos))
+
+	_, err = ors.GetOrg(solo.ID)
+	equals(t, aderrors.ErrNoRecords, err)
+	_, err = ors.GetOrgBySlug("solo")
+	equals(t, aderrors.ErrNoRecords, err)
+}
@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// rotationGracePeriod allows a rotated token to be presented again shortly
+// after rotation. Browsers often fire several requests at once with the same
+// cookie, and we don't want to mistake that for token theft.
+const rotationGracePeriod = 30 * time.Second
+
+type RememberTokenStore struct{ *BDB }
+
+// CreateRememberToken issues a new remember token for the user. Passing an
+// empty familyID starts a new family.
+func (rs *RememberTokenStore) CreateRememberToken(userID, familyID string) (string, *models.RememberToken, error) {
+	token, rt, err := models.GenerateRememberToken(userID, familyID, timeNow())
+	if err != nil {
+		return "", nil, err
+	}
+	err = rs.Update(func(tx *bolt.Tx) error {
+		return putRememberToken(tx, rt)
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("error saving remember token: %w", err)
+	}
+	return token, rt, nil
+}
+
+// ConsumeRememberToken validates a token presented by the client and rotates
+// it, returning the replacement token. If the token looks stolen, the whole
+// family is revoked and aderrors.ErrTokenReused is returned along with the
+// offending token, so the caller can clean up after it.
+func (rs *RememberTokenStore) ConsumeRememberToken(token string) (string, *models.RememberToken, error) {
+	selector, validator, ok := models.SplitRememberToken(token)
+	if !ok {
+		return "", nil, aderrors.ErrNoRecords
+	}
+
+	var newToken string
+	var old, rt *models.RememberToken
+	var reused bool
+	err := rs.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RememberTokenBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(RememberTokenBucket))
+		}
+		rtJSON := b.Get([]byte(selector))
+		if rtJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		old = &models.RememberToken{}
+		if err := json.Unmarshal(rtJSON, old); err != nil {
+			return err
+		}
+
+		now := timeNow()
+		if now.After(old.ExpiryTime) {
+			return aderrors.ErrExpired
+		}
+		if !old.CheckValidator(validator) ||
+			(old.IsRotated() && now.Sub(old.RotatedTime) > rotationGracePeriod) {
+			reused = true
+			return deleteRememberTokenFamily(tx, old.FamilyID)
+		}
+
+		var err error
+		newToken, rt, err = models.GenerateRememberToken(old.UserID, old.FamilyID, now)
+		if err != nil {
+			return err
+		}
+		if !old.IsRotated() {
+			old.RotatedTime = now
+			if err := putRememberToken(tx, old); err != nil {
+				return err
+			}
+		}
+		return putRememberToken(tx, rt)
+	})
+	if err != nil {
+		return "", nil, fmt.Errorf("error consuming remember token: %w", err)
+	}
+	if reused {
+		return "", old, aderrors.ErrTokenReused
+	}
+	return newToken, rt, nil
+}
+
+// DeleteRememberTokenFamily revokes every token in the family.
+func (rs *RememberTokenStore) DeleteRememberTokenFamily(familyID string) (bool, error) {
+	err := rs.Update(func(tx *bolt.Tx) error {
+		return deleteRememberTokenFamily(tx, familyID)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error deleting remember token family %s: %w", familyID, err)
+	}
+	return true, nil
+}
+
+// PurgeExpiredRememberTokens deletes the tokens that expired before now,
+// returning the number deleted. Rotated tokens are kept until they expire,
+// so that presenting one again is still caught as theft. Tokens saved
+// before there was a family index are added to it.
+func (rs *RememberTokenStore) PurgeExpiredRememberTokens(now time.Time) (int, error) {
+	n := 0
+	err := rs.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(RememberTokenBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(RememberTokenBucket))
+		}
+		bf := tx.Bucket(rememberFamilyBucket)
+		if bf == nil {
+			return fmt.Errorf("no %s bucket exists", string(rememberFamilyBucket))
+		}
+		var expired []*models.RememberToken
+		err := b.ForEach(func(k, v []byte) error {
+			rt := &models.RememberToken{}
+			if err := json.Unmarshal(v, rt); err != nil {
+				return err
+			}
+			if now.After(rt.ExpiryTime) {
+				expired = append(expired, rt)
+				return nil
+			}
+			return bf.Put(rememberFamilyKey(rt.FamilyID, rt.Selector), []byte{})
+		})
+		if err != nil {
+			return err
+		}
+		for _, rt := range expired {
+			if err := deleteRememberToken(tx, rt.FamilyID, rt.Selector); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error purging expired remember tokens: %w", err)
+	}
+	return n, nil
+}
+
+func putRememberToken(tx *bolt.Tx, rt *models.RememberToken) error {
+	b := tx.Bucket(RememberTokenBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(RememberTokenBucket))
+	}
+	bf := tx.Bucket(rememberFamilyBucket)
+	if bf == nil {
+		return fmt.Errorf("no %s bucket exists", string(rememberFamilyBucket))
+	}
+	rtJSON, err := json.Marshal(rt)
+	if err != nil {
+		return err
+	}
+	if err := bf.Put(rememberFamilyKey(rt.FamilyID, rt.Selector), []byte{}); err != nil {
+		return err
+	}
+	return b.Put([]byte(rt.Selector), rtJSON)
+}
+
+// deleteRememberToken deletes the token and its entry in the family index.
+func deleteRememberToken(tx *bolt.Tx, familyID, selector string) error {
+	if err := tx.Bucket(rememberFamilyBucket).Delete(rememberFamilyKey(familyID, selector)); err != nil {
+		return err
+	}
+	return tx.Bucket(RememberTokenBucket).Delete([]byte(selector))
+}
+
+func deleteRememberTokenFamily(tx *bolt.Tx, familyID string) error {
+	bf := tx.Bucket(rememberFamilyBucket)
+	if bf == nil {
+		return fmt.Errorf("no %s bucket exists", string(rememberFamilyBucket))
+	}
+	var selectors []string
+	err := forEachPrefix(bf, familyID, func(k, v []byte) error {
+		selectors = append(selectors, string(k[len(familyID)+1:]))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, selector := range selectors {
+		if err := deleteRememberToken(tx, familyID, selector); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rememberFamilyKey indexes a token by its family, so a family can be
+// revoked without reading every token.
+func rememberFamilyKey(familyID, selector string) []byte {
+	return []byte(familyID + "/" + selector)
+}
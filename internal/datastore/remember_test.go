@@ -0,0 +1,156 @@
+package datastore_test
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestRememberTokenRotation(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	rs := &datastore.RememberTokenStore{BDB: db}
+
+	tok, rt, err := rs.CreateRememberToken("user1", "")
+	ok(t, err)
+	assert(t, rt.FamilyID != "", "expected a family to be started")
+
+	tok2, rt2, err := rs.ConsumeRememberToken(tok)
+	ok(t, err)
+	assert(t, tok2 != tok, "expected the token to be rotated")
+	equals(t, rt.FamilyID, rt2.FamilyID)
+	equals(t, "user1", rt2.UserID)
+
+	_, _, err = rs.ConsumeRememberToken(tok2)
+	ok(t, err)
+}
+
+func TestRememberTokenValidatorMismatchRevokesFamily(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	rs := &datastore.RememberTokenStore{BDB: db}
+
+	tok, rt, err := rs.CreateRememberToken("user1", "")
+	ok(t, err)
+	tok2, _, err := rs.ConsumeRememberToken(tok)
+	ok(t, err)
+
+	selector := strings.SplitN(tok, ":", 2)[0]
+	_, stolen, err := rs.ConsumeRememberToken(selector + ":forged")
+	assert(t, errors.Is(err, aderrors.ErrTokenReused), "expected reuse to be detected, got %v", err)
+	equals(t, rt.FamilyID, stolen.FamilyID)
+
+	_, _, err = rs.ConsumeRememberToken(tok2)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the family to be revoked, got %v", err)
+}
+
+func TestRememberTokenDeleteFamily(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	rs := &datastore.RememberTokenStore{BDB: db}
+
+	tok, rt, err := rs.CreateRememberToken("user1", "")
+	ok(t, err)
+	other, _, err := rs.CreateRememberToken("user1", "")
+	ok(t, err)
+
+	_, err = rs.DeleteRememberTokenFamily(rt.FamilyID)
+	ok(t, err)
+
+	_, _, err = rs.ConsumeRememberToken(tok)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected token to be deleted, got %v", err)
+	_, _, err = rs.ConsumeRememberToken(other)
+	ok(t, err)
+}
+
+func TestRememberTokenPurgeExpired(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	rs := &datastore.RememberTokenStore{BDB: db}
+
+	tok, rt, err := rs.CreateRememberToken("user1", "")
+	ok(t, err)
+	tok2, _, err := rs.ConsumeRememberToken(tok)
+	ok(t, err)
+
+	// Tokens saved before the family index get added to it
+	ok(t, db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket([]byte("remember_family_bucket")) }))
+	ok(t, db.CreateAllBuckets())
+	n, err := rs.PurgeExpiredRememberTokens(time.Now())
+	ok(t, err)
+	equals(t, 0, n)
+	_, err = rs.DeleteRememberTokenFamily(rt.FamilyID)
+	ok(t, err)
+	_, _, err = rs.ConsumeRememberToken(tok2)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the family to be revoked, got %v", err)
+
+	// Rotated tokens stay until they expire, then go with the rest
+	tok, _, err = rs.CreateRememberToken("user1", "")
+	ok(t, err)
+	_, _, err = rs.ConsumeRememberToken(tok)
+	ok(t, err)
+	n, err = rs.PurgeExpiredRememberTokens(time.Now())
+	ok(t, err)
+	equals(t, 0, n)
+	n, err = rs.PurgeExpiredRememberTokens(time.Now().Add(models.RememberTokenLifetime + time.Minute))
+	ok(t, err)
+	equals(t, 2, n)
+	ok(t, db.View(func(tx *bolt.Tx) error {
+		equals(t, 0, tx.Bucket(datastore.RememberTokenBucket).Stats().KeyN)
+		equals(t, 0, tx.Bucket([]byte("remember_family_bucket")).Stats().KeyN)
+		return nil
+	}))
+}
+
+// newTestDB opens a bolt database in a temporary directory with all buckets created.
+func newTestDB(tb testing.TB) (*datastore.BDB, func()) {
+	dir, err := ioutil.TempDir("", "auth_demo")
+	ok(tb, err)
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	ok(tb, err)
+	bdb := &datastore.BDB{DB: db}
+	ok(tb, bdb.CreateAllBuckets())
+	return bdb, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
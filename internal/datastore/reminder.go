@@ -0,0 +1,203 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// ReminderStore keeps the schedule of todo reminders. Reminders are kept by
+// todo ID, and indexed in reminderDueBucket by when they're due so the due
+// ones can be found without reading them all.
+type ReminderStore struct{ *BDB }
+
+func (rs *ReminderStore) ClaimDueReminders(now time.Time) ([]*models.Reminder, error) {
+	reminders := []*models.Reminder{}
+	err := rs.Update(func(tx *bolt.Tx) error {
+		due := tx.Bucket(reminderDueBucket)
+		if due == nil {
+			return fmt.Errorf("no %s bucket exists", string(reminderDueBucket))
+		}
+		end := reminderDueKey(now, "\xff")
+		c := due.Cursor()
+		for k, v := c.First(); k != nil && bytes.Compare(k, end) <= 0; k, v = c.Next() {
+			r, err := getReminder(tx, string(v))
+			if err != nil {
+				return err
+			}
+			if r.ClaimedTime.IsZero() {
+				r.ClaimedTime = now
+				if err := putReminder(tx, r); err != nil {
+					return err
+				}
+			}
+			reminders = append(reminders, r)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error claiming due reminders: %w", err)
+	}
+	return reminders, nil
+}
+
+func (rs *ReminderStore) NextReminderTime() (time.Time, error) {
+	var next time.Time
+	err := rs.View(func(tx *bolt.Tx) error {
+		due := tx.Bucket(reminderDueBucket)
+		if due == nil {
+			return fmt.Errorf("no %s bucket exists", string(reminderDueBucket))
+		}
+		if k, _ := due.Cursor().First(); k != nil {
+			next = time.Unix(0, int64(binary.BigEndian.Uint64(k))).UTC()
+		}
+		return nil
+	})
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error finding the next reminder: %w", err)
+	}
+	return next, nil
+}
+
+func (rs *ReminderStore) MarkReminderSent(todoID, notifier string) error {
+	err := rs.Update(func(tx *bolt.Tx) error {
+		r, err := getReminder(tx, todoID)
+		if err != nil {
+			return err
+		}
+		if r.IsSentBy(notifier) {
+			return nil
+		}
+		r.Sent = append(r.Sent, notifier)
+		return putReminder(tx, r)
+	})
+	if err != nil {
+		return fmt.Errorf("error marking reminder of todo %s sent: %w", todoID, err)
+	}
+	return nil
+}
+
+func (rs *ReminderStore) CompleteReminder(r *models.Reminder) error {
+	err := rs.Update(func(tx *bolt.Tx) error {
+		cur, err := getReminder(tx, r.TodoID)
+		if err != nil {
+			return err
+		}
+		if !cur.RemindAt.Equal(r.RemindAt) {
+			// Rescheduled while it was being sent
+			return nil
+		}
+		if cur.Completed {
+			return aderrors.ErrNoRecords
+		}
+		cur.Completed = true
+		if err := putReminder(tx, cur); err != nil {
+			return err
+		}
+		return tx.Bucket(reminderDueBucket).Delete(reminderDueKey(cur.RemindAt, cur.TodoID))
+	})
+	if err != nil {
+		return fmt.Errorf("error completing reminder of todo %s: %w", r.TodoID, err)
+	}
+	return nil
+}
+
+// scheduleReminder keeps the todo's reminder in step with its RemindAt,
+// given the todo as it was saved before, or nil if it's new. A new
+// RemindAt gets a new reminder, while saving the todo with the same one
+// keeps how far sending it got, so it isn't sent again. Reminders of todos
+// that are done or trashed aren't due.
+func scheduleReminder(tx *bolt.Tx, old, td *models.Todo) error {
+	if !td.RemindAt.Valid {
+		if err := deleteReminder(tx, td.ID); err != nil && !errors.Is(err, aderrors.ErrNoRecords) {
+			return err
+		}
+		return nil
+	}
+	r, err := getReminder(tx, td.ID)
+	if err != nil && !errors.Is(err, aderrors.ErrNoRecords) {
+		return err
+	}
+	if old == nil || !old.RemindAt.Valid || !old.RemindAt.Time.Equal(td.RemindAt.Time) {
+		if r != nil {
+			if err := deleteReminder(tx, td.ID); err != nil {
+				return err
+			}
+		}
+		r = &models.Reminder{TodoID: td.ID, UserID: td.UserID, RemindAt: td.RemindAt.Time.UTC()}
+	} else if r == nil {
+		// Sent and removed before reminders were kept once completed
+		return nil
+	}
+	if err := putReminder(tx, r); err != nil {
+		return err
+	}
+	due := tx.Bucket(reminderDueBucket)
+	if due == nil {
+		return fmt.Errorf("no %s bucket exists", string(reminderDueBucket))
+	}
+	k := reminderDueKey(r.RemindAt, r.TodoID)
+	if r.Completed || td.IsDone.Bool || td.IsTrashed() {
+		return due.Delete(k)
+	}
+	return due.Put(k, []byte(r.TodoID))
+}
+
+// deleteReminder removes the todo's reminder, returning
+// aderrors.ErrNoRecords if it has none.
+func deleteReminder(tx *bolt.Tx, todoID string) error {
+	r, err := getReminder(tx, todoID)
+	if err != nil {
+		return err
+	}
+	due := tx.Bucket(reminderDueBucket)
+	if due == nil {
+		return fmt.Errorf("no %s bucket exists", string(reminderDueBucket))
+	}
+	if err := due.Delete(reminderDueKey(r.RemindAt, todoID)); err != nil {
+		return err
+	}
+	return tx.Bucket(ReminderBucket).Delete([]byte(todoID))
+}
+
+func getReminder(tx *bolt.Tx, todoID string) (*models.Reminder, error) {
+	b := tx.Bucket(ReminderBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(ReminderBucket))
+	}
+	rJSON := b.Get([]byte(todoID))
+	if rJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var r models.Reminder
+	if err := json.Unmarshal(rJSON, &r); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func putReminder(tx *bolt.Tx, r *models.Reminder) error {
+	b := tx.Bucket(ReminderBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(ReminderBucket))
+	}
+	rJSON, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(r.TodoID), rJSON)
+}
+
+// reminderDueKey sorts reminders by when they're due, then by todo.
+func reminderDueKey(t time.Time, todoID string) []byte {
+	k := make([]byte, 8, 8+len(todoID))
+	binary.BigEndian.PutUint64(k, uint64(t.UnixNano()))
+	return append(k, todoID...)
+}
@@ -0,0 +1,187 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestReminders(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	rs := &datastore.ReminderStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+
+	now := time.Now().UTC().Truncate(time.Second)
+	for i, at := range []time.Time{now.Add(2 * time.Hour), now.Add(time.Hour)} {
+		td := &models.Todo{UserID: alice.ID, Name: null.StringFrom("todo"), RemindAt: null.TimeFrom(at)}
+		td.ID = string(rune('a' + i))
+		_, err := ts.Create(td)
+		ok(t, err)
+	}
+	_, err := ts.Create(&models.Todo{ID: "c", UserID: alice.ID, Name: null.StringFrom("no reminder")})
+	ok(t, err)
+
+	next, err := rs.NextReminderTime()
+	ok(t, err)
+	equals(t, now.Add(time.Hour), next)
+	due, err := rs.ClaimDueReminders(now)
+	ok(t, err)
+	equals(t, 0, len(due))
+
+	due, err = rs.ClaimDueReminders(now.Add(90 * time.Minute))
+	ok(t, err)
+	equals(t, 1, len(due))
+	equals(t, "b", due[0].TodoID)
+	equals(t, alice.ID, due[0].UserID)
+	equals(t, now.Add(90*time.Minute), due[0].ClaimedTime)
+	ok(t, rs.MarkReminderSent("b", "in_app"))
+
+	// After a restart the claimed reminder is handed out again, remembering
+	// who has sent it
+	path := db.Path()
+	ok(t, db.Close())
+	bdb, err := bolt.Open(path, 0600, nil)
+	ok(t, err)
+	db.DB = bdb
+	due, err = rs.ClaimDueReminders(now.Add(3 * time.Hour))
+	ok(t, err)
+	equals(t, 2, len(due))
+	equals(t, "b", due[0].TodoID)
+	equals(t, now.Add(90*time.Minute), due[0].ClaimedTime)
+	assert(t, due[0].IsSentBy("in_app") && !due[0].IsSentBy("email"), "expected only in_app to have sent it, got %v", due[0].Sent)
+	equals(t, "a", due[1].TodoID)
+
+	ok(t, rs.CompleteReminder(due[0]))
+	ok(t, rs.CompleteReminder(due[1]))
+	err = rs.CompleteReminder(due[1])
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the reminder to be gone, got %v", err)
+	next, err = rs.NextReminderTime()
+	ok(t, err)
+	assert(t, next.IsZero(), "expected no more reminders, got %v", next)
+}
+
+// Saving a todo again doesn't send its reminder again, unless it's given
+// a new RemindAt.
+func TestReminderNotRearmed(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	rs := &datastore.ReminderStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+
+	now := time.Now().UTC().Truncate(time.Second)
+	_, err := ts.Create(&models.Todo{ID: "a", UserID: alice.ID, Name: null.StringFrom("todo"), RemindAt: null.TimeFrom(now)})
+	ok(t, err)
+	rename := func(name string) {
+		td, err := ts.Get("a")
+		ok(t, err)
+		td.Name = null.StringFrom(name)
+		_, err = ts.Update(td, alice.ID)
+		ok(t, err)
+	}
+
+	// A save while it's being sent keeps who has sent it
+	due, err := rs.ClaimDueReminders(now)
+	ok(t, err)
+	equals(t, 1, len(due))
+	ok(t, rs.MarkReminderSent("a", "in_app"))
+	rename("renamed while sending")
+	due, err = rs.ClaimDueReminders(now.Add(time.Minute))
+	ok(t, err)
+	equals(t, 1, len(due))
+	equals(t, now, due[0].ClaimedTime)
+	assert(t, due[0].IsSentBy("in_app"), "expected in_app to have sent it, got %v", due[0].Sent)
+	ok(t, rs.CompleteReminder(due[0]))
+
+	// Once sent, renaming, trashing and restoring, or marking it done and
+	// not done don't send it again
+	rename("renamed after")
+	_, err = ts.Delete([]string{"a"}, alice.ID)
+	ok(t, err)
+	_, err = ts.Restore("a", alice.ID)
+	ok(t, err)
+	for _, done := range []bool{true, false} {
+		td, err := ts.Get("a")
+		ok(t, err)
+		td.IsDone = null.BoolFrom(done)
+		_, err = ts.Update(td, alice.ID)
+		ok(t, err)
+	}
+	due, err = rs.ClaimDueReminders(now.Add(time.Hour))
+	ok(t, err)
+	equals(t, 0, len(due))
+
+	// A new RemindAt is a new reminder
+	td, err := ts.Get("a")
+	ok(t, err)
+	td.RemindAt = null.TimeFrom(now.Add(time.Hour))
+	_, err = ts.Update(td, alice.ID)
+	ok(t, err)
+	due, err = rs.ClaimDueReminders(now.Add(time.Hour))
+	ok(t, err)
+	equals(t, 1, len(due))
+	equals(t, []string(nil), due[0].Sent)
+}
+
+func TestRemindersPurged(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	rs := &datastore.ReminderStore{BDB: db}
+	ns := &datastore.NotificationStore{BDB: db}
+	as := &datastore.AccountStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+
+	_, err := ts.Create(&models.Todo{ID: "a", UserID: alice.ID, RemindAt: null.TimeFrom(time.Now())})
+	ok(t, err)
+	_, err = ns.CreateNotification(&models.Notification{ID: "n1", UserID: alice.ID})
+	ok(t, err)
+	_, err = as.Purge(alice.ID)
+	ok(t, err)
+
+	next, err := rs.NextReminderTime()
+	ok(t, err)
+	assert(t, next.IsZero(), "expected the reminder to be purged, got %v", next)
+	notifications, err := ns.GetNotificationsByUserID(alice.ID)
+	ok(t, err)
+	equals(t, 0, len(notifications))
+}
+
+func TestNotifications(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	ns := &datastore.NotificationStore{BDB: db}
+
+	now := time.Now().UTC()
+	_, err := ns.CreateNotification(&models.Notification{ID: "n1", UserID: "alice", Title: "first", DateCreated: now.Add(-time.Hour)})
+	ok(t, err)
+	_, err = ns.CreateNotification(&models.Notification{ID: "n2", UserID: "alice", Title: "second", DateCreated: now})
+	ok(t, err)
+	_, err = ns.CreateNotification(&models.Notification{ID: "n3", UserID: "bob", Title: "bob's"})
+	ok(t, err)
+	_, err = ns.CreateNotification(&models.Notification{ID: "n1", UserID: "alice", Title: "again"})
+	assert(t, errors.Is(err, aderrors.ErrAlreadyExists), "expected the same notification to be refused, got %v", err)
+
+	notifications, err := ns.GetNotificationsByUserID("alice")
+	ok(t, err)
+	equals(t, 2, len(notifications))
+	equals(t, "second", notifications[0].Title)
+	equals(t, "first", notifications[1].Title)
+
+	_, err = ns.MarkNotificationRead("bob", "n1")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to see alice's notification, got %v", err)
+	n, err := ns.MarkNotificationRead("alice", "n1")
+	ok(t, err)
+	assert(t, n.ReadTime != nil, "expected the notification to be read")
+}
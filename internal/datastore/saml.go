@@ -0,0 +1,127 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+// SAMLStore keeps the AuthnRequests waiting for an answer, and the IDs of
+// the assertions already used, until they expire.
+type SAMLStore struct{ *BDB }
+
+func (ss *SAMLStore) SaveSAMLRequest(req *models.SAMLRequest) error {
+	err := ss.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(samlRequestBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(samlRequestBucket))
+		}
+		if err := deleteExpired(b, timeNow()); err != nil {
+			return err
+		}
+		reqJSON, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(req.ID), reqJSON)
+	})
+	if err != nil {
+		return fmt.Errorf("error saving SAML request %s: %w", req.ID, err)
+	}
+	return nil
+}
+
+func (ss *SAMLStore) ConsumeSAMLRequest(id string) (*models.SAMLRequest, error) {
+	var req models.SAMLRequest
+	err := ss.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(samlRequestBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(samlRequestBucket))
+		}
+		reqJSON := b.Get([]byte(id))
+		if reqJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		if err := json.Unmarshal(reqJSON, &req); err != nil {
+			return err
+		}
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if timeNow().After(req.ExpiryTime) {
+			return aderrors.ErrExpired
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error consuming SAML request %s: %w", id, err)
+	}
+	return &req, nil
+}
+
+func (ss *SAMLStore) UseSAMLAssertion(id string, expiry time.Time) error {
+	err := ss.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(samlAssertionBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(samlAssertionBucket))
+		}
+		now := timeNow()
+		if err := deleteExpired(b, now); err != nil {
+			return err
+		}
+		if b.Get([]byte(id)) != nil {
+			return aderrors.ErrTokenReused
+		}
+		// Even an already expired assertion is remembered for a while, in
+		// case the clocks disagree
+		if expiry.Before(now.Add(time.Minute)) {
+			expiry = now.Add(time.Minute)
+		}
+		recJSON, err := json.Marshal(&usedAssertion{ID: id, ExpiryTime: expiry})
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(id), recJSON)
+	})
+	if err != nil {
+		return fmt.Errorf("error using SAML assertion %s: %w", id, err)
+	}
+	return nil
+}
+
+// usedAssertion is the record of an assertion used to log in.
+type usedAssertion struct {
+	ID         string    `json:"id"`
+	ExpiryTime time.Time `json:"expiry_time"`
+}
+
+// deleteExpired deletes the records in the bucket that expired before now.
+// Both buckets are small, only holding what a few minutes of logins leave.
+func deleteExpired(b *bolt.Bucket, now time.Time) error {
+	var keys [][]byte
+	err := b.ForEach(func(k, v []byte) error {
+		var rec struct {
+			ExpiryTime time.Time `json:"expiry_time"`
+		}
+		if err := json.Unmarshal(v, &rec); err != nil {
+			return err
+		}
+		if now.After(rec.ExpiryTime) {
+			keys = append(keys, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/search"
+)
+
+// The search index is an inverted index of todos' names and notes, and
+// their comments, each a document of its own. SearchIndexBucket holds a
+// posting for every term of every document, keyed by the term and the
+// document's ID with a zero byte between them, so the documents with a
+// term, or with terms starting with a prefix, are next to each other.
+// searchDocBucket keeps every document's terms, so its postings can be
+// found again when it changes.
+//
+// putTodo and putComment index what they save, and deleteTodoContent
+// takes a todo and its comments out of the index. Todos in the trash stay
+// indexed, and are left out of results as getTodo doesn't find them.
+
+const (
+	// snippetLength is about how long a highlight is, in bytes.
+	snippetLength = 160
+	// maxCommentHighlights is how many of a todo's comments are highlighted.
+	maxCommentHighlights = 3
+	// bm25K1 is how quickly a term being repeated in a field stops making a
+	// document a better match.
+	bm25K1 = 1.2
+)
+
+// searchFieldWeights is how much a match in each field counts. A todo
+// named after what's being searched for is the best match.
+var searchFieldWeights = map[string]float64{
+	models.SearchFieldName:    3,
+	models.SearchFieldNotes:   1,
+	models.SearchFieldComment: 1,
+}
+
+// SearchStore searches the index the TodoStore and CommentStore keep.
+type SearchStore struct {
+	*BDB
+}
+
+// searchDoc is a document in the index: the number of times each term is
+// in each of its fields.
+type searchDoc struct {
+	TodoID string                    `json:"todo_id"`
+	Terms  map[string]map[string]int `json:"terms"`
+}
+
+// searchPosting is a term of a document: the number of times it's in each
+// of the document's fields.
+type searchPosting struct {
+	TodoID string         `json:"todo_id"`
+	Fields map[string]int `json:"fields"`
+}
+
+// searchHit is a todo matching a search.
+type searchHit struct {
+	todo       *models.Todo
+	score      float64
+	scores     []float64
+	commentIDs map[string]bool
+}
+
+func (ss *SearchStore) Search(query, userID string, offset, limit int) ([]*models.SearchResult, int, error) {
+	q := search.ParseQuery(query)
+	results := []*models.SearchResult{}
+	total := 0
+	if len(q) == 0 {
+		return results, 0, nil
+	}
+	err := ss.View(func(tx *bolt.Tx) error {
+		hits, err := searchIndex(tx, q)
+		if err != nil {
+			return err
+		}
+		var visible []*searchHit
+		for todoID, h := range hits {
+			td, err := getTodo(tx, todoID)
+			if errors.Is(err, aderrors.ErrNoRecords) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			if err := authorizeTodo(tx, td, userID, models.PermTodosRead); err != nil {
+				if isAccessDenied(err) {
+					continue
+				}
+				return err
+			}
+			h.todo = td
+			visible = append(visible, h)
+		}
+		sort.Slice(visible, func(i, j int) bool {
+			if visible[i].score != visible[j].score {
+				return visible[i].score > visible[j].score
+			}
+			return visible[i].todo.ID < visible[j].todo.ID
+		})
+
+		total = len(visible)
+		for i := offset; i < len(visible) && len(results) < limit; i++ {
+			h := visible[i]
+			highlights, err := searchHighlights(tx, q, h)
+			if err != nil {
+				return err
+			}
+			results = append(results, &models.SearchResult{
+				ID:         h.todo.ID,
+				Score:      math.Round(h.score*1000) / 1000,
+				Highlights: highlights,
+				Todo:       h.todo,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("error searching for %q: %w", query, err)
+	}
+	return results, total, nil
+}
+
+// Reindex satisfies the models.SearchService interface. Todos in the
+// trash are indexed too, so they're found again once restored.
+func (ss *SearchStore) Reindex() (int, error) {
+	n := 0
+	err := ss.DB.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{SearchIndexBucket, searchDocBucket} {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+			if _, err := tx.CreateBucket(name); err != nil {
+				return err
+			}
+		}
+		b := tx.Bucket(TodoBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(TodoBucket))
+		}
+		err := b.ForEach(func(k, v []byte) error {
+			var td models.Todo
+			if err := json.Unmarshal(v, &td); err != nil {
+				return err
+			}
+			n++
+			return indexTodo(tx, &td)
+		})
+		if err != nil {
+			return err
+		}
+		return forEachComment(tx, func(c *models.Comment) error {
+			if !c.Deleted {
+				n++
+			}
+			return indexComment(tx, c)
+		})
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error rebuilding the search index: %w", err)
+	}
+	return n, nil
+}
+
+// searchIndex finds the todos whose documents match every term of the
+// query, scoring them with BM25, without field lengths as todos are short.
+func searchIndex(tx *bolt.Tx, q search.Query) (map[string]*searchHit, error) {
+	bi := tx.Bucket(SearchIndexBucket)
+	if bi == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(SearchIndexBucket))
+	}
+	bd := tx.Bucket(searchDocBucket)
+	if bd == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(searchDocBucket))
+	}
+	numDocs := float64(bd.Stats().KeyN)
+
+	hits := map[string]*searchHit{}
+	for i, qt := range q {
+		// The postings of every indexed term matching this query term
+		postings := map[string]map[string]*searchPosting{}
+		scan := func(prefix []byte) error {
+			c := bi.Cursor()
+			for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+				term, docID := splitPostingKey(k)
+				if qt.Match(term) == 0 {
+					continue
+				}
+				var p searchPosting
+				if err := json.Unmarshal(v, &p); err != nil {
+					return err
+				}
+				if postings[term] == nil {
+					postings[term] = map[string]*searchPosting{}
+				}
+				postings[term][docID] = &p
+			}
+			return nil
+		}
+		if err := scan([]byte(qt.Term + "\x00")); err != nil {
+			return nil, err
+		}
+		if qt.Prefix != "" {
+			if err := scan([]byte(qt.Prefix)); err != nil {
+				return nil, err
+			}
+		}
+
+		for term, docs := range postings {
+			df := float64(len(docs))
+			idf := math.Log(1 + (numDocs-df+0.5)/(df+0.5))
+			match := qt.Match(term)
+			for docID, p := range docs {
+				tf := 0.0
+				for field, n := range p.Fields {
+					tf += searchFieldWeights[field] * float64(n) * (bm25K1 + 1) / (float64(n) + bm25K1)
+				}
+				h := hits[p.TodoID]
+				if h == nil {
+					h = &searchHit{scores: make([]float64, len(q)), commentIDs: map[string]bool{}}
+					hits[p.TodoID] = h
+				}
+				h.scores[i] += match * idf * tf
+				if strings.HasPrefix(docID, commentDocPrefix) {
+					h.commentIDs[strings.TrimPrefix(docID, commentDocPrefix)] = true
+				}
+			}
+		}
+	}
+
+	for todoID, h := range hits {
+		for _, s := range h.scores {
+			if s == 0 {
+				delete(hits, todoID)
+				break
+			}
+			h.score += s
+		}
+	}
+	return hits, nil
+}
+
+// searchHighlights returns snippets of the todo's name, notes and comments
+// matching the query.
+func searchHighlights(tx *bolt.Tx, q search.Query, h *searchHit) ([]*models.SearchHighlight, error) {
+	highlights := []*models.SearchHighlight{}
+	if s := search.Snippet(h.todo.Name.String, q, snippetLength); s != "" {
+		highlights = append(highlights, &models.SearchHighlight{Field: models.SearchFieldName, Snippet: s})
+	}
+	if s := search.Snippet(h.todo.Notes, q, snippetLength); s != "" {
+		highlights = append(highlights, &models.SearchHighlight{Field: models.SearchFieldNotes, Snippet: s})
+	}
+
+	commentIDs := make([]string, 0, len(h.commentIDs))
+	for id := range h.commentIDs {
+		commentIDs = append(commentIDs, id)
+	}
+	sort.Strings(commentIDs)
+	b := tx.Bucket(CommentBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(CommentBucket))
+	}
+	n := 0
+	for _, id := range commentIDs {
+		if n == maxCommentHighlights {
+			break
+		}
+		v := b.Get([]byte(id))
+		if v == nil {
+			continue
+		}
+		var c models.Comment
+		if err := json.Unmarshal(v, &c); err != nil {
+			return nil, err
+		}
+		if s := search.Snippet(c.Body, q, snippetLength); s != "" && !c.Deleted {
+			highlights = append(highlights, &models.SearchHighlight{Field: models.SearchFieldComment, CommentID: c.ID, Snippet: s})
+			n++
+		}
+	}
+	return highlights, nil
+}
+
+// The IDs of documents in the index start with what they are.
+const (
+	todoDocPrefix    = "todo/"
+	commentDocPrefix = "comment/"
+)
+
+// indexTodo indexes the todo's name and notes.
+func indexTodo(tx *bolt.Tx, td *models.Todo) error {
+	return indexDoc(tx, todoDocPrefix+td.ID, td.ID, map[string]string{
+		models.SearchFieldName:  td.Name.String,
+		models.SearchFieldNotes: td.Notes,
+	})
+}
+
+// indexComment indexes the comment's body, or takes it out of the index if
+// it's deleted.
+func indexComment(tx *bolt.Tx, c *models.Comment) error {
+	if c.Deleted {
+		return unindexDoc(tx, commentDocPrefix+c.ID)
+	}
+	return indexDoc(tx, commentDocPrefix+c.ID, c.TodoID, map[string]string{
+		models.SearchFieldComment: c.Body,
+	})
+}
+
+// unindexTodo takes the todo's name and notes out of the index. Its
+// comments are taken out as they're deleted.
+func unindexTodo(tx *bolt.Tx, todoID string) error {
+	return unindexDoc(tx, todoDocPrefix+todoID)
+}
+
+// indexDoc replaces the document's postings with ones for the terms in its
+// fields. Nothing is written if its terms haven't changed, as most
+// changes to a todo don't touch its name or notes.
+func indexDoc(tx *bolt.Tx, docID, todoID string, fields map[string]string) error {
+	doc := &searchDoc{TodoID: todoID, Terms: map[string]map[string]int{}}
+	for field, text := range fields {
+		for term, n := range search.Terms(text) {
+			if doc.Terms[term] == nil {
+				doc.Terms[term] = map[string]int{}
+			}
+			doc.Terms[term][field] = n
+		}
+	}
+	old, err := getSearchDoc(tx, docID)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.TodoID == doc.TodoID && reflect.DeepEqual(old.Terms, doc.Terms) {
+		return nil
+	}
+	if err := unindexDoc(tx, docID); err != nil {
+		return err
+	}
+	if len(doc.Terms) == 0 {
+		return nil
+	}
+
+	bi := tx.Bucket(SearchIndexBucket)
+	if bi == nil {
+		return fmt.Errorf("no %s bucket exists", string(SearchIndexBucket))
+	}
+	for term, fields := range doc.Terms {
+		pJSON, err := json.Marshal(&searchPosting{TodoID: todoID, Fields: fields})
+		if err != nil {
+			return err
+		}
+		if err := bi.Put(postingKey(term, docID), pJSON); err != nil {
+			return err
+		}
+	}
+	return putRecord(tx, searchDocBucket, docID, doc)
+}
+
+// unindexDoc deletes the document's postings, if it's in the index.
+func unindexDoc(tx *bolt.Tx, docID string) error {
+	doc, err := getSearchDoc(tx, docID)
+	if err != nil || doc == nil {
+		return err
+	}
+	bi := tx.Bucket(SearchIndexBucket)
+	if bi == nil {
+		return fmt.Errorf("no %s bucket exists", string(SearchIndexBucket))
+	}
+	for term := range doc.Terms {
+		if err := bi.Delete(postingKey(term, docID)); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(searchDocBucket).Delete([]byte(docID))
+}
+
+// getSearchDoc returns the indexed document, or nil if it isn't indexed.
+func getSearchDoc(tx *bolt.Tx, docID string) (*searchDoc, error) {
+	bd := tx.Bucket(searchDocBucket)
+	if bd == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(searchDocBucket))
+	}
+	v := bd.Get([]byte(docID))
+	if v == nil {
+		return nil, nil
+	}
+	var doc searchDoc
+	if err := json.Unmarshal(v, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+func postingKey(term, docID string) []byte {
+	return []byte(term + "\x00" + docID)
+}
+
+func splitPostingKey(k []byte) (term, docID string) {
+	i := bytes.IndexByte(k, 0)
+	if i < 0 {
+		return string(k), ""
+	}
+	return string(k[:i]), string(k[i+1:])
+}
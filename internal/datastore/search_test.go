@@ -0,0 +1,115 @@
+package datastore_test
+
+import (
+	"testing"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestSearch(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ors := &datastore.OrgStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	cs := &datastore.CommentStore{BDB: db}
+	ss := &datastore.SearchStore{BDB: db}
+
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+	acme := newTestOrg(t, ors, "acme", alice)
+	create := func(id, orgID, name, notes string) *models.Todo {
+		td := &models.Todo{ID: id, UserID: alice.ID, OrgID: orgID, Name: null.StringFrom(name), Notes: notes}
+		_, err := ts.Create(td)
+		ok(t, err)
+		return td
+	}
+	find := func(q, userID string) []string {
+		results, total, err := ss.Search(q, userID, 0, 10)
+		ok(t, err)
+		equals(t, len(results), total)
+		ids := []string{}
+		for _, r := range results {
+			ids = append(ids, r.ID)
+		}
+		return ids
+	}
+
+	create("notes", "", "Call the plumber", "Ask about the **meeting** room's leaking pipes")
+	create("name", "", "Plan meetings", "")
+	create("org", acme.ID, "Budget meeting", "")
+	create("other", "", "Water the plants", "")
+
+	// Words are stemmed and matched by prefix, a match in the name counts
+	// most, and every word has to match
+	equals(t, []string{"name", "org", "notes"}, find("meeting", alice.ID))
+	equals(t, []string{"name", "org", "notes"}, find("MEET", alice.ID))
+	equals(t, []string{"name", "notes", "other"}, find("pl", alice.ID))
+	equals(t, []string{"notes"}, find("meeting pipe", alice.ID))
+	equals(t, []string{}, find("the", alice.ID))
+
+	// Only todos the user can read are found
+	equals(t, []string{}, find("meeting", bob.ID))
+	token, err := ors.CreateInvitation(&models.Invitation{OrgID: acme.ID, Email: bob.Email, Role: models.OrgRoleViewer, InviterID: alice.ID})
+	ok(t, err)
+	_, err = ors.AcceptInvitation(token, bob)
+	ok(t, err)
+	equals(t, []string{"org"}, find("meeting", bob.ID))
+
+	// Comments are searched, and the words that matched are highlighted
+	c := &models.Comment{TodoID: "org", UserID: alice.ID, Body: "Bring the <quarterly> figures"}
+	ok(t, cs.CreateComment(c))
+	results, _, err := ss.Search("quarter figure", bob.ID, 0, 10)
+	ok(t, err)
+	equals(t, 1, len(results))
+	equals(t, []*models.SearchHighlight{{Field: models.SearchFieldComment, CommentID: c.ID,
+		Snippet: "Bring the &lt;<mark>quarterly</mark>&gt; <mark>figures</mark>"}}, results[0].Highlights)
+	_, err = cs.DeleteComment("org", c.ID, alice.ID)
+	ok(t, err)
+	equals(t, []string{}, find("quarterly", bob.ID))
+
+	// The index follows changes to todos, and the trash
+	td, err := ts.Get("name")
+	ok(t, err)
+	td.Name = null.StringFrom("Plan the offsite")
+	_, err = ts.Update(td, alice.ID)
+	ok(t, err)
+	equals(t, []string{"org", "notes"}, find("meeting", alice.ID))
+	equals(t, []string{"name"}, find("offsite", alice.ID))
+	_, err = ts.Delete([]string{"name"}, alice.ID)
+	ok(t, err)
+	equals(t, []string{}, find("offsite", alice.ID))
+	_, err = ts.Restore("name", alice.ID)
+	ok(t, err)
+	equals(t, []string{"name"}, find("offsite", alice.ID))
+
+	// Rebuilding the index finds the same todos
+	ok(t, db.Update(func(tx *bolt.Tx) error { return tx.DeleteBucket(datastore.SearchIndexBucket) }))
+	ok(t, db.CreateAllBuckets())
+	equals(t, []string{}, find("offsite", alice.ID))
+	n, err := ss.Reindex()
+	ok(t, err)
+	equals(t, 4, n)
+	equals(t, []string{"name"}, find("offsite", alice.ID))
+
+	// Pages of results have the total number of matches
+	results, total, err := ss.Search("pl", alice.ID, 1, 1)
+	ok(t, err)
+	equals(t, 3, total)
+	equals(t, 1, len(results))
+
+	// Todos deleted for good aren't found, even through their comments
+	ok(t, cs.CreateComment(&models.Comment{TodoID: "other", UserID: alice.ID, Body: "fertilizer"}))
+	equals(t, []string{"other"}, find("fertilizer", alice.ID))
+	_, err = ts.Delete([]string{"other"}, alice.ID)
+	ok(t, err)
+	_, err = ts.EmptyTrash("", alice.ID)
+	ok(t, err)
+	n, err = ss.Reindex()
+	ok(t, err)
+	equals(t, 3, n)
+	equals(t, []string{}, find("fertilizer", alice.ID))
+}
@@ -2,12 +2,15 @@ package datastore
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 	"time"
 
 	"github.com/boltdb/bolt"
 	"github.com/ejamesc/auth_demo/internal/aderrors"
 	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/sirupsen/logrus"
 )
 
 type SessionStore struct {
@@ -27,6 +30,66 @@ func (ss *SessionStore) CreateUser(user *models.User) (bool, error) {
 	return ss.UserStore.Create(user)
 }
 
+func (ss *SessionStore) UpdateUser(user *models.User) (bool, error) {
+	return ss.UserStore.Update(user)
+}
+
+// CheckPassword checks the password of the user with the email, returning
+// aderrors.ErrWrongPassword along with the user if it's wrong. A correct
+// password whose hash is outdated is hashed again and saved, unless the
+// password has been changed meanwhile.
+func (ss *SessionStore) CheckPassword(email, pass string) (*models.User, error) {
+	u, err := ss.UserStore.GetByEmail(email)
+	if errors.Is(err, aderrors.ErrNoRecords) {
+		// Take as long as checking a real password would
+		(&models.User{}).CheckPassword(pass)
+		return nil, err
+	} else if err != nil {
+		return nil, fmt.Errorf("error retrieving user: %w", err)
+	}
+	passOK, needsRehash := u.CheckPassword(pass)
+	if !passOK {
+		return u, aderrors.ErrWrongPassword
+	}
+	if needsRehash {
+		if err := ss.rehashPassword(u, pass); err != nil {
+			log.WithFields(logrus.Fields{"error": err, "user_id": u.ID}).Error("error re-hashing password")
+		} else {
+			log.WithField("user_id", u.ID).Info("upgraded password hash")
+		}
+	}
+	return u, nil
+}
+
+// rehashPassword saves the user's password hashed with the current
+// algorithm, if the stored hash is still the one it was checked against.
+func (ss *SessionStore) rehashPassword(u *models.User, pass string) error {
+	checked := u.Password
+	if err := u.SetPassword(pass); err != nil {
+		return err
+	}
+	return ss.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UserBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UserBucket))
+		}
+		uJSON := b.Get([]byte(u.ID))
+		if uJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		var cur models.User
+		if err := json.Unmarshal(uJSON, &cur); err != nil {
+			return err
+		}
+		if cur.Password != checked {
+			u.Password = cur.Password
+			return nil
+		}
+		cur.Password = u.Password
+		return putRecord(tx, UserBucket, cur.ID, &cur)
+	})
+}
+
 func (ss *SessionStore) GetSession(id string) (*models.Session, error) {
 	var sess models.Session
 	err := ss.View(func(tx *bolt.Tx) error {
@@ -43,6 +106,9 @@ func (ss *SessionStore) GetSession(id string) (*models.Session, error) {
 	if err != nil {
 		return nil, err
 	}
+	if sess.IsExpired(timeNow()) {
+		return nil, aderrors.ErrExpired
+	}
 	return &sess, nil
 }
 
@@ -73,6 +139,36 @@ func (ss *SessionStore) GetSessionByToken(token string) (*models.Session, error)
 	return &sess, nil
 }
 
+// GetSessionsByUserID returns every session and token belonging to a user,
+// most recently seen first.
+func (ss *SessionStore) GetSessionsByUserID(userID string) ([]*models.Session, error) {
+	sessions := []*models.Session{}
+	now := timeNow()
+	err := ss.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SessionBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(SessionBucket))
+		}
+		return b.ForEach(func(k, v []byte) error {
+			var sess models.Session
+			if err := json.Unmarshal(v, &sess); err != nil {
+				return err
+			}
+			if sess.UserID == userID && !sess.IsExpired(now) {
+				sessions = append(sessions, &sess)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving sessions for user %s: %w", userID, err)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeenTime.After(sessions[j].LastSeenTime)
+	})
+	return sessions, nil
+}
+
 func (ss *SessionStore) GetUserBySessionID(sessionID string) (*models.User, error) {
 	sess, err := ss.GetSession(sessionID)
 	if err != nil {
@@ -88,18 +184,30 @@ func (ss *SessionStore) GetUserBySessionID(sessionID string) (*models.User, erro
 	return usr, nil
 }
 
-func (ss *SessionStore) CreateSession(userID string, tokenOnly bool) (*models.Session, error) {
+// CreateSession creates a session for the user. Cookie sessions expire after
+// models.BrowserSessionLifetime, tokens never do.
+func (ss *SessionStore) CreateSession(userID string, tokenOnly bool, opts models.SessionOptions) (*models.Session, error) {
 	usr, err := ss.UserStore.Get(userID)
 	if err != nil || usr == nil {
 		return nil, fmt.Errorf("error retrieving user with id %s: %w", userID, err)
 	}
 
+	now := timeNow()
 	sess := models.Session{
-		UserID:       userID,
-		TokenOnly:    tokenOnly,
-		LoginTime:    timeNow(),
-		LastSeenTime: timeNow(),
+		UserID:           userID,
+		TokenOnly:        tokenOnly,
+		LoginTime:        now,
+		LastSeenTime:     now,
+		RememberFamilyID: opts.RememberFamilyID,
+		ImpersonatorID:   opts.ImpersonatorID,
+	}
+	switch {
+	case sess.IsImpersonation():
+		sess.ExpiryTime = now.Add(models.ImpersonationLifetime)
+	case !tokenOnly:
+		sess.ExpiryTime = now.Add(models.BrowserSessionLifetime)
 	}
+	sess.SetClient(opts.Client)
 	sess.GenerateID()
 	sess.GenerateToken()
 	err = ss.Update(func(tx *bolt.Tx) error {
@@ -129,13 +237,30 @@ func (ss *SessionStore) CreateSession(userID string, tokenOnly bool) (*models.Se
 	return &sess, nil
 }
 
+// DeleteSession deletes the session along with its token, so the token
+// cannot be used to authenticate afterwards.
 func (ss *SessionStore) DeleteSession(id string) (bool, error) {
 	err := ss.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(SessionBucket)
 		if b == nil {
 			return fmt.Errorf("no %s bucket exists", string(SessionBucket))
 		}
+		bt := tx.Bucket(sessionTokenBucket)
+		if bt == nil {
+			return fmt.Errorf("no %s bucket exists", string(sessionTokenBucket))
+		}
 
+		sJSON := b.Get([]byte(id))
+		if sJSON == nil {
+			return aderrors.ErrNoRecords
+		}
+		var sess models.Session
+		if err := json.Unmarshal(sJSON, &sess); err != nil {
+			return err
+		}
+		if err := bt.Delete([]byte(sess.Token)); err != nil {
+			return err
+		}
 		return b.Delete([]byte(id))
 	})
 	if err != nil {
@@ -144,6 +269,50 @@ func (ss *SessionStore) DeleteSession(id string) (bool, error) {
 	return true, nil
 }
 
+// PurgeExpiredSessions deletes the sessions that expired before now, along
+// with their tokens, returning the number deleted.
+func (ss *SessionStore) PurgeExpiredSessions(now time.Time) (int, error) {
+	n := 0
+	err := ss.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SessionBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(SessionBucket))
+		}
+		bt := tx.Bucket(sessionTokenBucket)
+		if bt == nil {
+			return fmt.Errorf("no %s bucket exists", string(sessionTokenBucket))
+		}
+		var expired []*models.Session
+		err := b.ForEach(func(k, v []byte) error {
+			sess := &models.Session{}
+			if err := json.Unmarshal(v, sess); err != nil {
+				return err
+			}
+			if sess.IsExpired(now) {
+				expired = append(expired, sess)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, sess := range expired {
+			if err := bt.Delete([]byte(sess.Token)); err != nil {
+				return err
+			}
+			if err := b.Delete([]byte(sess.ID)); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error purging expired sessions: %w", err)
+	}
+	return n, nil
+}
+
 func (ss *SessionStore) updateLastSeenTime(sess *models.Session, tt time.Time) (bool, error) {
 	sess.LastSeenTime = tt
 
@@ -152,6 +321,10 @@ func (ss *SessionStore) updateLastSeenTime(sess *models.Session, tt time.Time) (
 		if b == nil {
 			return fmt.Errorf("no %s bucket exists", string(SessionBucket))
 		}
+		// The session may have been revoked since it was read; don't resurrect it.
+		if b.Get([]byte(sess.ID)) == nil {
+			return aderrors.ErrNoRecords
+		}
 
 		sJSON, err := json.Marshal(sess)
 		if err != nil {
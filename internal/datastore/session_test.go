@@ -0,0 +1,85 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	"github.com/ejamesc/auth_demo/internal/password"
+)
+
+func TestPurgeExpiredSessions(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ss := &datastore.SessionStore{BDB: db, UserStore: us}
+
+	alice := newTestUser(t, us, "alice")
+	browser, err := ss.CreateSession(alice.ID, false, models.SessionOptions{})
+	ok(t, err)
+	token, err := ss.CreateSession(alice.ID, true, models.SessionOptions{})
+	ok(t, err)
+
+	n, err := ss.PurgeExpiredSessions(time.Now())
+	ok(t, err)
+	equals(t, 0, n)
+
+	// Tokens never expire, so only the browser session goes
+	n, err = ss.PurgeExpiredSessions(time.Now().Add(models.BrowserSessionLifetime + time.Minute))
+	ok(t, err)
+	equals(t, 1, n)
+	_, err = ss.GetSession(browser.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected session to be purged, got %v", err)
+	_, err = ss.GetSessionByToken(browser.Token)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected session token to be purged, got %v", err)
+	_, err = ss.GetSessionByToken(token.Token)
+	ok(t, err)
+}
+
+func TestCheckPasswordRehashes(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ss := &datastore.SessionStore{BDB: db, UserStore: us}
+
+	// A hash made with weaker parameters than the current ones
+	weak := password.NewRegistry(password.NewArgon2idHasher(password.Argon2Params{
+		Memory: 1024, Iterations: 1, Parallelism: 1, SaltLength: 16, KeyLength: 32,
+	}))
+	oldHash, err := weak.Hash("correct horse")
+	ok(t, err)
+	alice := newTestUser(t, us, "alice")
+	alice.Password = oldHash
+	_, err = us.Update(alice)
+	ok(t, err)
+	stored := func() string {
+		u, err := us.Get(alice.ID)
+		ok(t, err)
+		return u.Password
+	}
+
+	// A wrong password leaves the hash alone
+	u, err := ss.CheckPassword(alice.Email, "wrong")
+	assert(t, errors.Is(err, aderrors.ErrWrongPassword), "expected the password to be wrong, got %v", err)
+	equals(t, alice.ID, u.ID)
+	equals(t, oldHash, stored())
+
+	// The right one has it hashed again with the current parameters
+	_, err = ss.CheckPassword(alice.Email, "correct horse")
+	ok(t, err)
+	newHash := stored()
+	assert(t, newHash != oldHash, "expected the password to be hashed again")
+	valid, needsRehash, err := password.DefaultRegistry.Verify(newHash, "correct horse")
+	ok(t, err)
+	equals(t, true, valid)
+	equals(t, false, needsRehash)
+	_, err = ss.CheckPassword(alice.Email, "correct horse")
+	ok(t, err)
+	equals(t, newHash, stored())
+
+	_, err = ss.CheckPassword("nobody@example.com", "correct horse")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected no user to be found, got %v", err)
+}
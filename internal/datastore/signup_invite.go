@@ -0,0 +1,193 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+type SignupInviteStore struct {
+	*BDB
+}
+
+func (sis *SignupInviteStore) CreateSignupInvite(inv *models.SignupInvite) (string, error) {
+	code, stored, err := models.NewSignupInvite(inv, timeNow())
+	if err != nil {
+		return "", err
+	}
+	err = sis.Update(func(tx *bolt.Tx) error {
+		return putSignupInvite(tx, stored)
+	})
+	if err != nil {
+		return "", fmt.Errorf("error creating signup invite: %w", err)
+	}
+	*inv = *stored
+	return code, nil
+}
+
+func (sis *SignupInviteStore) GetSignupInvite(id string) (*models.SignupInvite, error) {
+	var inv *models.SignupInvite
+	err := sis.View(func(tx *bolt.Tx) error {
+		var err error
+		inv, err = getSignupInvite(tx, []byte(id))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (sis *SignupInviteStore) GetSignupInviteByCode(code string) (*models.SignupInvite, error) {
+	var inv *models.SignupInvite
+	err := sis.View(func(tx *bolt.Tx) error {
+		var err error
+		inv, err = getSignupInviteByCode(tx, code)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inv, nil
+}
+
+func (sis *SignupInviteStore) GetSignupInvites(userID string) ([]*models.SignupInvite, error) {
+	invs := []*models.SignupInvite{}
+	err := sis.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(SignupInviteBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(SignupInviteBucket))
+		}
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var inv models.SignupInvite
+			if err := json.Unmarshal(v, &inv); err != nil {
+				return err
+			}
+			if userID == "" || inv.UserID == userID {
+				invs = append(invs, &inv)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving signup invites: %w", err)
+	}
+	return invs, nil
+}
+
+// RedeemSignupInvite checks the invite, counts the use and creates the user
+// in one transaction, so concurrent signups can't go over its limit and a
+// signup that fails doesn't use it up.
+func (sis *SignupInviteStore) RedeemSignupInvite(code string, u *models.User) (*models.SignupInvite, error) {
+	if u.D == nil {
+		u.D = &models.UserMetadata{}
+	}
+	var inv *models.SignupInvite
+	err := sis.Update(func(tx *bolt.Tx) error {
+		var err error
+		inv, err = getSignupInviteByCode(tx, code)
+		if err != nil {
+			return err
+		}
+		if !inv.IsUsable(timeNow()) {
+			return aderrors.ErrExpired
+		}
+		inv.UsedBy = append(inv.UsedBy, u.ID)
+		if err := putSignupInvite(tx, inv); err != nil {
+			return err
+		}
+		u.D.SignupInviteID = inv.ID
+		return createUser(tx, u)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error redeeming signup invite: %w", err)
+	}
+	return inv, nil
+}
+
+// RevokeSignupInvite stops the invite from being used. It's kept, so it's
+// still known which accounts signed up with it.
+func (sis *SignupInviteStore) RevokeSignupInvite(id string) error {
+	err := sis.Update(func(tx *bolt.Tx) error {
+		inv, err := getSignupInvite(tx, []byte(id))
+		if err != nil {
+			return err
+		}
+		if !inv.RevokedTime.IsZero() {
+			return nil
+		}
+		inv.RevokedTime = timeNow()
+		return putSignupInvite(tx, inv)
+	})
+	if err != nil {
+		return fmt.Errorf("error revoking signup invite %s: %w", id, err)
+	}
+	return nil
+}
+
+func putSignupInvite(tx *bolt.Tx, inv *models.SignupInvite) error {
+	b := tx.Bucket(SignupInviteBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(SignupInviteBucket))
+	}
+	cb := tx.Bucket(signupInviteCodeBucket)
+	if cb == nil {
+		return fmt.Errorf("no %s bucket exists", string(signupInviteCodeBucket))
+	}
+	iJSON, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(inv.ID), iJSON); err != nil {
+		return err
+	}
+	return cb.Put([]byte(inv.CodeHash), []byte(inv.ID))
+}
+
+func getSignupInvite(tx *bolt.Tx, id []byte) (*models.SignupInvite, error) {
+	b := tx.Bucket(SignupInviteBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(SignupInviteBucket))
+	}
+	iJSON := b.Get(id)
+	if iJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var inv models.SignupInvite
+	if err := json.Unmarshal(iJSON, &inv); err != nil {
+		return nil, err
+	}
+	return &inv, nil
+}
+
+func getSignupInviteByCode(tx *bolt.Tx, code string) (*models.SignupInvite, error) {
+	cb := tx.Bucket(signupInviteCodeBucket)
+	if cb == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(signupInviteCodeBucket))
+	}
+	id := cb.Get([]byte(models.HashSignupInviteCode(code)))
+	if id == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	return getSignupInvite(tx, id)
+}
+
+// deleteSignupInvites deletes the invites the user created, for when their
+// account is purged. Accounts created with them keep the invite's ID.
+func deleteSignupInvites(tx *bolt.Tx, userID string) error {
+	cb := tx.Bucket(signupInviteCodeBucket)
+	if cb == nil {
+		return fmt.Errorf("no %s bucket exists", string(signupInviteCodeBucket))
+	}
+	return deleteOwned(tx, SignupInviteBucket, userID, func(v []byte) error {
+		var inv models.SignupInvite
+		if err := json.Unmarshal(v, &inv); err != nil {
+			return err
+		}
+		return cb.Delete([]byte(inv.CodeHash))
+	})
+}
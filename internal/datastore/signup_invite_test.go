@@ -0,0 +1,76 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestSignupInviteRedeem(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	sis := &datastore.SignupInviteStore{BDB: db}
+	us := &datastore.UserStore{BDB: db}
+	newUser := func(username string) *models.User {
+		u := &models.User{Username: username, Email: username + "@example.com", Password: "$argon2id$placeholder", D: &models.UserMetadata{}}
+		u.GenerateID()
+		return u
+	}
+
+	inv := &models.SignupInvite{UserID: "alice", MaxUses: 2, ExpiryTime: time.Now().Add(time.Hour)}
+	code, err := sis.CreateSignupInvite(inv)
+	ok(t, err)
+	assert(t, inv.ID != "", "expected the invite to get an ID")
+	assert(t, inv.CodeHash != code, "the code shouldn't be stored in the clear")
+
+	bob, carol := newUser("bob"), newUser("carol")
+	got, err := sis.RedeemSignupInvite(code, bob)
+	ok(t, err)
+	equals(t, inv.ID, got.ID)
+	saved, err := us.Get(bob.ID)
+	ok(t, err)
+	equals(t, inv.ID, saved.D.SignupInviteID)
+
+	// A signup that fails doesn't use the invite up
+	bad := newUser("eve")
+	bad.Password = ""
+	_, err = sis.RedeemSignupInvite(code, bad)
+	assert(t, err != nil, "expected a user without a password not to be created")
+	_, err = us.Get(bad.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected no user to be created, got %v", err)
+
+	_, err = sis.RedeemSignupInvite(code, carol)
+	ok(t, err)
+	dave := newUser("dave")
+	_, err = sis.RedeemSignupInvite(code, dave)
+	assert(t, errors.Is(err, aderrors.ErrExpired), "expected a used up invite to be refused, got %v", err)
+	_, err = us.Get(dave.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected no user to be created, got %v", err)
+	got, err = sis.GetSignupInvite(inv.ID)
+	ok(t, err)
+	equals(t, []string{bob.ID, carol.ID}, got.UsedBy)
+
+	_, err = sis.RedeemSignupInvite("not a code", dave)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected an unknown code to be refused, got %v", err)
+
+	other := &models.SignupInvite{UserID: "bob"}
+	code, err = sis.CreateSignupInvite(other)
+	ok(t, err)
+	ok(t, sis.RevokeSignupInvite(other.ID))
+	_, err = sis.RedeemSignupInvite(code, dave)
+	assert(t, errors.Is(err, aderrors.ErrExpired), "expected a revoked invite to be refused, got %v", err)
+
+	invs, err := sis.GetSignupInvites("alice")
+	ok(t, err)
+	equals(t, 1, len(invs))
+	invs, err = sis.GetSignupInvites("")
+	ok(t, err)
+	equals(t, 2, len(invs))
+	// IDs made in the same millisecond aren't ordered, so only check both
+	// invites are there
+	assert(t, invs[0].ID != invs[1].ID && (invs[0].ID == other.ID || invs[1].ID == other.ID), "expected both invites, got %v", invs)
+}
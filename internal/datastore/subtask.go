@@ -0,0 +1,361 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/fracindex"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func (tdstr *TodoStore) GetChildren(id, userID string) ([]*models.Todo, error) {
+	var children []*models.Todo
+	err := tdstr.View(func(tx *bolt.Tx) error {
+		td, err := getTodo(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosRead); err != nil {
+			return err
+		}
+		tree, err := loadTodoTree(tx, td)
+		if err != nil {
+			return err
+		}
+		children = tree.children[id]
+		for _, child := range children {
+			if err := linkTodo(tx, child); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving subtasks of todo %s: %w", id, err)
+	}
+	if children == nil {
+		children = []*models.Todo{}
+	}
+	return children, nil
+}
+
+// Move only saves the moved todo, unless its new siblings are todos made
+// before they had positions, which are given them first.
+func (tdstr *TodoStore) Move(id, userID string, m *models.TodoMove) (*models.Todo, error) {
+	var td *models.Todo
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		td, err = getTodo(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		tree, err := loadTodoTree(tx, td)
+		if err != nil {
+			return err
+		}
+
+		var ve aderrors.ValidationError
+		depth := 0
+		if m.ParentID != "" {
+			parent := tree.todos[m.ParentID]
+			if parent == nil {
+				ve.Add("parent", "parent_not_found", "There's no such todo to move it under.")
+				return ve
+			}
+			if tree.isAncestor(td.ID, parent) {
+				ve.Add("parent", "move_cycle", "A todo can't be moved under itself or one of its subtasks.")
+				return ve
+			}
+			depth = tree.depth(parent)
+		}
+		if depth+tree.height(td) > tdstr.maxDepth() {
+			ve.Add("parent", "too_deep", fmt.Sprintf("Subtasks can only be nested %d deep.", tdstr.maxDepth()))
+			return ve
+		}
+
+		siblings := []*models.Todo{}
+		for _, sib := range tree.children[m.ParentID] {
+			if sib.ID != td.ID {
+				siblings = append(siblings, sib)
+			}
+		}
+		if err := ensurePositions(tx, siblings); err != nil {
+			return err
+		}
+		after, before, ok := neighbours(todoKeys(siblings, false), m.AfterID, m.BeforeID)
+		if !ok {
+			ve.Add("position", "position_invalid", "The todos to move it after and before need to be next to each other under its new parent.")
+			return ve
+		}
+		pos, err := fracindex.Between(after, before)
+		if err != nil {
+			return err
+		}
+
+		oldParentID := td.ParentID
+		td.ParentID, td.Position = m.ParentID, pos
+		if err := linkTodo(tx, td); err != nil {
+			return err
+		}
+		if err := putTodo(tx, td); err != nil {
+			return err
+		}
+		if err := syncAutoComplete(tx, td, oldParentID); err != nil {
+			return err
+		}
+		return syncAutoComplete(tx, td, td.ParentID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error moving todo %s: %w", id, err)
+	}
+	return td, nil
+}
+
+func (tdstr *TodoStore) maxDepth() int {
+	if tdstr.MaxDepth > 0 {
+		return tdstr.MaxDepth
+	}
+	return models.DefaultMaxTodoDepth
+}
+
+// placeSubtask checks the new todo can go under its parent, and gives it
+// the position after its last sibling.
+func (tdstr *TodoStore) placeSubtask(tx *bolt.Tx, td *models.Todo) error {
+	tree, err := loadTodoTree(tx, td)
+	if err != nil {
+		return err
+	}
+	var ve aderrors.ValidationError
+	if td.ParentID != "" {
+		parent := tree.todos[td.ParentID]
+		if parent == nil {
+			ve.Add("parent", "parent_not_found", "There's no such todo to put it under.")
+			return ve
+		}
+		if tree.depth(parent)+1 > tdstr.maxDepth() {
+			ve.Add("parent", "too_deep", fmt.Sprintf("Subtasks can only be nested %d deep.", tdstr.maxDepth()))
+			return ve
+		}
+	}
+	last := ""
+	if siblings := tree.children[td.ParentID]; len(siblings) > 0 {
+		last = siblings[len(siblings)-1].Position
+	}
+	td.Position, err = fracindex.Between(last, "")
+	return err
+}
+
+// placeAfter gives the new todo the position right after td among td's
+// siblings, so the next occurrence of a recurring todo takes its place.
+func placeAfter(tx *bolt.Tx, td, next *models.Todo) error {
+	tree, err := loadTodoTree(tx, td)
+	if err != nil {
+		return err
+	}
+	siblings := tree.children[td.ParentID]
+	if err := ensurePositions(tx, siblings); err != nil {
+		return err
+	}
+	if cur := tree.todos[td.ID]; cur != nil {
+		td.Position = cur.Position
+	}
+	after, before, _ := neighbours(todoKeys(siblings, false), td.ID, "")
+	next.Position, err = fracindex.Between(after, before)
+	return err
+}
+
+// orderKey is the ID and fracindex position of something kept in order.
+type orderKey struct {
+	id, position string
+}
+
+// todoKeys returns the order keys of todos, by Position or CardPosition.
+func todoKeys(todos []*models.Todo, cards bool) []orderKey {
+	keys := make([]orderKey, 0, len(todos))
+	for _, td := range todos {
+		pos := td.Position
+		if cards {
+			pos = td.CardPosition
+		}
+		keys = append(keys, orderKey{td.ID, pos})
+	}
+	return keys
+}
+
+// neighbours returns the positions to put something between so it's after
+// afterID or before beforeID among keys, which are in order, or last
+// without either. It returns false if they aren't among keys, or aren't
+// next to each other.
+func neighbours(keys []orderKey, afterID, beforeID string) (string, string, bool) {
+	index := func(id string) int {
+		for i, k := range keys {
+			if k.id == id {
+				return i
+			}
+		}
+		return -1
+	}
+	position := func(i int) string {
+		if i < 0 || i >= len(keys) {
+			return ""
+		}
+		return keys[i].position
+	}
+
+	switch {
+	case afterID != "":
+		i := index(afterID)
+		if i < 0 || (beforeID != "" && index(beforeID) != i+1) {
+			return "", "", false
+		}
+		return position(i), position(i + 1), true
+	case beforeID != "":
+		i := index(beforeID)
+		if i < 0 {
+			return "", "", false
+		}
+		return position(i - 1), position(i), true
+	}
+	return position(len(keys) - 1), "", true
+}
+
+// ensurePositions gives the siblings positions in their current order if
+// any of them doesn't have one, as todos made before positions didn't, or
+// shares one with another, as next occurrences of recurring todos once did.
+func ensurePositions(tx *bolt.Tx, siblings []*models.Todo) error {
+	missing := false
+	for i, sib := range siblings {
+		missing = missing || sib.Position == "" || (i > 0 && sib.Position == siblings[i-1].Position)
+	}
+	if !missing {
+		return nil
+	}
+	pos := ""
+	for _, sib := range siblings {
+		var err error
+		if pos, err = fracindex.Between(pos, ""); err != nil {
+			return err
+		}
+		sib.Position = pos
+		if err := putRecord(tx, TodoBucket, sib.ID, sib); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncAutoComplete marks the parent done if it auto-completes and all its
+// subtasks are done, or not done if one isn't, and so on up the tree.
+func syncAutoComplete(tx *bolt.Tx, owner *models.Todo, parentID string) error {
+	if parentID == "" {
+		return nil
+	}
+	tree, err := loadTodoTree(tx, owner)
+	if err != nil {
+		return err
+	}
+	for parent := tree.todos[parentID]; parent != nil && parent.AutoComplete; parent = tree.todos[parent.ParentID] {
+		children := tree.children[parent.ID]
+		if len(children) == 0 {
+			return nil
+		}
+		done := true
+		for _, child := range children {
+			done = done && child.IsDone.Bool
+		}
+		if parent.IsDone.Bool == done {
+			return nil
+		}
+		parent.IsDone = null.BoolFrom(done)
+		if err := putTodo(tx, parent); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// todoTree is all the todos with the same owner, as a user or an org, by
+// ID and by parent, leaving out those in the trash. Each parent's children are in order.
+type todoTree struct {
+	todos    map[string]*models.Todo
+	children map[string][]*models.Todo
+}
+
+func loadTodoTree(tx *bolt.Tx, owner *models.Todo) (*todoTree, error) {
+	b := tx.Bucket(TodoBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(TodoBucket))
+	}
+	tree := &todoTree{todos: map[string]*models.Todo{}, children: map[string][]*models.Todo{}}
+	err := b.ForEach(func(k, v []byte) error {
+		var td models.Todo
+		if err := json.Unmarshal(v, &td); err != nil {
+			return err
+		}
+		if td.OrgID == owner.OrgID && (td.OrgID != "" || td.UserID == owner.UserID) && !td.IsTrashed() {
+			tree.todos[td.ID] = &td
+			tree.children[td.ParentID] = append(tree.children[td.ParentID], &td)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, children := range tree.children {
+		sortTodos(children)
+	}
+	return tree, nil
+}
+
+// depth returns how deep td is, counting a todo without a parent as 1.
+func (t *todoTree) depth(td *models.Todo) int {
+	d := 1
+	for p := t.todos[td.ParentID]; p != nil; p = t.todos[p.ParentID] {
+		d++
+		if d > len(t.todos) {
+			break
+		}
+	}
+	return d
+}
+
+// height returns how many levels td and its subtasks take up.
+func (t *todoTree) height(td *models.Todo) int {
+	h := 0
+	for _, child := range t.children[td.ID] {
+		if ch := t.height(child); ch > h {
+			h = ch
+		}
+	}
+	return h + 1
+}
+
+// isAncestor returns whether the todo with the ID is td or one of its
+// parents.
+func (t *todoTree) isAncestor(id string, td *models.Todo) bool {
+	for i := 0; td != nil && i <= len(t.todos); i++ {
+		if td.ID == id {
+			return true
+		}
+		td = t.todos[td.ParentID]
+	}
+	return false
+}
+
+// sortTodos orders todos by position, then by ID, so todos made before
+// positions come first in the order they were made.
+func sortTodos(todos []*models.Todo) {
+	sort.SliceStable(todos, func(i, j int) bool {
+		if todos[i].Position != todos[j].Position {
+			return todos[i].Position < todos[j].Position
+		}
+		return todos[i].ID < todos[j].ID
+	})
+}
@@ -0,0 +1,115 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestSubtasks(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db, MaxDepth: 3}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	create := func(id, parentID string) *models.Todo {
+		td := &models.Todo{ID: id, UserID: alice.ID, Name: null.StringFrom(id), ParentID: parentID}
+		_, err := ts.Create(td)
+		ok(t, err)
+		return td
+	}
+	childIDs := func(id string) []string {
+		children, err := ts.GetChildren(id, alice.ID)
+		ok(t, err)
+		ids := []string{}
+		for _, c := range children {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	validationCode := func(err error) string {
+		var ve aderrors.ValidationError
+		if !errors.As(err, &ve) {
+			t.Fatalf("expected a validation error, got %v", err)
+		}
+		return ve.Fields[0].Code
+	}
+
+	create("a", "")
+	create("b", "a")
+	create("c", "a")
+	create("d", "a")
+	equals(t, []string{"b", "c", "d"}, childIDs("a"))
+	_, err := ts.GetChildren("a", bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to see alice's subtasks, got %v", err)
+
+	// Reordering only changes the moved todo
+	before, err := ts.Get("c")
+	ok(t, err)
+	moved, err := ts.Move("d", alice.ID, &models.TodoMove{ParentID: "a", AfterID: "b", BeforeID: "c"})
+	ok(t, err)
+	equals(t, []string{"b", "d", "c"}, childIDs("a"))
+	after, err := ts.Get("c")
+	ok(t, err)
+	equals(t, before.Position, after.Position)
+	assert(t, moved.Position < after.Position, "expected d's position %q before c's %q", moved.Position, after.Position)
+
+	_, err = ts.Move("b", alice.ID, &models.TodoMove{ParentID: "a", AfterID: "b"})
+	equals(t, "position_invalid", validationCode(err))
+	_, err = ts.Move("b", alice.ID, &models.TodoMove{ParentID: "a", AfterID: "d", BeforeID: "b"})
+	equals(t, "position_invalid", validationCode(err))
+
+	// Nesting
+	create("e", "b")
+	_, err = ts.Create(&models.Todo{ID: "f", UserID: alice.ID, ParentID: "e"})
+	equals(t, "too_deep", validationCode(err))
+	_, err = ts.Create(&models.Todo{ID: "g", UserID: bob.ID, ParentID: "a"})
+	equals(t, "parent_not_found", validationCode(err))
+	_, err = ts.Move("a", alice.ID, &models.TodoMove{ParentID: "e"})
+	equals(t, "move_cycle", validationCode(err))
+	_, err = ts.Move("b", alice.ID, &models.TodoMove{ParentID: "c"})
+	equals(t, "too_deep", validationCode(err))
+	_, err = ts.Move("b", bob.ID, &models.TodoMove{})
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to move alice's todo, got %v", err)
+
+	// Moving to the top level
+	_, err = ts.Move("e", alice.ID, &models.TodoMove{BeforeID: "a"})
+	ok(t, err)
+	equals(t, []string{}, childIDs("b"))
+	e, err := ts.Get("e")
+	ok(t, err)
+	equals(t, "", e.ParentID)
+
+	// Auto-completing
+	a, err := ts.Get("a")
+	ok(t, err)
+	a.AutoComplete = true
+	_, err = ts.Update(a, alice.ID)
+	ok(t, err)
+	for _, id := range []string{"b", "c", "d"} {
+		td, err := ts.Get(id)
+		ok(t, err)
+		td.IsDone = null.BoolFrom(true)
+		_, err = ts.Update(td, alice.ID)
+		ok(t, err)
+	}
+	a, err = ts.Get("a")
+	ok(t, err)
+	assert(t, a.IsDone.Bool, "expected a to be done with all its subtasks")
+
+	create("h", "a")
+	a, err = ts.Get("a")
+	ok(t, err)
+	assert(t, !a.IsDone.Bool, "expected a not to be done with a new subtask")
+	_, err = ts.Move("h", alice.ID, &models.TodoMove{})
+	ok(t, err)
+	a, err = ts.Get("a")
+	ok(t, err)
+	assert(t, a.IsDone.Bool, "expected a to be done again once h moved out")
+}
@@ -2,7 +2,9 @@ package datastore
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"sort"
 
 	"github.com/boltdb/bolt"
 	"github.com/ejamesc/auth_demo/internal/aderrors"
@@ -10,51 +12,390 @@ import (
 	null "gopkg.in/guregu/null.v3"
 )
 
-type TodoStore struct{ *BDB }
+// TodoStore keeps todos. MaxDepth is how deep subtasks can be nested, and
+// is models.DefaultMaxTodoDepth if it's 0.
+type TodoStore struct {
+	*BDB
+	MaxDepth int
+}
 
 func (tdstr *TodoStore) Get(id string) (*models.Todo, error) {
-	var todo models.Todo
+	var todo *models.Todo
+	err := tdstr.View(func(tx *bolt.Tx) error {
+		var err error
+		todo, err = getTodo(tx, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return todo, nil
+}
+
+// GetByUserID returns the todos owned by a user, ordered by ID. Todos they
+// created in an org belong to the org, and aren't included.
+func (tdstr *TodoStore) GetByUserID(userID string) ([]*models.Todo, error) {
+	todos := []*models.Todo{}
 	err := tdstr.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(TodoBucket)
 		if b == nil {
 			return fmt.Errorf("no %s bucket exists", string(TodoBucket))
 		}
-		tJSON := b.Get([]byte(id))
-		if tJSON == nil {
-			return aderrors.ErrNoRecords
+		return b.ForEach(func(k, v []byte) error {
+			var todo models.Todo
+			if err := json.Unmarshal(v, &todo); err != nil {
+				return err
+			}
+			if todo.UserID == userID && todo.OrgID == "" && !todo.IsTrashed() {
+				todos = append(todos, &todo)
+				return linkTodo(tx, &todo)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving todos for user %s: %w", userID, err)
+	}
+	return todos, nil
+}
+
+// GetByOrgID returns the todos owned by an org, ordered by ID. The user's
+// membership is checked in the same transaction: non-members get
+// aderrors.ErrNoRecords, and members whose role doesn't let them read
+// todos an aderrors.PermissionError.
+func (tdstr *TodoStore) GetByOrgID(orgID, userID string) ([]*models.Todo, error) {
+	todos := []*models.Todo{}
+	err := tdstr.View(func(tx *bolt.Tx) error {
+		if err := authorizeOrg(tx, orgID, userID, models.PermTodosRead); err != nil {
+			return err
+		}
+		b := tx.Bucket(TodoBucket)
+		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(TodoBucket))
 		}
-		return json.Unmarshal(tJSON, &todo)
+		return b.ForEach(func(k, v []byte) error {
+			var todo models.Todo
+			if err := json.Unmarshal(v, &todo); err != nil {
+				return err
+			}
+			if todo.OrgID == orgID && !todo.IsTrashed() {
+				todos = append(todos, &todo)
+				return linkTodo(tx, &todo)
+			}
+			return nil
+		})
 	})
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("error retrieving todos for org %s: %w", orgID, err)
 	}
-	return &todo, nil
+	return todos, nil
 }
 
+// Create saves the todo. An org todo is only saved if its creator may write
+// the org's todos, checked as in GetByOrgID. A subtask goes after its
+// siblings, whatever Position it's given, and it's only put on a board by
+// a BoardService.
 func (tdstr *TodoStore) Create(td *models.Todo) (bool, error) {
 	// Validations
 	if td.ID == "" {
 		return false, aderrors.ErrNoID
 	}
-	if t, _ := tdstr.Get(td.ID); t != nil {
+	// A todo in the trash still has its ID
+	if err := tdstr.View(func(tx *bolt.Tx) error {
+		_, err := getTodoOrTrashed(tx, td.ID)
+		return err
+	}); err == nil {
 		return false, aderrors.ErrAlreadyExists
 	}
 
 	td.DateCreated = null.NewTime(timeNow(), true)
-	err := tdstr.Update(func(tx *bolt.Tx) error {
+	td.ColumnID, td.CardPosition = "", ""
+	td.DeletedAt, td.TrashID, td.DeletedBy = null.Time{}, "", ""
+	if td.IsRecurring() && td.SeriesID == "" {
+		td.StartSeries()
+	}
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		if td.OrgID != "" {
+			if err := authorizeOrg(tx, td.OrgID, td.UserID, models.PermTodosWrite); err != nil {
+				return err
+			}
+		}
+		if err := tdstr.placeSubtask(tx, td); err != nil {
+			return err
+		}
+		if err := linkTodo(tx, td); err != nil {
+			return err
+		}
+		if err := putTodo(tx, td); err != nil {
+			return err
+		}
+		if td.Notes != "" {
+			if err := addNoteRevision(tx, td, td.UserID, 0); err != nil {
+				return err
+			}
+		}
+		return syncAutoComplete(tx, td, td.ParentID)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error saving todo item: %w", err)
+	}
+
+	return true, nil
+}
+
+// Update saves changes to the todo, checking userID may write it as in
+// Create. When it completes an occurrence of a recurring todo that wasn't
+// already done, the next occurrence is created and linked from it by
+// NextID. Changing its notes saves them as a new revision. Where it is
+// among its siblings is only changed by Move, and
+// where it is on a board by a BoardService.
+func (tdstr *TodoStore) Update(td *models.Todo, userID string) (*models.Todo, error) {
+	if td.ID == "" {
+		return nil, aderrors.ErrNoID
+	}
+	var next *models.Todo
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		cur, err := getTodo(tx, td.ID)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, cur, userID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		// Who owns it, when it was made and where it is can't be changed here
+		td.UserID, td.OrgID, td.DateCreated = cur.UserID, cur.OrgID, cur.DateCreated
+		td.ParentID, td.Position = cur.ParentID, cur.Position
+		td.ColumnID, td.CardPosition = cur.ColumnID, cur.CardPosition
+		td.DeletedAt, td.TrashID, td.DeletedBy = cur.DeletedAt, cur.TrashID, cur.DeletedBy
+		if err := linkTodo(tx, td); err != nil {
+			return err
+		}
+
+		if td.IsDone.Bool && !cur.IsDone.Bool && td.NextID == "" {
+			next, err = td.NextOccurrence()
+			if err != nil {
+				return err
+			}
+			if next != nil {
+				next.DateCreated = null.NewTime(timeNow(), true)
+				td.NextID = next.ID
+				if err := placeAfter(tx, td, next); err != nil {
+					return err
+				}
+				if err := putTodo(tx, next); err != nil {
+					return err
+				}
+				if next.Notes != "" {
+					if err := addNoteRevision(tx, next, userID, 0); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		if err := putTodo(tx, td); err != nil {
+			return err
+		}
+		if td.Notes != cur.Notes {
+			if err := addNoteRevision(tx, td, userID, 0); err != nil {
+				return err
+			}
+		}
+		return syncAutoComplete(tx, td, td.ParentID)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error updating todo %s: %w", td.ID, err)
+	}
+	return next, nil
+}
+
+func (tdstr *TodoStore) Skip(id, userID string) (*models.Todo, error) {
+	var td *models.Todo
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		td, err = getTodo(tx, id)
+		if err != nil {
+			return err
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		skipped, err := td.Skip()
+		if err != nil {
+			return err
+		}
+		if !skipped {
+			return aderrors.ErrNoRecords
+		}
+		return putTodo(tx, td)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error skipping occurrence of todo %s: %w", id, err)
+	}
+	return td, nil
+}
+
+// GetSeries returns the occurrences in the series, ordered by when they
+// were scheduled. Whether the user may read them is checked on the first,
+// as they all belong to the same user or org.
+func (tdstr *TodoStore) GetSeries(seriesID, userID string) ([]*models.Todo, error) {
+	todos := []*models.Todo{}
+	err := tdstr.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket(TodoBucket)
 		if b == nil {
 			return fmt.Errorf("no %s bucket exists", string(TodoBucket))
 		}
-		tjson, err := json.Marshal(td)
+		err := b.ForEach(func(k, v []byte) error {
+			var todo models.Todo
+			if err := json.Unmarshal(v, &todo); err != nil {
+				return err
+			}
+			if todo.SeriesID == seriesID && !todo.IsTrashed() {
+				todos = append(todos, &todo)
+				return linkTodo(tx, &todo)
+			}
+			return nil
+		})
 		if err != nil {
 			return err
 		}
-		return b.Put([]byte(td.ID), tjson)
+		if len(todos) == 0 {
+			return aderrors.ErrNoRecords
+		}
+		return authorizeTodo(tx, todos[0], userID, models.PermTodosRead)
 	})
 	if err != nil {
-		return false, fmt.Errorf("error saving todo item: %w", err)
+		return nil, fmt.Errorf("error retrieving todo series %s: %w", seriesID, err)
 	}
+	sort.SliceStable(todos, func(i, j int) bool {
+		return todos[i].RecurrenceID.Time.Before(todos[j].RecurrenceID.Time)
+	})
+	return todos, nil
+}
 
-	return true, nil
+// authorizeTodo checks the user may use the todo: their own todos are
+// theirs to do anything with, and org todos are checked as in authorizeOrg.
+// Other users' todos are aderrors.ErrNoRecords.
+func authorizeTodo(tx *bolt.Tx, td *models.Todo, userID string, perm models.Permission) error {
+	if td.OrgID != "" {
+		return authorizeOrg(tx, td.OrgID, userID, perm)
+	}
+	if td.UserID != userID {
+		return aderrors.ErrNoRecords
+	}
+	return nil
+}
+
+// linkTodo fills in the todo's relationships from their IDs. Its list,
+// labels and column have to belong to the user whose todo it is, so org
+// todos can't have any; one that doesn't exist or isn't theirs is an
+// aderrors.ValidationError.
+func linkTodo(tx *bolt.Tx, td *models.Todo) error {
+	var ve aderrors.ValidationError
+	td.List, td.Labels, td.Parent, td.Column = nil, []*models.Label{}, nil, nil
+	if td.ParentID != "" {
+		td.Parent = &models.Todo{ID: td.ParentID}
+	}
+	if td.OrgID != "" {
+		if td.ListID != "" || len(td.LabelIDs) > 0 || td.ColumnID != "" {
+			ve.Add("list", "org_todo_list", "Only your own todos can be put in lists, labelled or put on boards.")
+			return ve
+		}
+		return nil
+	}
+	if td.ListID != "" {
+		var l models.List
+		err := getOwnedRecord(tx, ListBucket, td.UserID, td.ListID, &l)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			ve.Add("list", "list_not_found", "There's no such list of yours.")
+		} else if err != nil {
+			return err
+		} else {
+			td.List = &l
+		}
+	}
+	if td.ColumnID != "" {
+		var c models.Column
+		err := getOwnedRecord(tx, ColumnBucket, td.UserID, td.ColumnID, &c)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			ve.Add("column", "column_not_found", "There's no such column of yours.")
+		} else if err != nil {
+			return err
+		} else {
+			c.Board = &models.Board{ID: c.BoardID}
+			td.Column = &c
+		}
+	}
+	for _, id := range td.LabelIDs {
+		var l models.Label
+		err := getOwnedRecord(tx, LabelBucket, td.UserID, id, &l)
+		if errors.Is(err, aderrors.ErrNoRecords) {
+			ve.Add("labels", "label_not_found", fmt.Sprintf("There's no label %s of yours.", id))
+		} else if err != nil {
+			return err
+		} else {
+			td.Labels = append(td.Labels, &l)
+		}
+	}
+	if ve.HasErrors() {
+		return ve
+	}
+	return nil
+}
+
+// getTodo returns aderrors.ErrNoRecords for a todo in the trash, as if it
+// had been deleted.
+func getTodo(tx *bolt.Tx, id string) (*models.Todo, error) {
+	td, err := getTodoOrTrashed(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if td.IsTrashed() {
+		return nil, aderrors.ErrNoRecords
+	}
+	return td, nil
+}
+
+func getTodoOrTrashed(tx *bolt.Tx, id string) (*models.Todo, error) {
+	b := tx.Bucket(TodoBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(TodoBucket))
+	}
+	tJSON := b.Get([]byte(id))
+	if tJSON == nil {
+		return nil, aderrors.ErrNoRecords
+	}
+	var td models.Todo
+	if err := json.Unmarshal(tJSON, &td); err != nil {
+		return nil, err
+	}
+	if err := linkTodo(tx, &td); err != nil {
+		return nil, err
+	}
+	return &td, nil
+}
+
+// putTodo saves the todo and schedules its reminder.
+func putTodo(tx *bolt.Tx, td *models.Todo) error {
+	b := tx.Bucket(TodoBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(TodoBucket))
+	}
+	var old *models.Todo
+	if v := b.Get([]byte(td.ID)); v != nil {
+		old = new(models.Todo)
+		if err := json.Unmarshal(v, old); err != nil {
+			return err
+		}
+	}
+	tJSON, err := json.Marshal(td)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(td.ID), tJSON); err != nil {
+		return err
+	}
+	if err := indexTodo(tx, td); err != nil {
+		return err
+	}
+	return scheduleReminder(tx, old, td)
 }
@@ -0,0 +1,128 @@
+package datastore_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestTodoRecurrence(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	rs := &datastore.ReminderStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	due := time.Now().UTC().Truncate(time.Second).Add(24 * time.Hour)
+	td := &models.Todo{
+		ID:       "a",
+		UserID:   alice.ID,
+		Name:     null.StringFrom("stand-up"),
+		DueAt:    null.TimeFrom(due),
+		RemindAt: null.TimeFrom(due.Add(-time.Hour)),
+		RRule:    null.StringFrom("FREQ=DAILY;COUNT=3"),
+	}
+	_, err := ts.Create(td)
+	ok(t, err)
+	equals(t, "a", td.SeriesID)
+
+	td.IsDone = null.BoolFrom(true)
+	_, err = ts.Update(td, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to be able to update alice's todo, got %v", err)
+	next, err := ts.Update(td, alice.ID)
+	ok(t, err)
+	equals(t, next.ID, td.NextID)
+	equals(t, due.Add(24*time.Hour), next.DueAt.Time)
+	equals(t, alice.ID, next.UserID)
+
+	// Only the first completion creates the next occurrence
+	again, err := ts.Update(td, alice.ID)
+	ok(t, err)
+	assert(t, again == nil, "expected no other occurrence, got %v", again)
+
+	// The reminder moved to the next occurrence
+	nextReminder, err := rs.NextReminderTime()
+	ok(t, err)
+	equals(t, due.Add(23*time.Hour), nextReminder)
+
+	skipped, err := ts.Skip(next.ID, alice.ID)
+	ok(t, err)
+	equals(t, due.Add(48*time.Hour), skipped.DueAt.Time)
+	equals(t, []string{due.Add(24 * time.Hour).Format(models.ExDateFormat)}, skipped.ExDates)
+	_, err = ts.Skip(next.ID, alice.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the series to have ended, got %v", err)
+
+	series, err := ts.GetSeries("a", alice.ID)
+	ok(t, err)
+	equals(t, 2, len(series))
+	equals(t, "a", series[0].ID)
+	equals(t, next.ID, series[1].ID)
+	_, err = ts.GetSeries("a", bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to see alice's series, got %v", err)
+}
+
+func TestRecurringTodoPosition(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+
+	for _, td := range []*models.Todo{
+		{ID: "a", UserID: alice.ID, Name: null.StringFrom("stand-up"), DueAt: null.TimeFrom(time.Now().UTC()), RRule: null.StringFrom("FREQ=DAILY")},
+		{ID: "b", UserID: alice.ID, Name: null.StringFrom("retro")},
+	} {
+		_, err := ts.Create(td)
+		ok(t, err)
+	}
+	td, err := ts.Get("a")
+	ok(t, err)
+	td.IsDone = null.BoolFrom(true)
+	next, err := ts.Update(td, alice.ID)
+	ok(t, err)
+	positions := func() (string, string, string) {
+		a, err := ts.Get("a")
+		ok(t, err)
+		n, err := ts.Get(next.ID)
+		ok(t, err)
+		b, err := ts.Get("b")
+		ok(t, err)
+		return a.Position, n.Position, b.Position
+	}
+
+	// The next occurrence goes right after the one completed
+	a, n, b := positions()
+	assert(t, a < n && n < b, "expected the next occurrence between a and b, got %q %q %q", a, n, b)
+	_, err = ts.Move("b", alice.ID, &models.TodoMove{AfterID: "a", BeforeID: next.ID})
+	ok(t, err)
+	a, n, b = positions()
+	assert(t, a < b && b < n, "expected b between the occurrences, got %q %q %q", a, b, n)
+
+	// Occurrences that were given the same position are spread out again
+	ok(t, db.Update(func(tx *bolt.Tx) error {
+		bt := tx.Bucket(datastore.TodoBucket)
+		var n models.Todo
+		if err := json.Unmarshal(bt.Get([]byte(next.ID)), &n); err != nil {
+			return err
+		}
+		n.Position = a
+		v, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		return bt.Put([]byte(next.ID), v)
+	}))
+	_, err = ts.Move("b", alice.ID, &models.TodoMove{AfterID: next.ID})
+	ok(t, err)
+	a, n, b = positions()
+	assert(t, a != n && n < b, "expected the occurrences apart and b after the next one, got %q %q %q", a, n, b)
+}
@@ -0,0 +1,328 @@
+package datastore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/fracindex"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+// Todos in the trash stay in TodoBucket with their DeletedAt set. getTodo
+// and loadTodoTree leave them out, so only the methods here see them.
+
+// Delete satisfies the models.TodoService interface. The undo token is the
+// TrashID of the batch.
+func (tdstr *TodoStore) Delete(ids []string, userID string) (string, error) {
+	trashID := models.NewTrashID()
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		todos := make([]*models.Todo, 0, len(ids))
+		for _, id := range ids {
+			td, err := getTodo(tx, id)
+			if err != nil {
+				return err
+			}
+			if err := authorizeTodo(tx, td, userID, models.PermTodosWrite); err != nil {
+				return err
+			}
+			todos = append(todos, td)
+		}
+		now := timeNow()
+		for _, td := range todos {
+			if err := trashTodo(tx, td, trashID, userID, now); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("error deleting todos: %w", err)
+	}
+	return trashID, nil
+}
+
+func (tdstr *TodoStore) GetTrash(orgID, userID string) ([]*models.Todo, error) {
+	var todos []*models.Todo
+	err := tdstr.View(func(tx *bolt.Tx) error {
+		if orgID != "" {
+			if err := authorizeOrg(tx, orgID, userID, models.PermTodosRead); err != nil {
+				return err
+			}
+		}
+		var err error
+		todos, err = trashedTodos(tx, func(td *models.Todo) bool {
+			return td.OrgID == orgID && (orgID != "" || td.UserID == userID)
+		})
+		if err != nil {
+			return err
+		}
+		for _, td := range todos {
+			if err := linkTodo(tx, td); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving trash: %w", err)
+	}
+	sort.SliceStable(todos, func(i, j int) bool {
+		if !todos[i].DeletedAt.Time.Equal(todos[j].DeletedAt.Time) {
+			return todos[i].DeletedAt.Time.After(todos[j].DeletedAt.Time)
+		}
+		return todos[i].ID < todos[j].ID
+	})
+	return todos, nil
+}
+
+func (tdstr *TodoStore) Restore(id, userID string) ([]*models.Todo, error) {
+	var todos []*models.Todo
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		td, err := getTodoOrTrashed(tx, id)
+		if err != nil {
+			return err
+		}
+		if !td.IsTrashed() {
+			return aderrors.ErrNoRecords
+		}
+		if err := authorizeTodo(tx, td, userID, models.PermTodosWrite); err != nil {
+			return err
+		}
+		batch, err := trashedTodos(tx, func(t *models.Todo) bool { return t.TrashID == td.TrashID })
+		if err != nil {
+			return err
+		}
+		// Only the subtasks trashed along with it come back with it
+		children := map[string][]*models.Todo{}
+		for _, t := range batch {
+			children[t.ParentID] = append(children[t.ParentID], t)
+		}
+		todos = []*models.Todo{td}
+		for i := 0; i < len(todos); i++ {
+			todos = append(todos, children[todos[i].ID]...)
+		}
+		return tdstr.restoreTodos(tx, todos)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error restoring todo %s: %w", id, err)
+	}
+	return todos, nil
+}
+
+func (tdstr *TodoStore) Undo(undoToken, userID string) ([]*models.Todo, error) {
+	var todos []*models.Todo
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		var err error
+		todos, err = trashedTodos(tx, func(td *models.Todo) bool {
+			return td.TrashID == undoToken && td.DeletedBy == userID
+		})
+		if err != nil {
+			return err
+		}
+		if len(todos) == 0 {
+			return aderrors.ErrNoRecords
+		}
+		for _, td := range todos {
+			if err := authorizeTodo(tx, td, userID, models.PermTodosWrite); err != nil {
+				return err
+			}
+		}
+		return tdstr.restoreTodos(tx, todos)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error undoing delete %s: %w", undoToken, err)
+	}
+	return todos, nil
+}
+
+func (tdstr *TodoStore) EmptyTrash(orgID, userID string) (int, error) {
+	n := 0
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		if orgID != "" {
+			if err := authorizeOrg(tx, orgID, userID, models.PermOrgMembersManage); err != nil {
+				return err
+			}
+		}
+		todos, err := trashedTodos(tx, func(td *models.Todo) bool {
+			return td.OrgID == orgID && (orgID != "" || td.UserID == userID)
+		})
+		if err != nil {
+			return err
+		}
+		n = len(todos)
+		return purgeTodos(tx, todos)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error emptying trash: %w", err)
+	}
+	return n, nil
+}
+
+func (tdstr *TodoStore) PurgeTrash(before time.Time) (int, error) {
+	n := 0
+	err := tdstr.DB.Update(func(tx *bolt.Tx) error {
+		todos, err := trashedTodos(tx, func(td *models.Todo) bool {
+			return td.DeletedAt.Time.Before(before)
+		})
+		if err != nil {
+			return err
+		}
+		n = len(todos)
+		return purgeTodos(tx, todos)
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error purging trash: %w", err)
+	}
+	return n, nil
+}
+
+// restoreTodos takes the todos out of the trash. One whose parent isn't
+// restored with it goes back under its parent if it can, or becomes a todo
+// of its own, last among them, if its parent is gone or the todos under it
+// would now be nested too deep.
+func (tdstr *TodoStore) restoreTodos(tx *bolt.Tx, todos []*models.Todo) error {
+	restoring := map[string]bool{}
+	children := map[string][]*models.Todo{}
+	for _, td := range todos {
+		restoring[td.ID] = true
+		children[td.ParentID] = append(children[td.ParentID], td)
+	}
+	var height func(td *models.Todo) int
+	height = func(td *models.Todo) int {
+		h := 0
+		for _, child := range children[td.ID] {
+			if ch := height(child); ch > h {
+				h = ch
+			}
+		}
+		return h + 1
+	}
+
+	var roots []*models.Todo
+	for _, td := range todos {
+		td.DeletedAt, td.TrashID, td.DeletedBy = null.Time{}, "", ""
+		if restoring[td.ParentID] {
+			continue
+		}
+		roots = append(roots, td)
+		tree, err := loadTodoTree(tx, td)
+		if err != nil {
+			return err
+		}
+		if parent := tree.todos[td.ParentID]; td.ParentID != "" && (parent == nil || tree.depth(parent)+height(td) > tdstr.maxDepth()) {
+			last := ""
+			if siblings := tree.children[""]; len(siblings) > 0 {
+				last = siblings[len(siblings)-1].Position
+			}
+			if td.Position, err = fracindex.Between(last, ""); err != nil {
+				return err
+			}
+			td.ParentID = ""
+		}
+		// Put it back now, so the next one placed last goes after it
+		if err := putTodo(tx, td); err != nil {
+			return err
+		}
+	}
+	for _, td := range todos {
+		if !restoring[td.ParentID] {
+			continue
+		}
+		if err := putTodo(tx, td); err != nil {
+			return err
+		}
+	}
+	for _, td := range todos {
+		if err := linkTodo(tx, td); err != nil {
+			return err
+		}
+	}
+	for _, td := range roots {
+		if err := syncAutoComplete(tx, td, td.ParentID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// trashTodo moves the todo and its subtasks to the trash, unless it's
+// already there.
+func trashTodo(tx *bolt.Tx, td *models.Todo, trashID, userID string, now time.Time) error {
+	tree, err := loadTodoTree(tx, td)
+	if err != nil {
+		return err
+	}
+	root := tree.todos[td.ID]
+	if root == nil {
+		return nil
+	}
+	subtree := []*models.Todo{root}
+	for i := 0; i < len(subtree); i++ {
+		subtree = append(subtree, tree.children[subtree[i].ID]...)
+	}
+	for _, t := range subtree {
+		t.DeletedAt, t.TrashID, t.DeletedBy = null.TimeFrom(now), trashID, userID
+		if err := putTodo(tx, t); err != nil {
+			return err
+		}
+	}
+	return syncAutoComplete(tx, root, root.ParentID)
+}
+
+// trashedTodos returns the todos in the trash that keep returns true for.
+func trashedTodos(tx *bolt.Tx, keep func(td *models.Todo) bool) ([]*models.Todo, error) {
+	b := tx.Bucket(TodoBucket)
+	if b == nil {
+		return nil, fmt.Errorf("no %s bucket exists", string(TodoBucket))
+	}
+	todos := []*models.Todo{}
+	err := b.ForEach(func(k, v []byte) error {
+		var td models.Todo
+		if err := json.Unmarshal(v, &td); err != nil {
+			return err
+		}
+		if td.IsTrashed() && keep(&td) {
+			todos = append(todos, &td)
+		}
+		return nil
+	})
+	return todos, err
+}
+
+// purgeTodos deletes the todos for good.
+func purgeTodos(tx *bolt.Tx, todos []*models.Todo) error {
+	for _, td := range todos {
+		if err := tx.Bucket(TodoBucket).Delete([]byte(td.ID)); err != nil {
+			return err
+		}
+		if err := deleteReminder(tx, td.ID); err != nil && !errors.Is(err, aderrors.ErrNoRecords) {
+			return err
+		}
+		if err := deleteTodoContent(tx, td.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteTodoContent deletes what's kept about a todo outside TodoBucket:
+// its note revisions, attachments, comments and search index entries, for
+// when the todo is deleted for good.
+func deleteTodoContent(tx *bolt.Tx, todoID string) error {
+	if err := unindexTodo(tx, todoID); err != nil {
+		return err
+	}
+	if err := deleteNoteRevisions(tx, todoID); err != nil {
+		return err
+	}
+	if err := deleteTodoAttachments(tx, todoID); err != nil {
+		return err
+	}
+	return deleteTodoComments(tx, todoID)
+}
@@ -0,0 +1,116 @@
+package datastore_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/datastore"
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestTrash(t *testing.T) {
+	db, cleanup := newTestDB(t)
+	defer cleanup()
+	us := &datastore.UserStore{BDB: db}
+	ts := &datastore.TodoStore{BDB: db}
+	cs := &datastore.CommentStore{BDB: db}
+	alice := newTestUser(t, us, "alice")
+	bob := newTestUser(t, us, "bob")
+
+	create := func(id, parentID string) {
+		td := &models.Todo{ID: id, UserID: alice.ID, Name: null.StringFrom(id), ParentID: parentID,
+			RemindAt: null.TimeFrom(time.Now().Add(time.Hour))}
+		_, err := ts.Create(td)
+		ok(t, err)
+	}
+	ids := func(todos []*models.Todo) []string {
+		ids := []string{}
+		for _, td := range todos {
+			ids = append(ids, td.ID)
+		}
+		return ids
+	}
+	live := func() []string {
+		todos, err := ts.GetByUserID(alice.ID)
+		ok(t, err)
+		return ids(todos)
+	}
+	trash := func() []string {
+		todos, err := ts.GetTrash("", alice.ID)
+		ok(t, err)
+		return ids(todos)
+	}
+	create("a", "")
+	create("b", "a")
+	create("c", "")
+	create("d", "")
+
+	// Deleting a todo trashes its subtasks too, and hides them
+	_, err := ts.Delete([]string{"a"}, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to delete alice's todo, got %v", err)
+	_, err = ts.Delete([]string{"a"}, alice.ID)
+	ok(t, err)
+	equals(t, []string{"c", "d"}, live())
+	equals(t, []string{"a", "b"}, trash())
+	_, err = ts.Get("b")
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected a trashed todo to be hidden, got %v", err)
+	_, err = ts.Create(&models.Todo{ID: "a", UserID: alice.ID})
+	assert(t, errors.Is(err, aderrors.ErrAlreadyExists), "expected a trashed todo to keep its ID, got %v", err)
+	due, err := (&datastore.ReminderStore{BDB: db}).ClaimDueReminders(time.Now().Add(2 * time.Hour))
+	ok(t, err)
+	equals(t, 2, len(due))
+	equals(t, []string{"c", "d"}, []string{due[0].TodoID, due[1].TodoID})
+
+	// Restoring a subtask on its own makes it a todo of its own, as its
+	// parent is still in the trash
+	restored, err := ts.Restore("b", alice.ID)
+	ok(t, err)
+	equals(t, []string{"b"}, ids(restored))
+	equals(t, "", restored[0].ParentID)
+	restored, err = ts.Restore("a", alice.ID)
+	ok(t, err)
+	equals(t, []string{"a"}, ids(restored))
+
+	// A bulk delete is undone all at once, only by who did it
+	token, err := ts.Delete([]string{"c", "d", "c"}, alice.ID)
+	ok(t, err)
+	equals(t, []string{"a", "b"}, live())
+	_, err = ts.Undo(token, bob.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected bob not to undo alice's delete, got %v", err)
+	restored, err = ts.Undo(token, alice.ID)
+	ok(t, err)
+	equals(t, []string{"c", "d"}, ids(restored))
+	equals(t, []string{"a", "b", "c", "d"}, live())
+	_, err = ts.Undo(token, alice.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected nothing left to undo, got %v", err)
+
+	// Emptying the trash deletes todos for good, with what's kept about them
+	ok(t, cs.CreateComment(&models.Comment{TodoID: "c", UserID: alice.ID, Body: "gone soon"}))
+	_, err = ts.Delete([]string{"c"}, alice.ID)
+	ok(t, err)
+	n, err := ts.EmptyTrash("", bob.ID)
+	ok(t, err)
+	equals(t, 0, n)
+	n, err = ts.EmptyTrash("", alice.ID)
+	ok(t, err)
+	equals(t, 1, n)
+	equals(t, []string{}, trash())
+	_, err = ts.Restore("c", alice.ID)
+	assert(t, errors.Is(err, aderrors.ErrNoRecords), "expected the todo to be gone, got %v", err)
+	export, err := (&datastore.AccountStore{BDB: db}).Export(alice.ID)
+	ok(t, err)
+	equals(t, 0, len(export.Comments))
+
+	// Old trash is purged
+	_, err = ts.Delete([]string{"d"}, alice.ID)
+	ok(t, err)
+	n, err = ts.PurgeTrash(time.Now().Add(-time.Hour))
+	ok(t, err)
+	equals(t, 0, n)
+	n, err = ts.PurgeTrash(time.Now().Add(time.Hour))
+	ok(t, err)
+	equals(t, 1, n)
+}
@@ -98,25 +98,70 @@ func (u *UserStore) GetByUsername(username string) (*models.User, error) {
 
 // Creates the user.
 func (u *UserStore) Create(usr *models.User) (bool, error) {
-	oldUser, err := u.Get(usr.ID)
-	if err != nil && err != aderrors.ErrNoRecords {
-		return false, fmt.Errorf("user id %s exists: %w", usr.ID, err)
+	err := u.DB.Update(func(tx *bolt.Tx) error {
+		return createUser(tx, usr)
+	})
+	if err != nil {
+		return false, fmt.Errorf("error saving user: %w", err)
 	}
-	if oldUser != nil {
-		return false, errors.New("id already exists")
+
+	return true, nil
+}
+
+// createUser saves a new user along with its email and username indexes.
+func createUser(tx *bolt.Tx, usr *models.User) error {
+	b := tx.Bucket(UserBucket)
+	if b == nil {
+		return fmt.Errorf("no %s bucket exists", string(UserBucket))
+	}
+	be := tx.Bucket(userEmailBucket)
+	if be == nil {
+		return fmt.Errorf("no %s bucket exists", string(userEmailBucket))
+	}
+	bu := tx.Bucket(userUsernameBucket)
+	if bu == nil {
+		return fmt.Errorf("no %s bucket exists", string(userUsernameBucket))
 	}
 
 	// Validations
 	if usr.ID == "" || usr.Email == "" || usr.Password == "" {
-		return false, errors.New("either id, password or email is empty, cannot save")
+		return errors.New("either id, password or email is empty, cannot save")
+	}
+	if b.Get([]byte(usr.ID)) != nil {
+		return errors.New("id already exists")
 	}
 
 	usr.DateCreated = timeNow()
-	err = u.Update(func(tx *bolt.Tx) error {
+	uJSON, err := json.Marshal(usr)
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(usr.ID), uJSON); err != nil {
+		return err
+	}
+	if err := be.Put([]byte(usr.Email), []byte(usr.ID)); err != nil {
+		return err
+	}
+	if usr.Username != "" {
+		return bu.Put([]byte(usr.Username), []byte(usr.ID))
+	}
+	return nil
+}
+
+// Update saves changes to an existing user. It doesn't touch the email or
+// username indexes, so it can't be used to change either.
+func (u *UserStore) Update(usr *models.User) (bool, error) {
+	if usr.ID == "" {
+		return false, aderrors.ErrNoID
+	}
+	err := u.DB.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket(UserBucket)
 		if b == nil {
 			return fmt.Errorf("no %s bucket exists", string(UserBucket))
 		}
+		if b.Get([]byte(usr.ID)) == nil {
+			return aderrors.ErrNoRecords
+		}
 
 		uJSON, err := json.Marshal(usr)
 		if err != nil {
@@ -125,18 +170,50 @@ func (u *UserStore) Create(usr *models.User) (bool, error) {
 		return b.Put([]byte(usr.ID), uJSON)
 	})
 	if err != nil {
-		return false, fmt.Errorf("error saving user: %w", err)
+		return false, fmt.Errorf("error updating user %s: %w", usr.ID, err)
+	}
+	return true, nil
+}
+
+// ChangeEmail moves the user to a new email address, updating the user and
+// the email index in a single transaction.
+func (u *UserStore) ChangeEmail(usr *models.User, newEmail string) (bool, error) {
+	if usr.ID == "" {
+		return false, aderrors.ErrNoID
 	}
-	err = u.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket(userEmailBucket)
+	oldEmail := usr.Email
+	err := u.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(UserBucket)
 		if b == nil {
+			return fmt.Errorf("no %s bucket exists", string(UserBucket))
+		}
+		be := tx.Bucket(userEmailBucket)
+		if be == nil {
 			return fmt.Errorf("no %s bucket exists", string(userEmailBucket))
 		}
-		return b.Put([]byte(usr.Email), []byte(usr.ID))
+		if b.Get([]byte(usr.ID)) == nil {
+			return aderrors.ErrNoRecords
+		}
+		if id := be.Get([]byte(newEmail)); id != nil && string(id) != usr.ID {
+			return aderrors.ErrAlreadyExists
+		}
+
+		if err := be.Delete([]byte(oldEmail)); err != nil {
+			return err
+		}
+		if err := be.Put([]byte(newEmail), []byte(usr.ID)); err != nil {
+			return err
+		}
+		usr.Email = newEmail
+		uJSON, err := json.Marshal(usr)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(usr.ID), uJSON)
 	})
 	if err != nil {
-		return false, fmt.Errorf("error saving user email or username association: %w", err)
+		usr.Email = oldEmail
+		return false, fmt.Errorf("error changing email for user %s: %w", usr.ID, err)
 	}
-
 	return true, nil
 }
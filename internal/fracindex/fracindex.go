@@ -0,0 +1,87 @@
+// Package fracindex makes keys for ordering things by hand. A key sorts
+// between any two others as a plain string, so moving something only
+// changes its own key rather than renumbering everything after it.
+//
+// Keys are made of the digits 0-9, A-Z and a-z, in that order, and never
+// end in 0, so there's always room for another key before or between.
+package fracindex
+
+import (
+	"errors"
+	"strings"
+)
+
+const digits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// ErrInvalidKey is returned for a key that isn't one Between could have
+// made, or for keys given out of order.
+var ErrInvalidKey = errors.New("fracindex: invalid key")
+
+// Between returns a key that sorts after a and before b. Either can be ""
+// for no bound, so Between("", "") is the first key, and Between(last, "")
+// goes after the last one.
+func Between(a, b string) (string, error) {
+	if !validOrEmpty(a) || !validOrEmpty(b) || (a != "" && b != "" && a >= b) {
+		return "", ErrInvalidKey
+	}
+	return midpoint(a, b), nil
+}
+
+// Valid returns whether key could have been made by Between.
+func Valid(key string) bool {
+	return key != "" && validOrEmpty(key)
+}
+
+func validOrEmpty(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if strings.IndexByte(digits, key[i]) < 0 {
+			return false
+		}
+	}
+	return !strings.HasSuffix(key, "0")
+}
+
+// midpoint returns a key between a and b, where a < b and b == "" means
+// there's no upper bound. It treats them as fractions after a point.
+func midpoint(a, b string) string {
+	if b != "" {
+		// Keep the digits they have in common, with a padded with 0s
+		n := 0
+		for n < len(b) && digitAt(a, n) == strings.IndexByte(digits, b[n]) {
+			n++
+		}
+		if n > 0 {
+			rest := ""
+			if n < len(a) {
+				rest = a[n:]
+			}
+			return b[:n] + midpoint(rest, b[n:])
+		}
+	}
+
+	da := digitAt(a, 0)
+	db := len(digits)
+	if b != "" {
+		db = strings.IndexByte(digits, b[0])
+	}
+	if db-da > 1 {
+		return string(digits[(da+db)/2])
+	}
+	// The first digits are next to each other
+	if b != "" && len(b) > 1 {
+		return b[:1]
+	}
+	rest := ""
+	if len(a) > 1 {
+		rest = a[1:]
+	}
+	return string(digits[da]) + midpoint(rest, "")
+}
+
+// digitAt returns the value of key's ith digit, which is 0 past its end.
+func digitAt(key string, i int) int {
+	if i >= len(key) {
+		return 0
+	}
+	return strings.IndexByte(digits, key[i])
+}
@@ -0,0 +1,89 @@
+package fracindex_test
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/fracindex"
+)
+
+func TestBetween(t *testing.T) {
+	tests := []struct {
+		a, b, exp string
+	}{
+		{"", "", "V"},
+		{"V", "", "k"},
+		{"", "V", "F"},
+		{"a", "b", "aV"},
+		{"a", "a1", "a0V"},
+		{"a0V", "a1", "a0k"},
+		{"z", "", "zV"},
+		{"", "1", "0V"},
+		{"Fz", "G", "FzV"},
+		{"F", "Gz", "G"},
+	}
+	for _, tt := range tests {
+		k, err := fracindex.Between(tt.a, tt.b)
+		ok(t, err)
+		equals(t, tt.exp, k)
+	}
+
+	for _, bad := range [][2]string{{"b", "a"}, {"a", "a"}, {"a0", ""}, {"", "a-b"}} {
+		_, err := fracindex.Between(bad[0], bad[1])
+		equals(t, fracindex.ErrInvalidKey, err)
+	}
+}
+
+// Inserting anywhere keeps every key in order.
+func TestBetweenKeepsOrder(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	keys := []string{}
+	for i := 0; i < 1000; i++ {
+		at := rnd.Intn(len(keys) + 1)
+		var a, b string
+		if at > 0 {
+			a = keys[at-1]
+		}
+		if at < len(keys) {
+			b = keys[at]
+		}
+		k, err := fracindex.Between(a, b)
+		ok(t, err)
+		assert(t, fracindex.Valid(k), "expected %q to be valid", k)
+		assert(t, (a == "" || a < k) && (b == "" || k < b), "expected %q between %q and %q", k, a, b)
+		keys = append(keys[:at], append([]string{k}, keys[at:]...)...)
+	}
+	assert(t, sort.StringsAreSorted(keys), "expected the keys to be in order")
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
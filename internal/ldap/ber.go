@@ -0,0 +1,196 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The BER tags LDAP uses.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+
+	tagBindRequest       = 0x60
+	tagBindResponse      = 0x61
+	tagUnbindRequest     = 0x42
+	tagSearchRequest     = 0x63
+	tagSearchResultEntry = 0x64
+	tagSearchResultDone  = 0x65
+	tagSearchResultRef   = 0x73
+	tagSimpleAuth        = 0x80
+)
+
+// maxMessageSize is the largest message read, which is plenty for the few
+// attributes of a user we ask for.
+const maxMessageSize = 4 << 20
+
+// tlv is a BER tag, length and value.
+type tlv struct {
+	tag     byte
+	content []byte
+}
+
+func (t tlv) constructed() bool {
+	return t.tag&0x20 != 0
+}
+
+// children parses the content of a constructed value.
+func (t tlv) children() ([]tlv, error) {
+	if !t.constructed() {
+		return nil, fmt.Errorf("ldap: tag %#x isn't constructed", t.tag)
+	}
+	var cs []tlv
+	rest := t.content
+	for len(rest) > 0 {
+		var c tlv
+		var err error
+		c, rest, err = parseTLV(rest)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func (t tlv) int() (int, error) {
+	if len(t.content) == 0 || len(t.content) > 4 {
+		return 0, fmt.Errorf("ldap: bad integer of %d bytes", len(t.content))
+	}
+	n := int(int8(t.content[0]))
+	for _, b := range t.content[1:] {
+		n = n<<8 | int(b)
+	}
+	return n, nil
+}
+
+func (t tlv) bool() bool {
+	return len(t.content) > 0 && t.content[0] != 0
+}
+
+// parseTLV parses the first value in b, returning the bytes after it.
+func parseTLV(b []byte) (tlv, []byte, error) {
+	if len(b) < 2 {
+		return tlv{}, nil, errors.New("ldap: truncated value")
+	}
+	tag := b[0]
+	if tag&0x1f == 0x1f {
+		return tlv{}, nil, errors.New("ldap: multi-byte tags aren't supported")
+	}
+	n, hdr, err := parseLength(b[1:])
+	if err != nil {
+		return tlv{}, nil, err
+	}
+	b = b[1+hdr:]
+	if n > len(b) {
+		return tlv{}, nil, errors.New("ldap: truncated value")
+	}
+	return tlv{tag, b[:n]}, b[n:], nil
+}
+
+// parseLength returns the length at the start of b and how many bytes it
+// took. Servers often use the long form for short lengths, which DER
+// doesn't allow, so encoding/asn1 can't be used.
+func parseLength(b []byte) (int, int, error) {
+	if len(b) == 0 {
+		return 0, 0, errors.New("ldap: truncated length")
+	}
+	if b[0] < 0x80 {
+		return int(b[0]), 1, nil
+	}
+	n := int(b[0] & 0x7f)
+	if n == 0 {
+		return 0, 0, errors.New("ldap: indefinite lengths aren't allowed")
+	}
+	if n > 4 || len(b) < 1+n {
+		return 0, 0, errors.New("ldap: bad length")
+	}
+	l := 0
+	for _, c := range b[1 : 1+n] {
+		l = l<<8 | int(c)
+	}
+	if l < 0 || l > maxMessageSize {
+		return 0, 0, fmt.Errorf("ldap: a value of %d bytes is too long", l)
+	}
+	return l, 1 + n, nil
+}
+
+// readTLV reads a whole value from r.
+func readTLV(r io.Reader) (tlv, error) {
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:2]); err != nil {
+		return tlv{}, err
+	}
+	lenBytes := 1
+	if hdr[1] > 0x80 {
+		lenBytes += int(hdr[1] & 0x7f)
+		if lenBytes > 5 {
+			return tlv{}, errors.New("ldap: bad length")
+		}
+		if _, err := io.ReadFull(r, hdr[2:1+lenBytes]); err != nil {
+			return tlv{}, err
+		}
+	}
+	n, _, err := parseLength(hdr[1 : 1+lenBytes])
+	if err != nil {
+		return tlv{}, err
+	}
+	content := make([]byte, n)
+	if _, err := io.ReadFull(r, content); err != nil {
+		return tlv{}, err
+	}
+	return tlv{hdr[0], content}, nil
+}
+
+// encodeTLV encodes a value from its tag and the encoded values or bytes
+// making up its content.
+func encodeTLV(tag byte, content ...[]byte) []byte {
+	n := 0
+	for _, c := range content {
+		n += len(c)
+	}
+	b := append([]byte{tag}, encodeLength(n)...)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func encodeInt(tag byte, n int) []byte {
+	var b []byte
+	for {
+		b = append([]byte{byte(n)}, b...)
+		n >>= 8
+		if n == 0 && b[0]&0x80 == 0 || n == -1 && b[0]&0x80 != 0 {
+			break
+		}
+	}
+	return encodeTLV(tag, b)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encodeTLV(tag, []byte(s))
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return []byte{tagBoolean, 1, 0xff}
+	}
+	return []byte{tagBoolean, 1, 0}
+}
@@ -0,0 +1,140 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"time"
+)
+
+// DefaultTimeout is how long a connection or operation can take when the
+// Directory doesn't say.
+const DefaultTimeout = 10 * time.Second
+
+// Conn is a connection to a directory server. It does one operation at a
+// time.
+type Conn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+	lastID  int
+}
+
+// Dial connects to the server at an ldap:// or ldaps:// URL. tlsConfig is
+// used for ldaps, and can be nil to check the server's certificate against
+// the system's roots.
+func Dial(rawurl string, tlsConfig *tls.Config, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, fmt.Errorf("ldap: bad URL %q: %w", rawurl, err)
+	}
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	host := u.Host
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "389")
+		}
+		conn, err = dialer.Dial("tcp", host)
+	case "ldaps":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "636")
+		}
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{ServerName: u.Hostname()}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", host, tlsConfig)
+	default:
+		return nil, fmt.Errorf("ldap: URL %q isn't ldap:// or ldaps://", rawurl)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ldap: connecting to %s: %w", host, err)
+	}
+	return &Conn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+// Bind logs in as dn. An empty password is refused, as servers treat it as
+// an anonymous bind that succeeds whatever the DN.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{Code: ResultInvalidCredentials, Message: "empty password"}
+	}
+	id, err := c.send(&BindRequest{Name: dn, Password: password})
+	if err != nil {
+		return err
+	}
+	for {
+		m, err := c.receive(id)
+		if err != nil {
+			return err
+		}
+		if res, ok := m.Op.(*BindResponse); ok {
+			return res.Err()
+		}
+	}
+}
+
+// Search returns the entries found by the search. Referrals to other
+// servers are ignored. If there were more entries than the size limit, the
+// ones that fit are returned along with an *Error.
+func (c *Conn) Search(req *SearchRequest) ([]*Entry, error) {
+	id, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for {
+		m, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch op := m.Op.(type) {
+		case *Entry:
+			entries = append(entries, op)
+		case *SearchResultDone:
+			return entries, op.Err()
+		}
+	}
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	_, err := c.send(&UnbindRequest{})
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (c *Conn) send(op interface{}) (int, error) {
+	c.lastID++
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return 0, err
+	}
+	return c.lastID, WriteMessage(c.conn, &Message{ID: c.lastID, Op: op})
+}
+
+// receive reads the next message about the operation with the ID.
+func (c *Conn) receive(id int) (*Message, error) {
+	for {
+		m, err := ReadMessage(c.r)
+		if err != nil {
+			return nil, err
+		}
+		if m.ID == id {
+			return m, nil
+		}
+		if m.ID == 0 {
+			// An unsolicited notification, which is only ever the server
+			// about to hang up
+			return nil, errors.New("ldap: the server is disconnecting")
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Package ldap implements the parts of LDAPv3 (RFC 4511) needed to
+// authenticate users against a directory: simple binds, searches and the
+// string form of filters. Directory does the usual search-then-bind, finding
+// a user's entry by their login then binding as it with their password.
+package ldap
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNoSuchUser is returned by Authenticate when no entry matches the
+	// login.
+	ErrNoSuchUser = errors.New("ldap: no such user")
+	// ErrInvalidCredentials is returned by Authenticate, along with the
+	// user, when their password is wrong.
+	ErrInvalidCredentials = errors.New("ldap: invalid credentials")
+	// ErrAmbiguousUser is returned by Authenticate when more than one entry
+	// matches the login.
+	ErrAmbiguousUser = errors.New("ldap: more than one user matches")
+)
+
+// DefaultUserFilter finds users by their email.
+const DefaultUserFilter = "(mail={login})"
+
+// Directory is a directory users are authenticated against. The zero
+// values of the attributes are the usual ones.
+type Directory struct {
+	URL string
+	// TLSConfig is used for ldaps:// URLs.
+	TLSConfig *tls.Config
+	// BindDN and BindPassword are the service account users are searched
+	// for as. With no BindDN the search is anonymous.
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserFilter finds the entry of a user, with {login} replaced by
+	// what they logged in with.
+	UserFilter string
+
+	// IDAttribute uniquely identifies a user, even if they're renamed or
+	// moved. If an entry doesn't have one its DN is used.
+	IDAttribute       string
+	EmailAttribute    string
+	UsernameAttribute string
+	NameAttribute     string
+
+	Timeout time.Duration
+}
+
+// User is a user found in the directory.
+type User struct {
+	DN       string
+	ID       string
+	Email    string
+	Username string
+	Name     string
+}
+
+func (d *Directory) userFilter(login string) (Filter, error) {
+	f := d.UserFilter
+	if f == "" {
+		f = DefaultUserFilter
+	}
+	return ParseFilter(strings.Replace(f, "{login}", EscapeFilter(login), -1))
+}
+
+// CheckUserFilter returns an error if the UserFilter can't be parsed.
+func (d *Directory) CheckUserFilter() error {
+	_, err := d.userFilter("user")
+	return err
+}
+
+func (d *Directory) attributes() (id, email, username, name string) {
+	return orDefault(d.IDAttribute, "entryUUID"), orDefault(d.EmailAttribute, "mail"),
+		orDefault(d.UsernameAttribute, "uid"), orDefault(d.NameAttribute, "cn")
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// Authenticate finds the user with the login, and checks their password by
+// binding as them. A user that's found is returned even when the password
+// is wrong.
+func (d *Directory) Authenticate(login, password string) (*User, error) {
+	filter, err := d.userFilter(login)
+	if err != nil {
+		return nil, err
+	}
+	c, err := Dial(d.URL, d.TLSConfig, d.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if d.BindDN != "" {
+		if err := c.Bind(d.BindDN, d.BindPassword); err != nil {
+			return nil, fmt.Errorf("ldap: binding as %s: %w", d.BindDN, err)
+		}
+	}
+	idAttr, emailAttr, usernameAttr, nameAttr := d.attributes()
+	entries, err := c.Search(&SearchRequest{
+		BaseDN:     d.BaseDN,
+		Scope:      ScopeWholeSubtree,
+		SizeLimit:  2,
+		TimeLimit:  int(orDuration(d.Timeout, DefaultTimeout) / time.Second),
+		Filter:     filter,
+		Attributes: []string{idAttr, emailAttr, usernameAttr, nameAttr},
+	})
+	if IsErrorCode(err, ResultSizeLimitExceeded) || len(entries) > 1 {
+		return nil, ErrAmbiguousUser
+	} else if err != nil {
+		return nil, fmt.Errorf("ldap: searching for %s: %w", filter, err)
+	} else if len(entries) == 0 {
+		return nil, ErrNoSuchUser
+	}
+
+	e := entries[0]
+	u := &User{
+		DN:       e.DN,
+		ID:       e.Get(idAttr),
+		Email:    e.Get(emailAttr),
+		Username: e.Get(usernameAttr),
+		Name:     e.Get(nameAttr),
+	}
+	if u.ID == "" {
+		u.ID = e.DN
+	}
+	// A bind with an empty password is an unauthenticated bind, which
+	// servers let succeed without checking anything
+	if password == "" {
+		return u, ErrInvalidCredentials
+	}
+	if err := c.Bind(e.DN, password); IsErrorCode(err, ResultInvalidCredentials) {
+		return u, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, fmt.Errorf("ldap: binding as %s: %w", e.DN, err)
+	}
+	return u, nil
+}
+
+func orDuration(d, def time.Duration) time.Duration {
+	if d <= 0 {
+		return def
+	}
+	return d
+}
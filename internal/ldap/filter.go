@@ -0,0 +1,484 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The context-specific tags of search filters.
+const (
+	tagFilterAnd        = 0xa0
+	tagFilterOr         = 0xa1
+	tagFilterNot        = 0xa2
+	tagFilterEqual      = 0xa3
+	tagFilterSubstrings = 0xa4
+	tagFilterGreater    = 0xa5
+	tagFilterLess       = 0xa6
+	tagFilterPresent    = 0x87
+	tagFilterApprox     = 0xa8
+
+	tagSubInitial = 0x80
+	tagSubAny     = 0x81
+	tagSubFinal   = 0x82
+)
+
+// Filter is a search filter. Matches is a simple version of what servers
+// do, comparing values without regard to case, which is enough to stand in
+// for a directory in tests.
+type Filter interface {
+	encode() []byte
+	Matches(e *Entry) bool
+	String() string
+}
+
+// And matches entries all the filters match.
+type And []Filter
+
+// Or matches entries any of the filters match.
+type Or []Filter
+
+// Not matches entries the filter doesn't.
+type Not struct {
+	Filter Filter
+}
+
+// Present matches entries with the attribute.
+type Present struct {
+	Attr string
+}
+
+// Compare matches entries with a value of the attribute that's equal to,
+// greater or equal to, less or equal to, or approximately Value, as given
+// by Op: one of "=", ">=", "<=" or "~=".
+type Compare struct {
+	Attr  string
+	Op    string
+	Value string
+}
+
+// Substrings matches entries with a value of the attribute that starts
+// with Initial, ends with Final, and has each of Any in order in between.
+type Substrings struct {
+	Attr    string
+	Initial string
+	Any     []string
+	Final   string
+}
+
+var compareTags = map[string]byte{
+	"=":  tagFilterEqual,
+	">=": tagFilterGreater,
+	"<=": tagFilterLess,
+	"~=": tagFilterApprox,
+}
+
+func (f And) encode() []byte { return encodeFilters(tagFilterAnd, f) }
+func (f Or) encode() []byte  { return encodeFilters(tagFilterOr, f) }
+
+func encodeFilters(tag byte, fs []Filter) []byte {
+	var b [][]byte
+	for _, f := range fs {
+		b = append(b, f.encode())
+	}
+	return encodeTLV(tag, b...)
+}
+
+func (f Not) encode() []byte {
+	return encodeTLV(tagFilterNot, f.Filter.encode())
+}
+
+func (f Present) encode() []byte {
+	return encodeString(tagFilterPresent, f.Attr)
+}
+
+func (f Compare) encode() []byte {
+	return encodeTLV(compareTags[f.Op], encodeString(tagOctetString, f.Attr), encodeString(tagOctetString, f.Value))
+}
+
+func (f Substrings) encode() []byte {
+	var subs [][]byte
+	if f.Initial != "" {
+		subs = append(subs, encodeString(tagSubInitial, f.Initial))
+	}
+	for _, a := range f.Any {
+		subs = append(subs, encodeString(tagSubAny, a))
+	}
+	if f.Final != "" {
+		subs = append(subs, encodeString(tagSubFinal, f.Final))
+	}
+	return encodeTLV(tagFilterSubstrings, encodeString(tagOctetString, f.Attr), encodeTLV(tagSequence, subs...))
+}
+
+func (f And) Matches(e *Entry) bool {
+	for _, c := range f {
+		if !c.Matches(e) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f Or) Matches(e *Entry) bool {
+	for _, c := range f {
+		if c.Matches(e) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f Not) Matches(e *Entry) bool {
+	return !f.Filter.Matches(e)
+}
+
+func (f Present) Matches(e *Entry) bool {
+	return strings.EqualFold(f.Attr, "objectClass") || len(e.Values(f.Attr)) > 0
+}
+
+func (f Compare) Matches(e *Entry) bool {
+	want := strings.ToLower(f.Value)
+	for _, v := range e.Values(f.Attr) {
+		v = strings.ToLower(v)
+		switch f.Op {
+		case "=", "~=":
+			if v == want {
+				return true
+			}
+		case ">=":
+			if compareValues(v, want) >= 0 {
+				return true
+			}
+		case "<=":
+			if compareValues(v, want) <= 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// compareValues orders numbers as numbers, and anything else as strings.
+func compareValues(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func (f Substrings) Matches(e *Entry) bool {
+	for _, v := range e.Values(f.Attr) {
+		v = strings.ToLower(v)
+		if !strings.HasPrefix(v, strings.ToLower(f.Initial)) {
+			continue
+		}
+		v = v[len(f.Initial):]
+		matched := true
+		for _, a := range f.Any {
+			i := strings.Index(v, strings.ToLower(a))
+			if i < 0 {
+				matched = false
+				break
+			}
+			v = v[i+len(a):]
+		}
+		if matched && strings.HasSuffix(v, strings.ToLower(f.Final)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f And) String() string { return "(&" + joinFilters(f) + ")" }
+func (f Or) String() string  { return "(|" + joinFilters(f) + ")" }
+
+func joinFilters(fs []Filter) string {
+	var b strings.Builder
+	for _, f := range fs {
+		b.WriteString(f.String())
+	}
+	return b.String()
+}
+
+func (f Not) String() string {
+	return "(!" + f.Filter.String() + ")"
+}
+
+func (f Present) String() string {
+	return "(" + f.Attr + "=*)"
+}
+
+func (f Compare) String() string {
+	return "(" + f.Attr + f.Op + EscapeFilter(f.Value) + ")"
+}
+
+func (f Substrings) String() string {
+	var b strings.Builder
+	b.WriteString("(" + f.Attr + "=" + EscapeFilter(f.Initial) + "*")
+	for _, a := range f.Any {
+		b.WriteString(EscapeFilter(a) + "*")
+	}
+	b.WriteString(EscapeFilter(f.Final) + ")")
+	return b.String()
+}
+
+// EscapeFilter escapes s so it can go in a filter as a value, and only
+// ever match itself.
+func EscapeFilter(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// ParseFilter parses a filter in the string form of RFC 4515, such as
+// "(&(objectClass=person)(mail=bjensen@example.com))". Extensible matches
+// aren't supported.
+func ParseFilter(s string) (Filter, error) {
+	p := &filterParser{s: s}
+	f, err := p.filter()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(s) {
+		return nil, p.errorf("unexpected %q after the filter", s[p.pos:])
+	}
+	return f, nil
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) errorf(format string, v ...interface{}) error {
+	return fmt.Errorf("ldap: bad filter %q: %s", p.s, fmt.Sprintf(format, v...))
+}
+
+func (p *filterParser) filter() (Filter, error) {
+	if p.pos >= len(p.s) || p.s[p.pos] != '(' {
+		return nil, p.errorf("expected ( at %d", p.pos)
+	}
+	p.pos++
+	if p.pos >= len(p.s) {
+		return nil, p.errorf("unexpected end")
+	}
+
+	var f Filter
+	var err error
+	switch p.s[p.pos] {
+	case '&', '|':
+		op := p.s[p.pos]
+		p.pos++
+		var fs []Filter
+		if fs, err = p.filterList(); err != nil {
+			return nil, err
+		}
+		if op == '&' {
+			f = And(fs)
+		} else {
+			f = Or(fs)
+		}
+	case '!':
+		p.pos++
+		var nf Filter
+		if nf, err = p.filter(); err != nil {
+			return nil, err
+		}
+		f = Not{nf}
+	default:
+		if f, err = p.item(); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.pos >= len(p.s) || p.s[p.pos] != ')' {
+		return nil, p.errorf("expected ) at %d", p.pos)
+	}
+	p.pos++
+	return f, nil
+}
+
+func (p *filterParser) filterList() ([]Filter, error) {
+	var fs []Filter
+	for p.pos < len(p.s) && p.s[p.pos] == '(' {
+		f, err := p.filter()
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	if len(fs) == 0 {
+		return nil, p.errorf("expected filters at %d", p.pos)
+	}
+	return fs, nil
+}
+
+func (p *filterParser) item() (Filter, error) {
+	end := strings.IndexByte(p.s[p.pos:], ')')
+	if end < 0 {
+		return nil, p.errorf("missing )")
+	}
+	item := p.s[p.pos : p.pos+end]
+	p.pos += end
+
+	eq := strings.IndexByte(item, '=')
+	if eq < 0 {
+		return nil, p.errorf("%q has no =", item)
+	}
+	attr, op, raw := item[:eq], "=", item[eq+1:]
+	if eq > 0 && strings.IndexByte("~<>", item[eq-1]) >= 0 {
+		attr, op = item[:eq-1], item[eq-1:eq+1]
+	}
+	if !validAttr(attr) {
+		return nil, p.errorf("bad attribute %q", attr)
+	}
+
+	if op != "=" || !strings.Contains(raw, "*") {
+		v, err := p.unescape(raw)
+		if err != nil {
+			return nil, err
+		}
+		return Compare{Attr: attr, Op: op, Value: v}, nil
+	}
+	if raw == "*" {
+		return Present{attr}, nil
+	}
+	parts := strings.Split(raw, "*")
+	vs := make([]string, len(parts))
+	for i, part := range parts {
+		v, err := p.unescape(part)
+		if err != nil {
+			return nil, err
+		}
+		vs[i] = v
+	}
+	f := Substrings{Attr: attr, Initial: vs[0], Final: vs[len(vs)-1]}
+	for _, v := range vs[1 : len(vs)-1] {
+		if v == "" {
+			return nil, p.errorf("%q has ** in it", item)
+		}
+		f.Any = append(f.Any, v)
+	}
+	return f, nil
+}
+
+func validAttr(attr string) bool {
+	if attr == "" {
+		return false
+	}
+	for _, c := range attr {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == ';') {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *filterParser) unescape(s string) (string, error) {
+	if strings.ContainsAny(s, "(") {
+		return "", p.errorf("%q should have ( escaped", s)
+	}
+	if !strings.Contains(s, `\`) {
+		return s, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", p.errorf("%q ends in the middle of an escape", s)
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", p.errorf("bad escape in %q", s)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func decodeFilter(t tlv) (Filter, error) {
+	switch t.tag {
+	case tagFilterPresent:
+		return Present{string(t.content)}, nil
+	case tagFilterAnd, tagFilterOr, tagFilterNot, tagFilterEqual, tagFilterSubstrings,
+		tagFilterGreater, tagFilterLess, tagFilterApprox:
+	default:
+		return nil, fmt.Errorf("ldap: filter tag %#x isn't supported", t.tag)
+	}
+
+	cs, err := t.children()
+	if err != nil {
+		return nil, err
+	}
+	switch t.tag {
+	case tagFilterAnd, tagFilterOr:
+		var fs []Filter
+		for _, c := range cs {
+			f, err := decodeFilter(c)
+			if err != nil {
+				return nil, err
+			}
+			fs = append(fs, f)
+		}
+		if t.tag == tagFilterAnd {
+			return And(fs), nil
+		}
+		return Or(fs), nil
+	case tagFilterNot:
+		if len(cs) != 1 {
+			return nil, errors.New("ldap: malformed not filter")
+		}
+		f, err := decodeFilter(cs[0])
+		return Not{f}, err
+	case tagFilterSubstrings:
+		if len(cs) != 2 {
+			return nil, errors.New("ldap: malformed substrings filter")
+		}
+		subs, err := cs[1].children()
+		if err != nil {
+			return nil, err
+		}
+		f := Substrings{Attr: string(cs[0].content)}
+		for _, s := range subs {
+			switch s.tag {
+			case tagSubInitial:
+				f.Initial = string(s.content)
+			case tagSubAny:
+				f.Any = append(f.Any, string(s.content))
+			case tagSubFinal:
+				f.Final = string(s.content)
+			}
+		}
+		return f, nil
+	}
+
+	if len(cs) != 2 {
+		return nil, errors.New("ldap: malformed comparison filter")
+	}
+	for op, tag := range compareTags {
+		if tag == t.tag {
+			return Compare{Attr: string(cs[0].content), Op: op, Value: string(cs[1].content)}, nil
+		}
+	}
+	panic("unreachable")
+}
@@ -0,0 +1,205 @@
+package ldap_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/ldap"
+)
+
+const baseDN = "ou=people,dc=example,dc=com"
+
+func testEntries() []*ldap.Entry {
+	return []*ldap.Entry{
+		{DN: "cn=reader,dc=example,dc=com", Attributes: map[string][]string{"userPassword": {"reader-pw"}}},
+		{DN: "uid=bjensen," + baseDN, Attributes: map[string][]string{
+			"entryUUID":    {"b6a2c8e0-0c1f-4d47-9a11-6f6c9ad3d4f1"},
+			"mail":         {"bjensen@example.com"},
+			"uid":          {"bjensen"},
+			"cn":           {"Barbara Jensen"},
+			"userPassword": {"correct horse"},
+		}},
+		{DN: "uid=jsmith," + baseDN, Attributes: map[string][]string{
+			"mail":         {"jsmith@example.com"},
+			"uid":          {"jsmith"},
+			"cn":           {"John Smith"},
+			"userPassword": {"battery staple"},
+		}},
+		{DN: "uid=shared," + baseDN, Attributes: map[string][]string{"mail": {"team@example.com"}, "userPassword": {"x"}}},
+		{DN: "uid=shared2," + baseDN, Attributes: map[string][]string{"mail": {"team@example.com"}, "userPassword": {"x"}}},
+	}
+}
+
+func newTestDirectory(s *testServer) *ldap.Directory {
+	return &ldap.Directory{
+		URL:          s.url,
+		BindDN:       "cn=reader,dc=example,dc=com",
+		BindPassword: "reader-pw",
+		BaseDN:       baseDN,
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	s := newTestServer(t, testEntries()...)
+	defer s.close()
+	d := newTestDirectory(s)
+
+	u, err := d.Authenticate("bjensen@example.com", "correct horse")
+	ok(t, err)
+	equals(t, &ldap.User{
+		DN:       "uid=bjensen," + baseDN,
+		ID:       "b6a2c8e0-0c1f-4d47-9a11-6f6c9ad3d4f1",
+		Email:    "bjensen@example.com",
+		Username: "bjensen",
+		Name:     "Barbara Jensen",
+	}, u)
+	equals(t, []string{"cn=reader,dc=example,dc=com", "uid=bjensen," + baseDN}, s.binds)
+
+	// Without the ID attribute the DN stands in for it
+	u, err = d.Authenticate("jsmith@example.com", "battery staple")
+	ok(t, err)
+	equals(t, "uid=jsmith,"+baseDN, u.ID)
+
+	d.UserFilter = "(&(objectClass=*)(uid={login}))"
+	u, err = d.Authenticate("bjensen", "correct horse")
+	ok(t, err)
+	equals(t, "bjensen@example.com", u.Email)
+}
+
+func TestAuthenticateFailures(t *testing.T) {
+	s := newTestServer(t, testEntries()...)
+	defer s.close()
+	d := newTestDirectory(s)
+
+	u, err := d.Authenticate("bjensen@example.com", "wrong")
+	equals(t, ldap.ErrInvalidCredentials, err)
+	equals(t, "bjensen", u.Username)
+
+	// An empty password would be an unauthenticated bind, which succeeds,
+	// so the user isn't bound as at all
+	s.mu.Lock()
+	s.binds = nil
+	s.mu.Unlock()
+	u, err = d.Authenticate("bjensen@example.com", "")
+	equals(t, ldap.ErrInvalidCredentials, err)
+	equals(t, "bjensen", u.Username)
+	s.mu.Lock()
+	equals(t, []string{"cn=reader,dc=example,dc=com"}, s.binds)
+	s.mu.Unlock()
+
+	_, err = d.Authenticate("nobody@example.com", "correct horse")
+	equals(t, ldap.ErrNoSuchUser, err)
+
+	_, err = d.Authenticate("team@example.com", "x")
+	equals(t, ldap.ErrAmbiguousUser, err)
+
+	d.BindPassword = "wrong"
+	_, err = d.Authenticate("bjensen@example.com", "correct horse")
+	assert(t, ldap.IsErrorCode(err, ldap.ResultInvalidCredentials), "expected the service account's bind to fail, got %v", err)
+	assert(t, !errors.Is(err, ldap.ErrInvalidCredentials), "expected the service account failing not to look like a wrong password")
+
+	d = newTestDirectory(s)
+	d.URL = "http://" + strings.TrimPrefix(s.url, "ldap://")
+	_, err = d.Authenticate("bjensen@example.com", "correct horse")
+	assert(t, err != nil, "expected a URL that isn't LDAP to be refused")
+}
+
+func TestAuthenticateEscapesLogin(t *testing.T) {
+	s := newTestServer(t, testEntries()...)
+	defer s.close()
+	d := newTestDirectory(s)
+
+	for _, login := range []string{"*", "bjensen@example.com)(mail=*", "*)(|(uid=*"} {
+		_, err := d.Authenticate(login, "correct horse")
+		equals(t, ldap.ErrNoSuchUser, err)
+	}
+	equals(t, []string{
+		`(mail=\2a)`,
+		`(mail=bjensen@example.com\29\28mail=\2a)`,
+		`(mail=\2a\29\28|\28uid=\2a)`,
+	}, s.searches)
+}
+
+func TestParseFilter(t *testing.T) {
+	e := &ldap.Entry{DN: "uid=bjensen", Attributes: map[string][]string{
+		"mail":       {"BJensen@Example.com"},
+		"cn":         {"Barbara Jensen", "Babs Jensen"},
+		"uidNumber":  {"1001"},
+		"memberOf":   {"cn=admins,ou=groups"},
+		"objectType": {"a*b(c)"},
+	}}
+	tests := []struct {
+		filter  string
+		matches bool
+	}{
+		{"(mail=bjensen@example.com)", true},
+		{"(mail=jsmith@example.com)", false},
+		{"(cn=babs jensen)", true},
+		{"(cn=Barb*)", true},
+		{"(cn=*Jen*)", true},
+		{"(cn=B*a*n)", true},
+		{"(cn=*Smith)", false},
+		{"(mail=*)", true},
+		{"(telephoneNumber=*)", false},
+		{"(uidNumber>=1000)", true},
+		{"(uidNumber<=999)", false},
+		{"(cn~=barbara jensen)", true},
+		{"(&(mail=*)(cn=Babs*))", true},
+		{"(&(mail=*)(cn=Jo*))", false},
+		{"(|(cn=Jo*)(uidNumber=1001))", true},
+		{"(!(cn=Jo*))", true},
+		{`(objectType=a\2ab\28c\29)`, true},
+		{`(objectType=a\2a*)`, true},
+		{`(memberOf=cn=admins,ou=groups)`, true},
+	}
+	for _, tt := range tests {
+		f, err := ldap.ParseFilter(tt.filter)
+		ok(t, err)
+		equals(t, tt.filter, f.String())
+		assert(t, f.Matches(e) == tt.matches, "expected %s matching to be %v", tt.filter, tt.matches)
+	}
+
+	for _, bad := range []string{"", "mail=x", "(mail=x", "(mail=x))", "(=x)", "(mail)", "(&)", "(mail=\\4)", "(mail=a**b)", "(ma il=x)", "(mail=(x)"} {
+		_, err := ldap.ParseFilter(bad)
+		assert(t, err != nil, "expected %q not to parse", bad)
+	}
+}
+
+func TestEscapeFilter(t *testing.T) {
+	equals(t, `a\2ab\28c\29d\5ce\00`, ldap.EscapeFilter("a*b(c)d\\e\x00"))
+	f, err := ldap.ParseFilter("(cn=" + ldap.EscapeFilter("x)(cn=*") + ")")
+	ok(t, err)
+	equals(t, ldap.Compare{Attr: "cn", Op: "=", Value: "x)(cn=*"}, f)
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,335 @@
+package ldap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The result codes we tell apart, from RFC 4511 appendix A.
+const (
+	ResultSuccess            = 0
+	ResultOperationsError    = 1
+	ResultProtocolError      = 2
+	ResultSizeLimitExceeded  = 4
+	ResultNoSuchObject       = 32
+	ResultInvalidCredentials = 49
+	ResultInsufficientAccess = 50
+	ResultUnwillingToPerform = 53
+	ResultOther              = 80
+)
+
+// The scopes of a search.
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+const (
+	protocolVersion           = 3
+	derefAliasesFindingBaseDN = 2
+)
+
+// Message is an LDAP message. Op is one of the request or response types
+// below.
+type Message struct {
+	ID int
+	Op interface{}
+}
+
+// BindRequest logs in to the directory with a simple bind.
+type BindRequest struct {
+	Name     string
+	Password string
+}
+
+// BindResponse answers a BindRequest.
+type BindResponse struct {
+	Result
+}
+
+// UnbindRequest ends the connection.
+type UnbindRequest struct{}
+
+// SearchRequest looks for entries under BaseDN matching the filter,
+// returning only the attributes asked for.
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	SizeLimit  int
+	TimeLimit  int
+	Filter     Filter
+	Attributes []string
+}
+
+// SearchResultDone ends the entries found by a search.
+type SearchResultDone struct {
+	Result
+}
+
+// Result is the outcome of an operation.
+type Result struct {
+	Code      int
+	MatchedDN string
+	Message   string
+}
+
+// Err returns the result as an *Error, or nil if it was a success.
+func (r *Result) Err() error {
+	if r.Code == ResultSuccess {
+		return nil
+	}
+	return &Error{Code: r.Code, Message: r.Message}
+}
+
+// Error is an operation that didn't succeed.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("ldap: result code %d", e.Code)
+	}
+	return fmt.Sprintf("ldap: result code %d: %s", e.Code, e.Message)
+}
+
+// IsErrorCode reports whether err is an *Error with the result code.
+func IsErrorCode(err error, code int) bool {
+	var le *Error
+	return errors.As(err, &le) && le.Code == code
+}
+
+// Entry is an entry in the directory, found by a search.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Get returns the first value of the attribute, whose name is matched
+// without regard to case as it is in LDAP.
+func (e *Entry) Get(attr string) string {
+	if vs := e.Values(attr); len(vs) > 0 {
+		return vs[0]
+	}
+	return ""
+}
+
+// Values returns the values of the attribute.
+func (e *Entry) Values(attr string) []string {
+	for k, vs := range e.Attributes {
+		if strings.EqualFold(k, attr) {
+			return vs
+		}
+	}
+	return nil
+}
+
+// Marshal encodes the message.
+func (m *Message) Marshal() ([]byte, error) {
+	var op []byte
+	switch o := m.Op.(type) {
+	case *BindRequest:
+		op = encodeTLV(tagBindRequest,
+			encodeInt(tagInteger, protocolVersion),
+			encodeString(tagOctetString, o.Name),
+			encodeString(tagSimpleAuth, o.Password))
+	case *BindResponse:
+		op = o.encode(tagBindResponse)
+	case *UnbindRequest:
+		op = encodeTLV(tagUnbindRequest)
+	case *SearchRequest:
+		if o.Filter == nil {
+			return nil, errors.New("ldap: a search needs a filter")
+		}
+		var attrs [][]byte
+		for _, a := range o.Attributes {
+			attrs = append(attrs, encodeString(tagOctetString, a))
+		}
+		op = encodeTLV(tagSearchRequest,
+			encodeString(tagOctetString, o.BaseDN),
+			encodeInt(tagEnumerated, o.Scope),
+			encodeInt(tagEnumerated, derefAliasesFindingBaseDN),
+			encodeInt(tagInteger, o.SizeLimit),
+			encodeInt(tagInteger, o.TimeLimit),
+			encodeBool(false),
+			o.Filter.encode(),
+			encodeTLV(tagSequence, attrs...))
+	case *Entry:
+		var attrs [][]byte
+		for k, vs := range o.Attributes {
+			var vals [][]byte
+			for _, v := range vs {
+				vals = append(vals, encodeString(tagOctetString, v))
+			}
+			attrs = append(attrs, encodeTLV(tagSequence, encodeString(tagOctetString, k), encodeTLV(tagSet, vals...)))
+		}
+		op = encodeTLV(tagSearchResultEntry, encodeString(tagOctetString, o.DN), encodeTLV(tagSequence, attrs...))
+	case *SearchResultDone:
+		op = o.encode(tagSearchResultDone)
+	default:
+		return nil, fmt.Errorf("ldap: can't encode %T", m.Op)
+	}
+	return encodeTLV(tagSequence, encodeInt(tagInteger, m.ID), op), nil
+}
+
+func (r *Result) encode(tag byte) []byte {
+	return encodeTLV(tag,
+		encodeInt(tagEnumerated, r.Code),
+		encodeString(tagOctetString, r.MatchedDN),
+		encodeString(tagOctetString, r.Message))
+}
+
+// WriteMessage encodes the message to w.
+func WriteMessage(w io.Writer, m *Message) error {
+	b, err := m.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(b)
+	return err
+}
+
+// ReadMessage reads the next message from r. Operations it doesn't know
+// are returned as an *UnknownOp.
+func ReadMessage(r io.Reader) (*Message, error) {
+	t, err := readTLV(r)
+	if err != nil {
+		return nil, err
+	}
+	if t.tag != tagSequence {
+		return nil, fmt.Errorf("ldap: expected a message, got tag %#x", t.tag)
+	}
+	cs, err := t.children()
+	if err != nil {
+		return nil, err
+	}
+	if len(cs) < 2 || cs[0].tag != tagInteger {
+		return nil, errors.New("ldap: malformed message")
+	}
+	m := &Message{}
+	if m.ID, err = cs[0].int(); err != nil {
+		return nil, err
+	}
+	if m.Op, err = decodeOp(cs[1]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// UnknownOp is an operation ReadMessage doesn't decode.
+type UnknownOp struct {
+	Tag byte
+}
+
+func decodeOp(t tlv) (interface{}, error) {
+	switch t.tag {
+	case tagUnbindRequest:
+		return &UnbindRequest{}, nil
+	case tagSearchResultRef:
+		return &UnknownOp{Tag: t.tag}, nil
+	}
+	if !t.constructed() {
+		return &UnknownOp{Tag: t.tag}, nil
+	}
+	cs, err := t.children()
+	if err != nil {
+		return nil, err
+	}
+
+	switch t.tag {
+	case tagBindRequest:
+		if len(cs) != 3 {
+			return nil, errors.New("ldap: malformed bind request")
+		}
+		if v, err := cs[0].int(); err != nil || v != protocolVersion {
+			return nil, errors.New("ldap: only LDAPv3 is supported")
+		}
+		if cs[2].tag != tagSimpleAuth {
+			return nil, errors.New("ldap: only simple binds are supported")
+		}
+		return &BindRequest{Name: string(cs[1].content), Password: string(cs[2].content)}, nil
+	case tagBindResponse:
+		r, err := decodeResult(cs)
+		return &BindResponse{r}, err
+	case tagSearchResultDone:
+		r, err := decodeResult(cs)
+		return &SearchResultDone{r}, err
+	case tagSearchRequest:
+		return decodeSearchRequest(cs)
+	case tagSearchResultEntry:
+		return decodeEntry(cs)
+	}
+	return &UnknownOp{Tag: t.tag}, nil
+}
+
+func decodeResult(cs []tlv) (Result, error) {
+	if len(cs) < 3 {
+		return Result{}, errors.New("ldap: malformed result")
+	}
+	code, err := cs[0].int()
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Code: code, MatchedDN: string(cs[1].content), Message: string(cs[2].content)}, nil
+}
+
+func decodeSearchRequest(cs []tlv) (*SearchRequest, error) {
+	if len(cs) != 8 {
+		return nil, errors.New("ldap: malformed search request")
+	}
+	req := &SearchRequest{BaseDN: string(cs[0].content)}
+	var err error
+	if req.Scope, err = cs[1].int(); err != nil {
+		return nil, err
+	}
+	if req.SizeLimit, err = cs[3].int(); err != nil {
+		return nil, err
+	}
+	if req.TimeLimit, err = cs[4].int(); err != nil {
+		return nil, err
+	}
+	if req.Filter, err = decodeFilter(cs[6]); err != nil {
+		return nil, err
+	}
+	attrs, err := cs[7].children()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		req.Attributes = append(req.Attributes, string(a.content))
+	}
+	return req, nil
+}
+
+func decodeEntry(cs []tlv) (*Entry, error) {
+	if len(cs) != 2 {
+		return nil, errors.New("ldap: malformed search result entry")
+	}
+	e := &Entry{DN: string(cs[0].content), Attributes: map[string][]string{}}
+	attrs, err := cs[1].children()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range attrs {
+		parts, err := a.children()
+		if err != nil {
+			return nil, err
+		}
+		if len(parts) != 2 {
+			return nil, errors.New("ldap: malformed attribute")
+		}
+		vals, err := parts[1].children()
+		if err != nil {
+			return nil, err
+		}
+		name := string(parts[0].content)
+		for _, v := range vals {
+			e.Attributes[name] = append(e.Attributes[name], string(v.content))
+		}
+	}
+	return e, nil
+}
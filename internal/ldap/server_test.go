@@ -0,0 +1,116 @@
+package ldap_test
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/ldap"
+)
+
+// testServer is a stand-in directory server. It answers simple binds by
+// checking an entry's userPassword, letting binds without a password
+// through unauthenticated like real servers do, and searches by matching
+// its entries against the filter.
+type testServer struct {
+	ln      net.Listener
+	url     string
+	entries []*ldap.Entry
+
+	mu       sync.Mutex
+	searches []string
+	binds    []string
+}
+
+func newTestServer(t *testing.T, entries ...*ldap.Entry) *testServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ok(t, err)
+	s := &testServer{ln: ln, url: "ldap://" + ln.Addr().String(), entries: entries}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *testServer) close() {
+	s.ln.Close()
+}
+
+func (s *testServer) serve(conn net.Conn) {
+	defer conn.Close()
+	bound := ""
+	for {
+		m, err := ldap.ReadMessage(conn)
+		if err != nil {
+			return
+		}
+		var replies []interface{}
+		switch op := m.Op.(type) {
+		case *ldap.BindRequest:
+			s.mu.Lock()
+			s.binds = append(s.binds, op.Name)
+			s.mu.Unlock()
+			res := ldap.Result{Code: ldap.ResultInvalidCredentials}
+			if op.Password == "" {
+				res.Code, bound = ldap.ResultSuccess, ""
+			} else if e := s.entry(op.Name); e != nil && e.Get("userPassword") == op.Password {
+				res.Code, bound = ldap.ResultSuccess, e.DN
+			}
+			replies = append(replies, &ldap.BindResponse{Result: res})
+		case *ldap.SearchRequest:
+			s.mu.Lock()
+			s.searches = append(s.searches, op.Filter.String())
+			s.mu.Unlock()
+			if bound == "" {
+				replies = append(replies, &ldap.SearchResultDone{Result: ldap.Result{Code: ldap.ResultInsufficientAccess}})
+				break
+			}
+			replies = append(replies, s.search(op)...)
+		case *ldap.UnbindRequest:
+			return
+		default:
+			return
+		}
+		for _, r := range replies {
+			if err := ldap.WriteMessage(conn, &ldap.Message{ID: m.ID, Op: r}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *testServer) entry(dn string) *ldap.Entry {
+	for _, e := range s.entries {
+		if strings.EqualFold(e.DN, dn) {
+			return e
+		}
+	}
+	return nil
+}
+
+func (s *testServer) search(req *ldap.SearchRequest) []interface{} {
+	var replies []interface{}
+	for _, e := range s.entries {
+		if !strings.HasSuffix(strings.ToLower(e.DN), strings.ToLower(req.BaseDN)) || !req.Filter.Matches(e) {
+			continue
+		}
+		if req.SizeLimit > 0 && len(replies) == req.SizeLimit {
+			return append(replies, &ldap.SearchResultDone{Result: ldap.Result{Code: ldap.ResultSizeLimitExceeded}})
+		}
+		found := &ldap.Entry{DN: e.DN, Attributes: map[string][]string{}}
+		for _, a := range req.Attributes {
+			if vs := e.Values(a); vs != nil {
+				found.Attributes[a] = vs
+			}
+		}
+		replies = append(replies, found)
+	}
+	return append(replies, &ldap.SearchResultDone{})
+}
@@ -0,0 +1,64 @@
+// Package mail sends the app's transactional emails.
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails.
+type Mailer interface {
+	Send(msg *Message) error
+}
+
+// LogMailer writes emails to the log instead of sending them.
+// It is the default when no SMTP server is configured.
+type LogMailer struct {
+	Log *logrus.Logger
+}
+
+// Send satisfies the Mailer interface.
+func (lm *LogMailer) Send(msg *Message) error {
+	lm.Log.WithFields(logrus.Fields{
+		"to":      msg.To,
+		"subject": msg.Subject,
+	}).Info(msg.Body)
+	return nil
+}
+
+// SMTPMailer sends emails through an SMTP server.
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth
+}
+
+// Send satisfies the Mailer interface.
+func (sm *SMTPMailer) Send(msg *Message) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", sm.From)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", strings.NewReplacer("\r", "", "\n", "").Replace(msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	buf.WriteString(strings.Replace(msg.Body, "\n", "\r\n", -1))
+
+	err := smtp.SendMail(sm.Addr, sm.Auth, sm.From, []string{msg.To}, buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("error sending email to %s: %w", msg.To, err)
+	}
+	return nil
+}
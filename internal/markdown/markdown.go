@@ -0,0 +1,549 @@
+// Package markdown renders the common subset of Markdown people write in
+// notes to HTML: headings, paragraphs, emphasis, code, links, quotes,
+// lists and task lists, and rules.
+//
+// The HTML is safe to show as it is. Raw HTML in the source is escaped
+// rather than passed through, and links only keep http, https and mailto
+// URLs, or relative ones, so there's nothing to sanitize afterwards.
+package markdown
+
+import (
+	"html"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	headingRe  = regexp.MustCompile(`^ {0,3}(#{1,6})(?:[ \t]+(.*?))?(?:[ \t]+#+)?[ \t]*$`)
+	ruleRe     = regexp.MustCompile(`^ {0,3}(?:(?:\*[ \t]*){3,}|(?:-[ \t]*){3,}|(?:_[ \t]*){3,})$`)
+	fenceRe    = regexp.MustCompile("^ {0,3}(`{3,}|~{3,})[ \t]*([^`\\s]*)")
+	quoteRe    = regexp.MustCompile(`^ {0,3}> ?`)
+	bulletRe   = regexp.MustCompile(`^( {0,3})([-*+])(?:[ \t]+|$)`)
+	orderedRe  = regexp.MustCompile(`^( {0,3})(\d{1,9})[.)](?:[ \t]+|$)`)
+	taskRe     = regexp.MustCompile(`^\[([ xX])\][ \t]+`)
+	languageRe = regexp.MustCompile(`^[A-Za-z0-9_+.#-]+$`)
+	bareURLRe  = regexp.MustCompile(`^https?://[^\s<>"]*[^\s<>".,:;!?)\]'*_~]`)
+)
+
+// ToHTML renders Markdown source as HTML.
+func ToHTML(src string) string {
+	src = strings.NewReplacer("\r\n", "\n", "\r", "\n", "\x00", "�").Replace(src)
+	var b strings.Builder
+	renderBlocks(&b, strings.Split(src, "\n"), 0)
+	return b.String()
+}
+
+// maxBlockNesting is how deep quotes and lists can be nested in each other.
+// Anything nested deeper is shown as a paragraph of the text as written.
+const maxBlockNesting = 16
+
+// renderBlocks renders lines nested depth quotes and lists deep.
+func renderBlocks(b *strings.Builder, lines []string, depth int) {
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case isBlank(line):
+			i++
+		case fenceRe.MatchString(line):
+			i = renderFence(b, lines, i)
+		case headingRe.MatchString(line):
+			m := headingRe.FindStringSubmatch(line)
+			level := string('0' + rune(len(m[1])))
+			b.WriteString("<h" + level + ">" + renderInline(m[2]) + "</h" + level + ">\n")
+			i++
+		case ruleRe.MatchString(line):
+			b.WriteString("<hr>\n")
+			i++
+		case depth >= maxBlockNesting && (quoteRe.MatchString(line) || listMarker(line) != ""):
+			start := i
+			for i++; i < len(lines) && !isBlank(lines[i]); i++ {
+			}
+			b.WriteString("<p>" + renderInline(joinLines(lines[start:i])) + "</p>\n")
+		case quoteRe.MatchString(line):
+			var quoted []string
+			for ; i < len(lines) && quoteRe.MatchString(lines[i]); i++ {
+				quoted = append(quoted, quoteRe.ReplaceAllString(lines[i], ""))
+			}
+			b.WriteString("<blockquote>\n")
+			renderBlocks(b, quoted, depth+1)
+			b.WriteString("</blockquote>\n")
+		case listMarker(line) != "":
+			i = renderList(b, lines, i, depth)
+		default:
+			i = renderParagraph(b, lines, i)
+		}
+	}
+}
+
+// renderFence renders the fenced code block starting at lines[i], which
+// runs to the closing fence or the end, and returns the line after it.
+func renderFence(b *strings.Builder, lines []string, i int) int {
+	m := fenceRe.FindStringSubmatch(lines[i])
+	fence := m[1]
+	if languageRe.MatchString(m[2]) {
+		b.WriteString(`<pre><code class="language-` + html.EscapeString(m[2]) + `">`)
+	} else {
+		b.WriteString("<pre><code>")
+	}
+	for i++; i < len(lines); i++ {
+		if t := strings.TrimSpace(lines[i]); strings.HasPrefix(t, fence) && strings.Trim(t, fence[:1]) == "" {
+			i++
+			break
+		}
+		b.WriteString(html.EscapeString(lines[i]) + "\n")
+	}
+	b.WriteString("</code></pre>\n")
+	return i
+}
+
+// listMarker returns "ul" or "ol" if the line starts a list item.
+func listMarker(line string) string {
+	if bulletRe.MatchString(line) && !ruleRe.MatchString(line) {
+		return "ul"
+	}
+	if orderedRe.MatchString(line) {
+		return "ol"
+	}
+	return ""
+}
+
+// renderList renders the list starting at lines[i] and returns the line
+// after it. Lines indented under an item are part of it, so lists nest.
+func renderList(b *strings.Builder, lines []string, i, depth int) int {
+	kind := listMarker(lines[i])
+	if kind == "ol" {
+		if start := strings.TrimLeft(orderedRe.FindStringSubmatch(lines[i])[2], "0"); start != "1" && start != "" {
+			b.WriteString(`<ol start="` + start + `">` + "\n")
+		} else {
+			b.WriteString("<ol>\n")
+		}
+	} else {
+		b.WriteString("<ul>\n")
+	}
+
+	for i < len(lines) && listMarker(lines[i]) == kind {
+		re := bulletRe
+		if kind == "ol" {
+			re = orderedRe
+		}
+		marker := re.FindString(lines[i])
+		item := []string{lines[i][len(marker):]}
+		indent := len(marker)
+		if indent > 4 || strings.TrimSpace(marker) == marker {
+			indent = 2
+		}
+		loose := false
+		for i++; i < len(lines); i++ {
+			line := lines[i]
+			if isBlank(line) {
+				// A blank line only continues the item if more of it follows
+				j := i
+				for j < len(lines) && isBlank(lines[j]) {
+					j++
+				}
+				if j == len(lines) || leadingSpaces(lines[j]) < indent {
+					break
+				}
+				item = append(item, "")
+				loose = true
+				continue
+			}
+			if leadingSpaces(line) >= indent {
+				item = append(item, line[indent:])
+			} else if listMarker(line) == "" && !startsBlock(line) && !isBlank(item[len(item)-1]) {
+				// A lazy continuation of the item's paragraph
+				item = append(item, line)
+			} else {
+				break
+			}
+		}
+		for i < len(lines) && isBlank(lines[i]) && i+1 < len(lines) && listMarker(lines[i+1]) == kind {
+			i++
+		}
+		renderItem(b, item, loose, depth+1)
+	}
+
+	b.WriteString("</" + kind + ">\n")
+	return i
+}
+
+func renderItem(b *strings.Builder, item []string, loose bool, depth int) {
+	b.WriteString("<li>")
+	if m := taskRe.FindStringSubmatch(item[0]); m != nil {
+		if m[1] == " " {
+			b.WriteString(`<input type="checkbox" disabled> `)
+		} else {
+			b.WriteString(`<input type="checkbox" checked disabled> `)
+		}
+		item[0] = item[0][len(m[0]):]
+	}
+	if loose {
+		b.WriteString("\n")
+		renderBlocks(b, item, depth)
+		b.WriteString("</li>\n")
+		return
+	}
+	// A tight item's first paragraph isn't wrapped in <p>
+	n := 0
+	for n < len(item) && !isBlank(item[n]) && (n == 0 || !startsBlock(item[n])) {
+		n++
+	}
+	b.WriteString(renderInline(joinLines(item[:n])))
+	if n < len(item) {
+		b.WriteString("\n")
+		renderBlocks(b, item[n:], depth)
+	}
+	b.WriteString("</li>\n")
+}
+
+func renderParagraph(b *strings.Builder, lines []string, i int) int {
+	start := i
+	for i++; i < len(lines) && !isBlank(lines[i]) && !startsBlock(lines[i]); i++ {
+	}
+	b.WriteString("<p>" + renderInline(joinLines(lines[start:i])) + "</p>\n")
+	return i
+}
+
+// startsBlock returns whether the line starts a block that interrupts a
+// paragraph.
+func startsBlock(line string) bool {
+	return fenceRe.MatchString(line) || headingRe.MatchString(line) || ruleRe.MatchString(line) ||
+		quoteRe.MatchString(line) || listMarker(line) != ""
+}
+
+// joinLines joins a paragraph's lines, keeping their trailing spaces so
+// hard line breaks can be found.
+func joinLines(lines []string) string {
+	trimmed := make([]string, len(lines))
+	for i, l := range lines {
+		trimmed[i] = strings.TrimLeft(l, " \t")
+	}
+	return strings.Join(trimmed, "\n")
+}
+
+func isBlank(line string) bool {
+	return strings.TrimSpace(line) == ""
+}
+
+func leadingSpaces(line string) int {
+	n := 0
+	for n < len(line) && line[n] == ' ' {
+		n++
+	}
+	if n < len(line) && line[n] == '\t' {
+		n += 4
+	}
+	return n
+}
+
+// maxInlineNesting is how deep emphasis and links can be nested in each
+// other. Anything nested deeper is shown as it was written.
+const maxInlineNesting = 16
+
+// renderInline renders the text of a paragraph or heading.
+func renderInline(s string) string {
+	return newInline(s, 0).render()
+}
+
+// inline renders the inline Markdown in s. Each opening delimiter is
+// looked for a closer at most once in linear time: brackets and
+// parentheses are matched up front, and delimiters and backtick runs with
+// nothing left to close them are remembered, so text full of unclosed
+// ones isn't scanned again for each.
+type inline struct {
+	s     string
+	depth int
+	// brackets and parens map the position of each [ and ( to that of the
+	// ] or ) closing it. Parentheses only close on the same line.
+	brackets, parens map[int]int
+	// unclosedCode has the lengths of the backtick runs with no run as
+	// long after them, and unclosedEmphasis the emphasis delimiters with no
+	// closer after them.
+	unclosedCode     map[int]bool
+	unclosedEmphasis map[string]bool
+}
+
+func newInline(s string, depth int) *inline {
+	in := &inline{
+		s:                s,
+		depth:            depth,
+		brackets:         map[int]int{},
+		parens:           map[int]int{},
+		unclosedCode:     map[int]bool{},
+		unclosedEmphasis: map[string]bool{},
+	}
+	var brackets, parens []int
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			brackets = append(brackets, i)
+		case ']':
+			if n := len(brackets); n > 0 {
+				in.brackets[brackets[n-1]] = i
+				brackets = brackets[:n-1]
+			}
+		}
+	}
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			parens = append(parens, i)
+		case ')':
+			if n := len(parens); n > 0 {
+				in.parens[parens[n-1]] = i
+				parens = parens[:n-1]
+			}
+		case '\n':
+			parens = parens[:0]
+		}
+	}
+	return in
+}
+
+// renderNested renders text nested in emphasis or a link.
+func (in *inline) renderNested(s string) string {
+	if in.depth >= maxInlineNesting {
+		return html.EscapeString(s)
+	}
+	return newInline(s, in.depth+1).render()
+}
+
+func (in *inline) render() string {
+	s := in.s
+	var b strings.Builder
+	text := 0
+	flush := func(i int) {
+		b.WriteString(html.EscapeString(s[text:i]))
+	}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s) && strings.IndexByte("\\`*_{}[]()#+-.!~<>|", s[i+1]) >= 0:
+			flush(i)
+			b.WriteString(html.EscapeString(s[i+1 : i+2]))
+			i += 2
+			text = i
+			continue
+		case c == '\\' && i+1 < len(s) && s[i+1] == '\n', c == '\n' && i >= 2 && s[i-2:i] == "  ":
+			// A hard line break
+			b.WriteString(html.EscapeString(strings.TrimRight(s[text:i], " ")))
+			b.WriteString("<br>\n")
+			if c == '\\' {
+				i++
+			}
+			i++
+			text = i
+			continue
+		case c == '`':
+			if n, html := in.codeSpan(i); n > 0 {
+				flush(i)
+				b.WriteString(html)
+				i += n
+				text = i
+				continue
+			}
+		case c == '*' || c == '_' || c == '~':
+			if n, html := in.emphasis(i); n > 0 {
+				flush(i)
+				b.WriteString(html)
+				i += n
+				text = i
+				continue
+			}
+		case c == '[' || (c == '!' && i+1 < len(s) && s[i+1] == '['):
+			if n, html := in.link(i); n > 0 {
+				flush(i)
+				b.WriteString(html)
+				i += n
+				text = i
+				continue
+			}
+		case c == '<':
+			// An autolink has no spaces or < in it
+			if end := strings.IndexAny(s[i+1:], "<> \t\n"); end > 0 && s[i+1+end] == '>' {
+				end++
+				if href, ok := safeURL(s[i+1 : i+end]); ok && strings.Contains(s[i+1:i+end], ":") {
+					flush(i)
+					b.WriteString(anchor(href, html.EscapeString(s[i+1:i+end])))
+					i += end + 1
+					text = i
+					continue
+				}
+			}
+		case c == 'h' && (i == 0 || !isWordByte(s[i-1])):
+			if u := bareURLRe.FindString(s[i:]); u != "" {
+				flush(i)
+				href, _ := safeURL(u)
+				b.WriteString(anchor(href, html.EscapeString(u)))
+				i += len(u)
+				text = i
+				continue
+			}
+		}
+		i++
+	}
+	flush(len(s))
+	return strings.TrimRight(b.String(), " ")
+}
+
+// codeSpan renders the code span starting at s[i], returning how much of s
+// it took up, or 0 if there's no closing run of backticks as long.
+func (in *inline) codeSpan(i int) (int, string) {
+	s := in.s[i:]
+	ticks := len(s) - len(strings.TrimLeft(s, "`"))
+	if in.unclosedCode[ticks] {
+		return 0, ""
+	}
+	fence := s[:ticks]
+	for i := ticks; i < len(s); {
+		j := strings.Index(s[i:], fence)
+		if j < 0 {
+			break
+		}
+		j += i
+		end := j + ticks
+		if end < len(s) && s[end] == '`' {
+			// A longer run of backticks doesn't close it
+			for end < len(s) && s[end] == '`' {
+				end++
+			}
+			i = end
+			continue
+		}
+		code := strings.Replace(s[ticks:j], "\n", " ", -1)
+		if len(code) > 2 && code[0] == ' ' && code[len(code)-1] == ' ' && strings.TrimSpace(code) != "" {
+			code = code[1 : len(code)-1]
+		}
+		return end, "<code>" + html.EscapeString(code) + "</code>"
+	}
+	in.unclosedCode[ticks] = true
+	return 0, ""
+}
+
+// emphasis renders the emphasis, strong emphasis or strikethrough starting
+// at s[i], returning how much of s it took up, or 0 if it isn't closed.
+func (in *inline) emphasis(i int) (int, string) {
+	s := in.s
+	c := s[i]
+	run := 1
+	for i+run < len(s) && s[i+run] == c && run < 2 {
+		run++
+	}
+	tag := map[int]string{1: "em", 2: "strong"}[run]
+	if c == '~' {
+		if run != 2 {
+			return 0, ""
+		}
+		tag = "del"
+	}
+	delim := s[i : i+run]
+	open := i + run
+	if open >= len(s) || isSpace(s[open]) || in.unclosedEmphasis[delim] {
+		return 0, ""
+	}
+	// _ only emphasises whole words
+	if c == '_' && i > 0 && isWordByte(s[i-1]) {
+		return 0, ""
+	}
+	for j := open + 1; j <= len(s)-run; j++ {
+		if s[j] == '`' {
+			if n, _ := in.codeSpan(j); n > 0 {
+				j += n - 1
+				continue
+			}
+		}
+		if s[j:j+run] != delim || isSpace(s[j-1]) {
+			continue
+		}
+		after := j + run
+		if after < len(s) && s[after] == c {
+			// Part of a longer run, such as the end of ***both***
+			if run == 1 {
+				j++
+			}
+			continue
+		}
+		if c == '_' && after < len(s) && isWordByte(s[after]) {
+			continue
+		}
+		return after - i, "<" + tag + ">" + in.renderNested(s[open:j]) + "</" + tag + ">"
+	}
+	// Whether a delimiter closes doesn't depend on where the opener is, so
+	// no later opener like this one is closed either
+	in.unclosedEmphasis[delim] = true
+	return 0, ""
+}
+
+// link renders the link or image [text](url) starting at s[i], returning
+// how much of s it took up, or 0 if it isn't one. Images are shown as
+// links to them, so notes can't load anything when they're viewed.
+func (in *inline) link(i int) (int, string) {
+	s := in.s
+	image := s[i] == '!'
+	start := i + 1
+	if image {
+		start = i + 2
+	}
+	textEnd, ok := in.brackets[start-1]
+	if !ok || textEnd+1 >= len(s) || s[textEnd+1] != '(' {
+		return 0, ""
+	}
+	// The destination can have balanced parentheses in it
+	close, ok := in.parens[textEnd+1]
+	if !ok {
+		return 0, ""
+	}
+	end := close + 1
+	dest := strings.TrimSpace(s[textEnd+2 : close])
+	// Drop a title, as in [text](url "title")
+	if sp := strings.IndexAny(dest, " \t"); sp >= 0 {
+		dest = dest[:sp]
+	}
+	dest = strings.TrimSuffix(strings.TrimPrefix(dest, "<"), ">")
+
+	text := in.renderNested(s[start:textEnd])
+	if image && text == "" {
+		text = html.EscapeString(dest)
+	}
+	href, ok := safeURL(dest)
+	if !ok {
+		return end - i, text
+	}
+	return end - i, anchor(href, text)
+}
+
+func anchor(href, text string) string {
+	return `<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer">` + text + "</a>"
+}
+
+// safeURL returns the URL to link to if it's one that can't run script:
+// http, https or mailto, or one relative to the page.
+func safeURL(raw string) (string, bool) {
+	if raw == "" || strings.ContainsAny(raw, " \t\n<>\"") {
+		return "", false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https", "mailto":
+		return u.String(), true
+	case "":
+		if u.Opaque == "" && !strings.HasPrefix(raw, "//") {
+			return u.String(), true
+		}
+	}
+	return "", false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n'
+}
+
+func isWordByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= 0x80
+}
@@ -0,0 +1,96 @@
+package markdown_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/markdown"
+)
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		src, exp string
+	}{
+		{"# Plan *for* `today`", "<h1>Plan <em>for</em> <code>today</code></h1>\n"},
+		{"one\ntwo\n\nthree", "<p>one\ntwo</p>\n<p>three</p>\n"},
+		{"**bold**, _it_, ~~gone~~ and snake_case_word", "<p><strong>bold</strong>, <em>it</em>, <del>gone</del> and snake_case_word</p>\n"},
+		{"5 * 3 = 15 and \\*not em\\*", "<p>5 * 3 = 15 and *not em*</p>\n"},
+		{"line  \nbreak", "<p>line<br>\nbreak</p>\n"},
+		{"`` a ` b ``", "<p><code>a ` b</code></p>\n"},
+		{"- [ ] milk\n- [x] call\n  - nested\n- last",
+			"<ul>\n<li><input type=\"checkbox\" disabled> milk</li>\n<li><input type=\"checkbox\" checked disabled> call\n<ul>\n<li>nested</li>\n</ul>\n</li>\n<li>last</li>\n</ul>\n"},
+		{"3. three\n4. four", "<ol start=\"3\">\n<li>three</li>\n<li>four</li>\n</ol>\n"},
+		{"> quoted\n> **text**", "<blockquote>\n<p>quoted\n<strong>text</strong></p>\n</blockquote>\n"},
+		{"```go\nif a < b {}\n```\n---", "<pre><code class=\"language-go\">if a &lt; b {}\n</code></pre>\n<hr>\n"},
+		{"[link](https://example.com \"title\") and https://go.dev/doc.",
+			"<p><a href=\"https://example.com\" rel=\"nofollow noopener noreferrer\">link</a> and <a href=\"https://go.dev/doc\" rel=\"nofollow noopener noreferrer\">https://go.dev/doc</a>.</p>\n"},
+		{"![logo](/logo.png)", "<p><a href=\"/logo.png\" rel=\"nofollow noopener noreferrer\">logo</a></p>\n"},
+	}
+	for _, tt := range tests {
+		equals(t, tt.exp, markdown.ToHTML(tt.src))
+	}
+}
+
+// Nothing in the source can add markup that runs script.
+func TestToHTMLIsSafe(t *testing.T) {
+	tests := []struct {
+		src, exp string
+	}{
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{`<img src=x onerror="alert(1)">`, "<p>&lt;img src=x onerror=&#34;alert(1)&#34;&gt;</p>\n"},
+		{"[a](javascript:alert(1)) [b](JaVaScRiPt:x) [c](data:text/html,x) [d](//evil.com)", "<p>a b c d</p>\n"},
+		{`[a](/x"onmouseover="alert(1))`, "<p>a</p>\n"},
+		{"<javascript:alert(1)>", "<p>&lt;javascript:alert(1)&gt;</p>\n"},
+		{"```\"><script>\n</script>\n```", "<pre><code>&lt;/script&gt;\n</code></pre>\n"},
+	}
+	for _, tt := range tests {
+		equals(t, tt.exp, markdown.ToHTML(tt.src))
+	}
+}
+
+// Notes full of delimiters that are never closed, or nested very deep,
+// render in linear time rather than each being scanned for to the end.
+func TestToHTMLPathological(t *testing.T) {
+	const size = 64 << 10
+	for _, unit := range []string{"_a ", "*a ", "**a ", "~~a ", "[", "![", "[a](", "[a](((", "<a ", "``a `b "} {
+		src := strings.Repeat(unit, size/len(unit))
+		start := time.Now()
+		markdown.ToHTML(src)
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("rendering %d bytes of %q took %s", len(src), unit, d)
+		}
+	}
+
+	for _, src := range []string{strings.Repeat(">", size), strings.Repeat("> ", size/2), strings.Repeat("> - ", size/4)} {
+		start := time.Now()
+		markdown.ToHTML(src)
+		if d := time.Since(start); d > time.Second {
+			t.Fatalf("rendering %d bytes of %q took %s", len(src), src[:4], d)
+		}
+	}
+
+	// Past maxBlockNesting, quotes are shown as they were written
+	out := markdown.ToHTML(strings.Repeat(">", 20) + " a")
+	equals(t, 16, strings.Count(out, "<blockquote>"))
+	equals(t, true, strings.Contains(out, "<p>&gt;&gt;&gt;&gt; a</p>"))
+
+	// Past maxInlineNesting, what's nested is shown as it was written
+	src := strings.Repeat("[", 20) + "a" + strings.Repeat("](/u)", 20)
+	out = markdown.ToHTML(src)
+	equals(t, 17, strings.Count(out, "<a "))
+	equals(t, true, strings.Contains(out, ">[[[a](/u)](/u)](/u)</a>"))
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,31 @@
+package models
+
+import "time"
+
+// AccountDeletionGracePeriod is how long a user has to change their mind
+// after asking for their account to be deleted.
+const AccountDeletionGracePeriod = 14 * 24 * time.Hour
+
+// AccountService deals with a user's account as a whole, across every store.
+type AccountService interface {
+	Export(userID string) (*AccountExport, error)
+	GetUsersDueForDeletion(t time.Time) ([]*User, error)
+	Purge(userID string) (bool, error)
+}
+
+// AccountExport is everything we hold about a user, with secrets such as
+// the password hash and session tokens removed.
+type AccountExport struct {
+	User          *User             `json:"user"`
+	Sessions      []*Session        `json:"sessions"`
+	Todos         []*Todo           `json:"todos"`
+	Identities    []*LinkedIdentity `json:"identities"`
+	Notifications []*Notification   `json:"notifications"`
+	Lists         []*List           `json:"lists"`
+	Labels        []*Label          `json:"labels"`
+	Boards        []*Board          `json:"boards"`
+	Columns       []*Column         `json:"columns"`
+	NoteRevisions []*NoteRevision   `json:"note_revisions"`
+	Attachments   []*Attachment     `json:"attachments"`
+	Comments      []*Comment        `json:"comments"`
+}
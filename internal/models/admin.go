@@ -0,0 +1,14 @@
+package models
+
+// AdminService lets admins find users and look after their accounts.
+// Simple changes such as locking a user or granting admin rights go
+// through UserService.Update.
+type AdminService interface {
+	// SearchUsers returns up to limit users matching query, newest first,
+	// skipping the first offset matches. It also returns the total number
+	// of matches. An empty query matches every user.
+	SearchUsers(query string, offset, limit int) ([]*User, int, error)
+	// ForceLogout ends every session and revokes every remember token the
+	// user has, returning the number of sessions ended.
+	ForceLogout(userID string) (int, error)
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"io"
+	"time"
+)
+
+// MaxAttachmentSize is how big a file attached to a todo can be, in bytes.
+const MaxAttachmentSize = 25 << 20
+
+// DefaultAttachmentQuota is how many bytes of attachments each user can
+// have, counting uploads that haven't finished.
+const DefaultAttachmentQuota = 100 << 20
+
+// UploadExpiry is how long a resumable upload can go unfinished before
+// it's deleted.
+const UploadExpiry = 24 * time.Hour
+
+// BlobStore keeps the contents of attached files, addressed by their
+// SHA-256 hash, so a file attached many times is stored once. It only
+// holds the bytes: the AttachmentService counts which blobs are used.
+type BlobStore interface {
+	// Stage writes r to a new blob that isn't stored yet, sniffing its
+	// content type. It fails with aderrors.ErrTooLarge if r is longer
+	// than limit bytes.
+	Stage(r io.Reader, limit int64) (*StagedBlob, error)
+	// Append writes r to the end of the resumable upload with the ID,
+	// starting it if it doesn't exist, and returns how long it is now.
+	// The upload has to be offset bytes long already, or it fails with
+	// aderrors.ErrUploadOffset, and can't grow past limit bytes. If r
+	// fails partway, what was read of it is kept.
+	Append(uploadID string, offset int64, r io.Reader, limit int64) (int64, error)
+	// StageUpload turns a finished upload into a staged blob.
+	StageUpload(uploadID string) (*StagedBlob, error)
+	// DeleteUpload deletes the upload, if it exists.
+	DeleteUpload(uploadID string) error
+	// Commit stores the staged blob under its hash, or discards it if a
+	// blob with the hash is already stored.
+	Commit(sb *StagedBlob) error
+	// Discard deletes a staged blob that won't be stored.
+	Discard(sb *StagedBlob) error
+	// Open returns aderrors.ErrNoRecords if there's no such blob.
+	Open(hash string) (Blob, error)
+	// Delete deletes the blob, if it exists.
+	Delete(hash string) error
+	// List returns the hashes of every stored blob.
+	List() ([]string, error)
+}
+
+// Blob is a stored blob being read.
+type Blob interface {
+	io.ReadSeeker
+	io.Closer
+}
+
+// StagedBlob is a blob written by a BlobStore that hasn't been stored
+// under its hash yet. Path is where the BlobStore put it.
+type StagedBlob struct {
+	Hash        string
+	Size        int64
+	ContentType string
+	Path        string
+}
+
+// AttachmentService keeps the files attached to todos, and counts how many
+// attachments use each blob in the BlobStore, so blobs no attachment uses
+// any more can be deleted. Reading a todo's attachments needs
+// PermTodosRead on an org's todo, and changing them PermTodosWrite; other
+// todos' are only their owner's.
+type AttachmentService interface {
+	GetAttachments(todoID, userID string) ([]*Attachment, error)
+	// GetAttachment returns aderrors.ErrNoRecords if there's no such
+	// attachment, or the user can't read it.
+	GetAttachment(id, userID string) (*Attachment, error)
+	// CreateAttachment attaches the staged blob to the todo, storing it.
+	// It's an aderrors.ValidationError if it would take the user who
+	// uploaded it over their quota.
+	CreateAttachment(a *Attachment, sb *StagedBlob) error
+	DeleteAttachment(id, userID string) error
+	// GetUsage returns how many bytes of the user's quota they have used.
+	GetUsage(userID string) (int64, error)
+
+	// CreateUpload starts a resumable upload, reserving its size from the
+	// user's quota.
+	CreateUpload(up *Upload) error
+	// GetUpload returns aderrors.ErrNoRecords if the user has no such
+	// upload.
+	GetUpload(id, userID string) (*Upload, error)
+	// SetUploadOffset records how much of the upload has been received.
+	SetUploadOffset(id, userID string, offset int64) error
+	// CompleteUpload attaches the finished upload, staged as sb, to its
+	// todo.
+	CompleteUpload(id, userID string, sb *StagedBlob) (*Attachment, error)
+	// DeleteUpload deletes the upload, and what's been received of it.
+	DeleteUpload(id, userID string) error
+	// DeleteExpiredUploads deletes uploads started before the time, as
+	// DeleteUpload does, returning their IDs.
+	DeleteExpiredUploads(before time.Time) ([]string, error)
+
+	// DeleteUnusedBlobs deletes the blobs no attachment uses any more from
+	// the BlobStore, along with any it has that were never counted,
+	// returning how many there were.
+	DeleteUnusedBlobs() (int, error)
+}
+
+// Attachment is a file attached to a todo. UserID is the user who
+// uploaded it, whose quota it counts towards, and ContentType is sniffed
+// from the file, not taken from the upload. DownloadURL is filled in by
+// the app with where the file can be downloaded from.
+type Attachment struct {
+	ID          string    `json:"id" jsonapi:"primary,attachment"`
+	TodoID      string    `json:"todo_id" jsonapi:"attr,todo_id"`
+	UserID      string    `json:"user_id" jsonapi:"attr,user_id"`
+	Name        string    `json:"name" jsonapi:"attr,name"`
+	ContentType string    `json:"content_type" jsonapi:"attr,content_type"`
+	Size        int64     `json:"size" jsonapi:"attr,size"`
+	Hash        string    `json:"hash" jsonapi:"attr,hash"`
+	DateCreated time.Time `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+	DownloadURL string    `json:"-" jsonapi:"attr,download_url"`
+}
+
+func (a *Attachment) GenerateID() {
+	a.ID = generateULID()
+}
+
+// Upload is a file being uploaded in parts, to be attached to a todo once
+// all Size bytes of it have arrived. Offset is how many have so far.
+type Upload struct {
+	ID          string    `json:"id" jsonapi:"primary,upload"`
+	UserID      string    `json:"user_id"`
+	TodoID      string    `json:"todo_id" jsonapi:"attr,todo_id"`
+	Name        string    `json:"name" jsonapi:"attr,name"`
+	Size        int64     `json:"size" jsonapi:"attr,size"`
+	Offset      int64     `json:"offset" jsonapi:"attr,offset"`
+	DateCreated time.Time `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+}
+
+func (up *Upload) GenerateID() {
+	up.ID = generateULID()
+}
@@ -0,0 +1,146 @@
+package models
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// The actions recorded in the audit log.
+const (
+	AuditSignup                   = "signup"
+	AuditLoginSucceeded           = "login.succeeded"
+	AuditLoginFailed              = "login.failed"
+	AuditLoginRestored            = "login.restored"
+	AuditLogout                   = "logout"
+	AuditTokenCreated             = "token.created"
+	AuditRememberTokenReused      = "remember_token.reused"
+	AuditSessionRevoked           = "session.revoked"
+	AuditPasswordChanged          = "password.changed"
+	AuditEmailChanged             = "email.changed"
+	AuditAccountExported          = "account.exported"
+	AuditAccountDeletionRequested = "account.deletion_requested"
+	AuditAccountDeletionCancelled = "account.deletion_cancelled"
+	AuditAccountPurged            = "account.purged"
+	AuditAdminLogout              = "admin.logout"
+	AuditAdminLock                = "admin.lock"
+	AuditAdminUnlock              = "admin.unlock"
+	AuditAdminRolesChanged        = "admin.roles_changed"
+	AuditImpersonationStarted     = "impersonation.started"
+	AuditImpersonationStopped     = "impersonation.stopped"
+	AuditOrgCreated               = "org.created"
+	AuditOrgMemberRoleChanged     = "org.member_role_changed"
+	AuditOrgMemberRemoved         = "org.member_removed"
+	AuditOrgInvitationCreated     = "org.invitation_created"
+	AuditOrgInvitationAccepted    = "org.invitation_accepted"
+	AuditOrgInvitationRevoked     = "org.invitation_revoked"
+	AuditSignupInviteCreated      = "signup_invite.created"
+	AuditSignupInviteRevoked      = "signup_invite.revoked"
+	AuditOrgSCIMTokenCreated      = "org.scim_token_created"
+	AuditOrgSCIMTokenRevoked      = "org.scim_token_revoked"
+	AuditSCIMUserCreated          = "scim.user_created"
+	AuditSCIMUserUpdated          = "scim.user_updated"
+	AuditSCIMUserDeleted          = "scim.user_deleted"
+	AuditSCIMGroupCreated         = "scim.group_created"
+	AuditSCIMGroupUpdated         = "scim.group_updated"
+	AuditSCIMGroupDeleted         = "scim.group_deleted"
+	AuditIdentityLinked           = "identity.linked"
+)
+
+// AuditService is an append-only log of security events. Every event holds
+// the hash of the one before it, so editing or removing an event breaks the
+// chain.
+type AuditService interface {
+	// Record fills in the event's ID, time and hashes, and appends it.
+	Record(e *AuditEvent) error
+	// Query returns the matching events, newest first.
+	Query(q AuditQuery) ([]*AuditEvent, error)
+	// ForEach calls fn for every event, oldest first.
+	ForEach(fn func(e *AuditEvent) error) error
+	// Verify checks the whole chain, returning the number of events checked.
+	// A broken chain is reported as an *AuditChainError.
+	Verify() (int, error)
+}
+
+// AuditEvent is something that happened to an account. ActorID is the user
+// who did it, if known, and TargetID the user it was done to.
+type AuditEvent struct {
+	ID        string            `json:"id"`
+	Time      time.Time         `json:"time"`
+	Action    string            `json:"action"`
+	ActorID   string            `json:"actor_id,omitempty"`
+	TargetID  string            `json:"target_id,omitempty"`
+	IP        string            `json:"ip,omitempty"`
+	UserAgent string            `json:"user_agent,omitempty"`
+	Details   map[string]string `json:"details,omitempty"`
+	PrevHash  string            `json:"prev_hash"`
+	Hash      string            `json:"hash"`
+}
+
+// AuditQuery narrows down the events returned by AuditService.Query.
+// Zero fields match everything. Before is an event ID to page backwards from.
+type AuditQuery struct {
+	ActorID  string
+	TargetID string
+	UserID   string // matches either the actor or the target
+	Action   string // matches the action or any action under it, e.g. "admin"
+	Since    time.Time
+	Until    time.Time
+	Before   string
+	Limit    int
+}
+
+// AuditChainError says where the audit log's hash chain is broken.
+type AuditChainError struct {
+	EventID string
+	Problem string
+}
+
+func (ace *AuditChainError) Error() string {
+	return fmt.Sprintf("audit log chain broken at event %s: %s", ace.EventID, ace.Problem)
+}
+
+// SetClient records the IP and user agent the event came from.
+func (e *AuditEvent) SetClient(client ClientInfo) {
+	e.IP = client.IP
+	e.UserAgent = client.UserAgent
+}
+
+// ComputeHash returns the SHA-256 of the event's JSON encoding without its
+// own hash. PrevHash is included, which is what chains the events together.
+func (e *AuditEvent) ComputeHash() (string, error) {
+	c := *e
+	c.Hash = ""
+	b, err := json.Marshal(&c)
+	if err != nil {
+		return "", fmt.Errorf("error marshalling audit event %s: %w", e.ID, err)
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Matches reports whether the event matches the query's filters.
+// Before and Limit are left to the caller.
+func (q AuditQuery) Matches(e *AuditEvent) bool {
+	switch {
+	case q.ActorID != "" && e.ActorID != q.ActorID:
+		return false
+	case q.TargetID != "" && e.TargetID != q.TargetID:
+		return false
+	case q.UserID != "" && e.ActorID != q.UserID && e.TargetID != q.UserID:
+		return false
+	case q.Action != "" && e.Action != q.Action && !hasActionPrefix(e.Action, q.Action):
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !e.Time.Before(q.Until):
+		return false
+	}
+	return true
+}
+
+func hasActionPrefix(action, prefix string) bool {
+	return len(action) > len(prefix) && action[:len(prefix)] == prefix && action[len(prefix)] == '.'
+}
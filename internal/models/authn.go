@@ -0,0 +1,23 @@
+package models
+
+// Authenticator checks the email and password a user logs in with. Several
+// can be tried in turn, such as a directory and then the passwords kept
+// here.
+type Authenticator interface {
+	// Authenticate returns aderrors.ErrNoRecords if it doesn't know the
+	// user, so the next authenticator can be tried, and
+	// aderrors.ErrWrongPassword along with the Authentication if the
+	// password is wrong.
+	Authenticate(email, password string) (*Authentication, error)
+}
+
+// Authentication is a user who logged in, and how.
+type Authentication struct {
+	User *User
+	// Method is what checked the password, such as "password" or "ldap".
+	Method string
+	// Created is whether the user's account was just made for them.
+	Created bool
+	// Linked is the identity that was just linked to the user, if any.
+	Linked *LinkedIdentity
+}
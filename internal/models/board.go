@@ -0,0 +1,84 @@
+package models
+
+import "time"
+
+// BoardService keeps users' kanban boards. A board has columns in order,
+// and the user's own todos can be put in them as cards, also in order.
+type BoardService interface {
+	// GetBoardsByUserID returns the user's boards, each filled in as by
+	// GetBoard.
+	GetBoardsByUserID(userID string) ([]*Board, error)
+	// GetBoard returns the board with its columns and their cards, in
+	// order, or aderrors.ErrNoRecords if the user has no such board.
+	GetBoard(userID, id string) (*Board, error)
+	CreateBoard(b *Board) error
+	UpdateBoard(b *Board) error
+	// DeleteBoard deletes the board and its columns. Their cards aren't
+	// deleted, just taken off the board.
+	DeleteBoard(userID, id string) error
+
+	// GetColumn returns aderrors.ErrNoRecords if the user has no such
+	// column.
+	GetColumn(userID, id string) (*Column, error)
+	// CreateColumn adds the column after the last one on its board.
+	CreateColumn(c *Column) error
+	UpdateColumn(c *Column) error
+	// MoveColumn reorders the column on its board.
+	MoveColumn(userID, id string, m *ColumnMove) (*Column, error)
+	// DeleteColumn deletes the column, taking its cards off the board.
+	DeleteColumn(userID, id string) error
+
+	// MoveCard puts one of the user's todos in a column, or moves it
+	// within its column, in one transaction. A column at its WIP limit
+	// doesn't take more cards, which is an aderrors.ValidationError.
+	MoveCard(userID, todoID string, m *CardMove) (*Todo, error)
+}
+
+// Board is a user's kanban board. Only its columns are saved with a
+// BoardID; the BoardService fills in Columns, and Cards with the todos in
+// them, ordered by column and then by position.
+type Board struct {
+	ID          string    `json:"id" jsonapi:"primary,board"`
+	UserID      string    `json:"user_id"`
+	Name        string    `json:"name" jsonapi:"attr,name"`
+	DateCreated time.Time `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+	Columns     []*Column `json:"-" jsonapi:"relation,columns"`
+	Cards       []*Todo   `json:"-" jsonapi:"relation,cards"`
+}
+
+func (b *Board) GenerateID() {
+	b.ID = generateULID()
+}
+
+// Column is a column of a board, ordered on it by Position, a fracindex
+// key. WIPLimit is how many cards it can hold, with 0 meaning any number.
+type Column struct {
+	ID          string    `json:"id" jsonapi:"primary,column"`
+	UserID      string    `json:"user_id"`
+	BoardID     string    `json:"board_id"`
+	Board       *Board    `json:"-" jsonapi:"relation,board"`
+	Name        string    `json:"name" jsonapi:"attr,name"`
+	Position    string    `json:"position" jsonapi:"attr,position"`
+	WIPLimit    int       `json:"wip_limit,omitempty" jsonapi:"attr,wip_limit"`
+	DateCreated time.Time `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+}
+
+func (c *Column) GenerateID() {
+	c.ID = generateULID()
+}
+
+// ColumnMove says where to move a column: after AfterID or before BeforeID
+// on its board, or last without either.
+type ColumnMove struct {
+	AfterID  string
+	BeforeID string
+}
+
+// CardMove says where to move a card: into the column ColumnID, or off its
+// board if it's "", and after AfterID or before BeforeID among the cards
+// there, or last without either.
+type CardMove struct {
+	ColumnID string
+	AfterID  string
+	BeforeID string
+}
@@ -0,0 +1,71 @@
+package models
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+// MaxCommentLength is how long a comment can be, in characters.
+const MaxCommentLength = 10000
+
+// mentionRegexp finds @username mentions. The @ can't follow a letter or
+// digit, so email addresses aren't mentions.
+var mentionRegexp = regexp.MustCompile(`(?:^|[^\pL\pN_@])@([\pL\pN_.-]+)`)
+
+// CommentService keeps the comments on todos. Anyone who can read a todo
+// can read its comments, and anyone who can write it can comment on it;
+// other todos' are only their owner's, as with the TodoService.
+type CommentService interface {
+	// GetComments returns the todo's comments, oldest first. Deleted
+	// comments are kept in their place, without their body.
+	GetComments(todoID, userID string) ([]*Comment, error)
+	// GetComment returns aderrors.ErrNoRecords if the todo has no such
+	// comment, or the user can't read it.
+	GetComment(todoID, id, userID string) (*Comment, error)
+	// CreateComment saves the comment, setting MentionIDs to the users it
+	// mentions who can read the todo, besides its author.
+	CreateComment(c *Comment) error
+	// UpdateComment saves a new body for the comment, which only its
+	// author can do, marking it edited and finding its mentions again.
+	UpdateComment(c *Comment, userID string) error
+	// DeleteComment soft deletes the comment, which its author can do, as
+	// can an org's admins for comments on its todos.
+	DeleteComment(todoID, id, userID string) (*Comment, error)
+}
+
+// Comment is a user's comment on a todo. MentionIDs are the IDs of the
+// users it mentions with @username who can read the todo.
+type Comment struct {
+	ID          string     `json:"id" jsonapi:"primary,comment"`
+	TodoID      string     `json:"todo_id" jsonapi:"attr,todo_id"`
+	UserID      string     `json:"user_id" jsonapi:"attr,author_id"`
+	Body        string     `json:"body" jsonapi:"attr,body"`
+	MentionIDs  []string   `json:"mention_ids" jsonapi:"attr,mention_ids"`
+	DateCreated time.Time  `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+	Edited      bool       `json:"edited" jsonapi:"attr,edited"`
+	EditedTime  *time.Time `json:"edited_time,omitempty" jsonapi:"attr,edited_time,iso8601,omitempty"`
+	Deleted     bool       `json:"deleted" jsonapi:"attr,deleted"`
+	DeletedTime *time.Time `json:"deleted_time,omitempty" jsonapi:"attr,deleted_time,iso8601,omitempty"`
+}
+
+func (c *Comment) GenerateID() {
+	c.ID = generateULID()
+}
+
+// Mentions returns the usernames the comment mentions, each once, in the
+// order they're first mentioned. A mention ending a sentence, such as
+// "thanks @alice.", doesn't take the full stop.
+func (c *Comment) Mentions() []string {
+	seen := map[string]bool{}
+	var usernames []string
+	for _, m := range mentionRegexp.FindAllStringSubmatch(c.Body, -1) {
+		username := strings.ToLower(strings.TrimRight(m[1], ".-"))
+		if username == "" || seen[username] {
+			continue
+		}
+		seen[username] = true
+		usernames = append(usernames, username)
+	}
+	return usernames
+}
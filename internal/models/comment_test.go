@@ -0,0 +1,14 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestCommentMentions(t *testing.T) {
+	c := &models.Comment{Body: "@Alice can you check with @bob_smith? cc @alice, @j.doe. Mail me at sam@example.com or @@nobody"}
+	equals(t, []string{"alice", "bob_smith", "j.doe"}, c.Mentions())
+	c.Body = "no mentions @ all"
+	equals(t, []string(nil), c.Mentions())
+}
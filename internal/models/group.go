@@ -0,0 +1,55 @@
+package models
+
+import "time"
+
+// GroupService manages the groups an org's directory provisions with SCIM.
+// Groups can give their members a role in the org.
+type GroupService interface {
+	// CreateGroup, UpdateGroup and DeleteGroup bring the roles of the
+	// group's members up to date.
+	CreateGroup(g *Group) error
+	GetGroup(orgID, id string) (*Group, error)
+	GetGroups(orgID string) ([]*Group, error)
+	UpdateGroup(g *Group) error
+	DeleteGroup(orgID, id string) error
+}
+
+// Group is a set of an org's members.
+type Group struct {
+	ID          string `json:"id"`
+	OrgID       string `json:"org_id"`
+	DisplayName string `json:"display_name"`
+	ExternalID  string `json:"external_id,omitempty"`
+	// Role is the role the group gives its members, if any. Members get the
+	// highest role of their groups, but owners are never changed.
+	Role         OrgRole   `json:"role,omitempty"`
+	MemberIDs    []string  `json:"member_ids"`
+	DateCreated  time.Time `json:"date_created"`
+	DateModified time.Time `json:"date_modified"`
+}
+
+func (g *Group) GenerateID() {
+	g.ID = generateULID()
+}
+
+// HasMember reports whether the user is in the group.
+func (g *Group) HasMember(userID string) bool {
+	for _, id := range g.MemberIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// GroupRole returns the highest role the groups give the user, or "" if
+// none of them do.
+func GroupRole(groups []*Group, userID string) OrgRole {
+	var role OrgRole
+	for _, g := range groups {
+		if g.Role != "" && g.HasMember(userID) && g.Role.Outranks(role) {
+			role = g.Role
+		}
+	}
+	return role
+}
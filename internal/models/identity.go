@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// IdentityService links users to their accounts at identity providers, so
+// they can log in through them.
+type IdentityService interface {
+	// GetIdentity returns the identity the provider knows by the subject, or
+	// aderrors.ErrNoRecords.
+	GetIdentity(provider, subject string) (*LinkedIdentity, error)
+	GetIdentitiesByUserID(userID string) ([]*LinkedIdentity, error)
+	// LinkIdentity returns aderrors.ErrAlreadyExists if the identity is
+	// already linked, to the user or anyone else.
+	LinkIdentity(li *LinkedIdentity) (bool, error)
+	// RecordIdentityLogin notes that the identity was just used to log in.
+	RecordIdentityLogin(provider, subject string) error
+}
+
+// LinkedIdentity is a user's account at an identity provider. Subject is
+// what the provider calls them, such as a SAML NameID, and never changes
+// for an account, unlike its email.
+type LinkedIdentity struct {
+	Provider      string    `json:"provider"`
+	Subject       string    `json:"subject"`
+	UserID        string    `json:"user_id"`
+	Email         string    `json:"email,omitempty"`
+	DateCreated   time.Time `json:"date_created"`
+	LastLoginTime time.Time `json:"last_login_time"`
+}
@@ -0,0 +1,50 @@
+package models
+
+import "time"
+
+// ListService keeps users' todo lists and labels. Both belong to a user,
+// and can only be used on that user's own todos.
+type ListService interface {
+	GetListsByUserID(userID string) ([]*List, error)
+	// GetList returns aderrors.ErrNoRecords if the user has no such list.
+	GetList(userID, id string) (*List, error)
+	CreateList(l *List) error
+	UpdateList(l *List) error
+	// DeleteList deletes the list, taking its todos out of it.
+	DeleteList(userID, id string) error
+
+	GetLabelsByUserID(userID string) ([]*Label, error)
+	// GetLabel returns aderrors.ErrNoRecords if the user has no such label.
+	GetLabel(userID, id string) (*Label, error)
+	CreateLabel(l *Label) error
+	UpdateLabel(l *Label) error
+	// DeleteLabel deletes the label, taking it off its todos.
+	DeleteLabel(userID, id string) error
+}
+
+// List is a user's list of todos, such as a project. A todo is in at most
+// one list.
+type List struct {
+	ID          string    `json:"id" jsonapi:"primary,list"`
+	UserID      string    `json:"user_id"`
+	Name        string    `json:"name" jsonapi:"attr,name"`
+	DateCreated time.Time `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+}
+
+func (l *List) GenerateID() {
+	l.ID = generateULID()
+}
+
+// Label is a user's tag for todos. A todo can have any number of labels.
+// Color is a hex colour such as #ff8800.
+type Label struct {
+	ID          string    `json:"id" jsonapi:"primary,label"`
+	UserID      string    `json:"user_id"`
+	Name        string    `json:"name" jsonapi:"attr,name"`
+	Color       string    `json:"color" jsonapi:"attr,color"`
+	DateCreated time.Time `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+}
+
+func (l *Label) GenerateID() {
+	l.ID = generateULID()
+}
@@ -0,0 +1,20 @@
+package models
+
+import "time"
+
+// MaxNotesLength is how long a todo's notes can be, in bytes.
+const MaxNotesLength = 64 << 10
+
+// NoteRevision is a version of a todo's notes, saved each time they change.
+// Revisions are numbered from 1 for each todo. AuthorID is the user who
+// made the change, and RestoredFrom the revision it went back to, if it was
+// a restore.
+type NoteRevision struct {
+	ID           string    `json:"-" jsonapi:"primary,note_revision"`
+	Number       int       `json:"number" jsonapi:"attr,number"`
+	TodoID       string    `json:"todo_id"`
+	AuthorID     string    `json:"author_id" jsonapi:"attr,author_id"`
+	Notes        string    `json:"notes" jsonapi:"attr,notes"`
+	RestoredFrom int       `json:"restored_from,omitempty" jsonapi:"attr,restored_from,omitempty"`
+	DateCreated  time.Time `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+}
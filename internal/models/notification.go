@@ -0,0 +1,42 @@
+package models
+
+import "time"
+
+// The kinds of notification.
+const (
+	NotificationTodoReminder   = "todo.reminder"
+	NotificationCommentMention = "comment.mention"
+)
+
+// Notifier tells a user about something, such as by email.
+type Notifier interface {
+	// Name tells notifiers apart, such as "email" or "in_app".
+	Name() string
+	Notify(n *Notification) error
+}
+
+// NotificationService keeps the notifications shown to users in the app.
+type NotificationService interface {
+	// CreateNotification returns aderrors.ErrAlreadyExists if there's
+	// already a notification with the ID.
+	CreateNotification(n *Notification) (bool, error)
+	// GetNotificationsByUserID returns the user's notifications, newest
+	// first.
+	GetNotificationsByUserID(userID string) ([]*Notification, error)
+	// MarkNotificationRead returns aderrors.ErrNoRecords if the user has
+	// no such notification.
+	MarkNotificationRead(userID, id string) (*Notification, error)
+}
+
+// Notification is something a user is told about. The ID is the same
+// every time the same thing is notified, so doing it twice can be spotted.
+type Notification struct {
+	ID          string     `json:"id" jsonapi:"primary,notification"`
+	UserID      string     `json:"user_id"`
+	Kind        string     `json:"kind" jsonapi:"attr,kind"`
+	Title       string     `json:"title" jsonapi:"attr,title"`
+	Body        string     `json:"body" jsonapi:"attr,body"`
+	TodoID      string     `json:"todo_id,omitempty" jsonapi:"attr,todo_id,omitempty"`
+	DateCreated time.Time  `json:"date_created" jsonapi:"attr,date_created,iso8601"`
+	ReadTime    *time.Time `json:"read_time,omitempty" jsonapi:"attr,read_time,iso8601,omitempty"`
+}
@@ -0,0 +1,219 @@
+package models
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// InvitationLifetime is how long an invitation to join an org can be accepted.
+const InvitationLifetime = 7 * 24 * time.Hour
+
+// The permissions an org role can grant, besides the todo ones.
+const (
+	PermOrgMembersManage Permission = "org:members:manage"
+	PermOrgManage        Permission = "org:manage"
+)
+
+// OrgRole is a member's role within an org. It only applies to that org.
+type OrgRole string
+
+const (
+	OrgRoleViewer OrgRole = "viewer"
+	OrgRoleMember OrgRole = "member"
+	OrgRoleAdmin  OrgRole = "admin"
+	OrgRoleOwner  OrgRole = "owner"
+)
+
+// OrgRolePermissions maps every org role to the permissions it grants
+// within the org.
+var OrgRolePermissions = map[OrgRole][]Permission{
+	OrgRoleViewer: {PermTodosRead},
+	OrgRoleMember: {PermTodosRead, PermTodosWrite},
+	OrgRoleAdmin:  {PermTodosRead, PermTodosWrite, PermOrgMembersManage},
+	OrgRoleOwner:  {PermTodosRead, PermTodosWrite, PermOrgMembersManage, PermOrgManage},
+}
+
+// orgRoleRanks orders the org roles, so admins can only hand out roles up
+// to their own.
+var orgRoleRanks = map[OrgRole]int{OrgRoleViewer: 1, OrgRoleMember: 2, OrgRoleAdmin: 3, OrgRoleOwner: 4}
+
+var orgSlugRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,38}[a-z0-9]$`)
+
+// OrgService manages orgs, their members and invitations.
+type OrgService interface {
+	// CreateOrg creates the org with the user as its owner.
+	CreateOrg(org *Org, ownerID string) error
+	GetOrg(id string) (*Org, error)
+	GetOrgBySlug(slug string) (*Org, error)
+	GetOrgsByUserID(userID string) ([]*Org, error)
+	GetMembership(orgID, userID string) (*Membership, error)
+	GetMembers(orgID string) ([]*Membership, error)
+	// SetMemberRole and RemoveMember return aderrors.ErrLastOwner rather than
+	// leave the org without an owner.
+	SetMemberRole(orgID, userID string, role OrgRole) (*Membership, error)
+	RemoveMember(orgID, userID string) error
+	// CreateInvitation stores the invitation, returning the token to send
+	// to the invitee.
+	CreateInvitation(inv *Invitation) (string, error)
+	GetInvitations(orgID string) ([]*Invitation, error)
+	GetInvitationByToken(token string) (*Invitation, error)
+	// AcceptInvitation makes the user a member with the invitation's role.
+	AcceptInvitation(token string, u *User) (*Membership, error)
+	RevokeInvitation(orgID, id string) error
+	// AddMember returns aderrors.ErrAlreadyExists if the user is already a
+	// member.
+	AddMember(m *Membership) error
+	// UpdateMember saves changes to a membership, refusing with
+	// aderrors.ErrLastOwner to leave the org without an active owner.
+	UpdateMember(m *Membership) error
+	// CreateSCIMToken replaces the org's SCIM token with a new one, which
+	// is returned.
+	CreateSCIMToken(orgID string) (string, error)
+	RevokeSCIMToken(orgID string) error
+	GetOrgBySCIMToken(token string) (*Org, error)
+}
+
+// Org is a group of users who share todos.
+type Org struct {
+	ID          string    `json:"id"`
+	Slug        string    `json:"slug"`
+	Name        string    `json:"name"`
+	DateCreated time.Time `json:"date_created"`
+	// SCIMTokenHash is the hash of the bearer token the org's directory
+	// provisions users with. It's empty unless SCIM is set up.
+	SCIMTokenHash string `json:"scim_token_hash,omitempty"`
+}
+
+func (o *Org) GenerateID() {
+	o.ID = generateULID()
+}
+
+// Membership is a user's place in an org.
+type Membership struct {
+	OrgID      string    `json:"org_id"`
+	UserID     string    `json:"user_id"`
+	Role       OrgRole   `json:"role"`
+	DateJoined time.Time `json:"date_joined"`
+	// ExternalID is the member's ID in the org's directory, if they were
+	// provisioned with SCIM.
+	ExternalID string `json:"external_id,omitempty"`
+	// DeactivatedTime is when the directory deactivated the member. A
+	// deactivated member keeps their place but can't do anything in the
+	// org. It is zero for active members.
+	DeactivatedTime time.Time `json:"deactivated_time"`
+}
+
+// Invitation asks whoever has the email address to join the org. Only a
+// hash of the token is stored.
+type Invitation struct {
+	ID           string    `json:"id"`
+	OrgID        string    `json:"org_id"`
+	Email        string    `json:"email"`
+	Role         OrgRole   `json:"role"`
+	InviterID    string    `json:"inviter_id"`
+	TokenHash    string    `json:"token_hash"`
+	DateCreated  time.Time `json:"date_created"`
+	ExpiryTime   time.Time `json:"expiry_time"`
+	AcceptedTime time.Time `json:"accepted_time"`
+	AcceptedBy   string    `json:"accepted_by,omitempty"`
+}
+
+// NewInvitation creates an invitation to the org, returning the token to
+// send to the invitee alongside the invitation to store.
+func NewInvitation(orgID, email string, role OrgRole, inviterID string, now time.Time) (string, *Invitation, error) {
+	token, err := randomString(24)
+	if err != nil {
+		return "", nil, fmt.Errorf("error generating invitation token: %w", err)
+	}
+	inv := &Invitation{
+		ID:          generateULID(),
+		OrgID:       orgID,
+		Email:       strings.ToLower(email),
+		Role:        role,
+		InviterID:   inviterID,
+		TokenHash:   HashInvitationToken(token),
+		DateCreated: now,
+		ExpiryTime:  now.Add(InvitationLifetime),
+	}
+	return token, inv, nil
+}
+
+// NewSCIMToken returns a new bearer token for an org's directory.
+func NewSCIMToken() (string, error) {
+	token, err := randomString(32)
+	if err != nil {
+		return "", fmt.Errorf("error generating SCIM token: %w", err)
+	}
+	return token, nil
+}
+
+// HashSCIMToken returns the hash an org's SCIM token is stored under.
+func HashSCIMToken(token string) string {
+	return hashValidator(token)
+}
+
+// HashInvitationToken returns the hash an invitation token is stored under.
+func HashInvitationToken(token string) string {
+	return hashValidator(token)
+}
+
+// IsPending reports whether the invitation can still be accepted.
+func (inv *Invitation) IsPending(now time.Time) bool {
+	return inv.AcceptedTime.IsZero() && now.Before(inv.ExpiryTime)
+}
+
+// IsValidOrgSlug reports whether the slug can be used in org URLs: 3 to 40
+// lowercase letters, digits and dashes, not starting or ending with a dash.
+func IsValidOrgSlug(slug string) bool {
+	return orgSlugRegexp.MatchString(slug)
+}
+
+// IsValid reports whether the org role is one we know about.
+func (r OrgRole) IsValid() bool {
+	_, ok := OrgRolePermissions[r]
+	return ok
+}
+
+// Grants reports whether the org role grants the permission.
+func (r OrgRole) Grants(p Permission) bool {
+	for _, rp := range OrgRolePermissions[r] {
+		if rp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Outranks reports whether the org role grants more than other does.
+func (r OrgRole) Outranks(other OrgRole) bool {
+	return orgRoleRanks[r] > orgRoleRanks[other]
+}
+
+// IsActive reports whether the member hasn't been deactivated.
+func (m *Membership) IsActive() bool {
+	return m.DeactivatedTime.IsZero()
+}
+
+// Can reports whether the member's role grants the permission. Deactivated
+// members can't do anything. It's nil safe, so the result of a failed
+// membership lookup can be checked directly.
+func (m *Membership) Can(p Permission) bool {
+	return m != nil && m.IsActive() && m.Role.Grants(p)
+}
+
+// CanAssign reports whether the member may give someone the role, either
+// by inviting them or by changing the role of an existing member whose
+// current role is from. Pass an empty from for invitations. Only owners can
+// make or unmake owners; admins can hand out any other role.
+func (m *Membership) CanAssign(from, to OrgRole) bool {
+	if !m.Can(PermOrgMembersManage) {
+		return false
+	}
+	if m.Role == OrgRoleOwner {
+		return true
+	}
+	return orgRoleRanks[to] <= orgRoleRanks[m.Role] && orgRoleRanks[from] <= orgRoleRanks[m.Role] &&
+		to != OrgRoleOwner && from != OrgRoleOwner
+}
@@ -0,0 +1,33 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestMembershipCanAssign(t *testing.T) {
+	owner := &models.Membership{Role: models.OrgRoleOwner}
+	admin := &models.Membership{Role: models.OrgRoleAdmin}
+	member := &models.Membership{Role: models.OrgRoleMember}
+
+	assert(t, owner.CanAssign(models.OrgRoleMember, models.OrgRoleOwner), "owners should be able to make owners")
+	assert(t, owner.CanAssign(models.OrgRoleOwner, models.OrgRoleViewer), "owners should be able to demote owners")
+	assert(t, admin.CanAssign("", models.OrgRoleAdmin), "admins should be able to invite admins")
+	assert(t, admin.CanAssign(models.OrgRoleViewer, models.OrgRoleMember), "admins should be able to promote viewers")
+	assert(t, !admin.CanAssign(models.OrgRoleMember, models.OrgRoleOwner), "admins shouldn't be able to make owners")
+	assert(t, !admin.CanAssign(models.OrgRoleOwner, models.OrgRoleMember), "admins shouldn't be able to demote owners")
+	assert(t, !member.CanAssign("", models.OrgRoleViewer), "members shouldn't be able to invite")
+
+	var nobody *models.Membership
+	assert(t, !nobody.Can(models.PermTodosRead), "a nil membership can't do anything")
+}
+
+func TestIsValidOrgSlug(t *testing.T) {
+	for _, slug := range []string{"acme", "a-1", "123"} {
+		assert(t, models.IsValidOrgSlug(slug), "%q should be valid", slug)
+	}
+	for _, slug := range []string{"ab", "-acme", "acme-", "Acme", "ac me"} {
+		assert(t, !models.IsValidOrgSlug(slug), "%q shouldn't be valid", slug)
+	}
+}
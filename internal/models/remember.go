@@ -0,0 +1,99 @@
+package models
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// RememberTokenLifetime is how long a remember token stays valid after it
+// was issued. Every use rotates the token and restarts the clock.
+const RememberTokenLifetime = 30 * 24 * time.Hour
+
+// RememberTokenService issues and consumes "remember me" tokens.
+type RememberTokenService interface {
+	CreateRememberToken(userID, familyID string) (string, *RememberToken, error)
+	ConsumeRememberToken(token string) (string, *RememberToken, error)
+	DeleteRememberTokenFamily(familyID string) (bool, error)
+	PurgeExpiredRememberTokens(now time.Time) (int, error)
+}
+
+// RememberToken is a long-lived login token using the selector/validator
+// pattern. The selector is used to look the token up; only a hash of the
+// validator is stored, so a leaked database cannot be used to log in.
+//
+// Each use rotates the token: the old one is marked as rotated and a new one
+// is issued in the same family. Presenting a rotated token or a wrong
+// validator means the token has been stolen, and the whole family is revoked.
+type RememberToken struct {
+	Selector      string    `json:"selector"`
+	ValidatorHash string    `json:"validator_hash"`
+	UserID        string    `json:"user_id"`
+	FamilyID      string    `json:"family_id"`
+	DateCreated   time.Time `json:"date_created"`
+	ExpiryTime    time.Time `json:"expiry_time"`
+	RotatedTime   time.Time `json:"rotated_time"`
+}
+
+// IsRotated reports whether the token has already been exchanged for a new one.
+func (rt *RememberToken) IsRotated() bool {
+	return !rt.RotatedTime.IsZero()
+}
+
+// GenerateRememberToken creates a new selector and validator pair, returning
+// the cookie value to hand to the client alongside the token to store.
+func GenerateRememberToken(userID, familyID string, now time.Time) (string, *RememberToken, error) {
+	selector, err := randomString(12)
+	if err != nil {
+		return "", nil, fmt.Errorf("error generating remember token selector: %w", err)
+	}
+	validator, err := randomString(32)
+	if err != nil {
+		return "", nil, fmt.Errorf("error generating remember token validator: %w", err)
+	}
+	if familyID == "" {
+		familyID = generateULID()
+	}
+	rt := &RememberToken{
+		Selector:      selector,
+		ValidatorHash: hashValidator(validator),
+		UserID:        userID,
+		FamilyID:      familyID,
+		DateCreated:   now,
+		ExpiryTime:    now.Add(RememberTokenLifetime),
+	}
+	return selector + ":" + validator, rt, nil
+}
+
+// SplitRememberToken splits a token given by the client into its selector
+// and validator.
+func SplitRememberToken(token string) (selector, validator string, ok bool) {
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// CheckValidator compares the validator against the stored hash in constant time.
+func (rt *RememberToken) CheckValidator(validator string) bool {
+	return subtle.ConstantTimeCompare([]byte(hashValidator(validator)), []byte(rt.ValidatorHash)) == 1
+}
+
+func hashValidator(validator string) string {
+	h := sha256.Sum256([]byte(validator))
+	return hex.EncodeToString(h[:])
+}
+
+func randomString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
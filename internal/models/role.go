@@ -0,0 +1,145 @@
+package models
+
+import "sort"
+
+// Permission is the name of something a user is allowed to do.
+type Permission string
+
+const (
+	PermTodosRead        Permission = "todos:read"
+	PermTodosWrite       Permission = "todos:write"
+	PermUsersRead        Permission = "users:read"
+	PermUsersLogout      Permission = "users:logout"
+	PermUsersLock        Permission = "users:lock"
+	PermRolesManage      Permission = "roles:manage"
+	PermUsersImpersonate Permission = "users:impersonate"
+	PermAuditRead        Permission = "audit:read"
+	// PermSignupInvitesCreate lets users create signup invites within the
+	// member limits; PermSignupInvitesManage lifts the limits and lets them
+	// see and revoke everyone's.
+	PermSignupInvitesCreate Permission = "signup_invites:create"
+	PermSignupInvitesManage Permission = "signup_invites:manage"
+)
+
+// Role is a named set of permissions.
+type Role string
+
+const (
+	RoleViewer  Role = "viewer"
+	RoleMember  Role = "member"
+	RoleSupport Role = "support"
+	RoleAdmin   Role = "admin"
+)
+
+// DefaultRole is the role of users who haven't been assigned one.
+const DefaultRole = RoleMember
+
+// RolePermissions maps every role to the permissions it grants.
+var RolePermissions = map[Role][]Permission{
+	RoleViewer:  {PermTodosRead},
+	RoleMember:  {PermTodosRead, PermTodosWrite, PermSignupInvitesCreate},
+	RoleSupport: {PermTodosRead, PermTodosWrite, PermSignupInvitesCreate, PermUsersRead, PermUsersLogout, PermUsersImpersonate},
+	RoleAdmin: {PermTodosRead, PermTodosWrite, PermSignupInvitesCreate, PermUsersRead, PermUsersLogout, PermUsersImpersonate,
+		PermUsersLock, PermRolesManage, PermAuditRead, PermSignupInvitesManage},
+}
+
+// Roles returns every known role, sorted by name.
+func Roles() []Role {
+	roles := make([]Role, 0, len(RolePermissions))
+	for r := range RolePermissions {
+		roles = append(roles, r)
+	}
+	sort.Slice(roles, func(i, j int) bool { return roles[i] < roles[j] })
+	return roles
+}
+
+// IsValid reports whether the role is one we know about.
+func (r Role) IsValid() bool {
+	_, ok := RolePermissions[r]
+	return ok
+}
+
+// Grants reports whether the role grants the permission.
+func (r Role) Grants(p Permission) bool {
+	for _, rp := range RolePermissions[r] {
+		if rp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// Roles returns the roles assigned to the user. Users without any get
+// DefaultRole, and users who were made admins before roles existed get
+// RoleAdmin.
+func (u *User) Roles() []Role {
+	var roles []Role
+	if u.D != nil {
+		roles = append(roles, u.D.Roles...)
+		if u.D.IsAdmin && !hasRole(roles, RoleAdmin) {
+			roles = append(roles, RoleAdmin)
+		}
+	}
+	if len(roles) == 0 {
+		roles = []Role{DefaultRole}
+	}
+	return roles
+}
+
+// SetRoles replaces the user's roles. IsAdmin is kept in step with the
+// admin role.
+func (u *User) SetRoles(roles []Role) {
+	if u.D == nil {
+		u.D = &UserMetadata{}
+	}
+	u.D.Roles = []Role{}
+	for _, r := range roles {
+		if !hasRole(u.D.Roles, r) {
+			u.D.Roles = append(u.D.Roles, r)
+		}
+	}
+	u.D.IsAdmin = hasRole(u.D.Roles, RoleAdmin)
+}
+
+// HasRole reports whether the user has been assigned the role.
+func (u *User) HasRole(role Role) bool {
+	return hasRole(u.Roles(), role)
+}
+
+// Can reports whether any of the user's roles grants the permission.
+func (u *User) Can(p Permission) bool {
+	if u == nil {
+		return false
+	}
+	for _, r := range u.Roles() {
+		if r.Grants(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// CanImpersonate reports whether the user may act as the target. Nobody can
+// impersonate themselves, or someone with a permission they don't have.
+func (u *User) CanImpersonate(target *User) bool {
+	if u == nil || target == nil || u.ID == target.ID || !u.Can(PermUsersImpersonate) {
+		return false
+	}
+	for _, r := range target.Roles() {
+		for _, p := range RolePermissions[r] {
+			if !u.Can(p) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func hasRole(roles []Role, role Role) bool {
+	for _, r := range roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package models_test
+
+import (
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestUserRoles(t *testing.T) {
+	u := &models.User{}
+	equals(t, []models.Role{models.DefaultRole}, u.Roles())
+	assert(t, u.Can(models.PermTodosWrite), "members should be able to write todos")
+	assert(t, !u.Can(models.PermUsersRead), "members shouldn't be able to read users")
+
+	// Admins from before roles existed keep their rights
+	u.D = &models.UserMetadata{IsAdmin: true}
+	assert(t, u.IsAdmin(), "legacy admin should have the admin role")
+	assert(t, u.Can(models.PermRolesManage), "admins should be able to manage roles")
+
+	u.SetRoles([]models.Role{models.RoleViewer, models.RoleSupport, models.RoleViewer})
+	equals(t, []models.Role{models.RoleViewer, models.RoleSupport}, u.Roles())
+	equals(t, false, u.D.IsAdmin)
+	assert(t, u.Can(models.PermUsersLogout), "support should be able to log users out")
+	assert(t, !u.Can(models.PermUsersLock), "support shouldn't be able to lock users")
+
+	u.SetRoles([]models.Role{models.RoleAdmin})
+	equals(t, true, u.D.IsAdmin)
+
+	var nobody *models.User
+	assert(t, !nobody.Can(models.PermTodosRead), "a nil user can't do anything")
+}
+
+func TestRoleIsValid(t *testing.T) {
+	for _, r := range models.Roles() {
+		assert(t, r.IsValid(), "%s should be valid", r)
+	}
+	assert(t, !models.Role("owner").IsValid(), "unknown roles shouldn't be valid")
+}
+
+func TestCanImpersonate(t *testing.T) {
+	newUser := func(id string, roles ...models.Role) *models.User {
+		u := &models.User{ID: id}
+		u.SetRoles(roles)
+		return u
+	}
+	admin := newUser("admin", models.RoleAdmin)
+	support := newUser("support", models.RoleSupport)
+	member := newUser("member")
+
+	assert(t, admin.CanImpersonate(member), "admins should be able to impersonate members")
+	assert(t, admin.CanImpersonate(support), "admins should be able to impersonate support")
+	assert(t, support.CanImpersonate(member), "support should be able to impersonate members")
+	assert(t, !support.CanImpersonate(admin), "support shouldn't be able to impersonate admins")
+	assert(t, !member.CanImpersonate(support), "members shouldn't be able to impersonate anyone")
+	assert(t, !admin.CanImpersonate(admin), "nobody should be able to impersonate themselves")
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// SAMLRequestLifetime is how long the IdP has to answer an AuthnRequest.
+const SAMLRequestLifetime = 10 * time.Minute
+
+// SAMLService keeps track of SAML logins: the AuthnRequests we've sent,
+// and the assertions we've already accepted.
+type SAMLService interface {
+	SaveSAMLRequest(req *SAMLRequest) error
+	// ConsumeSAMLRequest returns the request and forgets it, so it can
+	// only be answered once. It returns aderrors.ErrNoRecords for unknown
+	// requests and aderrors.ErrExpired for ones too old to answer.
+	ConsumeSAMLRequest(id string) (*SAMLRequest, error)
+	// UseSAMLAssertion remembers the assertion's ID until expiry, and
+	// returns aderrors.ErrTokenReused if it has been used before.
+	UseSAMLAssertion(id string, expiry time.Time) error
+}
+
+// SAMLRequest is an AuthnRequest we sent, with where to send the user
+// after they log in.
+type SAMLRequest struct {
+	ID         string    `json:"id"`
+	Next       string    `json:"next"`
+	ExpiryTime time.Time `json:"expiry_time"`
+}
@@ -0,0 +1,38 @@
+package models
+
+// SearchService finds todos by the words in their names, notes and
+// comments.
+type SearchService interface {
+	// Search returns up to limit of the todos matching every word of the
+	// query, best match first, skipping the first offset matches. It also
+	// returns the total number of matches. Only todos the user can read are
+	// found, and never those in the trash.
+	Search(query, userID string, offset, limit int) ([]*SearchResult, int, error)
+	// Reindex builds the search index again from every todo and comment,
+	// returning the number of them indexed.
+	Reindex() (int, error)
+}
+
+// SearchResult is a todo found by a search. Its ID is the todo's.
+type SearchResult struct {
+	ID         string             `jsonapi:"primary,search_result"`
+	Score      float64            `jsonapi:"attr,score"`
+	Highlights []*SearchHighlight `jsonapi:"attr,highlights"`
+	Todo       *Todo              `jsonapi:"relation,todo"`
+}
+
+// SearchHighlight is a snippet of a todo's name, notes or one of its
+// comments with the words that matched wrapped in <mark> tags. The rest of
+// the snippet is HTML-escaped.
+type SearchHighlight struct {
+	Field     string `json:"field"`
+	CommentID string `json:"comment_id,omitempty"`
+	Snippet   string `json:"snippet"`
+}
+
+// The fields a SearchHighlight can be of.
+const (
+	SearchFieldName    = "name"
+	SearchFieldNotes   = "notes"
+	SearchFieldComment = "comment"
+)
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"regexp"
+	"strings"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
@@ -9,23 +11,69 @@ import (
 type SessionService interface {
 	GetSession(id string) (*Session, error)
 	GetSessionByToken(token string) (*Session, error)
+	GetSessionsByUserID(userID string) ([]*Session, error)
 	GetUserBySessionID(sessionID string) (*User, error)
-	CreateSession(userID string, tokenOnly bool) (*Session, error)
+	CreateSession(userID string, tokenOnly bool, opts SessionOptions) (*Session, error)
 	DeleteSession(id string) (bool, error)
+	PurgeExpiredSessions(now time.Time) (int, error)
 	GetUserByEmail(email string) (*User, error)
 	GetUserByUsername(username string) (*User, error)
+	CheckPassword(email, password string) (*User, error)
 	CreateUser(user *User) (bool, error)
+	UpdateUser(user *User) (bool, error)
 }
 
+// BrowserSessionLifetime is how long a cookie session lasts. Tokens don't expire.
+const BrowserSessionLifetime = 12 * time.Hour
+
+// ImpersonationLifetime is how long an admin can act as another user before
+// having to start again.
+const ImpersonationLifetime = time.Hour
+
 // Session contains the session data. It associates a user with a session ID.
 // Session.TokenOnly = true means that this session can only be accessed via token
+// Session.RememberFamilyID is set when the session was created by a "remember me"
+// login, so the remember tokens can be revoked along with the session.
+// Session.ImpersonatorID is set when an admin is acting as the user, and
+// holds the admin's user ID.
 type Session struct {
 	ID           string    `json:"id"`
-	Token        string    `json:"token"`
+	Token        string    `json:"token,omitempty"`
 	UserID       string    `json:"user_id" db:"user_id"`
 	TokenOnly    bool      `json:"token_only" db:"token_only"`
 	LoginTime    time.Time `json:"login_time" db:"login_time"`
 	LastSeenTime time.Time `json:"last_seen_time" db:"last_seen_time"`
+	UserAgent    string    `json:"user_agent" db:"user_agent"`
+	IP           string    `json:"ip" db:"ip"`
+	DeviceName   string    `json:"device_name" db:"device_name"`
+	ExpiryTime   time.Time `json:"expiry_time" db:"expiry_time"`
+
+	RememberFamilyID string `json:"remember_family_id" db:"remember_family_id"`
+	ImpersonatorID   string `json:"impersonator_id,omitempty" db:"impersonator_id"`
+}
+
+// SessionOptions holds the optional details recorded when creating a session.
+type SessionOptions struct {
+	Client           ClientInfo
+	RememberFamilyID string
+	ImpersonatorID   string
+}
+
+// ClientInfo describes the client a session is created for.
+type ClientInfo struct {
+	UserAgent string
+	IP        string
+}
+
+// IsExpired reports whether the session has expired at time t.
+// Sessions without an expiry time never expire.
+func (s *Session) IsExpired(t time.Time) bool {
+	return !s.ExpiryTime.IsZero() && t.After(s.ExpiryTime)
+}
+
+// IsImpersonation reports whether an admin is acting as the user in this session.
+func (s *Session) IsImpersonation() bool {
+	return s.ImpersonatorID != ""
 }
 
 func (s *Session) GenerateID() {
@@ -35,3 +83,75 @@ func (s *Session) GenerateID() {
 func (s *Session) GenerateToken() {
 	s.Token = uuid.NewV4().String()
 }
+
+// SetClient records the user agent, IP and a friendly device name on the session.
+func (s *Session) SetClient(client ClientInfo) {
+	s.UserAgent = client.UserAgent
+	s.IP = client.IP
+	s.DeviceName = DeviceName(client.UserAgent)
+}
+
+// The order of these matters: Edge and Opera advertise Chrome, and Chrome
+// advertises Safari.
+var uaBrowsers = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"Edge", regexp.MustCompile(`Edg(e|A|iOS)?/`)},
+	{"Opera", regexp.MustCompile(`(OPR|Opera)/`)},
+	{"Firefox", regexp.MustCompile(`(Firefox|FxiOS)/`)},
+	{"Chrome", regexp.MustCompile(`(Chrome|CriOS)/`)},
+	{"Safari", regexp.MustCompile(`Safari/`)},
+}
+
+var uaOSes = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"iPhone", regexp.MustCompile(`iPhone`)},
+	{"iPad", regexp.MustCompile(`iPad`)},
+	{"Android", regexp.MustCompile(`Android`)},
+	{"Windows", regexp.MustCompile(`Windows`)},
+	{"macOS", regexp.MustCompile(`Mac OS X|Macintosh`)},
+	{"ChromeOS", regexp.MustCompile(`CrOS`)},
+	{"Linux", regexp.MustCompile(`Linux`)},
+}
+
+// DeviceName turns a user agent string into something a person would
+// recognise, e.g. "Firefox on Windows". Non-browser clients are named after
+// their product token, e.g. "curl".
+func DeviceName(userAgent string) string {
+	userAgent = strings.TrimSpace(userAgent)
+	if userAgent == "" {
+		return "Unknown device"
+	}
+
+	var browser, os string
+	for _, b := range uaBrowsers {
+		if b.re.MatchString(userAgent) {
+			browser = b.name
+			break
+		}
+	}
+	for _, o := range uaOSes {
+		if o.re.MatchString(userAgent) {
+			os = o.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	case os != "":
+		return "Unknown browser on " + os
+	}
+
+	product := strings.Fields(userAgent)[0]
+	if i := strings.Index(product, "/"); i > 0 {
+		product = product[:i]
+	}
+	return product
+}
@@ -0,0 +1,147 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SignupMode decides who can create an account.
+type SignupMode string
+
+const (
+	// SignupOpen lets anyone sign up.
+	SignupOpen SignupMode = "open"
+	// SignupClosed turns signups off altogether, invites included.
+	SignupClosed SignupMode = "closed"
+	// SignupInviteOnly only lets people with a signup invite sign up.
+	SignupInviteOnly SignupMode = "invite"
+	// SignupDomains lets people sign up with an email address at one of the
+	// allowed domains, or with a signup invite.
+	SignupDomains SignupMode = "domains"
+)
+
+// The limits on signup invites created by users without
+// PermSignupInvitesManage.
+const (
+	DefaultSignupInviteLifetime = 7 * 24 * time.Hour
+	MaxMemberInviteLifetime     = 30 * 24 * time.Hour
+	MaxMemberInviteUses         = 5
+)
+
+// ParseSignupMode returns the signup mode with the given name.
+func ParseSignupMode(s string) (SignupMode, error) {
+	switch m := SignupMode(strings.ToLower(strings.TrimSpace(s))); m {
+	case SignupOpen, SignupClosed, SignupInviteOnly, SignupDomains:
+		return m, nil
+	}
+	return "", fmt.Errorf("unknown signup mode %q, should be one of open, closed, invite or domains", s)
+}
+
+// SignupPolicy is how the site is configured to take signups.
+type SignupPolicy struct {
+	Mode SignupMode
+	// AllowedDomains are the email domains anyone can sign up with in
+	// SignupDomains mode, like "example.com". Subdomains aren't included.
+	AllowedDomains []string
+}
+
+// AllowsDomain reports whether the email address is at one of the allowed
+// domains.
+func (p SignupPolicy) AllowsDomain(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+	domain := email[at+1:]
+	for _, d := range p.AllowedDomains {
+		if strings.EqualFold(domain, strings.TrimPrefix(strings.TrimSpace(d), "@")) {
+			return true
+		}
+	}
+	return false
+}
+
+// NeedsInvite reports whether someone with the email address needs a signup
+// invite to sign up. It's meaningless in SignupClosed mode, where nobody can.
+func (p SignupPolicy) NeedsInvite(email string) bool {
+	switch p.Mode {
+	case SignupInviteOnly:
+		return true
+	case SignupDomains:
+		return !p.AllowsDomain(email)
+	}
+	return false
+}
+
+// SignupInviteService manages the invite codes people can sign up with.
+type SignupInviteService interface {
+	// CreateSignupInvite stores the invite, returning the code to hand out.
+	CreateSignupInvite(inv *SignupInvite) (string, error)
+	GetSignupInvite(id string) (*SignupInvite, error)
+	GetSignupInviteByCode(code string) (*SignupInvite, error)
+	// GetSignupInvites returns the user's invites, or everyone's if userID
+	// is empty, newest first.
+	GetSignupInvites(userID string) ([]*SignupInvite, error)
+	// RedeemSignupInvite uses up one of the invite's uses to create the new
+	// user, only using it up if the user is created. It returns
+	// aderrors.ErrExpired if the invite can't be used any more.
+	RedeemSignupInvite(code string, u *User) (*SignupInvite, error)
+	RevokeSignupInvite(id string) error
+}
+
+// SignupInvite is a code that lets people sign up when signups are
+// restricted. Only a hash of the code is stored.
+type SignupInvite struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"` // who created it
+	Note        string    `json:"note"`
+	CodeHash    string    `json:"code_hash"`
+	MaxUses     int       `json:"max_uses"` // zero for unlimited
+	UsedBy      []string  `json:"used_by"`
+	DateCreated time.Time `json:"date_created"`
+	// ExpiryTime is zero for invites that never expire.
+	ExpiryTime  time.Time `json:"expiry_time"`
+	RevokedTime time.Time `json:"revoked_time"`
+}
+
+// NewSignupInvite creates an invite from the given one's creator, note, use
+// limit and expiry, returning the code to hand out alongside the invite to
+// store.
+func NewSignupInvite(inv *SignupInvite, now time.Time) (string, *SignupInvite, error) {
+	code, err := randomString(18)
+	if err != nil {
+		return "", nil, fmt.Errorf("error generating signup invite code: %w", err)
+	}
+	stored := &SignupInvite{
+		ID:          generateULID(),
+		UserID:      inv.UserID,
+		Note:        inv.Note,
+		CodeHash:    HashSignupInviteCode(code),
+		MaxUses:     inv.MaxUses,
+		DateCreated: now,
+		ExpiryTime:  inv.ExpiryTime,
+	}
+	return code, stored, nil
+}
+
+// HashSignupInviteCode returns the hash an invite code is stored under.
+func HashSignupInviteCode(code string) string {
+	return hashValidator(code)
+}
+
+// Uses is how many accounts have been created with the invite.
+func (inv *SignupInvite) Uses() int {
+	return len(inv.UsedBy)
+}
+
+// IsUsable reports whether someone can still sign up with the invite.
+func (inv *SignupInvite) IsUsable(now time.Time) bool {
+	if !inv.RevokedTime.IsZero() {
+		return false
+	}
+	if !inv.ExpiryTime.IsZero() && !now.Before(inv.ExpiryTime) {
+		return false
+	}
+	return inv.MaxUses == 0 || inv.Uses() < inv.MaxUses
+}
@@ -0,0 +1,40 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/models"
+)
+
+func TestSignupPolicyNeedsInvite(t *testing.T) {
+	p := models.SignupPolicy{Mode: models.SignupDomains, AllowedDomains: []string{"example.com", "@Corp.org"}}
+	assert(t, !p.NeedsInvite("sam@example.com"), "allowed domains shouldn't need an invite")
+	assert(t, !p.NeedsInvite("sam@corp.ORG"), "domains should be matched case insensitively")
+	assert(t, p.NeedsInvite("sam@mail.example.com"), "subdomains shouldn't be allowed")
+	assert(t, p.NeedsInvite("sam@example.com.evil.net"), "only the whole domain should match")
+
+	p.Mode = models.SignupInviteOnly
+	assert(t, p.NeedsInvite("sam@example.com"), "invite only signups always need an invite")
+	p.Mode = models.SignupOpen
+	assert(t, !p.NeedsInvite("sam@elsewhere.net"), "open signups never need an invite")
+
+	_, err := models.ParseSignupMode("sometimes")
+	assert(t, err != nil, "expected an unknown mode to be refused")
+	m, err := models.ParseSignupMode(" Invite ")
+	ok(t, err)
+	equals(t, models.SignupInviteOnly, m)
+}
+
+func TestSignupInviteIsUsable(t *testing.T) {
+	now := time.Now()
+	inv := &models.SignupInvite{MaxUses: 1}
+	assert(t, inv.IsUsable(now), "an unused invite should be usable")
+	inv.UsedBy = []string{"someone"}
+	assert(t, !inv.IsUsable(now), "a used up invite shouldn't be usable")
+
+	inv = &models.SignupInvite{ExpiryTime: now}
+	assert(t, !inv.IsUsable(now), "an expired invite shouldn't be usable")
+	inv = &models.SignupInvite{RevokedTime: now}
+	assert(t, !inv.IsUsable(now), "a revoked invite shouldn't be usable")
+}
@@ -1,23 +1,342 @@
 package models
 
 import (
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/rrule"
 	null "gopkg.in/guregu/null.v3"
 )
 
+// ExDateFormat is the format of a recurring todo's ExDates.
+const ExDateFormat = "2006-01-02"
+
+// DefaultMaxTodoDepth is how deep subtasks can be nested if the TodoService
+// isn't told otherwise: a todo, its subtasks, and theirs.
+const DefaultMaxTodoDepth = 3
+
+// DefaultTrashRetention is how long todos stay in the trash before they're
+// deleted for good.
+const DefaultTrashRetention = 30 * 24 * time.Hour
+
+// The priorities a todo can have, from lowest to highest.
+const (
+	PriorityNone = iota
+	PriorityLow
+	PriorityMedium
+	PriorityHigh
+)
+
 type TodoService interface {
 	Get(id string) (*Todo, error)
+	// GetByUserID returns the user's own todos, without those of their orgs.
+	GetByUserID(userID string) ([]*Todo, error)
+	// GetByOrgID returns the org's todos, provided the user may read them.
+	GetByOrgID(orgID, userID string) ([]*Todo, error)
+	// Create saves a todo. Org todos are only saved if their creator,
+	// UserID, may write to the org's todos.
 	Create(*Todo) (bool, error)
-	//Update(*Todo) (bool, error)
-	//Delete(id string) (bool, error)
+	// Update saves changes to a todo, provided userID may write it: it's
+	// their own, or they may write the org's todos. Completing an
+	// occurrence of a recurring todo creates the next one in the same
+	// transaction, which is returned; it's nil otherwise.
+	Update(td *Todo, userID string) (next *Todo, err error)
+	// Skip moves a recurring todo on to its next occurrence, adding the
+	// skipped one to its ExDates. It returns aderrors.ErrNoRecords if the
+	// series has no more occurrences.
+	Skip(id, userID string) (*Todo, error)
+	// GetSeries returns the occurrences of a recurring todo in order,
+	// provided the user may read them.
+	GetSeries(seriesID, userID string) ([]*Todo, error)
+	// GetChildren returns the todo's subtasks in order, provided the user
+	// may read them.
+	GetChildren(id, userID string) ([]*Todo, error)
+	// Move puts the todo in a new place among its siblings, under a new
+	// parent or the same one, in a single transaction. Moves that would
+	// make a todo its own ancestor, or nest subtasks too deep, are an
+	// aderrors.ValidationError.
+	Move(id, userID string, m *TodoMove) (*Todo, error)
+	// GetNoteRevisions returns every version of the todo's notes, oldest
+	// first, provided the user may read it.
+	GetNoteRevisions(id, userID string) ([]*NoteRevision, error)
+	// GetNoteRevision returns aderrors.ErrNoRecords if the todo's notes
+	// have no such revision.
+	GetNoteRevision(id string, rev int, userID string) (*NoteRevision, error)
+	// RestoreNotes sets the todo's notes back to an old revision, provided
+	// the user may write it. This is a new revision, so it can be undone.
+	RestoreNotes(id string, rev int, userID string) (*Todo, error)
+
+	// Delete moves the todos and their subtasks to the trash, provided the
+	// user may write them all, in a single transaction. It returns the
+	// token Undo takes to restore them. Trashed todos are left out
+	// everywhere else, as if they'd been deleted.
+	Delete(ids []string, userID string) (undoToken string, err error)
+	// GetTrash returns the todos in the trash of the org, or the user's if
+	// orgID is "", provided the user may read them, most recently trashed
+	// first.
+	GetTrash(orgID, userID string) ([]*Todo, error)
+	// Restore takes the todo out of the trash with the subtasks trashed
+	// along with it, provided the user may write it, returning them.
+	Restore(id, userID string) ([]*Todo, error)
+	// Undo restores the todos the user trashed together, returning
+	// aderrors.ErrNoRecords once none of them are left in the trash.
+	Undo(undoToken, userID string) ([]*Todo, error)
+	// EmptyTrash deletes the todos in the trash of the org, or the user's
+	// if orgID is "", for good, returning how many there were. Emptying an
+	// org's trash needs PermOrgMembersManage.
+	EmptyTrash(orgID, userID string) (int, error)
+	// PurgeTrash deletes the todos trashed before the time for good,
+	// returning how many there were.
+	PurgeTrash(before time.Time) (int, error)
 }
 
+// Todo is a single todo item. It belongs to the org if OrgID is set, and to
+// the user otherwise; UserID is always who created it. Neither is exposed
+// over the API.
+//
+// DueAt and RemindAt are instants; TimeZone is the IANA name of the zone
+// they're shown in, such as in reminders, and is UTC if it isn't set.
+//
+// A todo with an RRule recurs: completing it creates the next occurrence.
+// The occurrences of a series share its SeriesID, the ID of the first, and
+// SeriesStart, when the rule started. RecurrenceID is when the occurrence
+// was scheduled, which stays the same if its DueAt is moved. ExDates are
+// the dates, in TimeZone, of occurrences that are skipped.
+//
+// A user's own todos can be put in one of their lists and given their
+// labels. Only ListID and LabelIDs are saved; the TodoService fills in
+// List and Labels when it reads the todo.
+//
+// Notes are Markdown. Every version of them is kept as a NoteRevision.
+//
+// A todo with a ParentID is a subtask of a todo with the same owner.
+// Siblings are ordered by Position, a fracindex key. A parent with
+// AutoComplete is done exactly when all its subtasks are.
+//
+// A user's own todo can also be a card in a column of one of their boards.
+// ColumnID is saved, and cards are ordered in the column by CardPosition.
+//
+// A todo in the trash has a DeletedAt. Todos trashed together share a
+// TrashID, and DeletedBy is who trashed them.
 type Todo struct {
 	ID          string      `json:"id" jsonapi:"primary,todo"`
+	UserID      string      `json:"user_id"`
+	OrgID       string      `json:"org_id,omitempty"`
 	Name        null.String `json:"name" jsonapi:"attr,name"`
 	IsDone      null.Bool   `json:"is_done" jsonapi:"attr,is_done"`
 	DateCreated null.Time   `json:"date_created" jsonapi:"attr,date_created"`
+	DueAt       null.Time   `json:"due_at" jsonapi:"attr,due_at"`
+	RemindAt    null.Time   `json:"remind_at" jsonapi:"attr,remind_at"`
+	TimeZone    null.String `json:"time_zone" jsonapi:"attr,time_zone"`
+	Notes       string      `json:"notes,omitempty" jsonapi:"attr,notes"`
+
+	RRule        null.String `json:"rrule" jsonapi:"attr,rrule"`
+	ExDates      []string    `json:"exdates,omitempty" jsonapi:"attr,exdates,omitempty"`
+	SeriesID     string      `json:"series_id,omitempty" jsonapi:"attr,series_id,omitempty"`
+	SeriesStart  null.Time   `json:"series_start"`
+	RecurrenceID null.Time   `json:"recurrence_id" jsonapi:"attr,recurrence_id"`
+	NextID       string      `json:"next_id,omitempty" jsonapi:"attr,next_id,omitempty"`
+
+	Priority int      `json:"priority,omitempty" jsonapi:"attr,priority"`
+	ListID   string   `json:"list_id,omitempty"`
+	LabelIDs []string `json:"label_ids,omitempty"`
+	List     *List    `json:"-" jsonapi:"relation,list"`
+	Labels   []*Label `json:"-" jsonapi:"relation,labels"`
+
+	ParentID     string `json:"parent_id,omitempty"`
+	Parent       *Todo  `json:"-" jsonapi:"relation,parent"`
+	Position     string `json:"position,omitempty" jsonapi:"attr,position"`
+	AutoComplete bool   `json:"auto_complete,omitempty" jsonapi:"attr,auto_complete"`
+
+	ColumnID     string  `json:"column_id,omitempty"`
+	Column       *Column `json:"-" jsonapi:"relation,column"`
+	CardPosition string  `json:"card_position,omitempty" jsonapi:"attr,card_position,omitempty"`
+
+	DeletedAt null.Time `json:"deleted_at" jsonapi:"attr,deleted_at"`
+	TrashID   string    `json:"trash_id,omitempty"`
+	DeletedBy string    `json:"deleted_by,omitempty"`
+}
+
+// TodoMove says where to move a todo: under ParentID, or at the top if
+// it's "", and after AfterID or before BeforeID among its new siblings.
+// Without either it goes last.
+type TodoMove struct {
+	ParentID string
+	AfterID  string
+	BeforeID string
 }
 
 func (t *Todo) GenerateID() {
 	t.ID = generateULID()
 }
+
+// NewTrashID returns the TrashID for a batch of todos being trashed.
+func NewTrashID() string {
+	return generateULID()
+}
+
+// IsTrashed returns whether the todo is in the trash.
+func (t *Todo) IsTrashed() bool {
+	return t.DeletedAt.Valid
+}
+
+// Location returns the time zone the todo's times are shown in.
+func (t *Todo) Location() *time.Location {
+	if !t.TimeZone.Valid || t.TimeZone.String == "" {
+		return time.UTC
+	}
+	loc, err := time.LoadLocation(t.TimeZone.String)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// IsRecurring returns whether the todo has a recurrence rule.
+func (t *Todo) IsRecurring() bool {
+	return t.RRule.Valid && t.RRule.String != ""
+}
+
+// StartSeries starts the todo's recurrence rule from its DueAt. The todo
+// stays in its series if it's already in one.
+func (t *Todo) StartSeries() {
+	if t.SeriesID == "" {
+		t.SeriesID = t.ID
+	}
+	t.SeriesStart = t.DueAt
+	t.RecurrenceID = t.DueAt
+}
+
+// NextOccurrence returns a new todo for the occurrence after this one that
+// isn't one of its ExDates, or nil if the series has ended. Its reminder
+// is as long before it's due on the wall clock as this one's is. It has the
+// same parent, but where it goes among its siblings is left to the store.
+func (t *Todo) NextOccurrence() (*Todo, error) {
+	if !t.IsRecurring() || !t.SeriesStart.Valid || !t.RecurrenceID.Valid {
+		return nil, nil
+	}
+	rule, err := rrule.Parse(t.RRule.String)
+	if err != nil {
+		return nil, err
+	}
+	loc := t.Location()
+	start := t.SeriesStart.Time.In(loc)
+	at := t.RecurrenceID.Time
+	for {
+		var more bool
+		at, more = rule.Next(start, at)
+		if !more {
+			return nil, nil
+		}
+		if !t.IsExDate(at) {
+			break
+		}
+	}
+
+	next := &Todo{
+		UserID:       t.UserID,
+		OrgID:        t.OrgID,
+		Name:         t.Name,
+		Notes:        t.Notes,
+		IsDone:       null.BoolFrom(false),
+		DueAt:        null.TimeFrom(at.UTC()),
+		TimeZone:     t.TimeZone,
+		RRule:        t.RRule,
+		ExDates:      append([]string{}, t.ExDates...),
+		SeriesID:     t.SeriesID,
+		SeriesStart:  t.SeriesStart,
+		RecurrenceID: null.TimeFrom(at.UTC()),
+		Priority:     t.Priority,
+		ListID:       t.ListID,
+		LabelIDs:     append([]string{}, t.LabelIDs...),
+		List:         t.List,
+		Labels:       t.Labels,
+		ParentID:     t.ParentID,
+		Parent:       t.Parent,
+		AutoComplete: t.AutoComplete,
+	}
+	next.GenerateID()
+	if t.RemindAt.Valid && t.DueAt.Valid {
+		lead := wallClock(t.DueAt.Time.In(loc)).Sub(wallClock(t.RemindAt.Time.In(loc)))
+		w := wallClock(at).Add(-lead)
+		next.RemindAt = null.TimeFrom(time.Date(w.Year(), w.Month(), w.Day(), w.Hour(), w.Minute(), w.Second(), 0, loc).UTC())
+	}
+	return next, nil
+}
+
+// Skip moves the todo on to its next occurrence, adding this one's date to
+// its ExDates. It returns false, leaving the todo as it was, if the series
+// has ended.
+func (t *Todo) Skip() (bool, error) {
+	next, err := t.NextOccurrence()
+	if err != nil || next == nil {
+		return false, err
+	}
+	t.ExDates = append(t.ExDates, t.RecurrenceID.Time.In(t.Location()).Format(ExDateFormat))
+	t.DueAt, t.RemindAt, t.RecurrenceID = next.DueAt, next.RemindAt, next.RecurrenceID
+	return true, nil
+}
+
+// IsExDate returns whether the occurrence at at is skipped.
+func (t *Todo) IsExDate(at time.Time) bool {
+	date := at.In(t.Location()).Format(ExDateFormat)
+	for _, d := range t.ExDates {
+		if d == date {
+			return true
+		}
+	}
+	return false
+}
+
+// wallClock returns the time on t's clock as if it were in UTC, so the
+// difference between two is how far apart they are on the clock on the
+// wall, whatever daylight saving does in between.
+func wallClock(t time.Time) time.Time {
+	y, m, d := t.Date()
+	h, mi, s := t.Clock()
+	return time.Date(y, m, d, h, mi, s, 0, time.UTC)
+}
+
+// ReminderService keeps the schedule of todo reminders. A todo has at most
+// one reminder, which is scheduled when the todo is saved with a RemindAt.
+//
+// Sending a reminder happens in steps that are each saved, so a restart
+// picks up where it left off: ClaimDueReminders hands out the reminders
+// that are due, MarkReminderSent records each notifier that has sent one,
+// and CompleteReminder marks it done once they all have. A completed
+// reminder is kept until the todo's RemindAt changes, so saving the todo
+// again doesn't send it again.
+type ReminderService interface {
+	// ClaimDueReminders returns the reminders due at now, including any
+	// claimed before that weren't completed, such as when the server
+	// stopped while sending them.
+	ClaimDueReminders(now time.Time) ([]*Reminder, error)
+	// NextReminderTime returns when the next reminder is due, or the zero
+	// time if there are none.
+	NextReminderTime() (time.Time, error)
+	MarkReminderSent(todoID, notifier string) error
+	// CompleteReminder marks the reminder done, unless the todo has been
+	// given another since it was claimed. It returns aderrors.ErrNoRecords
+	// if there isn't one waiting to be sent.
+	CompleteReminder(r *Reminder) error
+}
+
+// Reminder is a todo's scheduled reminder. Sent lists the notifiers that
+// have already sent it, so they aren't asked to again.
+type Reminder struct {
+	TodoID      string    `json:"todo_id"`
+	UserID      string    `json:"user_id"`
+	RemindAt    time.Time `json:"remind_at"`
+	ClaimedTime time.Time `json:"claimed_time"`
+	Sent        []string  `json:"sent,omitempty"`
+	Completed   bool      `json:"completed,omitempty"`
+}
+
+// IsSentBy returns whether the notifier has already sent the reminder.
+func (r *Reminder) IsSentBy(notifier string) bool {
+	for _, n := range r.Sent {
+		if n == notifier {
+			return true
+		}
+	}
+	return false
+}
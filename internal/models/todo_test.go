@@ -0,0 +1,57 @@
+package models_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/models"
+	null "gopkg.in/guregu/null.v3"
+)
+
+func TestTodoNextOccurrence(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	ok(t, err)
+	// Due Saturdays at 9am, reminded the evening before; clocks go
+	// forward on Sunday 8 March 2026
+	due := time.Date(2026, time.February, 28, 9, 0, 0, 0, ny)
+	td := &models.Todo{
+		ID:       "a",
+		UserID:   "alice",
+		Name:     null.StringFrom("Water the plants"),
+		DueAt:    null.TimeFrom(due.UTC()),
+		RemindAt: null.TimeFrom(due.Add(-15 * time.Hour).UTC()),
+		TimeZone: null.StringFrom("America/New_York"),
+		RRule:    null.StringFrom("FREQ=WEEKLY"),
+		ExDates:  []string{"2026-03-07"},
+	}
+	td.StartSeries()
+	equals(t, "a", td.SeriesID)
+
+	next, err := td.NextOccurrence()
+	ok(t, err)
+	assert(t, next.ID != "" && next.ID != td.ID, "expected the next occurrence to have its own ID, got %q", next.ID)
+	equals(t, "a", next.SeriesID)
+	equals(t, td.SeriesStart, next.SeriesStart)
+	equals(t, "2026-03-14 09:00 EDT", next.DueAt.Time.In(ny).Format("2006-01-02 15:04 MST"))
+	equals(t, next.DueAt, next.RecurrenceID)
+	equals(t, "2026-03-13 18:00 EDT", next.RemindAt.Time.In(ny).Format("2006-01-02 15:04 MST"))
+	equals(t, false, next.IsDone.Bool)
+
+	// Moving an occurrence doesn't move the ones after it
+	next.DueAt = null.TimeFrom(next.DueAt.Time.Add(48 * time.Hour))
+	after, err := next.NextOccurrence()
+	ok(t, err)
+	equals(t, "2026-03-21 09:00 EDT", after.DueAt.Time.In(ny).Format("2006-01-02 15:04 MST"))
+
+	skipped, err := td.Skip()
+	ok(t, err)
+	assert(t, skipped, "expected the occurrence to be skipped")
+	equals(t, []string{"2026-03-07", "2026-02-28"}, td.ExDates)
+	equals(t, "2026-03-14 09:00 EDT", td.DueAt.Time.In(ny).Format("2006-01-02 15:04 MST"))
+
+	td.RRule = null.StringFrom("FREQ=WEEKLY;UNTIL=20260315")
+	skipped, err = td.Skip()
+	ok(t, err)
+	assert(t, !skipped, "expected the series to have ended")
+	equals(t, "2026-03-14 09:00 EDT", td.DueAt.Time.In(ny).Format("2006-01-02 15:04 MST"))
+}
@@ -12,34 +12,48 @@ import (
 	"strings"
 	"time"
 
+	"github.com/ejamesc/auth_demo/internal/password"
 	ulid "github.com/oklog/ulid/v2"
-	"golang.org/x/crypto/bcrypt"
 )
 
-const PasswordWorkfactor = 12
-
 type UserService interface {
 	Get(id string) (*User, error)
 	GetByEmail(email string) (*User, error)
 	Create(*User) (bool, error)
+	Update(*User) (bool, error)
+	ChangeEmail(u *User, newEmail string) (bool, error)
 }
 
 type User struct {
 	ID          string        `json:"id"`
 	Username    string        `json:"username"`
 	Email       string        `json:"email"`
-	Password    string        `json:"password"`
+	Password    string        `json:"password,omitempty"`
 	Name        string        `json:"name"`
 	URL         string        `json:"url"`
 	Bio         string        `json:"bio"`
 	DateCreated time.Time     `json:"date_created" db:"date_created"`
 	D           *UserMetadata `json:"d" db:"data"`
+
+	// DeletionTime is when the account is due to be permanently deleted.
+	// It is zero unless the user has asked for their account to be deleted.
+	DeletionTime time.Time `json:"deletion_time" db:"deletion_time"`
+
+	// LockedTime is when an admin locked the account. A locked user can't
+	// log in. It is zero unless the account is locked.
+	LockedTime time.Time `json:"locked_time" db:"locked_time"`
 }
 
 type UserMetadata struct {
-	HasSaved    bool `json:"has_saved"`
-	IsFirstTime bool `json:"is_first_time"`
-	IsAdmin     bool `json:"is_admin"`
+	HasSaved    bool   `json:"has_saved"`
+	IsFirstTime bool   `json:"is_first_time"`
+	IsAdmin     bool   `json:"is_admin"`
+	Roles       []Role `json:"roles,omitempty"`
+	// SignupInviteID is the signup invite the user signed up with, if any.
+	SignupInviteID string `json:"signup_invite_id,omitempty"`
+	// SCIMOrgID is the org whose directory created the account, if any.
+	// Only that directory can change the account's details.
+	SCIMOrgID string `json:"scim_org_id,omitempty"`
 }
 
 // Value satisfies the driver.Valuer interface for db/sql
@@ -70,27 +84,65 @@ func (u *User) GenerateID() {
 	u.ID = generateULID()
 }
 
+// IsPendingDeletion reports whether the user has asked for their account to be deleted.
+func (u *User) IsPendingDeletion() bool {
+	return !u.DeletionTime.IsZero()
+}
+
+// IsLocked reports whether an admin has locked the account.
+func (u *User) IsLocked() bool {
+	return !u.LockedTime.IsZero()
+}
+
+// IsAdmin reports whether the user has the admin role.
+func (u *User) IsAdmin() bool {
+	return u.HasRole(RoleAdmin)
+}
+
 func (u *User) GravatarHash() string {
 	em := strings.TrimSpace(strings.ToLower(u.Email))
 	res := md5.Sum([]byte(em))
 	return hex.EncodeToString(res[:])
 }
 
+// SetPassword hashes the password with the current algorithm in
+// password.DefaultRegistry.
 func (u *User) SetPassword(pass string) error {
 	if pass == "" {
 		return fmt.Errorf("empty password given as input")
 	}
-	ps, err := bcrypt.GenerateFromPassword([]byte(pass), PasswordWorkfactor)
+	ps, err := password.DefaultRegistry.Hash(pass)
 	if err != nil {
-		return fmt.Errorf("error bcrypting password: %w", err)
+		return fmt.Errorf("error hashing password: %w", err)
 	}
-	u.Password = string(ps)
+	u.Password = ps
 	return nil
 }
 
-func (u *User) CheckPassword(pass string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(pass))
-	return (err == nil)
+// SetRandomPassword gives the user a password nobody knows, for accounts
+// created on someone's behalf that they'll log in to some other way.
+func (u *User) SetRandomPassword() error {
+	pass, err := randomString(32)
+	if err != nil {
+		return fmt.Errorf("error generating password: %w", err)
+	}
+	return u.SetPassword(pass)
+}
+
+// CheckPassword verifies the password with whichever registered algorithm it
+// was hashed with. needsRehash is true when the password is correct but the
+// hash is outdated, in which case the caller should SetPassword and save the user.
+func (u *User) CheckPassword(pass string) (ok, needsRehash bool) {
+	if u.Password == "" {
+		// Nothing to check against, but take as long as a real check would.
+		password.DefaultRegistry.VerifyDummy(pass)
+		return false, false
+	}
+	ok, needsRehash, err := password.DefaultRegistry.Verify(u.Password, pass)
+	if err != nil {
+		return false, false
+	}
+	return ok, needsRehash
 }
 
 func generateULID() string {
@@ -0,0 +1,91 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// BreachChecker reports whether a password has appeared in a known breach.
+type BreachChecker interface {
+	IsBreached(pass string) bool
+}
+
+// hashPrefixLen is the number of hex characters of the SHA-1 used to pick a
+// range, as in the Pwned Passwords k-anonymity API.
+const hashPrefixLen = 5
+
+// BreachCorpus is a locally loaded list of breached password hashes.
+//
+// Hashes are grouped by their 5 character prefix, so a lookup only ever looks
+// at the range for that prefix, the same way the Pwned Passwords range API
+// works. This keeps the lookup compatible with swapping in a remote range
+// API later on without the full hash ever leaving the process.
+type BreachCorpus struct {
+	ranges map[string]map[string]struct{}
+	size   int
+}
+
+// LoadBreachCorpus reads a file in the Pwned Passwords format, where each
+// line is an uppercase SHA-1 hex digest optionally followed by ":count".
+func LoadBreachCorpus(path string) (*BreachCorpus, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error opening breached password file: %w", err)
+	}
+	defer f.Close()
+	return ReadBreachCorpus(f)
+}
+
+// ReadBreachCorpus reads a corpus in the format described in LoadBreachCorpus.
+func ReadBreachCorpus(r io.Reader) (*BreachCorpus, error) {
+	bc := &BreachCorpus{ranges: map[string]map[string]struct{}{}}
+	sc := bufio.NewScanner(r)
+	line := 0
+	for sc.Scan() {
+		line++
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if i := strings.IndexByte(text, ':'); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.ToUpper(text)
+		if _, err := hex.DecodeString(text); err != nil || len(text) != sha1.Size*2 {
+			return nil, fmt.Errorf("invalid SHA-1 hash on line %d of breached password file", line)
+		}
+		prefix, suffix := text[:hashPrefixLen], text[hashPrefixLen:]
+		if bc.ranges[prefix] == nil {
+			bc.ranges[prefix] = map[string]struct{}{}
+		}
+		bc.ranges[prefix][suffix] = struct{}{}
+		bc.size++
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("error reading breached password file: %w", err)
+	}
+	return bc, nil
+}
+
+// Len returns the number of hashes in the corpus.
+func (bc *BreachCorpus) Len() int {
+	return bc.size
+}
+
+// IsBreached satisfies the BreachChecker interface.
+func (bc *BreachCorpus) IsBreached(pass string) bool {
+	sum := sha1.Sum([]byte(pass))
+	h := strings.ToUpper(hex.EncodeToString(sum[:]))
+	suffixes := bc.lookupRange(h[:hashPrefixLen])
+	_, ok := suffixes[h[hashPrefixLen:]]
+	return ok
+}
+
+func (bc *BreachCorpus) lookupRange(prefix string) map[string]struct{} {
+	return bc.ranges[prefix]
+}
@@ -0,0 +1,232 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownHash is returned when no registered Hasher recognises a hash.
+var ErrUnknownHash = errors.New("unknown password hash format")
+
+// Hasher hashes and verifies passwords in a PHC string format,
+// e.g. $argon2id$v=19$m=65536,t=3,p=4$<salt>$<hash>.
+type Hasher interface {
+	// IDs returns the PHC identifiers this Hasher understands. The first one
+	// is used for new hashes.
+	IDs() []string
+	Hash(pass string) (string, error)
+	Verify(encoded, pass string) (bool, error)
+	// NeedsRehash reports whether encoded was made with weaker parameters
+	// than the Hasher currently uses.
+	NeedsRehash(encoded string) bool
+}
+
+// Registry holds every Hasher passwords may be stored with. New hashes are
+// always made with the current Hasher; the others are only used to verify
+// existing hashes until they can be upgraded.
+type Registry struct {
+	current Hasher
+	hashers map[string]Hasher
+
+	dummyOnce sync.Once
+	dummy     string
+}
+
+// NewRegistry creates a Registry that hashes with current and can verify
+// with current or any of the others.
+func NewRegistry(current Hasher, others ...Hasher) *Registry {
+	r := &Registry{current: current, hashers: map[string]Hasher{}}
+	for _, h := range append(others, current) {
+		for _, id := range h.IDs() {
+			r.hashers[id] = h
+		}
+	}
+	return r
+}
+
+// DefaultRegistry hashes new passwords with argon2id, and still verifies
+// the bcrypt hashes made before argon2id was introduced.
+var DefaultRegistry = NewRegistry(
+	NewArgon2idHasher(DefaultArgon2Params),
+	NewBcryptHasher(DefaultBcryptCost),
+)
+
+// Hash hashes pass with the current Hasher.
+func (r *Registry) Hash(pass string) (string, error) {
+	return r.current.Hash(pass)
+}
+
+// Verify checks pass against encoded using whichever Hasher made it.
+// needsRehash is true if the password is correct but encoded should be
+// replaced with a hash from the current Hasher.
+func (r *Registry) Verify(encoded, pass string) (ok, needsRehash bool, err error) {
+	h, ok := r.hashers[hashID(encoded)]
+	if !ok {
+		return false, false, ErrUnknownHash
+	}
+	ok, err = h.Verify(encoded, pass)
+	if err != nil || !ok {
+		return false, false, err
+	}
+	return true, h != r.current || h.NeedsRehash(encoded), nil
+}
+
+// VerifyDummy spends as long as a real verification without checking
+// anything. Call it when there is no user to check against, so response
+// times don't reveal which accounts exist.
+func (r *Registry) VerifyDummy(pass string) {
+	r.dummyOnce.Do(func() {
+		r.dummy, _ = r.current.Hash("dummy password")
+	})
+	r.current.Verify(r.dummy, pass)
+}
+
+// hashID extracts the identifier from a PHC string, e.g. "argon2id" from
+// "$argon2id$v=19$...".
+func hashID(encoded string) string {
+	parts := strings.SplitN(encoded, "$", 3)
+	if len(parts) < 3 || parts[0] != "" {
+		return ""
+	}
+	return parts[1]
+}
+
+// DefaultBcryptCost is the bcrypt work factor used before argon2id.
+const DefaultBcryptCost = 12
+
+type bcryptHasher struct {
+	cost int
+}
+
+// NewBcryptHasher returns a Hasher for bcrypt's $2a$/$2b$/$2y$ format.
+func NewBcryptHasher(cost int) Hasher {
+	return &bcryptHasher{cost: cost}
+}
+
+func (b *bcryptHasher) IDs() []string {
+	return []string{"2a", "2b", "2y"}
+}
+
+func (b *bcryptHasher) Hash(pass string) (string, error) {
+	ps, err := bcrypt.GenerateFromPassword([]byte(pass), b.cost)
+	if err != nil {
+		return "", fmt.Errorf("error bcrypting password: %w", err)
+	}
+	return string(ps), nil
+}
+
+func (b *bcryptHasher) Verify(encoded, pass string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(pass))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *bcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost < b.cost
+}
+
+// Argon2Params are the argon2id tuning parameters.
+type Argon2Params struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// DefaultArgon2Params follow the second recommended option in RFC 9106.
+var DefaultArgon2Params = Argon2Params{
+	Memory:      64 * 1024,
+	Iterations:  3,
+	Parallelism: 4,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+type argon2idHasher struct {
+	params Argon2Params
+}
+
+// NewArgon2idHasher returns a Hasher for argon2id.
+func NewArgon2idHasher(params Argon2Params) Hasher {
+	return &argon2idHasher{params: params}
+}
+
+func (a *argon2idHasher) IDs() []string {
+	return []string{"argon2id"}
+}
+
+func (a *argon2idHasher) Hash(pass string) (string, error) {
+	salt := make([]byte, a.params.SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", fmt.Errorf("error generating salt: %w", err)
+	}
+	p := a.params
+	key := argon2.IDKey([]byte(pass), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, p.Memory, p.Iterations, p.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (a *argon2idHasher) Verify(encoded, pass string) (bool, error) {
+	p, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return false, err
+	}
+	other := argon2.IDKey([]byte(pass), salt, p.Iterations, p.Memory, p.Parallelism, p.KeyLength)
+	return subtle.ConstantTimeCompare(key, other) == 1, nil
+}
+
+func (a *argon2idHasher) NeedsRehash(encoded string) bool {
+	p, _, _, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+	return p.Memory < a.params.Memory ||
+		p.Iterations < a.params.Iterations ||
+		p.Parallelism != a.params.Parallelism ||
+		p.KeyLength < a.params.KeyLength
+}
+
+func decodeArgon2id(encoded string) (Argon2Params, []byte, []byte, error) {
+	var p Argon2Params
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 6 || parts[1] != "argon2id" {
+		return p, nil, nil, fmt.Errorf("invalid argon2id hash: %w", ErrUnknownHash)
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id version: %w", err)
+	}
+	if version != argon2.Version {
+		return p, nil, nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &p.Memory, &p.Iterations, &p.Parallelism); err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id parameters: %w", err)
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return p, nil, nil, fmt.Errorf("invalid argon2id key: %w", err)
+	}
+	p.SaltLength = uint32(len(salt))
+	p.KeyLength = uint32(len(key))
+	return p, salt, key, nil
+}
@@ -0,0 +1,76 @@
+package password_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/password"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var testArgon2Params = password.Argon2Params{
+	Memory:      1024,
+	Iterations:  1,
+	Parallelism: 1,
+	SaltLength:  16,
+	KeyLength:   32,
+}
+
+func TestRegistryArgon2id(t *testing.T) {
+	reg := password.NewRegistry(password.NewArgon2idHasher(testArgon2Params), password.NewBcryptHasher(bcrypt.MinCost))
+
+	encoded, err := reg.Hash("hunter2")
+	ok(t, err)
+	assert(t, strings.HasPrefix(encoded, "$argon2id$v=19$m=1024,t=1,p=1$"), "unexpected encoding %s", encoded)
+
+	valid, needsRehash, err := reg.Verify(encoded, "hunter2")
+	ok(t, err)
+	equals(t, true, valid)
+	equals(t, false, needsRehash)
+
+	valid, _, err = reg.Verify(encoded, "hunter3")
+	ok(t, err)
+	equals(t, false, valid)
+}
+
+func TestRegistryUpgradesBcrypt(t *testing.T) {
+	reg := password.NewRegistry(password.NewArgon2idHasher(testArgon2Params), password.NewBcryptHasher(bcrypt.MinCost))
+
+	legacy, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	ok(t, err)
+
+	valid, needsRehash, err := reg.Verify(string(legacy), "hunter2")
+	ok(t, err)
+	equals(t, true, valid)
+	equals(t, true, needsRehash)
+
+	valid, needsRehash, err = reg.Verify(string(legacy), "wrong")
+	ok(t, err)
+	equals(t, false, valid)
+	equals(t, false, needsRehash)
+}
+
+func TestRegistryUpgradesWeakerParams(t *testing.T) {
+	old := password.NewRegistry(password.NewArgon2idHasher(testArgon2Params))
+	encoded, err := old.Hash("hunter2")
+	ok(t, err)
+
+	stronger := testArgon2Params
+	stronger.Iterations = 2
+	reg := password.NewRegistry(password.NewArgon2idHasher(stronger))
+
+	valid, needsRehash, err := reg.Verify(encoded, "hunter2")
+	ok(t, err)
+	equals(t, true, valid)
+	equals(t, true, needsRehash)
+}
+
+func TestRegistryUnknownHash(t *testing.T) {
+	reg := password.NewRegistry(password.NewArgon2idHasher(testArgon2Params))
+
+	_, _, err := reg.Verify("$scrypt$ln=16,r=8,p=1$aM15713r3Xsvxbi31lqr1Q$nFNh2CVHVjNldFVKDHDlm4CbdRSCdEBsjjJxD+iCs5E", "hunter2")
+	assert(t, errors.Is(err, password.ErrUnknownHash), "expected ErrUnknownHash, got %v", err)
+	_, _, err = reg.Verify("", "hunter2")
+	assert(t, errors.Is(err, password.ErrUnknownHash), "expected ErrUnknownHash, got %v", err)
+}
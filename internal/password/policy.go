@@ -0,0 +1,88 @@
+// Package password implements the password policy applied whenever a user
+// picks a new password.
+package password
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+)
+
+// Policy is a configurable password policy.
+type Policy struct {
+	// MinLength is the minimum number of characters.
+	MinLength int
+	// MinStrength is the minimum strength Estimate must return.
+	MinStrength Score
+	// DisallowUserInfo rejects passwords containing the username or email.
+	DisallowUserInfo bool
+	// Breached, if set, rejects passwords that appear in a known breach.
+	Breached BreachChecker
+}
+
+// DefaultPolicy returns the policy used when nothing else is configured.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		MinLength:        10,
+		MinStrength:      ScoreSomewhatGuessable,
+		DisallowUserInfo: true,
+	}
+}
+
+// Check validates pass against the policy. It returns an
+// aderrors.ValidationError listing every rule the password breaks, keyed on
+// field, or nil if the password is acceptable.
+func (p *Policy) Check(field, pass, username, email string) error {
+	var ve aderrors.ValidationError
+	if strings.TrimSpace(pass) == "" {
+		ve.Add(field, "password_blank", "You need to provide a password.")
+		return ve
+	}
+
+	if n := len([]rune(pass)); n < p.MinLength {
+		ve.Add(field, "password_too_short",
+			fmt.Sprintf("Your password needs to be at least %d characters long.", p.MinLength))
+	}
+
+	userInputs := userInputs(username, email)
+	if p.DisallowUserInfo {
+		lower := strings.ToLower(pass)
+		for _, in := range userInputs {
+			if len(in) >= 3 && strings.Contains(lower, in) {
+				ve.Add(field, "password_contains_user_info",
+					"Your password can't contain your username or email address.")
+				break
+			}
+		}
+	}
+
+	if Estimate(pass, userInputs...) < p.MinStrength {
+		ve.Add(field, "password_too_weak",
+			"Your password is too easy to guess. Try a longer phrase or mixing in unrelated words.")
+	}
+
+	if p.Breached != nil && p.Breached.IsBreached(pass) {
+		ve.Add(field, "password_breached",
+			"This password has appeared in a data breach. Please choose a different one.")
+	}
+
+	if ve.HasErrors() {
+		return ve
+	}
+	return nil
+}
+
+func userInputs(username, email string) []string {
+	var ins []string
+	if u := strings.ToLower(strings.TrimSpace(username)); u != "" {
+		ins = append(ins, u)
+	}
+	if e := strings.ToLower(strings.TrimSpace(email)); e != "" {
+		ins = append(ins, e)
+		if i := strings.IndexByte(e, '@'); i > 0 {
+			ins = append(ins, e[:i])
+		}
+	}
+	return ins
+}
@@ -0,0 +1,97 @@
+package password_test
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/aderrors"
+	"github.com/ejamesc/auth_demo/internal/password"
+)
+
+func TestEstimate(t *testing.T) {
+	weak := []string{"password", "P@ssw0rd", "qwertyuiop", "aaaaaaaaaaaa", "abcdefgh", "alice1990"}
+	for _, p := range weak {
+		s := password.Estimate(p, "alice")
+		assert(t, s < password.ScoreSomewhatGuessable, "expected %q to be weak, got %d", p, s)
+	}
+
+	strong := []string{"correct horse battery staple", "x7#Lq9!vR2&m", "purple-otter-drives-north"}
+	for _, p := range strong {
+		s := password.Estimate(p, "alice")
+		assert(t, s >= password.ScoreSafelyUnguessable, "expected %q to be strong, got %d", p, s)
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	policy := password.DefaultPolicy()
+
+	ok(t, policy.Check("password", "purple-otter-drives-north", "alice", "alice@example.com"))
+
+	err := policy.Check("password", "alice", "alice", "alice@example.com")
+	var ve aderrors.ValidationError
+	assert(t, errors.As(err, &ve), "expected a ValidationError, got %v", err)
+	equals(t, []string{"password_too_short", "password_contains_user_info", "password_too_weak"}, fieldCodes(ve))
+	equals(t, "password", ve.Fields[0].Field)
+}
+
+func TestPolicyBreached(t *testing.T) {
+	// SHA-1 of "purple-otter-drives-north"
+	corpus, err := password.ReadBreachCorpus(strings.NewReader(
+		"# comment\n7C4A8D09CA3762AF61E59520943DC26494F8941B:24230577\n523F18330DE5B93C9FDFAA72C252A4428A2A1084:3\n"))
+	ok(t, err)
+	equals(t, 2, corpus.Len())
+	assert(t, corpus.IsBreached("123456"), "expected 123456 to be breached")
+	assert(t, !corpus.IsBreached("x7#Lq9!vR2&m"), "expected random password not to be breached")
+
+	policy := password.DefaultPolicy()
+	policy.Breached = corpus
+	err = policy.Check("password", "purple-otter-drives-north", "alice", "alice@example.com")
+	var ve aderrors.ValidationError
+	assert(t, errors.As(err, &ve), "expected a ValidationError, got %v", err)
+	equals(t, []string{"password_breached"}, fieldCodes(ve))
+}
+
+func TestReadBreachCorpusInvalid(t *testing.T) {
+	_, err := password.ReadBreachCorpus(strings.NewReader("not-a-hash\n"))
+	assert(t, err != nil, "expected an error for an invalid hash")
+}
+
+func fieldCodes(ve aderrors.ValidationError) []string {
+	var codes []string
+	for _, f := range ve.Fields {
+		codes = append(codes, f.Code)
+	}
+	return codes
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
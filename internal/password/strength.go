@@ -0,0 +1,185 @@
+package password
+
+import (
+	"math"
+	"strings"
+	"unicode"
+)
+
+// Score is a zxcvbn-style strength estimate, from 0 (trivially guessable)
+// to 4 (very unguessable).
+type Score int
+
+const (
+	ScoreTooGuessable Score = iota
+	ScoreVeryGuessable
+	ScoreSomewhatGuessable
+	ScoreSafelyUnguessable
+	ScoreVeryUnguessable
+)
+
+// Guess thresholds for each score, taken from zxcvbn.
+var scoreThresholds = []float64{1e3, 1e6, 1e8, 1e10}
+
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p",
+}
+
+var leetSubstitutions = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "3", "e", "6", "g", "1", "i", "!", "i",
+	"0", "o", "5", "s", "$", "s", "7", "t", "+", "t", "2", "z",
+)
+
+// Estimate returns the strength of a password. userInputs are words the
+// password should not be built from, e.g. the username and email address.
+//
+// This is a much simpler estimator than zxcvbn: it looks for common
+// passwords, the user's own details, repeated characters, sequences and
+// keyboard walks, then approximates the guesses needed for what remains.
+func Estimate(pass string, userInputs ...string) Score {
+	return scoreFromGuesses(estimateGuesses(pass, userInputs))
+}
+
+func scoreFromGuesses(guesses float64) Score {
+	for i, t := range scoreThresholds {
+		if guesses < t {
+			return Score(i)
+		}
+	}
+	return ScoreVeryUnguessable
+}
+
+func estimateGuesses(pass string, userInputs []string) float64 {
+	if pass == "" {
+		return 1
+	}
+	lower := strings.ToLower(pass)
+	unleet := leetSubstitutions.Replace(lower)
+
+	guesses := math.Pow(float64(cardinality(pass)), effectiveLength(lower))
+
+	// A known word with a few characters tacked on is barely better than the
+	// word itself, so we assume each extra character is a digit.
+	for _, candidate := range []string{lower, unleet} {
+		for w, rank := range commonPasswordRank {
+			if len(w) >= 4 && strings.Contains(candidate, w) || candidate == w {
+				rest := len(candidate) - len(w)
+				guesses = math.Min(guesses, float64(rank+1)*math.Pow(10, float64(rest)))
+			}
+		}
+		for _, in := range userInputs {
+			in = strings.ToLower(strings.TrimSpace(in))
+			if len(in) >= 3 && strings.Contains(candidate, in) {
+				rest := len(candidate) - len(in)
+				guesses = math.Min(guesses, 10*math.Pow(10, float64(rest)))
+			}
+		}
+	}
+	return guesses
+}
+
+// cardinality is the size of the character set the password draws from.
+func cardinality(pass string) int {
+	var lower, upper, digit, symbol, other bool
+	for _, r := range pass {
+		switch {
+		case r >= 'a' && r <= 'z':
+			lower = true
+		case r >= 'A' && r <= 'Z':
+			upper = true
+		case r >= '0' && r <= '9':
+			digit = true
+		case r < unicode.MaxASCII:
+			symbol = true
+		default:
+			other = true
+		}
+	}
+	c := 0
+	if lower {
+		c += 26
+	}
+	if upper {
+		c += 26
+	}
+	if digit {
+		c += 10
+	}
+	if symbol {
+		c += 33
+	}
+	if other {
+		c += 100
+	}
+	return c
+}
+
+// effectiveLength counts characters that add meaningful entropy. Characters
+// that repeat the previous one, or continue a sequence or keyboard walk,
+// only count for a fraction.
+func effectiveLength(lower string) float64 {
+	rs := []rune(lower)
+	length := 0.0
+	for i, r := range rs {
+		if i == 0 {
+			length++
+			continue
+		}
+		prev := rs[i-1]
+		switch {
+		case r == prev:
+			length += 0.2
+		case r == prev+1 || r == prev-1:
+			length += 0.3
+		case adjacentOnKeyboard(prev, r):
+			length += 0.4
+		default:
+			length++
+		}
+	}
+	return length
+}
+
+func adjacentOnKeyboard(a, b rune) bool {
+	for _, row := range keyboardRows {
+		i := strings.IndexRune(row, a)
+		if i < 0 {
+			continue
+		}
+		if (i > 0 && rune(row[i-1]) == b) || (i < len(row)-1 && rune(row[i+1]) == b) {
+			return true
+		}
+	}
+	return false
+}
+
+// commonPasswordRank maps some of the most common passwords to their rank.
+var commonPasswordRank = func() map[string]int {
+	m := make(map[string]int, len(commonPasswords))
+	for i, p := range commonPasswords {
+		m[p] = i
+	}
+	return m
+}()
+
+var commonPasswords = []string{
+	"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234",
+	"111111", "1234567", "dragon", "123123", "baseball", "abc123", "football",
+	"monkey", "letmein", "696969", "shadow", "master", "666666", "qwertyuiop",
+	"123321", "mustang", "1234567890", "michael", "654321", "superman",
+	"1qaz2wsx", "7777777", "121212", "000000", "qazwsx", "123qwe", "killer",
+	"trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter", "buster",
+	"soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+	"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel",
+	"starwars", "klaster", "112233", "george", "computer", "michelle",
+	"jessica", "pepper", "1111", "zxcvbn", "555555", "11111111", "131313",
+	"freedom", "777777", "pass", "maggie", "159753", "aaaaaa", "ginger",
+	"princess", "joshua", "cheese", "amanda", "summer", "love", "ashley",
+	"nicole", "chelsea", "biteme", "matthew", "access", "yankees", "987654321",
+	"dallas", "austin", "thunder", "taylor", "matrix", "welcome", "admin",
+	"login", "passw0rd", "secret", "changeme", "hello", "whatever",
+}
@@ -0,0 +1,558 @@
+// Package rrule parses RFC 5545 recurrence rules and steps through the
+// occurrences they describe. It supports the parts of a rule needed for
+// things that happen at most daily: FREQ of DAILY, WEEKLY, MONTHLY or
+// YEARLY, with INTERVAL, COUNT, UNTIL, BYDAY, BYMONTHDAY, BYMONTH and WKST.
+//
+// Occurrences are worked out on the wall clock of the start's time zone,
+// so a todo due at 9am stays due at 9am across daylight saving changes.
+package rrule
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Frequency is how often a rule repeats.
+type Frequency int
+
+// The frequencies we support. SECONDLY, MINUTELY and HOURLY aren't among
+// them.
+const (
+	Daily Frequency = iota + 1
+	Weekly
+	Monthly
+	Yearly
+)
+
+var frequencyNames = map[Frequency]string{
+	Daily:   "DAILY",
+	Weekly:  "WEEKLY",
+	Monthly: "MONTHLY",
+	Yearly:  "YEARLY",
+}
+
+func (f Frequency) String() string {
+	return frequencyNames[f]
+}
+
+var dayNames = [...]string{"SU", "MO", "TU", "WE", "TH", "FR", "SA"}
+
+// The formats UNTIL may be given in: a UTC time, a time on the start's
+// wall clock, or a date, meaning up to the end of that day.
+const (
+	untilUTCFormat   = "20060102T150405Z"
+	untilLocalFormat = "20060102T150405"
+	untilDateFormat  = "20060102"
+)
+
+// maxYears is how far past the start occurrences are looked for, so a rule
+// that can never occur again, such as every 30 February, ends.
+const maxYears = 200
+
+// WeekdayNum is a BYDAY value: a day of the week and, if N isn't 0, the
+// Nth one in the month or year, counting back from the end if N is
+// negative.
+type WeekdayNum struct {
+	N   int
+	Day time.Weekday
+}
+
+func (wn WeekdayNum) String() string {
+	if wn.N == 0 {
+		return dayNames[wn.Day]
+	}
+	return strconv.Itoa(wn.N) + dayNames[wn.Day]
+}
+
+// Rule is a parsed recurrence rule. Interval is at least 1, and at most one
+// of Count and Until is set.
+type Rule struct {
+	Freq     Frequency
+	Interval int
+	Count    int
+	Until    time.Time
+	// UntilLocal means Until was given without a time zone, so its wall
+	// clock is read in the start's time zone.
+	UntilLocal bool
+	ByDay      []WeekdayNum
+	ByMonthDay []int
+	ByMonth    []time.Month
+	WeekStart  time.Weekday
+}
+
+// Parse parses a rule such as "FREQ=WEEKLY;BYDAY=MO,WE". An "RRULE:"
+// prefix is allowed.
+func Parse(s string) (*Rule, error) {
+	s = strings.TrimSpace(s)
+	if len(s) >= 6 && strings.EqualFold(s[:6], "RRULE:") {
+		s = s[6:]
+	}
+	r := &Rule{Interval: 1, WeekStart: time.Monday}
+	seen := map[string]bool{}
+	for _, part := range strings.Split(s, ";") {
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq < 0 {
+			return nil, fmt.Errorf("rule part %q has no value", part)
+		}
+		name, value := strings.ToUpper(part[:eq]), strings.ToUpper(part[eq+1:])
+		if seen[name] {
+			return nil, fmt.Errorf("%s is given more than once", name)
+		}
+		seen[name] = true
+		if err := r.parsePart(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case r.Freq == 0:
+		return nil, fmt.Errorf("FREQ is required")
+	case r.Count > 0 && !r.Until.IsZero():
+		return nil, fmt.Errorf("COUNT and UNTIL can't both be given")
+	case len(r.ByMonthDay) > 0 && r.Freq == Weekly:
+		return nil, fmt.Errorf("BYMONTHDAY can't be used with FREQ=WEEKLY")
+	}
+	if r.Freq == Daily || r.Freq == Weekly {
+		for _, wn := range r.ByDay {
+			if wn.N != 0 {
+				return nil, fmt.Errorf("BYDAY=%s needs FREQ=MONTHLY or FREQ=YEARLY", wn)
+			}
+		}
+	}
+	return r, nil
+}
+
+func (r *Rule) parsePart(name, value string) error {
+	var err error
+	switch name {
+	case "FREQ":
+		for f, n := range frequencyNames {
+			if n == value {
+				r.Freq = f
+			}
+		}
+		if r.Freq == 0 {
+			return fmt.Errorf("FREQ=%s isn't supported", value)
+		}
+	case "INTERVAL":
+		r.Interval, err = parseInt(name, value, 1, 1000)
+	case "COUNT":
+		r.Count, err = parseInt(name, value, 1, 100000)
+	case "UNTIL":
+		r.Until, r.UntilLocal, err = parseUntil(value)
+	case "BYDAY":
+		for _, v := range strings.Split(value, ",") {
+			wn, err := parseWeekdayNum(v)
+			if err != nil {
+				return err
+			}
+			r.ByDay = append(r.ByDay, wn)
+		}
+	case "BYMONTHDAY":
+		for _, v := range strings.Split(value, ",") {
+			d, err := parseInt(name, v, -31, 31)
+			if err != nil {
+				return err
+			}
+			if d == 0 {
+				return fmt.Errorf("BYMONTHDAY can't be 0")
+			}
+			r.ByMonthDay = append(r.ByMonthDay, d)
+		}
+	case "BYMONTH":
+		for _, v := range strings.Split(value, ",") {
+			m, err := parseInt(name, v, 1, 12)
+			if err != nil {
+				return err
+			}
+			r.ByMonth = append(r.ByMonth, time.Month(m))
+		}
+	case "WKST":
+		d, ok := parseDay(value)
+		if !ok {
+			return fmt.Errorf("WKST=%s isn't a day of the week", value)
+		}
+		r.WeekStart = d
+	default:
+		return fmt.Errorf("%s isn't supported", name)
+	}
+	return err
+}
+
+func parseInt(name, value string, min, max int) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return 0, fmt.Errorf("%s=%s needs to be a number from %d to %d", name, value, min, max)
+	}
+	return n, nil
+}
+
+func parseUntil(value string) (time.Time, bool, error) {
+	if t, err := time.Parse(untilUTCFormat, value); err == nil {
+		return t, false, nil
+	}
+	if t, err := time.Parse(untilLocalFormat, value); err == nil {
+		return t, true, nil
+	}
+	if t, err := time.Parse(untilDateFormat, value); err == nil {
+		return t.Add(24*time.Hour - time.Second), true, nil
+	}
+	return time.Time{}, false, fmt.Errorf("UNTIL=%s isn't a date or time, such as 20261231 or 20261231T170000Z", value)
+}
+
+func parseWeekdayNum(value string) (WeekdayNum, error) {
+	if len(value) < 2 {
+		return WeekdayNum{}, fmt.Errorf("BYDAY=%s isn't a day of the week", value)
+	}
+	d, ok := parseDay(value[len(value)-2:])
+	if !ok {
+		return WeekdayNum{}, fmt.Errorf("BYDAY=%s isn't a day of the week", value)
+	}
+	wn := WeekdayNum{Day: d}
+	if n := value[:len(value)-2]; n != "" {
+		var err error
+		wn.N, err = strconv.Atoi(n)
+		if err != nil || wn.N == 0 || wn.N < -53 || wn.N > 53 {
+			return WeekdayNum{}, fmt.Errorf("BYDAY=%s needs a number from 1 to 53, or -53 to -1, before the day", value)
+		}
+	}
+	return wn, nil
+}
+
+func parseDay(value string) (time.Weekday, bool) {
+	for i, n := range dayNames {
+		if n == value {
+			return time.Weekday(i), true
+		}
+	}
+	return 0, false
+}
+
+// String returns the rule in the form Parse reads, without the "RRULE:"
+// prefix.
+func (r *Rule) String() string {
+	parts := []string{"FREQ=" + r.Freq.String()}
+	if r.Interval > 1 {
+		parts = append(parts, "INTERVAL="+strconv.Itoa(r.Interval))
+	}
+	if r.Count > 0 {
+		parts = append(parts, "COUNT="+strconv.Itoa(r.Count))
+	}
+	if !r.Until.IsZero() {
+		if r.UntilLocal {
+			parts = append(parts, "UNTIL="+r.Until.Format(untilLocalFormat))
+		} else {
+			parts = append(parts, "UNTIL="+r.Until.UTC().Format(untilUTCFormat))
+		}
+	}
+	if len(r.ByMonth) > 0 {
+		ms := make([]string, len(r.ByMonth))
+		for i, m := range r.ByMonth {
+			ms[i] = strconv.Itoa(int(m))
+		}
+		parts = append(parts, "BYMONTH="+strings.Join(ms, ","))
+	}
+	if len(r.ByMonthDay) > 0 {
+		ds := make([]string, len(r.ByMonthDay))
+		for i, d := range r.ByMonthDay {
+			ds[i] = strconv.Itoa(d)
+		}
+		parts = append(parts, "BYMONTHDAY="+strings.Join(ds, ","))
+	}
+	if len(r.ByDay) > 0 {
+		ds := make([]string, len(r.ByDay))
+		for i, wn := range r.ByDay {
+			ds[i] = wn.String()
+		}
+		parts = append(parts, "BYDAY="+strings.Join(ds, ","))
+	}
+	if r.WeekStart != time.Monday {
+		parts = append(parts, "WKST="+dayNames[r.WeekStart])
+	}
+	return strings.Join(parts, ";")
+}
+
+// Next returns the first occurrence of the rule started at start that is
+// after after, and false if there isn't one.
+func (r *Rule) Next(start, after time.Time) (time.Time, bool) {
+	it := r.Iterate(start)
+	for {
+		t, ok := it.Next()
+		if !ok || t.After(after) {
+			return t, ok
+		}
+	}
+}
+
+// Iterate returns an Iterator over the occurrences of the rule started at
+// start. The start is always the first occurrence, and the others are at
+// the same time of day in its time zone.
+func (r *Rule) Iterate(start time.Time) *Iterator {
+	it := &Iterator{r: r, start: start, until: r.Until}
+	if r.UntilLocal {
+		y, m, d := r.Until.Date()
+		h, mi, s := r.Until.Clock()
+		it.until = time.Date(y, m, d, h, mi, s, 0, start.Location())
+	}
+	return it
+}
+
+// Iterator steps through a rule's occurrences in order.
+type Iterator struct {
+	r       *Rule
+	start   time.Time
+	until   time.Time
+	period  int
+	pending []time.Time
+	n       int
+	done    bool
+}
+
+// Next returns the next occurrence, and false once there are no more.
+func (it *Iterator) Next() (time.Time, bool) {
+	for {
+		var t time.Time
+		switch {
+		case it.n == 0:
+			t = it.start
+		case len(it.pending) > 0:
+			t, it.pending = it.pending[0], it.pending[1:]
+		case it.done:
+			return time.Time{}, false
+		default:
+			it.expand()
+			continue
+		}
+		if (it.r.Count > 0 && it.n >= it.r.Count) || (!it.until.IsZero() && t.After(it.until)) {
+			it.done, it.pending = true, nil
+			return time.Time{}, false
+		}
+		it.n++
+		return t, true
+	}
+}
+
+// expand adds the occurrences in the next period, such as the next week of
+// a weekly rule, to pending.
+func (it *Iterator) expand() {
+	r := it.r
+	y, m, d := it.start.Date()
+	step := it.period * r.Interval
+	it.period++
+
+	// Days are worked out in UTC, where they're all 24 hours long, and only
+	// put on the start's wall clock at the end
+	var days []time.Time
+	switch r.Freq {
+	case Daily:
+		day := time.Date(y, m, d+step, 0, 0, 0, 0, time.UTC)
+		if r.matchesDay(day) {
+			days = append(days, day)
+		}
+	case Weekly:
+		offset := (int(it.start.Weekday()) - int(r.WeekStart) + 7) % 7
+		week := time.Date(y, m, d-offset+7*step, 0, 0, 0, 0, time.UTC)
+		for i := 0; i < 7; i++ {
+			day := week.AddDate(0, 0, i)
+			if r.matchesWeekday(day, it.start.Weekday()) && r.matchesMonth(day) {
+				days = append(days, day)
+			}
+		}
+	case Monthly:
+		first := time.Date(y, m+time.Month(step), 1, 0, 0, 0, 0, time.UTC)
+		if r.matchesMonth(first) {
+			days = r.monthDays(first, d)
+		}
+	case Yearly:
+		year := y + step
+		switch {
+		case len(r.ByMonth) > 0:
+			months := append([]time.Month{}, r.ByMonth...)
+			sort.Slice(months, func(i, j int) bool { return months[i] < months[j] })
+			for _, mo := range months {
+				days = append(days, r.monthDays(time.Date(year, mo, 1, 0, 0, 0, 0, time.UTC), d)...)
+			}
+		case len(r.ByDay) > 0 && len(r.ByMonthDay) == 0:
+			days = r.yearDays(year)
+		default:
+			days = r.monthDays(time.Date(year, m, 1, 0, 0, 0, 0, time.UTC), d)
+		}
+	}
+
+	h, mi, s := it.start.Clock()
+	for _, day := range days {
+		t := wallTime(day.Year(), day.Month(), day.Day(), h, mi, s, it.start.Nanosecond(), it.start.Location())
+		if t.After(it.start) {
+			it.pending = append(it.pending, t)
+		}
+	}
+	if periodYear(r.Freq, y, step) > y+maxYears {
+		it.done = true
+	}
+}
+
+// wallTime is like time.Date, except that a time that doesn't exist
+// because the clocks went forward is read with the offset from before they
+// did, as RFC 5545 asks: 2:30am on the day clocks go forward from 2am to
+// 3am is 3:30am.
+func wallTime(y int, m time.Month, d, h, mi, s, ns int, loc *time.Location) time.Time {
+	t := time.Date(y, m, d, h, mi, s, ns, loc)
+	if t.Hour() == h && t.Minute() == mi {
+		return t
+	}
+	wall := time.Date(y, m, d, h, mi, s, ns, time.UTC)
+	_, before := wall.Add(-24 * time.Hour).In(loc).Zone()
+	return wall.Add(-time.Duration(before) * time.Second).In(loc)
+}
+
+// periodYear is roughly the year a period starts in, for giving up on
+// rules that never occur again.
+func periodYear(f Frequency, y, step int) int {
+	switch f {
+	case Daily:
+		return y + step/365
+	case Weekly:
+		return y + step/52
+	case Monthly:
+		return y + step/12
+	}
+	return y + step
+}
+
+// matchesDay reports whether a day of a daily rule is in its BYMONTH,
+// BYMONTHDAY and BYDAY.
+func (r *Rule) matchesDay(day time.Time) bool {
+	if !r.matchesMonth(day) {
+		return false
+	}
+	if len(r.ByMonthDay) > 0 {
+		n := daysIn(day)
+		found := false
+		for _, md := range r.ByMonthDay {
+			if md == day.Day() || md < 0 && n+1+md == day.Day() {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return len(r.ByDay) == 0 || r.matchesWeekday(day, day.Weekday())
+}
+
+// matchesWeekday reports whether the day is one of the rule's BYDAY, or
+// the default day if it has none.
+func (r *Rule) matchesWeekday(day time.Time, def time.Weekday) bool {
+	if len(r.ByDay) == 0 {
+		return day.Weekday() == def
+	}
+	for _, wn := range r.ByDay {
+		if wn.Day == day.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Rule) matchesMonth(day time.Time) bool {
+	if len(r.ByMonth) == 0 {
+		return true
+	}
+	for _, m := range r.ByMonth {
+		if m == day.Month() {
+			return true
+		}
+	}
+	return false
+}
+
+// monthDays returns the days of a monthly rule in the month starting at
+// first, in order. Without BYMONTHDAY or BYDAY, that's the start's day of
+// the month, if the month has one.
+func (r *Rule) monthDays(first time.Time, startDay int) []time.Time {
+	n := daysIn(first)
+	in := make([]bool, n+1)
+	switch {
+	case len(r.ByMonthDay) == 0 && len(r.ByDay) == 0:
+		if startDay <= n {
+			in[startDay] = true
+		}
+	case len(r.ByMonthDay) > 0:
+		for _, md := range r.ByMonthDay {
+			if md < 0 {
+				md = n + 1 + md
+			}
+			if md >= 1 && md <= n {
+				in[md] = true
+			}
+		}
+		if len(r.ByDay) > 0 {
+			byDay := weekdayNumDays(r.ByDay, first, n)
+			for i := range in {
+				in[i] = in[i] && byDay[i]
+			}
+		}
+	default:
+		in = weekdayNumDays(r.ByDay, first, n)
+	}
+
+	var days []time.Time
+	for i := 1; i <= n; i++ {
+		if in[i] {
+			days = append(days, first.AddDate(0, 0, i-1))
+		}
+	}
+	return days
+}
+
+// yearDays returns the days of a yearly rule with only BYDAY, counting its
+// ordinals through the whole year.
+func (r *Rule) yearDays(year int) []time.Time {
+	first := time.Date(year, time.January, 1, 0, 0, 0, 0, time.UTC)
+	n := time.Date(year, time.December, 31, 0, 0, 0, 0, time.UTC).YearDay()
+	in := weekdayNumDays(r.ByDay, first, n)
+	var days []time.Time
+	for i := 1; i <= n; i++ {
+		if in[i] {
+			days = append(days, first.AddDate(0, 0, i-1))
+		}
+	}
+	return days
+}
+
+// weekdayNumDays marks which of the n days from first match the BYDAY
+// values, indexed from 1.
+func weekdayNumDays(byDay []WeekdayNum, first time.Time, n int) []bool {
+	in := make([]bool, n+1)
+	for _, wn := range byDay {
+		// The first day from first that's wn.Day, and the last
+		firstDay := 1 + (int(wn.Day)-int(first.Weekday())+7)%7
+		lastDay := firstDay + (n-firstDay)/7*7
+		switch {
+		case wn.N == 0:
+			for i := firstDay; i <= n; i += 7 {
+				in[i] = true
+			}
+		case wn.N > 0:
+			if i := firstDay + 7*(wn.N-1); i <= n {
+				in[i] = true
+			}
+		default:
+			if i := lastDay + 7*(wn.N+1); i >= 1 {
+				in[i] = true
+			}
+		}
+	}
+	return in
+}
+
+// daysIn returns the number of days in the month of t.
+func daysIn(t time.Time) int {
+	return time.Date(t.Year(), t.Month()+1, 0, 0, 0, 0, 0, time.UTC).Day()
+}
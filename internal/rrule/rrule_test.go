@@ -0,0 +1,168 @@
+package rrule_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/rrule"
+)
+
+// occurrences returns the first n occurrences of the rule from start, as
+// wall clock times in the start's zone.
+func occurrences(t *testing.T, rule string, start time.Time, n int) []string {
+	r, err := rrule.Parse(rule)
+	ok(t, err)
+	it := r.Iterate(start)
+	got := []string{}
+	for i := 0; i < n; i++ {
+		o, more := it.Next()
+		if !more {
+			break
+		}
+		got = append(got, o.Format("2006-01-02 15:04 MST"))
+	}
+	return got
+}
+
+func TestOccurrences(t *testing.T) {
+	jan31 := time.Date(2026, time.January, 31, 9, 0, 0, 0, time.UTC)
+	mon := time.Date(2026, time.January, 5, 9, 0, 0, 0, time.UTC)
+	tests := []struct {
+		rule  string
+		start time.Time
+		n     int
+		exp   []string
+	}{
+		{"FREQ=DAILY;INTERVAL=3;COUNT=3", mon, 10, []string{"2026-01-05 09:00 UTC", "2026-01-08 09:00 UTC", "2026-01-11 09:00 UTC"}},
+		{"FREQ=DAILY;BYDAY=SA,SU", mon, 3, []string{"2026-01-05 09:00 UTC", "2026-01-10 09:00 UTC", "2026-01-11 09:00 UTC"}},
+		{"FREQ=WEEKLY;BYDAY=MO,WE,FR", mon, 4, []string{"2026-01-05 09:00 UTC", "2026-01-07 09:00 UTC", "2026-01-09 09:00 UTC", "2026-01-12 09:00 UTC"}},
+		{"FREQ=WEEKLY;INTERVAL=2;BYDAY=TU", mon, 3, []string{"2026-01-05 09:00 UTC", "2026-01-06 09:00 UTC", "2026-01-20 09:00 UTC"}},
+		{"FREQ=WEEKLY;UNTIL=20260119", mon, 10, []string{"2026-01-05 09:00 UTC", "2026-01-12 09:00 UTC", "2026-01-19 09:00 UTC"}},
+		{"FREQ=WEEKLY;UNTIL=20260119T085959Z", mon, 10, []string{"2026-01-05 09:00 UTC", "2026-01-12 09:00 UTC"}},
+		// Months without a 31st are skipped
+		{"FREQ=MONTHLY", jan31, 3, []string{"2026-01-31 09:00 UTC", "2026-03-31 09:00 UTC", "2026-05-31 09:00 UTC"}},
+		{"FREQ=MONTHLY;BYMONTHDAY=-1", jan31, 3, []string{"2026-01-31 09:00 UTC", "2026-02-28 09:00 UTC", "2026-03-31 09:00 UTC"}},
+		{"FREQ=MONTHLY;BYDAY=-1FR", jan31, 3, []string{"2026-01-31 09:00 UTC", "2026-02-27 09:00 UTC", "2026-03-27 09:00 UTC"}},
+		{"FREQ=MONTHLY;BYDAY=2TU,4TU", mon, 3, []string{"2026-01-05 09:00 UTC", "2026-01-13 09:00 UTC", "2026-01-27 09:00 UTC"}},
+		{"FREQ=MONTHLY;BYDAY=FR;BYMONTHDAY=13", mon, 3, []string{"2026-01-05 09:00 UTC", "2026-02-13 09:00 UTC", "2026-03-13 09:00 UTC"}},
+		{"FREQ=YEARLY;BYMONTH=11;BYDAY=4TH", mon, 3, []string{"2026-01-05 09:00 UTC", "2026-11-26 09:00 UTC", "2027-11-25 09:00 UTC"}},
+		{"FREQ=YEARLY;BYDAY=1MO", mon, 3, []string{"2026-01-05 09:00 UTC", "2027-01-04 09:00 UTC", "2028-01-03 09:00 UTC"}},
+		{"FREQ=YEARLY", time.Date(2028, time.February, 29, 9, 0, 0, 0, time.UTC), 2, []string{"2028-02-29 09:00 UTC", "2032-02-29 09:00 UTC"}},
+		// Never occurs again, and gives up rather than looking forever
+		{"FREQ=DAILY;BYMONTH=2;BYMONTHDAY=30", mon, 3, []string{"2026-01-05 09:00 UTC"}},
+	}
+	for _, tt := range tests {
+		equals(t, tt.exp, occurrences(t, tt.rule, tt.start, tt.n))
+	}
+}
+
+func TestOccurrencesAcrossDST(t *testing.T) {
+	ny, err := time.LoadLocation("America/New_York")
+	ok(t, err)
+
+	// Daylight saving starts on 8 March 2026, and ends on 1 November
+	start := time.Date(2026, time.March, 7, 9, 0, 0, 0, ny)
+	equals(t, []string{"2026-03-07 09:00 EST", "2026-03-08 09:00 EDT", "2026-03-09 09:00 EDT"},
+		occurrences(t, "FREQ=DAILY", start, 3))
+	start = time.Date(2026, time.October, 25, 9, 0, 0, 0, ny)
+	equals(t, []string{"2026-10-25 09:00 EDT", "2026-11-01 09:00 EST"},
+		occurrences(t, "FREQ=WEEKLY", start, 2))
+
+	// 2:30am doesn't exist the day clocks go forward, so it's an hour later
+	start = time.Date(2026, time.March, 7, 2, 30, 0, 0, ny)
+	equals(t, []string{"2026-03-07 02:30 EST", "2026-03-08 03:30 EDT", "2026-03-09 02:30 EDT"},
+		occurrences(t, "FREQ=DAILY", start, 3))
+
+	// A local UNTIL is on the start's wall clock
+	start = time.Date(2026, time.March, 7, 9, 0, 0, 0, ny)
+	equals(t, []string{"2026-03-07 09:00 EST", "2026-03-08 09:00 EDT"},
+		occurrences(t, "FREQ=DAILY;UNTIL=20260308T090000", start, 5))
+}
+
+func TestNext(t *testing.T) {
+	r, err := rrule.Parse("RRULE:FREQ=WEEKLY;BYDAY=MO,TH")
+	ok(t, err)
+	start := time.Date(2026, time.January, 5, 9, 0, 0, 0, time.UTC)
+	next, more := r.Next(start, start)
+	equals(t, true, more)
+	equals(t, time.Date(2026, time.January, 8, 9, 0, 0, 0, time.UTC), next)
+	next, _ = r.Next(start, time.Date(2026, time.February, 1, 0, 0, 0, 0, time.UTC))
+	equals(t, time.Date(2026, time.February, 2, 9, 0, 0, 0, time.UTC), next)
+
+	r, err = rrule.Parse("FREQ=DAILY;COUNT=2")
+	ok(t, err)
+	_, more = r.Next(start, start.Add(24*time.Hour))
+	equals(t, false, more)
+}
+
+func TestParse(t *testing.T) {
+	r, err := rrule.Parse("freq=monthly;interval=2;byday=mo,-1fr;bymonth=1,7;wkst=su;count=5")
+	ok(t, err)
+	equals(t, &rrule.Rule{
+		Freq:      rrule.Monthly,
+		Interval:  2,
+		Count:     5,
+		ByDay:     []rrule.WeekdayNum{{Day: time.Monday}, {N: -1, Day: time.Friday}},
+		ByMonth:   []time.Month{time.January, time.July},
+		WeekStart: time.Sunday,
+	}, r)
+	equals(t, "FREQ=MONTHLY;INTERVAL=2;COUNT=5;BYMONTH=1,7;BYDAY=MO,-1FR;WKST=SU", r.String())
+
+	for _, s := range []string{"FREQ=DAILY;UNTIL=20261231T170000Z", "FREQ=YEARLY;UNTIL=20261231T170000;BYMONTHDAY=1,-1"} {
+		r, err := rrule.Parse(s)
+		ok(t, err)
+		equals(t, s, r.String())
+	}
+
+	for _, bad := range []string{
+		"",
+		"INTERVAL=2",
+		"FREQ=HOURLY",
+		"FREQ=DAILY;FREQ=WEEKLY",
+		"FREQ=DAILY;INTERVAL=0",
+		"FREQ=DAILY;COUNT=2;UNTIL=20261231",
+		"FREQ=DAILY;UNTIL=tomorrow",
+		"FREQ=WEEKLY;BYDAY=1MO",
+		"FREQ=WEEKLY;BYMONTHDAY=1",
+		"FREQ=MONTHLY;BYDAY=0MO",
+		"FREQ=MONTHLY;BYDAY=XX",
+		"FREQ=MONTHLY;BYMONTHDAY=32",
+		"FREQ=YEARLY;BYMONTH=13",
+		"FREQ=YEARLY;BYSETPOS=1",
+		"FREQ",
+	} {
+		_, err := rrule.Parse(bad)
+		assert(t, err != nil, "expected %q not to parse", bad)
+	}
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
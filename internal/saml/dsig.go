@@ -0,0 +1,150 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	// The hashes signatures can use
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// The XML Signature namespaces and algorithms we accept. SHA-1 and
+// inclusive canonicalization aren't among them.
+const (
+	nsDSig       = "http://www.w3.org/2000/09/xmldsig#"
+	nsExcC14N    = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algExcC14N   = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+)
+
+var signatureHashes = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmldsig-more#rsa-sha512": crypto.SHA512,
+}
+
+var digestHashes = map[string]crypto.Hash{
+	"http://www.w3.org/2001/04/xmlenc#sha256": crypto.SHA256,
+	"http://www.w3.org/2001/04/xmlenc#sha512": crypto.SHA512,
+}
+
+// errNoSignature is returned by verifySignature for unsigned elements.
+var errNoSignature = errors.New("not signed")
+
+// verifySignature checks the enveloped signature among the element's
+// children against the certificate. The signature has to cover the element
+// itself, by ID, so only what's inside the element can be trusted after.
+func verifySignature(e *element, cert *x509.Certificate) error {
+	sigs := e.elements(nsDSig, "Signature")
+	if len(sigs) == 0 {
+		return errNoSignature
+	}
+	if len(sigs) > 1 {
+		return errors.New("more than one signature")
+	}
+	sig := sigs[0]
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("the IdP's certificate doesn't have an RSA key")
+	}
+
+	si := sig.child(nsDSig, "SignedInfo")
+	if si == nil {
+		return errors.New("the signature needs one SignedInfo")
+	}
+	cm := si.child(nsDSig, "CanonicalizationMethod")
+	if cm == nil || cm.attr("Algorithm") != algExcC14N {
+		return errors.New("the signature has to use exclusive canonicalization")
+	}
+	sm := si.child(nsDSig, "SignatureMethod")
+	if sm == nil {
+		return errors.New("the signature has no SignatureMethod")
+	}
+	sigHash, ok := signatureHashes[sm.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("signature algorithm %q isn't supported", sm.attr("Algorithm"))
+	}
+
+	ref := si.child(nsDSig, "Reference")
+	if ref == nil {
+		return errors.New("the signature needs exactly one Reference")
+	}
+	id := e.attr("ID")
+	if id == "" || ref.attr("URI") != "#"+id {
+		return errors.New("the signature doesn't refer to the signed element")
+	}
+	refInclusive, err := checkTransforms(ref)
+	if err != nil {
+		return err
+	}
+	dm := ref.child(nsDSig, "DigestMethod")
+	if dm == nil {
+		return errors.New("the reference has no DigestMethod")
+	}
+	digestHash, ok := digestHashes[dm.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("digest algorithm %q isn't supported", dm.attr("Algorithm"))
+	}
+	dv := ref.child(nsDSig, "DigestValue")
+	if dv == nil {
+		return errors.New("the reference has no DigestValue")
+	}
+	want, err := decodeBase64(dv.text())
+	if err != nil {
+		return fmt.Errorf("error decoding digest: %w", err)
+	}
+
+	h := digestHash.New()
+	h.Write(canonicalize(e, sig, refInclusive))
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return errors.New("the digest doesn't match: the element was changed after signing")
+	}
+
+	sv := sig.child(nsDSig, "SignatureValue")
+	if sv == nil {
+		return errors.New("the signature has no SignatureValue")
+	}
+	sigValue, err := decodeBase64(sv.text())
+	if err != nil {
+		return fmt.Errorf("error decoding signature: %w", err)
+	}
+	h = sigHash.New()
+	h.Write(canonicalize(si, nil, inclusivePrefixes(cm)))
+	if err := rsa.VerifyPKCS1v15(pub, sigHash, h.Sum(nil), sigValue); err != nil {
+		return fmt.Errorf("the signature isn't valid: %w", err)
+	}
+	return nil
+}
+
+// checkTransforms makes sure the reference is transformed by removing the
+// signature then canonicalizing, returning the inclusive prefixes.
+func checkTransforms(ref *element) ([]string, error) {
+	ts := ref.child(nsDSig, "Transforms")
+	if ts == nil {
+		return nil, errors.New("the reference has no Transforms")
+	}
+	transforms := ts.elements(nsDSig, "Transform")
+	if len(transforms) != 2 || transforms[0].attr("Algorithm") != algEnveloped || transforms[1].attr("Algorithm") != algExcC14N {
+		return nil, errors.New("the reference has to use the enveloped signature and exclusive canonicalization transforms")
+	}
+	return inclusivePrefixes(transforms[1]), nil
+}
+
+func inclusivePrefixes(method *element) []string {
+	in := method.child(nsExcC14N, "InclusiveNamespaces")
+	if in == nil {
+		return nil
+	}
+	return strings.Fields(in.attr("PrefixList"))
+}
+
+// decodeBase64 decodes base64 that may be broken over lines.
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
@@ -0,0 +1,305 @@
+package saml_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsDSig      = "http://www.w3.org/2000/09/xmldsig#"
+	nsXS        = "http://www.w3.org/2001/XMLSchema"
+	nsXSI       = "http://www.w3.org/2001/XMLSchema-instance"
+	algExcC14N  = "http://www.w3.org/2001/10/xml-exc-c14n#"
+
+	spEntityID = "https://sp.example.com/saml/metadata"
+	spACSURL   = "https://sp.example.com/saml/acs"
+)
+
+// testIdP stands in for an IdP. It signs with the fixture keys, and writes
+// what it signs already in exclusive canonical form so the digests don't
+// depend on the canonicalization being tested.
+type testIdP struct {
+	entityID string
+	key      *rsa.PrivateKey
+	cert     *x509.Certificate
+	srv      *httptest.Server
+	// user is who the IdP says signs in at its SSO endpoint.
+	user testUser
+}
+
+type testUser struct {
+	nameID, email, name string
+}
+
+func newTestIdP(t *testing.T) *testIdP {
+	idp := &testIdP{
+		entityID: "https://idp.example.com/metadata",
+		key:      loadKey(t, "idp.key"),
+		cert:     loadCert(t, "idp.crt"),
+		user:     testUser{"bjensen-1234", "bjensen@example.com", "Barbara & Jensen"},
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metadata", idp.serveMetadata)
+	mux.HandleFunc("/sso", idp.serveSSO)
+	idp.srv = httptest.NewServer(mux)
+	return idp
+}
+
+func loadPEM(t *testing.T, name string) []byte {
+	t.Helper()
+	b, err := ioutil.ReadFile("testdata/" + name)
+	ok(t, err)
+	block, _ := pem.Decode(b)
+	assert(t, block != nil, "no PEM in %s", name)
+	return block.Bytes
+}
+
+func loadKey(t *testing.T, name string) *rsa.PrivateKey {
+	k, err := x509.ParsePKCS8PrivateKey(loadPEM(t, name))
+	ok(t, err)
+	return k.(*rsa.PrivateKey)
+}
+
+func loadCert(t *testing.T, name string) *x509.Certificate {
+	c, err := x509.ParseCertificate(loadPEM(t, name))
+	ok(t, err)
+	return c
+}
+
+func (idp *testIdP) metadata() string {
+	return `<?xml version="1.0"?>
+<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="` + idp.entityID + `">
+  <md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">
+    <md:KeyDescriptor use="encryption">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>bm90IGEgY2VydA==</ds:X509Certificate></ds:X509Data></ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:KeyDescriptor use="signing">
+      <ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#">
+        <ds:X509Data>
+          <ds:X509Certificate>
+            ` + base64.StdEncoding.EncodeToString(idp.cert.Raw) + `
+          </ds:X509Certificate>
+        </ds:X509Data>
+      </ds:KeyInfo>
+    </md:KeyDescriptor>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" Location="` + idp.srv.URL + `/sso/post"/>
+    <md:SingleSignOnService Binding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect" Location="` + idp.srv.URL + `/sso"/>
+  </md:IDPSSODescriptor>
+</md:EntityDescriptor>`
+}
+
+func (idp *testIdP) serveMetadata(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	fmt.Fprint(w, idp.metadata())
+}
+
+type authnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Destination                 string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	Issuer                      string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+// serveSSO signs the user in at once, answering with the form fields the
+// browser would post to the ACS.
+func (idp *testIdP) serveSSO(w http.ResponseWriter, r *http.Request) {
+	deflated, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("SAMLRequest"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b, err := ioutil.ReadAll(flate.NewReader(bytes.NewReader(deflated)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var req authnRequest
+	if err := xml.Unmarshal(b, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Destination != idp.srv.URL+"/sso" || req.Issuer != spEntityID {
+		http.Error(w, "unknown SP", http.StatusBadRequest)
+		return
+	}
+
+	opts := idp.defaults(time.Now())
+	opts.inResponseTo = req.ID
+	opts.recipient = req.AssertionConsumerServiceURL
+	form := url.Values{
+		"SAMLResponse": {idp.response(opts)},
+		"RelayState":   {r.URL.Query().Get("RelayState")},
+	}
+	w.Header().Set("Content-Type", "application/x-www-form-urlencoded")
+	fmt.Fprint(w, form.Encode())
+}
+
+// responseOpts says what goes in a Response.
+type responseOpts struct {
+	responseID, assertionID string
+	issuer, audience        string
+	destination, recipient  string
+	inResponseTo            string
+	status                  string
+	now                     time.Time
+	notBefore, notOnOrAfter time.Time
+	user                    testUser
+
+	signResponse, signAssertion bool
+	// key signs instead of the IdP's own key, if set.
+	key *rsa.PrivateKey
+	// tamper changes the Response after it's signed.
+	tamper func(string) string
+}
+
+func (idp *testIdP) defaults(now time.Time) *responseOpts {
+	return &responseOpts{
+		responseID:    "_r" + fmt.Sprint(now.UnixNano()),
+		assertionID:   "_a" + fmt.Sprint(now.UnixNano()),
+		issuer:        idp.entityID,
+		audience:      spEntityID,
+		destination:   spACSURL,
+		recipient:     spACSURL,
+		status:        "urn:oasis:names:tc:SAML:2.0:status:Success",
+		now:           now,
+		notBefore:     now.Add(-time.Minute),
+		notOnOrAfter:  now.Add(5 * time.Minute),
+		user:          idp.user,
+		signAssertion: true,
+	}
+}
+
+func samlTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05Z")
+}
+
+// escape escapes text the way canonical XML does; these tests don't put
+// anything in attributes that would need it.
+func escape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// assertion writes the assertion. nsDecl is the namespace declarations on
+// it, and xsiDecl those on each attribute value, which differ between the
+// document and the canonical forms.
+func (o *responseOpts) assertion(nsDecl, xsiDecl, sig string) string {
+	var attrs strings.Builder
+	for _, a := range [][2]string{{"email", o.user.email}, {"displayName", o.user.name}} {
+		attrs.WriteString(`<saml:Attribute Name="` + a[0] + `">`)
+		attrs.WriteString(`<saml:AttributeValue` + xsiDecl + ` xsi:type="xs:string">` + escape(a[1]) + `</saml:AttributeValue>`)
+		attrs.WriteString(`</saml:Attribute>`)
+	}
+	inResponseTo := ""
+	if o.inResponseTo != "" {
+		inResponseTo = ` InResponseTo="` + o.inResponseTo + `"`
+	}
+	return `<saml:Assertion` + nsDecl + ` ID="` + o.assertionID + `" IssueInstant="` + samlTime(o.now) + `" Version="2.0">` +
+		`<saml:Issuer>` + escape(o.issuer) + `</saml:Issuer>` + sig +
+		`<saml:Subject>` +
+		`<saml:NameID Format="urn:oasis:names:tc:SAML:2.0:nameid-format:persistent">` + escape(o.user.nameID) + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">` +
+		`<saml:SubjectConfirmationData` + inResponseTo + ` NotOnOrAfter="` + samlTime(o.notOnOrAfter) + `" Recipient="` + o.recipient + `"></saml:SubjectConfirmationData>` +
+		`</saml:SubjectConfirmation>` +
+		`</saml:Subject>` +
+		`<saml:Conditions NotBefore="` + samlTime(o.notBefore) + `" NotOnOrAfter="` + samlTime(o.notOnOrAfter) + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + escape(o.audience) + `</saml:Audience></saml:AudienceRestriction>` +
+		`</saml:Conditions>` +
+		`<saml:AuthnStatement AuthnInstant="` + samlTime(o.now) + `" SessionIndex="` + o.assertionID + `"></saml:AuthnStatement>` +
+		`<saml:AttributeStatement>` + attrs.String() + `</saml:AttributeStatement>` +
+		`</saml:Assertion>`
+}
+
+// response writes the Response: nsDecl and issuerDecl are the declarations
+// on it and its Issuer, and assertion is the assertion to put in it.
+func (o *responseOpts) responseXML(nsDecl, issuerDecl, sig, assertion string) string {
+	inResponseTo := ""
+	if o.inResponseTo != "" {
+		inResponseTo = ` InResponseTo="` + o.inResponseTo + `"`
+	}
+	return `<samlp:Response` + nsDecl + ` Destination="` + o.destination + `" ID="` + o.responseID + `"` + inResponseTo + ` IssueInstant="` + samlTime(o.now) + `" Version="2.0">` +
+		`<saml:Issuer` + issuerDecl + `>` + escape(o.issuer) + `</saml:Issuer>` + sig +
+		`<samlp:Status><samlp:StatusCode Value="` + o.status + `"></samlp:StatusCode></samlp:Status>` +
+		assertion +
+		`</samlp:Response>`
+}
+
+func decl(prefix, uri string) string {
+	return ` xmlns:` + prefix + `="` + uri + `"`
+}
+
+// response returns the Response, base64 encoded as it's posted.
+func (idp *testIdP) response(o *responseOpts) string {
+	key := idp.key
+	if o.key != nil {
+		key = o.key
+	}
+
+	assertionSig := ""
+	if o.signAssertion {
+		canonical := o.assertion(decl("saml", nsAssertion)+decl("xs", nsXS), decl("xsi", nsXSI), "")
+		assertionSig = signature(key, o.assertionID, canonical)
+	}
+	assertion := o.assertion("", "", assertionSig)
+
+	responseSig := ""
+	if o.signResponse {
+		canonicalAssertion := o.assertion(decl("saml", nsAssertion), decl("xsi", nsXSI), assertionSig)
+		canonical := o.responseXML(decl("samlp", nsProtocol)+decl("xs", nsXS), decl("saml", nsAssertion), "", canonicalAssertion)
+		responseSig = signature(key, o.responseID, canonical)
+	}
+	doc := `<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		o.responseXML(decl("samlp", nsProtocol)+decl("saml", nsAssertion)+decl("xs", nsXS)+decl("xsi", nsXSI), "", responseSig, assertion)
+	if o.tamper != nil {
+		doc = o.tamper(doc)
+	}
+	return base64.StdEncoding.EncodeToString([]byte(doc))
+}
+
+func signedInfo(nsDecl, id, digest string) string {
+	return `<ds:SignedInfo` + nsDecl + `>` +
+		`<ds:CanonicalizationMethod Algorithm="` + algExcC14N + `"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + id + `">` +
+		`<ds:Transforms>` +
+		`<ds:Transform Algorithm="http://www.w3.org/2000/09/xmldsig#enveloped-signature"></ds:Transform>` +
+		`<ds:Transform Algorithm="` + algExcC14N + `"><ec:InclusiveNamespaces xmlns:ec="` + algExcC14N + `" PrefixList="xs"></ec:InclusiveNamespaces></ds:Transform>` +
+		`</ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="http://www.w3.org/2001/04/xmlenc#sha256"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + digest + `</ds:DigestValue>` +
+		`</ds:Reference>` +
+		`</ds:SignedInfo>`
+}
+
+// signature returns an enveloped signature of the element with the ID,
+// given in canonical form.
+func signature(key *rsa.PrivateKey, id, canonical string) string {
+	digest := sha256.Sum256([]byte(canonical))
+	d := base64.StdEncoding.EncodeToString(digest[:])
+	h := sha256.Sum256([]byte(signedInfo(decl("ds", nsDSig), id, d)))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, h[:])
+	if err != nil {
+		panic(err)
+	}
+	return `<ds:Signature` + decl("ds", nsDSig) + `>` + signedInfo("", id, d) +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue>` +
+		`</ds:Signature>`
+}
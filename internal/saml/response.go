@@ -0,0 +1,321 @@
+package saml
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	statusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	confirmationBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// Assertion is what we take from a valid Response.
+type Assertion struct {
+	ID           string
+	Issuer       string
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	// InResponseTo is the ID of our AuthnRequest, or "" if the IdP sent the
+	// Response without one.
+	InResponseTo string
+	// Attributes holds the values of the attributes, by name, and by
+	// friendly name too for those that have one.
+	Attributes map[string][]string
+	// Expiry is when the assertion can no longer be used, so its ID needs
+	// remembering until then to stop it being replayed.
+	Expiry time.Time
+}
+
+// The attribute names the usual IdPs give their users' details under.
+var (
+	emailAttributes = []string{
+		"email", "mail", "emailAddress",
+		"urn:oid:0.9.2342.19200300.100.1.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/emailaddress",
+	}
+	nameAttributes = []string{
+		"displayName", "name", "cn",
+		"urn:oid:2.16.840.1.113730.3.1.241",
+		"urn:oid:2.5.4.3",
+		"http://schemas.xmlsoap.org/ws/2005/05/identity/claims/name",
+	}
+	usernameAttributes = []string{
+		"username", "uid",
+		"urn:oid:0.9.2342.19200300.100.1.1",
+	}
+)
+
+// Attribute returns the first value of the first of the attributes the
+// assertion has, matching names without regard to case.
+func (a *Assertion) Attribute(names ...string) string {
+	for _, name := range names {
+		for k, vs := range a.Attributes {
+			if strings.EqualFold(k, name) && len(vs) > 0 && vs[0] != "" {
+				return vs[0]
+			}
+		}
+	}
+	return ""
+}
+
+// Email returns the user's email address, from the attributes or else an
+// email NameID.
+func (a *Assertion) Email() string {
+	if email := a.Attribute(emailAttributes...); email != "" {
+		return email
+	}
+	if a.NameIDFormat == NameIDFormatEmail {
+		return a.NameID
+	}
+	return ""
+}
+
+// DisplayName returns the user's name, if the IdP sent it.
+func (a *Assertion) DisplayName() string {
+	return a.Attribute(nameAttributes...)
+}
+
+// Username returns the user's username, if the IdP sent one.
+func (a *Assertion) Username() string {
+	return a.Attribute(usernameAttributes...)
+}
+
+// ParseResponse checks the base64 encoded Response posted to the ACS and
+// returns its assertion. Either the Response or the assertion has to be
+// signed by the IdP, and the assertion has to be for us, now and from the
+// IdP. Whether it answers one of our requests, and whether it's been seen
+// before, is left to the caller.
+func (sp *ServiceProvider) ParseResponse(samlResponse string, now time.Time) (*Assertion, error) {
+	a, err := sp.parseResponse(samlResponse, now)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SAML response: %w", err)
+	}
+	return a, nil
+}
+
+func (sp *ServiceProvider) parseResponse(samlResponse string, now time.Time) (*Assertion, error) {
+	data, err := decodeBase64(samlResponse)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding: %w", err)
+	}
+	resp, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if !resp.is(nsProtocol, "Response") {
+		return nil, errors.New("it isn't a Response")
+	}
+	if resp.attr("Version") != "2.0" {
+		return nil, errors.New("it isn't SAML 2.0")
+	}
+
+	// The assertion is read only from elements a signature was checked on:
+	// the Response, which covers all of it, or else the assertion itself.
+	respErr := verifySignature(resp, sp.IdP.Certificate)
+	if respErr != nil && respErr != errNoSignature {
+		return nil, fmt.Errorf("the Response's signature: %w", respErr)
+	}
+	if len(resp.elements(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions aren't supported")
+	}
+	as := resp.child(nsAssertion, "Assertion")
+	if as == nil {
+		return nil, errors.New("it needs exactly one Assertion")
+	}
+	asErr := verifySignature(as, sp.IdP.Certificate)
+	if asErr != nil && asErr != errNoSignature {
+		return nil, fmt.Errorf("the Assertion's signature: %w", asErr)
+	}
+	if respErr == errNoSignature && asErr == errNoSignature {
+		return nil, errors.New("neither the Response nor the Assertion is signed")
+	}
+
+	if d := resp.attr("Destination"); d != "" && d != sp.ACSURL {
+		return nil, fmt.Errorf("it was sent to %q", d)
+	}
+	if iss := resp.child(nsAssertion, "Issuer"); iss != nil && iss.text() != sp.IdP.EntityID {
+		return nil, fmt.Errorf("it was issued by %q", iss.text())
+	}
+	if err := checkStatus(resp); err != nil {
+		return nil, err
+	}
+
+	a, err := sp.parseAssertion(as, now)
+	if err != nil {
+		return nil, err
+	}
+	if irt := resp.attr("InResponseTo"); irt != "" {
+		if a.InResponseTo != "" && a.InResponseTo != irt {
+			return nil, errors.New("the Response and the Assertion answer different requests")
+		}
+		a.InResponseTo = irt
+	}
+	return a, nil
+}
+
+func checkStatus(resp *element) error {
+	st := resp.child(nsProtocol, "Status")
+	if st == nil {
+		return errors.New("it has no Status")
+	}
+	sc := st.child(nsProtocol, "StatusCode")
+	if sc == nil {
+		return errors.New("it has no StatusCode")
+	}
+	if v := sc.attr("Value"); v != statusSuccess {
+		if msg := st.child(nsProtocol, "StatusMessage"); msg != nil && msg.text() != "" {
+			return fmt.Errorf("the IdP says %s: %s", v, msg.text())
+		}
+		return fmt.Errorf("the IdP says %s", v)
+	}
+	return nil
+}
+
+func (sp *ServiceProvider) parseAssertion(as *element, now time.Time) (*Assertion, error) {
+	skew := sp.clockSkew()
+	a := &Assertion{ID: as.attr("ID"), Attributes: map[string][]string{}}
+	if a.ID == "" {
+		return nil, errors.New("the Assertion has no ID")
+	}
+	if as.attr("Version") != "2.0" {
+		return nil, errors.New("the Assertion isn't SAML 2.0")
+	}
+	iss := as.child(nsAssertion, "Issuer")
+	if iss == nil || iss.text() != sp.IdP.EntityID {
+		return nil, errors.New("the Assertion wasn't issued by the IdP")
+	}
+	a.Issuer = iss.text()
+
+	conds := as.child(nsAssertion, "Conditions")
+	if conds == nil {
+		return nil, errors.New("the Assertion has no Conditions")
+	}
+	if err := checkTimes(conds, now, skew); err != nil {
+		return nil, fmt.Errorf("the Assertion %w", err)
+	}
+	ars := conds.elements(nsAssertion, "AudienceRestriction")
+	if len(ars) == 0 {
+		return nil, errors.New("the Assertion has no AudienceRestriction")
+	}
+	for _, ar := range ars {
+		if !hasAudience(ar, sp.EntityID) {
+			return nil, errors.New("the Assertion isn't for us")
+		}
+	}
+
+	subj := as.child(nsAssertion, "Subject")
+	if subj == nil {
+		return nil, errors.New("the Assertion needs one Subject")
+	}
+	nameID := subj.child(nsAssertion, "NameID")
+	if nameID == nil || nameID.text() == "" {
+		return nil, errors.New("the Subject has no NameID")
+	}
+	a.NameID = nameID.text()
+	a.NameIDFormat = nameID.attr("Format")
+	if err := sp.checkConfirmation(subj, a, now, skew); err != nil {
+		return nil, err
+	}
+	if t, err := parseTime(conds.attr("NotOnOrAfter")); err == nil && t.Before(a.Expiry) {
+		a.Expiry = t
+	}
+	a.Expiry = a.Expiry.Add(skew)
+
+	if stmt := as.child(nsAssertion, "AuthnStatement"); stmt != nil {
+		a.SessionIndex = stmt.attr("SessionIndex")
+	}
+	for _, stmt := range as.elements(nsAssertion, "AttributeStatement") {
+		for _, at := range stmt.elements(nsAssertion, "Attribute") {
+			var values []string
+			for _, v := range at.elements(nsAssertion, "AttributeValue") {
+				values = append(values, v.text())
+			}
+			for _, name := range []string{at.attr("Name"), at.attr("FriendlyName")} {
+				if name != "" {
+					a.Attributes[name] = append(a.Attributes[name], values...)
+				}
+			}
+		}
+	}
+	return a, nil
+}
+
+// checkConfirmation looks for a bearer confirmation that the assertion may
+// be used by whoever posts it to us, now.
+func (sp *ServiceProvider) checkConfirmation(subj *element, a *Assertion, now time.Time, skew time.Duration) error {
+	var lastErr error
+	for _, sc := range subj.elements(nsAssertion, "SubjectConfirmation") {
+		if sc.attr("Method") != confirmationBearer {
+			continue
+		}
+		scd := sc.child(nsAssertion, "SubjectConfirmationData")
+		if scd == nil {
+			lastErr = errors.New("the bearer confirmation has no data")
+			continue
+		}
+		if scd.attr("Recipient") != sp.ACSURL {
+			lastErr = fmt.Errorf("the Assertion was meant for %q", scd.attr("Recipient"))
+			continue
+		}
+		if scd.attr("NotOnOrAfter") == "" {
+			lastErr = errors.New("the bearer confirmation doesn't expire")
+			continue
+		}
+		if err := checkTimes(scd, now, skew); err != nil {
+			lastErr = fmt.Errorf("the bearer confirmation %w", err)
+			continue
+		}
+		a.Expiry, _ = parseTime(scd.attr("NotOnOrAfter"))
+		a.InResponseTo = scd.attr("InResponseTo")
+		return nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("the Subject has no bearer confirmation")
+	}
+	return lastErr
+}
+
+// checkTimes checks now is between the element's NotBefore and NotOnOrAfter,
+// give or take the skew. Each is optional.
+func checkTimes(e *element, now time.Time, skew time.Duration) error {
+	if s := e.attr("NotBefore"); s != "" {
+		t, err := parseTime(s)
+		if err != nil {
+			return err
+		}
+		if now.Add(skew).Before(t) {
+			return errors.New("isn't valid yet")
+		}
+	}
+	if s := e.attr("NotOnOrAfter"); s != "" {
+		t, err := parseTime(s)
+		if err != nil {
+			return err
+		}
+		if !now.Add(-skew).Before(t) {
+			return errors.New("has expired")
+		}
+	}
+	return nil
+}
+
+func hasAudience(ar *element, entityID string) bool {
+	for _, aud := range ar.elements(nsAssertion, "Audience") {
+		if aud.text() == entityID {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("has a bad time %q", s)
+	}
+	return t, nil
+}
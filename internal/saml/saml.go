@@ -0,0 +1,263 @@
+// Package saml implements the parts of SAML 2.0 a service provider needs for
+// web single sign-on: its metadata, AuthnRequests sent with the HTTP-Redirect
+// binding, and checking the signed Responses the IdP posts back to the
+// assertion consumer service. It knows nothing about users or sessions, and
+// nothing about replays beyond handing back the assertion's ID to remember.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// The SAML namespaces, bindings and formats we use.
+const (
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+
+	BindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	BindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	NameIDFormatEmail      = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatPersistent = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	NameIDFormatTransient  = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+// DefaultClockSkew is how far the IdP's clock may be from ours.
+const DefaultClockSkew = 3 * time.Minute
+
+// IdentityProvider is what we need to know about the IdP, usually read from
+// its metadata.
+type IdentityProvider struct {
+	EntityID string
+	// SSOURL is where AuthnRequests are sent, with the redirect binding.
+	SSOURL string
+	// Certificate holds the key the IdP signs with.
+	Certificate *x509.Certificate
+}
+
+// ServiceProvider is us.
+type ServiceProvider struct {
+	EntityID string
+	// ACSURL is the assertion consumer service, where the IdP posts its
+	// Responses.
+	ACSURL string
+	IdP    *IdentityProvider
+	// ClockSkew is allowed either way when checking times; zero means
+	// DefaultClockSkew.
+	ClockSkew time.Duration
+}
+
+func (sp *ServiceProvider) clockSkew() time.Duration {
+	if sp.ClockSkew == 0 {
+		return DefaultClockSkew
+	}
+	return sp.ClockSkew
+}
+
+type entityDescriptor struct {
+	XMLName  xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata EntityDescriptor"`
+	EntityID string   `xml:"entityID,attr"`
+	SP       spSSODescriptor
+}
+
+type spSSODescriptor struct {
+	XMLName                    xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata SPSSODescriptor"`
+	AuthnRequestsSigned        bool     `xml:"AuthnRequestsSigned,attr"`
+	WantAssertionsSigned       bool     `xml:"WantAssertionsSigned,attr"`
+	ProtocolSupportEnumeration string   `xml:"protocolSupportEnumeration,attr"`
+	NameIDFormats              []string `xml:"urn:oasis:names:tc:SAML:2.0:metadata NameIDFormat"`
+	ACS                        indexedEndpoint
+}
+
+type indexedEndpoint struct {
+	XMLName   xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:metadata AssertionConsumerService"`
+	Binding   string   `xml:"Binding,attr"`
+	Location  string   `xml:"Location,attr"`
+	Index     int      `xml:"index,attr"`
+	IsDefault bool     `xml:"isDefault,attr"`
+}
+
+// Metadata returns our metadata, for setting us up at the IdP.
+func (sp *ServiceProvider) Metadata() []byte {
+	ed := entityDescriptor{
+		EntityID: sp.EntityID,
+		SP: spSSODescriptor{
+			WantAssertionsSigned:       true,
+			ProtocolSupportEnumeration: nsProtocol,
+			NameIDFormats:              []string{NameIDFormatPersistent, NameIDFormatEmail},
+			ACS: indexedEndpoint{
+				Binding:   BindingPOST,
+				Location:  sp.ACSURL,
+				IsDefault: true,
+			},
+		},
+	}
+	b, err := xml.MarshalIndent(ed, "", "  ")
+	if err != nil {
+		panic(err) // only happens for types that can't be marshalled
+	}
+	return append([]byte(xml.Header), b...)
+}
+
+// NewRequestID returns a random ID for an AuthnRequest. IDs have to start
+// with a letter or underscore.
+func NewRequestID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return "_" + hex.EncodeToString(b)
+}
+
+type authnRequest struct {
+	XMLName                     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	ID                          string   `xml:"ID,attr"`
+	Version                     string   `xml:"Version,attr"`
+	IssueInstant                string   `xml:"IssueInstant,attr"`
+	Destination                 string   `xml:"Destination,attr"`
+	AssertionConsumerServiceURL string   `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string   `xml:"ProtocolBinding,attr"`
+	Issuer                      issuer
+	NameIDPolicy                nameIDPolicy
+}
+
+type issuer struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+	Value   string   `xml:",chardata"`
+}
+
+type nameIDPolicy struct {
+	XMLName     xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+	AllowCreate bool     `xml:"AllowCreate,attr"`
+}
+
+// AuthnRequestURL returns the URL to send the browser to so the IdP signs
+// the user in, with an AuthnRequest of the given ID. The Response will say
+// it's in response to the ID, and relayState comes back with it.
+func (sp *ServiceProvider) AuthnRequestURL(id, relayState string, now time.Time) (string, error) {
+	req := authnRequest{
+		ID:                          id,
+		Version:                     "2.0",
+		IssueInstant:                now.UTC().Format(time.RFC3339),
+		Destination:                 sp.IdP.SSOURL,
+		AssertionConsumerServiceURL: sp.ACSURL,
+		ProtocolBinding:             BindingPOST,
+		Issuer:                      issuer{Value: sp.EntityID},
+		NameIDPolicy:                nameIDPolicy{AllowCreate: true},
+	}
+	b, err := xml.Marshal(req)
+	if err != nil {
+		return "", fmt.Errorf("error encoding AuthnRequest: %w", err)
+	}
+
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.DefaultCompression)
+	w.Write(b)
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("error compressing AuthnRequest: %w", err)
+	}
+
+	u, err := url.Parse(sp.IdP.SSOURL)
+	if err != nil {
+		return "", fmt.Errorf("error parsing the IdP's SSO URL: %w", err)
+	}
+	q := u.Query()
+	q.Set("SAMLRequest", base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if relayState != "" {
+		q.Set("RelayState", relayState)
+	}
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+// ParseIdPMetadata reads the IdP's entity ID, redirect SSO endpoint and
+// signing certificate from its metadata, which may be an EntityDescriptor
+// or an EntitiesDescriptor with one IdP in it.
+func ParseIdPMetadata(data []byte) (*IdentityProvider, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	eds := []*element{root}
+	if root.is(nsMetadata, "EntitiesDescriptor") {
+		eds = root.elements(nsMetadata, "EntityDescriptor")
+	} else if !root.is(nsMetadata, "EntityDescriptor") {
+		return nil, errors.New("the metadata has no EntityDescriptor")
+	}
+
+	var idp *IdentityProvider
+	for _, ed := range eds {
+		desc := ed.child(nsMetadata, "IDPSSODescriptor")
+		if desc == nil {
+			continue
+		}
+		if idp != nil {
+			return nil, errors.New("the metadata describes more than one IdP")
+		}
+		idp = &IdentityProvider{EntityID: ed.attr("entityID")}
+		for _, sso := range desc.elements(nsMetadata, "SingleSignOnService") {
+			if sso.attr("Binding") == BindingRedirect {
+				idp.SSOURL = sso.attr("Location")
+				break
+			}
+		}
+		for _, kd := range desc.elements(nsMetadata, "KeyDescriptor") {
+			if use := kd.attr("use"); use != "" && use != "signing" {
+				continue
+			}
+			cert, err := keyDescriptorCert(kd)
+			if err != nil {
+				return nil, err
+			}
+			idp.Certificate = cert
+			break
+		}
+	}
+
+	switch {
+	case idp == nil:
+		return nil, errors.New("the metadata has no IDPSSODescriptor")
+	case idp.EntityID == "":
+		return nil, errors.New("the IdP has no entityID")
+	case idp.SSOURL == "":
+		return nil, errors.New("the IdP has no SingleSignOnService with the redirect binding")
+	case idp.Certificate == nil:
+		return nil, errors.New("the IdP has no signing certificate")
+	}
+	return idp, nil
+}
+
+func keyDescriptorCert(kd *element) (*x509.Certificate, error) {
+	ki := kd.child(nsDSig, "KeyInfo")
+	if ki == nil {
+		return nil, errors.New("the IdP's KeyDescriptor has no KeyInfo")
+	}
+	xd := ki.child(nsDSig, "X509Data")
+	if xd == nil {
+		return nil, errors.New("the IdP's KeyInfo has no X509Data")
+	}
+	xc := xd.child(nsDSig, "X509Certificate")
+	if xc == nil {
+		return nil, errors.New("the IdP's X509Data has no X509Certificate")
+	}
+	der, err := decodeBase64(xc.text())
+	if err != nil {
+		return nil, fmt.Errorf("error decoding the IdP's certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing the IdP's certificate: %w", err)
+	}
+	return cert, nil
+}
@@ -0,0 +1,234 @@
+package saml_test
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ejamesc/auth_demo/internal/saml"
+)
+
+func newTestSP(t *testing.T, idp *testIdP) *saml.ServiceProvider {
+	resp, err := http.Get(idp.srv.URL + "/metadata")
+	ok(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	ok(t, err)
+	md, err := saml.ParseIdPMetadata(b)
+	ok(t, err)
+	return &saml.ServiceProvider{EntityID: spEntityID, ACSURL: spACSURL, IdP: md}
+}
+
+func TestParseIdPMetadata(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.srv.Close()
+
+	md, err := saml.ParseIdPMetadata([]byte(idp.metadata()))
+	ok(t, err)
+	equals(t, idp.entityID, md.EntityID)
+	equals(t, idp.srv.URL+"/sso", md.SSOURL)
+	assert(t, md.Certificate.Equal(idp.cert), "expected the signing certificate")
+
+	_, err = saml.ParseIdPMetadata([]byte(strings.Replace(idp.metadata(), "HTTP-Redirect", "SOAP", 1)))
+	assert(t, err != nil, "expected an IdP without the redirect binding to be refused")
+	_, err = saml.ParseIdPMetadata([]byte(`<!DOCTYPE x [<!ENTITY a "b">]>` + idp.metadata()))
+	assert(t, err != nil, "expected a DTD to be refused")
+}
+
+func TestMetadata(t *testing.T) {
+	sp := &saml.ServiceProvider{EntityID: spEntityID, ACSURL: spACSURL}
+	var md struct {
+		EntityID string `xml:"entityID,attr"`
+		SP       struct {
+			WantAssertionsSigned bool `xml:"WantAssertionsSigned,attr"`
+			ACS                  struct {
+				Binding  string `xml:"Binding,attr"`
+				Location string `xml:"Location,attr"`
+			} `xml:"AssertionConsumerService"`
+		} `xml:"SPSSODescriptor"`
+	}
+	ok(t, xml.Unmarshal(sp.Metadata(), &md))
+	equals(t, spEntityID, md.EntityID)
+	equals(t, true, md.SP.WantAssertionsSigned)
+	equals(t, saml.BindingPOST, md.SP.ACS.Binding)
+	equals(t, spACSURL, md.SP.ACS.Location)
+}
+
+// TestSSO signs in through the stand-in IdP, from the AuthnRequest to
+// checking the Response it answers with.
+func TestSSO(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.srv.Close()
+	sp := newTestSP(t, idp)
+
+	id := saml.NewRequestID()
+	u, err := sp.AuthnRequestURL(id, "/c?tab=1", time.Now())
+	ok(t, err)
+	assert(t, strings.HasPrefix(u, idp.srv.URL+"/sso?"), "expected the redirect to go to the IdP, got %s", u)
+
+	resp, err := http.Get(u)
+	ok(t, err)
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	ok(t, err)
+	equals(t, http.StatusOK, resp.StatusCode)
+	form, err := url.ParseQuery(string(b))
+	ok(t, err)
+	equals(t, "/c?tab=1", form.Get("RelayState"))
+
+	a, err := sp.ParseResponse(form.Get("SAMLResponse"), time.Now())
+	ok(t, err)
+	equals(t, id, a.InResponseTo)
+	equals(t, idp.entityID, a.Issuer)
+	equals(t, "bjensen-1234", a.NameID)
+	equals(t, saml.NameIDFormatPersistent, a.NameIDFormat)
+	equals(t, "bjensen@example.com", a.Email())
+	equals(t, "Barbara & Jensen", a.DisplayName())
+	equals(t, "", a.Username())
+	assert(t, a.Expiry.After(time.Now().Add(5*time.Minute)), "expected the assertion to be remembered past its expiry, got %v", a.Expiry)
+}
+
+func TestParseResponse(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.srv.Close()
+	sp := newTestSP(t, idp)
+	now := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	other := loadKey(t, "other.key")
+
+	tests := []struct {
+		name   string
+		change func(o *responseOpts)
+		// err is part of the error expected, or "" if it should be valid.
+		err string
+	}{
+		{"signed assertion", func(o *responseOpts) {}, ""},
+		{"signed response", func(o *responseOpts) {
+			o.signResponse, o.signAssertion = true, false
+		}, ""},
+		{"both signed", func(o *responseOpts) { o.signResponse = true }, ""},
+		{"within the clock skew", func(o *responseOpts) {
+			o.notOnOrAfter = now.Add(-time.Minute)
+		}, ""},
+		{"unsigned", func(o *responseOpts) { o.signAssertion = false }, "neither"},
+		{"signed by another key", func(o *responseOpts) { o.key = other }, "signature isn't valid"},
+		{"assertion changed", func(o *responseOpts) {
+			o.tamper = func(s string) string { return strings.Replace(s, "bjensen-1234", "admin", 1) }
+		}, "digest doesn't match"},
+		{"response changed", func(o *responseOpts) {
+			o.signResponse, o.signAssertion = true, false
+			o.tamper = func(s string) string { return strings.Replace(s, "bjensen@example.com", "admin@example.com", 1) }
+		}, "digest doesn't match"},
+		{"signature moved", func(o *responseOpts) {
+			// A signed assertion tucked inside one made up by an attacker,
+			// hoping it's found by ID
+			o.tamper = func(s string) string {
+				start := strings.Index(s, "<saml:Assertion")
+				end := strings.Index(s, "</saml:Assertion>") + len("</saml:Assertion>")
+				signed := s[start:end]
+				evil := strings.Replace(signed, `ID="`+o.assertionID, `ID="_evil`, 1)
+				evil = strings.Replace(evil, "bjensen-1234", "admin", 1)
+				evil = strings.Replace(evil, "<saml:Subject>", "<saml:Advice>"+signed+"</saml:Advice><saml:Subject>", 1)
+				return s[:start] + evil + s[end:]
+			}
+		}, "doesn't refer to the signed element"},
+		{"second assertion", func(o *responseOpts) {
+			o.tamper = func(s string) string {
+				start := strings.Index(s, "<saml:Assertion")
+				return strings.Replace(s, "</samlp:Response>", s[start:len(s)-len("</samlp:Response>")]+"</samlp:Response>", 1)
+			}
+		}, "exactly one Assertion"},
+		{"DTD", func(o *responseOpts) {
+			o.tamper = func(s string) string {
+				return strings.Replace(s, "?>", `?><!DOCTYPE samlp:Response [<!ENTITY x "admin">]>`, 1)
+			}
+		}, "DTDs"},
+		{"wrong audience", func(o *responseOpts) { o.audience = "https://other.example.com" }, "isn't for us"},
+		{"expired", func(o *responseOpts) { o.notOnOrAfter = now.Add(-10 * time.Minute) }, "expired"},
+		{"not yet valid", func(o *responseOpts) { o.notBefore = now.Add(10 * time.Minute) }, "isn't valid yet"},
+		{"wrong recipient", func(o *responseOpts) { o.recipient = "https://other.example.com/acs" }, "meant for"},
+		{"wrong destination", func(o *responseOpts) { o.destination = "https://other.example.com/acs" }, "sent to"},
+		{"wrong issuer", func(o *responseOpts) { o.issuer = "https://evil.example.com" }, "issued by"},
+		{"failed", func(o *responseOpts) {
+			o.status = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+		}, "status:Responder"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := idp.defaults(now)
+			tt.change(o)
+			a, err := sp.ParseResponse(idp.response(o), now)
+			if tt.err == "" {
+				ok(t, err)
+				equals(t, "bjensen-1234", a.NameID)
+				equals(t, o.assertionID, a.ID)
+				return
+			}
+			assert(t, err != nil, "expected an error")
+			assert(t, strings.Contains(err.Error(), tt.err), "expected an error about %q, got %q", tt.err, err)
+		})
+	}
+}
+
+func TestParseResponseInResponseTo(t *testing.T) {
+	idp := newTestIdP(t)
+	defer idp.srv.Close()
+	sp := newTestSP(t, idp)
+	now := time.Now()
+
+	o := idp.defaults(now)
+	o.inResponseTo = "_req1"
+	a, err := sp.ParseResponse(idp.response(o), now)
+	ok(t, err)
+	equals(t, "_req1", a.InResponseTo)
+
+	o.tamper = func(s string) string {
+		return strings.Replace(s, `InResponseTo="_req1" IssueInstant`, `InResponseTo="_req2" IssueInstant`, 1)
+	}
+	_, err = sp.ParseResponse(idp.response(o), now)
+	assert(t, err != nil, "expected different requests in the Response and Assertion to be refused")
+
+	// IdP-initiated
+	o = idp.defaults(now)
+	a, err = sp.ParseResponse(idp.response(o), now)
+	ok(t, err)
+	equals(t, "", a.InResponseTo)
+
+	_, err = sp.ParseResponse(base64.StdEncoding.EncodeToString([]byte("<x/>")), now)
+	assert(t, err != nil, "expected something that isn't a Response to be refused")
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,290 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const nsXML = "http://www.w3.org/XML/1998/namespace"
+
+// element is an XML element kept the way it was written, prefixes and all,
+// which encoding/xml's structs don't do. Signatures are checked against
+// the canonical form of these, and the signed data is then read from the
+// very same elements.
+type element struct {
+	prefix, local string
+	// nsDecls maps the prefixes declared on the element, "" for the
+	// default namespace, to their URIs.
+	nsDecls map[string]string
+	attrs   []attr
+	// children holds *element, charData and procInst values.
+	children []interface{}
+	parent   *element
+}
+
+type attr struct {
+	prefix, local, value string
+}
+
+type charData string
+
+type procInst struct {
+	target string
+	inst   string
+}
+
+// parseXML parses a document, refusing DTDs so entity tricks can't be used.
+func parseXML(data []byte) (*element, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error parsing XML: %w", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			e := &element{prefix: t.Name.Space, local: t.Name.Local, nsDecls: map[string]string{}, parent: cur}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.nsDecls[""] = a.Value
+				case a.Name.Space == "xmlns":
+					e.nsDecls[a.Name.Local] = a.Value
+				default:
+					e.attrs = append(e.attrs, attr{a.Name.Space, a.Name.Local, a.Value})
+				}
+			}
+			if cur == nil {
+				if root != nil {
+					return nil, errors.New("error parsing XML: more than one root element")
+				}
+				root = e
+			} else {
+				cur.children = append(cur.children, e)
+			}
+			cur = e
+		case xml.EndElement:
+			if cur == nil || t.Name.Space != cur.prefix || t.Name.Local != cur.local {
+				return nil, fmt.Errorf("error parsing XML: unexpected </%s>", t.Name.Local)
+			}
+			cur = cur.parent
+		case xml.CharData:
+			if cur != nil {
+				cur.children = append(cur.children, charData(t))
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("error parsing XML: text outside the root element")
+			}
+		case xml.ProcInst:
+			if cur != nil {
+				cur.children = append(cur.children, procInst{t.Target, string(t.Inst)})
+			}
+		case xml.Directive:
+			return nil, errors.New("error parsing XML: DTDs aren't allowed")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("error parsing XML: incomplete document")
+	}
+	return root, nil
+}
+
+// lookupNS returns the URI the prefix is bound to where the element is.
+func (e *element) lookupNS(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return nsXML, true
+	}
+	for n := e; n != nil; n = n.parent {
+		if uri, ok := n.nsDecls[prefix]; ok {
+			return uri, true
+		}
+	}
+	return "", false
+}
+
+// is reports whether the element has the namespace and local name.
+func (e *element) is(space, local string) bool {
+	uri, _ := e.lookupNS(e.prefix)
+	return e.local == local && uri == space
+}
+
+// elements returns the element's child elements with the name.
+func (e *element) elements(space, local string) []*element {
+	var els []*element
+	for _, c := range e.children {
+		if ce, ok := c.(*element); ok && ce.is(space, local) {
+			els = append(els, ce)
+		}
+	}
+	return els
+}
+
+// child returns the only child element with the name, or nil if there
+// isn't exactly one.
+func (e *element) child(space, local string) *element {
+	els := e.elements(space, local)
+	if len(els) != 1 {
+		return nil
+	}
+	return els[0]
+}
+
+// attr returns the value of the unqualified attribute, or "".
+func (e *element) attr(local string) string {
+	for _, a := range e.attrs {
+		if a.prefix == "" && a.local == local {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// text returns the element's text content, trimmed.
+func (e *element) text() string {
+	var sb strings.Builder
+	for _, c := range e.children {
+		if cd, ok := c.(charData); ok {
+			sb.WriteString(string(cd))
+		}
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// canonicalize writes the element in Exclusive XML Canonicalization form,
+// without comments (https://www.w3.org/TR/xml-exc-c14n/), leaving out
+// exclude and everything in it. inclusive lists the prefixes treated as in
+// inclusive canonicalization, with "#default" for the default namespace.
+func canonicalize(e, exclude *element, inclusive []string) []byte {
+	incl := map[string]bool{}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		incl[p] = true
+	}
+	var buf bytes.Buffer
+	writeCanonical(&buf, e, exclude, map[string]string{}, incl)
+	return buf.Bytes()
+}
+
+// writeCanonical writes e. rendered holds the namespace declarations in
+// force from the output ancestors.
+func writeCanonical(buf *bytes.Buffer, e, exclude *element, rendered map[string]string, incl map[string]bool) {
+	used := map[string]bool{e.prefix: true}
+	for _, a := range e.attrs {
+		if a.prefix != "" {
+			used[a.prefix] = true
+		}
+	}
+	for p := range incl {
+		if _, ok := e.lookupNS(p); ok {
+			used[p] = true
+		}
+	}
+
+	type nsDecl struct{ prefix, uri string }
+	var decls []nsDecl
+	inScope := rendered
+	for p := range used {
+		if p == "xml" {
+			continue
+		}
+		uri, _ := e.lookupNS(p)
+		prev, ok := rendered[p]
+		if ok && prev == uri || !ok && uri == "" {
+			continue
+		}
+		if len(decls) == 0 {
+			inScope = make(map[string]string, len(rendered)+1)
+			for k, v := range rendered {
+				inScope[k] = v
+			}
+		}
+		decls = append(decls, nsDecl{p, uri})
+		inScope[p] = uri
+	}
+	sort.Slice(decls, func(i, j int) bool { return decls[i].prefix < decls[j].prefix })
+
+	type qattr struct {
+		space string
+		attr
+	}
+	attrs := make([]qattr, 0, len(e.attrs))
+	for _, a := range e.attrs {
+		space := ""
+		if a.prefix != "" {
+			space, _ = e.lookupNS(a.prefix)
+		}
+		attrs = append(attrs, qattr{space, a})
+	}
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return attrs[i].local < attrs[j].local
+	})
+
+	name := qualifiedName(e.prefix, e.local)
+	buf.WriteString("<" + name)
+	for _, d := range decls {
+		if d.prefix == "" {
+			buf.WriteString(` xmlns="`)
+		} else {
+			buf.WriteString(` xmlns:` + d.prefix + `="`)
+		}
+		escapeAttr(buf, d.uri)
+		buf.WriteString(`"`)
+	}
+	for _, a := range attrs {
+		buf.WriteString(" " + qualifiedName(a.prefix, a.local) + `="`)
+		escapeAttr(buf, a.value)
+		buf.WriteString(`"`)
+	}
+	buf.WriteString(">")
+
+	for _, c := range e.children {
+		switch c := c.(type) {
+		case *element:
+			if c != exclude {
+				writeCanonical(buf, c, exclude, inScope, incl)
+			}
+		case charData:
+			escapeText(buf, string(c))
+		case procInst:
+			buf.WriteString("<?" + c.target)
+			if c.inst != "" {
+				buf.WriteString(" " + c.inst)
+			}
+			buf.WriteString("?>")
+		}
+	}
+	buf.WriteString("</" + name + ">")
+}
+
+func qualifiedName(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var (
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+)
+
+func escapeAttr(buf *bytes.Buffer, s string) {
+	attrEscaper.WriteString(buf, s)
+}
+
+func escapeText(buf *bytes.Buffer, s string) {
+	textEscaper.WriteString(buf, s)
+}
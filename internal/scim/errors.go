@@ -0,0 +1,55 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+)
+
+// The scimType error keywords of RFC 7644 section 3.12.
+const (
+	ErrInvalidFilter = "invalidFilter"
+	ErrTooMany       = "tooMany"
+	ErrUniqueness    = "uniqueness"
+	ErrMutability    = "mutability"
+	ErrInvalidSyntax = "invalidSyntax"
+	ErrInvalidPath   = "invalidPath"
+	ErrNoTarget      = "noTarget"
+	ErrInvalidValue  = "invalidValue"
+)
+
+// Error is a SCIM error response.
+type Error struct {
+	Status int
+	// Type is one of the scimType keywords, if any apply.
+	Type   string
+	Detail string
+}
+
+// NewError returns a SCIM error. scimType may be empty.
+func NewError(status int, scimType, detail string) *Error {
+	return &Error{Status: status, Type: scimType, Detail: detail}
+}
+
+// NotFound returns the error for a resource that doesn't exist.
+func NotFound(detail string) *Error {
+	return NewError(404, "", detail)
+}
+
+func (e *Error) Error() string {
+	if e.Type != "" {
+		return fmt.Sprintf("scim %d %s: %s", e.Status, e.Type, e.Detail)
+	}
+	return fmt.Sprintf("scim %d: %s", e.Status, e.Detail)
+}
+
+// MarshalJSON writes the error in the error schema, where the status is a
+// string.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Schemas []string `json:"schemas"`
+		Status  string   `json:"status"`
+		Type    string   `json:"scimType,omitempty"`
+		Detail  string   `json:"detail,omitempty"`
+	}{[]string{ErrorSchema}, strconv.Itoa(e.Status), e.Type, e.Detail})
+}
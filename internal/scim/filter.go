@@ -0,0 +1,567 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Filter is a parsed filter expression, from RFC 7644 section 3.4.2.2.
+type Filter interface {
+	// Matches reports whether the resource, in the form returned by ToMap,
+	// matches the filter.
+	Matches(resource map[string]interface{}) bool
+}
+
+// AttrPath names an attribute, optionally qualified by the URI of its
+// schema and narrowed to a sub-attribute, as in
+// "urn:ietf:params:scim:schemas:core:2.0:User:name.familyName".
+type AttrPath struct {
+	URI  string
+	Attr string
+	Sub  string
+}
+
+// coreSchemas are the schemas whose attributes are at the top level of a
+// resource. Attributes of any other schema are nested under its URI.
+var coreSchemas = []string{UserSchema, GroupSchema, ServiceProviderConfigSchema}
+
+func parseAttrPath(s string) (AttrPath, error) {
+	var p AttrPath
+	rest := s
+	if i := strings.LastIndex(s, ":"); i >= 0 {
+		p.URI, rest = s[:i], s[i+1:]
+	}
+	p.Attr = rest
+	if i := strings.Index(rest, "."); i >= 0 {
+		p.Attr, p.Sub = rest[:i], rest[i+1:]
+	}
+	if !isAttrName(p.Attr) || (p.Sub != "" && !isAttrName(p.Sub)) || strings.Contains(p.Sub, ".") {
+		return AttrPath{}, fmt.Errorf("%q is not a valid attribute path", s)
+	}
+	return p, nil
+}
+
+// isAttrName reports whether s is an ATTRNAME from RFC 7644, allowing for
+// "$ref".
+func isAttrName(s string) bool {
+	if s == "$ref" {
+		return true
+	}
+	for i, r := range s {
+		switch {
+		case r < unicode.MaxASCII && unicode.IsLetter(r):
+		case i > 0 && (r == '-' || r == '_' || (r >= '0' && r <= '9')):
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (p AttrPath) String() string {
+	s := p.Attr
+	if p.Sub != "" {
+		s += "." + p.Sub
+	}
+	if p.URI != "" {
+		s = p.URI + ":" + s
+	}
+	return s
+}
+
+// container returns the map holding the attribute within the resource:
+// the resource itself, or the part of it for an extension schema.
+func (p AttrPath) container(resource map[string]interface{}, create bool) map[string]interface{} {
+	if p.URI == "" {
+		return resource
+	}
+	for _, s := range coreSchemas {
+		if strings.EqualFold(p.URI, s) {
+			return resource
+		}
+	}
+	key, v, ok := lookup(resource, p.URI)
+	if m, isMap := v.(map[string]interface{}); ok && isMap {
+		return m
+	}
+	if !create {
+		return nil
+	}
+	if !ok {
+		key = p.URI
+	}
+	m := map[string]interface{}{}
+	resource[key] = m
+	return m
+}
+
+// caseExact reports whether the attribute's values are compared case
+// sensitively. Most string attributes aren't, as in RFC 7643.
+func (p AttrPath) caseExact() bool {
+	attr := strings.ToLower(p.Attr)
+	if p.Sub == "" {
+		return attr == "id" || attr == "externalid"
+	}
+	return strings.EqualFold(p.Sub, "value") && (attr == "members" || attr == "groups")
+}
+
+// values returns the attribute's values in the resource. Multi-valued
+// attributes give all their values; for multi-valued complex attributes
+// like emails, the "value" sub-attribute stands in for each value.
+func (p AttrPath) values(resource map[string]interface{}) []interface{} {
+	c := p.container(resource, false)
+	if c == nil {
+		return nil
+	}
+	_, v, ok := lookup(c, p.Attr)
+	if !ok {
+		return nil
+	}
+	sub := p.Sub
+	arr, multi := v.([]interface{})
+	if !multi {
+		arr = []interface{}{v}
+	}
+	var out []interface{}
+	for _, e := range arr {
+		em, complex := e.(map[string]interface{})
+		switch {
+		case sub != "" && complex:
+			if _, sv, ok := lookup(em, sub); ok {
+				out = append(out, sv)
+			}
+		case sub == "" && complex && multi:
+			if _, sv, ok := lookup(em, "value"); ok {
+				out = append(out, sv)
+			}
+		case sub == "":
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+// lookup finds the attribute in m, ignoring case as attribute names do.
+func lookup(m map[string]interface{}, name string) (string, interface{}, bool) {
+	if v, ok := m[name]; ok {
+		return name, v, true
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return k, v, true
+		}
+	}
+	return "", nil, false
+}
+
+func present(v interface{}) bool {
+	switch vv := v.(type) {
+	case nil:
+		return false
+	case string:
+		return vv != ""
+	case []interface{}:
+		return len(vv) > 0
+	case map[string]interface{}:
+		return len(vv) > 0
+	}
+	return true
+}
+
+type attrExpr struct {
+	path  AttrPath
+	op    string
+	value interface{}
+}
+
+func (e *attrExpr) Matches(resource map[string]interface{}) bool {
+	vals := e.path.values(resource)
+	switch e.op {
+	case "pr":
+		for _, v := range vals {
+			if present(v) {
+				return true
+			}
+		}
+		return false
+	case "ne":
+		return !(&attrExpr{e.path, "eq", e.value}).Matches(resource)
+	}
+	if e.value == nil {
+		// Only "eq null" gets here, which matches a missing attribute
+		return !(&attrExpr{e.path, "pr", nil}).Matches(resource)
+	}
+	for _, v := range vals {
+		if compare(e.op, v, e.value, e.path.caseExact()) {
+			return true
+		}
+	}
+	return false
+}
+
+func compare(op string, actual, expected interface{}, caseExact bool) bool {
+	switch ev := expected.(type) {
+	case bool:
+		av, ok := actual.(bool)
+		return ok && op == "eq" && av == ev
+	case float64:
+		av, ok := actual.(float64)
+		if !ok {
+			return false
+		}
+		switch op {
+		case "eq":
+			return av == ev
+		case "gt":
+			return av > ev
+		case "ge":
+			return av >= ev
+		case "lt":
+			return av < ev
+		case "le":
+			return av <= ev
+		}
+		return false
+	case string:
+		av, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		if !caseExact {
+			av, ev = strings.ToLower(av), strings.ToLower(ev)
+		}
+		switch op {
+		case "eq":
+			return av == ev
+		case "co":
+			return strings.Contains(av, ev)
+		case "sw":
+			return strings.HasPrefix(av, ev)
+		case "ew":
+			return strings.HasSuffix(av, ev)
+		}
+		// Dates are ordered by time, everything else lexicographically
+		c := strings.Compare(av, ev)
+		at, aerr := time.Parse(time.RFC3339, av)
+		et, eerr := time.Parse(time.RFC3339, ev)
+		if aerr == nil && eerr == nil {
+			switch {
+			case at.Before(et):
+				c = -1
+			case at.After(et):
+				c = 1
+			default:
+				c = 0
+			}
+		}
+		switch op {
+		case "gt":
+			return c > 0
+		case "ge":
+			return c >= 0
+		case "lt":
+			return c < 0
+		case "le":
+			return c <= 0
+		}
+	}
+	return false
+}
+
+type logExpr struct {
+	and         bool
+	left, right Filter
+}
+
+func (e *logExpr) Matches(resource map[string]interface{}) bool {
+	if e.and {
+		return e.left.Matches(resource) && e.right.Matches(resource)
+	}
+	return e.left.Matches(resource) || e.right.Matches(resource)
+}
+
+type notExpr struct {
+	f Filter
+}
+
+func (e *notExpr) Matches(resource map[string]interface{}) bool {
+	return !e.f.Matches(resource)
+}
+
+// valuePathExpr matches resources where some value of a multi-valued
+// complex attribute matches the filter, as in emails[type eq "work"].
+type valuePathExpr struct {
+	path   AttrPath
+	filter Filter
+}
+
+func (e *valuePathExpr) Matches(resource map[string]interface{}) bool {
+	for _, el := range e.elements(resource) {
+		if e.filter.Matches(el) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *valuePathExpr) elements(resource map[string]interface{}) []map[string]interface{} {
+	c := e.path.container(resource, false)
+	if c == nil {
+		return nil
+	}
+	_, v, _ := lookup(c, e.path.Attr)
+	arr, _ := v.([]interface{})
+	var els []map[string]interface{}
+	for _, el := range arr {
+		if m, ok := el.(map[string]interface{}); ok {
+			els = append(els, m)
+		}
+	}
+	return els
+}
+
+var compareOps = map[string]bool{"eq": true, "ne": true, "co": true, "sw": true, "ew": true, "gt": true, "ge": true, "lt": true, "le": true}
+
+// ParseFilter parses a filter, returning an invalidFilter Error if it
+// isn't one. Attribute names, operators and "and", "or" and "not" are case
+// insensitive.
+func ParseFilter(s string) (Filter, error) {
+	toks, err := lex(s)
+	if err != nil {
+		return nil, invalidFilter(err.Error())
+	}
+	p := &parser{toks: toks}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tEOF {
+		return nil, invalidFilter(fmt.Sprintf("unexpected %q at position %d", t.text, t.pos))
+	}
+	return f, nil
+}
+
+func invalidFilter(detail string) *Error {
+	return NewError(400, ErrInvalidFilter, detail)
+}
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tWord
+	tString
+	tLParen
+	tRParen
+	tLBracket
+	tRBracket
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == '[' || c == ']':
+			kind := map[byte]tokenKind{'(': tLParen, ')': tRParen, '[': tLBracket, ']': tRBracket}[c]
+			toks = append(toks, token{kind, string(c), i})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string at position %d", i)
+			}
+			var str string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &str); err != nil {
+				return nil, fmt.Errorf("invalid string at position %d", i)
+			}
+			toks = append(toks, token{tString, str, i})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(s) && !strings.ContainsRune(" \t\n\r()[]\"", rune(s[j])); j++ {
+			}
+			toks = append(toks, token{tWord, s[i:j], i})
+			i = j
+		}
+	}
+	return append(toks, token{tEOF, "", len(s)}), nil
+}
+
+type parser struct {
+	toks []token
+	i    int
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) isKeyword(kw string) bool {
+	t := p.peek()
+	return t.kind == tWord && strings.EqualFold(t.text, kw)
+}
+
+func (p *parser) expect(kind tokenKind, what string) error {
+	if t := p.next(); t.kind != kind {
+		return invalidFilter(fmt.Sprintf("expected %s at position %d", what, t.pos))
+	}
+	return nil
+}
+
+// parseOr and parseAnd give "and" precedence over "or".
+func (p *parser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("or") {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logExpr{and: false, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd() (Filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isKeyword("and") {
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &logExpr{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseUnary() (Filter, error) {
+	negate := false
+	if p.isKeyword("not") {
+		p.next()
+		negate = true
+		if p.peek().kind != tLParen {
+			return nil, invalidFilter(fmt.Sprintf("expected ( after not at position %d", p.peek().pos))
+		}
+	}
+	var f Filter
+	var err error
+	if p.peek().kind == tLParen {
+		p.next()
+		if f, err = p.parseOr(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(tRParen, ")"); err != nil {
+			return nil, err
+		}
+	} else if f, err = p.parseAttrExpr(); err != nil {
+		return nil, err
+	}
+	if negate {
+		return &notExpr{f}, nil
+	}
+	return f, nil
+}
+
+func (p *parser) parseAttrExpr() (Filter, error) {
+	t := p.next()
+	if t.kind != tWord {
+		return nil, invalidFilter(fmt.Sprintf("expected an attribute at position %d", t.pos))
+	}
+	path, err := parseAttrPath(t.text)
+	if err != nil {
+		return nil, invalidFilter(err.Error())
+	}
+
+	if p.peek().kind == tLBracket {
+		p.next()
+		if path.Sub != "" {
+			return nil, invalidFilter(fmt.Sprintf("%q can't have a value filter", t.text))
+		}
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tRBracket, "]"); err != nil {
+			return nil, err
+		}
+		return &valuePathExpr{path: path, filter: inner}, nil
+	}
+
+	opTok := p.next()
+	op := strings.ToLower(opTok.text)
+	if opTok.kind != tWord || (op != "pr" && !compareOps[op]) {
+		return nil, invalidFilter(fmt.Sprintf("expected an operator after %s at position %d", t.text, opTok.pos))
+	}
+	if op == "pr" {
+		return &attrExpr{path: path, op: op}, nil
+	}
+
+	vt := p.next()
+	var value interface{}
+	switch {
+	case vt.kind == tString:
+		value = vt.text
+	case vt.kind == tWord && vt.text == "true":
+		value = true
+	case vt.kind == tWord && vt.text == "false":
+		value = false
+	case vt.kind == tWord && vt.text == "null":
+		value = nil
+	case vt.kind == tWord:
+		var n float64
+		if err := json.Unmarshal([]byte(vt.text), &n); err != nil {
+			return nil, invalidFilter(fmt.Sprintf("%q at position %d is not a valid value", vt.text, vt.pos))
+		}
+		value = n
+	default:
+		return nil, invalidFilter(fmt.Sprintf("expected a value at position %d", vt.pos))
+	}
+
+	switch value.(type) {
+	case bool:
+		if op != "eq" && op != "ne" {
+			return nil, invalidFilter(fmt.Sprintf("booleans can't be compared with %s", op))
+		}
+	case nil:
+		if op != "eq" && op != "ne" {
+			return nil, invalidFilter(fmt.Sprintf("null can't be compared with %s", op))
+		}
+	case float64:
+		if op == "co" || op == "sw" || op == "ew" {
+			return nil, invalidFilter(fmt.Sprintf("numbers can't be compared with %s", op))
+		}
+	}
+	return &attrExpr{path: path, op: op, value: value}, nil
+}
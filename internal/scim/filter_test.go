@@ -0,0 +1,190 @@
+package scim_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/scim"
+)
+
+// bjensen is the full user representation from RFC 7643 section 8.2,
+// trimmed of the attributes we don't support filtering on differently.
+const bjensen = `{
+  "schemas": ["urn:ietf:params:scim:schemas:core:2.0:User"],
+  "id": "2819c223-7f76-453a-919d-413861904646",
+  "externalId": "701984",
+  "userName": "bjensen@example.com",
+  "name": {
+    "formatted": "Ms. Barbara J Jensen, III",
+    "familyName": "Jensen",
+    "givenName": "Barbara"
+  },
+  "displayName": "Babs Jensen",
+  "nickName": "Babs",
+  "profileUrl": "https://login.example.com/bjensen",
+  "emails": [
+    {"value": "bjensen@example.com", "type": "work", "primary": true},
+    {"value": "babs@jensen.org", "type": "home"}
+  ],
+  "userType": "Employee",
+  "title": "Tour Guide",
+  "active": true,
+  "groups": [
+    {"value": "e9e30dba-f08f-4109-8486-d5c6a331660a", "display": "Tour Guides"}
+  ],
+  "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {
+    "employeeNumber": "701984",
+    "manager": {"value": "26118915-6090-4610-87e4-49d8ca9f808d", "displayName": "John Smith"}
+  },
+  "meta": {
+    "resourceType": "User",
+    "created": "2010-01-23T04:56:22Z",
+    "lastModified": "2011-05-13T04:42:34Z",
+    "version": "W\/\"3694e05e9dff591\"",
+    "location": "https://example.com/v2/Users/2819c223-7f76-453a-919d-413861904646"
+  }
+}`
+
+func loadBJensen(t *testing.T) map[string]interface{} {
+	var m map[string]interface{}
+	ok(t, json.Unmarshal([]byte(bjensen), &m))
+	return m
+}
+
+// TestParseFilterRFCExamples runs the example filters of RFC 7644 section
+// 3.4.2.2 against bjensen.
+func TestParseFilterRFCExamples(t *testing.T) {
+	user := loadBJensen(t)
+	cases := []struct {
+		filter string
+		match  bool
+	}{
+		{`userName eq "bjensen"`, false},
+		{`userName eq "BJENSEN@example.com"`, true},
+		{`name.familyName co "O'Malley"`, false},
+		{`name.familyName co "ens"`, true},
+		{`userName sw "J"`, false},
+		{`userName sw "b"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "J"`, false},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "bj"`, true},
+		{`title pr`, true},
+		{`nickName pr`, true},
+		{`x509Certificates pr`, false},
+		{`meta.lastModified gt "2011-05-13T04:42:34Z"`, false},
+		{`meta.lastModified ge "2011-05-13T04:42:34Z"`, true},
+		{`meta.lastModified lt "2011-05-13T04:42:34Z"`, false},
+		{`meta.lastModified le "2011-05-13T04:42:34Z"`, true},
+		{`title pr and userType eq "Employee"`, true},
+		{`title pr or userType eq "Intern"`, true},
+		{`schemas eq "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"`, false},
+		{`schemas eq "urn:ietf:params:scim:schemas:core:2.0:User"`, true},
+		{`userType eq "Employee" and (emails co "example.com" or emails.value co "example.org")`, true},
+		{`userType ne "Employee" and not (emails co "example.com" or emails.value co "example.org")`, false},
+		{`userType eq "Employee" and (emails.type eq "work")`, true},
+		{`userType eq "Employee" and emails[type eq "work" and value co "@example.com"]`, true},
+		{`emails[type eq "work" and value co "@example.com"] or ims[type eq "xmpp" and value co "@foo.com"]`, true},
+		{`emails[type eq "home" and value co "@example.com"]`, false},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:employeeNumber eq "701984"`, true},
+		{`urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:manager.displayName eq "john smith"`, true},
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`id eq "2819C223-7F76-453A-919D-413861904646"`, false},
+		{`not (userName ew ".org")`, true},
+	}
+	for _, c := range cases {
+		f, err := scim.ParseFilter(c.filter)
+		ok(t, err)
+		assert(t, f.Matches(user) == c.match, "expected %s to match: %v", c.filter, c.match)
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	bad := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName xx "bjensen"`,
+		`userName eq "bjensen`,
+		`(userName eq "bjensen"`,
+		`userName eq "bjensen" and`,
+		`not userName eq "bjensen"`,
+		`emails[type eq "work"`,
+		`active co true`,
+		`userName eq bjensen`,
+	}
+	for _, s := range bad {
+		_, err := scim.ParseFilter(s)
+		se, isSCIM := err.(*scim.Error)
+		assert(t, isSCIM, "expected %q to be refused with a SCIM error, got %v", s, err)
+		equals(t, 400, se.Status)
+		equals(t, scim.ErrInvalidFilter, se.Type)
+	}
+}
+
+func TestErrorJSON(t *testing.T) {
+	b, err := json.Marshal(scim.NewError(409, scim.ErrUniqueness, "userName is taken"))
+	ok(t, err)
+	var m map[string]interface{}
+	ok(t, json.Unmarshal(b, &m))
+	equals(t, map[string]interface{}{
+		"schemas":  []interface{}{scim.ErrorSchema},
+		"status":   "409",
+		"scimType": "uniqueness",
+		"detail":   "userName is taken",
+	}, m)
+
+	b, err = json.Marshal(scim.NotFound("no such user"))
+	ok(t, err)
+	m = nil
+	ok(t, json.Unmarshal(b, &m))
+	_, hasType := m["scimType"]
+	assert(t, !hasType, "expected no scimType when none applies")
+}
+
+func TestNewListResponse(t *testing.T) {
+	all := []interface{}{"a", "b", "c", "d", "e"}
+	lr := scim.NewListResponse(all, 2, 2)
+	equals(t, 5, lr.TotalResults)
+	equals(t, 2, lr.StartIndex)
+	equals(t, 2, lr.ItemsPerPage)
+	equals(t, []interface{}{"b", "c"}, lr.Resources)
+
+	lr = scim.NewListResponse(all, 10, 2)
+	equals(t, 0, lr.ItemsPerPage)
+	equals(t, []interface{}{}, lr.Resources)
+
+	lr = scim.NewListResponse(all, 0, 0)
+	equals(t, 1, lr.StartIndex)
+	equals(t, 0, lr.ItemsPerPage)
+}
+
+// assert fails the test if the condition is false.
+func assert(tb testing.TB, condition bool, msg string, v ...interface{}) {
+	if !condition {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: "+msg+"\033[39m\n\n", append([]interface{}{filepath.Base(file), line}, v...)...)
+		tb.FailNow()
+	}
+}
+
+// ok fails the test if an err is not nil.
+func ok(tb testing.TB, err error) {
+	if err != nil {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d: unexpected error: %s\033[39m\n\n", filepath.Base(file), line, err.Error())
+		tb.FailNow()
+	}
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -0,0 +1,355 @@
+package scim
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// PatchOp is a PATCH request, from RFC 7644 section 3.5.2.
+type PatchOp struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// PatchOperation is a single add, remove or replace. The op is case
+// insensitive, as some directories send "Replace".
+type PatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// patchPath is the target of an operation: an attribute, or the values of a
+// multi-valued attribute matching a filter, optionally narrowed to one of
+// their sub-attributes, as in emails[type eq "work"].value.
+type patchPath struct {
+	attr   AttrPath
+	filter Filter
+	sub    string
+}
+
+func parsePatchPath(s string) (*patchPath, error) {
+	invalid := func(detail string) error {
+		return NewError(400, ErrInvalidPath, fmt.Sprintf("%q is not a valid path: %s", s, detail))
+	}
+	i := strings.Index(s, "[")
+	if i < 0 {
+		attr, err := parseAttrPath(s)
+		if err != nil {
+			return nil, invalid(err.Error())
+		}
+		return &patchPath{attr: attr}, nil
+	}
+
+	j := strings.LastIndex(s, "]")
+	if j < i {
+		return nil, invalid("missing ]")
+	}
+	attr, err := parseAttrPath(s[:i])
+	if err != nil {
+		return nil, invalid(err.Error())
+	}
+	if attr.Sub != "" {
+		return nil, invalid("only attributes can have a value filter")
+	}
+	f, err := ParseFilter(s[i+1 : j])
+	if err != nil {
+		return nil, invalid(err.Error())
+	}
+	p := &patchPath{attr: attr, filter: f}
+	if rest := s[j+1:]; rest != "" {
+		if !strings.HasPrefix(rest, ".") || !isAttrName(rest[1:]) {
+			return nil, invalid("expected a sub-attribute after ]")
+		}
+		p.sub = rest[1:]
+	}
+	return p, nil
+}
+
+// Apply applies the operations to the resource, in the form returned by
+// ToMap, in order. Changing any of the readOnly top-level attributes is a
+// mutability Error. The resource may be partly changed if an operation
+// fails, so callers should discard it then.
+func (po *PatchOp) Apply(resource map[string]interface{}, readOnly ...string) error {
+	if !hasSchema(po.Schemas, PatchOpSchema) {
+		return NewError(400, ErrInvalidSyntax, "a PATCH request needs the "+PatchOpSchema+" schema")
+	}
+	if len(po.Operations) == 0 {
+		return NewError(400, ErrInvalidSyntax, "a PATCH request needs at least one operation")
+	}
+	for i, op := range po.Operations {
+		var err error
+		switch strings.ToLower(op.Op) {
+		case "add":
+			err = applySet(resource, op, false, readOnly)
+		case "replace":
+			err = applySet(resource, op, true, readOnly)
+		case "remove":
+			err = applyRemove(resource, op, readOnly)
+		default:
+			err = NewError(400, ErrInvalidSyntax, fmt.Sprintf("%q is not a PATCH operation", op.Op))
+		}
+		if err != nil {
+			if se, ok := err.(*Error); ok {
+				se.Detail = fmt.Sprintf("operation %d: %s", i+1, se.Detail)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func hasSchema(schemas []string, schema string) bool {
+	for _, s := range schemas {
+		if strings.EqualFold(s, schema) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkWritable(p AttrPath, readOnly []string) error {
+	if p.container(map[string]interface{}{}, false) == nil {
+		return nil // attributes of extensions are never read only
+	}
+	for _, ro := range readOnly {
+		if strings.EqualFold(p.Attr, ro) {
+			return NewError(400, ErrMutability, fmt.Sprintf("%s can't be changed", p.Attr))
+		}
+	}
+	return nil
+}
+
+func applySet(resource map[string]interface{}, op PatchOperation, replace bool, readOnly []string) error {
+	if op.Value == nil {
+		return NewError(400, ErrInvalidSyntax, fmt.Sprintf("%s needs a value", op.Op))
+	}
+	if op.Path == "" {
+		// The value holds the attributes to set, and extensions' attributes
+		// under their URIs
+		values, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return NewError(400, ErrInvalidValue, fmt.Sprintf("%s without a path needs an object value", op.Op))
+		}
+		for k, v := range values {
+			ext, isExt := v.(map[string]interface{})
+			if strings.Contains(k, ":") && isExt {
+				for sk, sv := range ext {
+					if err := setAttr(resource, AttrPath{URI: k, Attr: sk}, sv, replace); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			p, err := parseAttrPath(k)
+			if err != nil {
+				return NewError(400, ErrInvalidPath, err.Error())
+			}
+			if err := checkWritable(p, readOnly); err != nil {
+				return err
+			}
+			if err := setAttr(resource, p, v, replace); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	pp, err := parsePatchPath(op.Path)
+	if err != nil {
+		return err
+	}
+	if err := checkWritable(pp.attr, readOnly); err != nil {
+		return err
+	}
+	if pp.filter == nil {
+		return setAttr(resource, pp.attr, op.Value, replace)
+	}
+
+	els := (&valuePathExpr{path: pp.attr, filter: pp.filter}).elements(resource)
+	matched := false
+	for _, el := range els {
+		if !pp.filter.Matches(el) {
+			continue
+		}
+		matched = true
+		if pp.sub != "" {
+			key, _, ok := lookup(el, pp.sub)
+			if !ok {
+				key = pp.sub
+			}
+			el[key] = op.Value
+			continue
+		}
+		vm, ok := op.Value.(map[string]interface{})
+		if !ok {
+			return NewError(400, ErrInvalidValue, fmt.Sprintf("the values of %s need an object value", pp.attr.Attr))
+		}
+		merge(el, vm)
+	}
+	if !matched {
+		return NewError(400, ErrNoTarget, fmt.Sprintf("no values of %s match %q", pp.attr.Attr, op.Path))
+	}
+	return nil
+}
+
+// setAttr adds or replaces the attribute's value. Adding to a multi-valued
+// attribute appends the new values; complex attributes have the given
+// sub-attributes merged in either way.
+func setAttr(resource map[string]interface{}, p AttrPath, value interface{}, replace bool) error {
+	c := p.container(resource, true)
+	key, cur, exists := lookup(c, p.Attr)
+	if !exists {
+		key = p.Attr
+	}
+
+	if p.Sub != "" {
+		switch cv := cur.(type) {
+		case map[string]interface{}:
+			sk, _, ok := lookup(cv, p.Sub)
+			if !ok {
+				sk = p.Sub
+			}
+			cv[sk] = value
+		case nil:
+			c[key] = map[string]interface{}{p.Sub: value}
+		default:
+			return NewError(400, ErrInvalidPath, fmt.Sprintf("%s has no sub-attributes", p.Attr))
+		}
+		return nil
+	}
+
+	switch cv := cur.(type) {
+	case []interface{}:
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		if replace {
+			c[key] = values
+			return nil
+		}
+		for _, v := range values {
+			if indexOf(cv, v) < 0 {
+				cv = append(cv, v)
+			}
+		}
+		c[key] = cv
+		return nil
+	case map[string]interface{}:
+		if vm, ok := value.(map[string]interface{}); ok {
+			merge(cv, vm)
+			return nil
+		}
+	}
+	c[key] = value
+	return nil
+}
+
+func merge(dst, src map[string]interface{}) {
+	for k, v := range src {
+		dk, _, ok := lookup(dst, k)
+		if !ok {
+			dk = k
+		}
+		dst[dk] = v
+	}
+}
+
+// indexOf finds v among the values of a multi-valued attribute. Complex
+// values are the same if their "value" sub-attributes are.
+func indexOf(values []interface{}, v interface{}) int {
+	vm, vComplex := v.(map[string]interface{})
+	for i, e := range values {
+		em, eComplex := e.(map[string]interface{})
+		if vComplex && eComplex {
+			_, a, aok := lookup(em, "value")
+			_, b, bok := lookup(vm, "value")
+			if aok && bok {
+				if a == b {
+					return i
+				}
+				continue
+			}
+		}
+		if reflect.DeepEqual(e, v) {
+			return i
+		}
+	}
+	return -1
+}
+
+func applyRemove(resource map[string]interface{}, op PatchOperation, readOnly []string) error {
+	if op.Path == "" {
+		return NewError(400, ErrNoTarget, "remove needs a path")
+	}
+	pp, err := parsePatchPath(op.Path)
+	if err != nil {
+		return err
+	}
+	if err := checkWritable(pp.attr, readOnly); err != nil {
+		return err
+	}
+	c := pp.attr.container(resource, false)
+	if c == nil {
+		return nil
+	}
+	key, cur, exists := lookup(c, pp.attr.Attr)
+	if !exists {
+		return nil
+	}
+
+	if pp.filter != nil {
+		arr, _ := cur.([]interface{})
+		kept := []interface{}{}
+		for _, e := range arr {
+			em, ok := e.(map[string]interface{})
+			if !ok || !pp.filter.Matches(em) {
+				kept = append(kept, e)
+				continue
+			}
+			if pp.sub != "" {
+				if sk, _, ok := lookup(em, pp.sub); ok {
+					delete(em, sk)
+				}
+				kept = append(kept, em)
+			}
+		}
+		c[key] = kept
+		return nil
+	}
+
+	if pp.attr.Sub != "" {
+		elems, multi := cur.([]interface{})
+		if !multi {
+			elems = []interface{}{cur}
+		}
+		for _, e := range elems {
+			if em, ok := e.(map[string]interface{}); ok {
+				if sk, _, ok := lookup(em, pp.attr.Sub); ok {
+					delete(em, sk)
+				}
+			}
+		}
+		return nil
+	}
+
+	// Some directories say which values of a multi-valued attribute to
+	// remove in the value rather than with a filter
+	if arr, ok := cur.([]interface{}); ok && op.Value != nil {
+		values, ok := op.Value.([]interface{})
+		if !ok {
+			values = []interface{}{op.Value}
+		}
+		for _, v := range values {
+			if i := indexOf(arr, v); i >= 0 {
+				arr = append(arr[:i], arr[i+1:]...)
+			}
+		}
+		c[key] = arr
+		return nil
+	}
+	delete(c, key)
+	return nil
+}
@@ -0,0 +1,154 @@
+package scim_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/scim"
+)
+
+const patchGroup = `{
+  "schemas": ["urn:ietf:params:scim:schemas:core:2.0:Group"],
+  "id": "acbf3ae7-8463-4692-b4fd-9b4da3f908ce",
+  "displayName": "Tour Guides",
+  "members": [
+    {"value": "2819c223-7f76-453a-919d-413861904646", "display": "Babs Jensen"},
+    {"value": "902c246b-6245-4190-8e05-00816be7344a", "display": "Mandy Pepperidge"}
+  ]
+}`
+
+func applyPatch(t *testing.T, resource, patch string, readOnly ...string) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	ok(t, json.Unmarshal([]byte(resource), &m))
+	var po scim.PatchOp
+	ok(t, json.Unmarshal([]byte(patch), &po))
+	return m, po.Apply(m, readOnly...)
+}
+
+func memberIDs(m map[string]interface{}) []string {
+	ids := []string{}
+	members, _ := m["members"].([]interface{})
+	for _, mem := range members {
+		ids = append(ids, mem.(map[string]interface{})["value"].(string))
+	}
+	return ids
+}
+
+// TestPatchRFCExamples applies the examples of RFC 7644 section 3.5.2.
+func TestPatchRFCExamples(t *testing.T) {
+	g, err := applyPatch(t, patchGroup, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{
+	    "op": "add",
+	    "path": "members",
+	    "value": [
+	      {"display": "Babs Jensen", "value": "2819c223-7f76-453a-919d-413861904646"},
+	      {"display": "James Smith", "value": "08e1d05d-121c-4561-8b96-473d93df9210"}
+	    ]
+	  }]
+	}`)
+	ok(t, err)
+	equals(t, []string{"2819c223-7f76-453a-919d-413861904646", "902c246b-6245-4190-8e05-00816be7344a", "08e1d05d-121c-4561-8b96-473d93df9210"}, memberIDs(g))
+
+	g, err = applyPatch(t, patchGroup, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "remove", "path": "members[value eq \"2819c223-7f76-453a-919d-413861904646\"]"}]
+	}`)
+	ok(t, err)
+	equals(t, []string{"902c246b-6245-4190-8e05-00816be7344a"}, memberIDs(g))
+
+	g, err = applyPatch(t, patchGroup, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "remove", "path": "members"}]
+	}`)
+	ok(t, err)
+	_, hasMembers := g["members"]
+	assert(t, !hasMembers, "expected removing members to remove them all")
+
+	g, err = applyPatch(t, patchGroup, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [
+	    {"op": "remove", "path": "members"},
+	    {"op": "add", "path": "members", "value": [{"display": "James Smith", "value": "08e1d05d-121c-4561-8b96-473d93df9210"}]}
+	  ]
+	}`)
+	ok(t, err)
+	equals(t, []string{"08e1d05d-121c-4561-8b96-473d93df9210"}, memberIDs(g))
+
+	g, err = applyPatch(t, patchGroup, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "replace", "path": "members", "value": [{"display": "James Smith", "value": "08e1d05d-121c-4561-8b96-473d93df9210"}]}]
+	}`)
+	ok(t, err)
+	equals(t, []string{"08e1d05d-121c-4561-8b96-473d93df9210"}, memberIDs(g))
+
+	u, err := applyPatch(t, bjensen, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "replace", "path": "emails[type eq \"work\"].value", "value": "bjensen@example.org"}]
+	}`)
+	ok(t, err)
+	emails := u["emails"].([]interface{})
+	equals(t, "bjensen@example.org", emails[0].(map[string]interface{})["value"])
+	equals(t, "babs@jensen.org", emails[1].(map[string]interface{})["value"])
+
+	u, err = applyPatch(t, bjensen, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "replace", "value": {"userName": "babs", "name": {"givenName": "Babs"}, "active": false}}]
+	}`)
+	ok(t, err)
+	equals(t, "babs", u["userName"])
+	equals(t, false, u["active"])
+	name := u["name"].(map[string]interface{})
+	equals(t, "Babs", name["givenName"])
+	equals(t, "Jensen", name["familyName"])
+
+	u, err = applyPatch(t, bjensen, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "add", "value": {"nickName": "Barbie", "emails": [{"value": "babs@example.net", "type": "other"}]}}]
+	}`)
+	ok(t, err)
+	equals(t, "Barbie", u["nickName"])
+	equals(t, 3, len(u["emails"].([]interface{})))
+}
+
+func TestPatchDirectoryQuirks(t *testing.T) {
+	// Ops in any case, and members removed by value rather than filter
+	g, err := applyPatch(t, patchGroup, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "Remove", "path": "members", "value": [{"value": "902c246b-6245-4190-8e05-00816be7344a"}]}]
+	}`)
+	ok(t, err)
+	equals(t, []string{"2819c223-7f76-453a-919d-413861904646"}, memberIDs(g))
+
+	u, err := applyPatch(t, bjensen, `{
+	  "schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+	  "Operations": [{"op": "Replace", "value": {"name.familyName": "Jensen-Smith", "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User": {"employeeNumber": "42"}}}]
+	}`)
+	ok(t, err)
+	equals(t, "Jensen-Smith", u["name"].(map[string]interface{})["familyName"])
+	equals(t, "42", u["urn:ietf:params:scim:schemas:extension:enterprise:2.0:User"].(map[string]interface{})["employeeNumber"])
+}
+
+func TestPatchErrors(t *testing.T) {
+	cases := []struct {
+		patch    string
+		scimType string
+	}{
+		{`{"Operations": [{"op": "remove", "path": "title"}]}`, scim.ErrInvalidSyntax},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": []}`, scim.ErrInvalidSyntax},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "move", "path": "title"}]}`, scim.ErrInvalidSyntax},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "add", "path": "title"}]}`, scim.ErrInvalidSyntax},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "remove"}]}`, scim.ErrNoTarget},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "emails[type eq \"pager\"].value", "value": "x"}]}`, scim.ErrNoTarget},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "emails[type eq ", "value": "x"}]}`, scim.ErrInvalidPath},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "path": "id", "value": "x"}]}`, scim.ErrMutability},
+		{`{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"], "Operations": [{"op": "replace", "value": {"ID": "x"}}]}`, scim.ErrMutability},
+	}
+	for _, c := range cases {
+		_, err := applyPatch(t, bjensen, c.patch, "id", "meta")
+		se, isSCIM := err.(*scim.Error)
+		assert(t, isSCIM, "expected %s to fail with a SCIM error, got %v", c.patch, err)
+		equals(t, 400, se.Status)
+		equals(t, c.scimType, se.Type)
+	}
+}
@@ -0,0 +1,184 @@
+// Package scim implements the parts of SCIM 2.0 (RFC 7643 and RFC 7644)
+// needed for a directory to provision users and groups: the resources, list
+// responses, errors, filters and PATCH operations. It knows nothing about
+// how the resources are stored.
+package scim
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// MediaType is the content type of SCIM requests and responses.
+const MediaType = "application/scim+json"
+
+// The schema URNs used in the "schemas" of requests and responses.
+const (
+	UserSchema                  = "urn:ietf:params:scim:schemas:core:2.0:User"
+	GroupSchema                 = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	ServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ListResponseSchema          = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	PatchOpSchema               = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+	ErrorSchema                 = "urn:ietf:params:scim:api:messages:2.0:Error"
+	// GroupRoleSchema is our extension to groups, giving their members a
+	// role in the org.
+	GroupRoleSchema = "urn:ietf:params:scim:schemas:extension:auth_demo:2.0:Group"
+)
+
+// MaxResults is the most resources returned by a single list request.
+const MaxResults = 100
+
+// Meta is the metadata common to every resource.
+type Meta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location,omitempty"`
+}
+
+// Name is the components of a user's name.
+type Name struct {
+	Formatted  string `json:"formatted,omitempty"`
+	FamilyName string `json:"familyName,omitempty"`
+	GivenName  string `json:"givenName,omitempty"`
+}
+
+// MultiValue is a value of a multi-valued attribute like emails or members.
+type MultiValue struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Ref     string `json:"$ref,omitempty"`
+}
+
+// User is a User resource, with the attributes we support.
+type User struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id,omitempty"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	UserName    string       `json:"userName"`
+	Name        *Name        `json:"name,omitempty"`
+	DisplayName string       `json:"displayName,omitempty"`
+	Emails      []MultiValue `json:"emails,omitempty"`
+	// Active is a pointer so a missing value can be told apart from false.
+	Active *bool `json:"active,omitempty"`
+	// Password is write only, and never returned.
+	Password string       `json:"password,omitempty"`
+	Groups   []MultiValue `json:"groups,omitempty"`
+	Meta     *Meta        `json:"meta,omitempty"`
+}
+
+// PrimaryEmail returns the user's primary email address, or failing that
+// their first one.
+func (u *User) PrimaryEmail() string {
+	for _, e := range u.Emails {
+		if e.Primary {
+			return e.Value
+		}
+	}
+	if len(u.Emails) > 0 {
+		return u.Emails[0].Value
+	}
+	return ""
+}
+
+// IsActive reports whether the user should be active. Users are active
+// unless they're explicitly made inactive.
+func (u *User) IsActive() bool {
+	return u.Active == nil || *u.Active
+}
+
+// FormattedName returns the user's name as a single string.
+func (u *User) FormattedName() string {
+	if u.Name != nil {
+		if u.Name.Formatted != "" {
+			return u.Name.Formatted
+		}
+		if full := strings.TrimSpace(u.Name.GivenName + " " + u.Name.FamilyName); full != "" {
+			return full
+		}
+	}
+	return u.DisplayName
+}
+
+// Group is a Group resource.
+type Group struct {
+	Schemas     []string            `json:"schemas"`
+	ID          string              `json:"id,omitempty"`
+	ExternalID  string              `json:"externalId,omitempty"`
+	DisplayName string              `json:"displayName"`
+	Members     []MultiValue        `json:"members"`
+	Role        *GroupRoleExtension `json:"urn:ietf:params:scim:schemas:extension:auth_demo:2.0:Group,omitempty"`
+	Meta        *Meta               `json:"meta,omitempty"`
+}
+
+// GroupRoleExtension holds the org role a group gives its members.
+type GroupRoleExtension struct {
+	Role string `json:"role,omitempty"`
+}
+
+// ListResponse is the response to a query.
+type ListResponse struct {
+	Schemas      []string      `json:"schemas"`
+	TotalResults int           `json:"totalResults"`
+	StartIndex   int           `json:"startIndex"`
+	ItemsPerPage int           `json:"itemsPerPage"`
+	Resources    []interface{} `json:"Resources"`
+}
+
+// NewListResponse returns the page of resources starting at the 1-based
+// startIndex, with at most count resources, as in RFC 7644 section 3.4.2.4.
+func NewListResponse(resources []interface{}, startIndex, count int) *ListResponse {
+	if startIndex < 1 {
+		startIndex = 1
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > MaxResults {
+		count = MaxResults
+	}
+	page := []interface{}{}
+	if start := startIndex - 1; start < len(resources) {
+		end := start + count
+		if end > len(resources) {
+			end = len(resources)
+		}
+		page = resources[start:end]
+	}
+	return &ListResponse{
+		Schemas:      []string{ListResponseSchema},
+		TotalResults: len(resources),
+		StartIndex:   startIndex,
+		ItemsPerPage: len(page),
+		Resources:    page,
+	}
+}
+
+// ToMap turns a resource into the generic form filters and patches work on.
+func ToMap(resource interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(resource)
+	if err != nil {
+		return nil, err
+	}
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// FromMap turns the generic form of a resource back into a resource. Values
+// of the wrong type are reported as an invalidValue Error.
+func FromMap(m map[string]interface{}, resource interface{}) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, resource); err != nil {
+		return NewError(400, ErrInvalidValue, err.Error())
+	}
+	return nil
+}
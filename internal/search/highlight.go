@@ -0,0 +1,83 @@
+package search
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// Ellipsis marks where a snippet was cut out of longer text.
+const Ellipsis = "…"
+
+// Snippet returns up to about maxLen bytes of the text around the first
+// word that matches the query, with every matching word in it wrapped in
+// <mark> tags. The rest of the text is HTML-escaped, so the snippet can be
+// shown as HTML. It returns "" if no word in the text matches.
+func Snippet(text string, q Query, maxLen int) string {
+	tokens := Tokenize(text)
+	var matches []Token
+	for _, tok := range tokens {
+		if q.Matches(tok) {
+			matches = append(matches, tok)
+		}
+	}
+	if len(matches) == 0 {
+		return ""
+	}
+
+	// Show a little of what comes before the first match, starting on a
+	// word
+	first := matches[0]
+	start := first.Start - maxLen/4
+	if start <= 0 {
+		start = 0
+	} else {
+		start = runeStart(text, start)
+		if i := strings.IndexAny(text[start:first.Start], " \t\n"); i >= 0 {
+			start += i + 1
+		} else {
+			start = first.Start
+		}
+	}
+	end := start + maxLen
+	if end < first.End {
+		end = first.End
+	}
+	if end >= len(text) {
+		end = len(text)
+	} else {
+		end = runeStart(text, end)
+		if i := strings.LastIndexAny(text[first.End:end], " \t\n"); i >= 0 {
+			end = first.End + i
+		}
+	}
+
+	var sb strings.Builder
+	if start > 0 {
+		sb.WriteString(Ellipsis)
+	}
+	at := start
+	for _, tok := range matches {
+		if tok.Start < start || tok.End > end {
+			continue
+		}
+		sb.WriteString(html.EscapeString(text[at:tok.Start]))
+		sb.WriteString("<mark>")
+		sb.WriteString(html.EscapeString(text[tok.Start:tok.End]))
+		sb.WriteString("</mark>")
+		at = tok.End
+	}
+	sb.WriteString(html.EscapeString(text[at:end]))
+	if end < len(text) {
+		sb.WriteString(Ellipsis)
+	}
+	return strings.TrimSpace(sb.String())
+}
+
+// runeStart moves i back to the start of the character it's in.
+func runeStart(text string, i int) int {
+	for i > 0 && !utf8.RuneStart(text[i]) {
+		i--
+	}
+	return i
+}
@@ -0,0 +1,148 @@
+// Package search turns text into the terms of a full-text index, and
+// queries into the terms to look up in it.
+//
+// Text is split into words on anything that isn't a letter or a digit,
+// lower-cased, and English words are stemmed, so a query for "meetings"
+// finds "meeting" and "meet". Common words like "the" aren't indexed.
+package search
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// MaxTermLength is the longest term, in bytes, that's indexed. Longer
+// words are cut short.
+const MaxTermLength = 64
+
+// minPrefixLength is how long a query word has to be, in bytes, to match
+// the start of longer words.
+const minPrefixLength = 2
+
+// stopWords are too common to be worth indexing or looking up.
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true, "but": true,
+	"by": true, "for": true, "if": true, "in": true, "into": true, "is": true, "it": true, "no": true,
+	"not": true, "of": true, "on": true, "or": true, "so": true, "such": true, "that": true, "the": true,
+	"their": true, "then": true, "there": true, "these": true, "they": true, "this": true, "to": true,
+	"was": true, "will": true, "with": true,
+}
+
+// Token is a word in some text.
+type Token struct {
+	// Word is the word lower-cased, as it's matched against query prefixes.
+	Word string
+	// Term is the stemmed word, as it's indexed.
+	Term string
+	// Start and End are the byte offsets of the word in the text.
+	Start, End int
+}
+
+// Tokenize splits the text into words, leaving out stop words.
+func Tokenize(text string) []Token {
+	var tokens []Token
+	start := -1
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		if start >= 0 {
+			tokens = appendToken(tokens, text, start, i)
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = appendToken(tokens, text, start, len(text))
+	}
+	return tokens
+}
+
+func appendToken(tokens []Token, text string, start, end int) []Token {
+	word := truncate(strings.ToLower(text[start:end]))
+	if stopWords[word] {
+		return tokens
+	}
+	return append(tokens, Token{Word: word, Term: Stem(word), Start: start, End: end})
+}
+
+// truncate cuts the word down to MaxTermLength bytes, without splitting a
+// character.
+func truncate(word string) string {
+	if len(word) <= MaxTermLength {
+		return word
+	}
+	n := MaxTermLength
+	for n > 0 && !utf8.RuneStart(word[n]) {
+		n--
+	}
+	return word[:n]
+}
+
+// Terms counts how many times each term is in the text.
+func Terms(text string) map[string]int {
+	terms := map[string]int{}
+	for _, tok := range Tokenize(text) {
+		terms[tok.Term]++
+	}
+	return terms
+}
+
+// QueryTerm is a word of a query.
+type QueryTerm struct {
+	// Term is the stemmed word, matched exactly against indexed terms.
+	Term string
+	// Prefix is the word as it was typed, lower-cased, matched against the
+	// start of indexed terms. It's empty if the word is too short to be a
+	// prefix.
+	Prefix string
+}
+
+// Query is what's being searched for. Every one of its terms has to match.
+type Query []QueryTerm
+
+// ParseQuery splits the query into its terms, leaving out stop words
+// and repeated words.
+func ParseQuery(q string) Query {
+	var query Query
+	seen := map[string]bool{}
+	for _, tok := range Tokenize(q) {
+		if seen[tok.Word] {
+			continue
+		}
+		seen[tok.Word] = true
+		qt := QueryTerm{Term: tok.Term}
+		if len(tok.Word) >= minPrefixLength {
+			qt.Prefix = tok.Word
+		}
+		query = append(query, qt)
+	}
+	return query
+}
+
+// Match reports how well an indexed term matches the query term: 1 if it
+// is the same term, a half if it starts with the prefix, and 0 if it
+// doesn't match.
+func (qt QueryTerm) Match(term string) float64 {
+	switch {
+	case term == qt.Term:
+		return 1
+	case qt.Prefix != "" && strings.HasPrefix(term, qt.Prefix):
+		return 0.5
+	}
+	return 0
+}
+
+// Matches reports whether the token matches any of the query's terms,
+// either by its stem or by the word as written.
+func (q Query) Matches(tok Token) bool {
+	for _, qt := range q {
+		if qt.Match(tok.Term) > 0 || (qt.Prefix != "" && strings.HasPrefix(tok.Word, qt.Prefix)) {
+			return true
+		}
+	}
+	return false
+}
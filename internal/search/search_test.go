@@ -0,0 +1,90 @@
+package search_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/search"
+)
+
+func TestStem(t *testing.T) {
+	tests := []struct {
+		word, exp string
+	}{
+		{"caresses", "caress"},
+		{"ponies", "poni"},
+		{"cats", "cat"},
+		{"feed", "feed"},
+		{"agreed", "agre"},
+		{"plastered", "plaster"},
+		{"motoring", "motor"},
+		{"sing", "sing"},
+		{"conflated", "conflat"},
+		{"hopping", "hop"},
+		{"falling", "fall"},
+		{"filing", "file"},
+		{"happy", "happi"},
+		{"relational", "relat"},
+		{"conditional", "condit"},
+		{"digitizer", "digit"},
+		{"hopefulness", "hope"},
+		{"electrical", "electr"},
+		{"adjustment", "adjust"},
+		{"adoption", "adopt"},
+		{"controlling", "control"},
+		{"generalizations", "gener"},
+		{"meetings", "meet"},
+		{"connection", "connect"},
+		{"connecting", "connect"},
+		{"is", "is"},
+		{"café", "café"},
+		{"2024", "2024"},
+	}
+	for _, tt := range tests {
+		equals(t, tt.exp, search.Stem(tt.word))
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	toks := search.Tokenize("Call the Plumbers re: leak—ASAP! Größe 42")
+	var words, terms []string
+	for _, tok := range toks {
+		words = append(words, tok.Word)
+		terms = append(terms, tok.Term)
+	}
+	equals(t, []string{"call", "plumbers", "re", "leak", "asap", "größe", "42"}, words)
+	equals(t, []string{"call", "plumber", "re", "leak", "asap", "größe", "42"}, terms)
+	equals(t, "Plumbers", "Call the Plumbers"[toks[1].Start:toks[1].End])
+	equals(t, map[string]int{"meet": 2, "agenda": 1}, search.Terms("The meeting; the meetings' agenda"))
+}
+
+func TestQuery(t *testing.T) {
+	q := search.ParseQuery("the Meetings plan meetings x")
+	equals(t, search.Query{{Term: "meet", Prefix: "meetings"}, {Term: "plan", Prefix: "plan"}, {Term: "x"}}, q)
+	equals(t, 1.0, q[1].Match("plan"))
+	equals(t, 0.5, q[1].Match("planet"))
+	equals(t, 0.0, q[1].Match("plain"))
+	equals(t, 0.0, q[2].Match("xylophon"))
+	equals(t, search.Query(nil), search.ParseQuery("the and of"))
+}
+
+func TestSnippet(t *testing.T) {
+	q := search.ParseQuery("plan")
+	equals(t, "<mark>Plan</mark> the <mark>planning</mark> &lt;meeting&gt;", search.Snippet("Plan the planning <meeting>", q, 100))
+	equals(t, "", search.Snippet("nothing here", q, 100))
+
+	text := "one two three four five six seven eight nine ten plan eleven twelve thirteen fourteen fifteen"
+	equals(t, "…ten <mark>plan</mark> eleven twelve…", search.Snippet(text, q, 30))
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
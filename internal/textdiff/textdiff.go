@@ -0,0 +1,126 @@
+// Package textdiff compares two texts line by line.
+package textdiff
+
+import "strings"
+
+// The ways a line can differ between two texts.
+const (
+	Equal  = "equal"
+	Delete = "delete"
+	Insert = "insert"
+)
+
+// maxCells caps the table used to find the longest common subsequence, so
+// comparing two long texts doesn't use too much memory. Texts past it are
+// shown as entirely replaced.
+const maxCells = 4 << 20
+
+// Line is a line of the diff: one that's in both texts, or that's only in
+// the first, deleted, or only in the second, inserted.
+type Line struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// Lines returns the lines that turn a into b, keeping as many of a's lines
+// as it can. Lines deleted from a come before the ones inserted in their
+// place.
+func Lines(a, b string) []Line {
+	al, bl := split(a), split(b)
+
+	// Lines the texts start and end with don't need comparing
+	pre := 0
+	for pre < len(al) && pre < len(bl) && al[pre] == bl[pre] {
+		pre++
+	}
+	suf := 0
+	for suf < len(al)-pre && suf < len(bl)-pre && al[len(al)-1-suf] == bl[len(bl)-1-suf] {
+		suf++
+	}
+
+	var lines []Line
+	for _, l := range al[:pre] {
+		lines = append(lines, Line{Equal, l})
+	}
+	lines = append(lines, middle(al[pre:len(al)-suf], bl[pre:len(bl)-suf])...)
+	for _, l := range al[len(al)-suf:] {
+		lines = append(lines, Line{Equal, l})
+	}
+	return lines
+}
+
+// middle diffs a and b with a longest common subsequence table.
+func middle(a, b []string) []Line {
+	var lines []Line
+	if len(a)*len(b) > maxCells {
+		for _, l := range a {
+			lines = append(lines, Line{Delete, l})
+		}
+		for _, l := range b {
+			lines = append(lines, Line{Insert, l})
+		}
+		return lines
+	}
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, Line{Equal, a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, Line{Delete, a[i]})
+			i++
+		default:
+			lines = append(lines, Line{Insert, b[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// Unified formats the diff like diff -u, without the headers or hunk
+// ranges: each line starts with " ", "-" or "+".
+func Unified(lines []Line) string {
+	var b strings.Builder
+	for _, l := range lines {
+		switch l.Op {
+		case Delete:
+			b.WriteByte('-')
+		case Insert:
+			b.WriteByte('+')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(l.Text)
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+func split(s string) []string {
+	if s == "" {
+		return nil
+	}
+	s = strings.Replace(s, "\r\n", "\n", -1)
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
@@ -0,0 +1,50 @@
+package textdiff_test
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/ejamesc/auth_demo/internal/textdiff"
+)
+
+func TestLines(t *testing.T) {
+	tests := []struct {
+		a, b, exp string
+	}{
+		{"", "", ""},
+		{"a\nb\n", "a\nb", " a\n b\n"},
+		{"", "a\nb", "+a\n+b\n"},
+		{"a\nb\nc", "a\nc", " a\n-b\n c\n"},
+		{"a\nb\nc", "a\nx\nc\nd", " a\n-b\n+x\n c\n+d\n"},
+		{"milk\neggs\nbread\njam", "eggs\nmilk\nbread", "-milk\n eggs\n+milk\n bread\n-jam\n"},
+	}
+	for _, tt := range tests {
+		equals(t, tt.exp, textdiff.Unified(textdiff.Lines(tt.a, tt.b)))
+	}
+}
+
+// Applying a diff's kept and inserted lines gives the second text back.
+func TestLinesRoundTrip(t *testing.T) {
+	a := "the\nquick\nbrown\nfox\njumps\nover\nthe\nlazy\ndog"
+	b := "a\nquick\nred\nfox\nleaps\nover\nthe\ndog\ntoday"
+	var kept []string
+	for _, l := range textdiff.Lines(a, b) {
+		if l.Op != textdiff.Delete {
+			kept = append(kept, l.Text)
+		}
+	}
+	equals(t, b, strings.Join(kept, "\n"))
+}
+
+// equals fails the test if exp is not equal to act.
+func equals(tb testing.TB, exp, act interface{}) {
+	if !reflect.DeepEqual(exp, act) {
+		_, file, line, _ := runtime.Caller(1)
+		fmt.Printf("\033[31m%s:%d:\n\n\texp: %#v\n\n\tgot: %#v\033[39m\n\n", filepath.Base(file), line, exp, act)
+		tb.FailNow()
+	}
+}
@@ -18,7 +18,9 @@ const Root = {
 
     return m("main.w-100", 
       [
+        state.impersonating ? m(ImpersonationBanner, { state }) : null,
         m(".fl.w-100.w-20-ns", [
+          m(OrgSwitcher, { state, actions }),
           m(m.route.Link, {href: router.toPath([Route.Home()]), class: "pl3"}, "Home"),
           m(m.route.Link, {href: router.toPath([Route.Card()]), class: "pl3"}, "Card")
         ]),
@@ -27,3 +29,28 @@ const Root = {
   }
 };
 
+// Picks whose todos to show: the user's own, or one of their orgs'
+const OrgSwitcher = {
+  view: ({attrs: {state, actions}}) =>
+    m(".pa3", m("select.f6.w-100.pa1.ba.b--black-20.bg-white", {
+      value: state.currentOrg || "",
+      onchange: e => actions.switchOrg(e.target.value || null)
+    }, [
+      m("option", {value: ""}, "Personal"),
+      state.orgs.map(org =>
+        m("option", {value: org.attributes.slug}, org.attributes.name))
+    ]))
+};
+
+// Shown while an admin is logged in as this user
+const ImpersonationBanner = {
+  view: ({attrs: {state}}) =>
+    m(".w-100.bg-gold.black-80.pa2.tc.f6", [
+      "You are signed in as ", m("b", state.impersonating), ".",
+      m("form.dib.ml2", {action: "/impersonate/stop", method: "post"}, [
+        m("input", {type: "hidden", name: "gorilla.csrf.Token", value: state.csrfToken}),
+        m("input.b.ph2.pv1.input-reset.ba.b--black-80.bg-transparent.pointer.f6",
+          {type: "submit", value: "Stop impersonating"})
+      ])
+    ])
+};
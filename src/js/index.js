@@ -27,13 +27,27 @@ const app = {
   patch: navTo([Route.Home()]),
   initial: Object.assign({
     "todos": [],
+    "orgs": [],
+    "currentOrg": null,
   }),
   Actions: function(update) {
     const navigateTo = route => update(navTo(route));
-    const getTodo = () => {
+    // Todos belong to the current org if one is picked, and to the user otherwise
+    const todosURL = org => org ? `/api/v1/orgs/${encodeURIComponent(org)}/todos` : "/api/v1/todos";
+    const loadOrgs = () => {
       req({
         method: "GET",
-        url: "/api/v1/todos",
+        url: "/api/v1/orgs",
+      }).then((res) => {
+        update({orgs: res.data});
+      }).catch((e) => {
+        console.log(JSON.stringify(e));
+      });
+    };
+    const getTodo = (org) => {
+      req({
+        method: "GET",
+        url: todosURL(org),
       }).then((res) => {
         console.log(res);
         update({todos: res.data});
@@ -44,7 +58,7 @@ const app = {
     const postTodo = (state) => {
       req({
         method: "POST",
-        url: "/api/v1/todos",
+        url: todosURL(state.currentOrg),
         csrf: state.csrfToken,
         body: {
           "data": {
@@ -64,11 +78,17 @@ const app = {
         console.log(JSON.stringify(e));
       });
     };
+    const switchOrg = (org) => {
+      update({currentOrg: org, todos: []});
+      getTodo(org);
+    };
         
     return {
       navigateTo,
+      loadOrgs,
       getTodo,
-      postTodo
+      postTodo,
+      switchOrg
     };
   },
   services: [routeService, todoLoadService]
@@ -80,7 +100,13 @@ const { update, states, actions } =
 window.addEventListener("DOMContentLoaded", main);
 
 function main() {
-  update({"csrfToken": document.getElementsByTagName("meta")["csrf.Token"].getAttribute("content")});
+  const meta = document.getElementsByTagName("meta");
+  update({
+    "csrfToken": meta["csrf.Token"].getAttribute("content"),
+    "impersonating": meta["impersonating"] ? meta["impersonating"].getAttribute("content") : null,
+    "currentOrg": new URLSearchParams(window.location.search).get("org"),
+  });
+  actions.loadOrgs();
   m.route.prefix = "";
   m.route(
     root, 
@@ -12,7 +12,7 @@ export const todoLoadService = ({ state }) => {
   if (state.routeTransition.arrive.Card) {
     return {
       next: ({ state, patch, update, actions }) => {
-        actions.getTodo();
+        actions.getTodo(state.currentOrg);
       }
     };
   }